@@ -0,0 +1,271 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/vbatts/go-mtree"
+)
+
+// capabilityXattr is cleared by the kernel whenever the owner of a file is
+// changed, so it has to be restored by ChownBundle.
+const capabilityXattr = "security.capability"
+
+// shiftID applies shift to the given host id, returning an error if the result
+// is not a valid id.
+func shiftID(id, shift int64) (int64, error) {
+	newID := id + shift
+	if newID < 0 || newID >= math.MaxUint32 {
+		return -1, fmt.Errorf("id %d shifted by %d is out of range", id, shift)
+	}
+	return newID, nil
+}
+
+// shiftMappings returns the given id mappings with all of the host ids
+// shifted by shift. A nil set of mappings (the identity mapping) is converted
+// into an explicit mapping which covers every id which can still be mapped.
+func shiftMappings(mappings []rspec.LinuxIDMapping, shift int64) ([]rspec.LinuxIDMapping, error) {
+	if shift == 0 {
+		return mappings, nil
+	}
+	if mappings == nil {
+		if shift > 0 {
+			return []rspec.LinuxIDMapping{{ContainerID: 0, HostID: uint32(shift), Size: uint32(math.MaxUint32 - shift)}}, nil
+		}
+		return []rspec.LinuxIDMapping{{ContainerID: uint32(-shift), HostID: 0, Size: uint32(math.MaxUint32 + shift)}}, nil
+	}
+	newMappings := make([]rspec.LinuxIDMapping, len(mappings))
+	for idx, mapping := range mappings {
+		hostID := int64(mapping.HostID) + shift
+		if hostID < 0 || hostID+int64(mapping.Size) > math.MaxUint32 {
+			return nil, fmt.Errorf("mapping %d:%d:%d shifted by %d is out of range", mapping.ContainerID, mapping.HostID, mapping.Size, shift)
+		}
+		mapping.HostID = uint32(hostID)
+		newMappings[idx] = mapping
+	}
+	return newMappings, nil
+}
+
+// shiftMtree rewrites the uid and gid keywords of every entry in the mtree
+// manifest at mtreePath, so that the shifted rootfs still matches it.
+func shiftMtree(mtreePath string, uidShift, gidShift int64) error {
+	fh, err := os.Open(mtreePath)
+	if err != nil {
+		return fmt.Errorf("open mtree: %w", err)
+	}
+	spec, err := mtree.ParseSpec(fh)
+	fh.Close()
+	if err != nil {
+		return fmt.Errorf("parse mtree: %w", err)
+	}
+
+	for idx := range spec.Entries {
+		entry := &spec.Entries[idx]
+		for kvIdx, kv := range entry.Keywords {
+			var shift int64
+			switch kv.Keyword() {
+			case "uid":
+				shift = uidShift
+			case "gid":
+				shift = gidShift
+			default:
+				continue
+			}
+			id, err := strconv.ParseInt(kv.Value(), 10, 64)
+			if err != nil {
+				return fmt.Errorf("parse mtree %s: %w", kv, err)
+			}
+			newID, err := shiftID(id, shift)
+			if err != nil {
+				return err
+			}
+			entry.Keywords[kvIdx] = kv.NewValue(strconv.FormatInt(newID, 10))
+		}
+	}
+
+	fh, err = os.Create(mtreePath)
+	if err != nil {
+		return fmt.Errorf("rewrite mtree: %w", err)
+	}
+	defer fh.Close()
+	if _, err := spec.WriteTo(fh); err != nil {
+		return fmt.Errorf("rewrite mtree: %w", err)
+	}
+	return nil
+}
+
+// shiftRuntimeConfig updates the id mappings in the bundle's config.json (if
+// it has any) to match the shifted mappings.
+func shiftRuntimeConfig(configPath string, mapOptions layer.MapOptions) error {
+	data, err := ioutil.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read config.json: %w", err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("parse config.json: %w", err)
+	}
+	if spec.Linux == nil || (len(spec.Linux.UIDMappings) == 0 && len(spec.Linux.GIDMappings) == 0) {
+		return nil
+	}
+	spec.Linux.UIDMappings = mapOptions.UIDMappings
+	spec.Linux.GIDMappings = mapOptions.GIDMappings
+
+	fh, err := os.Create(configPath)
+	if err != nil {
+		return fmt.Errorf("rewrite config.json: %w", err)
+	}
+	defer fh.Close()
+	enc := json.NewEncoder(fh)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(spec); err != nil {
+		return fmt.Errorf("rewrite config.json: %w", err)
+	}
+	return nil
+}
+
+// chownEntry is an inode in the rootfs whose owner will be changed by
+// ChownBundle.
+type chownEntry struct {
+	path     string
+	mode     os.FileMode
+	uid, gid int64
+}
+
+// ChownBundle shifts the ownership of every inode in the rootfs of the given
+// bundle by uidShift and gidShift, without needing to re-extract the image.
+// This is useful when moving a bundle into a different user namespace. The
+// id mappings in the bundle's metadata (and config.json) are shifted to
+// match, as is the mtree manifest, so that a later umoci.Repack will only
+// include changes made to the rootfs (not the shift itself). All of the new
+// ids are checked before any changes are made.
+//
+// Rootless bundles are not supported, because their ownership is not stored
+// in the inode owner.
+func ChownBundle(bundlePath string, uidShift, gidShift int64) error {
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return fmt.Errorf("read umoci.json metadata: %w", err)
+	}
+	if meta.MapOptions.Rootless {
+		return errors.New("chown bundle: rootless bundles cannot be shifted")
+	}
+	if uidShift == 0 && gidShift == 0 {
+		return nil
+	}
+
+	newMapOptions := meta.MapOptions
+	if newMapOptions.UIDMappings, err = shiftMappings(meta.MapOptions.UIDMappings, uidShift); err != nil {
+		return fmt.Errorf("shift uid mappings: %w", err)
+	}
+	if newMapOptions.GIDMappings, err = shiftMappings(meta.MapOptions.GIDMappings, gidShift); err != nil {
+		return fmt.Errorf("shift gid mappings: %w", err)
+	}
+
+	// Collect all of the inodes (hardlinks must only be shifted once) and
+	// make sure they can all be shifted before changing anything.
+	fsEval := fseval.Default
+	rootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	seen := map[uint64]struct{}{}
+	var entries []chownEntry
+	if err := fsEval.Walk(rootfsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, err := fsEval.Lstatx(path)
+		if err != nil {
+			return fmt.Errorf("lstat %s: %w", path, err)
+		}
+		if _, ok := seen[st.Ino]; ok {
+			return nil
+		}
+		seen[st.Ino] = struct{}{}
+
+		uid, err := shiftID(int64(st.Uid), uidShift)
+		if err != nil {
+			return fmt.Errorf("shift owner of %s: %w", path, err)
+		}
+		gid, err := shiftID(int64(st.Gid), gidShift)
+		if err != nil {
+			return fmt.Errorf("shift group of %s: %w", path, err)
+		}
+		entries = append(entries, chownEntry{path: path, mode: info.Mode(), uid: uid, gid: gid})
+		return nil
+	}); err != nil {
+		return fmt.Errorf("chown bundle: %w", err)
+	}
+
+	log.Infof("shifting ownership of %d inodes in %s ...", len(entries), rootfsPath)
+	for _, entry := range entries {
+		isSymlink := entry.mode&os.ModeSymlink == os.ModeSymlink
+
+		// Changing the owner clears file capabilities and the setuid and
+		// setgid bits, so we need to restore them afterwards.
+		var caps []byte
+		if !isSymlink {
+			caps, _ = fsEval.Lgetxattr(entry.path, capabilityXattr)
+		}
+		// NOTE: This is not done through fsEval.
+		if err := os.Lchown(entry.path, int(entry.uid), int(entry.gid)); err != nil {
+			return fmt.Errorf("chown bundle: %s: %w", entry.path, err)
+		}
+		if isSymlink {
+			continue
+		}
+		if entry.mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			if err := fsEval.Chmod(entry.path, entry.mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+				return fmt.Errorf("chown bundle: restore mode of %s: %w", entry.path, err)
+			}
+		}
+		if len(caps) > 0 {
+			if err := fsEval.Lsetxattr(entry.path, capabilityXattr, caps, 0); err != nil {
+				return fmt.Errorf("chown bundle: restore capabilities of %s: %w", entry.path, err)
+			}
+		}
+	}
+	log.Info("... done")
+
+	// Update the bundle metadata to match.
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	if err := shiftMtree(filepath.Join(bundlePath, mtreeName+".mtree"), uidShift, gidShift); err != nil {
+		return fmt.Errorf("chown bundle: %w", err)
+	}
+	if err := shiftRuntimeConfig(filepath.Join(bundlePath, "config.json"), newMapOptions); err != nil {
+		return fmt.Errorf("chown bundle: %w", err)
+	}
+	meta.MapOptions = newMapOptions
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return fmt.Errorf("write umoci.json metadata: %w", err)
+	}
+	return nil
+}
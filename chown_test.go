@@ -0,0 +1,205 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/vbatts/go-mtree"
+)
+
+func TestChownBundle(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ChownBundle requires root")
+	}
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestChownBundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 0, Gid: 0},
+		{Name: "dir/root", Typeflag: tar.TypeReg, Mode: 0644, Uid: 0, Gid: 0},
+		{Name: "dir/user", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 100},
+		{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/user"},
+		{Name: "dir/suid", Typeflag: tar.TypeReg, Mode: 04755, Uid: 0, Gid: 0},
+		{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "user", Uid: 1000, Gid: 100},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, &ispec.History{CreatedBy: "test"}, mutate.GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+
+	owners := func() map[string][2]uint32 {
+		owners := map[string][2]uint32{}
+		for _, path := range []string{".", "dir", "dir/root", "dir/user", "dir/link", "dir/suid", "dir/symlink"} {
+			fi, err := os.Lstat(filepath.Join(rootfs, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			owners[path] = [2]uint32{st.Uid, st.Gid}
+		}
+		return owners
+	}
+	before := owners()
+
+	// Shifting ids out of range must fail without changing anything.
+	if err := ChownBundle(bundle, -1, 0); err == nil {
+		t.Errorf("expected shifting uid 0 by -1 to fail")
+	}
+	if got := owners(); !reflect.DeepEqual(before, got) {
+		t.Errorf("failed shift modified ownership: expected %v, got %v", before, got)
+	}
+
+	// Apply the shift.
+	const uidShift, gidShift = 100000, 200000
+	if err := ChownBundle(bundle, uidShift, gidShift); err != nil {
+		t.Fatalf("unexpected ChownBundle error: %+v", err)
+	}
+	after := owners()
+	for path, owner := range before {
+		expected := [2]uint32{owner[0] + uidShift, owner[1] + gidShift}
+		if after[path] != expected {
+			t.Errorf("%s: expected owner %v after shift, got %v", path, expected, after[path])
+		}
+	}
+
+	// The setuid bit must survive the chown.
+	fi, err := os.Lstat(filepath.Join(rootfs, "dir/suid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("setuid bit was cleared by shift: mode %v", fi.Mode())
+	}
+
+	// The metadata must have been shifted too.
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.MapOptions.UIDMappings) != 1 || meta.MapOptions.UIDMappings[0].HostID != uidShift || meta.MapOptions.UIDMappings[0].ContainerID != 0 {
+		t.Errorf("unexpected uid mappings after shift: %+v", meta.MapOptions.UIDMappings)
+	}
+	if len(meta.MapOptions.GIDMappings) != 1 || meta.MapOptions.GIDMappings[0].HostID != gidShift || meta.MapOptions.GIDMappings[0].ContainerID != 0 {
+		t.Errorf("unexpected gid mappings after shift: %+v", meta.MapOptions.GIDMappings)
+	}
+
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	fh, err := os.Open(filepath.Join(bundle, mtreeName+".mtree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	spec, err := mtree.ParseSpec(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Check(rootfs, spec, MtreeKeywords, fseval.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("shifted rootfs does not match shifted mtree: %v", diffs)
+	}
+
+	// Shifting back restores the original ownership.
+	if err := ChownBundle(bundle, -uidShift, -gidShift); err != nil {
+		t.Fatalf("unexpected ChownBundle error: %+v", err)
+	}
+	if got := owners(); !reflect.DeepEqual(before, got) {
+		t.Errorf("shifting back did not restore ownership: expected %v, got %v", before, got)
+	}
+	meta, err = ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.MapOptions.UIDMappings[0].HostID != 0 || meta.MapOptions.GIDMappings[0].HostID != 0 {
+		t.Errorf("unexpected mappings after shifting back: %+v", meta.MapOptions)
+	}
+
+	// Rootless bundles cannot be shifted.
+	meta.MapOptions.Rootless = true
+	meta.MapOptions.UIDMappings = []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 1}}
+	if err := WriteBundleMeta(bundle, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChownBundle(bundle, 1, 1); err == nil {
+		t.Errorf("expected shifting a rootless bundle to fail")
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var blobSubcommand = cli.Command{
+	Name:  "blob",
+	Usage: "low-level blob store management",
+	ArgsUsage: `blob <command> [<args>...]
+
+The umoci-blob(1) subcommands allow for fine-grained management of the blobs
+stored in an OCI layout, beyond what umoci-gc(1) provides.`,
+
+	Subcommands: []cli.Command{
+		blobListCommand,
+		blobRemoveCommand,
+		blobCheckCommand,
+	},
+}
+
+var blobListCommand = cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "lists the set of blobs in an OCI layout",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI layout.
+
+Gives the full list of blobs in an OCI layout, with each blob digest on a
+single line. If --older-than is specified, only blobs which were last modified
+before the given age are listed.`,
+
+	// blob list reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "older-than",
+			Usage: "only list blobs last modified at least this long ago (such as 12h or 30d)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("older-than") {
+			age, err := parseAge(ctx.String("older-than"))
+			if err != nil {
+				return fmt.Errorf("invalid --older-than: %w", err)
+			}
+			ctx.App.Metadata["--older-than"] = age
+		}
+		return nil
+	},
+
+	Action: blobList,
+}
+
+// parseAge parses an age string. It accepts anything time.ParseDuration
+// accepts, as well as an integral number of days with a "d" suffix.
+func parseAge(value string) (time.Duration, error) {
+	var age time.Duration
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("parse days: %w", err)
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		age, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("age cannot be negative: %s", value)
+	}
+	return age, nil
+}
+
+func blobList(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	blobs, err := engineExt.ListBlobs(context.Background())
+	if err != nil {
+		return fmt.Errorf("list blobs: %w", err)
+	}
+
+	now := time.Now()
+	for _, blob := range blobs {
+		if age, ok := ctx.App.Metadata["--older-than"].(time.Duration); ok {
+			mtime, err := dir.BlobModTime(context.Background(), imagePath, blob)
+			if err != nil {
+				return fmt.Errorf("get blob mtime %s: %w", blob, err)
+			}
+			if now.Sub(mtime) < age {
+				continue
+			}
+		}
+		fmt.Println(blob)
+	}
+	return nil
+}
+
+var blobRemoveCommand = cli.Command{
+	Name:    "remove",
+	Aliases: []string{"rm"},
+	Usage:   "removes blobs from an OCI layout",
+	ArgsUsage: `--layout <image-path> <digest>...
+
+Where "<image-path>" is the path to the OCI layout, and "<digest>" is the
+digest of a blob to remove.
+
+Blobs which are reachable from any reference in the layout will not be removed
+unless --force is specified (doing so will result in a broken image).`,
+
+	// blob rm modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "remove blobs even if they are referenced by the layout",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return errors.New("invalid number of positional arguments: expected at least one <digest>")
+		}
+		var blobs []digest.Digest
+		for _, arg := range ctx.Args() {
+			blob, err := digest.Parse(arg)
+			if err != nil {
+				return fmt.Errorf("invalid digest %q: %w", arg, err)
+			}
+			blobs = append(blobs, blob)
+		}
+		ctx.App.Metadata["blobs"] = blobs
+		return nil
+	},
+
+	Action: blobRemove,
+}
+
+func blobRemove(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	blobs := ctx.App.Metadata["blobs"].([]digest.Digest)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	referenced, err := engineExt.ReferencedBlobs(context.Background())
+	if err != nil {
+		return fmt.Errorf("get referenced blobs: %w", err)
+	}
+
+	// Check everything before removing anything, so we don't end up with only
+	// some of the blobs removed.
+	for _, blob := range blobs {
+		exists, err := engineExt.StatBlob(context.Background(), blob)
+		if err != nil {
+			return fmt.Errorf("stat blob %s: %w", blob, err)
+		}
+		if !exists {
+			return fmt.Errorf("blob not found: %s", blob)
+		}
+		if _, ok := referenced[blob]; ok {
+			if !ctx.Bool("force") {
+				return fmt.Errorf("blob %s is referenced by the layout (use --force to remove it anyway)", blob)
+			}
+			log.Warnf("removing referenced blob %s: the layout will be broken", blob)
+		}
+	}
+
+	for _, blob := range blobs {
+		if err := engineExt.DeleteBlob(context.Background(), blob); err != nil {
+			return fmt.Errorf("delete blob %s: %w", blob, err)
+		}
+		log.Infof("removed blob: %s", blob)
+	}
+	return nil
+}
+
+var blobCheckCommand = cli.Command{
+	Name:  "check",
+	Usage: "finds (and removes) invalid blobs in an OCI layout",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI layout.
+
+Checks the blob store for files which are not valid blobs, such as temporary
+files, blobs whose contents do not match their digest (usually left behind by a
+partial write) and stale temporary directories. Each such file is listed
+together with the reason it is invalid. Every blob is re-digested, so this may
+take a while for large layouts. If --remove is specified, the invalid files are
+also removed. Valid blobs are never modified.`,
+
+	// blob check reads (and possibly modifies) an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "remove",
+			Usage: "remove all invalid blobs and stale temporary files found",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: blobCheck,
+}
+
+func blobCheck(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Make sure this is actually a layout before we start removing things.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	defer engine.Close()
+
+	garbage, err := dir.CheckBlobs(context.Background(), imagePath, ctx.Bool("remove"))
+	for _, g := range garbage {
+		fmt.Printf("%s: %s\n", g.Path, g.Reason)
+	}
+	if err != nil {
+		return fmt.Errorf("check blobs: %w", err)
+	}
+	if ctx.Bool("remove") && len(garbage) > 0 {
+		log.Infof("removed %d invalid files", len(garbage))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/urfave/cli"
+)
+
+var chownBundleCommand = cli.Command{
+	Name:  "chown-bundle",
+	Usage: "shifts the ownership of an unpacked OCI runtime bundle",
+	ArgsUsage: `[--uid-shift <n>] [--gid-shift <n>] <bundle>
+
+Where "<bundle>" is the path to an OCI runtime bundle unpacked by
+umoci-unpack(1), and "<n>" is the (possibly negative) amount to shift each
+uid or gid by.
+
+The owner of every inode in the bundle's rootfs is shifted, and the id
+mappings stored in the bundle are updated to match (so that umoci-repack(1)
+will not treat the shift as a change to the rootfs). This is useful for moving
+a bundle into a different user namespace without unpacking it again. Rootless
+bundles cannot be shifted.`,
+
+	// chown-bundle only modifies a bundle.
+	Category: "bundle",
+
+	Flags: []cli.Flag{
+		cli.Int64Flag{
+			Name:  "uid-shift",
+			Usage: "amount to shift the uid of every inode by",
+		},
+		cli.Int64Flag{
+			Name:  "gid-shift",
+			Usage: "amount to shift the gid of every inode by",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.New("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.New("bundle path cannot be empty")
+		}
+		if !ctx.IsSet("uid-shift") && !ctx.IsSet("gid-shift") {
+			return errors.New("at least one of --uid-shift or --gid-shift must be specified")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		return nil
+	},
+
+	Action: chownBundle,
+}
+
+func chownBundle(ctx *cli.Context) error {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	uidShift, gidShift := ctx.Int64("uid-shift"), ctx.Int64("gid-shift")
+	if err := umoci.ChownBundle(bundlePath, uidShift, gidShift); err != nil {
+		return fmt.Errorf("chown bundle: %w", err)
+	}
+	log.Infof("shifted ownership of %s by %d:%d", bundlePath, uidShift, gidShift)
+	return nil
+}
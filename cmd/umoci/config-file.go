@@ -0,0 +1,253 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFiles are the configuration files (in order of preference)
+// which are used if --config-file was not specified. They are looked up
+// relative to the current directory.
+var defaultConfigFiles = []string{".umoci.yaml", ".umoci.yml", ".umoci.json"}
+
+// globalConfigSection is the section of the configuration file containing
+// the defaults for global flags.
+const globalConfigSection = "global"
+
+// configFile contains the default values for command-line flags. It is keyed
+// by section (the full name of a command such as "unpack" or "raw unpack", or
+// globalConfigSection) and then by flag name.
+type configFile map[string]map[string]interface{}
+
+// unconfigurableFlags are the flags which cannot be set in the configuration
+// file.
+var unconfigurableFlags = map[string]bool{
+	"config-file": true,
+	"help":        true,
+	"version":     true,
+}
+
+// configFlagConflicts lists the flags which may not be specified together. A
+// flag in the configuration file is ignored if a conflicting flag was set on
+// the command-line, so that the command-line always takes precedence.
+var configFlagConflicts = map[string][]string{
+	"log":                {"verbose"},
+	"verbose":            {"log"},
+	"no-history":         {"history.author", "history.comment", "history.created", "history.created_by", "history-template"},
+	"history.author":     {"no-history"},
+	"history.comment":    {"no-history"},
+	"history.created":    {"no-history"},
+	"history.created_by": {"no-history", "history-template"},
+	"history-template":   {"no-history", "history.created_by"},
+}
+
+// findConfigFile returns the path of the configuration file to use. If path
+// is empty, the first of defaultConfigFiles that exists is used (or "" if
+// none of them exist).
+func findConfigFile(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	for _, name := range defaultConfigFiles {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("stat config file: %w", err)
+		}
+	}
+	return "", nil
+}
+
+// readConfigFile parses the configuration file at the given path. JSON is a
+// subset of YAML, so both formats are parsed the same way.
+func readConfigFile(path string) (configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	var config configFile
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// flagName returns the primary name of a flag (without any aliases).
+func flagName(flag cli.Flag) string {
+	return strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+}
+
+// isSliceFlag returns whether the flag can be specified more than once.
+func isSliceFlag(flag cli.Flag) bool {
+	switch flag.(type) {
+	case cli.StringSliceFlag, cli.IntSliceFlag, cli.Int64SliceFlag:
+		return true
+	}
+	return false
+}
+
+// configSections returns the flags which can be set in each section of the
+// configuration file, for the given global flags and commands.
+func configSections(globalFlags []cli.Flag, commands map[string]*cli.Command) map[string][]cli.Flag {
+	sections := map[string][]cli.Flag{
+		globalConfigSection: globalFlags,
+	}
+	for name, cmd := range commands {
+		sections[name] = cmd.Flags
+	}
+	return sections
+}
+
+// namedCommands returns all of the commands (including subcommands), keyed by
+// their full name (such as "raw unpack").
+func namedCommands(prefix string, cmds []cli.Command) map[string]*cli.Command {
+	named := map[string]*cli.Command{}
+	for idx, cmd := range cmds {
+		name := prefix + cmd.Name
+		named[name] = &cmds[idx]
+		for subName, subCmd := range namedCommands(name+" ", cmd.Subcommands) {
+			named[subName] = subCmd
+		}
+	}
+	return named
+}
+
+// configValues converts the configuration file value of a flag to the
+// string values to set the flag to.
+func configValues(value interface{}, slice bool) ([]string, error) {
+	switch value := value.(type) {
+	case string:
+		return []string{value}, nil
+	case bool, int, int64, uint64, float64:
+		return []string{fmt.Sprint(value)}, nil
+	case []interface{}:
+		if !slice {
+			return nil, errors.New("flag cannot be specified more than once")
+		}
+		var values []string
+		for _, item := range value {
+			itemValues, err := configValues(item, false)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", value)
+}
+
+// validate checks that every section and flag in the configuration file
+// refers to a known command and flag, and that all values have a valid type.
+func (c configFile) validate(sections map[string][]cli.Flag) error {
+	for section, values := range c {
+		flags, ok := sections[section]
+		if !ok {
+			return fmt.Errorf("config file: unknown command %q", section)
+		}
+		for name, value := range values {
+			var flag cli.Flag
+			for _, f := range flags {
+				if flagName(f) == name {
+					flag = f
+					break
+				}
+			}
+			if flag == nil || unconfigurableFlags[name] {
+				return fmt.Errorf("config file: %s: unknown flag --%s", section, name)
+			}
+			if _, err := configValues(value, isSliceFlag(flag)); err != nil {
+				return fmt.Errorf("config file: %s: invalid value for --%s: %w", section, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyConfigSection sets each flag of ctx to its value in the given section
+// of the configuration file, unless the flag (or a conflicting flag) was set
+// on the command-line.
+func applyConfigSection(ctx *cli.Context, section map[string]interface{}) error {
+	var names []string
+	for name := range section {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Figure out which flags were set on the command-line before we start
+	// setting any flags ourselves.
+	skip := map[string]bool{}
+	for _, name := range names {
+		if ctx.IsSet(name) {
+			skip[name] = true
+		}
+		for _, conflict := range configFlagConflicts[name] {
+			if ctx.IsSet(conflict) {
+				skip[name] = true
+			}
+		}
+	}
+
+	for _, name := range names {
+		if skip[name] {
+			continue
+		}
+		// The section has already been validated, so we only need to
+		// distinguish between lists and single values.
+		_, slice := section[name].([]interface{})
+		values, err := configValues(section[name], slice)
+		if err != nil {
+			return fmt.Errorf("config file: invalid value for --%s: %w", name, err)
+		}
+		for _, value := range values {
+			if err := ctx.Set(name, value); err != nil {
+				return fmt.Errorf("config file: invalid value for --%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// uxConfigFile wraps the .Before of the given cli.Command so that the flags of
+// the command are set to their defaults from the given section of the
+// configuration file (stored in ctx.App.Metadata["--config-file"]) before the
+// command-line arguments are validated.
+func uxConfigFile(cmd cli.Command, section string) cli.Command {
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if config, ok := ctx.App.Metadata["--config-file"].(configFile); ok {
+			if err := applyConfigSection(ctx, config[section]); err != nil {
+				return fmt.Errorf("%s: %w", section, err)
+			}
+		}
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+	return cmd
+}
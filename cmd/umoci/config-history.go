@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var configHistoryCommand = cli.Command{
+	Name:  "config-history",
+	Usage: "displays how the config of an image manifest evolved over its history",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to inspect.
+
+The configuration changes are reconstructed on a best-effort basis from the
+ENV, CMD and LABEL directives recorded in the history of the image, so changes
+made by tools which don't record them (including "umoci config") are not
+shown.`,
+
+	// config-history gives information about a manifest.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the config history as a JSON encoded blob",
+		},
+	},
+
+	Action: configHistory,
+}
+
+func configHistory(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(manifestDescriptorPaths) == 0 {
+		return fmt.Errorf("tag not found: %s", tagName)
+	}
+	if len(manifestDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return fmt.Errorf("tag is ambiguous: %s", tagName)
+	}
+	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return fmt.Errorf("invalid saved from descriptor: descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType)
+	}
+
+	ch, err := umoci.StatConfigHistory(context.Background(), engineExt, manifestDescriptor)
+	if err != nil {
+		return fmt.Errorf("config history: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(ch); err != nil {
+			return fmt.Errorf("encoding config history: %w", err)
+		}
+	} else {
+		if err := ch.Format(os.Stdout); err != nil {
+			return fmt.Errorf("format config history: %w", err)
+		}
+	}
+	return nil
+}
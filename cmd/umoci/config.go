@@ -21,6 +21,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -36,7 +37,7 @@ import (
 // FIXME: We should also implement a raw mode that just does modifications of
 //
 //	JSON blobs (allowing this all to be used outside of our build setup).
-var configCommand = uxHistory(uxTag(cli.Command{
+var configCommand = uxGCAfter(uxOutputDescriptor(uxHistory(uxTag(cli.Command{
 	Name:  "config",
 	Usage: "modifies the image configuration of an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
@@ -95,16 +96,18 @@ image.`,
 	},
 
 	Action: config,
-}))
+}))))
 
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	created := meta.Created
 	return ispec.Image{
-		Config:       config,
-		Created:      &created,
-		Author:       meta.Author,
-		Architecture: meta.Architecture,
-		OS:           meta.OS,
+		Config:  config,
+		Created: &created,
+		Author:  meta.Author,
+		Platform: ispec.Platform{
+			Architecture: meta.Architecture,
+			OS:           meta.OS,
+		},
 	}
 }
 
@@ -171,6 +174,9 @@ func config(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("create mutator for manifest: %w", err)
 	}
+	if redactions, ok := ctx.App.Metadata["--history-redact"].([]*regexp.Regexp); ok {
+		mutator.SetHistoryRedactions(redactions)
+	}
 
 	config, err := mutator.Config(context.Background())
 	if err != nil {
@@ -317,6 +323,13 @@ func config(ctx *cli.Context) error {
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
+		if ctx.IsSet("history-template") {
+			history.CreatedBy = mutate.ExpandHistoryTemplate(ctx.String("history-template"), "config", nil, *history.Created)
+		}
+	}
+
+	if err := g.Validate(); err != nil {
+		return fmt.Errorf("validate modified configuration: %w", err)
 	}
 
 	newConfig, newMeta := fromImage(g.Image())
@@ -334,7 +347,16 @@ func config(ctx *cli.Context) error {
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return fmt.Errorf("add new tag: %w", err)
 	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
-	return nil
+	return gcAfter(ctx, engineExt)
 }
@@ -0,0 +1,170 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var copyCommand = uxRemap(cli.Command{
+	Name:  "copy",
+	Usage: "copies a tagged image from one OCI image layout to another",
+	ArgsUsage: `--src <image-path>[:<tag>] --dst <image-path>[:<tag>]
+
+Where "<image-path>" is the path to an OCI image layout and "<tag>" is the
+name of a tagged image. The destination layout must already exist.
+
+Every blob of the source image (including all of the manifests of an image
+index) is copied into the destination layout, and the destination tag is set
+to the same descriptor as the source tag. Blobs which already exist in the
+destination are not copied again, so interrupted copies can simply be
+re-run. If the destination tag already refers to a different image,
+umoci-copy(1) will fail unless --overwrite is specified.`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "src",
+			Usage: "OCI image URI of the form 'path[:tag]' to copy from",
+		},
+		cli.StringFlag{
+			Name:  "dst",
+			Usage: "OCI image URI of the form 'path[:tag]' to copy to",
+		},
+		cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "replace the destination tag if it already refers to a different image",
+		},
+	},
+
+	Action: copyImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		for _, flag := range []string{"src", "dst"} {
+			if !ctx.IsSet(flag) {
+				return fmt.Errorf("missing mandatory argument: --%s", flag)
+			}
+			path, tag, err := parseImageRef(ctx, flag, ctx.String(flag))
+			if err != nil {
+				return err
+			}
+			ctx.App.Metadata["--"+flag+"-path"] = path
+			ctx.App.Metadata["--"+flag+"-tag"] = tag
+		}
+		return nil
+	},
+})
+
+// resolveRoot returns the descriptor of the top-level index entry for the
+// given tag, which must not be ambiguous. Unlike resolveManifest, the
+// descriptor may refer to an image index.
+func resolveRoot(ctx context.Context, engineExt casext.Engine, name string) (ispec.Descriptor, error) {
+	descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(descriptorPaths) == 0 {
+		return ispec.Descriptor{}, fmt.Errorf("tag is not found: %s", name)
+	}
+	root := descriptorPaths[0].Root()
+	for _, descriptorPath := range descriptorPaths[1:] {
+		if descriptorPath.Root().Digest != root.Digest {
+			// TODO: Handle this more nicely.
+			return ispec.Descriptor{}, fmt.Errorf("tag is ambiguous: %s", name)
+		}
+	}
+	return root, nil
+}
+
+func copyImage(ctx *cli.Context) error {
+	srcPath := ctx.App.Metadata["--src-path"].(string)
+	srcName := ctx.App.Metadata["--src-tag"].(string)
+	dstPath := ctx.App.Metadata["--dst-path"].(string)
+	dstName := ctx.App.Metadata["--dst-tag"].(string)
+
+	// Get a reference to the CAS of each layout.
+	srcEngine, err := dir.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("open source CAS: %w", err)
+	}
+	srcEngineExt := casext.NewEngine(srcEngine)
+	defer srcEngine.Close()
+
+	dstEngineExt := srcEngineExt
+	if dstPath != srcPath {
+		dstEngine, err := dir.Open(dstPath)
+		if err != nil {
+			return fmt.Errorf("open destination CAS: %w", err)
+		}
+		dstEngineExt = casext.NewEngine(dstEngine)
+		defer dstEngine.Close()
+	}
+
+	descriptor, err := resolveRoot(context.Background(), srcEngineExt, srcName)
+	if err != nil {
+		return fmt.Errorf("invalid --src: %w", err)
+	}
+
+	// Make sure we aren't going to clobber an existing tag before copying
+	// anything.
+	if existing, err := resolveRoot(context.Background(), dstEngineExt, dstName); err == nil {
+		if existing.Digest != descriptor.Digest && !ctx.Bool("overwrite") {
+			return fmt.Errorf("destination tag already exists (use --overwrite to replace it): %s", dstName)
+		}
+	}
+
+	n, err := srcEngineExt.CopyBlobs(context.Background(), dstEngineExt, descriptor)
+	if err != nil {
+		return fmt.Errorf("copy blobs: %w", err)
+	}
+	log.Infof("copied %d blobs", n)
+
+	// The index entry is copied as-is (including any annotations), other than
+	// the original name of the source tag (if it was sanitized) which doesn't
+	// apply to the destination tag.
+	annotations := map[string]string{}
+	for key, value := range descriptor.Annotations {
+		if key != casext.UmociOriginalRefNameAnnotation {
+			annotations[key] = value
+		}
+	}
+	descriptor.Annotations = annotations
+
+	if err := dstEngineExt.UpdateReference(context.Background(), dstName, descriptor); err != nil {
+		return fmt.Errorf("put reference: %w", err)
+	}
+	if err := recordRelaxedReference(ctx, dstEngineExt, dstName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, dstEngineExt); err != nil {
+		return err
+	}
+
+	log.Infof("copied image %s to %s", ctx.String("src"), ctx.String("dst"))
+	return nil
+}
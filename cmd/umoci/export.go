@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "exports an image as a Docker image archive",
+	ArgsUsage: `--image <image-path>[:<tag>] [--image-name <name>]... <archive>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to export, and "<archive>" is the path of the Docker image archive
+to create (it must not already exist).
+
+The archive has the same format as the output of "docker save", and so can be
+loaded with "docker load" or imported with umoci-import(1). The layers of the
+image are stored uncompressed (regardless of how they are compressed in the
+image). --image-name sets the names (such as "busybox:latest") which "docker
+load" will tag the image with, and can be specified more than once.`,
+
+	// export reads an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "image-name",
+			Usage: "name to give the image in the archive (can be specified more than once)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.New("invalid number of positional arguments: expected <archive>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.New("archive path cannot be empty")
+		}
+		ctx.App.Metadata["archive"] = ctx.Args().First()
+		for _, name := range ctx.StringSlice("image-name") {
+			if name == "" {
+				return errors.New("--image-name cannot be empty")
+			}
+		}
+		return nil
+	},
+
+	Action: exportImage,
+}
+
+func exportImage(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return fmt.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return fmt.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	archive, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	defer func() {
+		if err := archive.Close(); err != nil && Err == nil {
+			Err = fmt.Errorf("close archive: %w", err)
+		}
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(archivePath)
+		}
+	}()
+
+	if err := umoci.ExportDockerArchive(context.Background(), engineExt, fromDescriptorPaths[0], archive, &umoci.ExportDockerArchiveOptions{
+		RepoTags: ctx.StringSlice("image-name"),
+	}); err != nil {
+		return fmt.Errorf("export docker archive: %w", err)
+	}
+
+	log.Infof("exported image to docker archive: %s", archivePath)
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var importCommand = uxGCAfter(uxOutputDescriptor(cli.Command{
+	Name:  "import",
+	Usage: "imports an image from a Docker image archive",
+	ArgsUsage: `--image <image-path>:<new-tag> [--image-name <name>] <archive>
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag for the imported image, and "<archive>" is a Docker image archive (as
+created by "docker save").
+
+If the archive contains more than one image, --image-name must be used to
+select the image to import (either by one of the names of the image, such as
+"busybox:latest", or by the digest of the image configuration). The layers of
+the image are compressed with --compress, and their diffids are verified
+against the image configuration. Foreign layers (which are referenced by URL)
+are not imported, and are instead referenced as non-distributable layers.`,
+
+	// import modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "image-name",
+			Usage: "name (or configuration digest) of the image to import from the archive",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression to use for the imported layers (none, gzip, zstd, zstd:chunked, lz4)",
+			Value: "gzip",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.New("invalid number of positional arguments: expected <archive>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.New("archive path cannot be empty")
+		}
+		ctx.App.Metadata["archive"] = ctx.Args().First()
+
+		compressor, err := uxCompressor(ctx.String("compress"))
+		if err != nil {
+			return fmt.Errorf("invalid --compress: %w", err)
+		}
+		ctx.App.Metadata["--compress"] = compressor
+		return nil
+	},
+
+	Action: importImage,
+}))
+
+func importImage(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+	compressor := ctx.App.Metadata["--compress"].(mutate.Compressor)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer archive.Close()
+
+	descriptor, err := umoci.ImportDockerArchive(context.Background(), engineExt, archive, &umoci.ImportDockerArchiveOptions{
+		ImageName:  ctx.String("image-name"),
+		Compressor: compressor,
+	})
+	if err != nil {
+		return fmt.Errorf("import docker archive: %w", err)
+	}
+
+	log.Infof("new image manifest created: %s", descriptor.Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return fmt.Errorf("add new tag: %w", err)
+	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+
+	log.Infof("created new tag for imported image: %s", tagName)
+	return gcAfter(ctx, engineExt)
+}
@@ -0,0 +1,186 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/urfave/cli"
+)
+
+var indexCommand = uxOutputDescriptor(cli.Command{
+	Name:  "index",
+	Usage: "creates a new image index from a set of tagged images",
+	ArgsUsage: `--image <image-path>:<new-tag> [--media-type <type>] <tag>...
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag for the new index, and each "<tag>" is the name of an existing tagged
+image to include in the index. The platform of each entry is taken from the
+index the tag resolves through (including nested indexes) if it declares
+one, and is otherwise filled from the configuration of the image it
+references.
+
+The index is written as an OCI image index by default ("oci"). Use
+"--media-type docker" to write a Docker manifest list instead, for registries
+and tools that do not support OCI image indexes.`,
+
+	// index modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "media-type",
+			Usage: "format of the new index (oci, docker)",
+			Value: "oci",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() == 0 {
+			return errors.New("invalid number of positional arguments: expected <tag>...")
+		}
+		mediaType, err := uxIndexMediaType(ctx.String("media-type"))
+		if err != nil {
+			return fmt.Errorf("invalid --media-type: %w", err)
+		}
+		ctx.App.Metadata["--media-type"] = mediaType
+		return nil
+	},
+
+	Action: index,
+})
+
+// uxIndexMediaType returns the index media-type described by the given
+// user-provided format name.
+func uxIndexMediaType(name string) (string, error) {
+	switch name {
+	case "oci":
+		return ispec.MediaTypeImageIndex, nil
+	case "docker":
+		return mediatype.DockerManifestList, nil
+	}
+	return "", fmt.Errorf("unknown index format %q (must be oci or docker)", name)
+}
+
+// entryPlatform returns the platform described by the configuration of the
+// given manifest, or nil if the descriptor is not a manifest.
+func entryPlatform(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) (*ispec.Platform, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return nil, nil
+	}
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, fmt.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, fmt.Errorf("get config: %w", err)
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, fmt.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+	}
+	return &ispec.Platform{
+		Architecture: config.Architecture,
+		OS:           config.OS,
+	}, nil
+}
+
+func index(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	mediaType := ctx.App.Metadata["--media-type"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var manifests []ispec.Descriptor
+	for _, fromName := range ctx.Args() {
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+		if err != nil {
+			return fmt.Errorf("get descriptor: %w", err)
+		}
+		if len(descriptorPaths) == 0 {
+			return fmt.Errorf("tag not found: %s", fromName)
+		}
+		if len(descriptorPaths) != 1 {
+			// TODO: Handle this more nicely.
+			return fmt.Errorf("tag is ambiguous: %s", fromName)
+		}
+		descriptor := descriptorPaths[0].Descriptor()
+
+		// Tag-specific annotations don't belong in the index entries.
+		descriptor.Annotations = nil
+		platform := descriptorPaths[0].Platform()
+		if platform == nil {
+			platform, err = entryPlatform(context.Background(), engineExt, descriptor)
+			if err != nil {
+				return fmt.Errorf("get platform of %s: %w", fromName, err)
+			}
+		}
+		descriptor.Platform = platform
+		manifests = append(manifests, descriptor)
+	}
+
+	newDescriptor, err := engineExt.CreateIndex(context.Background(), mediaType, manifests, nil)
+	if err != nil {
+		return fmt.Errorf("create index: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"mediatype": newDescriptor.MediaType,
+		"digest":    newDescriptor.Digest,
+		"size":      newDescriptor.Size,
+	}).Infof("created new index")
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptor); err != nil {
+		return fmt.Errorf("add new tag: %w", err)
+	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+
+	log.Infof("created new tag for index: %q -> %q", tagName, newDescriptor.Digest)
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 
 	"github.com/apex/log"
 	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/urfave/cli"
 )
 
@@ -65,6 +66,15 @@ func initLayout(ctx *cli.Context) error {
 		return fmt.Errorf("image layout creation: %w", err)
 	}
 
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	defer engine.Close()
+	if err := recordIndexCreated(ctx, casext.NewEngine(engine)); err != nil {
+		return err
+	}
+
 	log.Infof("created new OCI image: %s", imagePath)
 	return nil
 }
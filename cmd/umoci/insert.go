@@ -20,7 +20,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/apex/log"
@@ -34,7 +36,7 @@ import (
 	"github.com/urfave/cli"
 )
 
-var insertCommand = uxRemap(uxHistory(uxTag(cli.Command{
+var insertCommand = uxGCAfter(uxOutputDescriptor(uxRemap(uxHistory(uxTag(cli.Command{
 	Name:  "insert",
 	Usage: "insert content into an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--opaque] <source> <target>
@@ -48,6 +50,10 @@ The path at "<source>" is added to the image with the given "<target>" name.
 If "--whiteout" is specified, rather than inserting content into the image, a
 removal entry for "<target>" is inserted instead.
 
+If "--no-clobber" is specified, the insertion is refused if "<target>" already
+exists in the image. This check is best-effort, as symlinks in the image are
+not resolved.
+
 If "--opaque" is specified then any paths below "<target>" (assuming it is a
 directory) from previous layers will no longer be present. Only the contents
 inserted by this command will be visible. This can be used to replace an entire
@@ -77,6 +83,10 @@ Some examples:
 			Name:  "opaque",
 			Usage: "mask any previous entries in the target directory",
 		},
+		cli.BoolFlag{
+			Name:  "no-clobber",
+			Usage: "refuse to insert if the target path already exists in the image",
+		},
 	},
 
 	Before: func(ctx *cli.Context) error {
@@ -89,6 +99,9 @@ Some examples:
 		if ctx.NArg() != numArgs {
 			return fmt.Errorf("invalid number of positional arguments: expected %d", numArgs)
 		}
+		if ctx.IsSet("whiteout") && ctx.IsSet("no-clobber") {
+			return errors.New("--whiteout and --no-clobber may not be specified together")
+		}
 		for idx, args := range ctx.Args() {
 			if args == "" {
 				return fmt.Errorf("invalid positional argument %d: arguments cannot be empty", idx)
@@ -107,7 +120,7 @@ Some examples:
 		ctx.App.Metadata["--target-path"] = targetPath
 		return nil
 	},
-})))
+})))))
 
 func insert(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -146,6 +159,23 @@ func insert(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("create mutator for base image: %w", err)
 	}
+	if redactions, ok := ctx.App.Metadata["--history-redact"].([]*regexp.Regexp); ok {
+		mutator.SetHistoryRedactions(redactions)
+	}
+
+	if ctx.Bool("no-clobber") {
+		manifest, err := mutator.Manifest(context.Background())
+		if err != nil {
+			return fmt.Errorf("get manifest: %w", err)
+		}
+		exists, err := layer.PathExists(context.Background(), engine, manifest, targetPath)
+		if err != nil {
+			return fmt.Errorf("check target path: %w", err)
+		}
+		if exists {
+			return fmt.Errorf("refusing to clobber existing path in image: %s", targetPath)
+		}
+	}
 
 	var meta umoci.Meta
 	meta.Version = umoci.MetaVersion
@@ -186,6 +216,9 @@ func insert(ctx *cli.Context) error {
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
+		if ctx.IsSet("history-template") {
+			history.CreatedBy = mutate.ExpandHistoryTemplate(ctx.String("history-template"), "insert", []string{targetPath}, *history.Created)
+		}
 	}
 
 	// TODO: We should add a flag to allow for a new layer to be made
@@ -204,6 +237,15 @@ func insert(ctx *cli.Context) error {
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return fmt.Errorf("add new tag: %w", err)
 	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
 	log.Infof("updated tag for image manifest: %s", tagName)
-	return nil
+	return gcAfter(ctx, engineExt)
 }
@@ -0,0 +1,192 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/urfave/cli"
+)
+
+var layerFromDiffCommand = uxRemap(cli.Command{
+	Name:  "layer-from-diff",
+	Usage: "generates a layer containing the differences between two images",
+	ArgsUsage: `--base <image-path>[:<tag>] --target <image-path>[:<tag>] --output <archive>
+
+Where "<image-path>" is the path to an OCI image layout, "<tag>" is the name
+of a tagged image (both images may be in different layouts) and "<archive>" is
+the path where the generated (uncompressed) tar layer will be written.
+
+The generated layer contains the changes needed to turn the root filesystem
+of the base image into the root filesystem of the target image, with removed
+paths represented as whiteouts. Adding it to the base image (with
+umoci-raw-add-layer(1)) results in the same root filesystem as the target
+image.`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "OCI image URI of the form 'path[:tag]' to compute the diff from",
+		},
+		cli.StringFlag{
+			Name:  "target",
+			Usage: "OCI image URI of the form 'path[:tag]' to compute the diff to",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "path to write the generated tar layer to",
+		},
+	},
+
+	Action: layerFromDiff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		for _, flag := range []string{"base", "target"} {
+			if !ctx.IsSet(flag) {
+				return fmt.Errorf("missing mandatory argument: --%s", flag)
+			}
+			path, tag, err := parseImageRef(ctx, flag, ctx.String(flag))
+			if err != nil {
+				return err
+			}
+			ctx.App.Metadata["--"+flag+"-path"] = path
+			ctx.App.Metadata["--"+flag+"-tag"] = tag
+		}
+		if !ctx.IsSet("output") {
+			return errors.New("missing mandatory argument: --output")
+		}
+		if ctx.String("output") == "" {
+			return errors.New("--output path cannot be empty")
+		}
+		return nil
+	},
+})
+
+// resolveManifest returns the manifest referenced by the given tag, which must
+// refer to exactly one image manifest.
+func resolveManifest(ctx context.Context, engineExt casext.Engine, name string) (ispec.Manifest, error) {
+	descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+	if err != nil {
+		return ispec.Manifest{}, fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(descriptorPaths) == 0 {
+		return ispec.Manifest{}, fmt.Errorf("tag is not found: %s", name)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return ispec.Manifest{}, fmt.Errorf("tag is ambiguous: %s", name)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptorPaths[0].Descriptor())
+	if err != nil {
+		return ispec.Manifest{}, fmt.Errorf("get manifest: %w", err)
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return ispec.Manifest{}, fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType)
+	}
+	return manifest, nil
+}
+
+func layerFromDiff(ctx *cli.Context) (Err error) {
+	basePath := ctx.App.Metadata["--base-path"].(string)
+	baseName := ctx.App.Metadata["--base-tag"].(string)
+	targetPath := ctx.App.Metadata["--target-path"].(string)
+	targetName := ctx.App.Metadata["--target-tag"].(string)
+	outputPath := ctx.String("output")
+
+	var unpackOptions layer.UnpackOptions
+	var meta umoci.Meta
+	meta.Version = umoci.MetaVersion
+
+	// Parse map options.
+	// We need to set mappings if we're in rootless mode.
+	err := umoci.ParseIdmapOptions(&meta, ctx)
+	if err != nil {
+		return err
+	}
+	unpackOptions.MapOptions = meta.MapOptions
+
+	// Get a reference to the CAS of each image.
+	baseEngine, err := dir.Open(basePath)
+	if err != nil {
+		return fmt.Errorf("open base CAS: %w", err)
+	}
+	baseEngineExt := casext.NewEngine(baseEngine)
+	defer baseEngine.Close()
+
+	targetEngineExt := baseEngineExt
+	if targetPath != basePath {
+		targetEngine, err := dir.Open(targetPath)
+		if err != nil {
+			return fmt.Errorf("open target CAS: %w", err)
+		}
+		targetEngineExt = casext.NewEngine(targetEngine)
+		defer targetEngine.Close()
+	}
+
+	baseManifest, err := resolveManifest(context.Background(), baseEngineExt, baseName)
+	if err != nil {
+		return fmt.Errorf("invalid --base: %w", err)
+	}
+	targetManifest, err := resolveManifest(context.Background(), targetEngineExt, targetName)
+	if err != nil {
+		return fmt.Errorf("invalid --target: %w", err)
+	}
+
+	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("create output layer: %w", err)
+	}
+	defer func() {
+		if err := output.Close(); err != nil && Err == nil {
+			Err = fmt.Errorf("close output layer: %w", err)
+		}
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(outputPath)
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"base":   ctx.String("base"),
+		"target": ctx.String("target"),
+		"output": outputPath,
+	}).Debugf("umoci: generating diff layer")
+
+	if err := umoci.LayerFromDiff(context.Background(), baseEngineExt, baseManifest, targetEngineExt, targetManifest, output, &unpackOptions); err != nil {
+		return fmt.Errorf("generate diff layer: %w", err)
+	}
+
+	log.Infof("generated diff layer: %s", outputPath)
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var layoutDiffCommand = cli.Command{
+	Name:  "layout-diff",
+	Usage: "compares the blobs and references of two OCI layouts",
+	ArgsUsage: `<layout-a> <layout-b>
+
+Where "<layout-a>" and "<layout-b>" are the paths to the OCI layouts to
+compare.
+
+Lists the blobs and references (tags) which are only present in one of the
+layouts, as well as the references which are present in both layouts but refer
+to different descriptors. Entries only in <layout-a> are prefixed with "-",
+entries only in <layout-b> with "+" and changed references with "~". Only the
+presence of blobs is compared, see umoci-verify(1) to check their contents.`,
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the differences as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.New("invalid number of positional arguments: expected <layout-a> <layout-b>")
+		}
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.New("layout path cannot be empty")
+			}
+		}
+		return nil
+	},
+
+	Action: layoutDiff,
+}
+
+func layoutDiff(ctx *cli.Context) error {
+	var engines []casext.Engine
+	for _, path := range ctx.Args() {
+		engine, err := dir.Open(path)
+		if err != nil {
+			return fmt.Errorf("open CAS %s: %w", path, err)
+		}
+		defer engine.Close()
+		engines = append(engines, casext.NewEngine(engine))
+	}
+
+	diff, err := umoci.DiffLayouts(context.Background(), engines[0], engines[1])
+	if err != nil {
+		return fmt.Errorf("diff layouts: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(diff); err != nil {
+			return fmt.Errorf("encoding layout diff: %w", err)
+		}
+	} else {
+		if err := diff.Format(os.Stdout); err != nil {
+			return fmt.Errorf("format layout diff: %w", err)
+		}
+	}
+	return nil
+}
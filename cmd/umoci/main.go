@@ -62,6 +62,19 @@ func Main(args []string) error {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.BoolFlag{
+			Name:  "relaxed-refs",
+			Usage: "sanitize tags containing characters disallowed by the OCI specification rather than rejecting them",
+		},
+		cli.StringFlag{
+			Name:  "index-created",
+			Usage: "set the created annotation of the image index and its entries (ISO-8601 timestamp, or @<seconds> since the epoch)",
+		},
+		cli.StringFlag{
+			Name:   "config-file",
+			Usage:  "read default flag values from this file (default: .umoci.yaml, .umoci.yml or .umoci.json if present)",
+			EnvVar: "UMOCI_CONFIG_FILE",
+		},
 		cli.StringFlag{
 			Name:   "cpu-profile",
 			Usage:  "profile umoci during execution and output it to a file",
@@ -72,6 +85,26 @@ func Main(args []string) error {
 	app.Before = func(ctx *cli.Context) error {
 		log.SetHandler(logcli.New(os.Stderr))
 
+		// Load the configuration file before anything else, so that it can
+		// provide defaults for the global flags.
+		configPath, err := findConfigFile(ctx.GlobalString("config-file"))
+		if err != nil {
+			return err
+		}
+		if configPath != "" {
+			config, err := readConfigFile(configPath)
+			if err != nil {
+				return err
+			}
+			if err := config.validate(configSections(ctx.App.Flags, namedCommands("", ctx.App.Commands))); err != nil {
+				return fmt.Errorf("%s: %w", configPath, err)
+			}
+			ctx.App.Metadata["--config-file"] = config
+			if err := applyConfigSection(ctx, config[globalConfigSection]); err != nil {
+				return fmt.Errorf("%s: %w", configPath, err)
+			}
+		}
+
 		if ctx.GlobalBool("verbose") {
 			if ctx.GlobalIsSet("log") {
 				return errors.New("--log=* and --verbose are mutually exclusive")
@@ -86,6 +119,17 @@ func Main(args []string) error {
 			return fmt.Errorf("parsing log level: %w", err)
 		}
 		log.SetLevel(level)
+		if configPath != "" {
+			log.Debugf("umoci: using flag defaults from config file %s", configPath)
+		}
+
+		if ctx.GlobalIsSet("index-created") {
+			created, err := parseIndexCreated(ctx.GlobalString("index-created"))
+			if err != nil {
+				return fmt.Errorf("parsing --index-created: %w", err)
+			}
+			ctx.App.Metadata["--index-created"] = created
+		}
 
 		if path := ctx.GlobalString("cpu-profile"); path != "" {
 			fh, err := os.Create(path)
@@ -109,14 +153,27 @@ func Main(args []string) error {
 		unpackCommand,
 		repackCommand,
 		gcCommand,
+		blobSubcommand,
+		referrersSubcommand,
 		initCommand,
 		newCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
 		statCommand,
+		configHistoryCommand,
 		rawSubcommand,
 		insertCommand,
+		recompressCommand,
+		splitLayerCommand,
+		verifyCommand,
+		chownBundleCommand,
+		indexCommand,
+		layerFromDiffCommand,
+		copyCommand,
+		importCommand,
+		exportCommand,
+		layoutDiffCommand,
 	}
 
 	app.Metadata = map[string]interface{}{}
@@ -156,6 +213,13 @@ func Main(args []string) error {
 		}
 	}
 
+	// The configuration file defaults must be applied before any of the
+	// validation in the .Before of each command, so this has to be the last
+	// wrapper.
+	for name, cmd := range namedCommands("", app.Commands) {
+		*cmd = uxConfigFile(*cmd, name)
+	}
+
 	err := app.Run(args)
 	if err != nil {
 		// If an error is a permission based error, give a hint to the user
@@ -27,7 +27,7 @@ import (
 	"github.com/urfave/cli"
 )
 
-var newCommand = cli.Command{
+var newCommand = uxOutputDescriptor(cli.Command{
 	Name:  "new",
 	Usage: "creates a blank tagged OCI image",
 	ArgsUsage: `--image <image-path>:<new-tag>
@@ -51,7 +51,7 @@ needing a base image to start from.`,
 	},
 
 	Action: newImage,
-}
+})
 
 func newImage(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -65,5 +65,14 @@ func newImage(ctx *cli.Context) error {
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
-	return umoci.NewImage(engineExt, tagName)
+	if err := umoci.NewImage(engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	return recordOutputDescriptor(ctx, engineExt, tagName)
 }
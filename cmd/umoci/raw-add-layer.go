@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/apex/log"
@@ -34,7 +35,7 @@ import (
 	"github.com/urfave/cli"
 )
 
-var rawAddLayerCommand = uxHistory(uxTag(cli.Command{
+var rawAddLayerCommand = uxGCAfter(uxOutputDescriptor(uxHistory(uxTag(cli.Command{
 	Name:  "add-layer",
 	Usage: "add a layer archive verbatim to an image",
 	ArgsUsage: `--image <image-path>[:<tag>] <new-layer.tar>
@@ -63,9 +64,12 @@ only supports uncompressed archives.`,
 			return errors.New("<new-layer.tar> path cannot be empty")
 		}
 		ctx.App.Metadata["newlayer"] = ctx.Args().First()
+		if err := rejectHistoryFiles(ctx); err != nil {
+			return err
+		}
 		return nil
 	},
-}))
+}))))
 
 func rawAddLayer(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -107,6 +111,9 @@ func rawAddLayer(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("create mutator for base image: %w", err)
 	}
+	if redactions, ok := ctx.App.Metadata["--history-redact"].([]*regexp.Regexp); ok {
+		mutator.SetHistoryRedactions(redactions)
+	}
 
 	newLayer, err := os.Open(newLayerPath)
 	if err != nil {
@@ -152,6 +159,9 @@ func rawAddLayer(ctx *cli.Context) error {
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
+		if ctx.IsSet("history-template") {
+			history.CreatedBy = mutate.ExpandHistoryTemplate(ctx.String("history-template"), "raw add-layer", nil, *history.Created)
+		}
 	}
 
 	// TODO: We should add a flag to allow for a new layer to be made
@@ -170,7 +180,16 @@ func rawAddLayer(ctx *cli.Context) error {
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return fmt.Errorf("add new tag: %w", err)
 	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
-	return nil
+	return gcAfter(ctx, engineExt)
 }
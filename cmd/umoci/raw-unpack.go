@@ -21,6 +21,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -28,17 +29,22 @@ import (
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/selinux"
 	"github.com/urfave/cli"
 )
 
 var rawUnpackCommand = uxRemap(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into a rootfs",
-	ArgsUsage: `--image <image-path>[:<tag>] <rootfs>
+	ArgsUsage: `--image <image-path>[:<tag>] [--output <archive>] [<rootfs>]
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<rootfs>"
-is the destination to unpack the image to.`,
+is the destination to unpack the image to.
+
+If --output is specified, the merged root filesystem is instead written as a
+single tar archive to "<archive>" (in the style of "docker export") and no
+"<rootfs>" may be given.`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -48,11 +54,44 @@ is the destination to unpack the image to.`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "numeric-owner",
+			Usage: "only use the numeric uid and gid of entries for ownership, never the user and group names",
+		},
+		cli.BoolFlag{
+			Name:  "sequential-io",
+			Usage: "advise the kernel that layers are read and files are written sequentially",
+		},
+		cli.BoolFlag{
+			Name:  "no-clobber-type-change",
+			Usage: "fail rather than replace a directory with a non-directory (or vice versa)",
+		},
+		cli.BoolFlag{
+			Name:  "strict-xattr",
+			Usage: "fail if an xattr cannot be applied, rather than skipping it with a warning",
+		},
+		cli.BoolFlag{
+			Name:  "selinux-labels",
+			Usage: "label unpacked files with their default labels from the SELinux policy of the host",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "write the merged rootfs as a tar archive to this path rather than unpacking it",
+		},
 	},
 
 	Action: rawUnpack,
 
 	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("output") {
+			if ctx.NArg() != 0 {
+				return errors.New("invalid number of positional arguments: expected none with --output")
+			}
+			if ctx.String("output") == "" {
+				return errors.New("--output path cannot be empty")
+			}
+			return nil
+		}
 		if ctx.NArg() != 1 {
 			return errors.New("invalid number of positional arguments: expected <rootfs>")
 		}
@@ -67,7 +106,7 @@ is the destination to unpack the image to.`,
 func rawUnpack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
-	rootfsPath := ctx.App.Metadata["rootfs"].(string)
+	rootfsPath, _ := ctx.App.Metadata["rootfs"].(string)
 
 	var unpackOptions layer.UnpackOptions
 	var meta umoci.Meta
@@ -81,6 +120,17 @@ func rawUnpack(ctx *cli.Context) error {
 	}
 
 	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions.NumericOwner = ctx.Bool("numeric-owner")
+	unpackOptions.SequentialIO = ctx.Bool("sequential-io")
+	unpackOptions.NoClobberTypeChange = ctx.Bool("no-clobber-type-change")
+	unpackOptions.StrictXattrs = ctx.Bool("strict-xattr")
+	if ctx.Bool("selinux-labels") {
+		fileContexts, err := selinux.HostFileContexts()
+		if err != nil {
+			return fmt.Errorf("--selinux-labels: %w", err)
+		}
+		unpackOptions.SELinuxFileContexts = fileContexts
+	}
 	unpackOptions.MapOptions = meta.MapOptions
 
 	// Get a reference to the CAS.
@@ -127,6 +177,10 @@ func rawUnpack(ctx *cli.Context) error {
 		return fmt.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
 	}
 
+	if ctx.IsSet("output") {
+		return rawExport(engineExt, manifest, ctx.String("output"), &unpackOptions)
+	}
+
 	log.Warnf("unpacking rootfs ...")
 	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfsPath, manifest, &unpackOptions); err != nil {
 		return fmt.Errorf("create rootfs: %w", err)
@@ -136,3 +190,28 @@ func rawUnpack(ctx *cli.Context) error {
 	log.Warnf("unpacked image rootfs: %s", rootfsPath)
 	return nil
 }
+
+func rawExport(engineExt casext.Engine, manifest ispec.Manifest, outputPath string, unpackOptions *layer.UnpackOptions) (Err error) {
+	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("create output archive: %w", err)
+	}
+	defer func() {
+		if err := output.Close(); err != nil && Err == nil {
+			Err = fmt.Errorf("close output archive: %w", err)
+		}
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(outputPath)
+		}
+	}()
+
+	log.Warnf("exporting rootfs ...")
+	if err := layer.ExportRootfs(context.Background(), engineExt, manifest, output, unpackOptions); err != nil {
+		return fmt.Errorf("export rootfs: %w", err)
+	}
+	log.Warnf("... done")
+
+	log.Warnf("exported image rootfs: %s", outputPath)
+	return nil
+}
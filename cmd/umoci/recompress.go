@@ -0,0 +1,145 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var recompressCommand = uxGCAfter(uxOutputDescriptor(uxTag(cli.Command{
+	Name:  "recompress",
+	Usage: "changes the compression of every layer in an image",
+	ArgsUsage: `--image <image-path>[:<tag>] --to <compression>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify, and "<compression>" is the compression to use for the
+new layer blobs ("none", or a compression algorithm such as "gzip", "zstd",
+"zstd:chunked", "lz4" or "zstd;level=19").
+
+The uncompressed contents of each layer are unchanged, so the image
+configuration (including the layer diffids) is not modified.`,
+
+	// recompress modifies an image manifest.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("to") {
+			return errors.New("missing mandatory argument: --to")
+		}
+		compressor, err := uxCompressor(ctx.String("to"))
+		if err != nil {
+			return fmt.Errorf("invalid --to: %w", err)
+		}
+		ctx.App.Metadata["--to"] = compressor
+		return nil
+	},
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "compression to use for the layer blobs (none, gzip, zstd, zstd:chunked, lz4)",
+		},
+	},
+
+	Action: recompress,
+})))
+
+// uxCompressor returns the mutate.Compressor described by the given
+// user-provided compression name.
+func uxCompressor(name string) (mutate.Compressor, error) {
+	if name == "none" {
+		return mutate.NoopCompressor, nil
+	}
+	return mutate.CompressorFromAnnotation(name)
+}
+
+func recompress(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	compressor := ctx.App.Metadata["--to"].(mutate.Compressor)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return fmt.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return fmt.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return fmt.Errorf("create mutator for manifest: %w", err)
+	}
+
+	if err := umoci.Recompress(context.Background(), engineExt, mutator, compressor); err != nil {
+		return fmt.Errorf("recompress layers: %w", err)
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return fmt.Errorf("commit mutated image: %w", err)
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return fmt.Errorf("add new tag: %w", err)
+	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return gcAfter(ctx, engineExt)
+}
@@ -0,0 +1,194 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var referrersSubcommand = cli.Command{
+	Name:  "referrers",
+	Usage: "manages artifacts which refer to an image",
+	ArgsUsage: `referrers <command> [<args>...]
+
+The umoci-referrers(1) subcommands allow for the management of the artifacts
+(such as signatures and SBOMs) in an OCI layout which refer to an image through
+the subject of their manifest.`,
+
+	Subcommands: []cli.Command{
+		referrersListCommand,
+		referrersRemoveCommand,
+	},
+}
+
+var referrersListCommand = cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "lists the referrers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose referrers will be listed.
+
+Gives the digest and artifact type of each referrer of the image, with each
+referrer on a single line. If --artifact-type is specified, only referrers of
+that artifact type are listed.`,
+
+	// referrers list reads an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "only list referrers with this artifact type",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: referrersList,
+}
+
+// resolveSubject returns the descriptor that the given tag refers to in the
+// top-level index, which is the subject referrers of the tagged image refer
+// to.
+func resolveSubject(engineExt casext.Engine, tagName string) (ispec.Descriptor, error) {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(descriptorPaths) == 0 {
+		return ispec.Descriptor{}, fmt.Errorf("tag not found: %s", tagName)
+	}
+	subject := descriptorPaths[0].Root()
+	for _, descriptorPath := range descriptorPaths[1:] {
+		if descriptorPath.Root().Digest != subject.Digest {
+			return ispec.Descriptor{}, fmt.Errorf("tag is ambiguous: %s", tagName)
+		}
+	}
+	return subject, nil
+}
+
+func referrersList(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	subject, err := resolveSubject(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+	referrers, err := engineExt.ListReferrers(context.Background(), subject, ctx.String("artifact-type"))
+	if err != nil {
+		return fmt.Errorf("list referrers: %w", err)
+	}
+	for _, referrer := range referrers {
+		fmt.Printf("%s %s\n", referrer.Digest, referrer.ArtifactType)
+	}
+	return nil
+}
+
+var referrersRemoveCommand = uxGCAfter(cli.Command{
+	Name:    "remove",
+	Aliases: []string{"rm"},
+	Usage:   "removes the referrers of an image with a given artifact type",
+	ArgsUsage: `--image <image-path>[:<tag>] --artifact-type <type>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image whose referrers will be removed, and "<type>" is the artifact type
+of the referrers to remove.
+
+Every entry in the index which refers to a referrer of the image with the given
+artifact type is removed (no matter what its tag is). The blobs of the removed
+referrers are only deleted by the next umoci-gc(1) (or with --gc-after).`,
+
+	// referrers remove modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "artifact type of the referrers to remove (mandatory)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("artifact-type") == "" {
+			return errors.New("missing mandatory argument: --artifact-type")
+		}
+		return nil
+	},
+
+	Action: referrersRemove,
+})
+
+func referrersRemove(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	subject, err := resolveSubject(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+	removed, err := engineExt.RemoveReferrers(context.Background(), subject, ctx.String("artifact-type"))
+	if err != nil {
+		return fmt.Errorf("remove referrers: %w", err)
+	}
+	if len(removed) == 0 {
+		log.Warnf("no referrers of %s with artifact type %s", tagName, ctx.String("artifact-type"))
+	}
+	for _, referrer := range removed {
+		log.Infof("removed referrer: %s", referrer.Digest)
+	}
+
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	return gcAfter(ctx, engineExt)
+}
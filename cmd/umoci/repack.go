@@ -21,6 +21,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"mime"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/apex/log"
@@ -30,11 +33,13 @@ import (
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
 	"github.com/opencontainers/umoci/pkg/mtreefilter"
 	"github.com/urfave/cli"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxGCAfter(uxOutputDescriptor(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -74,6 +79,47 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "refresh-bundle",
 			Usage: "update the bundle metadata to reflect the packed rootfs",
 		},
+		cli.BoolFlag{
+			Name:  "lint-symlinks",
+			Usage: "warn about symlinks in the new layer with absolute targets or targets escaping the rootfs",
+		},
+		cli.BoolFlag{
+			Name:  "record-btime",
+			Usage: "record the birth time of each file in the new layer (if the filesystem supports it)",
+		},
+		cli.BoolFlag{
+			Name:  "cache-layer",
+			Usage: "reuse the previously generated layer if the bundle has the same changes as the last repack",
+		},
+		cli.BoolFlag{
+			Name:  "verify-baseline",
+			Usage: "fail if the bundle's mtree manifest is missing or inconsistent with umoci.json",
+		},
+		cli.BoolFlag{
+			Name:  "file-manifest",
+			Usage: "store a sorted list of the paths and sizes of the entries in the new layer as a separate blob",
+		},
+		cli.BoolFlag{
+			Name:  "diffid-annotation",
+			Usage: "annotate the new layer descriptor with the diffid of the layer",
+		},
+		cli.StringFlag{
+			Name:  "force-owner",
+			Usage: "force every entry in the new layer to be owned by the given uid:gid (rather than the owner of the file)",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression to use for the new layer (gzip, zstd, zstd:chunked, lz4) (default: the compression recorded in the bundle, or gzip)",
+		},
+		cli.StringFlag{
+			Name:  "layer-media-type",
+			Usage: "base media-type of the new layer, to which the compression suffix is appended (default: " + ispec.MediaTypeImageLayer + ")",
+		},
+		cli.IntFlag{
+			Name:  "mtree-concurrency",
+			Usage: "maximum number of files to read concurrently when computing the bundle diff and refreshing the bundle mtree manifest",
+			Value: 1,
+		},
 	},
 
 	Action: repack,
@@ -86,9 +132,32 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.New("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if err := rejectHistoryFiles(ctx); err != nil {
+			return err
+		}
+		if ctx.Int("mtree-concurrency") < 1 {
+			return errors.New("--mtree-concurrency must be at least 1")
+		}
+		if ctx.IsSet("compress") {
+			if _, err := mutate.CompressorFromAnnotation(ctx.String("compress")); err != nil {
+				return fmt.Errorf("invalid --compress: %w", err)
+			}
+		}
+		if ctx.IsSet("layer-media-type") {
+			if err := validateLayerMediaType(ctx.String("layer-media-type")); err != nil {
+				return fmt.Errorf("invalid --layer-media-type: %w", err)
+			}
+		}
+		if ctx.IsSet("force-owner") {
+			owner, err := idtools.ParseOwner(ctx.String("force-owner"))
+			if err != nil {
+				return fmt.Errorf("invalid --force-owner: %w", err)
+			}
+			ctx.App.Metadata["--force-owner"] = owner
+		}
 		return nil
 	},
-})
+})))
 
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -97,7 +166,9 @@ func repack(ctx *cli.Context) error {
 
 	// Read the metadata first.
 	meta, err := umoci.ReadBundleMeta(bundlePath)
-	if err != nil {
+	if errors.Is(err, umoci.ErrNoBundleMeta) {
+		return fmt.Errorf("%w: bundles unpacked with --no-meta cannot be repacked", err)
+	} else if err != nil {
 		return fmt.Errorf("read umoci.json metadata: %w", err)
 	}
 
@@ -107,6 +178,12 @@ func repack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: loaded Meta metadata")
 
+	// --compress overrides the compression the bundle was unpacked with (and
+	// will be recorded in umoci.json if the bundle is refreshed).
+	if ctx.IsSet("compress") {
+		meta.Compression = ctx.String("compress")
+	}
+
 	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
 		return fmt.Errorf("invalid saved from descriptor: descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType)
 	}
@@ -124,6 +201,9 @@ func repack(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("create mutator for base image: %w", err)
 	}
+	if redactions, ok := ctx.App.Metadata["--history-redact"].([]*regexp.Regexp); ok {
+		mutator.SetHistoryRedactions(redactions)
+	}
 
 	// We need to mask config.Volumes.
 	config, err := mutator.Config(context.Background())
@@ -170,11 +250,59 @@ func repack(ctx *cli.Context) error {
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
+		if ctx.IsSet("history-template") {
+			history.CreatedBy = mutate.ExpandHistoryTemplate(ctx.String("history-template"), "repack", nil, *history.Created)
+		}
 	}
 
 	filters := []mtreefilter.FilterFunc{
 		mtreefilter.MaskFilter(maskedPaths),
 	}
 
-	return umoci.Repack(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator)
+	repackOptions := layer.RepackOptions{
+		LintSymlinks:     ctx.Bool("lint-symlinks"),
+		MtreeConcurrency: ctx.Int("mtree-concurrency"),
+		RecordBirthTime:  ctx.Bool("record-btime"),
+		CacheLayer:       ctx.Bool("cache-layer"),
+		VerifyBaseline:   ctx.Bool("verify-baseline"),
+
+		RecordFileManifest: ctx.Bool("file-manifest"),
+		RecordDiffID:       ctx.Bool("diffid-annotation"),
+		LayerMediaType:     ctx.String("layer-media-type"),
+	}
+	if owner, ok := ctx.App.Metadata["--force-owner"].(idtools.Owner); ok {
+		repackOptions.ForceOwner = &owner
+	}
+
+	if err := umoci.RepackWithOptions(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator, &repackOptions); err != nil {
+		return err
+	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	return gcAfter(ctx, engineExt)
+}
+
+// validateLayerMediaType checks that the given --layer-media-type is a plain
+// lowercase "type/subtype" media-type without any parameters.
+func validateLayerMediaType(mediaType string) error {
+	mt, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(params) > 0:
+		return fmt.Errorf("media-type %q must not have parameters", mediaType)
+	case !strings.Contains(mt, "/"):
+		return fmt.Errorf("media-type %q is missing a subtype", mediaType)
+	case mt != mediaType:
+		return fmt.Errorf("media-type %q must be lowercase", mediaType)
+	}
+	return nil
 }
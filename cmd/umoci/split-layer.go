@@ -0,0 +1,176 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var splitLayerCommand = uxGCAfter(uxOutputDescriptor(uxTag(cli.Command{
+	Name:  "split-layer",
+	Usage: "splits a layer of an image into several layers by path",
+	ArgsUsage: `--image <image-path>[:<tag>] --layer <index> --by-path <prefix>[,<prefix>...]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify, "<index>" is the (zero-based) index of the layer to
+split, and each "<prefix>" is a path inside the root filesystem.
+
+The entries of the layer are divided into new layers: one containing all of the
+whiteouts in the layer, one containing the entries not under any prefix, and
+one for each prefix (in the order given). Empty layers are omitted. Applying
+the new layers has the same effect as applying the original layer.`,
+
+	// split-layer modifies an image manifest.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.New("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("layer") {
+			return errors.New("missing mandatory argument: --layer")
+		}
+		var prefixes []string
+		for _, value := range ctx.StringSlice("by-path") {
+			for _, prefix := range strings.Split(value, ",") {
+				if prefix == "" {
+					return errors.New("--by-path prefixes cannot be empty")
+				}
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			return errors.New("missing mandatory argument: --by-path")
+		}
+		ctx.App.Metadata["--by-path"] = prefixes
+		if ctx.Int("concurrency") < 1 {
+			return errors.New("--concurrency must be at least 1")
+		}
+		if ctx.IsSet("compress") {
+			compressor, err := uxCompressor(ctx.String("compress"))
+			if err != nil {
+				return fmt.Errorf("invalid --compress: %w", err)
+			}
+			ctx.App.Metadata["--compress"] = compressor
+		}
+		return nil
+	},
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "layer",
+			Usage: "index of the layer to split",
+		},
+		cli.StringSliceFlag{
+			Name:  "by-path",
+			Usage: "comma-separated path prefixes to split the layer by (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression to use for the new layer blobs (default: same as the original layer)",
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "maximum number of new layer blobs to compress and write at the same time",
+			Value: 1,
+		},
+	},
+
+	Action: splitLayer,
+})))
+
+func splitLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	layerIndex := ctx.Int("layer")
+	prefixes := ctx.App.Metadata["--by-path"].([]string)
+
+	var compressor mutate.Compressor
+	if val, ok := ctx.App.Metadata["--compress"]; ok {
+		compressor = val.(mutate.Compressor)
+	}
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return fmt.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return fmt.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return fmt.Errorf("create mutator for manifest: %w", err)
+	}
+	mutator.SetBlobConcurrency(ctx.Int("concurrency"))
+
+	if err := umoci.SplitLayer(context.Background(), engineExt, mutator, layerIndex, prefixes, compressor); err != nil {
+		return err
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return fmt.Errorf("commit mutated image: %w", err)
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return fmt.Errorf("add new tag: %w", err)
+	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return gcAfter(ctx, engineExt)
+}
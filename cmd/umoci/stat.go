@@ -50,6 +50,9 @@ humans to read, and might change in future versions.`,
 		if ctx.NArg() != 0 {
 			return errors.New("invalid number of positional arguments: expected none")
 		}
+		if ctx.Int("last") < 0 {
+			return errors.New("--last must be a non-negative integer")
+		}
 		return nil
 	},
 
@@ -58,6 +61,14 @@ humans to read, and might change in future versions.`,
 			Name:  "json",
 			Usage: "output the stat information as a JSON encoded blob",
 		},
+		cli.BoolFlag{
+			Name:  "security-lint",
+			Usage: "scan the image layers for setuid, setgid and world-writable entries",
+		},
+		cli.IntFlag{
+			Name:  "last",
+			Usage: "only show the last <n> history entries (0 shows all entries)",
+		},
 	},
 
 	Action: stat,
@@ -98,6 +109,13 @@ func stat(ctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("stat: %w", err)
 	}
+	ms.TrimHistory(ctx.Int("last"))
+	if ctx.Bool("security-lint") {
+		ms.SecurityIssues, err = umoci.SecurityLint(context.Background(), engineExt, manifestDescriptor)
+		if err != nil {
+			return fmt.Errorf("security lint: %w", err)
+		}
+	}
 
 	// Output the stat information.
 	if ctx.Bool("json") {
@@ -23,38 +23,58 @@ import (
 	"fmt"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/urfave/cli"
 )
 
-var tagAddCommand = cli.Command{
+var tagAddCommand = uxGCAfter(uxOutputDescriptor(cli.Command{
 	Name:  "tag",
 	Usage: "creates a new tag in an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the old name of
-the tag and "<new-tag>" is the new name of the tag.`,
+the tag and "<new-tag>" is the new name of the tag.
+
+If "<new-tag>" already exists, umoci-tag(1) will fail unless --overwrite (to
+replace the existing tag) or --if-not-exists (to leave the existing tag
+untouched) is specified.`,
 
 	// tag modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "replace <new-tag> if it already exists",
+		},
+		cli.BoolFlag{
+			Name:  "if-not-exists",
+			Usage: "do nothing if <new-tag> already exists",
+		},
+	},
+
 	Action: tagAdd,
 
 	Before: func(ctx *cli.Context) error {
+		if ctx.Bool("overwrite") && ctx.Bool("if-not-exists") {
+			return errors.New("--overwrite and --if-not-exists are mutually exclusive")
+		}
 		if ctx.NArg() != 1 {
 			return errors.New("invalid number of positional arguments: expected <new-tag>")
 		}
 		if ctx.Args().First() == "" {
 			return errors.New("new tag cannot be empty")
 		}
-		if !casext.IsValidReferenceName(ctx.Args().First()) {
-			return errors.New("new tag is an invalid reference")
+		newTag, err := uxReferenceName(ctx, ctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("new tag is an invalid reference: %w", err)
 		}
-		ctx.App.Metadata["new-tag"] = ctx.Args().First()
+		ctx.App.Metadata["new-tag"] = newTag
 		return nil
 	},
-}
+}))
 
 func tagAdd(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -83,16 +103,49 @@ func tagAdd(ctx *cli.Context) error {
 	}
 	descriptor := descriptorPaths[0].Descriptor()
 
+	// The original name of the old tag (if it was sanitized) doesn't apply to
+	// the new tag.
+	if _, ok := descriptor.Annotations[casext.UmociOriginalRefNameAnnotation]; ok {
+		annotations := map[string]string{}
+		for key, value := range descriptor.Annotations {
+			if key != casext.UmociOriginalRefNameAnnotation {
+				annotations[key] = value
+			}
+		}
+		descriptor.Annotations = annotations
+	}
+
 	// Add it.
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+	if ctx.Bool("overwrite") {
+		err = engineExt.UpdateReference(context.Background(), tagName, descriptor)
+	} else {
+		err = engineExt.AddReference(context.Background(), tagName, descriptor)
+		if errors.Is(err, cas.ErrClobber) {
+			if ctx.Bool("if-not-exists") {
+				log.Infof("tag already exists, leaving it unchanged: %q", tagName)
+				return recordOutputDescriptor(ctx, engineExt, tagName)
+			}
+			return fmt.Errorf("tag already exists (use --overwrite to replace it): %s", tagName)
+		}
+	}
+	if err != nil {
 		return fmt.Errorf("put reference: %w", err)
 	}
+	if err := recordRelaxedReference(ctx, engineExt, tagName); err != nil {
+		return err
+	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
+	if err := recordOutputDescriptor(ctx, engineExt, tagName); err != nil {
+		return err
+	}
 
 	log.Infof("created new tag: %q -> %q", tagName, fromName)
-	return nil
+	return gcAfter(ctx, engineExt)
 }
 
-var tagRemoveCommand = cli.Command{
+var tagRemoveCommand = uxGCAfter(cli.Command{
 	Name:    "remove",
 	Aliases: []string{"rm"},
 	Usage:   "removes a tag from an OCI image",
@@ -113,7 +166,7 @@ tag to remove.`,
 	},
 
 	Action: tagRemove,
-}
+})
 
 func tagRemove(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -131,9 +184,12 @@ func tagRemove(ctx *cli.Context) error {
 	if err := engineExt.DeleteReference(context.Background(), tagName); err != nil {
 		return fmt.Errorf("delete reference: %w", err)
 	}
+	if err := recordIndexCreated(ctx, engineExt); err != nil {
+		return err
+	}
 
 	log.Infof("removed tag: %s", tagName)
-	return nil
+	return gcAfter(ctx, engineExt)
 }
 
 var tagListCommand = cli.Command{
@@ -20,11 +20,14 @@ package main
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/selinux"
 	"github.com/urfave/cli"
 )
 
@@ -49,6 +52,67 @@ creation with umoci-repack(1).`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "numeric-owner",
+			Usage: "only use the numeric uid and gid of entries for ownership, never the user and group names",
+		},
+		cli.BoolFlag{
+			Name:  "sequential-io",
+			Usage: "advise the kernel that layers are read and files are written sequentially",
+		},
+		cli.BoolFlag{
+			Name:  "no-clobber-type-change",
+			Usage: "fail rather than replace a directory with a non-directory (or vice versa)",
+		},
+		cli.BoolFlag{
+			Name:  "strict-xattr",
+			Usage: "fail if an xattr cannot be applied, rather than skipping it with a warning",
+		},
+		cli.BoolFlag{
+			Name:  "selinux-labels",
+			Usage: "label unpacked files with their default labels from the SELinux policy of the host",
+		},
+		cli.IntFlag{
+			Name:  "mtree-concurrency",
+			Usage: "maximum number of files to read concurrently when generating the bundle mtree manifest",
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "decompress-ahead",
+			Usage: "number of upcoming layers to decompress in the background while each layer is extracted",
+		},
+		cli.BoolFlag{
+			Name:  "record-entry-order",
+			Usage: "record the order of layer entries so that umoci-repack(1) can reproduce it",
+		},
+		cli.BoolFlag{
+			Name:  "no-meta",
+			Usage: "do not write the umoci.json metadata or mtree manifest (the bundle cannot be repacked)",
+		},
+		cli.BoolFlag{
+			Name:  "self-check",
+			Usage: "verify the unpacked rootfs against the generated mtree manifest",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-meta",
+			Usage: "keep user-added fields from an existing umoci.json in the bundle",
+		},
+		cli.StringFlag{
+			Name:  "hint-annotations",
+			Usage: "derive the whiteout mode and repack compression from manifest annotations with this prefix",
+		},
+		cli.BoolFlag{
+			Name:  "detect-sparse",
+			Usage: "leave blocks of zeroes in unpacked files as holes to save disk space",
+		},
+		cli.StringFlag{
+			Name:  "reflink-from",
+			Usage: "reflink unchanged files from an earlier unpack of the image in this bundle",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/arch[/variant]) of the manifest to unpack from a multi-platform image (default: host platform)",
+		},
 	},
 
 	Action: unpack,
@@ -61,6 +125,26 @@ creation with umoci-repack(1).`,
 			return errors.New("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.Int("mtree-concurrency") < 1 {
+			return errors.New("--mtree-concurrency must be at least 1")
+		}
+		if ctx.Int("decompress-ahead") < 0 {
+			return errors.New("--decompress-ahead cannot be negative")
+		}
+		if ctx.IsSet("platform") {
+			platform, err := casext.ParsePlatform(ctx.String("platform"))
+			if err != nil {
+				return fmt.Errorf("--platform: %w", err)
+			}
+			ctx.App.Metadata["--platform"] = platform
+		}
+		if ctx.Bool("no-meta") {
+			for _, flag := range []string{"preserve-meta", "record-entry-order", "self-check"} {
+				if ctx.IsSet(flag) {
+					return fmt.Errorf("--no-meta and --%s are mutually exclusive", flag)
+				}
+			}
+		}
 		return nil
 	},
 })
@@ -81,6 +165,35 @@ func unpack(ctx *cli.Context) error {
 	}
 
 	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions.NumericOwner = ctx.Bool("numeric-owner")
+	unpackOptions.SequentialIO = ctx.Bool("sequential-io")
+	unpackOptions.NoClobberTypeChange = ctx.Bool("no-clobber-type-change")
+	unpackOptions.StrictXattrs = ctx.Bool("strict-xattr")
+	unpackOptions.DetectSparse = ctx.Bool("detect-sparse")
+	if ctx.Bool("selinux-labels") {
+		fileContexts, err := selinux.HostFileContexts()
+		if err != nil {
+			return fmt.Errorf("--selinux-labels: %w", err)
+		}
+		unpackOptions.SELinuxFileContexts = fileContexts
+	}
+	unpackOptions.MtreeConcurrency = ctx.Int("mtree-concurrency")
+	unpackOptions.DecompressAhead = ctx.Int("decompress-ahead")
+	unpackOptions.RecordEntryOrder = ctx.Bool("record-entry-order")
+	unpackOptions.PreserveMeta = ctx.Bool("preserve-meta")
+	unpackOptions.NoMeta = ctx.Bool("no-meta")
+	unpackOptions.SelfCheck = ctx.Bool("self-check")
+	unpackOptions.AnnotationHintPrefix = ctx.String("hint-annotations")
+	if reflinkFrom := ctx.String("reflink-from"); reflinkFrom != "" {
+		// Make sure we were actually given a bundle.
+		if _, err := umoci.ReadBundleMeta(reflinkFrom); err != nil {
+			return fmt.Errorf("--reflink-from %s: %w", reflinkFrom, err)
+		}
+		unpackOptions.ReflinkFrom = filepath.Join(reflinkFrom, layer.RootfsName)
+	}
+	if platform, ok := ctx.App.Metadata["--platform"].(ispec.Platform); ok {
+		unpackOptions.Platform = platform
+	}
 	unpackOptions.MapOptions = meta.MapOptions
 
 	// Get a reference to the CAS.
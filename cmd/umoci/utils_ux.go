@@ -18,11 +18,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/casext"
+	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/urfave/cli"
 )
 
@@ -35,11 +44,163 @@ func flattenCommands(cmds []cli.Command) []*cli.Command {
 	return flatten
 }
 
+// uxReferenceName validates a user-provided reference name. If --relaxed-refs
+// was specified, invalid reference names are sanitized with
+// casext.SanitizeReferenceName (rather than being rejected) and the original
+// name is stored in ctx.App.Metadata["--relaxed-refs"] so that it can be
+// recorded by recordRelaxedReference once the reference has been stored.
+func uxReferenceName(ctx *cli.Context, refname string) (string, error) {
+	if casext.IsValidReferenceName(refname) {
+		return refname, nil
+	}
+	if !ctx.GlobalBool("relaxed-refs") {
+		return "", fmt.Errorf("tag contains invalid characters: %q", refname)
+	}
+	sanitized, err := casext.SanitizeReferenceName(refname)
+	if err != nil {
+		return "", err
+	}
+	originals, ok := ctx.App.Metadata["--relaxed-refs"].(map[string]string)
+	if !ok {
+		originals = map[string]string{}
+		ctx.App.Metadata["--relaxed-refs"] = originals
+	}
+	originals[sanitized] = refname
+	log.Warnf("tag %q contains invalid characters: using %q instead", refname, sanitized)
+	return sanitized, nil
+}
+
+// recordRelaxedReference records the original name of refname in the image
+// index, if refname was sanitized by uxReferenceName. It must be called after
+// refname has been stored in the index.
+func recordRelaxedReference(ctx *cli.Context, engineExt casext.Engine, refname string) error {
+	originals, _ := ctx.App.Metadata["--relaxed-refs"].(map[string]string)
+	original, ok := originals[refname]
+	if !ok {
+		return nil
+	}
+	if err := engineExt.SetOriginalReferenceName(context.Background(), refname, original); err != nil {
+		return fmt.Errorf("record original tag name: %w", err)
+	}
+	return nil
+}
+
+// parseIndexCreated parses the value of --index-created. It accepts an
+// ISO-8601 timestamp, or a number of seconds since the Unix epoch prefixed
+// with "@" (so that "@$SOURCE_DATE_EPOCH" can be used).
+func parseIndexCreated(value string) (time.Time, error) {
+	if seconds := strings.TrimPrefix(value, "@"); seconds != value {
+		n, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parse epoch: %w", err)
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(igen.ISO8601, value)
+}
+
+// recordIndexCreated sets the created annotation of the image index and all
+// of its entries, if --index-created was specified. It must be called after
+// any modifications to the image index have been made.
+func recordIndexCreated(ctx *cli.Context, engineExt casext.Engine) error {
+	created, ok := ctx.App.Metadata["--index-created"].(time.Time)
+	if !ok {
+		return nil
+	}
+	if err := engineExt.SetIndexCreated(context.Background(), created); err != nil {
+		return fmt.Errorf("set index created annotation: %w", err)
+	}
+	return nil
+}
+
+// uxGCAfter adds a --gc-after flag to the given cli.Command. Commands must
+// call gcAfter once they have successfully committed all of their changes.
+func uxGCAfter(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.BoolFlag{
+		Name:  "gc-after",
+		Usage: "garbage-collect any blobs which are no longer reachable once the operation has succeeded",
+	})
+	return cmd
+}
+
+// gcAfter garbage-collects the image if --gc-after was specified. Since it
+// removes everything that is not reachable from the index, it must only be
+// called after the command has successfully updated the index.
+func gcAfter(ctx *cli.Context, engineExt casext.Engine) error {
+	if !ctx.Bool("gc-after") {
+		return nil
+	}
+	if err := engineExt.GC(context.Background()); err != nil {
+		return fmt.Errorf("gc: %w", err)
+	}
+	return nil
+}
+
+// uxOutputDescriptor adds an --output-descriptor flag to the given
+// cli.Command. Commands must call recordOutputDescriptor once the resulting
+// reference has been stored in the index.
+func uxOutputDescriptor(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "output-descriptor",
+		Usage: "write the descriptor of the resulting image to this path (as JSON)",
+	})
+	return cmd
+}
+
+// outputDescriptor is the format of the file written by --output-descriptor.
+type outputDescriptor struct {
+	// Descriptor is the descriptor stored in the index for the reference.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// DescriptorPath is the path from Descriptor to the image manifest. It is
+	// omitted if the reference refers to more than one image manifest (such
+	// as with umoci-index(1)).
+	DescriptorPath *casext.DescriptorPath `json:"descriptor_path,omitempty"`
+}
+
+// recordOutputDescriptor writes the descriptor of refname to the path given
+// with --output-descriptor (if it was specified). It must be called after
+// refname has been stored in the index.
+func recordOutputDescriptor(ctx *cli.Context, engineExt casext.Engine, refname string) error {
+	path := ctx.String("output-descriptor")
+	if path == "" {
+		return nil
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), refname)
+	if err != nil {
+		return fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(descriptorPaths) == 0 {
+		return fmt.Errorf("tag not found: %s", refname)
+	}
+	output := outputDescriptor{
+		Descriptor: descriptorPaths[0].Root(),
+	}
+	if len(descriptorPaths) == 1 {
+		output.DescriptorPath = &descriptorPaths[0]
+	}
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return fmt.Errorf("marshal output descriptor: %w", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write output descriptor: %w", err)
+	}
+	return nil
+}
+
 // uxHistory adds the full set of --history.* flags to the given cli.Command as
 // well as adding relevant validation logic to the .Before of the command. The
 // values will be stored in ctx.Metadata with the keys "--history.author",
 // "--history.created", "--history.created_by", "--history.comment", with
-// string values. If they are not set the value will be nil.
+// string values. If they are not set the value will be nil. --history-template
+// is also added, which callers should expand with mutate.ExpandHistoryTemplate
+// to produce the created_by value. The patterns given with --history-redact and
+// --history-redact-file are compiled and stored in ctx.Metadata["--history-redact"]
+// as a []*regexp.Regexp (or nil if neither was specified), and callers should
+// pass them to mutate.Mutator.SetHistoryRedactions.
 func uxHistory(cmd cli.Command) cli.Command {
 	historyFlags := []cli.Flag{
 		cli.BoolFlag{
@@ -62,8 +223,24 @@ func uxHistory(cmd cli.Command) cli.Command {
 			Name:  "history.created_by",
 			Usage: "created_by value for the history entry",
 		},
+		cli.StringFlag{
+			Name:  "history-template",
+			Usage: "template for the created_by value of the history entry (supports {op}, {files}, {time})",
+		},
 	}
 	cmd.Flags = append(cmd.Flags, historyFlags...)
+	// Redactions apply to the existing history as well, so they are not
+	// incompatible with --no-history.
+	cmd.Flags = append(cmd.Flags,
+		cli.StringSliceFlag{
+			Name:  "history-redact",
+			Usage: "regular expression to redact from the created_by value of all history entries (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "history-redact-file",
+			Usage: "file containing --history-redact patterns (one per line)",
+		},
+	)
 
 	oldBefore := cmd.Before
 	cmd.Before = func(ctx *cli.Context) error {
@@ -77,6 +254,30 @@ func uxHistory(cmd cli.Command) cli.Command {
 				}
 			}
 		}
+		if ctx.IsSet("history.created_by") && ctx.IsSet("history-template") {
+			return errors.New("--history.created_by and --history-template may not be specified together")
+		}
+
+		// Compile the set of redaction patterns.
+		patterns := ctx.StringSlice("history-redact")
+		if ctx.IsSet("history-redact-file") {
+			filePatterns, err := readHistoryRedactFile(ctx.String("history-redact-file"))
+			if err != nil {
+				return fmt.Errorf("invalid --history-redact-file: %w", err)
+			}
+			patterns = append(patterns, filePatterns...)
+		}
+		if len(patterns) > 0 {
+			var redactions []*regexp.Regexp
+			for _, pattern := range patterns {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid --history-redact pattern %q: %w", pattern, err)
+				}
+				redactions = append(redactions, re)
+			}
+			ctx.App.Metadata["--history-redact"] = redactions
+		}
 
 		// Include any old befores set.
 		if oldBefore != nil {
@@ -88,9 +289,41 @@ func uxHistory(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// rejectHistoryFiles returns an error if --history-template uses the {files}
+// placeholder. It is used by commands which generate layers but cannot list
+// the paths they changed when the history entry is created, where expanding
+// {files} to nothing would be misleading.
+func rejectHistoryFiles(ctx *cli.Context) error {
+	if strings.Contains(ctx.String("history-template"), "{files}") {
+		return fmt.Errorf("--history-template: {files} is not supported by umoci %s", ctx.Command.FullName())
+	}
+	return nil
+}
+
+// readHistoryRedactFile reads the set of redaction patterns from the given
+// file. Each non-empty line is a pattern, and lines starting with '#' are
+// ignored.
+func readHistoryRedactFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
 // uxTag adds a --tag flag to the given cli.Command as well as adding relevant
 // validation logic to the .Before of the command. The value will be stored in
-// ctx.Metadata["--tag"] as a string (or nil if --tag was not specified).
+// ctx.Metadata["--tag"] as a string (or nil if --tag was not specified). If
+// --relaxed-refs was specified, the stored tag may have been sanitized (see
+// uxReferenceName).
 func uxTag(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, cli.StringFlag{
 		Name:  "tag",
@@ -102,12 +335,13 @@ func uxTag(cmd cli.Command) cli.Command {
 		// Verify tag value.
 		if ctx.IsSet("tag") {
 			tag := ctx.String("tag")
-			if !casext.IsValidReferenceName(tag) {
-				return fmt.Errorf("invalid --tag: tag contains invalid characters: %q", tag)
-			}
 			if tag == "" {
 				return errors.New("invalid --tag: tag is empty")
 			}
+			tag, err := uxReferenceName(ctx, tag)
+			if err != nil {
+				return fmt.Errorf("invalid --tag: %w", err)
+			}
 			ctx.App.Metadata["--tag"] = tag
 		}
 
@@ -121,11 +355,42 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// parseImageRef parses an image reference of the form "path[:tag]" given with
+// the --<flag> flag, returning the path and the (possibly sanitized, see
+// uxReferenceName) tag. If no tag is given, "latest" is used.
+func parseImageRef(ctx *cli.Context, flag, image string) (string, string, error) {
+	var dir, tag string
+	sep := strings.Index(image, ":")
+	if sep == -1 {
+		dir = image
+		tag = "latest"
+	} else {
+		dir = image[:sep]
+		tag = image[sep+1:]
+	}
+
+	// Verify directory value.
+	if dir == "" {
+		return "", "", fmt.Errorf("invalid --%s: path is empty", flag)
+	}
+
+	// Verify tag value.
+	if tag == "" {
+		return "", "", fmt.Errorf("invalid --%s: tag is empty", flag)
+	}
+	tag, err := uxReferenceName(ctx, tag)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid --%s: %w", flag, err)
+	}
+	return dir, tag, nil
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
 // ctx.Metadata["--image-tag"] as strings (both will be nil if --image is not
-// specified).
+// specified). If --relaxed-refs was specified, the stored tag may have been
+// sanitized (see uxReferenceName).
 func uxImage(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, cli.StringFlag{
 		Name:  "image",
@@ -136,29 +401,9 @@ func uxImage(cmd cli.Command) cli.Command {
 	cmd.Before = func(ctx *cli.Context) error {
 		// Verify and parse --image.
 		if ctx.IsSet("image") {
-			image := ctx.String("image")
-
-			var dir, tag string
-			sep := strings.Index(image, ":")
-			if sep == -1 {
-				dir = image
-				tag = "latest"
-			} else {
-				dir = image[:sep]
-				tag = image[sep+1:]
-			}
-
-			// Verify directory value.
-			if dir == "" {
-				return errors.New("invalid --image: path is empty")
-			}
-
-			// Verify tag value.
-			if !casext.IsValidReferenceName(tag) {
-				return fmt.Errorf("invalid --image: tag contains invalid characters: %q", tag)
-			}
-			if tag == "" {
-				return errors.New("invalid --image: tag is empty")
+			dir, tag, err := parseImageRef(ctx, "image", ctx.String("image"))
+			if err != nil {
+				return err
 			}
 
 			ctx.App.Metadata["--image-path"] = dir
@@ -0,0 +1,110 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/urfave/cli"
+)
+
+var verifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "verifies the integrity of tagged images in an OCI layout",
+	ArgsUsage: `--layout <image-path> [<tag>...]
+
+Where "<image-path>" is the path to the OCI layout, and "<tag>" is the name of
+a tagged image to verify. If no tags are given, every tag in the layout is
+verified.
+
+Every blob reachable from each tag is read in full and checked against the
+digest and size of the descriptor referencing it. Tags are verified
+concurrently (see --concurrency), and the result for each tag is printed once
+all tags have been verified. By default a failure to verify one tag does not
+stop the others from being verified (see --fail-fast).`,
+
+	// verify reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "maximum number of tags to verify concurrently",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "stop verifying further tags after the first failure",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.Int("concurrency") < 1 {
+			return errors.New("--concurrency must be at least 1")
+		}
+		return nil
+	},
+
+	Action: verify,
+}
+
+func verify(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("open CAS: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	names := ctx.Args()
+	if len(names) == 0 {
+		names, err = engineExt.ListReferences(context.Background())
+		if err != nil {
+			return fmt.Errorf("list references: %w", err)
+		}
+	}
+
+	results := umoci.ForEachReference(context.Background(), names, ctx.Int("concurrency"), ctx.Bool("fail-fast"),
+		func(ctx context.Context, name string) error {
+			return umoci.VerifyReference(ctx, engineExt, name)
+		})
+
+	var failed int
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("%s: FAILED: %v\n", result.Reference, result.Err)
+			log.Debugf("verify %s: %+v", result.Reference, result.Err)
+			continue
+		}
+		fmt.Printf("%s: OK\n", result.Reference)
+	}
+	if failed > 0 {
+		return fmt.Errorf("verify: %d of %d tags failed verification", failed, len(results))
+	}
+	return nil
+}
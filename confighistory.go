@@ -0,0 +1,346 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// ConfigState is the subset of an image configuration which can be recovered
+// from the Dockerfile directives recorded in the history of an image.
+type ConfigState struct {
+	// Env is the set of environment variables, in the same "KEY=value" form
+	// as ispec.ImageConfig.Env.
+	Env []string `json:"env"`
+
+	// Cmd is the default command.
+	Cmd []string `json:"cmd"`
+
+	// Labels is the set of labels.
+	Labels map[string]string `json:"labels"`
+}
+
+// copy returns a deep copy of the ConfigState.
+func (cs ConfigState) copy() ConfigState {
+	newState := ConfigState{
+		Env:    append([]string(nil), cs.Env...),
+		Cmd:    append([]string(nil), cs.Cmd...),
+		Labels: map[string]string{},
+	}
+	for key, value := range cs.Labels {
+		newState.Labels[key] = value
+	}
+	return newState
+}
+
+// setEnv sets the environment variable key to value, replacing any existing
+// value but keeping its position in Env.
+func (cs *ConfigState) setEnv(key, value string) {
+	for idx, env := range cs.Env {
+		if strings.SplitN(env, "=", 2)[0] == key {
+			cs.Env[idx] = key + "=" + value
+			return
+		}
+	}
+	cs.Env = append(cs.Env, key+"="+value)
+}
+
+// ConfigHistoryStep is a single entry in a ConfigHistory.
+type ConfigHistoryStep struct {
+	// Directive is the directive ("ENV", "CMD" or "LABEL") that was parsed
+	// from the CreatedBy field of the history entry. It is empty if the
+	// history entry did not modify the configuration (or umoci could not
+	// figure out how it did so).
+	Directive string `json:"directive,omitempty"`
+
+	// Config is the reconstructed configuration after this step.
+	Config ConfigState `json:"config"`
+
+	// History is embedded in the step information.
+	ispec.History
+}
+
+// ConfigHistory describes how the configuration of an image evolved over the
+// course of its history, as reconstructed by ReconstructConfigHistory.
+type ConfigHistory struct {
+	// Steps is the set of steps, in the same order as the image history.
+	Steps []ConfigHistoryStep `json:"steps"`
+}
+
+// ReconstructConfigHistory reconstructs how the environment, default command
+// and labels of an image evolved over the given history. This is done on a
+// best-effort basis by parsing the "#(nop)" directives recorded in CreatedBy
+// by "docker build" (and the equivalent directives recorded by BuildKit), so
+// changes made by other tools will not be visible and the result may not
+// match the actual image configuration.
+func ReconstructConfigHistory(history []ispec.History) ConfigHistory {
+	var (
+		configHistory ConfigHistory
+		state         = ConfigState{Labels: map[string]string{}}
+	)
+	for _, histEntry := range history {
+		step := ConfigHistoryStep{History: histEntry}
+		if directive, args, ok := parseHistoryDirective(histEntry.CreatedBy); ok {
+			state = state.copy()
+			switch directive {
+			case "ENV":
+				for _, kv := range parseHistoryKeyValues(args) {
+					state.setEnv(kv[0], kv[1])
+				}
+			case "LABEL":
+				for _, kv := range parseHistoryKeyValues(args) {
+					state.Labels[kv[0]] = kv[1]
+				}
+			case "CMD":
+				state.Cmd = parseHistoryCmd(args)
+			}
+			step.Directive = directive
+		}
+		step.Config = state
+		configHistory.Steps = append(configHistory.Steps, step)
+	}
+	return configHistory
+}
+
+// StatConfigHistory computes the ConfigHistory of the given manifest using
+// ReconstructConfigHistory. The provided descriptor must refer to an OCI
+// Manifest with a standard image configuration.
+func StatConfigHistory(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (ConfigHistory, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ConfigHistory{}, fmt.Errorf("config history: cannot stat a non-manifest descriptor: invalid media type %q", manifestDescriptor.MediaType)
+	}
+
+	manifestBlob, err := engine.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return ConfigHistory{}, fmt.Errorf("config history: %w", err)
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ConfigHistory{}, fmt.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return ConfigHistory{}, fmt.Errorf("config history: %w", err)
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return ConfigHistory{}, fmt.Errorf("config history: unsupported config media type %q", configBlob.Descriptor.MediaType)
+	}
+	return ReconstructConfigHistory(config.History), nil
+}
+
+// Format formats a ConfigHistory using the default formatting, and writes the
+// result to the given writer. Each step is followed by the configuration
+// changes it made.
+func (ch ConfigHistory) Format(w io.Writer) error {
+	prev := ConfigState{Labels: map[string]string{}}
+	for idx, step := range ch.Steps {
+		createdBy := strings.Replace(step.CreatedBy, "\n", " ", -1)
+		if _, err := fmt.Fprintf(w, "STEP %d: %s\n", idx, createdBy); err != nil {
+			return err
+		}
+		for _, change := range configChanges(prev, step.Config) {
+			if _, err := fmt.Fprintf(w, "    %s\n", change); err != nil {
+				return err
+			}
+		}
+		prev = step.Config
+	}
+	return nil
+}
+
+// configChanges returns a human-readable description of the changes between
+// two ConfigStates.
+func configChanges(oldState, newState ConfigState) []string {
+	var changes []string
+
+	oldEnv := map[string]string{}
+	for _, env := range oldState.Env {
+		kv := strings.SplitN(env, "=", 2)
+		oldEnv[kv[0]] = env
+	}
+	for _, env := range newState.Env {
+		if oldEnv[strings.SplitN(env, "=", 2)[0]] != env {
+			changes = append(changes, "ENV "+env)
+		}
+	}
+
+	if strings.Join(oldState.Cmd, "\x00") != strings.Join(newState.Cmd, "\x00") || len(oldState.Cmd) != len(newState.Cmd) {
+		cmd, _ := json.Marshal(newState.Cmd)
+		changes = append(changes, "CMD "+string(cmd))
+	}
+
+	var labels []string
+	for key, value := range newState.Labels {
+		if oldValue, ok := oldState.Labels[key]; !ok || oldValue != value {
+			labels = append(labels, key)
+		}
+	}
+	sort.Strings(labels)
+	for _, key := range labels {
+		changes = append(changes, fmt.Sprintf("LABEL %s=%s", key, newState.Labels[key]))
+	}
+	return changes
+}
+
+// parseHistoryDirective parses a history CreatedBy string, returning the
+// configuration directive (in upper-case) it describes along with its
+// arguments. Both the "docker build" format ("/bin/sh -c #(nop)  ENV a=b")
+// and the BuildKit format ("ENV a=b") are supported. ok is false if createdBy
+// doesn't describe an ENV, CMD or LABEL directive.
+func parseHistoryDirective(createdBy string) (directive, args string, ok bool) {
+	line := strings.TrimSpace(createdBy)
+	if idx := strings.Index(line, "#(nop)"); idx >= 0 {
+		line = line[idx+len("#(nop)"):]
+	}
+	line = strings.TrimSpace(strings.TrimSuffix(line, "# buildkit"))
+
+	fields := strings.SplitN(line, " ", 2)
+	directive = strings.ToUpper(fields[0])
+	switch directive {
+	case "ENV", "CMD", "LABEL":
+	default:
+		return "", "", false
+	}
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return directive, args, true
+}
+
+// parseHistoryKeyValues parses the arguments of an ENV or LABEL directive
+// into a list of key-value pairs. Both the "key=value ..." and legacy
+// "key value" forms are supported. Because "docker build" doesn't quote the
+// values it records, words without a "=" are treated as a continuation of
+// the previous value.
+func parseHistoryKeyValues(args string) [][2]string {
+	words := splitHistoryWords(args)
+	if len(words) == 0 {
+		return nil
+	}
+	if !strings.Contains(words[0], "=") {
+		return [][2]string{{words[0], strings.Join(words[1:], " ")}}
+	}
+
+	var kvs [][2]string
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) == 2 {
+			kvs = append(kvs, [2]string{kv[0], kv[1]})
+		} else if len(kvs) > 0 {
+			kvs[len(kvs)-1][1] += " " + word
+		}
+	}
+	return kvs
+}
+
+// splitHistoryWords splits s into words in a similar manner to a shell,
+// handling single and double quotes as well as backslash escapes.
+func splitHistoryWords(s string) []string {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// parseHistoryCmd parses the arguments of a CMD directive. The exec form may
+// either be a JSON array or a list of Go-quoted strings (which is how both
+// "docker build" and BuildKit record it). Anything else is treated as the
+// shell form.
+func parseHistoryCmd(args string) []string {
+	if strings.HasPrefix(args, "[") && strings.HasSuffix(args, "]") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(args), &cmd); err == nil {
+			return cmd
+		}
+		if cmd, ok := parseQuotedList(args[1 : len(args)-1]); ok {
+			return cmd
+		}
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// parseQuotedList parses a space-separated list of Go-quoted strings.
+func parseQuotedList(s string) ([]string, bool) {
+	list := []string{}
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return list, true
+		}
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, false
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, false
+		}
+		list = append(list, value)
+		s = s[len(quoted):]
+	}
+}
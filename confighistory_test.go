@@ -0,0 +1,107 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReconstructConfigHistory(t *testing.T) {
+	history := []ispec.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:0123456789abcdef in / "},
+		{CreatedBy: `/bin/sh -c #(nop)  CMD ["/bin/sh"]`, EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c #(nop)  ENV PATH=/usr/local/bin:/usr/bin:/bin", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c #(nop) ENV LANG C.UTF-8", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c #(nop)  LABEL maintainer=Jane Doe <jane@example.com> version=1.0", EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c apt-get update && echo ENV=foo"},
+		{CreatedBy: "RUN /bin/sh -c make install # buildkit"},
+		{CreatedBy: `ENV PATH=/opt/app/bin:/usr/local/bin:/usr/bin:/bin APP_MODE="release build"`, EmptyLayer: true},
+		{CreatedBy: `LABEL version=2.0 "org.example.quoted"='a b'`, EmptyLayer: true},
+		{CreatedBy: `CMD ["/opt/app/bin/app", "--serve"]`, EmptyLayer: true},
+		{CreatedBy: "/bin/sh -c #(nop)  CMD app --port 80", EmptyLayer: true},
+		{CreatedBy: "umoci config --config.env FOO=bar", EmptyLayer: true},
+	}
+
+	baseEnv := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "LANG=C.UTF-8"}
+	finalEnv := []string{"PATH=/opt/app/bin:/usr/local/bin:/usr/bin:/bin", "LANG=C.UTF-8", "APP_MODE=release build"}
+	baseLabels := map[string]string{"maintainer": "Jane Doe <jane@example.com>", "version": "1.0"}
+	finalLabels := map[string]string{"maintainer": "Jane Doe <jane@example.com>", "version": "2.0", "org.example.quoted": "a b"}
+
+	expected := []struct {
+		directive string
+		config    ConfigState
+	}{
+		{"", ConfigState{Labels: map[string]string{}}},
+		{"CMD", ConfigState{Cmd: []string{"/bin/sh"}, Labels: map[string]string{}}},
+		{"ENV", ConfigState{Env: baseEnv[:1], Cmd: []string{"/bin/sh"}, Labels: map[string]string{}}},
+		{"ENV", ConfigState{Env: baseEnv, Cmd: []string{"/bin/sh"}, Labels: map[string]string{}}},
+		{"LABEL", ConfigState{Env: baseEnv, Cmd: []string{"/bin/sh"}, Labels: baseLabels}},
+		{"", ConfigState{Env: baseEnv, Cmd: []string{"/bin/sh"}, Labels: baseLabels}},
+		{"", ConfigState{Env: baseEnv, Cmd: []string{"/bin/sh"}, Labels: baseLabels}},
+		{"ENV", ConfigState{Env: finalEnv, Cmd: []string{"/bin/sh"}, Labels: baseLabels}},
+		{"LABEL", ConfigState{Env: finalEnv, Cmd: []string{"/bin/sh"}, Labels: finalLabels}},
+		{"CMD", ConfigState{Env: finalEnv, Cmd: []string{"/opt/app/bin/app", "--serve"}, Labels: finalLabels}},
+		{"CMD", ConfigState{Env: finalEnv, Cmd: []string{"/bin/sh", "-c", "app --port 80"}, Labels: finalLabels}},
+		{"", ConfigState{Env: finalEnv, Cmd: []string{"/bin/sh", "-c", "app --port 80"}, Labels: finalLabels}},
+	}
+
+	ch := ReconstructConfigHistory(history)
+	if len(ch.Steps) != len(expected) {
+		t.Fatalf("unexpected number of steps: expected %d got %d", len(expected), len(ch.Steps))
+	}
+	for idx, step := range ch.Steps {
+		want := expected[idx]
+		if step.CreatedBy != history[idx].CreatedBy {
+			t.Errorf("step %d: created_by not preserved: expected %q got %q", idx, history[idx].CreatedBy, step.CreatedBy)
+		}
+		if step.Directive != want.directive {
+			t.Errorf("step %d (%q): expected directive %q got %q", idx, step.CreatedBy, want.directive, step.Directive)
+		}
+		if !reflect.DeepEqual(step.Config, want.config) {
+			t.Errorf("step %d (%q): unexpected config state:\n\texpected %#v\n\tgot      %#v", idx, step.CreatedBy, want.config, step.Config)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := ch.Format(&buffer); err != nil {
+		t.Fatalf("unexpected error formatting config history: %+v", err)
+	}
+	output := buffer.String()
+	for _, line := range []string{
+		`STEP 1: /bin/sh -c #(nop)  CMD ["/bin/sh"]`,
+		`    CMD ["/bin/sh"]`,
+		`    ENV LANG=C.UTF-8`,
+		`    LABEL version=1.0`,
+		`    ENV PATH=/opt/app/bin:/usr/local/bin:/usr/bin:/bin`,
+		`    LABEL org.example.quoted=a b`,
+		`    CMD ["/bin/sh","-c","app --port 80"]`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("formatted config history missing %q:\n%s", line, output)
+		}
+	}
+	// Unchanged values must not be listed again.
+	if n := strings.Count(output, "ENV LANG=C.UTF-8"); n != 1 {
+		t.Errorf("expected LANG change to be listed once, got %d times:\n%s", n, output)
+	}
+}
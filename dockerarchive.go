@@ -0,0 +1,624 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/system"
+)
+
+// Media-types of Docker foreign layers, which are referenced by URL and (like
+// OCI non-distributable layers) are not meant to be distributed with images.
+const (
+	dockerForeignLayer     = "application/vnd.docker.image.rootfs.foreign.diff.tar"
+	dockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// dockerArchiveManifestPath is the path of the manifest in a Docker image
+// archive, which lists the images in the archive.
+const dockerArchiveManifestPath = "manifest.json"
+
+// maxDockerArchiveSymlinks is the maximum number of symlinks followed when
+// opening a path in a Docker image archive.
+const maxDockerArchiveSymlinks = 32
+
+// dockerArchiveImage is an entry in the manifest of a Docker image archive
+// (as created by "docker save").
+type dockerArchiveImage struct {
+	// Config is the path of the image configuration in the archive.
+	Config string `json:"Config"`
+
+	// RepoTags are the names of the image (such as "busybox:latest").
+	RepoTags []string `json:"RepoTags"`
+
+	// Layers are the paths of the uncompressed layers in the archive, in the
+	// same order as the diffids in the image configuration.
+	Layers []string `json:"Layers"`
+
+	// LayerSources contains the descriptors of foreign layers, keyed by the
+	// diffid of the layer.
+	LayerSources map[digest.Digest]ispec.Descriptor `json:"LayerSources,omitempty"`
+}
+
+// dockerArchive is a Docker image archive. Docker image archives contain
+// their manifest at the end of the archive, so entries have to be read out of
+// order.
+type dockerArchive struct {
+	archive io.ReadSeeker
+}
+
+// open returns a reader for the contents of the regular file with the given
+// path in the archive, following any symlinks and hardlinks (which "docker
+// save" uses for duplicate layers). The reader is only valid until the next
+// call to open. The resolved path of the file is also returned.
+func (da dockerArchive) open(name string) (io.Reader, string, error) {
+	name = path.Clean("/" + name)
+	for i := 0; i < maxDockerArchiveSymlinks; i++ {
+		if _, err := da.archive.Seek(0, io.SeekStart); err != nil {
+			return nil, "", fmt.Errorf("seek to start of archive: %w", err)
+		}
+		tr := tar.NewReader(da.archive)
+		var hdr *tar.Header
+		for {
+			next, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return nil, "", fmt.Errorf("%s is not in archive", name)
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("read next entry: %w", err)
+			}
+			if path.Clean("/"+next.Name) == name {
+				hdr = next
+				break
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			return tr, name, nil
+		case tar.TypeSymlink:
+			name = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			name = path.Clean("/" + hdr.Linkname)
+		default:
+			return nil, "", fmt.Errorf("%s is not a regular file", name)
+		}
+	}
+	return nil, "", fmt.Errorf("too many levels of symbolic links in archive: %s", name)
+}
+
+// decodeJSON reads the JSON file at the given path in the archive.
+func (da dockerArchive) decodeJSON(name string, v interface{}) error {
+	rdr, _, err := da.open(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(rdr).Decode(v); err != nil {
+		return fmt.Errorf("decode %s: %w", name, err)
+	}
+	return nil
+}
+
+// selectDockerArchiveImage returns the image in the archive manifest with the
+// given name. The name can be one of the RepoTags of the image (with the tag
+// defaulting to "latest") or the digest of its configuration. If name is
+// empty, the archive must only contain one image.
+func selectDockerArchiveImage(images []dockerArchiveImage, name string) (dockerArchiveImage, error) {
+	if len(images) == 0 {
+		return dockerArchiveImage{}, errors.New("archive contains no images")
+	}
+	if name == "" {
+		if len(images) > 1 {
+			var names []string
+			for _, image := range images {
+				names = append(names, image.RepoTags...)
+			}
+			return dockerArchiveImage{}, fmt.Errorf("archive contains %d images (%s): an image name must be specified", len(images), strings.Join(names, ", "))
+		}
+		return images[0], nil
+	}
+
+	candidates := []string{name}
+	if !strings.Contains(path.Base(name), ":") {
+		candidates = append(candidates, name+":latest")
+	}
+	var (
+		found   dockerArchiveImage
+		matches int
+	)
+	for _, image := range images {
+		configDigest := "sha256:" + strings.TrimSuffix(path.Base(image.Config), ".json")
+		names := append([]string{configDigest}, image.RepoTags...)
+	match:
+		for _, imageName := range names {
+			for _, candidate := range candidates {
+				if imageName == candidate {
+					found = image
+					matches++
+					break match
+				}
+			}
+		}
+	}
+	switch matches {
+	case 0:
+		return dockerArchiveImage{}, fmt.Errorf("image %q is not in archive", name)
+	case 1:
+		return found, nil
+	default:
+		return dockerArchiveImage{}, fmt.Errorf("image name %q is ambiguous", name)
+	}
+}
+
+// foreignLayerMediaType returns the OCI media-type equivalent to the media-type
+// of a foreign layer in a Docker image archive.
+func foreignLayerMediaType(mediaType string) (string, error) {
+	switch mediaType {
+	case dockerForeignLayer:
+		return ispec.MediaTypeImageLayerNonDistributable, nil
+	case dockerForeignLayerGzip:
+		return ispec.MediaTypeImageLayerNonDistributableGzip, nil
+	case ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		ispec.MediaTypeImageLayerNonDistributableZstd:
+		return mediaType, nil
+	}
+	return "", fmt.Errorf("unsupported foreign layer media-type %q", mediaType)
+}
+
+// decompressDockerLayer returns a reader for the uncompressed contents of a
+// layer in a Docker image archive. "docker save" stores layers uncompressed,
+// but gzip and zstd compressed layers are also accepted.
+func decompressDockerLayer(r io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read layer header: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzRdr, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("create gzip reader: %w", err)
+		}
+		return gzRdr, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zstdRdr, err := zstd.NewReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("create zstd reader: %w", err)
+		}
+		return zstdRdr.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+// ImportDockerArchiveOptions are the options for ImportDockerArchive.
+type ImportDockerArchiveOptions struct {
+	// ImageName selects the image to import, and must be set if the archive
+	// contains more than one image. It can be one of the names of the image
+	// (such as "busybox:latest", with the tag defaulting to "latest") or the
+	// digest of the image configuration.
+	ImageName string
+
+	// Compressor is used to compress the imported layers. If nil,
+	// mutate.GzipCompressor is used.
+	Compressor mutate.Compressor
+}
+
+// ImportDockerArchive imports an image from a Docker image archive (as
+// created by "docker save") into the image layout, and returns the descriptor
+// of the new image manifest. The caller is responsible for creating a
+// reference to the new image.
+//
+// The layers are compressed and their diffids are recomputed (and must match
+// the diffids in the image configuration). Layers which are used several times
+// are only imported once. Foreign layers (which are referenced by URL) are
+// not imported -- their descriptors are converted to OCI non-distributable
+// layer descriptors instead, and the layer blobs must be fetched separately.
+func ImportDockerArchive(ctx context.Context, engineExt casext.Engine, archive io.ReadSeeker, opt *ImportDockerArchiveOptions) (ispec.Descriptor, error) {
+	var imageName string
+	compressor := mutate.GzipCompressor
+	if opt != nil {
+		imageName = opt.ImageName
+		if opt.Compressor != nil {
+			compressor = opt.Compressor
+		}
+	}
+	da := dockerArchive{archive: archive}
+
+	var images []dockerArchiveImage
+	if err := da.decodeJSON(dockerArchiveManifestPath, &images); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("read archive manifest: %w", err)
+	}
+	image, err := selectDockerArchiveImage(images, imageName)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	// The Docker image configuration is a superset of the OCI one, and any
+	// Docker-specific fields are dropped.
+	var config ispec.Image
+	if err := da.decodeJSON(image.Config, &config); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("read image config: %w", err)
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(image.Layers) {
+		return ispec.Descriptor{}, fmt.Errorf("image config has %d diffids but image has %d layers", len(diffIDs), len(image.Layers))
+	}
+	history := config.History
+
+	// Create an empty image with the configuration, which the layers and
+	// history are then added to.
+	config.RootFS = ispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{}}
+	config.History = nil
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("put config blob: %w", err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("put manifest blob: %w", err)
+	}
+	mutator, err := mutate.New(engineExt, casext.DescriptorPath{
+		Walk: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}},
+	})
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("create mutator for new image: %w", err)
+	}
+
+	// Layers already imported, keyed by their resolved path in the archive.
+	imported := map[string]ispec.Descriptor{}
+
+	addLayer := func(idx int, history *ispec.History) error {
+		diffID := diffIDs[idx]
+		if source, ok := image.LayerSources[diffID]; ok && len(source.URLs) > 0 {
+			mediaType, err := foreignLayerMediaType(source.MediaType)
+			if err != nil {
+				return err
+			}
+			desc := ispec.Descriptor{
+				MediaType:   mediaType,
+				Digest:      source.Digest,
+				Size:        source.Size,
+				URLs:        source.URLs,
+				Annotations: source.Annotations,
+			}
+			log.Warnf("layer %d is a foreign layer: its blob %s must be fetched separately", idx, desc.Digest)
+			return mutator.AddExisting(ctx, desc, history, diffID)
+		}
+
+		rdr, layerPath, err := da.open(image.Layers[idx])
+		if err != nil {
+			return fmt.Errorf("open layer: %w", err)
+		}
+		if desc, ok := imported[layerPath]; ok {
+			log.Debugf("layer %d is a duplicate of %s", idx, layerPath)
+			return mutator.AddExisting(ctx, desc, history, diffID)
+		}
+
+		layerRdr, err := decompressDockerLayer(rdr)
+		if err != nil {
+			return err
+		}
+		defer layerRdr.Close()
+		desc, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, layerRdr, history, compressor, nil)
+		if err != nil {
+			return err
+		}
+		newConfig, err := mutator.Config(ctx)
+		if err != nil {
+			return fmt.Errorf("get config: %w", err)
+		}
+		if got := newConfig.RootFS.DiffIDs[len(newConfig.RootFS.DiffIDs)-1]; got != diffID {
+			return fmt.Errorf("layer has diffid %s but image config has diffid %s", got, diffID)
+		}
+		imported[layerPath] = desc
+		log.WithFields(log.Fields{
+			"diffid": diffID,
+			"digest": desc.Digest,
+		}).Infof("imported layer %d", idx)
+		return nil
+	}
+
+	// Replay the history so that the empty-layer history entries are
+	// interleaved with the layers in the same way as in the original image.
+	var layerIdx int
+	for _, entry := range history {
+		entry := entry
+		if entry.EmptyLayer {
+			meta, err := mutator.Meta(ctx)
+			if err != nil {
+				return ispec.Descriptor{}, fmt.Errorf("get meta: %w", err)
+			}
+			annotations, err := mutator.Annotations(ctx)
+			if err != nil {
+				return ispec.Descriptor{}, fmt.Errorf("get annotations: %w", err)
+			}
+			if err := mutator.Set(ctx, config.Config, meta, annotations, &entry); err != nil {
+				return ispec.Descriptor{}, fmt.Errorf("add history entry: %w", err)
+			}
+			continue
+		}
+		if layerIdx >= len(image.Layers) {
+			return ispec.Descriptor{}, fmt.Errorf("image config has more history entries than layers (%d)", len(image.Layers))
+		}
+		if err := addLayer(layerIdx, &entry); err != nil {
+			return ispec.Descriptor{}, fmt.Errorf("import layer %d: %w", layerIdx, err)
+		}
+		layerIdx++
+	}
+	for ; layerIdx < len(image.Layers); layerIdx++ {
+		if err := addLayer(layerIdx, nil); err != nil {
+			return ispec.Descriptor{}, fmt.Errorf("import layer %d: %w", layerIdx, err)
+		}
+	}
+
+	newPath, err := mutator.Commit(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("commit image: %w", err)
+	}
+	return newPath.Descriptor(), nil
+}
+
+// dockerForeignLayerMediaType returns the media-type of a Docker foreign layer
+// equivalent to the given OCI non-distributable layer media-type. Media-types
+// without a Docker equivalent are returned unchanged.
+func dockerForeignLayerMediaType(mediaType string) string {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerNonDistributable:
+		return dockerForeignLayer
+	case ispec.MediaTypeImageLayerNonDistributableGzip:
+		return dockerForeignLayerGzip
+	}
+	return mediaType
+}
+
+// ExportDockerArchiveOptions are the options for ExportDockerArchive.
+type ExportDockerArchiveOptions struct {
+	// RepoTags are the names given to the image in the archive (such as
+	// "busybox:latest"), which "docker load" will tag the image with. If a
+	// name has no tag, it defaults to "latest".
+	RepoTags []string
+}
+
+// writeDockerArchiveFile writes a regular file with the given contents to
+// the archive.
+func writeDockerArchiveFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     size,
+	}); err != nil {
+		return fmt.Errorf("write %s header: %w", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+// exportDockerLayer writes the uncompressed contents of the layer to the
+// archive as <diffid>/layer.tar (as with "docker save", layers are stored
+// uncompressed so the archive can be loaded regardless of how the layers are
+// compressed), and returns the path of the layer in the archive. The contents
+// of the layer must match the given diffid.
+func exportDockerLayer(ctx context.Context, engineExt casext.Engine, tw *tar.Writer, desc ispec.Descriptor, diffID digest.Digest) (string, error) {
+	layerRdr, err := layer.OpenLayer(ctx, engineExt, desc)
+	if err != nil {
+		return "", err
+	}
+	defer layerRdr.Close()
+
+	// The size of the uncompressed layer is needed for the tar header, so it
+	// has to be decompressed to a temporary file first.
+	tmp, err := ioutil.TempFile("", "umoci-export-layer-")
+	if err != nil {
+		return "", fmt.Errorf("create temporary layer file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := system.Copy(io.MultiWriter(tmp, digester.Hash()), layerRdr)
+	if err != nil {
+		return "", fmt.Errorf("decompress layer: %w", err)
+	}
+	if got := digester.Digest(); got != diffID {
+		return "", fmt.Errorf("layer has diffid %s but image config has diffid %s", got, diffID)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("seek temporary layer file: %w", err)
+	}
+
+	layerDir := diffID.Encoded()
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     layerDir + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0o755,
+	}); err != nil {
+		return "", fmt.Errorf("write layer directory header: %w", err)
+	}
+	layerPath := layerDir + "/layer.tar"
+	if err := writeDockerArchiveFile(tw, layerPath, size, tmp); err != nil {
+		return "", err
+	}
+	return layerPath, nil
+}
+
+// ExportDockerArchive writes the image with the given manifest to w as a
+// Docker image archive, which can be loaded with "docker load" (or imported
+// with ImportDockerArchive). The image configuration is stored as-is (the
+// OCI image configuration is a subset of the Docker one), so the Docker image
+// ID of the image is the digest of its configuration. Layers are stored
+// uncompressed, and non-distributable layers with URLs are also recorded as
+// Docker foreign layers.
+func ExportDockerArchive(ctx context.Context, engineExt casext.Engine, manifestPath casext.DescriptorPath, w io.Writer, opt *ExportDockerArchiveOptions) error {
+	var repoTags []string
+	if opt != nil {
+		for _, name := range opt.RepoTags {
+			if !strings.Contains(path.Base(name), ":") {
+				name += ":latest"
+			}
+			repoTags = append(repoTags, name)
+		}
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, manifestPath.Descriptor())
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return fmt.Errorf("get config: %w", err)
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return fmt.Errorf("config blob is not correct mediatype %s: %T", manifest.Config.MediaType, configBlob.Data)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("image config has %d diffids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	tw := tar.NewWriter(w)
+
+	image := dockerArchiveImage{
+		Config:   manifest.Config.Digest.Encoded() + ".json",
+		RepoTags: repoTags,
+		Layers:   []string{},
+	}
+	exported := map[digest.Digest]string{}
+	for idx, desc := range manifest.Layers {
+		diffID := config.RootFS.DiffIDs[idx]
+		layerPath, ok := exported[diffID]
+		if !ok {
+			layerPath, err = exportDockerLayer(ctx, engineExt, tw, desc, diffID)
+			if err != nil {
+				return fmt.Errorf("export layer %d: %w", idx, err)
+			}
+			exported[diffID] = layerPath
+			log.WithFields(log.Fields{
+				"diffid": diffID,
+				"digest": desc.Digest,
+			}).Infof("exported layer %d", idx)
+		}
+		image.Layers = append(image.Layers, layerPath)
+
+		if len(desc.URLs) > 0 {
+			if image.LayerSources == nil {
+				image.LayerSources = map[digest.Digest]ispec.Descriptor{}
+			}
+			image.LayerSources[diffID] = ispec.Descriptor{
+				MediaType:   dockerForeignLayerMediaType(desc.MediaType),
+				Digest:      desc.Digest,
+				Size:        desc.Size,
+				URLs:        desc.URLs,
+				Annotations: desc.Annotations,
+			}
+		}
+	}
+
+	// The configuration blob is copied byte-for-byte so that its digest (the
+	// Docker image ID) is unchanged.
+	configRdr, err := engineExt.GetVerifiedBlob(ctx, manifest.Config)
+	if err != nil {
+		return fmt.Errorf("get config blob: %w", err)
+	}
+	defer configRdr.Close()
+	if err := writeDockerArchiveFile(tw, image.Config, manifest.Config.Size, configRdr); err != nil {
+		return err
+	}
+
+	manifestJSON, err := json.Marshal([]dockerArchiveImage{image})
+	if err != nil {
+		return fmt.Errorf("encode archive manifest: %w", err)
+	}
+	if err := writeDockerArchiveFile(tw, dockerArchiveManifestPath, int64(len(manifestJSON)), bytes.NewReader(manifestJSON)); err != nil {
+		return err
+	}
+
+	// The legacy "repositories" file maps each name to the top-most layer.
+	if len(repoTags) > 0 && len(image.Layers) > 0 {
+		topLayer := path.Dir(image.Layers[len(image.Layers)-1])
+		repositories := map[string]map[string]string{}
+		for _, name := range repoTags {
+			idx := strings.LastIndex(name, ":")
+			repo, tag := name[:idx], name[idx+1:]
+			if repositories[repo] == nil {
+				repositories[repo] = map[string]string{}
+			}
+			repositories[repo][tag] = topLayer
+		}
+		repositoriesJSON, err := json.Marshal(repositories)
+		if err != nil {
+			return fmt.Errorf("encode repositories: %w", err)
+		}
+		if err := writeDockerArchiveFile(tw, "repositories", int64(len(repositoriesJSON)), bytes.NewReader(repositoriesJSON)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("finish archive: %w", err)
+	}
+	return nil
+}
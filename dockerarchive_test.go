@@ -0,0 +1,481 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// dockerArchiveEntry is an entry in a test Docker image archive.
+type dockerArchiveEntry struct {
+	name     string
+	linkname string
+	data     []byte
+}
+
+// makeDockerArchive returns a Docker image archive containing the given
+// entries (entries with a linkname are symlinks).
+func makeDockerArchive(t *testing.T, entries []dockerArchiveEntry) *bytes.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(entry.data)),
+		}
+		if entry.linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.linkname
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+// makeTestLayer returns an uncompressed layer containing the given files.
+func makeTestLayer(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(name))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestImportDockerArchive(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestImportDockerArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	layerA := makeTestLayer(t, "etc/passwd", "etc/group")
+	layerB := makeTestLayer(t, "usr/bin/sh")
+	layerForeign := makeTestLayer(t, "Windows/System32/foreign.dll")
+	diffA := digest.FromBytes(layerA)
+	diffB := digest.FromBytes(layerB)
+	diffForeign := digest.FromBytes(layerForeign)
+
+	// Layer B is stored compressed in the archive.
+	var gzLayerB bytes.Buffer
+	gzw := gzip.NewWriter(&gzLayerB)
+	if _, err := gzw.Write(layerB); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// This is structured in the same way as "docker save" output.
+	configJSON := mustJSON(t, map[string]interface{}{
+		"architecture": "arm64",
+		"os":           "linux",
+		"created":      "2024-01-02T03:04:05Z",
+		"config": map[string]interface{}{
+			"Env":        []string{"PATH=/usr/bin"},
+			"Cmd":        []string{"/usr/bin/sh"},
+			"Hostname":   "docker-specific",
+			"WorkingDir": "/",
+		},
+		"container":      "docker-specific",
+		"docker_version": "24.0.0",
+		"history": []map[string]interface{}{
+			{"created_by": "ADD etc /etc"},
+			{"created_by": "ENV PATH=/usr/bin", "empty_layer": true},
+			{"created_by": "ADD usr /usr"},
+			{"created_by": "ADD etc /etc"},
+			{"created_by": "CMD [\"/usr/bin/sh\"]", "empty_layer": true},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []digest.Digest{diffA, diffB, diffA},
+		},
+	})
+	configDigest := digest.FromBytes(configJSON)
+	otherJSON := mustJSON(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "windows",
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []digest.Digest{diffA, diffForeign},
+		},
+	})
+	otherDigest := digest.FromBytes(otherJSON)
+	foreignDesc := ispec.Descriptor{
+		MediaType: "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+		Digest:    "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		Size:      1234,
+		URLs:      []string{"https://example.com/foreign.tar.gz"},
+	}
+	manifestJSON := mustJSON(t, []map[string]interface{}{
+		{
+			"Config":   configDigest.Encoded() + ".json",
+			"RepoTags": []string{"example:v1"},
+			"Layers":   []string{"aaaa/layer.tar", "bbbb/layer.tar", "cccc/layer.tar"},
+		},
+		{
+			"Config":   otherDigest.Encoded() + ".json",
+			"RepoTags": []string{"other:latest"},
+			"Layers":   []string{"aaaa/layer.tar", "ffff/layer.tar"},
+			"LayerSources": map[digest.Digest]ispec.Descriptor{
+				diffForeign: foreignDesc,
+			},
+		},
+	})
+	archive := makeDockerArchive(t, []dockerArchiveEntry{
+		{name: "aaaa/layer.tar", data: layerA},
+		{name: "bbbb/layer.tar", data: gzLayerB.Bytes()},
+		{name: "cccc/layer.tar", linkname: "../aaaa/layer.tar"},
+		{name: "ffff/layer.tar", data: layerForeign},
+		{name: configDigest.Encoded() + ".json", data: configJSON},
+		{name: otherDigest.Encoded() + ".json", data: otherJSON},
+		{name: "manifest.json", data: manifestJSON},
+	})
+
+	importImage := func(name, tagName string) error {
+		descriptor, err := ImportDockerArchive(ctx, engineExt, archive, &ImportDockerArchiveOptions{ImageName: name})
+		if err != nil {
+			return err
+		}
+		return engineExt.UpdateReference(ctx, tagName, descriptor)
+	}
+
+	t.Run("Ambiguous", func(t *testing.T) {
+		if err := importImage("", "ambiguous"); err == nil {
+			t.Errorf("expected importing without an image name to fail")
+		}
+		if err := importImage("missing:latest", "missing"); err == nil {
+			t.Errorf("expected importing a missing image to fail")
+		}
+	})
+
+	t.Run("Image", func(t *testing.T) {
+		if err := importImage("example:v1", "example"); err != nil {
+			t.Fatalf("unexpected error importing image: %+v", err)
+		}
+		manifest, config := imageManifestConfig(t, engineExt, "example")
+
+		if len(manifest.Layers) != 3 {
+			t.Fatalf("unexpected number of layers: %d", len(manifest.Layers))
+		}
+		for idx, desc := range manifest.Layers {
+			if desc.MediaType != ispec.MediaTypeImageLayerGzip {
+				t.Errorf("layer %d has unexpected media-type %s", idx, desc.MediaType)
+			}
+		}
+		// The duplicate layer must be imported as the same blob.
+		if manifest.Layers[0].Digest != manifest.Layers[2].Digest {
+			t.Errorf("duplicate layer was not deduplicated: %s != %s", manifest.Layers[0].Digest, manifest.Layers[2].Digest)
+		}
+		if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+			t.Errorf("unexpected config media-type %s", manifest.Config.MediaType)
+		}
+
+		if expected := []digest.Digest{diffA, diffB, diffA}; !reflect.DeepEqual(config.RootFS.DiffIDs, expected) {
+			t.Errorf("unexpected diffids: expected %v got %v", expected, config.RootFS.DiffIDs)
+		}
+		if config.Architecture != "arm64" || config.OS != "linux" {
+			t.Errorf("unexpected platform: %s/%s", config.OS, config.Architecture)
+		}
+		if config.Created == nil || config.Created.Unix() != 1704164645 {
+			t.Errorf("unexpected created time: %v", config.Created)
+		}
+		if !reflect.DeepEqual(config.Config.Env, []string{"PATH=/usr/bin"}) || !reflect.DeepEqual(config.Config.Cmd, []string{"/usr/bin/sh"}) {
+			t.Errorf("unexpected image config: %+v", config.Config)
+		}
+
+		// The history (including the empty layers) must be unchanged.
+		var createdBy []string
+		var emptyLayers []bool
+		for _, history := range config.History {
+			createdBy = append(createdBy, history.CreatedBy)
+			emptyLayers = append(emptyLayers, history.EmptyLayer)
+		}
+		if expected := []string{"ADD etc /etc", "ENV PATH=/usr/bin", "ADD usr /usr", "ADD etc /etc", `CMD ["/usr/bin/sh"]`}; !reflect.DeepEqual(createdBy, expected) {
+			t.Errorf("unexpected history: expected %v got %v", expected, createdBy)
+		}
+		if expected := []bool{false, true, false, false, true}; !reflect.DeepEqual(emptyLayers, expected) {
+			t.Errorf("unexpected history empty layers: expected %v got %v", expected, emptyLayers)
+		}
+
+		// The layers must have the same contents.
+		for idx, expected := range [][]byte{layerA, layerB, layerA} {
+			rdr, err := layer.OpenLayer(ctx, engineExt, manifest.Layers[idx])
+			if err != nil {
+				t.Fatalf("unexpected error opening layer %d: %+v", idx, err)
+			}
+			got, err := ioutil.ReadAll(rdr)
+			_ = rdr.Close()
+			if err != nil {
+				t.Fatalf("unexpected error reading layer %d: %+v", idx, err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Errorf("layer %d has unexpected contents", idx)
+			}
+		}
+	})
+
+	t.Run("ForeignLayer", func(t *testing.T) {
+		// The tag defaults to "latest".
+		if err := importImage("other", "other"); err != nil {
+			t.Fatalf("unexpected error importing image: %+v", err)
+		}
+		manifest, config := imageManifestConfig(t, engineExt, "other")
+
+		if len(manifest.Layers) != 2 {
+			t.Fatalf("unexpected number of layers: %d", len(manifest.Layers))
+		}
+		foreign := manifest.Layers[1]
+		if foreign.MediaType != ispec.MediaTypeImageLayerNonDistributableGzip {
+			t.Errorf("unexpected foreign layer media-type %s", foreign.MediaType)
+		}
+		if foreign.Digest != foreignDesc.Digest || foreign.Size != foreignDesc.Size || !reflect.DeepEqual(foreign.URLs, foreignDesc.URLs) {
+			t.Errorf("unexpected foreign layer descriptor: %+v", foreign)
+		}
+		if expected := []digest.Digest{diffA, diffForeign}; !reflect.DeepEqual(config.RootFS.DiffIDs, expected) {
+			t.Errorf("unexpected diffids: expected %v got %v", expected, config.RootFS.DiffIDs)
+		}
+		if config.OS != "windows" {
+			t.Errorf("unexpected os: %s", config.OS)
+		}
+	})
+
+	t.Run("ConfigDigest", func(t *testing.T) {
+		if err := importImage(otherDigest.String(), "other-digest"); err != nil {
+			t.Fatalf("unexpected error importing image: %+v", err)
+		}
+		oldManifest, _ := imageManifestConfig(t, engineExt, "other")
+		newManifest, _ := imageManifestConfig(t, engineExt, "other-digest")
+		if !reflect.DeepEqual(oldManifest, newManifest) {
+			t.Errorf("importing by config digest resulted in a different image")
+		}
+	})
+}
+
+func TestImportDockerArchiveBadDiffID(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestImportDockerArchiveBadDiffID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	layerA := makeTestLayer(t, "etc/passwd")
+	configJSON := mustJSON(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []digest.Digest{digest.FromString("not the layer")},
+		},
+	})
+	archive := makeDockerArchive(t, []dockerArchiveEntry{
+		{name: "aaaa/layer.tar", data: layerA},
+		{name: "config.json", data: configJSON},
+		{name: "manifest.json", data: mustJSON(t, []map[string]interface{}{
+			{"Config": "config.json", "Layers": []string{"aaaa/layer.tar"}},
+		})},
+	})
+
+	if _, err := ImportDockerArchive(ctx, engineExt, archive, nil); err == nil {
+		t.Errorf("expected importing a layer with the wrong diffid to fail")
+	}
+}
+
+func TestExportDockerArchive(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestExportDockerArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	makeLayerImage(t, engineExt, "latest", [][]*tar.Header{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+		},
+		{
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0o755},
+		},
+	}, nil)
+
+	// Docker cannot load zstd layers, so make sure they are exported
+	// uncompressed.
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Recompress(ctx, engineExt, mutator, mutate.ZstdCompressor); err != nil {
+		t.Fatalf("unexpected error recompressing image: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	manifest, config := imageManifestConfig(t, engineExt, "latest")
+	if manifest.Layers[0].MediaType != "application/vnd.oci.image.layer.v1.tar+zstd" {
+		t.Fatalf("unexpected layer media-type %s", manifest.Layers[0].MediaType)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportDockerArchive(ctx, engineExt, newDescriptorPath, &buf, &ExportDockerArchiveOptions{
+		RepoTags: []string{"example.com/image", "example.com/image:v1"},
+	}); err != nil {
+		t.Fatalf("unexpected error exporting image: %+v", err)
+	}
+	archive := bytes.NewReader(buf.Bytes())
+
+	// Check the archive contents directly.
+	da := dockerArchive{archive: archive}
+	var images []dockerArchiveImage
+	if err := da.decodeJSON(dockerArchiveManifestPath, &images); err != nil {
+		t.Fatalf("unexpected error reading archive manifest: %+v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("unexpected number of images in archive: %d", len(images))
+	}
+	if expected := []string{"example.com/image:latest", "example.com/image:v1"}; !reflect.DeepEqual(images[0].RepoTags, expected) {
+		t.Errorf("unexpected repo tags: expected %v got %v", expected, images[0].RepoTags)
+	}
+	// The config must be unchanged, so the Docker image ID is the same as the
+	// config digest.
+	configRdr, _, err := da.open(images[0].Config)
+	if err != nil {
+		t.Fatalf("unexpected error opening config: %+v", err)
+	}
+	if got, err := digest.Canonical.FromReader(configRdr); err != nil {
+		t.Fatal(err)
+	} else if got != manifest.Config.Digest {
+		t.Errorf("exported config has digest %s, expected %s", got, manifest.Config.Digest)
+	}
+	if len(images[0].Layers) != len(config.RootFS.DiffIDs) {
+		t.Fatalf("unexpected number of layers: %d", len(images[0].Layers))
+	}
+	for idx, layerPath := range images[0].Layers {
+		rdr, _, err := da.open(layerPath)
+		if err != nil {
+			t.Fatalf("unexpected error opening layer %d: %+v", idx, err)
+		}
+		if got, err := digest.Canonical.FromReader(rdr); err != nil {
+			t.Fatal(err)
+		} else if got != config.RootFS.DiffIDs[idx] {
+			t.Errorf("layer %d is not uncompressed: digest %s, diffid %s", idx, got, config.RootFS.DiffIDs[idx])
+		}
+	}
+	var repositories map[string]map[string]string
+	if err := da.decodeJSON("repositories", &repositories); err != nil {
+		t.Fatalf("unexpected error reading repositories: %+v", err)
+	}
+	if got := repositories["example.com/image"]["v1"]; got+"/layer.tar" != images[0].Layers[1] {
+		t.Errorf("unexpected repositories entry: %q", got)
+	}
+
+	// Importing the archive must result in the same image.
+	descriptor, err := ImportDockerArchive(ctx, engineExt, archive, &ImportDockerArchiveOptions{
+		ImageName:  "example.com/image:v1",
+		Compressor: mutate.ZstdCompressor,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error importing exported image: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "imported", descriptor); err != nil {
+		t.Fatal(err)
+	}
+	newManifest, newConfig := imageManifestConfig(t, engineExt, "imported")
+	if !reflect.DeepEqual(config, newConfig) {
+		t.Errorf("imported config differs:\n\texpected %+v\n\tgot %+v", config, newConfig)
+	}
+	for idx := range manifest.Layers {
+		if manifest.Layers[idx].Digest != newManifest.Layers[idx].Digest {
+			t.Errorf("imported layer %d differs: expected %s got %s", idx, manifest.Layers[idx].Digest, newManifest.Layers[idx].Digest)
+		}
+	}
+}
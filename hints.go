@@ -0,0 +1,80 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// The suffixes of the manifest annotations read by ParseAnnotationHints. The
+// full annotation name is "<prefix>.<suffix>", where the prefix is chosen by
+// the user (see layer.UnpackOptions.AnnotationHintPrefix).
+const (
+	// WhiteoutModeHint selects the style of whiteouts written to the root
+	// filesystem when unpacking. Valid values are "oci" and "overlayfs".
+	WhiteoutModeHint = "whiteout-mode"
+
+	// CompressionHint selects the compression used for new layers when
+	// repacking. The value has the same format as the
+	// mutate.UmociCompressionAnnotation annotation (such as "zstd;level=3").
+	CompressionHint = "compression"
+)
+
+// AnnotationHints are the extraction defaults requested by an image through
+// the annotations of its manifest. These annotations are not standard, and
+// are only read if the user has opted into them.
+type AnnotationHints struct {
+	// WhiteoutMode is the style of whiteouts requested by the image, or nil
+	// if the image did not request one.
+	WhiteoutMode *layer.WhiteoutMode
+
+	// Compression is the compression requested for new layers by the image,
+	// or "" if the image did not request one.
+	Compression string
+}
+
+// ParseAnnotationHints returns the extraction defaults requested by the given
+// manifest annotations, using annotations with the given prefix. Invalid hint
+// values are treated as an error, rather than being silently ignored.
+func ParseAnnotationHints(annotations map[string]string, prefix string) (AnnotationHints, error) {
+	var hints AnnotationHints
+
+	if value, ok := annotations[prefix+"."+WhiteoutModeHint]; ok {
+		var mode layer.WhiteoutMode
+		switch value {
+		case "oci":
+			mode = layer.OCIStandardWhiteout
+		case "overlayfs":
+			mode = layer.OverlayFSWhiteout
+		default:
+			return hints, fmt.Errorf("invalid %s.%s hint: unknown whiteout mode %q", prefix, WhiteoutModeHint, value)
+		}
+		hints.WhiteoutMode = &mode
+	}
+
+	if value, ok := annotations[prefix+"."+CompressionHint]; ok {
+		if _, err := mutate.CompressorFromAnnotation(value); err != nil {
+			return hints, fmt.Errorf("invalid %s.%s hint: %w", prefix, CompressionHint, err)
+		}
+		hints.Compression = value
+	}
+	return hints, nil
+}
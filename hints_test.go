@@ -0,0 +1,213 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+func TestParseAnnotationHints(t *testing.T) {
+	overlayfs := layer.OverlayFSWhiteout
+	oci := layer.OCIStandardWhiteout
+
+	for _, test := range []struct {
+		name         string
+		annotations  map[string]string
+		whiteoutMode *layer.WhiteoutMode
+		compression  string
+		expectErr    bool
+	}{
+		{"None", nil, nil, "", false},
+		{"OtherPrefix", map[string]string{"org.other.whiteout-mode": "overlayfs"}, nil, "", false},
+		{"OverlayFS", map[string]string{"org.example.whiteout-mode": "overlayfs"}, &overlayfs, "", false},
+		{"OCI", map[string]string{"org.example.whiteout-mode": "oci"}, &oci, "", false},
+		{"Compression", map[string]string{"org.example.compression": "zstd;level=3"}, nil, "zstd;level=3", false},
+		{"Both", map[string]string{
+			"org.example.whiteout-mode": "overlayfs",
+			"org.example.compression":   "gzip",
+		}, &overlayfs, "gzip", false},
+		{"BadWhiteoutMode", map[string]string{"org.example.whiteout-mode": "aufs"}, nil, "", true},
+		{"BadCompression", map[string]string{"org.example.compression": "lzma"}, nil, "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hints, err := ParseAnnotationHints(test.annotations, "org.example")
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error parsing hints, got %+v", hints)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error parsing hints: %+v", err)
+			}
+			switch {
+			case test.whiteoutMode == nil && hints.WhiteoutMode != nil:
+				t.Errorf("unexpected whiteout mode: %d", *hints.WhiteoutMode)
+			case test.whiteoutMode != nil && hints.WhiteoutMode == nil:
+				t.Errorf("expected whiteout mode %d, got none", *test.whiteoutMode)
+			case test.whiteoutMode != nil && *hints.WhiteoutMode != *test.whiteoutMode:
+				t.Errorf("expected whiteout mode %d, got %d", *test.whiteoutMode, *hints.WhiteoutMode)
+			}
+			if hints.Compression != test.compression {
+				t.Errorf("expected compression %q, got %q", test.compression, hints.Compression)
+			}
+		})
+	}
+}
+
+func TestUnpackAnnotationHints(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackAnnotationHints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	// Create an image with an annotated manifest.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, nil, mutate.GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageMeta, err := mutator.Meta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(ctx, config.Config, imageMeta, map[string]string{
+		"org.example.whiteout-mode": "overlayfs",
+		"org.example.compression":   "zstd",
+		"org.oci.whiteout-mode":     "oci",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name             string
+		prefix           string
+		userWhiteoutMode layer.WhiteoutMode
+		whiteoutMode     layer.WhiteoutMode
+		compression      string
+		mediaType        string
+	}{
+		// The hints are ignored unless the user opts in.
+		{"Ignored", "", layer.OCIStandardWhiteout, layer.OCIStandardWhiteout, "", ispec.MediaTypeImageLayerGzip},
+		{"OtherPrefix", "org.other", layer.OCIStandardWhiteout, layer.OCIStandardWhiteout, "", ispec.MediaTypeImageLayerGzip},
+		{"Hints", "org.example", layer.OCIStandardWhiteout, layer.OverlayFSWhiteout, "zstd", ispec.MediaTypeImageLayer + "+zstd"},
+		// Options set by the user take precedence over the hints.
+		{"ExplicitWhiteoutMode", "org.oci", layer.OverlayFSWhiteout, layer.OverlayFSWhiteout, "", ispec.MediaTypeImageLayerGzip},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle := filepath.Join(dir, "bundle-"+test.name)
+			// Map root to the current user.
+			unpackOptions := layer.UnpackOptions{
+				MapOptions: layer.MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				WhiteoutMode:         test.userWhiteoutMode,
+				AnnotationHintPrefix: test.prefix,
+			}
+			if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+				t.Fatalf("unexpected unpack error: %+v", err)
+			}
+
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.WhiteoutMode != test.whiteoutMode {
+				t.Errorf("expected whiteout mode %d, got %d", test.whiteoutMode, meta.WhiteoutMode)
+			}
+			if meta.Compression != test.compression {
+				t.Errorf("expected compression %q, got %q", test.compression, meta.Compression)
+			}
+
+			// The compression hint is used for new layers when repacking.
+			if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "new"), []byte("new file"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mutator, err := mutate.New(engineExt, meta.From)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tagName := "repacked-" + test.name
+			if err := Repack(engineExt, tagName, bundle, meta, nil, nil, false, mutator); err != nil {
+				t.Fatalf("unexpected repack error: %+v", err)
+			}
+			manifest, _ := imageManifestConfig(t, engineExt, tagName)
+			if got := manifest.Layers[len(manifest.Layers)-1].MediaType; got != test.mediaType {
+				t.Errorf("expected new layer media-type %q, got %q", test.mediaType, got)
+			}
+		})
+	}
+}
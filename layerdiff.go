@@ -0,0 +1,162 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/vbatts/go-mtree"
+)
+
+// LayerFromDiff writes a single (uncompressed) tar layer to w containing the
+// filesystem changes needed to turn the root filesystem of the base manifest
+// into the root filesystem of the target manifest. Applying the layer on top of
+// base's layers produces the same root filesystem as target, with removed
+// paths being represented with whiteouts. The two manifests may come from
+// different engines.
+//
+// Both root filesystems are extracted to temporary directories (using opt,
+// which may be nil) and compared in the same way as Repack compares a bundle
+// to its mtree manifest. The ownership of the entries in the layer is mapped
+// back into the container using opt.MapOptions, so rootless callers produce
+// the same layer as privileged ones.
+func LayerFromDiff(ctx context.Context, baseEngine casext.Engine, base ispec.Manifest, targetEngine casext.Engine, target ispec.Manifest, w io.Writer, opt *layer.UnpackOptions) (Err error) {
+	var unpackOptions layer.UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	// Both root filesystems must be complete plain root filesystems for the
+	// diff to make sense, and there's no point in touching any other targets.
+	unpackOptions.WhiteoutMode = layer.OCIStandardWhiteout
+	unpackOptions.WhiteoutsOnly = false
+	unpackOptions.StartFrom = ispec.Descriptor{}
+	unpackOptions.ExtraTargets = nil
+
+	fsEval := fseval.Default
+	if unpackOptions.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	tmpDir, err := ioutil.TempDir("", "umoci-layer-diff-")
+	if err != nil {
+		return fmt.Errorf("create temporary directory: %w", err)
+	}
+	defer func() {
+		if err := fsEval.RemoveAll(tmpDir); err != nil && Err == nil {
+			Err = fmt.Errorf("remove temporary directory: %w", err)
+		}
+	}()
+
+	baseRootfs := filepath.Join(tmpDir, "base")
+	targetRootfs := filepath.Join(tmpDir, "target")
+
+	log.Info("unpacking base rootfs ...")
+	if err := layer.UnpackRootfs(ctx, baseEngine, baseRootfs, base, &unpackOptions); err != nil {
+		return fmt.Errorf("unpack base rootfs: %w", err)
+	}
+	log.Info("unpacking target rootfs ...")
+	if err := layer.UnpackRootfs(ctx, targetEngine, targetRootfs, target, &unpackOptions); err != nil {
+		return fmt.Errorf("unpack target rootfs: %w", err)
+	}
+
+	log.Info("computing filesystem diff ...")
+	spec, err := walkParallel(baseRootfs, MtreeKeywords, fsEval, unpackOptions.MtreeConcurrency)
+	if err != nil {
+		return fmt.Errorf("generate base mtree spec: %w", err)
+	}
+	diffs, err := mtree.Check(targetRootfs, spec, MtreeKeywords, fsEval)
+	if err != nil {
+		return fmt.Errorf("check mtree: %w", err)
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.SimplifyFilter(diffs))
+	log.Info("... done")
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: computed layer diff")
+
+	reader, err := layer.GenerateLayer(targetRootfs, diffs, &layer.RepackOptions{
+		MapOptions: unpackOptions.MapOptions,
+	})
+	if err != nil {
+		return fmt.Errorf("generate diff layer: %w", err)
+	}
+	defer reader.Close()
+
+	if _, err := system.Copy(w, reader); err != nil {
+		return fmt.Errorf("write diff layer: %w", err)
+	}
+	return nil
+}
+
+// DiffLayer is like LayerFromDiff, except that the base and target images are
+// given as descriptor paths (which must refer to image manifests) within the
+// same engine and the layer is returned as a stream. The stream can be passed
+// directly to mutate.Mutator.Add for a mutator of base in order to produce an
+// image with the same root filesystem as target. The caller must Close the
+// returned reader.
+func DiffLayer(ctx context.Context, engineExt casext.Engine, base, target casext.DescriptorPath, opt *layer.UnpackOptions) (io.ReadCloser, error) {
+	baseManifest, err := descriptorPathManifest(ctx, engineExt, base)
+	if err != nil {
+		return nil, fmt.Errorf("get base manifest: %w", err)
+	}
+	targetManifest, err := descriptorPathManifest(ctx, engineExt, target)
+	if err != nil {
+		return nil, fmt.Errorf("get target manifest: %w", err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		// #nosec G104
+		_ = writer.CloseWithError(LayerFromDiff(ctx, engineExt, baseManifest, engineExt, targetManifest, writer, opt))
+	}()
+	return reader, nil
+}
+
+// descriptorPathManifest returns the image manifest referenced by the given
+// descriptor path.
+func descriptorPathManifest(ctx context.Context, engineExt casext.Engine, descriptorPath casext.DescriptorPath) (ispec.Manifest, error) {
+	descriptor := descriptorPath.Descriptor()
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Manifest{}, fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", descriptor.MediaType)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Manifest{}, err
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, fmt.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,363 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// makeLayerImage creates a new image with the given tag containing one layer
+// for each set of headers. Regular files contain their contents[name] (or
+// their name if not set).
+func makeLayerImage(t *testing.T, engineExt casext.Engine, tagName string, layers [][]*tar.Header, contents map[string]string) {
+	ctx := context.Background()
+
+	if err := NewImage(engineExt, tagName); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hdrs := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			var data []byte
+			if hdr.Typeflag == tar.TypeReg && !strings.Contains(hdr.Name, ".wh.") {
+				data = []byte(hdr.Name)
+				if content, ok := contents[hdr.Name]; ok {
+					data = []byte(content)
+				}
+			}
+			hdr.Size = int64(len(data))
+			hdr.ModTime = time.Unix(1234567890, 0)
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, &ispec.History{CreatedBy: "test"}, mutate.GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, tagName, newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stripMtreeComments removes all comments (which include the path of the
+// bundle) from the given mtree manifest.
+func stripMtreeComments(data []byte) []byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			lines = append(lines, line)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+func TestLayerFromDiff(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestLayerFromDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	makeLayerImage(t, engineExt, "base", [][]*tar.Header{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/gone", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "var/cache/a", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "var/cache/b", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "etc/passwd"},
+		},
+	}, nil)
+
+	// The target is built independently of the base (with a different set
+	// of layers), and removes, modifies and adds files relative to it.
+	makeLayerImage(t, engineExt, "target", [][]*tar.Header{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/gone", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "etc/passwd"},
+		},
+		{
+			{Name: "etc/.wh.gone", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0600},
+			{Name: "usr/bin/new", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "opt/", Typeflag: tar.TypeDir, Mode: 0700},
+			{Name: "opt/sh", Typeflag: tar.TypeLink, Linkname: "usr/bin/sh"},
+		},
+	}, map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh",
+	})
+
+	baseManifest, _ := imageManifestConfig(t, engineExt, "base")
+	targetManifest, _ := imageManifestConfig(t, engineExt, "target")
+
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	var delta bytes.Buffer
+	if err := LayerFromDiff(ctx, engineExt, baseManifest, engineExt, targetManifest, &delta, &unpackOptions); err != nil {
+		t.Fatalf("unexpected LayerFromDiff error: %+v", err)
+	}
+
+	// Make sure the delta only contains the changes.
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(delta.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading delta layer: %+v", err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("delta entry %q has unexpected owner %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	for _, name := range []string{"etc/.wh.gone", "etc/passwd", "opt/", "opt/sh", "usr/bin/new", "var/.wh.cache"} {
+		if idx := sort.SearchStrings(names, name); idx >= len(names) || names[idx] != name {
+			t.Errorf("delta layer is missing entry %q: %v", name, names)
+		}
+	}
+	for _, name := range []string{"link", "var/cache/.wh.a", "var/cache/.wh.b"} {
+		if idx := sort.SearchStrings(names, name); idx < len(names) && names[idx] == name {
+			t.Errorf("delta layer has unexpected entry %q: %v", name, names)
+		}
+	}
+
+	// Applying the delta to the base must produce the target.
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &delta, &ispec.History{CreatedBy: "delta"}, mutate.GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding delta layer: %+v", err)
+	}
+	appliedDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	targetDescriptorPaths, err := engineExt.ResolveReference(ctx, "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundles := make([]string, 2)
+	for idx, descriptorPath := range []casext.DescriptorPath{targetDescriptorPaths[0], appliedDescriptorPath} {
+		bundles[idx] = filepath.Join(dir, "bundle"+string(rune('0'+idx)))
+		if err := UnpackManifest(ctx, engineExt, descriptorPath, bundles[idx], &unpackOptions); err != nil {
+			t.Fatalf("unexpected unpack error: %+v", err)
+		}
+	}
+	targetContents, appliedContents := rootfsContents(t, bundles[0]), rootfsContents(t, bundles[1])
+	if !reflect.DeepEqual(targetContents, appliedContents) {
+		t.Errorf("delta applied to base differs from target:\ntarget:  %v\napplied: %v", targetContents, appliedContents)
+	}
+	if _, ok := appliedContents["etc/gone"]; ok {
+		t.Errorf("etc/gone should have been removed by the delta")
+	}
+	if _, ok := appliedContents["var/cache"]; ok {
+		t.Errorf("var/cache should have been removed by the delta")
+	}
+
+	// The two bundles must also be identical according to their mtree
+	// manifests (which also include ownership and timestamps).
+	mtreeName := strings.Replace(appliedDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
+	targetMtreeName := strings.Replace(targetDescriptorPaths[0].Descriptor().Digest.String(), ":", "_", 1)
+	if got, want := stripMtreeComments(readMtree(t, filepath.Join(bundles[1], mtreeName+".mtree"))), stripMtreeComments(readMtree(t, filepath.Join(bundles[0], targetMtreeName+".mtree"))); !bytes.Equal(got, want) {
+		t.Errorf("mtree manifests of delta applied to base and target differ:\ntarget:\n%s\napplied:\n%s", want, got)
+	}
+}
+
+func TestDiffLayer(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestDiffLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	baseLayer := []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+	}
+	contents := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh",
+	}
+	makeLayerImage(t, engineExt, "a", [][]*tar.Header{baseLayer}, contents)
+	// B is A with another layer of changes on top.
+	makeLayerImage(t, engineExt, "b", [][]*tar.Header{
+		baseLayer,
+		{
+			{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "bin/bash", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "bin/rbash", Typeflag: tar.TypeSymlink, Linkname: "bash"},
+		},
+	}, map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/bash",
+	})
+
+	resolve := func(tagName string) casext.DescriptorPath {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 {
+			t.Fatalf("unexpected number of descriptors for tag %s: %d", tagName, len(descriptorPaths))
+		}
+		return descriptorPaths[0]
+	}
+	aDescriptorPath, bDescriptorPath := resolve("a"), resolve("b")
+
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	// Apply the diff to A.
+	reader, err := DiffLayer(ctx, engineExt, aDescriptorPath, bDescriptorPath, &unpackOptions)
+	if err != nil {
+		t.Fatalf("unexpected DiffLayer error: %+v", err)
+	}
+	defer reader.Close()
+	mutator, err := mutate.New(engineExt, aDescriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, reader, &ispec.History{CreatedBy: "diff"}, mutate.GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding diff layer: %+v", err)
+	}
+	appliedDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	bundles := make([]string, 2)
+	for idx, descriptorPath := range []casext.DescriptorPath{bDescriptorPath, appliedDescriptorPath} {
+		bundles[idx] = filepath.Join(dir, "bundle"+string(rune('0'+idx)))
+		if err := UnpackManifest(ctx, engineExt, descriptorPath, bundles[idx], &unpackOptions); err != nil {
+			t.Fatalf("unexpected unpack error: %+v", err)
+		}
+	}
+	bContents, appliedContents := rootfsContents(t, bundles[0]), rootfsContents(t, bundles[1])
+	if !reflect.DeepEqual(bContents, appliedContents) {
+		t.Errorf("diff applied to A differs from B:\nB:       %v\napplied: %v", bContents, appliedContents)
+	}
+	if got, want := appliedContents["etc/passwd"], "-rw-r--r-- root:x:0:0:root:/root:/bin/bash"; got != want {
+		t.Errorf("unexpected etc/passwd after applying diff: expected %q got %q", want, got)
+	}
+	if _, ok := appliedContents["etc/shadow"]; ok {
+		t.Errorf("etc/shadow should have been removed by the diff")
+	}
+
+	// DiffLayer only operates on image manifests.
+	if _, err := DiffLayer(ctx, engineExt, aDescriptorPath, casext.DescriptorPath{Walk: []ispec.Descriptor{{MediaType: ispec.MediaTypeImageConfig}}}, &unpackOptions); err == nil {
+		t.Errorf("expected DiffLayer with non-manifest target to fail")
+	}
+}
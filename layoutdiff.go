@@ -0,0 +1,221 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// ReferenceDiff describes a reference which is present in both layouts
+// compared by DiffLayouts but which refers to different descriptors.
+type ReferenceDiff struct {
+	// Name is the name of the reference.
+	Name string `json:"name"`
+
+	// A and B are the (sorted) digests of the descriptors the reference
+	// refers to in each layout. There is usually only one, but a reference
+	// may be ambiguous.
+	A []digest.Digest `json:"a"`
+	B []digest.Digest `json:"b"`
+}
+
+// LayoutDiff is the set of differences between two OCI layouts, as computed
+// by DiffLayouts. All of the lists are sorted.
+type LayoutDiff struct {
+	// BlobsOnlyInA and BlobsOnlyInB are the blobs which are only present in
+	// one of the layouts.
+	BlobsOnlyInA []digest.Digest `json:"blobs_only_in_a"`
+	BlobsOnlyInB []digest.Digest `json:"blobs_only_in_b"`
+
+	// ReferencesOnlyInA and ReferencesOnlyInB are the names of the references
+	// which are only present in one of the layouts.
+	ReferencesOnlyInA []string `json:"references_only_in_a"`
+	ReferencesOnlyInB []string `json:"references_only_in_b"`
+
+	// ChangedReferences are the references present in both layouts which
+	// refer to different descriptors.
+	ChangedReferences []ReferenceDiff `json:"changed_references"`
+}
+
+// Empty returns whether the two layouts compared had no differences.
+func (d LayoutDiff) Empty() bool {
+	return len(d.BlobsOnlyInA) == 0 && len(d.BlobsOnlyInB) == 0 &&
+		len(d.ReferencesOnlyInA) == 0 && len(d.ReferencesOnlyInB) == 0 &&
+		len(d.ChangedReferences) == 0
+}
+
+// Format writes a human-readable description of the differences to w, in
+// the style of a diff from layout a to layout b: blobs and references only in
+// a are prefixed with "-", those only in b with "+", and changed references
+// with "~".
+func (d LayoutDiff) Format(w io.Writer) error {
+	var lines []string
+	for _, blob := range d.BlobsOnlyInA {
+		lines = append(lines, fmt.Sprintf("- blob %s", blob))
+	}
+	for _, blob := range d.BlobsOnlyInB {
+		lines = append(lines, fmt.Sprintf("+ blob %s", blob))
+	}
+	for _, name := range d.ReferencesOnlyInA {
+		lines = append(lines, fmt.Sprintf("- reference %s", name))
+	}
+	for _, name := range d.ReferencesOnlyInB {
+		lines = append(lines, fmt.Sprintf("+ reference %s", name))
+	}
+	for _, ref := range d.ChangedReferences {
+		lines = append(lines, fmt.Sprintf("~ reference %s: %s -> %s", ref.Name, joinDigests(ref.A), joinDigests(ref.B)))
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinDigests returns a comma-separated list of digests.
+func joinDigests(digests []digest.Digest) string {
+	strs := make([]string, len(digests))
+	for idx, dgst := range digests {
+		strs[idx] = dgst.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// layoutReferences returns the sorted digests of the descriptors referred to
+// by each reference in the layout.
+func layoutReferences(ctx context.Context, engineExt casext.Engine) (map[string][]digest.Digest, error) {
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list references: %w", err)
+	}
+	refs := make(map[string][]digest.Digest, len(names))
+	for _, name := range names {
+		if _, ok := refs[name]; ok {
+			continue
+		}
+		descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("get descriptor %s: %w", name, err)
+		}
+		seen := map[digest.Digest]struct{}{}
+		digests := []digest.Digest{}
+		for _, descriptorPath := range descriptorPaths {
+			root := descriptorPath.Root().Digest
+			if _, ok := seen[root]; !ok {
+				seen[root] = struct{}{}
+				digests = append(digests, root)
+			}
+		}
+		sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+		refs[name] = digests
+	}
+	return refs, nil
+}
+
+// diffBlobs returns the blobs present in a but not in b.
+func diffBlobs(a, b []digest.Digest) []digest.Digest {
+	inB := make(map[digest.Digest]struct{}, len(b))
+	for _, blob := range b {
+		inB[blob] = struct{}{}
+	}
+	only := []digest.Digest{}
+	for _, blob := range a {
+		if _, ok := inB[blob]; !ok {
+			only = append(only, blob)
+		}
+	}
+	sort.Slice(only, func(i, j int) bool { return only[i] < only[j] })
+	return only
+}
+
+// equalDigests returns whether the two sorted lists of digests are the same.
+func equalDigests(a, b []digest.Digest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// DiffLayouts compares the blobs and references of two OCI layouts (which
+// may use different engines), returning which blobs and references are only
+// present in one of them and which references are present in both but refer
+// to different descriptors. Only the presence of blobs is compared, not their
+// contents (see VerifyReference).
+func DiffLayouts(ctx context.Context, a, b casext.Engine) (*LayoutDiff, error) {
+	blobsA, err := a.ListBlobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list blobs of layout a: %w", err)
+	}
+	blobsB, err := b.ListBlobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list blobs of layout b: %w", err)
+	}
+	refsA, err := layoutReferences(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("layout a: %w", err)
+	}
+	refsB, err := layoutReferences(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("layout b: %w", err)
+	}
+
+	diff := &LayoutDiff{
+		BlobsOnlyInA:      diffBlobs(blobsA, blobsB),
+		BlobsOnlyInB:      diffBlobs(blobsB, blobsA),
+		ReferencesOnlyInA: []string{},
+		ReferencesOnlyInB: []string{},
+		ChangedReferences: []ReferenceDiff{},
+	}
+	for name, digestsA := range refsA {
+		digestsB, ok := refsB[name]
+		switch {
+		case !ok:
+			diff.ReferencesOnlyInA = append(diff.ReferencesOnlyInA, name)
+		case !equalDigests(digestsA, digestsB):
+			diff.ChangedReferences = append(diff.ChangedReferences, ReferenceDiff{
+				Name: name,
+				A:    digestsA,
+				B:    digestsB,
+			})
+		}
+	}
+	for name := range refsB {
+		if _, ok := refsA[name]; !ok {
+			diff.ReferencesOnlyInB = append(diff.ReferencesOnlyInB, name)
+		}
+	}
+	sort.Strings(diff.ReferencesOnlyInA)
+	sort.Strings(diff.ReferencesOnlyInB)
+	sort.Slice(diff.ChangedReferences, func(i, j int) bool {
+		return diff.ChangedReferences[i].Name < diff.ChangedReferences[j].Name
+	})
+	return diff, nil
+}
@@ -0,0 +1,165 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+func TestDiffLayouts(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestDiffLayouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineA, err := CreateLayout(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineA.Close()
+	engineB, err := CreateLayout(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineB.Close()
+
+	// Copy the same image into both layouts.
+	if err := NewImage(engineA, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineA.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+	root := descriptorPaths[0].Root()
+	if _, err := engineA.CopyBlobs(ctx, engineB, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := engineB.UpdateReference(ctx, "latest", root); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffLayouts(ctx, engineA, engineB)
+	if err != nil {
+		t.Fatalf("unexpected error diffing layouts: %+v", err)
+	}
+	if !diff.Empty() {
+		t.Errorf("expected identical layouts to have no differences: %+v", diff)
+	}
+
+	// Add a blob only to b and a reference only to a.
+	extraBlob, _, err := engineB.PutBlob(ctx, bytes.NewBufferString("extra blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineA.UpdateReference(ctx, "extra", root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change which manifest "latest" refers to in b (the new manifest is
+	// added to both layouts, so it doesn't show up as a blob difference).
+	manifest, _ := imageManifestConfig(t, engineA, "latest")
+	manifest.Annotations = map[string]string{"org.opencontainers.image.title": "changed"}
+	var changedRoot ispec.Descriptor
+	for _, engineExt := range []casext.Engine{engineA, engineB} {
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changedRoot = ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+	}
+	if err := engineB.UpdateReference(ctx, "latest", changedRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err = DiffLayouts(ctx, engineA, engineB)
+	if err != nil {
+		t.Fatalf("unexpected error diffing layouts: %+v", err)
+	}
+	expected := &LayoutDiff{
+		BlobsOnlyInA:      []digest.Digest{},
+		BlobsOnlyInB:      []digest.Digest{extraBlob},
+		ReferencesOnlyInA: []string{"extra"},
+		ReferencesOnlyInB: []string{},
+		ChangedReferences: []ReferenceDiff{{
+			Name: "latest",
+			A:    []digest.Digest{root.Digest},
+			B:    []digest.Digest{changedRoot.Digest},
+		}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected layout diff: expected %+v got %+v", expected, diff)
+	}
+
+	// The diff is symmetric.
+	reverse, err := DiffLayouts(ctx, engineB, engineA)
+	if err != nil {
+		t.Fatalf("unexpected error diffing layouts: %+v", err)
+	}
+	if !reflect.DeepEqual(reverse.BlobsOnlyInA, diff.BlobsOnlyInB) || !reflect.DeepEqual(reverse.ReferencesOnlyInB, diff.ReferencesOnlyInA) {
+		t.Errorf("reversed layout diff doesn't match: %+v", reverse)
+	}
+
+	var buf bytes.Buffer
+	if err := diff.Format(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expectedOutput := strings.Join([]string{
+		"+ blob " + extraBlob.String(),
+		"- reference extra",
+		"~ reference latest: " + root.Digest.String() + " -> " + changedRoot.Digest.String(),
+	}, "\n") + "\n"
+	if buf.String() != expectedOutput {
+		t.Errorf("unexpected formatted diff: expected %q got %q", expectedOutput, buf.String())
+	}
+
+	// Make sure the JSON form is stable.
+	data, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded LayoutDiff
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, diff) {
+		t.Errorf("layout diff changed after JSON round-trip: expected %+v got %+v", diff, decoded)
+	}
+}
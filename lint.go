@@ -0,0 +1,116 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// Mode bits as stored in tar headers (see the c_IS* constants in archive/tar).
+const (
+	tarModeSetuid = 04000
+	tarModeSetgid = 02000
+	tarModeSticky = 01000
+	tarModeOtherW = 00002
+)
+
+// SecurityIssue describes a potentially risky entry found in an image layer
+// by SecurityLint.
+type SecurityIssue struct {
+	// Layer is the digest of the layer containing the entry.
+	Layer digest.Digest `json:"layer"`
+
+	// Path is the path of the entry within the layer.
+	Path string `json:"path"`
+
+	// Mode is the permission bits of the entry (as stored in the layer).
+	Mode int64 `json:"mode"`
+
+	// Problem is a human-readable description of the issue.
+	Problem string `json:"problem"`
+}
+
+// securityProblems returns the set of problems with the given tar entry.
+func securityProblems(hdr *tar.Header) []string {
+	var problems []string
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		if hdr.Mode&tarModeSetuid != 0 {
+			problems = append(problems, "setuid file")
+		}
+		if hdr.Mode&tarModeSetgid != 0 {
+			problems = append(problems, "setgid file")
+		}
+		if hdr.Mode&tarModeOtherW != 0 {
+			problems = append(problems, "world-writable file")
+		}
+	case tar.TypeDir:
+		if hdr.Mode&tarModeOtherW != 0 && hdr.Mode&tarModeSticky == 0 {
+			problems = append(problems, "world-writable directory without sticky bit")
+		}
+	}
+	return problems
+}
+
+// SecurityLint scans all of the layers of the given manifest for entries with
+// potentially risky permissions, such as setuid or setgid files and
+// world-writable directories without the sticky bit set. Each layer is
+// scanned independently, so entries which are removed by later layers are
+// still reported. SecurityLint is read-only.
+func SecurityLint(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) ([]SecurityIssue, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return nil, fmt.Errorf("security lint: cannot lint a non-manifest descriptor: invalid media type %q", manifestDescriptor.MediaType)
+	}
+
+	manifestBlob, err := engine.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, fmt.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	var issues []SecurityIssue
+	for _, layerDescriptor := range manifest.Layers {
+		if err := layer.WalkLayer(ctx, engine, layerDescriptor, func(hdr *tar.Header, _ io.Reader) error {
+			for _, problem := range securityProblems(hdr) {
+				issues = append(issues, SecurityIssue{
+					Layer:   layerDescriptor.Digest,
+					Path:    hdr.Name,
+					Mode:    hdr.Mode,
+					Problem: problem,
+				})
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("security lint: walk layer %s: %w", layerDescriptor.Digest, err)
+		}
+	}
+	return issues, nil
+}
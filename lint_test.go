@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+)
+
+func TestSecurityLint(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestSecurityLint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755},
+		{Name: "usr/bin/wall", Typeflag: tar.TypeReg, Mode: 02755},
+		{Name: "usr/bin/ls", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777},
+		{Name: "data/", Typeflag: tar.TypeDir, Mode: 0777},
+		{Name: "data/file", Typeflag: tar.TypeReg, Mode: 0666},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "usr/bin/su", Mode: 0777},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDesc, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, nil, mutate.GzipCompressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	issues, err := SecurityLint(ctx, engineExt, newDescriptorPath.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error in security lint: %+v", err)
+	}
+
+	expected := []SecurityIssue{
+		{Layer: layerDesc.Digest, Path: "usr/bin/su", Mode: 04755, Problem: "setuid file"},
+		{Layer: layerDesc.Digest, Path: "usr/bin/wall", Mode: 02755, Problem: "setgid file"},
+		{Layer: layerDesc.Digest, Path: "data/", Mode: 0777, Problem: "world-writable directory without sticky bit"},
+		{Layer: layerDesc.Digest, Path: "data/file", Mode: 0666, Problem: "world-writable file"},
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("unexpected number of issues: expected %d got %d: %+v", len(expected), len(issues), issues)
+	}
+	for idx := range expected {
+		if issues[idx] != expected[idx] {
+			t.Errorf("unexpected issue %d: expected %+v got %+v", idx, expected[idx], issues[idx])
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/vbatts/go-mtree"
+)
+
+// digestKeyword is the mtree keyword which requires hashing the contents of
+// every regular file, and thus dominates the cost of an mtree walk.
+const digestKeyword = mtree.Keyword("sha256digest")
+
+// walkParallel is equivalent to mtree.Walk (without excludes), except that the
+// sha256digest keyword is computed by up to concurrency workers in parallel.
+// The resulting DirectoryHierarchy is identical to the one mtree.Walk would
+// have generated. If concurrency is less than 2, this is just mtree.Walk.
+func walkParallel(root string, keywords []mtree.Keyword, fsEval mtree.FsEval, concurrency int) (*mtree.DirectoryHierarchy, error) {
+	digestIdx := -1
+	for idx, keyword := range keywords {
+		if mtree.KeywordSynonym(string(keyword)) == digestKeyword {
+			digestIdx = idx
+			break
+		}
+	}
+	if concurrency < 2 || digestIdx < 0 {
+		return mtree.Walk(root, nil, keywords, fsEval)
+	}
+	if fsEval == nil {
+		fsEval = mtree.DefaultFsEval{}
+	}
+
+	// Do the walk without the expensive keyword. We fill it in afterwards.
+	var walkKeywords []mtree.Keyword
+	walkKeywords = append(walkKeywords, keywords[:digestIdx]...)
+	walkKeywords = append(walkKeywords, keywords[digestIdx+1:]...)
+	dh, err := mtree.Walk(root, nil, walkKeywords, fsEval)
+	if err != nil {
+		return nil, err
+	}
+
+	// The walk included a comment with the set of keywords it used, which we
+	// need to switch to the full set of keywords.
+	walkComment := keywordsComment(walkKeywords)
+	for idx, entry := range dh.Entries {
+		if entry.Type == mtree.CommentType && entry.Raw == walkComment {
+			dh.Entries[idx].Raw = keywordsComment(keywords)
+		}
+	}
+
+	// Figure out which entries need to be hashed.
+	var (
+		entries []int
+		paths   []string
+	)
+	for idx, entry := range dh.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		if !isRegularEntry(entry) {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			return nil, fmt.Errorf("get mtree entry path: %w", err)
+		}
+		entries = append(entries, idx)
+		paths = append(paths, filepath.Join(root, path))
+	}
+
+	// Hash all of the files.
+	digests := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				digests[job], errs[job] = hashFile(fsEval, paths[job])
+			}
+		}()
+	}
+	for job := range paths {
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Insert the keyword where mtree.Walk would've put it, which is before any
+	// keywords which came after it in the keyword list.
+	later := map[mtree.Keyword]struct{}{}
+	for _, keyword := range keywords[digestIdx+1:] {
+		later[keyword.Prefix()] = struct{}{}
+	}
+	for job, idx := range entries {
+		if errs[job] != nil {
+			return nil, fmt.Errorf("hash %s: %w", paths[job], errs[job])
+		}
+		entry := &dh.Entries[idx]
+		kv := mtree.KeyVal(fmt.Sprintf("%s=%s", digestKeyword, digests[job]))
+
+		pos := len(entry.Keywords)
+		for kvIdx, oldKv := range entry.Keywords {
+			if _, ok := later[oldKv.Keyword().Prefix()]; ok {
+				pos = kvIdx
+				break
+			}
+		}
+		var newKeywords []mtree.KeyVal
+		newKeywords = append(newKeywords, entry.Keywords[:pos]...)
+		newKeywords = append(newKeywords, kv)
+		newKeywords = append(newKeywords, entry.Keywords[pos:]...)
+		entry.Keywords = newKeywords
+	}
+	return dh, nil
+}
+
+// checkParallel is equivalent to mtree.Check, except that files are hashed by
+// up to concurrency workers in parallel (see walkParallel). mtree.Compare
+// returns the deltas in an arbitrary order, so they are sorted by path to make
+// the result deterministic (and independent of concurrency).
+func checkParallel(root string, dh *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fsEval mtree.FsEval, concurrency int) ([]mtree.InodeDelta, error) {
+	if keywords == nil {
+		keywords = dh.UsedKeywords()
+	}
+	newDh, err := walkParallel(root, keywords, fsEval, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := mtree.Compare(dh, newDh, keywords)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return diffs[i].Path() < diffs[j].Path()
+	})
+	return diffs, nil
+}
+
+// keywordsComment returns the comment mtree.Walk includes in a generated
+// DirectoryHierarchy to describe which keywords were used.
+func keywordsComment(keywords []mtree.Keyword) string {
+	return fmt.Sprintf("#%16s%s", "keywords: ", strings.Join(mtree.FromKeywords(keywords), ","))
+}
+
+// isRegularEntry returns whether the given mtree entry is a regular file.
+func isRegularEntry(entry mtree.Entry) bool {
+	for _, kv := range entry.AllKeys() {
+		if kv.Keyword().Prefix() == "type" {
+			return kv.Value() == "file"
+		}
+	}
+	return false
+}
+
+// hashFile returns the hex-encoded SHA256 digest of the file at the given
+// path, opened using fsEval.
+func hashFile(fsEval mtree.FsEval, path string) (string, error) {
+	fh, err := fsEval.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := system.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,329 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/vbatts/go-mtree"
+)
+
+// makeMtreeBundle creates a bundle with a rootfs containing a variety of
+// files, for use with mtree generation tests.
+func makeMtreeBundle(t testing.TB, ndirs, nfiles int) string {
+	bundle, err := ioutil.TempDir("", "umoci-TestMtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+
+	for i := 0; i < ndirs; i++ {
+		dir := filepath.Join(rootfs, fmt.Sprintf("dir%d", i), "sub dir")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < nfiles; j++ {
+			data := bytes.Repeat([]byte(fmt.Sprintf("file %d in %d\n", j, i)), 1024*j)
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", j)), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("sub dir/file0", filepath.Join(rootfs, fmt.Sprintf("dir%d", i), "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(filepath.Join(rootfs, fmt.Sprintf("dir%d", i), "empty"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bundle
+}
+
+// readMtree reads the given mtree manifest, stripping the generation date
+// comment so that manifests generated at different times can be compared.
+func readMtree(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, "# "), []byte("date: ")) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+func TestGenerateBundleManifestParallel(t *testing.T) {
+	bundle := makeMtreeBundle(t, 8, 16)
+	defer os.RemoveAll(bundle)
+
+	if err := GenerateBundleManifest("serial", bundle, fseval.Default); err != nil {
+		t.Fatalf("unexpected error generating serial mtree: %+v", err)
+	}
+	serial := readMtree(t, filepath.Join(bundle, "serial.mtree"))
+
+	for _, concurrency := range []int{0, 2, 4, 32} {
+		name := fmt.Sprintf("parallel-%d", concurrency)
+		if err := GenerateBundleManifestParallel(name, bundle, fseval.Default, concurrency); err != nil {
+			t.Fatalf("unexpected error generating mtree with concurrency %d: %+v", concurrency, err)
+		}
+		parallel := readMtree(t, filepath.Join(bundle, name+".mtree"))
+		if !bytes.Equal(serial, parallel) {
+			t.Errorf("mtree with concurrency %d differs from serial mtree:\nserial:\n%s\nparallel:\n%s", concurrency, serial, parallel)
+		}
+	}
+}
+
+// countingFsEval is an mtree.FsEval which keeps track of the maximum number of
+// concurrent Open calls.
+type countingFsEval struct {
+	mtree.FsEval
+
+	lock       sync.Mutex
+	current    int
+	maxCurrent int
+	total      int
+}
+
+func (fs *countingFsEval) Open(path string) (*os.File, error) {
+	fs.lock.Lock()
+	fs.current++
+	fs.total++
+	if fs.current > fs.maxCurrent {
+		fs.maxCurrent = fs.current
+	}
+	fs.lock.Unlock()
+
+	// Give other workers a chance to overlap with us.
+	time.Sleep(time.Millisecond)
+
+	fs.lock.Lock()
+	fs.current--
+	fs.lock.Unlock()
+	return fs.FsEval.Open(path)
+}
+
+func TestGenerateBundleManifestParallelLimit(t *testing.T) {
+	bundle := makeMtreeBundle(t, 2, 8)
+	defer os.RemoveAll(bundle)
+
+	if err := GenerateBundleManifest("serial", bundle, fseval.Default); err != nil {
+		t.Fatalf("unexpected error generating serial mtree: %+v", err)
+	}
+	serial := readMtree(t, filepath.Join(bundle, "serial.mtree"))
+
+	for _, concurrency := range []int{1, 2, 3} {
+		name := fmt.Sprintf("limited-%d", concurrency)
+		fsEval := &countingFsEval{FsEval: fseval.Default}
+		if err := GenerateBundleManifestParallel(name, bundle, fsEval, concurrency); err != nil {
+			t.Fatalf("unexpected error generating mtree with concurrency %d: %+v", concurrency, err)
+		}
+		if fsEval.total == 0 {
+			t.Errorf("no files were opened with concurrency %d", concurrency)
+		}
+		if fsEval.maxCurrent > concurrency {
+			t.Errorf("concurrency limit %d not respected: %d files opened concurrently", concurrency, fsEval.maxCurrent)
+		}
+
+		limited := readMtree(t, filepath.Join(bundle, name+".mtree"))
+		if !bytes.Equal(serial, limited) {
+			t.Errorf("mtree with concurrency %d differs from serial mtree:\nserial:\n%s\nlimited:\n%s", concurrency, serial, limited)
+		}
+	}
+}
+
+func benchmarkGenerateBundleManifest(b *testing.B, concurrency int) {
+	bundle := makeMtreeBundle(b, 32, 32)
+	defer os.RemoveAll(bundle)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("bench-%d", i)
+		if err := GenerateBundleManifestParallel(name, bundle, fseval.Default, concurrency); err != nil {
+			b.Fatalf("unexpected error generating mtree: %+v", err)
+		}
+		b.StopTimer()
+		if err := os.Remove(filepath.Join(bundle, name+".mtree")); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkGenerateBundleManifestSerial(b *testing.B) {
+	benchmarkGenerateBundleManifest(b, 1)
+}
+
+func BenchmarkGenerateBundleManifestParallel(b *testing.B) {
+	benchmarkGenerateBundleManifest(b, 8)
+}
+
+// describeDeltas returns a description of each delta (including the changed
+// keywords), for comparing sets of deltas.
+func describeDeltas(diffs []mtree.InodeDelta) []string {
+	var descs []string
+	for _, diff := range diffs {
+		// The order of the changed keywords is arbitrary.
+		var keys []string
+		for _, key := range diff.Diff() {
+			keyDesc := fmt.Sprintf("%s:%s", key.Name(), key.Type())
+			if old := key.Old(); old != nil {
+				keyDesc += fmt.Sprintf(" old=%s", *old)
+			}
+			if new := key.New(); new != nil {
+				keyDesc += fmt.Sprintf(" new=%s", *new)
+			}
+			keys = append(keys, keyDesc)
+		}
+		sort.Strings(keys)
+		descs = append(descs, fmt.Sprintf("%s %s [%s]", diff.Type(), diff.Path(), strings.Join(keys, ", ")))
+	}
+	return descs
+}
+
+// modifyMtreeBundle makes a variety of changes to a bundle created with
+// makeMtreeBundle.
+func modifyMtreeBundle(t testing.TB, bundle string, ndirs int) {
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	for i := 0; i < ndirs; i++ {
+		dir := filepath.Join(rootfs, fmt.Sprintf("dir%d", i))
+		switch i % 4 {
+		case 0:
+			// Same size, different contents.
+			data, err := ioutil.ReadFile(filepath.Join(dir, "sub dir", "file1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[0] ^= 0xff
+			if err := ioutil.WriteFile(filepath.Join(dir, "sub dir", "file1"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		case 1:
+			if err := os.Remove(filepath.Join(dir, "sub dir", "file2")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(filepath.Join(dir, "empty"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			if err := ioutil.WriteFile(filepath.Join(dir, "new file"), []byte("new contents"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("empty", filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+		case 3:
+			if err := os.RemoveAll(filepath.Join(dir, "sub dir")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// parseMtree parses the mtree manifest at the given path.
+func parseMtree(t testing.TB, path string) *mtree.DirectoryHierarchy {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	spec, err := mtree.ParseSpec(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestCheckParallel(t *testing.T) {
+	bundle := makeMtreeBundle(t, 8, 16)
+	defer os.RemoveAll(bundle)
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+
+	if err := GenerateBundleManifest("baseline", bundle, fseval.Default); err != nil {
+		t.Fatalf("unexpected error generating mtree: %+v", err)
+	}
+	spec := parseMtree(t, filepath.Join(bundle, "baseline.mtree"))
+	modifyMtreeBundle(t, bundle, 8)
+
+	serialDiffs, err := mtree.Check(rootfs, spec, MtreeKeywords, fseval.Default)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	sort.Slice(serialDiffs, func(i, j int) bool {
+		return serialDiffs[i].Path() < serialDiffs[j].Path()
+	})
+	serial := describeDeltas(serialDiffs)
+	if len(serial) == 0 {
+		t.Fatalf("modified bundle has no changes")
+	}
+
+	for _, concurrency := range []int{0, 1, 2, 4, 32} {
+		diffs, err := checkParallel(rootfs, spec, MtreeKeywords, fseval.Default, concurrency)
+		if err != nil {
+			t.Fatalf("unexpected error checking mtree with concurrency %d: %+v", concurrency, err)
+		}
+		parallel := describeDeltas(diffs)
+		if !reflect.DeepEqual(serial, parallel) {
+			t.Errorf("deltas with concurrency %d differ from serial deltas:\nserial:\n%s\nparallel:\n%s", concurrency, strings.Join(serial, "\n"), strings.Join(parallel, "\n"))
+		}
+	}
+}
+
+func benchmarkCheck(b *testing.B, concurrency int) {
+	bundle := makeMtreeBundle(b, 32, 32)
+	defer os.RemoveAll(bundle)
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+
+	if err := GenerateBundleManifest("baseline", bundle, fseval.Default); err != nil {
+		b.Fatalf("unexpected error generating mtree: %+v", err)
+	}
+	spec := parseMtree(b, filepath.Join(bundle, "baseline.mtree"))
+	modifyMtreeBundle(b, bundle, 32)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := checkParallel(rootfs, spec, MtreeKeywords, fseval.Default, concurrency); err != nil {
+			b.Fatalf("unexpected error checking mtree: %+v", err)
+		}
+	}
+}
+
+func BenchmarkCheckSerial(b *testing.B) {
+	benchmarkCheck(b, 1)
+}
+
+func BenchmarkCheckParallel(b *testing.B) {
+	benchmarkCheck(b, 8)
+}
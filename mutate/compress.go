@@ -5,11 +5,14 @@ import (
 	"io"
 	"io/ioutil"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/apex/log"
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pierrec/lz4/v4"
 )
 
 // Compressor is an interface which users can use to implement different
@@ -45,18 +48,50 @@ func (nc noopCompressor) BytesRead() int64 {
 // NoopCompressor provides no compression.
 var NoopCompressor Compressor = noopCompressor{}
 
+// defaultGzipLevel is the compression level used by GzipCompressor. This is
+// the same as the default level of the gzip library, but is pinned here so
+// that it can be recorded in UmociCompressionAnnotation.
+const defaultGzipLevel = 5
+
+// GzipBlockSize is the size of the blocks which gzip compression splits its
+// input into, each of which is compressed separately (in parallel). The
+// compressed output depends on the block size, so it is fixed here (rather
+// than using the default of the gzip library) to ensure that the same layer
+// always results in the same gzip blob.
+const GzipBlockSize = 256 << 10
+
 // GzipCompressor provides gzip compression.
-var GzipCompressor Compressor = &gzipCompressor{}
+var GzipCompressor Compressor = &gzipCompressor{level: defaultGzipLevel}
+
+// GzipCompressorWithLevel returns a Compressor which provides gzip compression
+// with the given compression level, from gzip.HuffmanOnly (-2) and
+// gzip.NoCompression (0) to gzip.BestCompression (9). gzip.DefaultCompression
+// (-1) is the same as GzipCompressor. The media type suffix is always "gzip",
+// so the compressor can be used anywhere GzipCompressor can.
+func GzipCompressorWithLevel(level int) (Compressor, error) {
+	if level == gzip.DefaultCompression {
+		level = defaultGzipLevel
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	return &gzipCompressor{level: level}, nil
+}
 
 type gzipCompressor struct {
+	level     int
 	bytesRead int64
 }
 
 func (gz *gzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
 	pipeReader, pipeWriter := io.Pipe()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	if err := gzw.SetConcurrency(256<<10, 2*runtime.NumCPU()); err != nil {
+	gzw, err := gzip.NewWriterLevel(pipeWriter, gz.level)
+	if err != nil {
+		return nil, fmt.Errorf("create gzip writer: %w", err)
+	}
+	// The number of blocks compressed in parallel does not affect the output.
+	if err := gzw.SetConcurrency(GzipBlockSize, 2*runtime.NumCPU()); err != nil {
 		return nil, fmt.Errorf("set concurrency level to %v blocks: %w", 2*runtime.NumCPU(), err)
 	}
 	go func() {
@@ -92,17 +127,80 @@ func (gz gzipCompressor) BytesRead() int64 {
 	return gz.bytesRead
 }
 
+// defaultZstdLevel is the compression level (using the standard zstd level
+// numbering) used by ZstdCompressor. This is the same as the default level of
+// the zstd library, but is pinned here so that it can be recorded in
+// UmociCompressionAnnotation.
+const defaultZstdLevel = 3
+
+// maxZstdLevel is the highest compression level supported by zstd.
+const maxZstdLevel = 22
+
+// The zstd window size (the maximum back-reference distance) used for each
+// range of zstd compression levels. The compressed output depends on the
+// window size, so these are fixed here (rather than using the defaults of the
+// zstd library) to ensure that the same layer compressed with the same level
+// always results in the same zstd blob.
+const (
+	// ZstdFastestWindowSize is the window size used for levels 1 and 2.
+	ZstdFastestWindowSize = 4 << 20
+	// ZstdDefaultWindowSize is the window size used for levels 3 to 5.
+	ZstdDefaultWindowSize = 8 << 20
+	// ZstdBetterWindowSize is the window size used for levels 6 and above.
+	ZstdBetterWindowSize = 16 << 20
+)
+
+// zstdEncoderOptions returns the zstd encoder options for the given
+// compression level. All options which affect the compressed output are set
+// explicitly.
+func zstdEncoderOptions(level int) []zstd.EOption {
+	windowSize := ZstdDefaultWindowSize
+	switch {
+	case level < 3:
+		windowSize = ZstdFastestWindowSize
+	case level >= 6:
+		windowSize = ZstdBetterWindowSize
+	}
+	return []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithWindowSize(windowSize),
+		zstd.WithEncoderCRC(true),
+		zstd.WithZeroFrames(false),
+	}
+}
+
 // ZstdCompressor provides zstd compression.
-var ZstdCompressor Compressor = &zstdCompressor{}
+var ZstdCompressor Compressor = &zstdCompressor{level: defaultZstdLevel}
+
+// ZstdCompressorWithLevel returns a Compressor which provides zstd compression
+// with the given compression level, using the standard zstd level numbering
+// from 1 (fastest) to 22 (best compression). The zstd library only implements
+// a few distinct encoder levels, so nearby levels may produce identical
+// output. The media type suffix is always "zstd", so the compressor can be
+// used anywhere ZstdCompressor can.
+func ZstdCompressorWithLevel(level int) (Compressor, error) {
+	if err := checkZstdLevel(level); err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{level: level}, nil
+}
+
+func checkZstdLevel(level int) error {
+	if level < 1 || level > maxZstdLevel {
+		return fmt.Errorf("invalid zstd compression level %d", level)
+	}
+	return nil
+}
 
 type zstdCompressor struct {
+	level     int
 	bytesRead int64
 }
 
 func (zs *zstdCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
 
 	pipeReader, pipeWriter := io.Pipe()
-	zw, err := zstd.NewWriter(pipeWriter)
+	zw, err := zstd.NewWriter(pipeWriter, zstdEncoderOptions(zs.level)...)
 	if err != nil {
 		return nil, err
 	}
@@ -138,3 +236,171 @@ func (zs zstdCompressor) MediaTypeSuffix() string {
 func (zs zstdCompressor) BytesRead() int64 {
 	return zs.bytesRead
 }
+
+// LZ4Compressor provides lz4 compression (using the LZ4 frame format). lz4
+// compresses less than gzip or zstd, but decompression is much faster, which
+// can be worth it on slow hardware. Note that lz4 layers are not defined by
+// the image-spec, and are not supported by many other tools.
+var LZ4Compressor Compressor = &lz4Compressor{}
+
+type lz4Compressor struct {
+	bytesRead int64
+}
+
+func (lc *lz4Compressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	lzw := lz4.NewWriter(pipeWriter)
+	// These are the defaults, but they are set explicitly because the layer
+	// digest depends on them.
+	if err := lzw.Apply(
+		lz4.BlockSizeOption(lz4.Block4Mb),
+		lz4.ChecksumOption(true),
+		lz4.CompressionLevelOption(lz4.Fast),
+		lz4.ConcurrencyOption(1),
+	); err != nil {
+		return nil, fmt.Errorf("set lz4 writer options: %w", err)
+	}
+	go func() {
+		bytesRead, err := system.Copy(lzw, reader)
+		if err != nil {
+			log.Warnf("lz4 compress: could not compress layer: %v", err)
+			// #nosec G104
+			_ = pipeWriter.CloseWithError(fmt.Errorf("compressing layer: %w", err))
+			return
+		}
+		lc.bytesRead = bytesRead
+		if err := lzw.Close(); err != nil {
+			log.Warnf("lz4 compress: could not close lz4 writer: %v", err)
+			// #nosec G104
+			_ = pipeWriter.CloseWithError(fmt.Errorf("close lz4 writer: %w", err))
+			return
+		}
+		if err := pipeWriter.Close(); err != nil {
+			log.Warnf("lz4 compress: could not close pipe: %v", err)
+			// We don't CloseWithError because we cannot override the Close.
+			return
+		}
+	}()
+
+	return pipeReader, nil
+}
+
+func (lc lz4Compressor) MediaTypeSuffix() string {
+	return "lz4"
+}
+
+func (lc lz4Compressor) BytesRead() int64 {
+	return lc.bytesRead
+}
+
+// cloneCompressor returns a new Compressor with the same settings as the given
+// Compressor, so that several blobs can be compressed concurrently without
+// their BytesRead values being mixed up. Only umoci's own compressors can be
+// cloned.
+func cloneCompressor(compressor Compressor) (Compressor, bool) {
+	switch c := compressor.(type) {
+	case noopCompressor:
+		return c, true
+	case *gzipCompressor:
+		return &gzipCompressor{level: c.level}, true
+	case *zstdCompressor:
+		return &zstdCompressor{level: c.level}, true
+	case *zstdChunkedCompressor:
+		return &zstdChunkedCompressor{level: c.level, chunkSize: c.chunkSize}, true
+	case *lz4Compressor:
+		return &lz4Compressor{}, true
+	}
+	return nil, false
+}
+
+// UmociCompressionAnnotation is an umoci-specific annotation set on the
+// descriptors of compressed blobs, describing the exact compression algorithm
+// and settings used to create the blob (such as "gzip;level=5"). This allows
+// for blobs to be reproduced byte-for-byte, even if the default settings used
+// by umoci change. All other settings which affect the compressed output
+// (such as GzipBlockSize) are fixed. Use CompressorFromAnnotation to get a
+// Compressor with the same settings.
+const UmociCompressionAnnotation = "ci.umo.compression"
+
+// compressionAnnotation returns the UmociCompressionAnnotation value for the
+// given Compressor. Only umoci's own compressors can be described.
+func compressionAnnotation(compressor Compressor) (string, bool) {
+	switch c := compressor.(type) {
+	case *gzipCompressor:
+		return fmt.Sprintf("%s;level=%d", c.MediaTypeSuffix(), c.level), true
+	case *zstdCompressor:
+		return fmt.Sprintf("%s;level=%d", c.MediaTypeSuffix(), c.level), true
+	case *zstdChunkedCompressor:
+		return fmt.Sprintf("%s;level=%d;chunk-size=%d", zstdChunkedAlgorithm, c.level, c.chunkSize), true
+	case *lz4Compressor:
+		// Our lz4 writer has no settings.
+		return c.MediaTypeSuffix(), true
+	}
+	return "", false
+}
+
+// CompressorFromAnnotation returns a new Compressor which uses the compression
+// algorithm and settings described by the given UmociCompressionAnnotation
+// value, allowing a blob to be reproduced with exactly the same settings.
+func CompressorFromAnnotation(value string) (Compressor, error) {
+	parts := strings.Split(value, ";")
+	algorithm, params := parts[0], parts[1:]
+
+	level := -1
+	var chunkSize int64 = -1
+	for _, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid compression parameter %q", param)
+		}
+		switch kv[0] {
+		case "level":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("parse compression level: %w", err)
+			}
+			level = n
+		case "chunk-size":
+			if algorithm != zstdChunkedAlgorithm {
+				return nil, fmt.Errorf("compression parameter %q is only supported by %s", kv[0], zstdChunkedAlgorithm)
+			}
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse chunk size: %w", err)
+			}
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid chunk size %d", n)
+			}
+			chunkSize = n
+		default:
+			return nil, fmt.Errorf("unknown compression parameter %q", kv[0])
+		}
+	}
+
+	switch algorithm {
+	case "gzip":
+		return GzipCompressorWithLevel(level)
+	case "zstd":
+		if level == -1 {
+			level = defaultZstdLevel
+		}
+		return ZstdCompressorWithLevel(level)
+	case zstdChunkedAlgorithm:
+		if level == -1 {
+			level = defaultZstdLevel
+		}
+		if err := checkZstdLevel(level); err != nil {
+			return nil, err
+		}
+		if chunkSize == -1 {
+			chunkSize = defaultZstdChunkSize
+		}
+		return &zstdChunkedCompressor{level: level, chunkSize: chunkSize}, nil
+	case "lz4":
+		if level != -1 {
+			return nil, fmt.Errorf("lz4 compression does not support compression levels")
+		}
+		return &lz4Compressor{}, nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+}
@@ -1,13 +1,21 @@
 package mutate
 
 import (
+	"archive/tar"
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"strings"
 	"testing"
 
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	"github.com/pierrec/lz4/v4"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -66,3 +74,350 @@ func TestZstdCompressor(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(content.String(), fact)
 }
+
+func TestLZ4Compressor(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := bytes.NewBufferString(fact)
+	c := LZ4Compressor
+
+	r, err := c.Compress(buf)
+	assert.NoError(err)
+	assert.Equal(c.MediaTypeSuffix(), "lz4")
+
+	content, err := ioutil.ReadAll(lz4.NewReader(r))
+	assert.NoError(err)
+	assert.Equal(string(content), fact)
+}
+
+func TestGzipCompressorWithLevel(t *testing.T) {
+	data := bytes.Repeat([]byte(fact), 4096)
+
+	for _, level := range []int{gzip.HuffmanOnly, gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		t.Run(fmt.Sprintf("Level%d", level), func(t *testing.T) {
+			assert := assert.New(t)
+
+			c, err := GzipCompressorWithLevel(level)
+			assert.NoError(err)
+			assert.Equal("gzip", c.MediaTypeSuffix())
+
+			r, err := c.Compress(bytes.NewReader(data))
+			assert.NoError(err)
+			r, err = gzip.NewReader(r)
+			assert.NoError(err)
+			content, err := ioutil.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(data, content)
+			assert.Equal(int64(len(data)), c.BytesRead())
+
+			// The level must be recorded so the blob can be reproduced with
+			// a compressor of the same family.
+			value, ok := compressionAnnotation(c)
+			assert.True(ok)
+			assert.Equal(fmt.Sprintf("gzip;level=%d", level), value)
+			reproducer, err := CompressorFromAnnotation(value)
+			assert.NoError(err)
+			assert.Equal(c.MediaTypeSuffix(), reproducer.MediaTypeSuffix())
+		})
+	}
+
+	// The default level is the same as GzipCompressor.
+	c, err := GzipCompressorWithLevel(gzip.DefaultCompression)
+	assert.NoError(t, err)
+	value, _ := compressionAnnotation(c)
+	defaultValue, _ := compressionAnnotation(GzipCompressor)
+	assert.Equal(t, defaultValue, value)
+
+	for _, level := range []int{-3, 10} {
+		_, err := GzipCompressorWithLevel(level)
+		assert.Error(t, err, "level %d should be rejected", level)
+	}
+}
+
+func TestZstdCompressorWithLevel(t *testing.T) {
+	data := bytes.Repeat([]byte(fact), 4096)
+
+	for _, level := range []int{1, 3, 11, 22} {
+		t.Run(fmt.Sprintf("Level%d", level), func(t *testing.T) {
+			assert := assert.New(t)
+
+			c, err := ZstdCompressorWithLevel(level)
+			assert.NoError(err)
+			assert.Equal("zstd", c.MediaTypeSuffix())
+
+			r, err := c.Compress(bytes.NewReader(data))
+			assert.NoError(err)
+			dec, err := zstd.NewReader(r)
+			assert.NoError(err)
+			defer dec.Close()
+			content, err := ioutil.ReadAll(dec)
+			assert.NoError(err)
+			assert.Equal(data, content)
+			assert.Equal(int64(len(data)), c.BytesRead())
+
+			// The level must be recorded so the blob can be reproduced with
+			// a compressor of the same family.
+			value, ok := compressionAnnotation(c)
+			assert.True(ok)
+			assert.Equal(fmt.Sprintf("zstd;level=%d", level), value)
+			reproducer, err := CompressorFromAnnotation(value)
+			assert.NoError(err)
+			assert.Equal(c.MediaTypeSuffix(), reproducer.MediaTypeSuffix())
+		})
+	}
+
+	for _, level := range []int{-1, 0, 23} {
+		_, err := ZstdCompressorWithLevel(level)
+		assert.Error(t, err, "level %d should be rejected", level)
+	}
+}
+
+func TestCompressorFromAnnotation(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		valid    bool
+		expected string
+	}{
+		{"gzip", true, "gzip;level=5"},
+		{"gzip;level=9", true, "gzip;level=9"},
+		{"gzip;level=1", true, "gzip;level=1"},
+		{"gzip;level=10", false, ""},
+		{"gzip;level=abc", false, ""},
+		{"gzip;level", false, ""},
+		{"gzip;speed=1", false, ""},
+		{"zstd", true, "zstd;level=3"},
+		{"zstd;level=19", true, "zstd;level=19"},
+		{"zstd;level=22", true, "zstd;level=22"},
+		{"zstd;level=0", false, ""},
+		{"zstd;level=23", false, ""},
+		{"zstd;chunk-size=1024", false, ""},
+		{"zstd:chunked", true, "zstd:chunked;level=3;chunk-size=4194304"},
+		{"zstd:chunked;chunk-size=1024;level=19", true, "zstd:chunked;level=19;chunk-size=1024"},
+		{"zstd:chunked;chunk-size=0", false, ""},
+		{"zstd:chunked;chunk-size=abc", false, ""},
+		{"zstd:chunked;level=0", false, ""},
+		{"lz4", true, "lz4"},
+		{"lz4;level=1", false, ""},
+		{"lzma;level=1", false, ""},
+		{"", false, ""},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			assert := assert.New(t)
+
+			c, err := CompressorFromAnnotation(test.value)
+			if !test.valid {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+
+			value, ok := compressionAnnotation(c)
+			assert.True(ok)
+			assert.Equal(test.expected, value)
+
+			// Make sure the compressor actually works.
+			r, err := c.Compress(bytes.NewBufferString(fact))
+			assert.NoError(err)
+			_, err = io.Copy(ioutil.Discard, r)
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestCompressionAnnotationDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	// The default compressors must produce exactly the same output as the
+	// compressors described by their annotations.
+	for _, c := range []Compressor{GzipCompressor, ZstdCompressor, ZstdChunkedCompressor, LZ4Compressor} {
+		value, ok := compressionAnnotation(c)
+		assert.True(ok)
+
+		reproducer, err := CompressorFromAnnotation(value)
+		assert.NoError(err)
+
+		r1, err := c.Compress(bytes.NewBufferString(fact))
+		assert.NoError(err)
+		out1, err := ioutil.ReadAll(r1)
+		assert.NoError(err)
+
+		r2, err := reproducer.Compress(bytes.NewBufferString(fact))
+		assert.NoError(err)
+		out2, err := ioutil.ReadAll(r2)
+		assert.NoError(err)
+
+		assert.Equal(out1, out2, "compressor %q is not reproducible", value)
+	}
+
+	_, ok := compressionAnnotation(NoopCompressor)
+	assert.False(ok)
+}
+
+func TestZstdChunkedCompressor(t *testing.T) {
+	assert := assert.New(t)
+
+	files := map[string]string{
+		"small":       fact,
+		"empty":       "",
+		"dir/chunked": strings.Repeat(fact, 200),
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	assert.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755}))
+	assert.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "small"}))
+	for _, name := range []string{"small", "empty", "dir/chunked"} {
+		assert.NoError(tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Xattrs:   map[string]string{"user.name": name},
+		}))
+		_, err := tw.Write([]byte(files[name]))
+		assert.NoError(err)
+	}
+	assert.NoError(tw.Close())
+	layer := buffer.Bytes()
+
+	c := NewZstdChunkedCompressor(1024)
+	assert.Equal("zstd", c.MediaTypeSuffix())
+
+	r, err := c.Compress(bytes.NewReader(layer))
+	assert.NoError(err)
+	blob, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(int64(len(layer)), c.BytesRead())
+
+	// The blob must decompress to exactly the same stream.
+	dec, err := zstd.NewReader(nil)
+	assert.NoError(err)
+	defer dec.Close()
+	content, err := dec.DecodeAll(blob, nil)
+	assert.NoError(err)
+	assert.Equal(layer, content)
+
+	// The footer points to the table of contents.
+	footer := blob[len(blob)-zstdChunkedFooterSize:]
+	assert.Equal(zstdChunkedFooterMagic, footer[56:])
+	manifestOffset := binary.LittleEndian.Uint64(footer[0:])
+	manifestSize := binary.LittleEndian.Uint64(footer[8:])
+	manifestUncompressedSize := binary.LittleEndian.Uint64(footer[16:])
+	assert.EqualValues(zstdChunkedManifestType, binary.LittleEndian.Uint64(footer[24:]))
+
+	// ... as do the annotations.
+	annotations := c.(annotatedCompressor).Annotations()
+	assert.Equal(fmt.Sprintf("%d:%d:%d:%d", manifestOffset, manifestSize, manifestUncompressedSize, zstdChunkedManifestType), annotations[ZstdChunkedManifestPositionAnnotation])
+	compressedManifest := blob[manifestOffset : manifestOffset+manifestSize]
+	assert.Equal(digest.FromBytes(compressedManifest).String(), annotations[ZstdChunkedManifestChecksumAnnotation])
+
+	manifestJSON, err := dec.DecodeAll(compressedManifest, nil)
+	assert.NoError(err)
+	assert.EqualValues(manifestUncompressedSize, len(manifestJSON))
+	var manifest zstdChunkedManifest
+	assert.NoError(json.Unmarshal(manifestJSON, &manifest))
+	assert.Equal(1, manifest.Version)
+
+	// Every file (and chunk) can be extracted from its own frames.
+	contents := map[string]string{}
+	var types []string
+	for _, entry := range manifest.Entries {
+		types = append(types, entry.Type)
+		if entry.Offset == 0 {
+			continue
+		}
+		chunk, err := dec.DecodeAll(blob[entry.Offset:entry.EndOffset], nil)
+		assert.NoError(err)
+		if entry.ChunkDigest != "" {
+			assert.Equal(digest.FromBytes(chunk).String(), entry.ChunkDigest)
+		}
+		contents[entry.Name] += string(chunk)
+	}
+	assert.Equal([]string{"dir", "symlink", "reg", "reg", "reg", "chunk", "chunk", "chunk"}, types)
+	assert.Equal(map[string]string{
+		"small":       files["small"],
+		"dir/chunked": files["dir/chunked"],
+	}, contents)
+	for _, entry := range manifest.Entries {
+		if entry.Type == "reg" && entry.Size > 0 {
+			assert.Equal(digest.FromString(files[entry.Name]).String(), entry.Digest, "digest of %s", entry.Name)
+		}
+	}
+}
+
+func TestZstdChunkedCompressorNotTar(t *testing.T) {
+	assert := assert.New(t)
+
+	c := ZstdChunkedCompressor
+	r, err := c.Compress(bytes.NewBufferString(fact))
+	assert.NoError(err)
+
+	dec, err := zstd.NewReader(r)
+	assert.NoError(err)
+	defer dec.Close()
+
+	var content bytes.Buffer
+	_, err = io.Copy(&content, dec)
+	assert.NoError(err)
+	assert.Equal(fact, content.String())
+	assert.Contains(c.(annotatedCompressor).Annotations(), ZstdChunkedManifestPositionAnnotation)
+}
+
+// stableCompressionInput returns the input used by TestCompressorDigests. It
+// spans several gzip blocks and contains both compressible and incompressible
+// data.
+func stableCompressionInput() []byte {
+	var buf bytes.Buffer
+	// The math/rand sequence for a given seed is stable.
+	rng := rand.New(rand.NewSource(1337))
+	for i := 0; buf.Len() < 768<<10; i++ {
+		fmt.Fprintf(&buf, "%d: %s\n", i, fact)
+		if i%64 == 0 {
+			noise := make([]byte, 512)
+			_, _ = rng.Read(noise)
+			buf.Write(noise)
+		}
+	}
+	return buf.Bytes()
+}
+
+// TestCompressorDigests makes sure that compressing the same input results in
+// the same blob, regardless of the version of the compression libraries and
+// their defaults. If this test fails after updating a compression library,
+// the update changes the digests of layers created by umoci (and should be
+// fixed by pinning the changed setting) -- these digests must never be
+// changed.
+func TestCompressorDigests(t *testing.T) {
+	input := stableCompressionInput()
+
+	for _, test := range []struct {
+		annotation string
+		expected   digest.Digest
+	}{
+		{"gzip", "sha256:dd4e137463352460a264691b6c158ce5b9b6d905d14e1a8a7872c8b94123c14d"},
+		{"gzip;level=1", "sha256:ef36a11f8256cd845edbec25698c8f7a15c8d16513f74653f25070b3d6ea32af"},
+		{"gzip;level=9", "sha256:a25d13fc87d50c579ed893de9cf878a7eb9e79fcaa87c03daeac9132dcfdb875"},
+		{"zstd", "sha256:776040d827e1adc26542c6910b029c281a1a0bd994d69d64fbbf09ecd7eb58e9"},
+		{"zstd;level=1", "sha256:755139c1c6e050bef68780e3bb9fa5fd21f66f8f87d76be0361f56c4db13f95c"},
+		{"zstd;level=19", "sha256:27e5d7676d85f81120e2f6d803689b1a3d087b7a6a54d84e09906c6d0b5b969a"},
+		{"lz4", "sha256:f2a30c34002650c09c0a4a3b75522ae1b4b62d8eccd450a48ebb9aa492bda2aa"},
+	} {
+		t.Run(test.annotation, func(t *testing.T) {
+			c, err := CompressorFromAnnotation(test.annotation)
+			if err != nil {
+				t.Fatalf("unexpected error getting compressor: %+v", err)
+			}
+			r, err := c.Compress(bytes.NewReader(input))
+			if err != nil {
+				t.Fatalf("unexpected error compressing: %+v", err)
+			}
+			got, err := digest.SHA256.FromReader(r)
+			if err != nil {
+				t.Fatalf("unexpected error reading compressed blob: %+v", err)
+			}
+			if got != test.expected {
+				t.Errorf("unexpected compressed blob digest: expected %s got %s", test.expected, got)
+			}
+		})
+	}
+}
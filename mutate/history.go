@@ -0,0 +1,84 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RedactedValue is the text which RedactCreatedBy replaces redacted text
+// with.
+const RedactedValue = "<redacted>"
+
+// ExpandHistoryTemplate expands the placeholders in a history template, for
+// use as the CreatedBy value of an ispec.History entry. The supported
+// placeholders are:
+//
+//   - {op}, the name of the operation which created the entry (such as
+//     "insert" or "repack").
+//   - {files}, the space-separated list of paths affected by the operation.
+//   - {time}, the creation time of the entry in ISO-8601 format.
+//
+// Any other text (including unknown placeholders) is left untouched.
+func ExpandHistoryTemplate(template, op string, files []string, created time.Time) string {
+	return strings.NewReplacer(
+		"{op}", op,
+		"{files}", strings.Join(files, " "),
+		"{time}", created.Format(time.RFC3339Nano),
+	).Replace(template)
+}
+
+// RedactCreatedBy returns createdBy with every match of each of the given
+// patterns replaced with RedactedValue, for scrubbing secrets or host paths
+// from the CreatedBy value of an ispec.History entry. If a pattern contains
+// capturing groups, only the text matched by the groups is replaced (so that
+// `--password=(\S+)` leaves "--password=" in place). Patterns are applied in
+// order.
+func RedactCreatedBy(createdBy string, patterns []*regexp.Regexp) string {
+	for _, pattern := range patterns {
+		var (
+			sb   strings.Builder
+			last int // end of the text already copied to sb
+		)
+		for _, match := range pattern.FindAllStringSubmatchIndex(createdBy, -1) {
+			spans := [][]int{match[0:2]}
+			if pattern.NumSubexp() > 0 {
+				spans = nil
+				for idx := 2; idx < len(match); idx += 2 {
+					spans = append(spans, match[idx:idx+2])
+				}
+			}
+			for _, span := range spans {
+				start, end := span[0], span[1]
+				// Skip unmatched and empty groups, as well as groups nested
+				// inside a group which was already redacted.
+				if start < 0 || start == end || start < last {
+					continue
+				}
+				sb.WriteString(createdBy[last:start])
+				sb.WriteString(RedactedValue)
+				last = end
+			}
+		}
+		sb.WriteString(createdBy[last:])
+		createdBy = sb.String()
+	}
+	return createdBy
+}
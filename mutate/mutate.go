@@ -23,10 +23,17 @@
 package mutate
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
@@ -44,6 +51,26 @@ import (
 // for a zip-bomb blob.
 const UmociUncompressedBlobSizeAnnotation = "ci.umo.uncompressed_blob_size"
 
+// UmociDiffIDAnnotation is an umoci-specific annotation set on layer
+// descriptors (see Mutator.SetRecordDiffIDs) containing the DiffID of the
+// layer, so that tooling which only has the manifest can find the DiffID
+// without fetching the image configuration. As with
+// UmociUncompressedBlobSizeAnnotation, the value should be treated as a hint
+// -- the configuration is authoritative.
+const UmociDiffIDAnnotation = "ci.umo.diff_id"
+
+// UmociFileManifestAnnotation is an umoci-specific annotation set on layer
+// descriptors, containing the digest of a blob which lists the paths and sizes
+// of every entry in the layer (see layer.FileManifest). The blob is not
+// referenced by a descriptor, so the annotation is registered with
+// casext.RegisterBlobAnnotation to ensure that GC retains the blob for as
+// long as the layer descriptor is.
+const UmociFileManifestAnnotation = "ci.umo.file_manifest"
+
+func init() {
+	casext.RegisterBlobAnnotation(UmociFileManifestAnnotation)
+}
+
 func configPtr(c ispec.Image) *ispec.Image         { return &c }
 func manifestPtr(m ispec.Manifest) *ispec.Manifest { return &m }
 func timePtr(t time.Time) *time.Time               { return &t }
@@ -71,6 +98,26 @@ type Mutator struct {
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// rawConfig is the original config blob if it has a custom media-type
+	// (see SetConfigMediaType), in which case it may contain fields which
+	// ispec.Image doesn't know about (or not be an image configuration at
+	// all). rawConfigImage is the JSON encoding of the ispec.Image parsed
+	// from it (nil if it couldn't be parsed), which is used by Commit to
+	// detect whether the configuration was modified.
+	rawConfig      []byte
+	rawConfigImage []byte
+
+	// historyRedactions are applied to the history on Commit.
+	historyRedactions []*regexp.Regexp
+
+	// blobConcurrency is the maximum number of layer blobs written at the
+	// same time by operations which create several layers.
+	blobConcurrency int
+
+	// recordDiffIDs causes new layer descriptors to be annotated with
+	// UmociDiffIDAnnotation.
+	recordDiffIDs bool
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -123,8 +170,26 @@ func (m *Mutator) cache(ctx context.Context) error {
 		}
 		defer blob.Close()
 
-		config, ok := blob.Data.(ispec.Image)
-		if !ok {
+		var config ispec.Image
+		switch data := blob.Data.(type) {
+		case ispec.Image:
+			config = data
+		case io.Reader:
+			// The config has a custom media-type (see SetConfigMediaType). We
+			// keep the original blob so that Commit doesn't rewrite it, but
+			// still try to parse it so that it can be modified.
+			raw, err := ioutil.ReadAll(data)
+			if err != nil {
+				return fmt.Errorf("cache source config: read %s config: %w", blob.Descriptor.MediaType, err)
+			}
+			m.rawConfig = raw
+			if err := json.Unmarshal(raw, &config); err != nil {
+				log.Debugf("%s config is not an image config: %v", blob.Descriptor.MediaType, err)
+				config = ispec.Image{}
+			} else if m.rawConfigImage, err = json.Marshal(config); err != nil {
+				return fmt.Errorf("cache source config: %w", err)
+			}
+		default:
 			// Should _never_ be reached.
 			return fmt.Errorf("[internal error] unknown config blob type: %s", blob.Descriptor.MediaType)
 		}
@@ -256,10 +321,10 @@ func (m *Mutator) appendToConfig(history *ispec.History, layerDiffID digest.Dige
 
 // add adds the given layer to the CAS, and mutates the configuration to
 // include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History, compressor Compressor) (digest.Digest, int64, error) {
+// layer (which is compressed by us), followed by its size and the DiffID.
+func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History, compressor Compressor) (digest.Digest, int64, digest.Digest, error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, fmt.Errorf("getting cache failed: %w", err)
+		return "", -1, "", fmt.Errorf("getting cache failed: %w", err)
 	}
 
 	diffidDigester := cas.BlobAlgorithm.Digester()
@@ -267,19 +332,19 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.Hist
 
 	compressed, err := compressor.Compress(hashReader)
 	if err != nil {
-		return "", -1, fmt.Errorf("couldn't create compression for blob: %w", err)
+		return "", -1, "", fmt.Errorf("couldn't create compression for blob: %w", err)
 	}
 	defer compressed.Close()
 
 	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
 	if err != nil {
-		return "", -1, fmt.Errorf("put layer blob: %w", err)
+		return "", -1, "", fmt.Errorf("put layer blob: %w", err)
 	}
 
 	// Add DiffID to configuration.
 	layerDiffID := diffidDigester.Digest()
 	m.appendToConfig(history, layerDiffID)
-	return layerDigest, layerSize, nil
+	return layerDigest, layerSize, layerDiffID, nil
 }
 
 // Add adds a layer to the image, by reading the layer changeset blob from the
@@ -293,7 +358,7 @@ func (m *Mutator) Add(ctx context.Context, mediaType string, r io.Reader, histor
 		return desc, fmt.Errorf("getting cache failed: %w", err)
 	}
 
-	digest, size, err := m.add(ctx, r, history, compressor)
+	digest, size, diffID, err := m.add(ctx, r, history, compressor)
 	if err != nil {
 		return desc, fmt.Errorf("add layer: %w", err)
 	}
@@ -309,6 +374,15 @@ func (m *Mutator) Add(ctx context.Context, mediaType string, r io.Reader, histor
 	if compressor.BytesRead() >= 0 {
 		annotations[UmociUncompressedBlobSizeAnnotation] = fmt.Sprintf("%d", compressor.BytesRead())
 	}
+	if value, ok := compressionAnnotation(compressor); ok {
+		annotations[UmociCompressionAnnotation] = value
+	}
+	for key, value := range compressorAnnotations(compressor) {
+		annotations[key] = value
+	}
+	if m.recordDiffIDs {
+		annotations[UmociDiffIDAnnotation] = diffID.String()
+	}
 
 	// Append to layers.
 	desc = ispec.Descriptor{
@@ -329,11 +403,604 @@ func (m *Mutator) AddExisting(ctx context.Context, desc ispec.Descriptor, histor
 		return fmt.Errorf("getting cache failed: %w", err)
 	}
 
+	if m.recordDiffIDs {
+		annotations := make(map[string]string, len(desc.Annotations)+1)
+		for key, value := range desc.Annotations {
+			annotations[key] = value
+		}
+		annotations[UmociDiffIDAnnotation] = diffID.String()
+		desc.Annotations = annotations
+	}
+
 	m.appendToConfig(history, diffID)
 	m.manifest.Layers = append(m.manifest.Layers, desc)
 	return nil
 }
 
+// Recompress replaces the blob of the layer at the given index with a new
+// blob created by compressing the layer changeset read from r with the
+// provided compressor. As with Add, the stream must not be compressed. The
+// DiffID of the stream must match the DiffID of the existing layer (the
+// contents of the layer cannot be changed with Recompress), so the image
+// configuration is left unchanged. The new layer descriptor is returned.
+func (m *Mutator) Recompress(ctx context.Context, index int, r io.Reader, compressor Compressor) (ispec.Descriptor, error) {
+	desc, diffID, err := m.replaceLayer(ctx, index, r, compressor)
+	if err != nil {
+		return desc, err
+	}
+	if diffID != m.config.RootFS.DiffIDs[index] {
+		return ispec.Descriptor{}, fmt.Errorf("recompressed layer %d diffid mismatch: expected %s got %s", index, m.config.RootFS.DiffIDs[index], diffID)
+	}
+	m.manifest.Layers[index] = desc
+	return desc, nil
+}
+
+// ReplaceLayer replaces the layer at the given index with a new layer, by
+// reading the layer changeset blob from the provided reader and compressing
+// it with the provided compressor. As with Add, the stream must not be
+// compressed. Unlike Recompress, the contents of the layer may differ from
+// the existing layer, and so the DiffID of the layer in the image
+// configuration is updated. The position of the layer (and all other layers)
+// is left unchanged. If history is non-nil, it replaces the history entry
+// corresponding to the layer. The new layer descriptor is returned.
+func (m *Mutator) ReplaceLayer(ctx context.Context, index int, r io.Reader, history *ispec.History, compressor Compressor) (ispec.Descriptor, error) {
+	historyIndex := -1
+	if history != nil {
+		if history.EmptyLayer {
+			return ispec.Descriptor{}, errors.New("replacement history entry cannot be an empty layer")
+		}
+		if err := m.cache(ctx); err != nil {
+			return ispec.Descriptor{}, fmt.Errorf("getting cache failed: %w", err)
+		}
+		historyIndex = m.layerHistoryIndex(index)
+		if historyIndex < 0 {
+			return ispec.Descriptor{}, fmt.Errorf("layer index %d has no corresponding history entry", index)
+		}
+	}
+
+	desc, diffID, err := m.replaceLayer(ctx, index, r, compressor)
+	if err != nil {
+		return desc, err
+	}
+	// The file manifest of the old layer no longer describes its contents.
+	delete(desc.Annotations, UmociFileManifestAnnotation)
+	m.manifest.Layers[index] = desc
+	m.config.RootFS.DiffIDs[index] = diffID
+	if history != nil {
+		m.config.History[historyIndex] = *history
+	}
+	return desc, nil
+}
+
+// SplitLayer replaces the layer at the given index with a sequence of new
+// layers, one for each changeset read from rs (in order). Each changeset is
+// compressed with the provided compressor. The layer's history entry (if
+// there is one) is duplicated so that every new layer has its own entry. It
+// is the caller's responsibility to ensure that applying the new layers in
+// order has the same effect as applying the original layer.
+func (m *Mutator) SplitLayer(ctx context.Context, index int, rs []io.Reader, compressor Compressor) ([]ispec.Descriptor, error) {
+	if len(rs) == 0 {
+		return nil, errors.New("split layer requires at least one changeset")
+	}
+	if err := m.cache(ctx); err != nil {
+		return nil, fmt.Errorf("getting cache failed: %w", err)
+	}
+
+	descs, diffIDs, err := m.replaceLayers(ctx, index, rs, compressor)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range descs {
+		// Any other annotations on the original layer (such as the list of
+		// changed files) describe the layer as a whole.
+		for key := range desc.Annotations {
+			if !isCompressionAnnotation(key) {
+				delete(desc.Annotations, key)
+			}
+		}
+	}
+
+	var layers []ispec.Descriptor
+	layers = append(layers, m.manifest.Layers[:index]...)
+	layers = append(layers, descs...)
+	layers = append(layers, m.manifest.Layers[index+1:]...)
+	m.manifest.Layers = layers
+
+	var rootfsDiffIDs []digest.Digest
+	rootfsDiffIDs = append(rootfsDiffIDs, m.config.RootFS.DiffIDs[:index]...)
+	rootfsDiffIDs = append(rootfsDiffIDs, diffIDs...)
+	rootfsDiffIDs = append(rootfsDiffIDs, m.config.RootFS.DiffIDs[index+1:]...)
+	m.config.RootFS.DiffIDs = rootfsDiffIDs
+
+	if historyIndex := m.layerHistoryIndex(index); historyIndex >= 0 {
+		var history []ispec.History
+		history = append(history, m.config.History[:historyIndex]...)
+		for range descs {
+			history = append(history, m.config.History[historyIndex])
+		}
+		history = append(history, m.config.History[historyIndex+1:]...)
+		m.config.History = history
+	}
+	return descs, nil
+}
+
+// DedupLayers removes any layer which is identical (same digest, media-type
+// and DiffID) to the layer immediately before it in the manifest. Applying the
+// same changeset twice in a row has the same effect as applying it once, so
+// this does not change the root filesystem of the image. Identical layers
+// which are not adjacent are left alone, because the layers between them may
+// have modified paths which the later copy restores. The history entry of
+// each removed layer is kept but marked as an empty layer. The indices (in
+// the original layer list) of the removed layers are returned in ascending
+// order.
+func (m *Mutator) DedupLayers(ctx context.Context) ([]int, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, fmt.Errorf("getting cache failed: %w", err)
+	}
+	if len(m.manifest.Layers) != len(m.config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("manifest has %d layers but config has %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+
+	var (
+		removed      []int
+		layers       []ispec.Descriptor
+		diffIDs      []digest.Digest
+		emptyHistory []int
+	)
+	for idx, layer := range m.manifest.Layers {
+		diffID := m.config.RootFS.DiffIDs[idx]
+		if idx > 0 {
+			prev := m.manifest.Layers[idx-1]
+			if layer.Digest == prev.Digest && layer.MediaType == prev.MediaType && diffID == m.config.RootFS.DiffIDs[idx-1] {
+				log.Debugf("dedup layers: removing layer %d (%s), identical to layer %d", idx, layer.Digest, idx-1)
+				removed = append(removed, idx)
+				emptyHistory = append(emptyHistory, m.layerHistoryIndex(idx))
+				continue
+			}
+		}
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, diffID)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	// The history indices must all be computed before any entries are marked
+	// as empty layers, since that changes which entry maps to which layer.
+	for _, historyIndex := range emptyHistory {
+		if historyIndex >= 0 {
+			m.config.History[historyIndex].EmptyLayer = true
+		}
+	}
+	m.manifest.Layers = layers
+	m.config.RootFS.DiffIDs = diffIDs
+	return removed, nil
+}
+
+// RemoveLayer removes the layer at the given index from the image, along with
+// its DiffID and its history entry. History entries are associated with
+// layers in order, skipping empty-layer entries (the same way umoci stat
+// does), so any empty-layer entries around the removed entry are kept. It is
+// an error to remove a layer which has no corresponding history entry if the
+// image has any history. Note that removing a layer changes the root
+// filesystem of the image, since later layers may depend on the removed one
+// (for instance, whiteouts for files which only it contained are left behind).
+func (m *Mutator) RemoveLayer(ctx context.Context, index int) error {
+	if err := m.cache(ctx); err != nil {
+		return fmt.Errorf("getting cache failed: %w", err)
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return fmt.Errorf("layer index %d out of range", index)
+	}
+	if len(m.manifest.Layers) != len(m.config.RootFS.DiffIDs) {
+		return fmt.Errorf("manifest has %d layers but config has %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	historyIndex := m.layerHistoryIndex(index)
+	if historyIndex < 0 && len(m.config.History) > 0 {
+		return fmt.Errorf("layer index %d has no corresponding history entry", index)
+	}
+
+	var layers []ispec.Descriptor
+	layers = append(layers, m.manifest.Layers[:index]...)
+	layers = append(layers, m.manifest.Layers[index+1:]...)
+	m.manifest.Layers = layers
+
+	var rootfsDiffIDs []digest.Digest
+	rootfsDiffIDs = append(rootfsDiffIDs, m.config.RootFS.DiffIDs[:index]...)
+	rootfsDiffIDs = append(rootfsDiffIDs, m.config.RootFS.DiffIDs[index+1:]...)
+	m.config.RootFS.DiffIDs = rootfsDiffIDs
+
+	if historyIndex >= 0 {
+		var history []ispec.History
+		history = append(history, m.config.History[:historyIndex]...)
+		history = append(history, m.config.History[historyIndex+1:]...)
+		m.config.History = history
+	}
+	return nil
+}
+
+// FilterLayers removes every layer for which keep returns false, along with
+// its DiffID and history entry (in the same way as RemoveLayer). keep is
+// called once for each layer, in order, with the index of the layer in the
+// current layer list. If a layer to be removed has no corresponding history
+// entry (and the image has any history) an error is returned and the image is
+// left unmodified. As with RemoveLayer, removing layers changes the root
+// filesystem of the image.
+func (m *Mutator) FilterLayers(ctx context.Context, keep func(index int, desc ispec.Descriptor, diffID digest.Digest) bool) error {
+	if err := m.cache(ctx); err != nil {
+		return fmt.Errorf("getting cache failed: %w", err)
+	}
+	if len(m.manifest.Layers) != len(m.config.RootFS.DiffIDs) {
+		return fmt.Errorf("manifest has %d layers but config has %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+
+	var (
+		layers         []ispec.Descriptor
+		diffIDs        []digest.Digest
+		removedHistory = map[int]struct{}{}
+	)
+	for idx, layer := range m.manifest.Layers {
+		diffID := m.config.RootFS.DiffIDs[idx]
+		if keep(idx, layer, diffID) {
+			layers = append(layers, layer)
+			diffIDs = append(diffIDs, diffID)
+			continue
+		}
+		historyIndex := m.layerHistoryIndex(idx)
+		if historyIndex < 0 && len(m.config.History) > 0 {
+			return fmt.Errorf("layer index %d has no corresponding history entry", idx)
+		}
+		log.Debugf("filter layers: removing layer %d (%s)", idx, layer.Digest)
+		if historyIndex >= 0 {
+			removedHistory[historyIndex] = struct{}{}
+		}
+	}
+	if len(layers) == len(m.manifest.Layers) {
+		return nil
+	}
+
+	var history []ispec.History
+	for idx, entry := range m.config.History {
+		if _, removed := removedHistory[idx]; !removed {
+			history = append(history, entry)
+		}
+	}
+	m.manifest.Layers = layers
+	m.config.RootFS.DiffIDs = diffIDs
+	m.config.History = history
+	return nil
+}
+
+// replaceLayers is like replaceLayer, except that a new blob is created for
+// each of the changesets read from rs. If SetBlobConcurrency has been used
+// (and the compressor can be cloned), up to that many blobs are compressed
+// and written concurrently. The returned descriptors and DiffIDs are in the
+// same order as rs regardless.
+func (m *Mutator) replaceLayers(ctx context.Context, index int, rs []io.Reader, compressor Compressor) ([]ispec.Descriptor, []digest.Digest, error) {
+	descs := make([]ispec.Descriptor, len(rs))
+	diffIDs := make([]digest.Digest, len(rs))
+
+	concurrency := m.blobConcurrency
+	if concurrency > len(rs) {
+		concurrency = len(rs)
+	}
+	if concurrency > 1 {
+		if _, ok := cloneCompressor(compressor); !ok {
+			log.Debugf("cannot clone compressor %T: writing layer blobs serially", compressor)
+			concurrency = 1
+		}
+	}
+	if concurrency <= 1 {
+		for idx, r := range rs {
+			desc, diffID, err := m.replaceLayer(ctx, index, r, compressor)
+			if err != nil {
+				return nil, nil, err
+			}
+			descs[idx], diffIDs[idx] = desc, diffID
+		}
+		return descs, diffIDs, nil
+	}
+
+	// Make sure the cache is populated before the workers start, so that
+	// they only ever read the cached values.
+	if err := m.cache(ctx); err != nil {
+		return nil, nil, fmt.Errorf("getting cache failed: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(rs))
+	jobs := make(chan int)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				if err := ctx.Err(); err != nil {
+					errs[idx] = err
+					continue
+				}
+				// Each blob needs its own compressor, since compressors
+				// track the number of bytes they have read.
+				blobCompressor, _ := cloneCompressor(compressor)
+				descs[idx], diffIDs[idx], errs[idx] = m.replaceLayer(ctx, index, rs[idx], blobCompressor)
+				if errs[idx] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+	for idx := range rs {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Return the first "real" error, rather than a cancellation caused by it.
+	var firstErr error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	return descs, diffIDs, nil
+}
+
+// layerHistoryIndex returns the index of the history entry corresponding to
+// the layer at the given index (history entries for empty layers don't
+// correspond to any layer), or -1 if there is no such entry.
+func (m *Mutator) layerHistoryIndex(index int) int {
+	layerIndex := 0
+	for idx, entry := range m.config.History {
+		if entry.EmptyLayer {
+			continue
+		}
+		if layerIndex == index {
+			return idx
+		}
+		layerIndex++
+	}
+	return -1
+}
+
+// replaceLayer creates a new blob for the layer at the given index by
+// compressing the layer changeset read from r with the provided compressor.
+// The returned descriptor is based on the existing layer descriptor (with the
+// media-type and compression annotations updated to match the compressor),
+// and the DiffID of the changeset is also returned. The manifest and
+// configuration are not modified.
+func (m *Mutator) replaceLayer(ctx context.Context, index int, r io.Reader, compressor Compressor) (ispec.Descriptor, digest.Digest, error) {
+	desc := ispec.Descriptor{}
+	if err := m.cache(ctx); err != nil {
+		return desc, "", fmt.Errorf("getting cache failed: %w", err)
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return desc, "", fmt.Errorf("layer index %d out of range", index)
+	}
+	if index >= len(m.config.RootFS.DiffIDs) {
+		return desc, "", fmt.Errorf("layer index %d has no corresponding diffid", index)
+	}
+	oldDesc := m.manifest.Layers[index]
+
+	diffidDigester := cas.BlobAlgorithm.Digester()
+	hashReader := io.TeeReader(r, diffidDigester.Hash())
+
+	compressed, err := compressor.Compress(hashReader)
+	if err != nil {
+		return desc, "", fmt.Errorf("couldn't create compression for blob: %w", err)
+	}
+	defer compressed.Close()
+
+	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
+	if err != nil {
+		return desc, "", fmt.Errorf("put layer blob: %w", err)
+	}
+
+	// Strip the old compression suffix (if any) from the media-type.
+	mediaType := oldDesc.MediaType
+	if idx := strings.LastIndex(mediaType, "+"); idx >= 0 {
+		mediaType = mediaType[:idx]
+	}
+	if compressor.MediaTypeSuffix() != "" {
+		mediaType = mediaType + "+" + compressor.MediaTypeSuffix()
+	}
+
+	annotations := make(map[string]string)
+	for key, value := range oldDesc.Annotations {
+		if isCompressionAnnotation(key) {
+			continue
+		}
+		annotations[key] = value
+	}
+	if compressor.BytesRead() >= 0 {
+		annotations[UmociUncompressedBlobSizeAnnotation] = fmt.Sprintf("%d", compressor.BytesRead())
+	}
+	if value, ok := compressionAnnotation(compressor); ok {
+		annotations[UmociCompressionAnnotation] = value
+	}
+	for key, value := range compressorAnnotations(compressor) {
+		annotations[key] = value
+	}
+	// Don't leave a stale DiffID annotation behind if the contents changed.
+	layerDiffID := diffidDigester.Digest()
+	if _, ok := oldDesc.Annotations[UmociDiffIDAnnotation]; ok || m.recordDiffIDs {
+		annotations[UmociDiffIDAnnotation] = layerDiffID.String()
+	}
+
+	desc = ispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      layerDigest,
+		Size:        layerSize,
+		URLs:        oldDesc.URLs,
+		Platform:    oldDesc.Platform,
+		Annotations: annotations,
+	}
+	return desc, layerDiffID, nil
+}
+
+// SetConfigMediaType changes the media-type of the config descriptor in the
+// manifest, which is otherwise left unchanged from the source manifest
+// (usually ispec.MediaTypeImageConfig). This is useful for creating artifacts
+// with a custom config type. Only the descriptor is changed: the config blob
+// is still the JSON serialisation of the image configuration managed by the
+// Mutator. If the source manifest already had a custom config type, its blob
+// is preserved by Commit (see putConfig) rather than being re-serialised.
+func (m *Mutator) SetConfigMediaType(ctx context.Context, mediaType string) error {
+	if mediaType == "" {
+		return errors.New("config media-type cannot be empty")
+	}
+	if err := m.cache(ctx); err != nil {
+		return fmt.Errorf("getting cache failed: %w", err)
+	}
+
+	m.manifest.Config.MediaType = mediaType
+	return nil
+}
+
+// SetSubject sets the subject of the manifest to the given descriptor, making
+// the image a referrer of the subject (see casext.Engine.ListReferrers). Only
+// the digest, media-type and size of the descriptor are required by the spec,
+// but the descriptor is stored as given.
+func (m *Mutator) SetSubject(ctx context.Context, desc *ispec.Descriptor) error {
+	if desc == nil {
+		return errors.New("subject descriptor cannot be nil")
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid subject digest: %w", err)
+	}
+	if desc.MediaType == "" {
+		return errors.New("subject media-type cannot be empty")
+	}
+	if err := m.cache(ctx); err != nil {
+		return fmt.Errorf("getting cache failed: %w", err)
+	}
+
+	subject := *desc
+	m.manifest.Subject = &subject
+	return nil
+}
+
+// ClearSubject removes the subject of the manifest (if it had one), so that
+// the image is no longer a referrer of any other manifest.
+func (m *Mutator) ClearSubject(ctx context.Context) error {
+	if err := m.cache(ctx); err != nil {
+		return fmt.Errorf("getting cache failed: %w", err)
+	}
+
+	m.manifest.Subject = nil
+	return nil
+}
+
+// SetLayerAnnotations sets the given annotations on the descriptor of the
+// layer at the given index, overriding any existing annotations with the same
+// keys. This is useful for annotations (such as
+// UmociFileManifestAnnotation) which can only be computed after the
+// layer has been added.
+func (m *Mutator) SetLayerAnnotations(ctx context.Context, index int, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return fmt.Errorf("getting cache failed: %w", err)
+	}
+	if index < 0 || index >= len(m.manifest.Layers) {
+		return fmt.Errorf("layer index %d out of range", index)
+	}
+
+	desc := &m.manifest.Layers[index]
+	newAnnotations := make(map[string]string, len(desc.Annotations)+len(annotations))
+	for key, value := range desc.Annotations {
+		newAnnotations[key] = value
+	}
+	for key, value := range annotations {
+		newAnnotations[key] = value
+	}
+	desc.Annotations = newAnnotations
+	return nil
+}
+
+// SetBlobConcurrency sets the maximum number of layer blobs which are
+// compressed and written to the engine concurrently by operations which
+// create several layers at once (such as SplitLayer). Blobs are
+// content-addressed, so concurrent writes cannot conflict, and the resulting
+// image is identical to the one created with serial writes. Concurrency is
+// only used with the compressors provided by this package. If n is less than
+// 2 (the default), blobs are written one at a time.
+func (m *Mutator) SetBlobConcurrency(n int) {
+	m.blobConcurrency = n
+}
+
+// SetRecordDiffIDs sets whether the descriptors of layers added (or
+// replaced) by the Mutator are annotated with their DiffID, using
+// UmociDiffIDAnnotation. The DiffID is always recorded in the image
+// configuration regardless, this only makes it available to tooling which
+// only inspects the manifest. It is disabled by default.
+func (m *Mutator) SetRecordDiffIDs(record bool) {
+	m.recordDiffIDs = record
+}
+
+// SetHistoryRedactions sets the patterns used to redact the CreatedBy value
+// of every history entry in the image (including entries inherited from the
+// original image) when the changes are committed. See RedactCreatedBy for
+// how the patterns are applied.
+func (m *Mutator) SetHistoryRedactions(patterns []*regexp.Regexp) {
+	m.historyRedactions = patterns
+}
+
+// putConfig writes the current configuration to the engine. Configs with a
+// custom media-type are written back unchanged if they haven't been
+// modified. Otherwise the modified top-level fields of the image
+// configuration are merged into the original blob, so that any fields which
+// ispec.Image doesn't know about are preserved.
+func (m *Mutator) putConfig(ctx context.Context) (digest.Digest, int64, error) {
+	if m.rawConfig == nil {
+		return m.engine.PutBlobJSON(ctx, m.config)
+	}
+
+	image, err := json.Marshal(m.config)
+	if err != nil {
+		return "", -1, fmt.Errorf("encode config: %w", err)
+	}
+	if m.rawConfigImage == nil {
+		if reflect.DeepEqual(*m.config, ispec.Image{}) {
+			return m.engine.PutBlob(ctx, bytes.NewReader(m.rawConfig))
+		}
+		return "", -1, fmt.Errorf("cannot modify %s config which is not an image configuration", m.manifest.Config.MediaType)
+	}
+	if bytes.Equal(image, m.rawConfigImage) {
+		return m.engine.PutBlob(ctx, bytes.NewReader(m.rawConfig))
+	}
+
+	var fields, oldFields, newFields map[string]json.RawMessage
+	if err := json.Unmarshal(m.rawConfig, &fields); err != nil {
+		return "", -1, fmt.Errorf("cannot modify %s config which is not a JSON object: %w", m.manifest.Config.MediaType, err)
+	}
+	if fields == nil {
+		fields = map[string]json.RawMessage{}
+	}
+	if err := json.Unmarshal(m.rawConfigImage, &oldFields); err != nil {
+		return "", -1, fmt.Errorf("[internal error] decode original config: %w", err)
+	}
+	if err := json.Unmarshal(image, &newFields); err != nil {
+		return "", -1, fmt.Errorf("[internal error] decode modified config: %w", err)
+	}
+	// Fields which have been cleared are omitted from the encoding.
+	for key := range oldFields {
+		if _, ok := newFields[key]; !ok {
+			delete(fields, key)
+		}
+	}
+	for key, value := range newFields {
+		fields[key] = value
+	}
+	return m.engine.PutBlobJSON(ctx, fields)
+}
+
 // Commit writes all of the temporary changes made to the configuration,
 // metadata and manifest to the engine. It then returns a new manifest
 // descriptor (which can be used in place of the source descriptor provided to
@@ -343,8 +1010,19 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 		return casext.DescriptorPath{}, fmt.Errorf("getting cache failed: %w", err)
 	}
 
+	// Redact the history before anything is written.
+	if len(m.historyRedactions) > 0 {
+		for idx := range m.config.History {
+			history := &m.config.History[idx]
+			if redacted := RedactCreatedBy(history.CreatedBy, m.historyRedactions); redacted != history.CreatedBy {
+				log.Debugf("redacted created_by of history entry %d", idx)
+				history.CreatedBy = redacted
+			}
+		}
+	}
+
 	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	configDigest, configSize, err := m.putConfig(ctx)
 	if err != nil {
 		return casext.DescriptorPath{}, fmt.Errorf("commit mutated config blob: %w", err)
 	}
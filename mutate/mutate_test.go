@@ -21,20 +21,33 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/umoci/oci/cas"
 	casdir "github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pierrec/lz4/v4"
+	"github.com/vbatts/go-mtree"
 )
 
 // These come from just running the code.
@@ -45,7 +58,7 @@ const (
 	expectedManifestDigest = "sha256:a4f6551691241fd52bcabb6af7994c30e9f8c8fe3d5b6b0c1ffd137386689675"
 )
 
-func setup(t *testing.T, dir string) (cas.Engine, ispec.Descriptor) {
+func setup(t testing.TB, dir string) (cas.Engine, ispec.Descriptor) {
 	dir = filepath.Join(dir, "image")
 	if err := casdir.Create(dir); err != nil {
 		t.Fatal(err)
@@ -254,7 +267,7 @@ func TestMutateAdd(t *testing.T) {
 	if mutator.manifest.Layers[1].Digest == expectedLayerDigest {
 		t.Errorf("manifest.Layers[1].Digest is not the same!")
 	}
-	if len(mutator.manifest.Layers[1].Annotations) != 2 {
+	if len(mutator.manifest.Layers[1].Annotations) != 3 {
 		t.Errorf("manifest.Layers[1].Annotations was not set correctly!: %+v", mutator.manifest.Layers[1].Annotations)
 	}
 	if mutator.manifest.Layers[1].Annotations["hello"] != "world" {
@@ -302,6 +315,23 @@ func TestMutateAdd(t *testing.T) {
 	if mutator.config.History[1].Comment != "new layer" {
 		t.Errorf("config.History[1].Comment was not set")
 	}
+
+	// Check that the compression annotation can reproduce the layer.
+	compression := mutator.manifest.Layers[1].Annotations[UmociCompressionAnnotation]
+	if compression != "gzip;level=5" {
+		t.Errorf("manifest.Layers[1].Annotations[%q] was not set correctly!: %q", UmociCompressionAnnotation, compression)
+	}
+	compressor, err := CompressorFromAnnotation(compression)
+	if err != nil {
+		t.Fatalf("unexpected error parsing compression annotation: %+v", err)
+	}
+	reproducedLayerDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("contents"), nil, compressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding reproduced layer: %+v", err)
+	}
+	if reproducedLayerDesc.Digest != newLayerDesc.Digest {
+		t.Errorf("reproduced layer has a different digest: expected %s got %s", newLayerDesc.Digest, reproducedLayerDesc.Digest)
+	}
 }
 
 func TestMutateAddExisting(t *testing.T) {
@@ -389,6 +419,217 @@ func TestMutateAddExisting(t *testing.T) {
 	}
 }
 
+func TestMutateRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := append([]digest.Digest{}, config.RootFS.DiffIDs...)
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLayerDesc := manifest.Layers[0]
+
+	// The base layer blob is not actually compressed.
+	layerContents := func() io.Reader {
+		blob, err := engine.GetBlob(context.Background(), oldLayerDesc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Close()
+		data, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(data)
+	}
+
+	// Out-of-range layers cannot be recompressed.
+	if _, err := mutator.Recompress(context.Background(), 1, layerContents(), ZstdCompressor); err == nil {
+		t.Errorf("expected error recompressing out-of-range layer")
+	}
+
+	// Changing the contents of the layer is not permitted.
+	if _, err := mutator.Recompress(context.Background(), 0, bytes.NewBufferString("other contents"), ZstdCompressor); err == nil {
+		t.Errorf("expected error recompressing layer with different contents")
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[0], oldLayerDesc) {
+		t.Errorf("failed recompress modified layer descriptor: %+v", mutator.manifest.Layers[0])
+	}
+
+	newLayerDesc, err := mutator.Recompress(context.Background(), 0, layerContents(), ZstdCompressor)
+	if err != nil {
+		t.Fatalf("unexpected error recompressing layer: %+v", err)
+	}
+	if newLayerDesc.MediaType != ispec.MediaTypeImageLayer+"+zstd" {
+		t.Errorf("recompressed layer has the wrong media-type: %s", newLayerDesc.MediaType)
+	}
+	if newLayerDesc.Digest == oldLayerDesc.Digest {
+		t.Errorf("recompressed layer has the same digest as the original layer")
+	}
+	if got := newLayerDesc.Annotations[UmociCompressionAnnotation]; got != "zstd;level=3" {
+		t.Errorf("recompressed layer has the wrong %q annotation: %q", UmociCompressionAnnotation, got)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[0], newLayerDesc) {
+		t.Errorf("manifest.Layers[0] was not updated")
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+		t.Errorf("config.RootFS.DiffIDs was modified: %v", mutator.config.RootFS.DiffIDs)
+	}
+
+	// Going back to no compression strips the media-type suffix.
+	newLayerDesc, err = mutator.Recompress(context.Background(), 0, layerContents(), NoopCompressor)
+	if err != nil {
+		t.Fatalf("unexpected error recompressing layer: %+v", err)
+	}
+	if newLayerDesc.MediaType != ispec.MediaTypeImageLayer {
+		t.Errorf("uncompressed layer has the wrong media-type: %s", newLayerDesc.MediaType)
+	}
+	if _, ok := newLayerDesc.Annotations[UmociCompressionAnnotation]; ok {
+		t.Errorf("uncompressed layer has a %q annotation", UmociCompressionAnnotation)
+	}
+}
+
+func TestMutateReplaceLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateReplaceLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add two more layers, so that there is a middle layer to replace.
+	for _, contents := range []string{"middle layer", "top layer"} {
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString(contents), &ispec.History{
+			Comment: contents,
+		}, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLayers := append([]ispec.Descriptor{}, oldManifest.Layers...)
+	oldConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := append([]digest.Digest{}, oldConfig.RootFS.DiffIDs...)
+	oldHistory := append([]ispec.History{}, oldConfig.History...)
+
+	// Out-of-range layers cannot be replaced.
+	for _, index := range []int{-1, 3} {
+		if _, err := mutator.ReplaceLayer(context.Background(), index, bytes.NewBufferString("contents"), nil, GzipCompressor); err == nil {
+			t.Errorf("expected error replacing out-of-range layer %d", index)
+		}
+	}
+	// Empty-layer history entries cannot replace a real layer's history.
+	if _, err := mutator.ReplaceLayer(context.Background(), 1, bytes.NewBufferString("contents"), &ispec.History{EmptyLayer: true}, GzipCompressor); err == nil {
+		t.Errorf("expected error replacing layer with an empty-layer history entry")
+	}
+
+	newContents := "replaced middle layer"
+	newLayerDesc, err := mutator.ReplaceLayer(context.Background(), 1, bytes.NewBufferString(newContents), &ispec.History{
+		Comment: "replaced",
+	}, ZstdCompressor)
+	if err != nil {
+		t.Fatalf("unexpected error replacing layer: %+v", err)
+	}
+	if newLayerDesc.MediaType != ispec.MediaTypeImageLayer+"+zstd" {
+		t.Errorf("replaced layer has the wrong media-type: %s", newLayerDesc.MediaType)
+	}
+	if got := newLayerDesc.Annotations[UmociUncompressedBlobSizeAnnotation]; got != fmt.Sprintf("%d", len(newContents)) {
+		t.Errorf("replaced layer has the wrong %q annotation: %q", UmociUncompressedBlobSizeAnnotation, got)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// The layer must have been replaced in place.
+	if len(mutator.manifest.Layers) != len(oldLayers) {
+		t.Fatalf("manifest.Layers changed length: %d", len(mutator.manifest.Layers))
+	}
+	if len(mutator.config.RootFS.DiffIDs) != len(mutator.manifest.Layers) {
+		t.Fatalf("config.RootFS.DiffIDs doesn't match manifest.Layers: %d != %d", len(mutator.config.RootFS.DiffIDs), len(mutator.manifest.Layers))
+	}
+	if len(mutator.config.History) != len(oldHistory) {
+		t.Fatalf("config.History changed length: %d", len(mutator.config.History))
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[1], newLayerDesc) {
+		t.Errorf("manifest.Layers[1] was not updated: %+v", mutator.manifest.Layers[1])
+	}
+	if expected := digest.FromString(newContents); mutator.config.RootFS.DiffIDs[1] != expected {
+		t.Errorf("config.RootFS.DiffIDs[1] is wrong: expected %s got %s", expected, mutator.config.RootFS.DiffIDs[1])
+	}
+	if mutator.config.History[1].Comment != "replaced" {
+		t.Errorf("config.History[1] was not updated: %+v", mutator.config.History[1])
+	}
+
+	// The replaced layer blob must decompress to the new diffid.
+	blob, err := engine.GetBlob(context.Background(), newLayerDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	decompressed, err := zstd.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressed.Close()
+	diffID, err := digest.FromReader(decompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID != mutator.config.RootFS.DiffIDs[1] {
+		t.Errorf("replaced layer blob has the wrong diffid: expected %s got %s", mutator.config.RootFS.DiffIDs[1], diffID)
+	}
+
+	// All of the other layers must be untouched.
+	for _, idx := range []int{0, 2} {
+		if !reflect.DeepEqual(mutator.manifest.Layers[idx], oldLayers[idx]) {
+			t.Errorf("manifest.Layers[%d] was modified: %+v", idx, mutator.manifest.Layers[idx])
+		}
+		if mutator.config.RootFS.DiffIDs[idx] != oldDiffIDs[idx] {
+			t.Errorf("config.RootFS.DiffIDs[%d] was modified: %s", idx, mutator.config.RootFS.DiffIDs[idx])
+		}
+		if !reflect.DeepEqual(mutator.config.History[idx], oldHistory[idx]) {
+			t.Errorf("config.History[%d] was modified: %+v", idx, mutator.config.History[idx])
+		}
+	}
+}
+
 func TestMutateSet(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateSet")
 	if err != nil {
@@ -527,6 +768,235 @@ func TestMutateSetNoHistory(t *testing.T) {
 	}
 }
 
+func TestMutateSetConfigMediaType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetConfigMediaType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	const customMediaType = "application/vnd.umoci.test.config.v1+json"
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetConfigMediaType(context.Background(), ""); err == nil {
+		t.Errorf("expected empty config media-type to be rejected")
+	}
+	if err := mutator.SetConfigMediaType(context.Background(), customMediaType); err != nil {
+		t.Fatalf("unexpected error setting config media-type: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The custom config must still be usable by a new mutator.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting custom config: %+v", err)
+	}
+	if config.Config.User != "default:user" {
+		t.Errorf("custom config was not parsed correctly: %+v", config)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	if manifest.Config.MediaType != customMediaType {
+		t.Errorf("unexpected config media-type: expected %q got %q", customMediaType, manifest.Config.MediaType)
+	}
+
+	// Modifying the config must keep the media-type.
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Config.User = "another:user"
+	if err := mutator.Set(context.Background(), config.Config, meta, nil, nil); err != nil {
+		t.Fatalf("unexpected error modifying custom config: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	manifestBlob, err := casext.NewEngine(engine).FromDescriptor(context.Background(), newDescriptor.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	if mt := manifestBlob.Data.(ispec.Manifest).Config.MediaType; mt != customMediaType {
+		t.Errorf("config media-type changed after modification: expected %q got %q", customMediaType, mt)
+	}
+}
+
+// customConfigManifest writes a copy of the manifest described by
+// fromDescriptor with its config replaced by the given blob of the given
+// media-type, returning the descriptor of the new manifest.
+func customConfigManifest(t *testing.T, engine cas.Engine, fromDescriptor ispec.Descriptor, mediaType string, config []byte) ispec.Descriptor {
+	engineExt := casext.NewEngine(engine)
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	manifest := manifestBlob.Data.(ispec.Manifest)
+
+	configDigest, configSize, err := engine.PutBlob(context.Background(), bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+// committedConfig returns the media-type and contents of the config blob of
+// the manifest at the end of the given path.
+func committedConfig(t *testing.T, engine cas.Engine, path casext.DescriptorPath) (ispec.Descriptor, []byte) {
+	engineExt := casext.NewEngine(engine)
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), path.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	configDesc := manifestBlob.Data.(ispec.Manifest).Config
+
+	rdr, err := engine.GetBlob(context.Background(), configDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configDesc, data
+}
+
+func TestMutateCustomConfigRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateCustomConfigRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	const customMediaType = "application/vnd.umoci.test.artifact.v1+json"
+	// The formatting and key order must be preserved, and ispec.Image
+	// doesn't know about any of these fields.
+	artifactConfig := []byte(`{"name": "artifact",  "settings": {"verbose": true}, "version": 3}` + "\n")
+	artifactDescriptor := customConfigManifest(t, engine, fromDescriptor, customMediaType, artifactConfig)
+
+	t.Run("Unmodified", func(t *testing.T) {
+		mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{artifactDescriptor}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Changing the manifest must not touch the config.
+		if err := mutator.SetLayerAnnotations(context.Background(), 0, map[string]string{"foo": "bar"}); err != nil {
+			t.Fatal(err)
+		}
+		newPath, err := mutator.Commit(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error committing changes: %+v", err)
+		}
+		configDesc, data := committedConfig(t, engine, newPath)
+		if configDesc.MediaType != customMediaType {
+			t.Errorf("unexpected config media-type: expected %q got %q", customMediaType, configDesc.MediaType)
+		}
+		if !bytes.Equal(data, artifactConfig) {
+			t.Errorf("config blob was rewritten: expected %q got %q", artifactConfig, data)
+		}
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{artifactDescriptor}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("new layer"), &ispec.History{Comment: "new layer"}, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		newPath, err := mutator.Commit(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error committing changes: %+v", err)
+		}
+		_, data := committedConfig(t, engine, newPath)
+
+		// The unknown fields must be preserved alongside the new diffid.
+		var fields struct {
+			Name     string          `json:"name"`
+			Settings json.RawMessage `json:"settings"`
+			Version  int             `json:"version"`
+			RootFS   ispec.RootFS    `json:"rootfs"`
+		}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("modified config is not valid JSON: %+v", err)
+		}
+		if fields.Name != "artifact" || string(fields.Settings) != `{"verbose":true}` || fields.Version != 3 {
+			t.Errorf("unknown config fields were not preserved: %s", data)
+		}
+		if len(fields.RootFS.DiffIDs) != 1 || fields.RootFS.DiffIDs[0] != digest.FromString("new layer") {
+			t.Errorf("modified config is missing the new diffid: %s", data)
+		}
+	})
+
+	opaqueConfig := []byte("this is not json")
+	opaqueDescriptor := customConfigManifest(t, engine, fromDescriptor, "application/octet-stream", opaqueConfig)
+
+	t.Run("OpaqueUnmodified", func(t *testing.T) {
+		mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{opaqueDescriptor}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		newPath, err := mutator.Commit(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error committing changes: %+v", err)
+		}
+		if _, data := committedConfig(t, engine, newPath); !bytes.Equal(data, opaqueConfig) {
+			t.Errorf("config blob was rewritten: expected %q got %q", opaqueConfig, data)
+		}
+	})
+
+	t.Run("OpaqueModified", func(t *testing.T) {
+		mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{opaqueDescriptor}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("new layer"), nil, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		if _, err := mutator.Commit(context.Background()); err == nil {
+			t.Errorf("expected error committing a modified non-JSON config")
+		}
+	})
+}
+
 func walkDescriptorRoot(ctx context.Context, engine casext.Engine, root ispec.Descriptor) (casext.DescriptorPath, error) {
 	var foundPath *casext.DescriptorPath
 
@@ -663,3 +1133,1464 @@ func TestMutatePath(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandHistoryTemplate(t *testing.T) {
+	created := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+
+	for _, test := range []struct {
+		name, template, op string
+		files              []string
+		expected           string
+	}{
+		{"Plain", "some text", "insert", nil, "some text"},
+		{"Op", "umoci {op}", "repack", nil, "umoci repack"},
+		{"Files", "added {files}", "insert", []string{"/etc/passwd", "/usr/bin"}, "added /etc/passwd /usr/bin"},
+		{"NoFiles", "added [{files}]", "config", nil, "added []"},
+		{"Time", "at {time}", "insert", nil, "at 2021-03-14T15:09:26Z"},
+		{"All", "{op} {files} @ {time} ({op})", "insert", []string{"/foo"}, "insert /foo @ 2021-03-14T15:09:26Z (insert)"},
+		{"Unknown", "{op} {unknown}", "insert", nil, "insert {unknown}"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := ExpandHistoryTemplate(test.template, test.op, test.files, created)
+			if got != test.expected {
+				t.Errorf("unexpected expansion of %q: expected %q got %q", test.template, test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRedactCreatedBy(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		createdBy string
+		patterns  []string
+		expected  string
+	}{
+		{"NoPatterns", "some --password=hunter2", nil, "some --password=hunter2"},
+		{"NoMatch", "some command", []string{`secret`}, "some command"},
+		{"WholeMatch", "cp /home/user/build/foo /foo", []string{`/home/[^/]+`}, "cp <redacted>/build/foo /foo"},
+		{"Group", "login --password=hunter2 --user=root", []string{`--password=(\S+)`}, "login --password=<redacted> --user=root"},
+		{"MultipleMatches", "a --token=x b --token=yy", []string{`--token=(\S+)`}, "a --token=<redacted> b --token=<redacted>"},
+		{"MultipleGroups", "user=admin pass=1234", []string{`user=(\S+) pass=(\S+)`}, "user=<redacted> pass=<redacted>"},
+		{"OptionalGroup", "key= value", []string{`key=(\S*)`}, "key= value"},
+		{"NestedGroups", "token=abc123", []string{`token=((abc)123)`}, "token=<redacted>"},
+		{"MultiplePatterns", "/home/user --password=x", []string{`/home/\S+`, `--password=(\S+)`}, "<redacted> --password=<redacted>"},
+		{"EmptyMatch", "abc", []string{`x*`}, "abc"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var patterns []*regexp.Regexp
+			for _, pattern := range test.patterns {
+				patterns = append(patterns, regexp.MustCompile(pattern))
+			}
+			got := RedactCreatedBy(test.createdBy, patterns)
+			if got != test.expected {
+				t.Errorf("unexpected redaction of %q: expected %q got %q", test.createdBy, test.expected, got)
+			}
+		})
+	}
+}
+
+func TestMutateHistoryRedactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateHistoryRedactions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator.SetHistoryRedactions([]*regexp.Regexp{regexp.MustCompile(`--password=(\S+)`)})
+
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("contents"), &ispec.History{
+		CreatedBy: "fetch --password=hunter2 https://example.com",
+		Comment:   "--password=not-redacted",
+	}, GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// Check the committed configuration.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := config.History[len(config.History)-1]
+	if history.CreatedBy != "fetch --password=<redacted> https://example.com" {
+		t.Errorf("CreatedBy was not redacted: %q", history.CreatedBy)
+	}
+	if history.Comment != "--password=not-redacted" {
+		t.Errorf("Comment should not be redacted: %q", history.Comment)
+	}
+	if raw, err := json.Marshal(config); err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(raw, []byte("hunter2")) {
+		t.Errorf("secret present in committed config: %s", raw)
+	}
+}
+
+// splitChangesets returns n changesets of differing sizes for SplitLayer.
+func splitChangesets(n, size int) [][]byte {
+	changesets := make([][]byte, n)
+	for idx := range changesets {
+		changesets[idx] = bytes.Repeat([]byte(fmt.Sprintf("changeset %d\n", idx)), size*(idx+1)/16)
+	}
+	return changesets
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestMutateSplitLayerConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSplitLayerConcurrency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	changesets := splitChangesets(8, 64<<10)
+
+	var serialDescs []ispec.Descriptor
+	for _, concurrency := range []int{1, 3, 8, 16} {
+		t.Run(fmt.Sprintf("Concurrency%d", concurrency), func(t *testing.T) {
+			mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutator.SetBlobConcurrency(concurrency)
+
+			var readers []io.Reader
+			for _, changeset := range changesets {
+				readers = append(readers, bytes.NewReader(changeset))
+			}
+			descs, err := mutator.SplitLayer(context.Background(), 0, readers, GzipCompressor)
+			if err != nil {
+				t.Fatalf("unexpected error splitting layer: %+v", err)
+			}
+			if len(descs) != len(changesets) {
+				t.Fatalf("unexpected number of layers: expected %d got %d", len(changesets), len(descs))
+			}
+
+			config, err := mutator.Config(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for idx, desc := range descs {
+				// Each blob must be present and match its digest.
+				blob, err := engineExt.GetVerifiedBlob(context.Background(), desc)
+				if err != nil {
+					t.Fatalf("layer %d: get blob: %+v", idx, err)
+				}
+				if _, err := io.Copy(ioutil.Discard, blob); err != nil {
+					t.Errorf("layer %d: read blob: %+v", idx, err)
+				}
+				if err := blob.Close(); err != nil {
+					t.Errorf("layer %d: verify blob: %+v", idx, err)
+				}
+
+				// The metadata of each layer must match its own changeset.
+				if got, want := config.RootFS.DiffIDs[idx], digest.FromBytes(changesets[idx]); got != want {
+					t.Errorf("layer %d: unexpected diffid: expected %s got %s", idx, want, got)
+				}
+				if got, want := desc.Annotations[UmociUncompressedBlobSizeAnnotation], fmt.Sprintf("%d", len(changesets[idx])); got != want {
+					t.Errorf("layer %d: unexpected %q annotation: expected %q got %q", idx, UmociUncompressedBlobSizeAnnotation, want, got)
+				}
+			}
+
+			// The result must not depend on the concurrency.
+			if serialDescs == nil {
+				serialDescs = descs
+			} else if !reflect.DeepEqual(descs, serialDescs) {
+				t.Errorf("concurrent split differs from serial split:\nserial:     %v\nconcurrent: %v", serialDescs, descs)
+			}
+		})
+	}
+}
+
+func TestMutateSplitLayerConcurrencyError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSplitLayerConcurrencyError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator.SetBlobConcurrency(4)
+
+	readErr := errors.New("broken changeset")
+	var readers []io.Reader
+	for idx, changeset := range splitChangesets(8, 4096) {
+		if idx == 5 {
+			readers = append(readers, errReader{readErr})
+			continue
+		}
+		readers = append(readers, bytes.NewReader(changeset))
+	}
+	if _, err := mutator.SplitLayer(context.Background(), 0, readers, GzipCompressor); !errors.Is(err, readErr) {
+		t.Errorf("expected SplitLayer to fail with %v, got %v", readErr, err)
+	}
+
+	// The mutator must not have been modified.
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != expectedLayerDigest {
+		t.Errorf("failed SplitLayer modified the manifest layers: %v", manifest.Layers)
+	}
+}
+
+func BenchmarkMutateSplitLayer(b *testing.B) {
+	changesets := make([][]byte, 8)
+	for idx := range changesets {
+		changesets[idx] = make([]byte, 8<<20)
+		if _, err := rand.Read(changesets[idx]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Concurrency%d", concurrency), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "umoci-BenchmarkMutateSplitLayer")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engine, fromDescriptor := setup(b, dir)
+			defer engine.Close()
+
+			b.SetBytes(int64(len(changesets) * len(changesets[0])))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				mutator.SetBlobConcurrency(concurrency)
+
+				var readers []io.Reader
+				for _, changeset := range changesets {
+					readers = append(readers, bytes.NewReader(changeset))
+				}
+				if _, err := mutator.SplitLayer(context.Background(), 0, readers, ZstdCompressor); err != nil {
+					b.Fatalf("unexpected error splitting layer: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateDedupLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateDedupLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	baseDesc := mutator.manifest.Layers[0]
+	baseDiffID := mutator.config.RootFS.DiffIDs[0]
+
+	// Layer 1 is a duplicate of layer 0 and can be removed.
+	if err := mutator.AddExisting(context.Background(), baseDesc, &ispec.History{Comment: "duplicate"}, baseDiffID); err != nil {
+		t.Fatal(err)
+	}
+	// An empty layer history entry between layers must not confuse us.
+	if err := mutator.Set(context.Background(), mutator.config.Config, Meta{}, nil, &ispec.History{Comment: "config change", EmptyLayer: true}); err != nil {
+		t.Fatal(err)
+	}
+	otherDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("other contents"), &ispec.History{Comment: "other"}, GzipCompressor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Layer 3 is identical to layer 0 but is not adjacent to it (layer 2 may
+	// have modified the paths it restores), so it must be left alone.
+	if err := mutator.AddExisting(context.Background(), baseDesc, &ispec.History{Comment: "not adjacent"}, baseDiffID); err != nil {
+		t.Fatal(err)
+	}
+	// Layer 4 has the same blob as layer 3 but a different DiffID, so it isn't
+	// obviously identical and must be left alone.
+	if err := mutator.AddExisting(context.Background(), baseDesc, &ispec.History{Comment: "different diffid"}, digest.FromString("different")); err != nil {
+		t.Fatal(err)
+	}
+	// Layers 5 and 6 are both duplicates of layer 4.
+	for _, comment := range []string{"duplicate 2", "duplicate 3"} {
+		if err := mutator.AddExisting(context.Background(), baseDesc, &ispec.History{Comment: comment}, digest.FromString("different")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := mutator.DedupLayers(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error deduplicating layers: %+v", err)
+	}
+	if expected := []int{1, 5, 6}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("unexpected removed layers: expected %v got %v", expected, removed)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLayers := []digest.Digest{baseDesc.Digest, otherDesc.Digest, baseDesc.Digest, baseDesc.Digest}
+	var layers []digest.Digest
+	for _, layer := range manifest.Layers {
+		layers = append(layers, layer.Digest)
+	}
+	if !reflect.DeepEqual(layers, expectedLayers) {
+		t.Errorf("unexpected layers after dedup: expected %v got %v", expectedLayers, layers)
+	}
+	expectedDiffIDs := []digest.Digest{baseDiffID, config.RootFS.DiffIDs[1], baseDiffID, digest.FromString("different")}
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diffids after dedup: expected %v got %v", expectedDiffIDs, config.RootFS.DiffIDs)
+	}
+
+	// All history entries are kept, but the removed layers' entries are now
+	// empty layers.
+	expectedEmpty := map[string]bool{
+		"":                 false,
+		"duplicate":        true,
+		"config change":    true,
+		"other":            false,
+		"not adjacent":     false,
+		"different diffid": false,
+		"duplicate 2":      true,
+		"duplicate 3":      true,
+	}
+	if len(config.History) != len(expectedEmpty) {
+		t.Fatalf("unexpected number of history entries: expected %d got %d", len(expectedEmpty), len(config.History))
+	}
+	for _, history := range config.History {
+		if history.EmptyLayer != expectedEmpty[history.Comment] {
+			t.Errorf("history entry %q: expected empty_layer=%v got %v", history.Comment, expectedEmpty[history.Comment], history.EmptyLayer)
+		}
+	}
+
+	// Nothing is left to deduplicate.
+	removed, err = mutator.DedupLayers(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error deduplicating layers again: %+v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("unexpected removed layers on second dedup: %v", removed)
+	}
+}
+
+func TestMutateAddZstdChunked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddZstdChunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	data := bytes.Repeat([]byte("some contents"), 1000)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := buffer.Bytes()
+
+	desc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewReader(layer), &ispec.History{Comment: "zstd:chunked"}, NewZstdChunkedCompressor(4096), nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if desc.MediaType != ispec.MediaTypeImageLayer+"+zstd" {
+		t.Errorf("unexpected media-type: %s", desc.MediaType)
+	}
+	for _, key := range []string{ZstdChunkedManifestChecksumAnnotation, ZstdChunkedManifestPositionAnnotation} {
+		if _, ok := desc.Annotations[key]; !ok {
+			t.Errorf("missing %s annotation: %v", key, desc.Annotations)
+		}
+	}
+	if got, want := desc.Annotations[UmociCompressionAnnotation], "zstd:chunked;level=3;chunk-size=4096"; got != want {
+		t.Errorf("unexpected %s annotation: expected %q got %q", UmociCompressionAnnotation, want, got)
+	}
+
+	// The blob is a regular zstd stream with the same diffid.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.RootFS.DiffIDs[1], digest.FromBytes(layer); got != want {
+		t.Errorf("unexpected diffid: expected %s got %s", want, got)
+	}
+	blob, err := engineExt.GetVerifiedBlob(context.Background(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	dec, err := zstd.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	content, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decompress zstd:chunked blob: %+v", err)
+	}
+	if !bytes.Equal(content, layer) {
+		t.Errorf("zstd:chunked blob doesn't decompress to the original layer")
+	}
+
+	// Recompressing the layer must drop the zstd:chunked annotations.
+	newDesc, err := mutator.Recompress(context.Background(), 1, bytes.NewReader(layer), GzipCompressor)
+	if err != nil {
+		t.Fatalf("unexpected error recompressing layer: %+v", err)
+	}
+	for key := range newDesc.Annotations {
+		if strings.HasPrefix(key, zstdChunkedAnnotationPrefix) {
+			t.Errorf("recompressed layer still has %s annotation", key)
+		}
+	}
+}
+
+func TestMutateAddLZ4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddLZ4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := bytes.Repeat([]byte("some lz4 contents "), 1000)
+	desc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewReader(layer), &ispec.History{Comment: "lz4"}, LZ4Compressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if desc.MediaType != ispec.MediaTypeImageLayer+"+lz4" {
+		t.Errorf("unexpected media-type: %s", desc.MediaType)
+	}
+	if got, want := desc.Annotations[UmociCompressionAnnotation], "lz4"; got != want {
+		t.Errorf("unexpected %s annotation: expected %q got %q", UmociCompressionAnnotation, want, got)
+	}
+	if got, want := desc.Annotations[UmociUncompressedBlobSizeAnnotation], fmt.Sprintf("%d", len(layer)); got != want {
+		t.Errorf("unexpected %s annotation: expected %q got %q", UmociUncompressedBlobSizeAnnotation, want, got)
+	}
+	if desc.Size >= int64(len(layer)) {
+		t.Errorf("lz4 layer was not compressed: %d bytes to %d bytes", len(layer), desc.Size)
+	}
+
+	// The blob must decompress to the diffid.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.RootFS.DiffIDs[1], digest.FromBytes(layer); got != want {
+		t.Errorf("unexpected diffid: expected %s got %s", want, got)
+	}
+	blob, err := engineExt.GetVerifiedBlob(context.Background(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, err := ioutil.ReadAll(lz4.NewReader(blob))
+	if err != nil {
+		t.Fatalf("decompress lz4 blob: %+v", err)
+	}
+	if !bytes.Equal(content, layer) {
+		t.Errorf("lz4 blob doesn't decompress to the original layer")
+	}
+
+	// The compression annotation must reproduce the layer.
+	compressor, err := CompressorFromAnnotation(desc.Annotations[UmociCompressionAnnotation])
+	if err != nil {
+		t.Fatalf("unexpected error parsing compression annotation: %+v", err)
+	}
+	reproducedDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewReader(layer), nil, compressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding reproduced layer: %+v", err)
+	}
+	if reproducedDesc.Digest != desc.Digest {
+		t.Errorf("reproduced layer has a different digest: expected %s got %s", desc.Digest, reproducedDesc.Digest)
+	}
+}
+
+func TestMutateRecordDiffIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecordDiffIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers are not annotated by default.
+	desc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("unannotated"), &ispec.History{Comment: "unannotated"}, GzipCompressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if value, ok := desc.Annotations[UmociDiffIDAnnotation]; ok {
+		t.Errorf("unexpected %s annotation without SetRecordDiffIDs: %q", UmociDiffIDAnnotation, value)
+	}
+
+	mutator.SetRecordDiffIDs(true)
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("annotated"), &ispec.History{Comment: "annotated"}, ZstdCompressor, map[string]string{"foo": "bar"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	// Existing layers are annotated with the provided DiffID.
+	if err := mutator.AddExisting(context.Background(), desc, &ispec.History{Comment: "existing"}, digest.FromString("unannotated")); err != nil {
+		t.Fatalf("unexpected error adding existing layer: %+v", err)
+	}
+	if value, ok := desc.Annotations[UmociDiffIDAnnotation]; ok {
+		t.Errorf("AddExisting modified the caller's descriptor annotations: %q", value)
+	}
+	// Replacing a layer must update the annotation.
+	if _, err := mutator.ReplaceLayer(context.Background(), 1, bytes.NewBufferString("replaced"), nil, GzipCompressor); err != nil {
+		t.Fatalf("unexpected error replacing layer: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 4 || len(config.RootFS.DiffIDs) != 4 {
+		t.Fatalf("unexpected number of layers: %d layers and %d diffids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	for idx, layer := range manifest.Layers[1:] {
+		idx++ // skip the base layer
+		if got, want := layer.Annotations[UmociDiffIDAnnotation], config.RootFS.DiffIDs[idx].String(); got != want {
+			t.Errorf("layer %d: unexpected %s annotation: expected %q got %q", idx, UmociDiffIDAnnotation, want, got)
+		}
+	}
+	if got, want := config.RootFS.DiffIDs[1], digest.FromString("replaced"); got != want {
+		t.Errorf("unexpected replaced layer diffid: expected %s got %s", want, got)
+	}
+	if got := manifest.Layers[2].Annotations["foo"]; got != "bar" {
+		t.Errorf("user-provided annotation was lost: got %q", got)
+	}
+}
+
+func TestMutateRemoveLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers 0 ("" history), 1 ("secret") and 2 ("after"), with empty layer
+	// history entries before and after the layer we will remove.
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{}, Meta{}, nil, &ispec.History{Comment: "config before", EmptyLayer: true}); err != nil {
+		t.Fatal(err)
+	}
+	secretDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("secret contents"), &ispec.History{Comment: "secret"}, GzipCompressor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{}, Meta{}, nil, &ispec.History{Comment: "config after", EmptyLayer: true}); err != nil {
+		t.Fatal(err)
+	}
+	afterDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewBufferString("after contents"), &ispec.History{Comment: "after"}, GzipCompressor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Out-of-range layers cannot be removed.
+	for _, index := range []int{-1, 3} {
+		if err := mutator.RemoveLayer(context.Background(), index); err == nil {
+			t.Errorf("expected error removing out-of-range layer %d", index)
+		}
+	}
+
+	if err := mutator.RemoveLayer(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLayers := []ispec.Descriptor{oldManifest.Layers[0], afterDesc}
+	if !reflect.DeepEqual(manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers after removal: expected %+v got %+v", expectedLayers, manifest.Layers)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Digest == secretDesc.Digest {
+			t.Errorf("removed layer %s still in manifest", secretDesc.Digest)
+		}
+	}
+	expectedDiffIDs := []digest.Digest{oldConfig.RootFS.DiffIDs[0], oldConfig.RootFS.DiffIDs[2]}
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diffids after removal: expected %v got %v", expectedDiffIDs, config.RootFS.DiffIDs)
+	}
+	var comments []string
+	for _, history := range config.History {
+		comments = append(comments, history.Comment)
+	}
+	if expected := []string{"", "config before", "config after", "after"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("unexpected history after removal: expected %q got %q", expected, comments)
+	}
+
+	// The image must be internally consistent: every layer has a diffid and
+	// a (non-empty) history entry in the same order.
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		t.Errorf("manifest has %d layers but config has %d diffids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	nonEmpty := 0
+	for _, history := range config.History {
+		if !history.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(manifest.Layers) {
+		t.Errorf("manifest has %d layers but config has %d non-empty history entries", len(manifest.Layers), nonEmpty)
+	}
+	if idx := mutator.layerHistoryIndex(1); idx < 0 || config.History[idx].Comment != "after" {
+		t.Errorf("layer 1 is associated with the wrong history entry: %d", idx)
+	}
+
+	// Layers without a history entry cannot be removed if the image has
+	// history, since we can't tell which entry belongs to the layer.
+	if err := mutator.AddExisting(context.Background(), afterDesc, nil, config.RootFS.DiffIDs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.RemoveLayer(context.Background(), 2); err == nil {
+		t.Errorf("expected error removing layer without a history entry")
+	}
+	if manifest, err := mutator.Manifest(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(manifest.Layers) != 3 {
+		t.Errorf("failed removal modified the manifest: %d layers", len(manifest.Layers))
+	}
+}
+
+func TestMutateFilterLayers(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateFilterLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The setup() layer is not actually compressed, so replace it with
+	// layers we can unpack. The "secret" layer is surrounded by empty layer
+	// history entries which must be kept.
+	if err := mutator.RemoveLayer(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"base", "secret", "top"} {
+		if name == "secret" {
+			if err := mutator.Set(ctx, ispec.ImageConfig{}, Meta{}, nil, &ispec.History{Comment: "config before", EmptyLayer: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buffer bytes.Buffer
+		tw := tar.NewWriter(&buffer)
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(name))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buffer, &ispec.History{Comment: name}, GzipCompressor, nil); err != nil {
+			t.Fatal(err)
+		}
+		if name == "secret" {
+			if err := mutator.Set(ctx, ispec.ImageConfig{}, Meta{}, nil, &ispec.History{Comment: "config after", EmptyLayer: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	oldManifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretDesc := oldManifest.Layers[1]
+
+	// Keeping every layer is a no-op, and keep must see every layer in order.
+	var seen []int
+	if err := mutator.FilterLayers(ctx, func(index int, desc ispec.Descriptor, diffID digest.Digest) bool {
+		seen = append(seen, index)
+		if !reflect.DeepEqual(desc, oldManifest.Layers[index]) || diffID != oldConfig.RootFS.DiffIDs[index] {
+			t.Errorf("keep called with the wrong layer %d: %+v %s", index, desc, diffID)
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("unexpected error filtering layers: %+v", err)
+	}
+	if expected := []int{0, 1, 2}; !reflect.DeepEqual(seen, expected) {
+		t.Errorf("keep called with unexpected indices: expected %v got %v", expected, seen)
+	}
+
+	if err := mutator.FilterLayers(ctx, func(_ int, desc ispec.Descriptor, _ digest.Digest) bool {
+		return desc.Digest != secretDesc.Digest
+	}); err != nil {
+		t.Fatalf("unexpected error filtering layers: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLayers := []ispec.Descriptor{oldManifest.Layers[0], oldManifest.Layers[2]}
+	if !reflect.DeepEqual(manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers after filtering: expected %+v got %+v", expectedLayers, manifest.Layers)
+	}
+	expectedDiffIDs := []digest.Digest{oldConfig.RootFS.DiffIDs[0], oldConfig.RootFS.DiffIDs[2]}
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diffids after filtering: expected %v got %v", expectedDiffIDs, config.RootFS.DiffIDs)
+	}
+	var comments []string
+	for _, history := range config.History {
+		comments = append(comments, history.Comment)
+	}
+	if expected := []string{"base", "config before", "config after", "top"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("unexpected history after filtering: expected %q got %q", expected, comments)
+	}
+	for idx := range manifest.Layers {
+		historyIndex := mutator.layerHistoryIndex(idx)
+		if historyIndex < 0 || config.History[historyIndex].Comment != []string{"base", "top"}[idx] {
+			t.Errorf("layer %d is associated with the wrong history entry: %d", idx, historyIndex)
+		}
+	}
+
+	// The filtered layer's contents must be gone from the root filesystem.
+	mapOptions := layer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := layer.UnpackRootfsFromSource(ctx, engineSource{engineExt}, rootfs, config, manifest, &layer.UnpackOptions{MapOptions: mapOptions}); err != nil {
+		t.Fatalf("unexpected error unpacking filtered image: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "secret")); !os.IsNotExist(err) {
+		t.Errorf("filtered layer contents exist after unpack: %v", err)
+	}
+	for _, name := range []string{"base", "top"} {
+		if data, err := ioutil.ReadFile(filepath.Join(rootfs, name)); err != nil || string(data) != name {
+			t.Errorf("unexpected contents of %s after unpack: %q (%v)", name, data, err)
+		}
+	}
+
+	// Layers without a history entry cannot be removed if the image has
+	// history, and a failed filter must not modify the image.
+	if err := mutator.AddExisting(ctx, secretDesc, nil, oldConfig.RootFS.DiffIDs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.FilterLayers(ctx, func(index int, _ ispec.Descriptor, _ digest.Digest) bool {
+		return index == 1
+	}); err == nil {
+		t.Errorf("expected error filtering layer without a history entry")
+	}
+	if manifest, err := mutator.Manifest(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(manifest.Layers) != 3 {
+		t.Errorf("failed filter modified the manifest: %d layers", len(manifest.Layers))
+	}
+}
+
+func TestMutateSquash(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The setup() layer is not actually compressed, so replace it with a
+	// base layer containing "test" and then add some layers on top of it,
+	// including whiteouts of files from earlier layers.
+	if err := mutator.RemoveLayer(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range [][]struct {
+		hdr  tar.Header
+		data string
+	}{
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "test", Mode: 0644}, data: "test"},
+		},
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "a/b", Mode: 0644}, data: "b contents"},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "a/c", Mode: 0600}, data: "c contents"},
+			{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "opaque/", Mode: 0755}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "opaque/old", Mode: 0644}, data: "old"},
+		},
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: ".wh.test", Mode: 0644}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "a/.wh.b", Mode: 0644}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "a/c", Mode: 0640}, data: "new c contents"},
+			{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "a/link", Linkname: "c", Mode: 0777}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "opaque/.wh..wh..opq", Mode: 0644}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "opaque/new", Mode: 0644}, data: "new"},
+		},
+	} {
+		var buffer bytes.Buffer
+		tw := tar.NewWriter(&buffer)
+		for _, entry := range entries {
+			hdr := entry.hdr
+			hdr.Size = int64(len(entry.data))
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(entry.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buffer, &ispec.History{Comment: "layer"}, GzipCompressor, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An empty layer history entry must also be collapsed.
+	if err := mutator.Set(ctx, ispec.ImageConfig{User: "default:user"}, Meta{}, nil, &ispec.History{Comment: "config", EmptyLayer: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	mapOptions := layer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}
+	unpack := func(name string) string {
+		manifest, err := mutator.Manifest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := mutator.Config(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootfs := filepath.Join(dir, name)
+		if err := layer.UnpackRootfsFromSource(ctx, engineSource{engineExt}, rootfs, config, manifest, &layer.UnpackOptions{MapOptions: mapOptions}); err != nil {
+			t.Fatalf("unexpected error unpacking %s: %+v", name, err)
+		}
+		return rootfs
+	}
+	before := unpack("before")
+
+	desc, err := mutator.Squash(ctx, nil, GzipCompressor, &SquashOptions{MapOptions: mapOptions, TempDir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error squashing image: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image must now have a single, consistent layer.
+	if len(manifest.Layers) != 1 || !reflect.DeepEqual(manifest.Layers[0], desc) {
+		t.Fatalf("unexpected layers after squash: %+v", manifest.Layers)
+	}
+	if len(config.RootFS.DiffIDs) != 1 {
+		t.Fatalf("unexpected diffids after squash: %v", config.RootFS.DiffIDs)
+	}
+	if len(config.History) != 1 || config.History[0].EmptyLayer || config.History[0].Comment != "squashed 3 layers" {
+		t.Errorf("unexpected history after squash: %+v", config.History)
+	}
+	if config.Config.User != "default:user" {
+		t.Errorf("squash modified the image configuration: %+v", config.Config)
+	}
+
+	// The squashed layer must match its diffid and contain no whiteouts.
+	blob, err := engineExt.GetVerifiedBlob(ctx, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	gzRdr, err := gzip.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffIDDigester := digest.SHA256.Digester()
+	tarRdr := io.TeeReader(gzRdr, diffIDDigester.Hash())
+	tr := tar.NewReader(tarRdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(filepath.Base(hdr.Name), ".wh.") {
+			t.Errorf("squashed layer contains whiteout %q", hdr.Name)
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, tarRdr); err != nil {
+		t.Fatal(err)
+	}
+	if diffIDDigester.Digest() != config.RootFS.DiffIDs[0] {
+		t.Errorf("squashed layer has the wrong diffid: expected %s got %s", config.RootFS.DiffIDs[0], diffIDDigester.Digest())
+	}
+
+	// The extracted root filesystem must be identical.
+	after := unpack("after")
+	fsEval := fseval.Default
+	if mapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+	keywords := []mtree.Keyword{"type", "mode", "size", "link", "sha256digest", "xattr"}
+	beforeDh, err := mtree.Walk(before, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterDh, err := mtree.Walk(after, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(beforeDh, afterDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("rootfs differs after squash: %s", diff)
+	}
+	for _, path := range []string{"test", "a/b", "opaque/old"} {
+		if _, err := os.Lstat(filepath.Join(after, path)); !os.IsNotExist(err) {
+			t.Errorf("whited-out path %s exists after squash: %v", path, err)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(after, "a", "c")); err != nil || string(data) != "new c contents" {
+		t.Errorf("unexpected contents of a/c after squash: %q (%v)", data, err)
+	}
+}
+
+func TestMutateSubject(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSubject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, subjectDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Create an image which refers to the base image as its subject.
+	blob, err := engineExt.FromDescriptor(ctx, subjectDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := blob.Data.(ispec.Manifest)
+	blob.Close()
+	manifest.ArtifactType = "application/vnd.example.artifact"
+	manifest.Subject = &subjectDescriptor
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(ctx, ispec.ImageConfig{
+		User: "changed:user",
+	}, Meta{}, map[string]string{"example.key": "value"}, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if newDescriptor.Descriptor().Digest == fromDescriptor.Digest {
+		t.Fatalf("new and old descriptors are the same!")
+	}
+
+	// The subject and artifact type must have been kept.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newManifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	if newManifest.Subject == nil || !reflect.DeepEqual(*newManifest.Subject, subjectDescriptor) {
+		t.Errorf("manifest.Subject was not kept: expected %v got %v", subjectDescriptor, newManifest.Subject)
+	}
+	if newManifest.ArtifactType != manifest.ArtifactType {
+		t.Errorf("manifest.ArtifactType was not kept: expected %q got %q", manifest.ArtifactType, newManifest.ArtifactType)
+	}
+
+	// And the new image is a referrer of the subject.
+	if err := engineExt.UpdateReference(ctx, "referrer", newDescriptor.Root()); err != nil {
+		t.Fatal(err)
+	}
+	referrers, err := engineExt.ListReferrers(ctx, subjectDescriptor, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %+v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != newDescriptor.Descriptor().Digest {
+		t.Errorf("unexpected referrers: expected [%s] got %v", newDescriptor.Descriptor().Digest, referrers)
+	}
+	if len(referrers) == 1 && referrers[0].ArtifactType != manifest.ArtifactType {
+		t.Errorf("unexpected referrer artifact type: expected %q got %q", manifest.ArtifactType, referrers[0].ArtifactType)
+	}
+}
+
+func TestMutateSetClearSubject(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetClearSubject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	subjectDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject manifest"),
+		Size:      16,
+	}
+
+	// Setting a nil or invalid subject must fail.
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetSubject(ctx, nil); err == nil {
+		t.Errorf("SetSubject(nil) should have failed")
+	}
+	if err := mutator.SetSubject(ctx, &ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "invalid"}); err == nil {
+		t.Errorf("SetSubject with an invalid digest should have failed")
+	}
+
+	// Set the subject.
+	if err := mutator.SetSubject(ctx, &subjectDescriptor); err != nil {
+		t.Fatalf("unexpected error setting subject: %+v", err)
+	}
+	withSubject, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, withSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	if manifest.Subject == nil || !reflect.DeepEqual(*manifest.Subject, subjectDescriptor) {
+		t.Errorf("manifest.Subject was not set: expected %v got %v", subjectDescriptor, manifest.Subject)
+	}
+
+	// The image must now be a referrer of the subject.
+	if err := engineExt.UpdateReference(ctx, "referrer", withSubject.Root()); err != nil {
+		t.Fatal(err)
+	}
+	referrers, err := engineExt.ListReferrers(ctx, subjectDescriptor, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %+v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != withSubject.Descriptor().Digest {
+		t.Errorf("unexpected referrers: expected [%s] got %v", withSubject.Descriptor().Digest, referrers)
+	}
+
+	// Clear the subject again.
+	if err := mutator.ClearSubject(ctx); err != nil {
+		t.Fatalf("unexpected error clearing subject: %+v", err)
+	}
+	withoutSubject, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, withoutSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err = mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	if manifest.Subject != nil {
+		t.Errorf("manifest.Subject was not cleared: got %v", manifest.Subject)
+	}
+
+	// Clearing the subject round-trips back to the original manifest.
+	if withoutSubject.Descriptor().Digest != fromDescriptor.Digest {
+		t.Errorf("clearing the subject did not round-trip: expected %s got %s", fromDescriptor.Digest, withoutSubject.Descriptor().Digest)
+	}
+}
+
+func TestMutateSquashKeepSeparate(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquashKeepSeparate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the setup() layer with a base layer which is kept separate,
+	// and add some layers on top of it (including a whiteout of a file from
+	// the base layer).
+	if err := mutator.RemoveLayer(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	for idx, entries := range [][]struct {
+		hdr  tar.Header
+		data string
+	}{
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/base", Mode: 0644}, data: "base"},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/removed", Mode: 0644}, data: "removed"},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/changed", Mode: 0644}, data: "old"},
+		},
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.removed", Mode: 0644}},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "app", Mode: 0755}, data: "app v1"},
+		},
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "app", Mode: 0755}, data: "app v2"},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/changed", Mode: 0644}, data: "new"},
+		},
+	} {
+		var buffer bytes.Buffer
+		tw := tar.NewWriter(&buffer)
+		for _, entry := range entries {
+			hdr := entry.hdr
+			hdr.Size = int64(len(entry.data))
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(entry.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var annotations map[string]string
+		if idx == 0 {
+			annotations = map[string]string{UmociKeepSeparateAnnotation: "true"}
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buffer, &ispec.History{Comment: fmt.Sprintf("layer %d", idx)}, GzipCompressor, annotations); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mutator.Set(ctx, ispec.ImageConfig{User: "default:user"}, Meta{}, nil, &ispec.History{Comment: "config", EmptyLayer: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldManifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapOptions := layer.MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}
+	unpack := func(name string, config ispec.Image, manifest ispec.Manifest) string {
+		rootfs := filepath.Join(dir, name)
+		if err := layer.UnpackRootfsFromSource(ctx, engineSource{engineExt}, rootfs, config, manifest, &layer.UnpackOptions{MapOptions: mapOptions}); err != nil {
+			t.Fatalf("unexpected error unpacking %s: %+v", name, err)
+		}
+		return rootfs
+	}
+	before := unpack("before", oldConfig, oldManifest)
+
+	desc, err := mutator.Squash(ctx, nil, GzipCompressor, &SquashOptions{MapOptions: mapOptions, TempDir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error squashing image: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The base layer must have been kept as-is, with the rest squashed.
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("unexpected number of layers after squash: %+v", manifest.Layers)
+	}
+	if !reflect.DeepEqual(manifest.Layers[0], oldManifest.Layers[0]) {
+		t.Errorf("base layer was modified by squash: expected %+v got %+v", oldManifest.Layers[0], manifest.Layers[0])
+	}
+	if !reflect.DeepEqual(manifest.Layers[1], desc) {
+		t.Errorf("unexpected squashed layer: expected %+v got %+v", desc, manifest.Layers[1])
+	}
+	if len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[0] != oldConfig.RootFS.DiffIDs[0] {
+		t.Errorf("unexpected diffids after squash: %v", config.RootFS.DiffIDs)
+	}
+	if len(config.History) != 2 || config.History[0].Comment != "layer 0" || config.History[1].Comment != "squashed 2 layers" {
+		t.Errorf("unexpected history after squash: %+v", config.History)
+	}
+
+	// The squashed layer must only contain the changes above the base layer.
+	blob, err := engineExt.GetVerifiedBlob(ctx, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	gzRdr, err := gzip.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzRdr)
+	entries := map[string]struct{}{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[filepath.Clean(hdr.Name)] = struct{}{}
+	}
+	for _, name := range []string{"app", "etc/changed", "etc/.wh.removed"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("squashed layer is missing %q: %v", name, entries)
+		}
+	}
+	if _, ok := entries["etc/base"]; ok {
+		t.Errorf("squashed layer contains unchanged base file etc/base: %v", entries)
+	}
+
+	// The extracted root filesystem must be identical.
+	after := unpack("after", config, manifest)
+	fsEval := fseval.Default
+	if mapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+	keywords := []mtree.Keyword{"type", "mode", "size", "link", "sha256digest", "xattr"}
+	beforeDh, err := mtree.Walk(before, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterDh, err := mtree.Walk(after, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(beforeDh, afterDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("rootfs differs after squash: %s", diff)
+	}
+
+	// With only the kept layers left, there is nothing to squash.
+	if err := mutator.SetLayerAnnotations(ctx, 1, map[string]string{UmociKeepSeparateAnnotation: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Squash(ctx, nil, GzipCompressor, &SquashOptions{MapOptions: mapOptions, TempDir: dir}); err == nil {
+		t.Errorf("expected an error squashing an image with every layer kept separate")
+	}
+	if err := mutator.SetLayerAnnotations(ctx, 1, map[string]string{UmociKeepSeparateAnnotation: "invalid"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Squash(ctx, nil, GzipCompressor, &SquashOptions{MapOptions: mapOptions, TempDir: dir}); err == nil {
+		t.Errorf("expected an error squashing an image with an invalid %s annotation", UmociKeepSeparateAnnotation)
+	}
+}
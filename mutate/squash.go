@@ -0,0 +1,247 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/vbatts/go-mtree"
+)
+
+// UmociKeepSeparateAnnotation is an umoci-specific annotation which can be set
+// (to "true") on the descriptor of a layer to stop Mutator.Squash from
+// collapsing it. Only the layers above the last layer with this annotation are
+// squashed, which allows for partial squashing (such as keeping an immutable
+// base layer shared with other images).
+const UmociKeepSeparateAnnotation = "ci.umo.keep_separate"
+
+// squashKeywords are the mtree keywords used to compute the changes made by
+// the squashed layers when some layers are kept separate. They match the
+// keywords umoci.Repack uses to detect changes to a bundle.
+var squashKeywords = []mtree.Keyword{
+	"size",
+	"type",
+	"uid",
+	"gid",
+	"mode",
+	"link",
+	"nlink",
+	"tar_time",
+	"sha256digest",
+	"xattr",
+}
+
+// SquashOptions describes how Mutator.Squash extracts the layers of an image
+// and generates the squashed layer.
+type SquashOptions struct {
+	// MapOptions are the UID and GID mappings used both when extracting the
+	// layers and when generating the squashed layer, so that ownership is
+	// preserved. When squashing as an unprivileged user, Rootless must be set
+	// (with the root user of the image mapped to the current user).
+	MapOptions layer.MapOptions
+
+	// TempDir is the directory in which the layers are temporarily extracted.
+	// If it is empty, the default directory for temporary files is used.
+	// The extracted root filesystem can be as large as the image, so it may
+	// be necessary to use a directory on a larger filesystem.
+	TempDir string
+}
+
+// engineSource is a layer.BlobSource which reads layer blobs from a
+// casext.Engine.
+type engineSource struct {
+	engine casext.Engine
+}
+
+// OpenBlob implements layer.BlobSource.
+func (s engineSource) OpenBlob(ctx context.Context, desc ispec.Descriptor) (io.ReadCloser, error) {
+	return s.engine.GetVerifiedBlob(ctx, desc)
+}
+
+// keepSeparateIndex returns the index of the last layer annotated with
+// UmociKeepSeparateAnnotation, or -1 if no layers have the annotation.
+func keepSeparateIndex(layers []ispec.Descriptor) (int, error) {
+	keep := -1
+	for idx, desc := range layers {
+		value, ok := desc.Annotations[UmociKeepSeparateAnnotation]
+		if !ok {
+			continue
+		}
+		keepSeparate, err := strconv.ParseBool(value)
+		if err != nil {
+			return -1, fmt.Errorf("layer %s has invalid %s annotation %q: %w", desc.Digest, UmociKeepSeparateAnnotation, value, err)
+		}
+		if keepSeparate {
+			keep = idx
+		}
+	}
+	return keep, nil
+}
+
+// Squash replaces all of the layers of the image with a single layer, which
+// contains the root filesystem produced by extracting every layer in order.
+// Whiteouts in later layers are applied while extracting, so files removed
+// by later layers are not included in the squashed layer (and it contains no
+// whiteouts). The DiffIDs in the image configuration are replaced by the
+// DiffID of the new layer, and the whole history of the image (including any
+// empty-layer entries) is replaced by a single entry for the new layer. If
+// history is nil, the entry records the number of layers squashed and keeps
+// the creation time and author of the last history entry. The new layer is
+// compressed with the provided compressor, and its descriptor is returned.
+// opt may be nil, in which case no ID mappings are used.
+//
+// If any layers are annotated with UmociKeepSeparateAnnotation, the last such
+// layer and every layer below it are kept unchanged (along with their DiffIDs
+// and history entries) and only the layers above it are squashed. In this case
+// the squashed layer contains the changes made by those layers relative to the
+// kept layers, including whiteouts for any paths they removed.
+func (m *Mutator) Squash(ctx context.Context, history *ispec.History, compressor Compressor, opt *SquashOptions) (ispec.Descriptor, error) {
+	var squashOptions SquashOptions
+	if opt != nil {
+		squashOptions = *opt
+	}
+	if history != nil && history.EmptyLayer {
+		return ispec.Descriptor{}, errors.New("squashed history entry cannot be an empty layer")
+	}
+	if err := m.cache(ctx); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("getting cache failed: %w", err)
+	}
+	if len(m.manifest.Layers) == 0 {
+		return ispec.Descriptor{}, errors.New("image has no layers to squash")
+	}
+	keep, err := keepSeparateIndex(m.manifest.Layers)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if keep == len(m.manifest.Layers)-1 {
+		return ispec.Descriptor{}, errors.New("image has no layers to squash above the last layer kept separate")
+	}
+	keepHistory := 0
+	if keep >= 0 {
+		keepHistory = m.layerHistoryIndex(keep) + 1
+	}
+	numSquashed := len(m.manifest.Layers) - (keep + 1)
+
+	fsEval := fseval.Default
+	if squashOptions.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	tempDir, err := ioutil.TempDir(squashOptions.TempDir, "umoci-squash")
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("create squash directory: %w", err)
+	}
+	defer func() {
+		if err := fsEval.RemoveAll(tempDir); err != nil {
+			log.Warnf("squash: could not remove %s: %v", tempDir, err)
+		}
+	}()
+	rootfs := filepath.Join(tempDir, layer.RootfsName)
+
+	// Every path in the merged root filesystem is new relative to an empty
+	// image, so only the types of the paths are needed to include everything.
+	// If some layers are kept separate, we need to record the state of the
+	// root filesystem after extracting them so that the squashed layer only
+	// contains the changes made by the layers above them.
+	keywords := []mtree.Keyword{"type"}
+	if keep >= 0 {
+		keywords = squashKeywords
+	}
+	var (
+		baseDh   *mtree.DirectoryHierarchy
+		unpacked int
+	)
+
+	// Extract every layer, which applies the whiteouts of later layers.
+	log.Infof("squash: extracting %d layers", len(m.manifest.Layers))
+	unpackOptions := &layer.UnpackOptions{
+		MapOptions: squashOptions.MapOptions,
+		AfterLayerUnpack: func(ispec.Manifest, ispec.Descriptor) error {
+			if unpacked == keep {
+				var err error
+				baseDh, err = mtree.Walk(rootfs, nil, keywords, fsEval)
+				if err != nil {
+					return fmt.Errorf("walk kept layers rootfs: %w", err)
+				}
+			}
+			unpacked++
+			return nil
+		},
+	}
+	if err := layer.UnpackRootfsFromSource(ctx, engineSource{m.engine}, rootfs, *m.config, *m.manifest, unpackOptions); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("extract layers: %w", err)
+	}
+
+	dh, err := mtree.Walk(rootfs, nil, keywords, fsEval)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("walk squashed rootfs: %w", err)
+	}
+	deltas, err := mtree.Compare(baseDh, dh, keywords)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("compute squashed rootfs entries: %w", err)
+	}
+	reader, err := layer.GenerateLayer(rootfs, deltas, &layer.RepackOptions{
+		MapOptions: squashOptions.MapOptions,
+	})
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("generate squashed layer: %w", err)
+	}
+	defer reader.Close()
+
+	if history == nil {
+		history = &ispec.History{
+			Comment: fmt.Sprintf("squashed %d layers", numSquashed),
+		}
+		if len(m.config.History) > 0 {
+			last := m.config.History[len(m.config.History)-1]
+			history.Created = last.Created
+			history.Author = last.Author
+		}
+	}
+
+	// Add appends to the existing layers, so truncate them to the kept
+	// layers first (and restore them if the new layer couldn't be added).
+	oldLayers := m.manifest.Layers
+	oldDiffIDs := m.config.RootFS.DiffIDs
+	oldHistory := m.config.History
+	m.manifest.Layers = append([]ispec.Descriptor(nil), oldLayers[:keep+1]...)
+	m.config.RootFS.DiffIDs = append([]digest.Digest(nil), oldDiffIDs[:keep+1]...)
+	m.config.History = append([]ispec.History(nil), oldHistory[:keepHistory]...)
+
+	desc, err := m.Add(ctx, ispec.MediaTypeImageLayer, reader, history, compressor, nil)
+	if err != nil {
+		m.manifest.Layers = oldLayers
+		m.config.RootFS.DiffIDs = oldDiffIDs
+		m.config.History = oldHistory
+		return ispec.Descriptor{}, fmt.Errorf("add squashed layer: %w", err)
+	}
+	log.Infof("squash: squashed %d layers into %s", numSquashed, desc.Digest)
+	return desc, nil
+}
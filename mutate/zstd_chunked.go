@@ -0,0 +1,480 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// These are the annotations used by containers/storage to find the table of
+// contents of a zstd:chunked blob without reading the whole blob.
+const (
+	// ZstdChunkedManifestChecksumAnnotation is the digest of the compressed
+	// table of contents of a zstd:chunked blob.
+	ZstdChunkedManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+
+	// ZstdChunkedManifestPositionAnnotation describes the position of the
+	// table of contents within a zstd:chunked blob, in the form
+	// "<offset>:<compressed-size>:<uncompressed-size>:<type>".
+	ZstdChunkedManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+
+	// zstdChunkedAnnotationPrefix is the common prefix of all zstd:chunked
+	// annotations.
+	zstdChunkedAnnotationPrefix = "io.github.containers.zstd-chunked."
+)
+
+const (
+	// zstdChunkedAlgorithm is the name of zstd:chunked compression in
+	// UmociCompressionAnnotation.
+	zstdChunkedAlgorithm = "zstd:chunked"
+
+	// defaultZstdChunkSize is the maximum size of the chunks regular files
+	// are split into by ZstdChunkedCompressor.
+	defaultZstdChunkSize = 4 << 20
+
+	// zstdChunkedManifestType is the type of table of contents we generate
+	// (containers/storage calls it "CRFS").
+	zstdChunkedManifestType = 1
+
+	// zstdChunkedFooterSize is the size of the data in the footer frame.
+	zstdChunkedFooterSize = 64
+
+	// zstdSkippableFrameMagic is the magic number of the skippable frames
+	// used to store the table of contents and footer. Standard zstd decoders
+	// ignore the contents of these frames.
+	zstdSkippableFrameMagic = 0x184D2A50
+)
+
+// zstdChunkedFooterMagic marks the end of a zstd:chunked blob.
+var zstdChunkedFooterMagic = []byte("GNUlInUx")
+
+// annotatedCompressor is implemented by Compressors which need to add
+// annotations to the descriptor of the blobs they create. Annotations must
+// only be called after the compressed stream has been completely read.
+type annotatedCompressor interface {
+	Annotations() map[string]string
+}
+
+// compressorAnnotations returns the annotations the given compressor needs
+// set on the descriptor of the blob it just compressed.
+func compressorAnnotations(compressor Compressor) map[string]string {
+	if c, ok := compressor.(annotatedCompressor); ok {
+		return c.Annotations()
+	}
+	return nil
+}
+
+// isCompressionAnnotation returns whether the given descriptor annotation
+// describes the compression of the blob (and so has to be dropped or replaced
+// if the blob is recompressed).
+func isCompressionAnnotation(key string) bool {
+	return key == UmociUncompressedBlobSizeAnnotation ||
+		key == UmociCompressionAnnotation ||
+		strings.HasPrefix(key, zstdChunkedAnnotationPrefix)
+}
+
+// ZstdChunkedCompressor provides zstd:chunked compression with the default
+// chunk size. See NewZstdChunkedCompressor for more details.
+var ZstdChunkedCompressor Compressor = NewZstdChunkedCompressor(0)
+
+// NewZstdChunkedCompressor returns a Compressor which produces zstd:chunked
+// blobs, which allow for tools such as containers/storage to only fetch the
+// files they are missing from a layer. The contents of each regular file in
+// the layer are compressed in separate zstd frames of at most chunkSize bytes
+// (if chunkSize is not positive, a default of 4MiB is used), and a table of
+// contents describing where each file is stored is appended to the blob in a
+// skippable frame. The position of the table of contents is stored in the
+// ZstdChunkedManifestChecksumAnnotation and
+// ZstdChunkedManifestPositionAnnotation annotations when the compressor is
+// used with Mutator.Add. The blob is still a valid zstd stream, and so can be
+// decompressed like any other zstd blob.
+//
+// The tar-split data that some tools use to reconstruct the original tar
+// headers is not generated. If the stream is not a valid tar archive, the
+// rest of the stream is compressed as a single frame.
+func NewZstdChunkedCompressor(chunkSize int64) Compressor {
+	if chunkSize <= 0 {
+		chunkSize = defaultZstdChunkSize
+	}
+	return &zstdChunkedCompressor{level: defaultZstdLevel, chunkSize: chunkSize}
+}
+
+type zstdChunkedCompressor struct {
+	level       int
+	chunkSize   int64
+	bytesRead   int64
+	annotations map[string]string
+}
+
+func (zc *zstdChunkedCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	enc, err := zstd.NewWriter(nil, zstdEncoderOptions(zc.level)...)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		zw := &zstdChunkedWriter{
+			out:       &countingWriter{w: pipeWriter},
+			enc:       enc,
+			chunkSize: zc.chunkSize,
+		}
+		annotations, err := zw.compress(reader)
+		if err != nil {
+			log.Warnf("zstd:chunked compress: could not compress layer: %v", err)
+			// #nosec G104
+			_ = pipeWriter.CloseWithError(fmt.Errorf("compressing layer: %w", err))
+			return
+		}
+		zc.bytesRead = zw.bytesRead
+		zc.annotations = annotations
+		if err := pipeWriter.Close(); err != nil {
+			log.Warnf("zstd:chunked compress: could not close pipe: %v", err)
+			// We don't CloseWithError because we cannot override the Close.
+			return
+		}
+	}()
+
+	return pipeReader, nil
+}
+
+func (zc zstdChunkedCompressor) MediaTypeSuffix() string {
+	return "zstd"
+}
+
+func (zc zstdChunkedCompressor) BytesRead() int64 {
+	return zc.bytesRead
+}
+
+func (zc zstdChunkedCompressor) Annotations() map[string]string {
+	return zc.annotations
+}
+
+// zstdChunkedManifest is the table of contents of a zstd:chunked blob, in the
+// format used by containers/storage.
+type zstdChunkedManifest struct {
+	Version int                `json:"version"`
+	Entries []zstdChunkedEntry `json:"entries"`
+}
+
+// zstdChunkedEntry describes a single tar entry (or an additional chunk of a
+// regular file) in a zstd:chunked table of contents. Offset and EndOffset are
+// the positions (in the compressed blob) of the frame containing the data.
+type zstdChunkedEntry struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name,omitempty"`
+	Linkname    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	ModTime     *time.Time        `json:"modtime,omitempty"`
+	Devmajor    int64             `json:"devMajor,omitempty"`
+	Devminor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	EndOffset   int64             `json:"endOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// zstdChunkedEntryType returns the table of contents type for a tar entry.
+func zstdChunkedEntryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "reg"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return string(typeflag)
+}
+
+func newZstdChunkedEntry(hdr *tar.Header) zstdChunkedEntry {
+	entry := zstdChunkedEntry{
+		Type:     zstdChunkedEntryType(hdr.Typeflag),
+		Name:     hdr.Name,
+		Linkname: hdr.Linkname,
+		Mode:     hdr.Mode,
+		Size:     hdr.Size,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	if !hdr.ModTime.IsZero() {
+		modTime := hdr.ModTime
+		entry.ModTime = &modTime
+	}
+	for key, value := range hdr.Xattrs {
+		if entry.Xattrs == nil {
+			entry.Xattrs = make(map[string]string)
+		}
+		entry.Xattrs[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return entry
+}
+
+// countingWriter counts the number of bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// recordingReader keeps a copy of all of the bytes read from the underlying
+// reader, so that the exact bytes of the tar stream (which archive/tar
+// doesn't give us) can be compressed.
+type recordingReader struct {
+	r   io.Reader
+	buf bytes.Buffer
+	n   int64
+	err error
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf.Write(p[:n])
+	rr.n += int64(n)
+	if err != nil && err != io.EOF && rr.err == nil {
+		rr.err = err
+	}
+	return n, err
+}
+
+// zstdChunkedWriter writes a zstd:chunked blob to out.
+type zstdChunkedWriter struct {
+	out       *countingWriter
+	enc       *zstd.Encoder
+	chunkSize int64
+	bytesRead int64
+	entries   []zstdChunkedEntry
+}
+
+// writeFrame compresses data as a new zstd frame, returning the offsets of
+// the start and end of the frame.
+func (zw *zstdChunkedWriter) writeFrame(data []byte) (int64, int64, error) {
+	start := zw.out.n
+	if len(data) == 0 {
+		return start, start, nil
+	}
+	zw.enc.Reset(zw.out)
+	if _, err := zw.enc.Write(data); err != nil {
+		return 0, 0, fmt.Errorf("write zstd frame: %w", err)
+	}
+	if err := zw.enc.Close(); err != nil {
+		return 0, 0, fmt.Errorf("close zstd frame: %w", err)
+	}
+	return start, zw.out.n, nil
+}
+
+// writeSkippableFrame writes data as a skippable frame.
+func (zw *zstdChunkedWriter) writeSkippableFrame(data []byte) error {
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:4], zstdSkippableFrameMagic)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+	if _, err := zw.out.Write(header[:]); err != nil {
+		return fmt.Errorf("write skippable frame header: %w", err)
+	}
+	if _, err := zw.out.Write(data); err != nil {
+		return fmt.Errorf("write skippable frame: %w", err)
+	}
+	return nil
+}
+
+// writeFile compresses the contents of the regular file hdr (read from tr) in
+// frames of at most chunkSize bytes, and appends its table of contents
+// entries. Any bytes read by tr before the file contents must already have
+// been flushed from rr.
+func (zw *zstdChunkedWriter) writeFile(hdr *tar.Header, tr *tar.Reader, rr *recordingReader) error {
+	var (
+		chunks   []zstdChunkedEntry
+		offset   int64
+		raw      int64
+		digester = digest.SHA256.Digester()
+		buf      = make([]byte, zw.chunkSize)
+	)
+	for offset < hdr.Size {
+		n, err := io.ReadFull(tr, buf)
+		if n > 0 {
+			// #nosec G104
+			_, _ = digester.Hash().Write(buf[:n])
+			data := rr.buf.Bytes()
+			raw += int64(len(data))
+			start, end, err := zw.writeFrame(data)
+			if err != nil {
+				return err
+			}
+			rr.buf.Reset()
+			chunks = append(chunks, zstdChunkedEntry{
+				Type:        "chunk",
+				Name:        hdr.Name,
+				Offset:      start,
+				EndOffset:   end,
+				ChunkOffset: offset,
+				ChunkSize:   int64(n),
+				ChunkDigest: digest.FromBytes(buf[:n]).String(),
+			})
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if offset != hdr.Size {
+		return fmt.Errorf("short read of %s: expected %d bytes got %d", hdr.Name, hdr.Size, offset)
+	}
+
+	entry := newZstdChunkedEntry(hdr)
+	// The stored data of sparse files doesn't match their contents, so we
+	// can't describe where their contents are.
+	if raw == hdr.Size && len(chunks) > 0 {
+		entry.Digest = digester.Digest().String()
+		entry.Offset, entry.EndOffset = chunks[0].Offset, chunks[0].EndOffset
+		if len(chunks) > 1 {
+			entry.ChunkSize = chunks[0].ChunkSize
+			entry.ChunkDigest = chunks[0].ChunkDigest
+		} else {
+			chunks = nil
+		}
+	} else {
+		chunks = nil
+	}
+	zw.entries = append(zw.entries, entry)
+	if len(chunks) > 1 {
+		zw.entries = append(zw.entries, chunks[1:]...)
+	}
+	return nil
+}
+
+// compress compresses the tar stream read from r, returning the annotations
+// describing the blob.
+func (zw *zstdChunkedWriter) compress(r io.Reader) (map[string]string, error) {
+	rr := &recordingReader{r: r}
+	tr := tar.NewReader(rr)
+	for {
+		hdr, err := tr.Next()
+		if rr.err != nil {
+			return nil, rr.err
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugf("zstd:chunked compress: compressing the rest of the stream as a single frame: %v", err)
+			}
+			break
+		}
+		// Each set of tar headers gets its own frame, so that the contents
+		// of regular files are in separate frames.
+		if _, _, err := zw.writeFrame(rr.buf.Bytes()); err != nil {
+			return nil, err
+		}
+		rr.buf.Reset()
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			zw.entries = append(zw.entries, newZstdChunkedEntry(hdr))
+			continue
+		}
+		if err := zw.writeFile(hdr, tr, rr); err != nil {
+			if rr.err != nil {
+				return nil, rr.err
+			}
+			log.Debugf("zstd:chunked compress: compressing the rest of the stream as a single frame: %v", err)
+			break
+		}
+	}
+
+	// Compress whatever is left (the end of the archive, or the rest of a
+	// stream which isn't a valid tar archive).
+	zw.enc.Reset(zw.out)
+	if _, err := zw.enc.Write(rr.buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("write zstd frame: %w", err)
+	}
+	rest, err := io.Copy(zw.enc, rr.r)
+	if err != nil {
+		return nil, fmt.Errorf("write zstd frame: %w", err)
+	}
+	if err := zw.enc.Close(); err != nil {
+		return nil, fmt.Errorf("close zstd frame: %w", err)
+	}
+	zw.bytesRead = rr.n + rest
+
+	// Append the table of contents and the footer.
+	manifest, err := json.Marshal(zstdChunkedManifest{
+		Version: 1,
+		Entries: zw.entries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal zstd:chunked manifest: %w", err)
+	}
+	compressedManifest := zw.enc.EncodeAll(manifest, nil)
+	manifestOffset := zw.out.n + 8 // skip the skippable frame header
+	if err := zw.writeSkippableFrame(compressedManifest); err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(manifestOffset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(compressedManifest)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(manifest)))
+	binary.LittleEndian.PutUint64(footer[24:], zstdChunkedManifestType)
+	// The next 24 bytes describe the (missing) tar-split data.
+	copy(footer[56:], zstdChunkedFooterMagic)
+	if err := zw.writeSkippableFrame(footer); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		ZstdChunkedManifestChecksumAnnotation: digest.FromBytes(compressedManifest).String(),
+		ZstdChunkedManifestPositionAnnotation: fmt.Sprintf("%d:%d:%d:%d", manifestOffset, len(compressedManifest), len(manifest), zstdChunkedManifestType),
+	}, nil
+}
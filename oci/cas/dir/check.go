@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+	"golang.org/x/sys/unix"
+)
+
+// Garbage describes a file in an OCI layout which is not a valid blob (or is
+// a leftover temporary file), as found by CheckBlobs.
+type Garbage struct {
+	// Path is the path of the file, relative to the root of the layout.
+	Path string `json:"path"`
+
+	// Reason is a human-readable description of why the file is garbage.
+	Reason string `json:"reason"`
+}
+
+// isLocked returns whether the given temporary directory is currently locked
+// by another dirEngine (and thus is still in use).
+func isLocked(path string) (bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open for locking: %w", err)
+	}
+	defer fh.Close()
+
+	if err := unix.Flock(int(fh.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return true, nil
+	}
+	// #nosec G104
+	_ = unix.Flock(int(fh.Fd()), unix.LOCK_UN)
+	return false, nil
+}
+
+// checkBlob returns why the blob directory entry is not a valid blob, or ""
+// if it is valid. Blobs with a valid name are re-digested, so that blobs left
+// behind by a partial (non-atomic) write are detected.
+func checkBlob(path string, fi os.FileInfo) (string, error) {
+	if !fi.Mode().IsRegular() {
+		return "not a regular file", nil
+	}
+	expected := digest.NewDigestFromEncoded(cas.BlobAlgorithm, fi.Name())
+	if err := expected.Validate(); err != nil {
+		return fmt.Sprintf("name is not a valid %s digest", cas.BlobAlgorithm), nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open blob: %w", err)
+	}
+	defer fh.Close()
+
+	got, err := cas.BlobAlgorithm.FromReader(fh)
+	if err != nil {
+		return "", fmt.Errorf("digest blob: %w", err)
+	}
+	if got != expected {
+		return fmt.Sprintf("contents have digest %s (partial or corrupted write)", got), nil
+	}
+	return "", nil
+}
+
+// CheckBlobs scans the OCI layout at the given path for files which are not
+// valid blobs, such as temporary files left behind in the blob directory,
+// blobs whose contents do not match their name (usually the result of a
+// partial write by some other tool) and stale temporary directories left
+// behind by a crashed umoci process. Every blob is re-digested, so this can
+// be quite slow for large layouts. If remove is set, all of the garbage found
+// is also removed. Valid blobs are never modified.
+func CheckBlobs(ctx context.Context, path string, remove bool) ([]Garbage, error) {
+	var garbage []Garbage
+
+	blobDir := filepath.Join(blobDirectory, cas.BlobAlgorithm.String())
+	entries, err := ioutil.ReadDir(filepath.Join(path, blobDir))
+	if err != nil {
+		return nil, fmt.Errorf("read blobdir: %w", err)
+	}
+	for _, fi := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		relPath := filepath.Join(blobDir, fi.Name())
+		reason, err := checkBlob(filepath.Join(path, relPath), fi)
+		if err != nil {
+			return nil, fmt.Errorf("check %s: %w", relPath, err)
+		}
+		if reason != "" {
+			garbage = append(garbage, Garbage{Path: relPath, Reason: reason})
+		}
+	}
+
+	// Temporary directories are only garbage if nobody holds a lock on them.
+	numBlobGarbage := len(garbage)
+	tempDirs, err := filepath.Glob(filepath.Join(path, ".umoci-*"))
+	if err != nil {
+		return nil, fmt.Errorf("glob .umoci-*: %w", err)
+	}
+	for _, tempDir := range tempDirs {
+		locked, err := isLocked(tempDir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("check %s: %w", tempDir, err)
+		}
+		if !locked {
+			garbage = append(garbage, Garbage{Path: filepath.Base(tempDir), Reason: "stale temporary directory"})
+		}
+	}
+
+	if remove {
+		for idx, g := range garbage {
+			if idx >= numBlobGarbage {
+				// Re-take the lock while removing the temporary directory, in
+				// case it started being used since we checked it.
+				e := &dirEngine{path: path}
+				if err := e.cleanPath(ctx, filepath.Join(path, g.Path)); err != nil && err != filepath.SkipDir {
+					return garbage, fmt.Errorf("remove %s: %w", g.Path, err)
+				}
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(path, g.Path)); err != nil {
+				return garbage, fmt.Errorf("remove %s: %w", g.Path, err)
+			}
+			log.Debugf("removed garbage %s: %s", g.Path, g.Reason)
+		}
+	}
+	return garbage, nil
+}
@@ -0,0 +1,146 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+)
+
+func TestCheckBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCheckBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// Add some valid blobs (this also creates a locked temporary directory
+	// which must not be touched).
+	var valid []digest.Digest
+	for _, data := range []string{"some blob", "another blob"} {
+		blob, _, err := engine.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %+v", err)
+		}
+		valid = append(valid, blob)
+	}
+
+	// Plant some garbage: a temporary file in the blob directory, a blob
+	// whose contents don't match its name (a partial write) and a stale
+	// temporary directory.
+	blobDir := filepath.Join(blobDirectory, cas.BlobAlgorithm.String())
+	if err := ioutil.WriteFile(filepath.Join(image, blobDir, "blob-1234.partial"), []byte("some bl"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	misnamed := cas.BlobAlgorithm.FromString("the full contents")
+	if err := ioutil.WriteFile(filepath.Join(image, blobDir, misnamed.Encoded()), []byte("the full"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(image, ".umoci-stale", "blob-5678"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid blob names are not listed.
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	if len(blobs) != 3 {
+		t.Errorf("expected only blobs with valid names to be listed, got %v", blobs)
+	}
+
+	expected := []string{
+		".umoci-stale",
+		filepath.Join(blobDir, "blob-1234.partial"),
+		filepath.Join(blobDir, misnamed.Encoded()),
+	}
+	sort.Strings(expected)
+	checkGarbage := func(remove bool) {
+		garbage, err := CheckBlobs(ctx, image, remove)
+		if err != nil {
+			t.Fatalf("unexpected error checking blobs: %+v", err)
+		}
+		var got []string
+		for _, g := range garbage {
+			got = append(got, g.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("unexpected garbage (remove=%v): expected %v, got %v", remove, expected, got)
+		}
+	}
+
+	// Detection doesn't remove anything.
+	checkGarbage(false)
+	for _, path := range expected {
+		if _, err := os.Lstat(filepath.Join(image, path)); err != nil {
+			t.Errorf("garbage %s removed without remove being set: %v", path, err)
+		}
+	}
+
+	// Remove the garbage.
+	checkGarbage(true)
+	for _, path := range expected {
+		if _, err := os.Lstat(filepath.Join(image, path)); !os.IsNotExist(err) {
+			t.Errorf("garbage %s was not removed: %v", path, err)
+		}
+	}
+
+	// Valid blobs (and our own temporary directory) are untouched.
+	for _, blob := range valid {
+		rdr, err := engine.GetBlob(ctx, blob)
+		if err != nil {
+			t.Fatalf("unexpected error getting valid blob %s: %+v", blob, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, rdr); err != nil {
+			t.Errorf("unexpected error reading valid blob %s: %+v", blob, err)
+		}
+		if err := rdr.Close(); err != nil {
+			t.Errorf("unexpected error verifying valid blob %s: %+v", blob, err)
+		}
+	}
+	if _, err := os.Stat(engine.(*dirEngine).temp); err != nil {
+		t.Errorf("locked temporary directory was removed: %v", err)
+	}
+
+	// Nothing else is left over.
+	expected = nil
+	checkGarbage(false)
+}
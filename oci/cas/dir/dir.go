@@ -26,6 +26,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
@@ -74,12 +76,19 @@ func blobPath(digest digest.Digest) (string, error) {
 }
 
 type dirEngine struct {
-	path     string
+	path string
+
+	// tempLock protects temp and tempFile, so that blobs can be written
+	// concurrently.
+	tempLock sync.Mutex
 	temp     string
 	tempFile *os.File
 }
 
 func (e *dirEngine) ensureTempDir() error {
+	e.tempLock.Lock()
+	defer e.tempLock.Unlock()
+
 	if e.temp == "" {
 		tempDir, err := ioutil.TempDir(e.path, ".umoci-")
 		if err != nil {
@@ -229,7 +238,7 @@ func (e *dirEngine) StatBlob(ctx context.Context, digest digest.Digest) (bool, e
 	if err != nil {
 		return false, fmt.Errorf("compute blob path: %w", err)
 	}
-	_, err = os.Stat(path)
+	_, err = os.Stat(filepath.Join(e.path, path))
 	if errors.Is(err, os.ErrNotExist) {
 		return false, nil
 	}
@@ -239,6 +248,21 @@ func (e *dirEngine) StatBlob(ctx context.Context, digest digest.Digest) (bool, e
 	return true, nil
 }
 
+// BlobModTime returns the modification time of the blob with the given digest
+// in the directory-backed OCI image at path. This is not part of cas.Engine,
+// because the modification time of a blob is specific to this backend.
+func BlobModTime(ctx context.Context, path string, digest digest.Digest) (time.Time, error) {
+	blob, err := blobPath(digest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("compute blob path: %w", err)
+	}
+	fi, err := os.Stat(filepath.Join(path, blob))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("stat blob path: %w", err)
+	}
+	return fi.ModTime(), nil
+}
+
 // PutIndex sets the index of the OCI image to the given index, replacing the
 // previously existing index. This operation is atomic; any readers attempting
 // to access the OCI image while it is being modified will only ever see the
@@ -330,6 +354,13 @@ func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
 		}
 		// XXX: Do we need to handle multiple-directory-deep cases?
 		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
+		// Files which can't be blobs (such as temporary files left behind by
+		// a crash) would break every user of ListBlobs, so skip them. They
+		// can be removed with CheckBlobs.
+		if err := digest.Validate(); err != nil {
+			log.Warnf("ignoring invalid blob name %s: %v", path, err)
+			return nil
+		}
 		digests = append(digests, digest)
 		return nil
 	}); err != nil {
@@ -386,6 +417,9 @@ func (e *dirEngine) cleanPath(ctx context.Context, path string) error {
 // Close releases all references held by the e. Subsequent operations may
 // fail.
 func (e *dirEngine) Close() error {
+	e.tempLock.Lock()
+	defer e.tempLock.Unlock()
+
 	if e.temp != "" {
 		if err := unix.Flock(int(e.tempFile.Fd()), unix.LOCK_UN); err != nil {
 			return fmt.Errorf("unlock tempdir: %w", err)
@@ -21,12 +21,16 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/pkg/testutils"
 )
@@ -117,6 +121,12 @@ func TestEngineBlob(t *testing.T) {
 			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(test.bytes), size)
 		}
 
+		if exists, err := engine.StatBlob(ctx, digest); err != nil {
+			t.Errorf("StatBlob: unexpected error: %+v", err)
+		} else if !exists {
+			t.Errorf("StatBlob: blob doesn't exist after PutBlob")
+		}
+
 		blobReader, err := engine.GetBlob(ctx, digest)
 		if err != nil {
 			t.Errorf("GetBlob: unexpected error: %+v", err)
@@ -143,6 +153,11 @@ func TestEngineBlob(t *testing.T) {
 				t.Errorf("GetBlob: unexpected error: %+v", err)
 			}
 		}
+		if exists, err := engine.StatBlob(ctx, digest); err != nil {
+			t.Errorf("StatBlob: unexpected error: %+v", err)
+		} else if exists {
+			t.Errorf("StatBlob: blob still exists after DeleteBlob")
+		}
 
 		// DeleteBlob is idempotent. It shouldn't cause an error.
 		if err := engine.DeleteBlob(ctx, digest); err != nil {
@@ -158,6 +173,134 @@ func TestEngineBlob(t *testing.T) {
 	}
 }
 
+func TestBlobModTime(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestBlobModTime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	digest, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("some blob")))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// Set a well-known mtime on the blob.
+	path, err := blobPath(digest)
+	if err != nil {
+		t.Fatalf("unexpected error computing blob path: %+v", err)
+	}
+	expected := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(image, path), expected, expected); err != nil {
+		t.Fatalf("unexpected error setting blob mtime: %+v", err)
+	}
+
+	mtime, err := BlobModTime(ctx, image, digest)
+	if err != nil {
+		t.Fatalf("BlobModTime: unexpected error: %+v", err)
+	}
+	if !mtime.Equal(expected) {
+		t.Errorf("BlobModTime: mtime doesn't match: expected=%s got=%s", expected, mtime)
+	}
+
+	if err := engine.DeleteBlob(ctx, digest); err != nil {
+		t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+	}
+	if _, err := BlobModTime(ctx, image, digest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("BlobModTime: expected ErrNotExist for deleted blob: got %+v", err)
+	}
+
+	// Invalid digests are rejected rather than being used as a path.
+	if _, err := BlobModTime(ctx, image, "sha256:../../index.json"); err == nil {
+		t.Errorf("BlobModTime: expected error for invalid digest")
+	}
+}
+
+func TestEngineBlobConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// Write a set of blobs (including duplicates) at the same time, using an
+	// engine which has not yet created its temporary directory.
+	const numBlobs = 32
+	var wg sync.WaitGroup
+	digests := make([]digest.Digest, numBlobs)
+	errs := make([]error, numBlobs)
+	for idx := 0; idx < numBlobs; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("blob %d", idx%(numBlobs/2)))
+			digests[idx], _, errs[idx] = engine.PutBlob(ctx, bytes.NewReader(data))
+		}(idx)
+	}
+	wg.Wait()
+
+	for idx := 0; idx < numBlobs; idx++ {
+		if errs[idx] != nil {
+			t.Errorf("PutBlob %d: unexpected error: %+v", idx, errs[idx])
+			continue
+		}
+		data := []byte(fmt.Sprintf("blob %d", idx%(numBlobs/2)))
+		if expected := digest.FromBytes(data); digests[idx] != expected {
+			t.Errorf("PutBlob %d: digest doesn't match: expected=%s got=%s", idx, expected, digests[idx])
+		}
+		blobReader, err := engine.GetBlob(ctx, digests[idx])
+		if err != nil {
+			t.Errorf("GetBlob %d: unexpected error: %+v", idx, err)
+			continue
+		}
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		if err != nil {
+			t.Errorf("GetBlob %d: failed to read blob: %+v", idx, err)
+		}
+		if err := blobReader.Close(); err != nil {
+			t.Errorf("GetBlob %d: failed to verify blob: %+v", idx, err)
+		}
+		if !bytes.Equal(gotBytes, data) {
+			t.Errorf("GetBlob %d: bytes did not match: expected=%q got=%q", idx, data, gotBytes)
+		}
+	}
+
+	// Only one temporary directory should have been created.
+	tempDirs, err := filepath.Glob(filepath.Join(image, ".umoci-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tempDirs) != 1 {
+		t.Errorf("expected exactly one temporary directory, got %v", tempDirs)
+	}
+}
+
 func TestEngineValidate(t *testing.T) {
 	root, err := ioutil.TempDir("", "umoci-TestEngineValidate")
 	if err != nil {
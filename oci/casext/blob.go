@@ -43,6 +43,7 @@ type Blob struct {
 	// ispec.MediaTypeDescriptor => ispec.Descriptor
 	// ispec.MediaTypeImageManifest => ispec.Manifest
 	// ispec.MediaTypeImageIndex => ispec.Index
+	// mediatype.DockerManifestList => ispec.Index
 	// ispec.MediaTypeImageLayer => io.ReadCloser
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
@@ -0,0 +1,70 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CopyBlobs copies every blob reachable from root in this engine (the same
+// set of blobs which GC would retain for root, including root itself) into
+// dst, returning the number of blobs copied. Blobs which already exist in dst
+// are not copied, so CopyBlobs can safely be re-run (such as after an
+// interrupted copy) and only the missing blobs will be copied. The digest of
+// every copied blob is verified.
+func (e Engine) CopyBlobs(ctx context.Context, dst Engine, root ispec.Descriptor) (int, error) {
+	blobs, err := e.reachable(ctx, root)
+	if err != nil {
+		return 0, fmt.Errorf("get reachable blobs: %w", err)
+	}
+	// Copy the blobs in a stable order.
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i] < blobs[j] })
+
+	var n int
+	for _, blob := range blobs {
+		exists, err := dst.StatBlob(ctx, blob)
+		if err != nil {
+			return n, fmt.Errorf("stat destination blob %s: %w", blob, err)
+		}
+		if exists {
+			log.Debugf("skipping copy of existing blob: %s", blob)
+			continue
+		}
+
+		reader, err := e.GetBlob(ctx, blob)
+		if err != nil {
+			return n, fmt.Errorf("get source blob %s: %w", blob, err)
+		}
+		newDigest, _, err := dst.PutBlob(ctx, reader)
+		_ = reader.Close()
+		if err != nil {
+			return n, fmt.Errorf("put destination blob %s: %w", blob, err)
+		}
+		if newDigest != blob {
+			return n, fmt.Errorf("copy blob %s: contents have digest %s", blob, newDigest)
+		}
+		log.Debugf("copied blob: %s", blob)
+		n++
+	}
+	return n, nil
+}
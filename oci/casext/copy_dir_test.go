@@ -0,0 +1,142 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestEngineCopyBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCopyBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	openImage := func(name string) Engine {
+		image := filepath.Join(root, name)
+		if err := dir.Create(image); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		engine, err := dir.Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		return NewEngine(engine)
+	}
+	src := openImage("src")
+	defer src.Close()
+	dst := openImage("dst")
+	defer dst.Close()
+
+	putBlob := func(engine Engine, data string) ispec.Descriptor {
+		blobDigest, blobSize, err := engine.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    blobDigest,
+			Size:      blobSize,
+		}
+	}
+	putManifest := func(config string, layers ...string) ispec.Descriptor {
+		manifest := ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config:    putBlob(src, config),
+		}
+		manifest.Config.MediaType = ispec.MediaTypeImageConfig
+		for _, layer := range layers {
+			manifest.Layers = append(manifest.Layers, putBlob(src, layer))
+		}
+		manifestDigest, manifestSize, err := src.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest blob: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+	}
+
+	// A multi-platform image with a layer shared between both manifests.
+	amd64 := putManifest(`{"architecture":"amd64"}`, "shared layer", "amd64 layer")
+	arm64 := putManifest(`{"architecture":"arm64"}`, "shared layer", "arm64 layer 1", "arm64 layer 2")
+	index, err := src.CreateIndex(ctx, "", []ispec.Descriptor{amd64, arm64}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating index: %+v", err)
+	}
+	// An unrelated blob which must not be copied.
+	unrelated := putBlob(src, "unrelated blob")
+
+	expected, err := src.reachable(ctx, index)
+	if err != nil {
+		t.Fatalf("unexpected error getting reachable blobs: %+v", err)
+	}
+	// index + 2 manifests + 2 configs + 4 distinct layers.
+	if len(expected) != 9 {
+		t.Fatalf("unexpected number of reachable blobs: expected 9 got %d", len(expected))
+	}
+
+	// Simulate a partial earlier copy.
+	putBlob(dst, "shared layer")
+
+	n, err := src.CopyBlobs(ctx, dst, index)
+	if err != nil {
+		t.Fatalf("unexpected error copying blobs: %+v", err)
+	}
+	if n != len(expected)-1 {
+		t.Errorf("unexpected number of copied blobs: expected %d got %d", len(expected)-1, n)
+	}
+	for _, blob := range expected {
+		if exists, err := dst.StatBlob(ctx, blob); err != nil {
+			t.Errorf("unexpected error stating blob %s: %+v", blob, err)
+		} else if !exists {
+			t.Errorf("blob %s was not copied", blob)
+		}
+	}
+	if exists, err := dst.StatBlob(ctx, unrelated.Digest); err != nil {
+		t.Errorf("unexpected error stating blob %s: %+v", unrelated.Digest, err)
+	} else if exists {
+		t.Errorf("unreachable blob %s was copied", unrelated.Digest)
+	}
+
+	// Copying again must be a no-op.
+	n, err = src.CopyBlobs(ctx, dst, index)
+	if err != nil {
+		t.Fatalf("unexpected error re-copying blobs: %+v", err)
+	}
+	if n != 0 {
+		t.Errorf("unexpected number of re-copied blobs: expected 0 got %d", n)
+	}
+}
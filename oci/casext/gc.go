@@ -20,12 +20,55 @@ package casext
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+var (
+	blobAnnotationsLock sync.RWMutex
+
+	// blobAnnotations is the set of annotations whose values are the digests
+	// of blobs referenced by the annotated descriptor.
+	blobAnnotations = map[string]struct{}{}
+)
+
+// RegisterBlobAnnotation registers an annotation whose value is the digest of
+// a blob which is referenced by the annotated descriptor, despite there being
+// no descriptor for the blob (such as mutate.UmociFileManifestAnnotation). GC
+// treats such annotations as references, so the blob is retained for as long
+// as the annotated descriptor is.
+func RegisterBlobAnnotation(annotation string) {
+	blobAnnotationsLock.Lock()
+	blobAnnotations[annotation] = struct{}{}
+	blobAnnotationsLock.Unlock()
+}
+
+// annotatedBlobs returns the digests of the blobs referenced by the
+// registered blob annotations of the given descriptor (see
+// RegisterBlobAnnotation).
+func annotatedBlobs(descriptor ispec.Descriptor) []digest.Digest {
+	blobAnnotationsLock.RLock()
+	defer blobAnnotationsLock.RUnlock()
+
+	var blobs []digest.Digest
+	for annotation := range blobAnnotations {
+		value, ok := descriptor.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		blob, err := digest.Parse(value)
+		if err != nil {
+			log.Warnf("ignoring invalid %s annotation on blob %s: %v", annotation, descriptor.Digest, err)
+			continue
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs
+}
+
 // GCPolicy is a policy function that returns 'true' if a blob can be GC'ed
 type GCPolicy func(ctx context.Context, digest digest.Digest) (bool, error)
 
@@ -44,35 +87,10 @@ type GCPolicy func(ctx context.Context, digest digest.Digest) (bool, error)
 // blob's digest can indicate whether that blob needs to garbage collected. The
 // blob is skipped for garbage collection if a policy returns false.
 func (e Engine) GC(ctx context.Context, policies ...GCPolicy) error {
-	// Generate the root set of descriptors.
-	var root []ispec.Descriptor
-
-	index, err := e.GetIndex(ctx)
-	if err != nil {
-		return fmt.Errorf("get top-level index: %w", err)
-	}
-
-	for _, descriptor := range index.Manifests {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: got reference")
-		root = append(root, descriptor)
-	}
-
 	// Mark from the root sets.
-	black := map[digest.Digest]struct{}{}
-	for idx, descriptor := range root {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: marking from root")
-
-		reachables, err := e.reachable(ctx, descriptor)
-		if err != nil {
-			return fmt.Errorf("getting reachables from root %d: %w", idx, err)
-		}
-		for _, reachable := range reachables {
-			black[reachable] = struct{}{}
-		}
+	black, err := e.ReferencedBlobs(ctx)
+	if err != nil {
+		return err
 	}
 
 	// Sweep all blobs in the white set.
@@ -117,3 +135,40 @@ sweep:
 	log.Debugf("garbage collected %d blobs", n)
 	return nil
 }
+
+// ReferencedBlobs returns the set of blob digests which are reachable by
+// following a descriptor path from the root set of references in the image.
+// These are the blobs which GC would retain.
+func (e Engine) ReferencedBlobs(ctx context.Context) (map[digest.Digest]struct{}, error) {
+	// Generate the root set of descriptors.
+	var root []ispec.Descriptor
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get top-level index: %w", err)
+	}
+
+	for _, descriptor := range index.Manifests {
+		log.WithFields(log.Fields{
+			"digest": descriptor.Digest,
+		}).Debugf("GC: got reference")
+		root = append(root, descriptor)
+	}
+
+	// Mark from the root sets.
+	black := map[digest.Digest]struct{}{}
+	for idx, descriptor := range root {
+		log.WithFields(log.Fields{
+			"digest": descriptor.Digest,
+		}).Debugf("GC: marking from root")
+
+		reachables, err := e.reachable(ctx, descriptor)
+		if err != nil {
+			return nil, fmt.Errorf("getting reachables from root %d: %w", idx, err)
+		}
+		for _, reachable := range reachables {
+			black[reachable] = struct{}{}
+		}
+	}
+	return black, nil
+}
@@ -329,3 +329,105 @@ func TestGCWithPolicy(t *testing.T) {
 		t.Fatalf("expected blob list with two entries after GC: %#v", b)
 	}
 }
+
+func TestGCBlobAnnotationSharedLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCBlobAnnotationSharedLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	const testBlobAnnotation = "ci.umo.test_blob_annotation"
+	RegisterBlobAnnotation(testBlobAnnotation)
+
+	putBlob := func(content string) ispec.Descriptor {
+		digest, size, err := engine.PutBlob(ctx, strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("error writing blob: %+v", err)
+		}
+		return ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: digest, Size: size}
+	}
+	putJSON := func(mediaType string, v interface{}) ispec.Descriptor {
+		digest, size, err := engineExt.PutBlobJSON(ctx, v)
+		if err != nil {
+			t.Fatalf("error writing json blob: %+v", err)
+		}
+		return ispec.Descriptor{MediaType: mediaType, Digest: digest, Size: size}
+	}
+
+	config := putBlob("config")
+	layer := putBlob("shared layer")
+	sidecar := putBlob("sidecar")
+	orphan := putBlob("orphan")
+
+	// Both manifests share the same layer, but only the second descriptor of
+	// the layer refers to the sidecar blob. The first manifest is walked
+	// first, so the layer has already been seen when the annotation is found.
+	annotatedLayer := layer
+	annotatedLayer.Annotations = map[string]string{
+		testBlobAnnotation: sidecar.Digest.String(),
+	}
+	var manifests []ispec.Descriptor
+	for _, layerDesc := range []ispec.Descriptor{layer, annotatedLayer} {
+		manifests = append(manifests, putJSON(ispec.MediaTypeImageManifest, ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []ispec.Descriptor{layerDesc},
+		}))
+	}
+	nested := putJSON(ispec.MediaTypeImageIndex, ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	})
+	if err := engine.PutIndex(ctx, ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: []ispec.Descriptor{nested},
+	}); err != nil {
+		t.Fatalf("error writing index: %+v", err)
+	}
+
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC failed: %+v", err)
+	}
+
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	remaining := map[digest.Digest]struct{}{}
+	for _, blob := range blobs {
+		remaining[blob] = struct{}{}
+	}
+	for name, desc := range map[string]ispec.Descriptor{
+		"config":       config,
+		"layer":        layer,
+		"sidecar":      sidecar,
+		"manifest 0":   manifests[0],
+		"manifest 1":   manifests[1],
+		"nested index": nested,
+	} {
+		if _, ok := remaining[desc.Digest]; !ok {
+			t.Errorf("GC removed reachable %s blob %s", name, desc.Digest)
+		}
+	}
+	if _, ok := remaining[orphan.Digest]; ok {
+		t.Errorf("GC didn't remove orphan blob %s", orphan.Digest)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+)
+
+// CreateIndex creates a new index blob containing the given descriptors and
+// returns a descriptor referencing it. The mediaType selects the format of the
+// index, and must be either ispec.MediaTypeImageIndex (the default if empty)
+// or mediatype.DockerManifestList. The two formats are structurally identical,
+// but Docker manifest lists do not support annotations.
+//
+// The new index is not referenced by anything, so callers will usually want
+// to follow this with UpdateReference.
+func (e Engine) CreateIndex(ctx context.Context, mediaType string, manifests []ispec.Descriptor, annotations map[string]string) (ispec.Descriptor, error) {
+	switch mediaType {
+	case "":
+		mediaType = ispec.MediaTypeImageIndex
+	case ispec.MediaTypeImageIndex:
+		// nothing
+	case mediatype.DockerManifestList:
+		if len(annotations) != 0 {
+			return ispec.Descriptor{}, errors.New("docker manifest lists do not support annotations")
+		}
+	default:
+		return ispec.Descriptor{}, fmt.Errorf("unsupported index media-type: %s", mediaType)
+	}
+	if manifests == nil {
+		// The "manifests" field is required, even if it is empty.
+		manifests = []ispec.Descriptor{}
+	}
+
+	index := ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType:   mediaType,
+		Manifests:   manifests,
+		Annotations: annotations,
+	}
+	indexDigest, indexSize, err := e.PutBlobJSON(ctx, index)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("put index blob: %w", err)
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}, nil
+}
+
+// SetIndexCreated sets the "org.opencontainers.image.created" annotation of
+// the top-level index, as well as of every descriptor in the index, to the
+// given time (in RFC 3339 format). Any existing values are overwritten, so
+// that the result only depends on the provided time (such as one derived from
+// SOURCE_DATE_EPOCH) and not on when the index entries were first created.
+func (e Engine) SetIndexCreated(ctx context.Context, created time.Time) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return fmt.Errorf("get top-level index: %w", err)
+	}
+
+	value := created.UTC().Format(time.RFC3339)
+	index.Annotations = withAnnotation(index.Annotations, ispec.AnnotationCreated, value)
+	for idx, descriptor := range index.Manifests {
+		index.Manifests[idx].Annotations = withAnnotation(descriptor.Annotations, ispec.AnnotationCreated, value)
+	}
+
+	if err := e.PutIndex(ctx, index); err != nil {
+		return fmt.Errorf("replace index: %w", err)
+	}
+	return nil
+}
+
+// withAnnotation returns a copy of the given annotations with key set to
+// value. The original map is not modified, as it may be shared.
+func withAnnotation(annotations map[string]string, key, value string) map[string]string {
+	newAnnotations := map[string]string{}
+	for k, v := range annotations {
+		newAnnotations[k] = v
+	}
+	newAnnotations[key] = value
+	return newAnnotations
+}
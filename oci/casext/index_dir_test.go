@@ -0,0 +1,218 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+)
+
+func TestEngineSetIndexCreated(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSetIndexCreated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("fakeSetupEngine generated too few descriptors: %d", len(descMap))
+	}
+	for idx, name := range []string{"a", "b"} {
+		if err := engineExt.UpdateReference(ctx, name, descMap[idx].index); err != nil {
+			t.Fatalf("UpdateReference: unexpected error: %+v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		created  time.Time
+		expected string
+	}{
+		// A SOURCE_DATE_EPOCH-style time.
+		{time.Unix(1700000000, 0), "2023-11-14T22:13:20Z"},
+		// Times are always stored in UTC.
+		{time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC+10", 10*60*60)), "2020-01-01T17:04:05Z"},
+	} {
+		if err := engineExt.SetIndexCreated(ctx, test.created); err != nil {
+			t.Fatalf("SetIndexCreated: unexpected error: %+v", err)
+		}
+
+		index, err := engineExt.GetIndex(ctx)
+		if err != nil {
+			t.Fatalf("GetIndex: unexpected error: %+v", err)
+		}
+		if got := index.Annotations[ispec.AnnotationCreated]; got != test.expected {
+			t.Errorf("index created annotation: expected %q got %q", test.expected, got)
+		}
+		if len(index.Manifests) != 2 {
+			t.Fatalf("unexpected number of index entries: %d", len(index.Manifests))
+		}
+		for _, descriptor := range index.Manifests {
+			if got := descriptor.Annotations[ispec.AnnotationCreated]; got != test.expected {
+				t.Errorf("index entry %s created annotation: expected %q got %q", descriptor.Digest, test.expected, got)
+			}
+			// Other annotations must be left alone.
+			if descriptor.Annotations[ispec.AnnotationRefName] == "" {
+				t.Errorf("index entry %s lost its reference name annotation", descriptor.Digest)
+			}
+		}
+	}
+}
+
+func TestEngineCreateIndex(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineCreateIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("fakeSetupEngine generated too few descriptors: %d", len(descMap))
+	}
+	entries := []ispec.Descriptor{descMap[0].result, descMap[1].result}
+
+	for _, test := range []struct {
+		name, mediaType, expected string
+	}{
+		{"default", "", ispec.MediaTypeImageIndex},
+		{"oci", ispec.MediaTypeImageIndex, ispec.MediaTypeImageIndex},
+		{"docker", mediatype.DockerManifestList, mediatype.DockerManifestList},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			descriptor, err := engineExt.CreateIndex(ctx, test.mediaType, entries, nil)
+			if err != nil {
+				t.Fatalf("CreateIndex: unexpected error: %+v", err)
+			}
+			if descriptor.MediaType != test.expected {
+				t.Errorf("CreateIndex: expected media-type %q got %q", test.expected, descriptor.MediaType)
+			}
+
+			// The blob must parse as an index with a matching media-type.
+			blob, err := engineExt.FromDescriptor(ctx, descriptor)
+			if err != nil {
+				t.Fatalf("FromDescriptor: unexpected error: %+v", err)
+			}
+			defer blob.Close()
+			index, ok := blob.Data.(ispec.Index)
+			if !ok {
+				t.Fatalf("FromDescriptor: expected ispec.Index got %T", blob.Data)
+			}
+			if index.MediaType != test.expected {
+				t.Errorf("index blob: expected media-type %q got %q", test.expected, index.MediaType)
+			}
+			if index.SchemaVersion != 2 {
+				t.Errorf("index blob: expected schemaVersion 2 got %d", index.SchemaVersion)
+			}
+			if !reflect.DeepEqual(index.Manifests, entries) {
+				t.Errorf("index blob: unexpected entries: expected %+v got %+v", entries, index.Manifests)
+			}
+
+			// References to the index must resolve through to the entries.
+			name := "index-" + test.name
+			if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+				t.Fatalf("UpdateReference: unexpected error: %+v", err)
+			}
+			descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+			if err != nil {
+				t.Fatalf("ResolveReference: unexpected error: %+v", err)
+			}
+			if len(descriptorPaths) != len(entries) {
+				t.Fatalf("ResolveReference: expected %d paths got %d: %+v", len(entries), len(descriptorPaths), descriptorPaths)
+			}
+			for idx, path := range descriptorPaths {
+				if got := path.Root(); got.Digest != descriptor.Digest || got.MediaType != descriptor.MediaType {
+					t.Errorf("ResolveReference: path %d has unexpected root: %+v", idx, got)
+				}
+				if got := path.Descriptor(); !reflect.DeepEqual(got, entries[idx]) {
+					t.Errorf("ResolveReference: path %d: expected %+v got %+v", idx, entries[idx], got)
+				}
+			}
+		})
+	}
+
+	// Docker manifest lists cannot hold annotations.
+	if _, err := engineExt.CreateIndex(ctx, mediatype.DockerManifestList, entries, map[string]string{"foo": "bar"}); err == nil {
+		t.Errorf("CreateIndex: expected error with annotations on a docker manifest list")
+	}
+	// Unknown media-types are rejected.
+	if _, err := engineExt.CreateIndex(ctx, ispec.MediaTypeImageManifest, entries, nil); err == nil {
+		t.Errorf("CreateIndex: expected error with non-index media-type")
+	}
+
+	// Everything reachable from either index must survive a GC.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	for _, name := range []string{"index-oci", "index-docker"} {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+		if err != nil {
+			t.Fatalf("ResolveReference after GC: unexpected error: %+v", err)
+		}
+		for _, path := range descriptorPaths {
+			if err := engineExt.Walk(ctx, path.Descriptor(), func(descriptorPath DescriptorPath) error {
+				return nil
+			}); err != nil {
+				t.Errorf("Walk %s after GC: unexpected error: %+v", name, err)
+			}
+		}
+	}
+}
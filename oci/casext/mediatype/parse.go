@@ -155,7 +155,20 @@ func JSONParser[T any](rdr io.Reader) (_ interface{}, err error) {
 	return v, err
 }
 
-func indexParser(rdr io.Reader) (interface{}, error) {
+// DockerManifestList is the media-type of a Docker (image manifest v2, schema
+// 2) manifest list. Manifest lists are structurally identical to OCI image
+// indexes (which were derived from them), and so are parsed as ispec.Index.
+const DockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// indexParser returns a ParseFunc for index-like blobs with the given
+// media-type (either an OCI image index or a Docker manifest list).
+func indexParser(mediaType string) ParseFunc {
+	return func(rdr io.Reader) (interface{}, error) {
+		return parseIndex(mediaType, rdr)
+	}
+}
+
+func parseIndex(mediaType string, rdr io.Reader) (interface{}, error) {
 	// Construct a fake struct which contains fields that shouldn't exist, to
 	// detect images that have maliciously-inserted fields. CVE-2021-41190
 	var index struct {
@@ -170,7 +183,7 @@ func indexParser(rdr io.Reader) (interface{}, error) {
 	if err := json.NewDecoder(rdr).Decode(&index); err != nil {
 		return nil, err
 	}
-	if index.MediaType != "" && index.MediaType != ispec.MediaTypeImageIndex {
+	if index.MediaType != "" && index.MediaType != mediaType {
 		return nil, fmt.Errorf("malicious image detected: index contained incorrect mediaType: %s", index.MediaType)
 	}
 	if len(index.Config) != 0 {
@@ -208,7 +221,8 @@ func manifestParser(rdr io.Reader) (interface{}, error) {
 // Register the core image-spec types.
 func init() {
 	RegisterParser(ispec.MediaTypeDescriptor, JSONParser[ispec.Descriptor])
-	RegisterParser(ispec.MediaTypeImageIndex, indexParser)
+	RegisterParser(ispec.MediaTypeImageIndex, indexParser(ispec.MediaTypeImageIndex))
+	RegisterParser(DockerManifestList, indexParser(DockerManifestList))
 	RegisterParser(ispec.MediaTypeImageConfig, JSONParser[ispec.Image])
 
 	RegisterTarget(ispec.MediaTypeImageManifest)
@@ -0,0 +1,145 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+)
+
+// FormatPlatform returns the "os/arch[/variant]" form of platform.
+func FormatPlatform(platform ispec.Platform) string {
+	str := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		str += "/" + platform.Variant
+	}
+	return str
+}
+
+// ParsePlatform parses a platform of the form "os/arch[/variant]".
+func ParsePlatform(str string) (ispec.Platform, error) {
+	parts := strings.Split(str, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, fmt.Errorf("invalid platform %q: must be of the form os/arch[/variant]", str)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, fmt.Errorf("invalid platform %q: empty component", str)
+		}
+	}
+	platform := ispec.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// platformMatches returns whether have satisfies the requested platform. The
+// variant is only compared if one was requested.
+func platformMatches(want, have ispec.Platform) bool {
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return false
+	}
+	return want.Variant == "" || want.Variant == have.Variant
+}
+
+// manifestPlatform returns the platform of the manifest referenced by
+// descriptorPath. This is the platform in the descriptor path if there is
+// one, otherwise the platform is taken from the image configuration (or nil
+// if the manifest isn't an image manifest).
+func (e Engine) manifestPlatform(ctx context.Context, descriptorPath DescriptorPath) (*ispec.Platform, error) {
+	if platform := descriptorPath.Platform(); platform != nil {
+		return platform, nil
+	}
+
+	manifestBlob, err := e.FromDescriptor(ctx, descriptorPath.Descriptor())
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return nil, nil
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, fmt.Errorf("get config: %w", err)
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, nil
+	}
+	return &config.Platform, nil
+}
+
+// ResolvePlatform walks the index tree rooted at descriptor and returns the
+// path to the single manifest for the given platform. The platform of each
+// manifest is taken from the descriptors in its path (falling back to the
+// image configuration if none of them specify a platform). If platform has no
+// variant, manifests with any variant match. An error is returned if no
+// manifest (or more than one manifest) matches.
+func (e Engine) ResolvePlatform(ctx context.Context, descriptor ispec.Descriptor, platform ispec.Platform) (DescriptorPath, error) {
+	var (
+		matches   []DescriptorPath
+		available []string
+	)
+	if err := e.Walk(ctx, descriptor, func(descriptorPath DescriptorPath) error {
+		if !mediatype.IsTarget(descriptorPath.Descriptor().MediaType) {
+			return nil
+		}
+		have, err := e.manifestPlatform(ctx, descriptorPath)
+		if err != nil {
+			return err
+		}
+		if have == nil {
+			available = append(available, "<unknown>")
+		} else {
+			available = append(available, FormatPlatform(*have))
+			if platformMatches(platform, *have) {
+				matches = append(matches, descriptorPath)
+			}
+		}
+		return ErrSkipDescriptor
+	}); err != nil {
+		return DescriptorPath{}, fmt.Errorf("walk %s: %w", descriptor.Digest, err)
+	}
+
+	switch len(matches) {
+	case 0:
+		return DescriptorPath{}, fmt.Errorf("no manifest matches platform %s (available platforms: %s)", FormatPlatform(platform), strings.Join(available, ", "))
+	case 1:
+		log.Debugf("casext.ResolvePlatform(%s) selected manifest %s", FormatPlatform(platform), matches[0].Descriptor().Digest)
+		return matches[0], nil
+	default:
+		var digests []string
+		for _, match := range matches {
+			digests = append(digests, match.Descriptor().Digest.String())
+		}
+		return DescriptorPath{}, fmt.Errorf("platform %s is ambiguous: matched %d manifests (%s)", FormatPlatform(platform), len(matches), strings.Join(digests, ", "))
+	}
+}
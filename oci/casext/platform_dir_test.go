@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestEngineResolvePlatform(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineResolvePlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engineExt.Close()
+
+	putManifest := func(config string, platform *ispec.Platform) ispec.Descriptor {
+		configDigest, configSize, err := engineExt.PutBlob(ctx, bytes.NewBufferString(config))
+		if err != nil {
+			t.Fatalf("unexpected error putting config blob: %+v", err)
+		}
+		manifest := ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest blob: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+			Platform:  platform,
+		}
+	}
+
+	amd64 := putManifest(`{"os":"linux","architecture":"amd64"}`, &ispec.Platform{OS: "linux", Architecture: "amd64"})
+	arm64 := putManifest(`{"os":"linux","architecture":"arm64"}`, &ispec.Platform{OS: "linux", Architecture: "arm64"})
+	armv6 := putManifest(`{"os":"linux","architecture":"arm","variant":"v6"}`, &ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"})
+	armv7 := putManifest(`{"os":"linux","architecture":"arm","variant":"v7"}`, &ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	index, err := engineExt.CreateIndex(ctx, "", []ispec.Descriptor{amd64, arm64, armv6, armv7}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating index: %+v", err)
+	}
+	// A manifest without a platform in its descriptor.
+	plain := putManifest(`{"os":"linux","architecture":"riscv64"}`, nil)
+
+	for _, test := range []struct {
+		name     string
+		root     ispec.Descriptor
+		platform ispec.Platform
+		expected *ispec.Descriptor
+		errMsg   string
+	}{
+		{"IndexAmd64", index, ispec.Platform{OS: "linux", Architecture: "amd64"}, &amd64, ""},
+		{"IndexArm64", index, ispec.Platform{OS: "linux", Architecture: "arm64"}, &arm64, ""},
+		{"IndexVariant", index, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, &armv7, ""},
+		{"IndexAmbiguous", index, ispec.Platform{OS: "linux", Architecture: "arm"}, nil, "ambiguous"},
+		{"IndexMissing", index, ispec.Platform{OS: "linux", Architecture: "s390x"}, nil, "no manifest matches platform linux/s390x"},
+		{"IndexWrongOS", index, ispec.Platform{OS: "windows", Architecture: "amd64"}, nil, "no manifest matches"},
+		{"ManifestConfig", plain, ispec.Platform{OS: "linux", Architecture: "riscv64"}, &plain, ""},
+		{"ManifestConfigMismatch", plain, ispec.Platform{OS: "linux", Architecture: "amd64"}, nil, "available platforms: linux/riscv64"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			descriptorPath, err := engineExt.ResolvePlatform(ctx, test.root, test.platform)
+			if test.expected == nil {
+				if err == nil {
+					t.Fatalf("expected error resolving %s, got %s", FormatPlatform(test.platform), descriptorPath.Descriptor().Digest)
+				}
+				if !strings.Contains(err.Error(), test.errMsg) {
+					t.Errorf("unexpected error resolving %s: %v", FormatPlatform(test.platform), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error resolving %s: %+v", FormatPlatform(test.platform), err)
+			}
+			if got := descriptorPath.Descriptor().Digest; got != test.expected.Digest {
+				t.Errorf("resolved the wrong manifest for %s: expected %s got %s", FormatPlatform(test.platform), test.expected.Digest, got)
+			}
+			if descriptorPath.Walk[0].Digest != test.root.Digest {
+				t.Errorf("resolved path does not start at the root: %+v", descriptorPath.Walk)
+			}
+		})
+	}
+}
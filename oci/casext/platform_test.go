@@ -0,0 +1,58 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, test := range []struct {
+		str      string
+		platform ispec.Platform
+		valid    bool
+	}{
+		{"linux/amd64", ispec.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"linux/arm/v7", ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"windows/amd64", ispec.Platform{OS: "windows", Architecture: "amd64"}, true},
+		{"", ispec.Platform{}, false},
+		{"linux", ispec.Platform{}, false},
+		{"linux/", ispec.Platform{}, false},
+		{"/amd64", ispec.Platform{}, false},
+		{"linux/arm/", ispec.Platform{}, false},
+		{"linux/arm/v7/extra", ispec.Platform{}, false},
+	} {
+		platform, err := ParsePlatform(test.str)
+		if (err == nil) != test.valid {
+			t.Errorf("ParsePlatform(%q): expected valid=%v, got err=%v", test.str, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if !reflect.DeepEqual(platform, test.platform) {
+			t.Errorf("ParsePlatform(%q): expected %+v got %+v", test.str, test.platform, platform)
+		}
+		if str := FormatPlatform(platform); str != test.str {
+			t.Errorf("FormatPlatform(%+v): expected %q got %q", platform, test.str, str)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrerArtifactType returns the artifact type of the given manifest, as
+// defined by the referrers API of the OCI distribution-spec. This is the
+// manifest's artifactType or (if it is not set) the media-type of its config.
+func referrerArtifactType(manifest ispec.Manifest) string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+	return manifest.Config.MediaType
+}
+
+// ListReferrers returns descriptors for all of the image manifests reachable
+// from the top-level index whose subject refers to the given descriptor
+// (which is matched by digest). If artifactType is not empty, only referrers
+// of that artifact type are returned. Each returned descriptor has its
+// ArtifactType and Annotations filled from the referrer manifest, in the same
+// way as the referrers API of the OCI distribution-spec. Each referrer is only
+// returned once, even if it is reachable through several paths.
+func (e Engine) ListReferrers(ctx context.Context, subject ispec.Descriptor, artifactType string) ([]ispec.Descriptor, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get top-level index: %w", err)
+	}
+
+	seen := map[digest.Digest]struct{}{}
+	var referrers []ispec.Descriptor
+	for _, root := range index.Manifests {
+		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := seen[descriptor.Digest]; ok {
+				return ErrSkipDescriptor
+			}
+			seen[descriptor.Digest] = struct{}{}
+			if descriptor.MediaType != ispec.MediaTypeImageManifest {
+				return nil
+			}
+
+			blob, err := e.FromDescriptor(ctx, descriptor)
+			if err != nil {
+				return fmt.Errorf("get manifest %s: %w", descriptor.Digest, err)
+			}
+			defer blob.Close()
+			manifest, ok := blob.Data.(ispec.Manifest)
+			if !ok {
+				// Should _never_ be reached.
+				return fmt.Errorf("[internal error] unknown manifest blob type: %s", blob.Descriptor.MediaType)
+			}
+
+			if manifest.Subject != nil && manifest.Subject.Digest == subject.Digest {
+				referrer := ispec.Descriptor{
+					MediaType:    descriptor.MediaType,
+					Digest:       descriptor.Digest,
+					Size:         descriptor.Size,
+					ArtifactType: referrerArtifactType(manifest),
+					Annotations:  manifest.Annotations,
+				}
+				if artifactType == "" || referrer.ArtifactType == artifactType {
+					referrers = append(referrers, referrer)
+				}
+			}
+			// Referrers are themselves reachable from the top-level index, so
+			// there is no need to walk into the config, layers or subject of
+			// the manifest.
+			return ErrSkipDescriptor
+		}); err != nil {
+			return nil, fmt.Errorf("walk %s: %w", root.Digest, err)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"referrers": referrers,
+	}).Debugf("casext.ListReferrers(%s) got these descriptors", subject.Digest)
+	return referrers, nil
+}
+
+// RemoveReferrers removes all of the referrers of the given descriptor (as
+// returned by ListReferrers with the same arguments) from the top-level index,
+// and returns the descriptors of the removed referrers. Every top-level index
+// entry which refers to one of the referrers is removed, regardless of its
+// reference name. If a referrer would still be reachable afterwards (because
+// it is also referenced by a nested index) an error is returned and the index
+// is not modified, as nested indexes are never rewritten. The blobs of the
+// removed referrers are not deleted until the next GC.
+func (e Engine) RemoveReferrers(ctx context.Context, subject ispec.Descriptor, artifactType string) ([]ispec.Descriptor, error) {
+	referrers, err := e.ListReferrers(ctx, subject, artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("list referrers: %w", err)
+	}
+	if len(referrers) == 0 {
+		return nil, nil
+	}
+	remove := map[digest.Digest]struct{}{}
+	for _, referrer := range referrers {
+		remove[referrer.Digest] = struct{}{}
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get top-level index: %w", err)
+	}
+	var newManifests []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if _, ok := remove[descriptor.Digest]; !ok {
+			newManifests = append(newManifests, descriptor)
+		}
+	}
+
+	// Make sure none of the referrers are still reachable from the entries
+	// we are keeping.
+	for _, root := range newManifests {
+		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := remove[descriptor.Digest]; ok {
+				return fmt.Errorf("referrer %s is referenced by a nested index which cannot be modified", descriptor.Digest)
+			}
+			if descriptor.MediaType == ispec.MediaTypeImageManifest {
+				// Referrers are never reachable through an image manifest
+				// (not even through its subject), so there is no need to
+				// walk into it.
+				return ErrSkipDescriptor
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("walk %s: %w", root.Digest, err)
+		}
+	}
+
+	index.Manifests = newManifests
+	if err := e.PutIndex(ctx, index); err != nil {
+		return nil, fmt.Errorf("replace index: %w", err)
+	}
+	return referrers, nil
+}
@@ -0,0 +1,329 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestEngineListReferrers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineListReferrers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// Artifacts use the empty config blob.
+	if _, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("{}")); err != nil {
+		t.Fatalf("unexpected error putting empty blob: %+v", err)
+	}
+
+	// putManifest creates a manifest with the given subject, artifact type
+	// and config media-type.
+	putManifest := func(subject *ispec.Descriptor, artifactType, configType string, annotations map[string]string) ispec.Descriptor {
+		config := ispec.DescriptorEmptyJSON
+		config.MediaType = configType
+		manifest := ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType:    ispec.MediaTypeImageManifest,
+			ArtifactType: artifactType,
+			Config:       config,
+			Layers:       []ispec.Descriptor{ispec.DescriptorEmptyJSON},
+			Subject:      subject,
+			Annotations:  annotations,
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest blob: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+	}
+
+	subject := putManifest(nil, "application/vnd.example.image", ispec.MediaTypeEmptyJSON, nil)
+	other := putManifest(nil, "application/vnd.example.other", ispec.MediaTypeEmptyJSON, nil)
+	sbom := putManifest(&subject, "application/spdx+json", ispec.MediaTypeEmptyJSON, map[string]string{"example.sbom": "1"})
+	// The artifact type of this referrer is the config media-type.
+	signature := putManifest(&subject, "", "application/vnd.example.signature.config", nil)
+	unrelated := putManifest(&other, "application/spdx+json", ispec.MediaTypeEmptyJSON, nil)
+
+	// The signature is only reachable through a nested index, and the sbom
+	// is reachable twice.
+	nested, err := engineExt.CreateIndex(ctx, "", []ispec.Descriptor{signature, sbom}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating index: %+v", err)
+	}
+	for name, descriptor := range map[string]ispec.Descriptor{
+		"subject":   subject,
+		"other":     other,
+		"sbom":      sbom,
+		"nested":    nested,
+		"unrelated": unrelated,
+	} {
+		if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+			t.Fatalf("unexpected error adding reference %s: %+v", name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		name         string
+		subject      ispec.Descriptor
+		artifactType string
+		expected     []ispec.Descriptor
+	}{
+		{"All", subject, "", []ispec.Descriptor{sbom, signature}},
+		{"ArtifactType", subject, "application/spdx+json", []ispec.Descriptor{sbom}},
+		{"ConfigMediaType", subject, "application/vnd.example.signature.config", []ispec.Descriptor{signature}},
+		{"NoMatchingType", subject, "application/vnd.example.unknown", nil},
+		{"Other", other, "", []ispec.Descriptor{unrelated}},
+		{"NoReferrers", sbom, "", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			referrers, err := engineExt.ListReferrers(ctx, test.subject, test.artifactType)
+			if err != nil {
+				t.Fatalf("unexpected error listing referrers: %+v", err)
+			}
+			var got, want []digest.Digest
+			for _, referrer := range referrers {
+				got = append(got, referrer.Digest)
+			}
+			for _, descriptor := range test.expected {
+				want = append(want, descriptor.Digest)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+			if len(got) != len(want) {
+				t.Fatalf("unexpected referrers: expected %v got %v", want, got)
+			}
+			for idx := range got {
+				if got[idx] != want[idx] {
+					t.Errorf("unexpected referrers: expected %v got %v", want, got)
+					break
+				}
+			}
+		})
+	}
+
+	// The descriptors must have the artifact type and annotations of the
+	// referrer manifests.
+	referrers, err := engineExt.ListReferrers(ctx, subject, "application/spdx+json")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %+v", err)
+	}
+	if len(referrers) != 1 {
+		t.Fatalf("unexpected number of referrers: %d", len(referrers))
+	}
+	if referrers[0].ArtifactType != "application/spdx+json" {
+		t.Errorf("unexpected referrer artifact type: %q", referrers[0].ArtifactType)
+	}
+	if referrers[0].Annotations["example.sbom"] != "1" {
+		t.Errorf("unexpected referrer annotations: %v", referrers[0].Annotations)
+	}
+}
+
+func TestEngineRemoveReferrers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineRemoveReferrers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// Artifacts use the empty config blob.
+	if _, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("{}")); err != nil {
+		t.Fatalf("unexpected error putting empty blob: %+v", err)
+	}
+
+	// putArtifact creates an artifact manifest with the given subject and
+	// artifact type, with a single layer containing the given data.
+	putArtifact := func(subject *ispec.Descriptor, artifactType, data string) (ispec.Descriptor, ispec.Descriptor) {
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("unexpected error putting layer blob: %+v", err)
+		}
+		layer := ispec.Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}
+		manifest := ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType:    ispec.MediaTypeImageManifest,
+			ArtifactType: artifactType,
+			Config:       ispec.DescriptorEmptyJSON,
+			Layers:       []ispec.Descriptor{layer},
+			Subject:      subject,
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest blob: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}, layer
+	}
+
+	const (
+		notaryType = "application/vnd.cncf.notary.signature"
+		cosignType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	)
+
+	subject, subjectLayer := putArtifact(nil, "application/vnd.example.image", "image contents")
+	notary, notaryLayer := putArtifact(&subject, notaryType, "notary signature")
+	cosign, cosignLayer := putArtifact(&subject, cosignType, "cosign signature")
+	for name, descriptor := range map[string]ispec.Descriptor{
+		"subject": subject,
+		"notary":  notary,
+		"cosign":  cosign,
+	} {
+		if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+			t.Fatalf("unexpected error adding reference %s: %+v", name, err)
+		}
+	}
+	// A referrer can also be in the index more than once.
+	if err := engineExt.AddReference(ctx, "notary-copy", notary); err != nil {
+		t.Fatalf("unexpected error adding reference notary-copy: %+v", err)
+	}
+
+	// Removing a type without any referrers is a no-op.
+	removed, err := engineExt.RemoveReferrers(ctx, subject, "application/vnd.example.unknown")
+	if err != nil {
+		t.Fatalf("unexpected error removing referrers: %+v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("unexpected removed referrers: %v", removed)
+	}
+
+	removed, err = engineExt.RemoveReferrers(ctx, subject, notaryType)
+	if err != nil {
+		t.Fatalf("unexpected error removing referrers: %+v", err)
+	}
+	if len(removed) != 1 || removed[0].Digest != notary.Digest {
+		t.Fatalf("unexpected removed referrers: expected [%s] got %v", notary.Digest, removed)
+	}
+
+	// Only the notary signature must have been removed from the index.
+	refs, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	}
+	sort.Strings(refs)
+	if len(refs) != 2 || refs[0] != "cosign" || refs[1] != "subject" {
+		t.Errorf("unexpected references after removal: %v", refs)
+	}
+	referrers, err := engineExt.ListReferrers(ctx, subject, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %+v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != cosign.Digest {
+		t.Errorf("unexpected referrers after removal: expected [%s] got %v", cosign.Digest, referrers)
+	}
+
+	// After a GC only the unique blobs of the notary signature are gone.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("unexpected error during GC: %+v", err)
+	}
+	for _, test := range []struct {
+		name   string
+		digest digest.Digest
+		exists bool
+	}{
+		{"NotaryManifest", notary.Digest, false},
+		{"NotaryLayer", notaryLayer.Digest, false},
+		{"CosignManifest", cosign.Digest, true},
+		{"CosignLayer", cosignLayer.Digest, true},
+		{"SubjectManifest", subject.Digest, true},
+		{"SubjectLayer", subjectLayer.Digest, true},
+		{"SharedConfig", ispec.DescriptorEmptyJSON.Digest, true},
+	} {
+		exists, err := engineExt.StatBlob(ctx, test.digest)
+		if err != nil {
+			t.Fatalf("unexpected error stating blob %s: %+v", test.digest, err)
+		}
+		if exists != test.exists {
+			t.Errorf("%s: unexpected blob existence for %s: expected %v got %v", test.name, test.digest, test.exists, exists)
+		}
+	}
+
+	// Referrers which are referenced by a nested index cannot be removed, and
+	// the index must not be modified.
+	nested, err := engineExt.CreateIndex(ctx, "", []ispec.Descriptor{cosign}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating index: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "nested", nested); err != nil {
+		t.Fatalf("unexpected error adding reference nested: %+v", err)
+	}
+	if _, err := engineExt.RemoveReferrers(ctx, subject, cosignType); err == nil {
+		t.Errorf("expected an error removing a referrer referenced by a nested index")
+	}
+	refs, err = engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing references: %+v", err)
+	}
+	if len(refs) != 3 {
+		t.Errorf("index was modified after a failed removal: %v", refs)
+	}
+}
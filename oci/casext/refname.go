@@ -19,11 +19,14 @@ package casext
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext/mediatype"
 )
 
@@ -44,6 +47,60 @@ func IsValidReferenceName(refname string) bool {
 	return refnameRegex.MatchString(refname)
 }
 
+// UmociOriginalRefNameAnnotation is set on index entries whose reference name
+// was produced by SanitizeReferenceName, and contains the original (invalid)
+// reference name.
+const UmociOriginalRefNameAnnotation = "ci.umo.original_ref_name"
+
+// refnameSeparatorRegex matches a single valid refname separator.
+var refnameSeparatorRegex = regexp.MustCompile(`^([-._:@+]|--)$`)
+
+func isRefnameAlphanum(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
+
+// SanitizeReferenceName converts an arbitrary reference name (such as a tag
+// containing characters that are permitted by other tools but not by the OCI
+// specification) into a valid reference name. Runs of characters which are
+// not a valid separator are replaced with "_", and leading or trailing
+// separators (as well as empty components) are dropped. Valid reference names
+// are returned unchanged. An error is returned if refname contains no
+// alphanumeric characters.
+func SanitizeReferenceName(refname string) (string, error) {
+	var components []string
+	for _, component := range strings.Split(refname, "/") {
+		var newComponent, separator strings.Builder
+		for _, r := range component {
+			if !isRefnameAlphanum(r) {
+				separator.WriteRune(r)
+				continue
+			}
+			if newComponent.Len() > 0 && separator.Len() > 0 {
+				if sep := separator.String(); refnameSeparatorRegex.MatchString(sep) {
+					newComponent.WriteString(sep)
+				} else {
+					newComponent.WriteString("_")
+				}
+			}
+			separator.Reset()
+			newComponent.WriteRune(r)
+		}
+		if newComponent.Len() > 0 {
+			components = append(components, newComponent.String())
+		}
+	}
+
+	sanitized := strings.Join(components, "/")
+	if sanitized == "" {
+		return "", fmt.Errorf("cannot sanitize reference %q: no alphanumeric characters", refname)
+	}
+	if !IsValidReferenceName(sanitized) {
+		// Should _never_ be reached.
+		return "", fmt.Errorf("[internal error] sanitized reference %q is invalid", sanitized)
+	}
+	return sanitized, nil
+}
+
 // ResolveReference will attempt to resolve all possible descriptor paths to
 // Manifests (or any unknown blobs) that match a particular reference name (if
 // descriptors are stored in non-standard blobs, Resolve will be unable to find
@@ -158,6 +215,58 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 	return nil
 }
 
+// AddReference adds a new entry for refname with the given descriptor. Unlike
+// UpdateReference, if there is already an entry for refname an error wrapping
+// cas.ErrClobber is returned and the index is left unchanged.
+func (e Engine) AddReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	if !IsValidReferenceName(refname) {
+		return fmt.Errorf("refusing to add invalid reference %q", refname)
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return fmt.Errorf("get top-level index: %w", err)
+	}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+			return fmt.Errorf("add reference %q: %w", refname, cas.ErrClobber)
+		}
+	}
+	return e.UpdateReference(ctx, refname, descriptor)
+}
+
+// SetOriginalReferenceName records original as the original name of every
+// entry for refname in the index (using UmociOriginalRefNameAnnotation). This
+// is intended to be used after storing a reference whose name was produced by
+// SanitizeReferenceName.
+func (e Engine) SetOriginalReferenceName(ctx context.Context, refname, original string) error {
+	if !IsValidReferenceName(refname) {
+		return fmt.Errorf("refusing to annotate invalid reference %q", refname)
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return fmt.Errorf("get top-level index: %w", err)
+	}
+
+	var found bool
+	for idx, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
+			continue
+		}
+		index.Manifests[idx].Annotations = withAnnotation(descriptor.Annotations, UmociOriginalRefNameAnnotation, original)
+		found = true
+	}
+	if !found {
+		return errors.New("reference not found: " + refname)
+	}
+
+	if err := e.PutIndex(ctx, index); err != nil {
+		return fmt.Errorf("replace index: %w", err)
+	}
+	return nil
+}
+
 // DeleteReference removes all entries in the index that match the given
 // refname.
 func (e Engine) DeleteReference(ctx context.Context, refname string) error {
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -36,6 +37,7 @@ import (
 	"github.com/opencontainers/go-digest"
 	ispecs "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	"github.com/opencontainers/umoci/pkg/testutils"
@@ -131,10 +133,12 @@ func fakeSetupEngine(t *testing.T, engineExt Engine) ([]descriptorMap, error) {
 		// Create our config and insert it.
 		created := time.Now()
 		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
-			Created:      &created,
-			Author:       "Jane Author <janesmith@example.com>",
-			Architecture: runtime.GOARCH,
-			OS:           runtime.GOOS,
+			Created: &created,
+			Author:  "Jane Author <janesmith@example.com>",
+			Platform: ispec.Platform{
+				Architecture: runtime.GOARCH,
+				OS:           runtime.GOOS,
+			},
 			RootFS: ispec.RootFS{
 				Type: "unknown",
 			},
@@ -417,6 +421,143 @@ func TestEngineReference(t *testing.T) {
 	}
 }
 
+func TestEngineAddReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineAddReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("fakeSetupEngine generated too few descriptors: %d", len(descMap))
+	}
+
+	const name = "new_tag"
+	if err := engineExt.AddReference(ctx, name, descMap[0].index); err != nil {
+		t.Fatalf("AddReference: unexpected error: %+v", err)
+	}
+
+	// Adding the same reference again must fail without modifying it.
+	if err := engineExt.AddReference(ctx, name, descMap[1].index); !errors.Is(err, cas.ErrClobber) {
+		t.Errorf("AddReference: expected cas.ErrClobber when clobbering, got %+v", err)
+	}
+	gotDescriptorPaths, err := engineExt.ResolveReference(ctx, name)
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(gotDescriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: expected %q to get %d descriptors, got %d: %+v", name, 1, len(gotDescriptorPaths), gotDescriptorPaths)
+	}
+	if gotDescriptor := gotDescriptorPaths[0].Descriptor(); !reflect.DeepEqual(descMap[0].result, gotDescriptor) {
+		t.Errorf("ResolveReference: reference was modified by failed AddReference: expected=%v got=%v", descMap[0].result, gotDescriptor)
+	}
+
+	// Invalid references are rejected.
+	if err := engineExt.AddReference(ctx, "/invalid", descMap[0].index); err == nil {
+		t.Errorf("AddReference: expected error with invalid reference name")
+	}
+}
+
+func TestEngineSetOriginalReferenceName(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSetOriginalReferenceName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 1 {
+		t.Fatalf("fakeSetupEngine generated too few descriptors: %d", len(descMap))
+	}
+
+	// An invalid (docker-style) tag can only be stored once sanitized.
+	const original = "v1.0~rc1"
+	if err := engineExt.UpdateReference(ctx, original, descMap[0].index); err == nil {
+		t.Errorf("UpdateReference: expected error with invalid reference name")
+	}
+	name, err := SanitizeReferenceName(original)
+	if err != nil {
+		t.Fatalf("SanitizeReferenceName: unexpected error: %+v", err)
+	}
+
+	// Annotating a missing reference fails.
+	if err := engineExt.SetOriginalReferenceName(ctx, name, original); err == nil {
+		t.Errorf("SetOriginalReferenceName: expected error with missing reference")
+	}
+
+	if err := engineExt.UpdateReference(ctx, name, descMap[0].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.SetOriginalReferenceName(ctx, name, original); err != nil {
+		t.Fatalf("SetOriginalReferenceName: unexpected error: %+v", err)
+	}
+
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	var found int
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] != name {
+			continue
+		}
+		found++
+		if got := descriptor.Annotations[UmociOriginalRefNameAnnotation]; got != original {
+			t.Errorf("original reference name annotation: expected %q got %q", original, got)
+		}
+	}
+	if found != 1 {
+		t.Errorf("expected exactly one index entry for %q, got %d", name, found)
+	}
+
+	// The sanitized reference still resolves to the same descriptor.
+	gotDescriptorPaths, err := engineExt.ResolveReference(ctx, name)
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(gotDescriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: expected %q to get %d descriptors, got %d: %+v", name, 1, len(gotDescriptorPaths), gotDescriptorPaths)
+	}
+	if gotDescriptor := gotDescriptorPaths[0].Descriptor(); gotDescriptor.Digest != descMap[0].result.Digest {
+		t.Errorf("ResolveReference: got different descriptor to original: expected=%v got=%v", descMap[0].result, gotDescriptor)
+	}
+}
+
 func TestEngineReferenceReadonly(t *testing.T) {
 	ctx := context.Background()
 
@@ -63,3 +63,53 @@ func TestValidateRefname(t *testing.T) {
 		}
 	}
 }
+
+func TestSanitizeReferenceName(t *testing.T) {
+	for _, test := range []struct {
+		refname   string
+		sanitized string
+		err       bool
+	}{
+		// Valid names are left alone.
+		{"latest", "latest", false},
+		{"v1.3.1+dev", "v1.3.1+dev", false},
+		{"A/1--2.C+9@e_4/3", "A/1--2.C+9@e_4/3", false},
+		// Invalid characters are replaced.
+		{"my tag", "my_tag", false},
+		{"v1.0~rc1", "v1.0_rc1", false},
+		{"release#42", "release_42", false},
+		{"a__b", "a_b", false},
+		{"a..b", "a_b", false},
+		{"a-.-b", "a_b", false},
+		{"caf\u00e9/bar", "caf/bar", false},
+		// Leading and trailing separators are dropped.
+		{"-latest", "latest", false},
+		{"latest.", "latest", false},
+		{"/a/b/", "a/b", false},
+		// Empty components are dropped.
+		{"some//test/hello", "some/test/hello", false},
+		{"a/--/b", "a/b", false},
+		// Nothing salvageable.
+		{"", "", true},
+		{"---", "", true},
+		{"/!/", "", true},
+	} {
+		sanitized, err := SanitizeReferenceName(test.refname)
+		if test.err {
+			if err == nil {
+				t.Errorf("SanitizeReferenceName(%q): expected error, got %q", test.refname, sanitized)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SanitizeReferenceName(%q): unexpected error: %+v", test.refname, err)
+			continue
+		}
+		if sanitized != test.sanitized {
+			t.Errorf("SanitizeReferenceName(%q): expected %q got %q", test.refname, test.sanitized, sanitized)
+		}
+		if !IsValidReferenceName(sanitized) {
+			t.Errorf("SanitizeReferenceName(%q): result %q is not a valid reference name", test.refname, sanitized)
+		}
+	}
+}
@@ -87,6 +87,19 @@ func (d DescriptorPath) Descriptor() ispec.Descriptor {
 	return d.Walk[len(d.Walk)-1]
 }
 
+// Platform returns the platform of the target descriptor. With nested indexes
+// the platform may only be specified by the descriptor of one of the
+// enclosing indexes, so this is the platform of the last descriptor in the
+// walk which has one (or nil if no descriptor in the walk has a platform).
+func (d DescriptorPath) Platform() *ispec.Platform {
+	for idx := len(d.Walk) - 1; idx >= 0; idx-- {
+		if platform := d.Walk[idx].Platform; platform != nil {
+			return platform
+		}
+	}
+	return nil
+}
+
 // ErrSkipDescriptor is a special error returned by WalkFunc which will cause
 // Walk to not recurse into the descriptor currently being evaluated by
 // WalkFunc. This interface is roughly equivalent to filepath.SkipDir.
@@ -151,10 +164,14 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 		}
 	}()
 
-	// Recurse into children.
+	// Recurse into children. Each child needs its own copy of the walk, as
+	// otherwise sibling paths (such as the entries of a nested index) could
+	// share the same backing array and overwrite each other.
 	for _, child := range childDescriptors(blob.Data) {
+		walk := make([]ispec.Descriptor, len(descriptorPath.Walk), len(descriptorPath.Walk)+1)
+		copy(walk, descriptorPath.Walk)
 		if err := ws.recurse(ctx, DescriptorPath{
-			Walk: append(descriptorPath.Walk, child),
+			Walk: append(walk, child),
 		}); err != nil {
 			return err
 		}
@@ -187,17 +204,31 @@ func (e Engine) Walk(ctx context.Context, root ispec.Descriptor, walkFunc WalkFu
 // want to use Walk directly).
 func (e Engine) reachable(ctx context.Context, root ispec.Descriptor) ([]digest.Digest, error) {
 	seen := map[digest.Digest]struct{}{}
+	// Blobs referenced by a descriptor's annotations (rather than by a
+	// descriptor) are tracked separately, as they are never walked into.
+	annotated := map[digest.Digest]struct{}{}
 	if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
-		digest := descriptorPath.Descriptor().Digest
-		if _, ok := seen[digest]; ok {
+		descriptor := descriptorPath.Descriptor()
+
+		// The same blob can be referenced by several descriptors with
+		// different annotations, so this must happen before we skip
+		// descriptors we've already seen.
+		for _, blob := range annotatedBlobs(descriptor) {
+			annotated[blob] = struct{}{}
+		}
+
+		if _, ok := seen[descriptor.Digest]; ok {
 			// Don't traverse further if we've already seen this digest.
 			return ErrSkipDescriptor
 		}
-		seen[digest] = struct{}{}
+		seen[descriptor.Digest] = struct{}{}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
+	for blob := range annotated {
+		seen[blob] = struct{}{}
+	}
 	var reachable []digest.Digest
 	for node := range seen {
 		reachable = append(reachable, node)
@@ -0,0 +1,227 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestEngineNestedIndex(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineNestedIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// All of the blobs which must be reachable from the tag.
+	blobs := map[digest.Digest]struct{}{}
+
+	// putManifest creates a (small) image for the given architecture.
+	putManifest := func(arch string) ispec.Descriptor {
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewBufferString("layer-"+arch))
+		if err != nil {
+			t.Fatalf("%s: error putting layer blob: %+v", arch, err)
+		}
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			Platform: ispec.Platform{
+				Architecture: arch,
+				OS:           "linux",
+			},
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: []digest.Digest{layerDigest},
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: error putting config blob: %+v", arch, err)
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    layerDigest,
+				Size:      layerSize,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("%s: error putting manifest blob: %+v", arch, err)
+		}
+		for _, d := range []digest.Digest{layerDigest, configDigest, manifestDigest} {
+			blobs[d] = struct{}{}
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+	}
+
+	// putIndex creates an index with the given entries.
+	putIndex := func(entries ...ispec.Descriptor) ispec.Descriptor {
+		desc, err := engineExt.CreateIndex(ctx, "", entries, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating index: %+v", err)
+		}
+		blobs[desc.Digest] = struct{}{}
+		return desc
+	}
+
+	// withPlatform returns a copy of desc with the given platform.
+	withPlatform := func(desc ispec.Descriptor, arch string) ispec.Descriptor {
+		desc.Platform = &ispec.Platform{OS: "linux", Architecture: arch}
+		return desc
+	}
+
+	manifests := map[string]ispec.Descriptor{}
+	for _, arch := range []string{"amd64", "arm64", "s390x", "ppc64le", "mips64le", "riscv64"} {
+		manifests[arch] = putManifest(arch)
+	}
+
+	// The tag refers to an index which contains two manifests as well as two
+	// nested indexes. The entries of the first nested index (which itself
+	// contains another nested index) have platforms, while the second nested
+	// index only has a platform on its own descriptor.
+	nestedDeeper := putIndex(
+		withPlatform(manifests["ppc64le"], "ppc64le"),
+		withPlatform(manifests["mips64le"], "mips64le"),
+	)
+	nestedPlatforms := putIndex(
+		withPlatform(manifests["s390x"], "s390x"),
+		nestedDeeper,
+	)
+	nestedNoPlatform := putIndex(manifests["riscv64"])
+	topIndex := putIndex(
+		withPlatform(manifests["amd64"], "amd64"),
+		withPlatform(manifests["arm64"], "arm64"),
+		nestedPlatforms,
+		withPlatform(nestedNoPlatform, "riscv64"),
+	)
+	if err := engineExt.UpdateReference(ctx, "nested", topIndex); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Resolution must find every manifest, each with its own walk.
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "nested")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptorPaths) != len(manifests) {
+		t.Fatalf("ResolveReference: expected %d paths, got %d: %+v", len(manifests), len(descriptorPaths), descriptorPaths)
+	}
+	for arch, expectedWalk := range map[string][]digest.Digest{
+		"amd64":    {topIndex.Digest, manifests["amd64"].Digest},
+		"arm64":    {topIndex.Digest, manifests["arm64"].Digest},
+		"s390x":    {topIndex.Digest, nestedPlatforms.Digest, manifests["s390x"].Digest},
+		"ppc64le":  {topIndex.Digest, nestedPlatforms.Digest, nestedDeeper.Digest, manifests["ppc64le"].Digest},
+		"mips64le": {topIndex.Digest, nestedPlatforms.Digest, nestedDeeper.Digest, manifests["mips64le"].Digest},
+		"riscv64":  {topIndex.Digest, nestedNoPlatform.Digest, manifests["riscv64"].Digest},
+	} {
+		// Platform selection must use the platform from the nested indexes.
+		var found []DescriptorPath
+		for _, descriptorPath := range descriptorPaths {
+			if platform := descriptorPath.Platform(); platform != nil && platform.Architecture == arch {
+				found = append(found, descriptorPath)
+			}
+		}
+		if len(found) != 1 {
+			t.Errorf("expected one path with platform %s, got %d: %+v", arch, len(found), found)
+			continue
+		}
+		descriptorPath := found[0]
+		if descriptorPath.Descriptor().Digest != manifests[arch].Digest {
+			t.Errorf("path with platform %s resolved to wrong manifest: expected %s got %s", arch, manifests[arch].Digest, descriptorPath.Descriptor().Digest)
+		}
+		var walk []digest.Digest
+		for _, descriptor := range descriptorPath.Walk {
+			walk = append(walk, descriptor.Digest)
+		}
+		if len(walk) != len(expectedWalk) {
+			t.Errorf("path with platform %s has wrong walk: expected %v got %v", arch, expectedWalk, walk)
+			continue
+		}
+		for idx := range walk {
+			if walk[idx] != expectedWalk[idx] {
+				t.Errorf("path with platform %s has wrong walk: expected %v got %v", arch, expectedWalk, walk)
+				break
+			}
+		}
+	}
+
+	// Every blob must be reachable through the nested indexes.
+	referenced, err := engineExt.ReferencedBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ReferencedBlobs: unexpected error: %+v", err)
+	}
+	for blob := range blobs {
+		if _, ok := referenced[blob]; !ok {
+			t.Errorf("blob %s not reachable from nested index", blob)
+		}
+	}
+	if len(referenced) != len(blobs) {
+		t.Errorf("unexpected number of reachable blobs: expected %d got %d", len(blobs), len(referenced))
+	}
+
+	// ... and so must survive garbage collection.
+	unreferenced, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("unreferenced"))
+	if err != nil {
+		t.Fatalf("unexpected error putting unreferenced blob: %+v", err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	for blob := range blobs {
+		if exists, err := engineExt.StatBlob(ctx, blob); err != nil || !exists {
+			t.Errorf("blob %s was garbage collected: %v", blob, err)
+		}
+	}
+	if exists, err := engineExt.StatBlob(ctx, unreferenced); err != nil || exists {
+		t.Errorf("unreferenced blob %s was not garbage collected: %v", unreferenced, err)
+	}
+}
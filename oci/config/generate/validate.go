@@ -0,0 +1,145 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// signalNames is the set of signal names (without the "SIG" prefix) which
+// are accepted as a StopSignal. Image configurations are not tied to the
+// platform umoci is running on, so this is a fixed list rather than whatever
+// the host happens to support.
+var signalNames = map[string]struct{}{
+	"ABRT": {}, "ALRM": {}, "BUS": {}, "CHLD": {}, "CLD": {}, "CONT": {},
+	"FPE": {}, "HUP": {}, "ILL": {}, "INT": {}, "IO": {}, "IOT": {},
+	"KILL": {}, "PIPE": {}, "POLL": {}, "PROF": {}, "PWR": {}, "QUIT": {},
+	"SEGV": {}, "STKFLT": {}, "STOP": {}, "SYS": {}, "TERM": {}, "TRAP": {},
+	"TSTP": {}, "TTIN": {}, "TTOU": {}, "URG": {}, "USR1": {}, "USR2": {},
+	"VTALRM": {}, "WINCH": {}, "XCPU": {}, "XFSZ": {},
+}
+
+// maxSignal is the largest numeric signal accepted as a StopSignal (the
+// largest real-time signal on Linux).
+const maxSignal = 64
+
+// validateStopSignal checks that the signal is either a signal number, a
+// signal name (with or without the "SIG" prefix) or a real-time signal of
+// the form "RTMIN+n" or "RTMAX-n".
+func validateStopSignal(signal string) error {
+	if num, err := strconv.Atoi(signal); err == nil {
+		if num < 1 || num > maxSignal {
+			return fmt.Errorf("signal number %d out of range", num)
+		}
+		return nil
+	}
+	name := strings.TrimPrefix(signal, "SIG")
+	if _, ok := signalNames[name]; ok {
+		return nil
+	}
+	for _, rt := range []struct{ prefix, sep string }{{"RTMIN", "+"}, {"RTMAX", "-"}} {
+		if !strings.HasPrefix(name, rt.prefix) {
+			continue
+		}
+		offset := strings.TrimPrefix(name, rt.prefix)
+		if offset == "" {
+			return nil
+		}
+		if !strings.HasPrefix(offset, rt.sep) {
+			break
+		}
+		if num, err := strconv.Atoi(offset[1:]); err == nil && num >= 0 && num <= maxSignal {
+			return nil
+		}
+	}
+	return errors.New("unknown signal")
+}
+
+// validateExposedPort checks that the port is of the form "port" or
+// "port/proto", where proto is one of "tcp", "udp" or "sctp".
+func validateExposedPort(port string) error {
+	num, proto := port, "tcp"
+	if idx := strings.Index(port, "/"); idx >= 0 {
+		num, proto = port[:idx], port[idx+1:]
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("unknown protocol %q", proto)
+	}
+	// Don't allow signs or leading whitespace, which Atoi would accept.
+	if num == "" || strings.TrimLeft(num, "0123456789") != "" {
+		return fmt.Errorf("port %q is not a number", num)
+	}
+	if n, err := strconv.Atoi(num); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port %q out of range", num)
+	}
+	return nil
+}
+
+// validateUser checks that the user is of the form "user", "uid",
+// "user:group", "uid:gid", "uid:group" or "user:gid".
+func validateUser(user string) error {
+	parts := strings.Split(user, ":")
+	if len(parts) > 2 {
+		return errors.New("too many ':' separators")
+	}
+	for _, part := range parts {
+		if part == "" {
+			return errors.New("empty user or group")
+		}
+		if strings.IndexFunc(part, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}) >= 0 {
+			return fmt.Errorf("user or group %q contains whitespace or control characters", part)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the image configuration conforms to the image-spec,
+// returning an error describing the first invalid field. Only fields with a
+// well-defined format are checked (StopSignal, ExposedPorts, User and Env).
+func (g *Generator) Validate() error {
+	config := g.image.Config
+	if config.StopSignal != "" {
+		if err := validateStopSignal(config.StopSignal); err != nil {
+			return fmt.Errorf("invalid stop signal %q: %w", config.StopSignal, err)
+		}
+	}
+	for _, port := range g.ConfigExposedPortsArray() {
+		if err := validateExposedPort(port); err != nil {
+			return fmt.Errorf("invalid exposed port %q: %w", port, err)
+		}
+	}
+	if config.User != "" {
+		if err := validateUser(config.User); err != nil {
+			return fmt.Errorf("invalid user %q: %w", config.User, err)
+		}
+	}
+	for _, env := range config.Env {
+		if idx := strings.Index(env, "="); idx <= 0 {
+			return fmt.Errorf("invalid environment variable %q: must be of the form NAME=value", env)
+		}
+	}
+	return nil
+}
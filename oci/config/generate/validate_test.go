@@ -0,0 +1,139 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"testing"
+)
+
+func TestValidateStopSignal(t *testing.T) {
+	for _, test := range []struct {
+		signal string
+		valid  bool
+	}{
+		{"", true},
+		{"SIGTERM", true},
+		{"TERM", true},
+		{"SIGUSR1", true},
+		{"9", true},
+		{"64", true},
+		{"SIGRTMIN", true},
+		{"SIGRTMIN+3", true},
+		{"RTMAX-1", true},
+		{"SIGFOO", false},
+		{"sigterm", false},
+		{"0", false},
+		{"65", false},
+		{"-9", false},
+		{"SIGRTMIN-3", false},
+		{"SIGRTMAX+1", false},
+		{"SIGRTMIN+", false},
+		{"SIG", false},
+	} {
+		g := New()
+		g.SetConfigStopSignal(test.signal)
+		err := g.Validate()
+		if test.valid && err != nil {
+			t.Errorf("expected stop signal %q to be valid, got %v", test.signal, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected stop signal %q to be invalid", test.signal)
+		}
+	}
+}
+
+func TestValidateExposedPorts(t *testing.T) {
+	for _, test := range []struct {
+		port  string
+		valid bool
+	}{
+		{"80", true},
+		{"8080/tcp", true},
+		{"53/udp", true},
+		{"9899/sctp", true},
+		{"65535/tcp", true},
+		{"", false},
+		{"/tcp", false},
+		{"0/tcp", false},
+		{"65536/tcp", false},
+		{"+80/tcp", false},
+		{"http/tcp", false},
+		{"80/icmp", false},
+		{"80/TCP", false},
+		{"80/", false},
+		{"8000-8010/tcp", false},
+		{"80/tcp/udp", false},
+	} {
+		g := New()
+		g.AddConfigExposedPort(test.port)
+		err := g.Validate()
+		if test.valid && err != nil {
+			t.Errorf("expected exposed port %q to be valid, got %v", test.port, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected exposed port %q to be invalid", test.port)
+		}
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	for _, test := range []struct {
+		user  string
+		valid bool
+	}{
+		{"", true},
+		{"root", true},
+		{"1000", true},
+		{"user:group", true},
+		{"1000:100", true},
+		{"1000:group", true},
+		{"user:100", true},
+		{":group", false},
+		{"user:", false},
+		{":", false},
+		{"a:b:c", false},
+		{"some user", false},
+		{"user\n", false},
+	} {
+		g := New()
+		g.SetConfigUser(test.user)
+		err := g.Validate()
+		if test.valid && err != nil {
+			t.Errorf("expected user %q to be valid, got %v", test.user, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected user %q to be invalid", test.user)
+		}
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	g := New()
+	g.AddConfigEnv("PATH", "/bin")
+	g.AddConfigEnv("EMPTY", "")
+	if err := g.Validate(); err != nil {
+		t.Errorf("expected environment to be valid, got %v", err)
+	}
+
+	image := g.Image()
+	image.Config.Env = append(image.Config.Env, "=value")
+	g, err := NewFromImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err == nil {
+		t.Errorf("expected environment with empty name to be invalid")
+	}
+}
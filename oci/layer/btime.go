@@ -0,0 +1,80 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paxBirthTime is the PAX record used to store the birth (creation) time of a
+// file. There is no standard record for this, so we use the same record as
+// libarchive (which stores it in the same format as the standard PAX time
+// records).
+const paxBirthTime = "LIBARCHIVE.creationtime"
+
+// formatPAXTime formats a time in the decimal seconds format used by PAX time
+// records, with trailing zeroes in the fractional part removed.
+func formatPAXTime(t time.Time) string {
+	secs, nsecs := t.Unix(), t.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+
+	// Negative times have the fractional part counting away from zero.
+	sign := ""
+	if secs < 0 {
+		sign = "-"
+		secs = -(secs + 1)
+		nsecs = -(nsecs - 1e9)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
+
+// parsePAXTime parses a time in the format produced by formatPAXTime. Any
+// precision beyond nanoseconds is discarded.
+func parsePAXTime(s string) (time.Time, error) {
+	ss, sn := s, ""
+	if pos := strings.IndexByte(s, '.'); pos >= 0 {
+		ss, sn = s[:pos], s[pos+1:]
+	}
+
+	secs, err := strconv.ParseInt(ss, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid pax time %q: %w", s, err)
+	}
+	if sn == "" {
+		return time.Unix(secs, 0), nil
+	}
+	if strings.Trim(sn, "0123456789") != "" {
+		return time.Time{}, fmt.Errorf("invalid pax time %q: bad fractional part", s)
+	}
+	if len(sn) < 9 {
+		sn += strings.Repeat("0", 9-len(sn))
+	}
+	nsecs, err := strconv.ParseInt(sn[:9], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid pax time %q: %w", s, err)
+	}
+	if strings.HasPrefix(ss, "-") {
+		return time.Unix(secs, -nsecs), nil
+	}
+	return time.Unix(secs, nsecs), nil
+}
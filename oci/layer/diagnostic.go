@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+)
+
+// DiagnosticCode identifies the class of a Diagnostic, so that callers can
+// check for specific kinds of problems without parsing messages.
+type DiagnosticCode string
+
+const (
+	// DiagnosticXattrForbidden indicates that an xattr was not applied
+	// because it is in the set of xattrs umoci never modifies (such as
+	// security.selinux).
+	DiagnosticXattrForbidden DiagnosticCode = "xattr-forbidden"
+
+	// DiagnosticXattrOversized indicates that an xattr was not applied
+	// because it was larger than UnpackOptions.MaxXattrSize.
+	DiagnosticXattrOversized DiagnosticCode = "xattr-oversized"
+
+	// DiagnosticXattrUnsupported indicates that xattrs could not be read or
+	// modified because the filesystem does not support them.
+	DiagnosticXattrUnsupported DiagnosticCode = "xattr-unsupported"
+
+	// DiagnosticXattrEmpty indicates that an xattr was not included in a
+	// generated layer because it had an empty value.
+	DiagnosticXattrEmpty DiagnosticCode = "xattr-empty"
+
+	// DiagnosticRootlessEPERM indicates that an operation which is not
+	// permitted for unprivileged users (such as setting some xattrs) was
+	// skipped during a rootless extraction.
+	DiagnosticRootlessEPERM DiagnosticCode = "rootless-eperm"
+
+	// DiagnosticRootlessDevice indicates that a device node was replaced with
+	// an empty file during a rootless extraction.
+	DiagnosticRootlessDevice DiagnosticCode = "rootless-device"
+
+	// DiagnosticForeignDevice indicates that a device node was skipped
+	// because the image is a Windows image, where device nodes have no
+	// meaning.
+	DiagnosticForeignDevice DiagnosticCode = "foreign-device"
+
+	// DiagnosticBirthTimeUnsupported indicates that the birth time of a file
+	// could not be read or restored.
+	DiagnosticBirthTimeUnsupported DiagnosticCode = "btime-unsupported"
+
+	// DiagnosticEmptyLinkTarget indicates that a link entry with an empty
+	// target was skipped (see UnpackOptions.SkipEmptyLinkTargets).
+	DiagnosticEmptyLinkTarget DiagnosticCode = "empty-link-target"
+
+	// DiagnosticDeniedPath indicates that an entry was skipped because it
+	// would have modified one of UnpackOptions.DenyPaths.
+	DiagnosticDeniedPath DiagnosticCode = "denied-path"
+
+	// DiagnosticFilteredLinkTarget indicates that a hardlink entry was
+	// skipped because its target was not selected for extraction by
+	// UnpackOptions.IncludePaths and UnpackOptions.ExcludePaths.
+	DiagnosticFilteredLinkTarget DiagnosticCode = "filtered-link-target"
+
+	// DiagnosticSymlinkLint indicates that a symlink added to a generated
+	// layer was flagged by RepackOptions.LintSymlinks.
+	DiagnosticSymlinkLint DiagnosticCode = "symlink-lint"
+
+	// DiagnosticTrailingData indicates that a layer blob contained trailing
+	// data after the end of the tar archive.
+	DiagnosticTrailingData DiagnosticCode = "trailing-data"
+)
+
+// Diagnostic is a machine-readable form of a warning emitted while extracting
+// or generating a layer.
+type Diagnostic struct {
+	// Code is the class of problem.
+	Code DiagnosticCode `json:"code"`
+
+	// Path is the path (within the layer or root filesystem) the problem
+	// relates to. It may be empty for problems which apply to an entire
+	// layer.
+	Path string `json:"path,omitempty"`
+
+	// Message is the human-readable warning, as it was logged.
+	Message string `json:"message"`
+}
+
+// DiagnosticFunc is called for every Diagnostic emitted during an operation,
+// in the order the underlying warnings were emitted.
+type DiagnosticFunc func(Diagnostic)
+
+// report passes a Diagnostic to fn (if it is non-nil), without logging it.
+// This is used for warnings which have already been logged (or deliberately
+// suppressed from the logs), but which should still be reported.
+func (fn DiagnosticFunc) report(code DiagnosticCode, path, format string, args ...interface{}) {
+	if fn != nil {
+		fn(Diagnostic{Code: code, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// warnf logs a warning and also passes it to fn (if it is non-nil) as a
+// Diagnostic.
+func (fn DiagnosticFunc) warnf(code DiagnosticCode, path, format string, args ...interface{}) {
+	log.Warnf(format, args...)
+	fn.report(code, path, format, args...)
+}
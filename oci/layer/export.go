@@ -0,0 +1,84 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/unpriv"
+)
+
+// ExportRootfs writes the fully-merged root filesystem of the given manifest
+// to w as a single (uncompressed) tar archive, in the style of "docker
+// export". All of the layers are applied (with whiteouts resolved) to a
+// temporary directory which is then archived and removed, so the archive
+// contains no whiteouts and no entry for the root directory itself. The
+// ownership of entries is mapped back into the container using
+// opt.MapOptions, so rootless exports produce the same archive as privileged
+// ones.
+func ExportRootfs(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, w io.Writer, opt *UnpackOptions) (Err error) {
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+
+	fsEval := fseval.Default
+	if unpackOptions.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	tmpDir, err := ioutil.TempDir("", "umoci-export-")
+	if err != nil {
+		return fmt.Errorf("create temporary rootfs: %w", err)
+	}
+	defer func() {
+		if err := fsEval.RemoveAll(tmpDir); err != nil && Err == nil {
+			Err = fmt.Errorf("remove temporary rootfs: %w", err)
+		}
+	}()
+
+	rootfs := filepath.Join(tmpDir, RootfsName)
+	if err := UnpackRootfs(ctx, engine, rootfs, manifest, &unpackOptions); err != nil {
+		return fmt.Errorf("unpack rootfs: %w", err)
+	}
+
+	tg := newTarGenerator(w, unpackOptions.MapOptions)
+	if err := unpriv.Walk(rootfs, func(curPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if curPath == rootfs {
+			return nil
+		}
+		return tg.AddFile(curPath[len(rootfs):], curPath)
+	}); err != nil {
+		return fmt.Errorf("generate rootfs archive: %w", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		return fmt.Errorf("close tar writer: %w", err)
+	}
+	return nil
+}
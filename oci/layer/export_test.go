@@ -0,0 +1,173 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+func TestExportRootfs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestExportRootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Create a two-layer image where the second layer removes some of the
+	// files in the first layer.
+	var diffIDs []digest.Digest
+	var layerDescriptors []ispec.Descriptor
+	for _, hdrs := range [][]*tar.Header{
+		{
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "a/keep", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "b", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "c/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "c/old", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "a/.wh.file", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: ".wh.b", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "c/", Typeflag: tar.TypeDir, Mode: 0700},
+			{Name: "c/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "c/new", Typeflag: tar.TypeReg, Mode: 0600},
+			{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "a/keep"},
+		},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffIDs = append(diffIDs, layerDigest)
+		layerDescriptors = append(layerDescriptors, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}}
+
+	var archive bytes.Buffer
+	if err := ExportRootfs(ctx, engineExt, manifest, &archive, unpackOptions); err != nil {
+		t.Fatalf("unexpected ExportRootfs error: %+v", err)
+	}
+
+	type entry struct {
+		typeflag byte
+		mode     int64
+		linkname string
+	}
+	expected := map[string]entry{
+		"a/":     {tar.TypeDir, 0755, ""},
+		"a/keep": {tar.TypeReg, 0644, ""},
+		"c/":     {tar.TypeDir, 0700, ""},
+		"c/new":  {tar.TypeReg, 0600, ""},
+		"d":      {tar.TypeSymlink, 0777, "a/keep"},
+	}
+	got := map[string]entry{}
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading exported archive: %v", err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("entry %q has unmapped owner %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		got[hdr.Name] = entry{hdr.Typeflag, hdr.Mode & 0777, hdr.Linkname}
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("exported archive mismatch:\nexpected: %v\ngot:      %v", expected, got)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// EntryFunc is called with the header of each entry (including whiteouts)
+// after it has been written to a generated layer.
+type EntryFunc func(hdr *tar.Header)
+
+// FileManifestEntry describes a single entry in a layer.
+type FileManifestEntry struct {
+	// Path is the name of the entry in the layer archive.
+	Path string `json:"path"`
+
+	// Size is the size of the entry's contents (zero for anything other
+	// than regular files).
+	Size int64 `json:"size"`
+}
+
+// FileManifest is a list of the entries in a layer, sorted by path. It allows
+// tooling to reason about the contents of a layer without decompressing it.
+type FileManifest []FileManifestEntry
+
+// Add appends an entry for the given header to the manifest. It can be used as
+// an EntryFunc (in which case Sort must be called once the layer has been
+// generated).
+func (fm *FileManifest) Add(hdr *tar.Header) {
+	*fm = append(*fm, FileManifestEntry{
+		Path: hdr.Name,
+		Size: hdr.Size,
+	})
+}
+
+// Sort sorts the manifest by path.
+func (fm FileManifest) Sort() {
+	sort.SliceStable(fm, func(i, j int) bool { return fm[i].Path < fm[j].Path })
+}
+
+// GenerateFileManifest computes the FileManifest of the uncompressed layer
+// archive read from r.
+func GenerateFileManifest(r io.Reader) (FileManifest, error) {
+	fm := FileManifest{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read next entry: %w", err)
+		}
+		fm.Add(hdr)
+	}
+	fm.Sort()
+	return fm, nil
+}
@@ -24,6 +24,7 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/umoci/pkg/unpriv"
@@ -38,6 +39,30 @@ func (ids inodeDeltas) Len() int           { return len(ids) }
 func (ids inodeDeltas) Less(i, j int) bool { return ids[i].Path() < ids[j].Path() }
 func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 
+// entryOrderName normalises a tar entry name (or mtree path) so that names
+// from layers can be compared with mtree delta paths.
+func entryOrderName(name string) string {
+	return strings.TrimPrefix(CleanPath("/"+name), "/")
+}
+
+// sortDeltasByEntryOrder stably re-orders deltas so that any deltas whose path
+// is in order come first (in the same order as in order), followed by the
+// remaining deltas in their existing order.
+func sortDeltasByEntryOrder(deltas []mtree.InodeDelta, order []string) {
+	positions := make(map[string]int, len(order))
+	for idx, name := range order {
+		positions[entryOrderName(name)] = idx
+	}
+	sort.SliceStable(deltas, func(i, j int) bool {
+		posI, okI := positions[entryOrderName(deltas[i].Path())]
+		posJ, okJ := positions[entryOrderName(deltas[j].Path())]
+		if okI && okJ {
+			return posI < posJ
+		}
+		return okI && !okJ
+	})
+}
+
 // GenerateLayer creates a new OCI diff layer based on the mtree diff provided.
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
@@ -67,12 +92,21 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
 		tg := newTarGenerator(writer, packOptions.MapOptions)
+		tg.forceOwner = packOptions.ForceOwner
+		tg.lintSymlinks = packOptions.LintSymlinks
+		tg.recordBirthTime = packOptions.RecordBirthTime
+		tg.overlayXattrs = packOptions.TranslateOverlayWhiteouts
+		tg.diagnostics = packOptions.OnDiagnostic
+		tg.onEntry = packOptions.OnEntry
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
 		//        doing something silly like deleting a file which we actually
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
+		if len(packOptions.EntryOrder) > 0 {
+			sortDeltasByEntryOrder(deltas, packOptions.EntryOrder)
+		}
 
 		for _, delta := range deltas {
 			name := delta.Path()
@@ -85,7 +119,7 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 			switch delta.Type() {
 			case mtree.Modified, mtree.Extra:
 				if packOptions.TranslateOverlayWhiteouts {
-					fi, err := os.Stat(fullPath)
+					fi, err := os.Lstat(fullPath)
 					if err != nil {
 						return fmt.Errorf("couldn't determine overlay whiteout for %s: %w", fullPath, err)
 					}
@@ -95,11 +129,11 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 						return err
 					}
 					if whiteout {
-						if err := tg.AddWhiteout(fullPath); err != nil {
+						if err := tg.AddWhiteout(name); err != nil {
 							return fmt.Errorf("generate whiteout from overlayfs: %w", err)
 						}
+						continue
 					}
-					continue
 				}
 				if err := tg.AddFile(name, fullPath); err != nil {
 					log.Warnf("generate layer: could not add file %q: %s", name, err)
@@ -149,6 +183,12 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 		}()
 
 		tg := newTarGenerator(writer, packOptions.MapOptions)
+		tg.forceOwner = packOptions.ForceOwner
+		tg.lintSymlinks = packOptions.LintSymlinks
+		tg.recordBirthTime = packOptions.RecordBirthTime
+		tg.overlayXattrs = packOptions.TranslateOverlayWhiteouts
+		tg.diagnostics = packOptions.OnDiagnostic
+		tg.onEntry = packOptions.OnEntry
 
 		defer func() {
 			if err := tg.tw.Close(); err != nil {
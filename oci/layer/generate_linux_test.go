@@ -92,11 +92,58 @@ func TestGenerateLayerTranslateOverlayWhiteouts(t *testing.T) {
 
 	tr := tar.NewReader(reader)
 
+	// The root directory is included because it is "extra" in the diff.
 	hdr, err := tr.Next()
 	assert.NoError(err)
+	assert.Equal(hdr.Name, ".")
+
+	hdr, err = tr.Next()
+	assert.NoError(err)
 
 	assert.Equal(int32(hdr.Typeflag), int32(tar.TypeReg))
-	assert.Equal(path.Base(hdr.Name), whPrefix+"test")
+	assert.Equal(hdr.Name, whPrefix+"test")
 	_, err = tr.Next()
 	assert.Equal(err, io.EOF)
 }
+
+func TestGenerateLayerTranslateOverlayWhiteoutsRegular(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "umoci-TestTranslateOverlayWhiteoutsRegular")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Ordinary files must still be included when translating whiteouts.
+	err = ioutil.WriteFile(path.Join(dir, "file"), []byte("contents"), 0644)
+	assert.NoError(err)
+	err = os.Symlink("/nonexistent", path.Join(dir, "link"))
+	assert.NoError(err)
+
+	packOptions := RepackOptions{TranslateOverlayWhiteouts: true}
+	mtreeKeywords := []mtree.Keyword{
+		"size",
+		"type",
+		"uid",
+		"gid",
+		"mode",
+	}
+	deltas, err := mtree.Check(dir, nil, mtreeKeywords, fseval.Default)
+	assert.NoError(err)
+
+	reader, err := GenerateLayer(dir, deltas, &packOptions)
+	assert.NoError(err)
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(err) {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	assert.ElementsMatch([]string{".", "file", "link"}, names)
+}
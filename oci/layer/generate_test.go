@@ -24,8 +24,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/apex/log"
 	"github.com/vbatts/go-mtree"
 )
 
@@ -270,3 +273,94 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+// logRecorder is a log.Handler which records all log messages.
+type logRecorder struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (r *logRecorder) HandleLog(entry *log.Entry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.messages = append(r.messages, entry.Message)
+	return nil
+}
+
+func TestGenerateLintSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLintSymlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "some", "parents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	symlinks := map[string]string{
+		"some/absolute":       "/etc/passwd",
+		"some/parents/escape": "../../../etc/passwd",
+		"some/parents/fine":   "../../etc/passwd",
+		"some/relative":       "parents/fine",
+	}
+	for name, target := range symlinks {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lint := range []bool{false, true} {
+		recorder := &logRecorder{}
+		oldHandler := log.Log.(*log.Logger).Handler
+		log.SetHandler(recorder)
+
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{LintSymlinks: lint})
+		if err != nil {
+			log.SetHandler(oldHandler)
+			t.Fatal(err)
+		}
+		_, err = io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		log.SetHandler(oldHandler)
+		if err != nil {
+			t.Fatalf("unexpected error generating layer: %+v", err)
+		}
+
+		warned := map[string]bool{}
+		for _, msg := range recorder.messages {
+			for name := range symlinks {
+				if strings.HasPrefix(msg, "lint: symlink "+name+" ") {
+					warned[name] = true
+				}
+			}
+		}
+		for name, expected := range map[string]bool{
+			"some/absolute":       lint,
+			"some/parents/escape": lint,
+			"some/parents/fine":   false,
+			"some/relative":       false,
+		} {
+			if warned[name] != expected {
+				t.Errorf("unexpected lint warning state for %s (lint=%v): expected %v got %v", name, lint, expected, warned[name])
+			}
+		}
+	}
+}
@@ -260,7 +260,9 @@ func makeImage(base641, base642 string) (string, ispec.Manifest, casext.Engine,
 
 	// Create the config.
 	config := ispec.Image{
-		OS: "linux",
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
 		RootFS: ispec.RootFS{
 			Type:    "layers",
 			DiffIDs: layerDigests,
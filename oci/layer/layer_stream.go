@@ -0,0 +1,238 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/pkg/system"
+)
+
+// layerStream is the uncompressed contents of a layer blob being extracted.
+type layerStream interface {
+	io.Reader
+
+	// Finish must be called once the uncompressed contents have been read in
+	// full. It consumes any trailing data in the (compressed) blob and closes
+	// it, returning the number of trailing bytes.
+	Finish() (int64, error)
+
+	// Close releases any resources held by the stream. It can be called
+	// whether or not Finish has been called.
+	Close() error
+}
+
+// serialLayer is a layerStream which decompresses a layer blob as it is read.
+type serialLayer struct {
+	data io.ReadCloser
+	raw  io.ReadCloser
+}
+
+// openSerialLayer opens the blob of the given layer for decompression while it
+// is being read.
+func openSerialLayer(ctx context.Context, src BlobSource, descriptor ispec.Descriptor, opt *UnpackOptions) (_ *serialLayer, Err error) {
+	layerData, err := src.OpenBlob(ctx, descriptor)
+	if err != nil {
+		return nil, fmt.Errorf("get layer blob: %w", err)
+	}
+	defer func() {
+		if Err != nil {
+			_ = layerData.Close()
+		}
+	}()
+	if opt.SequentialIO {
+		adviseSequential(layerData)
+	}
+
+	// We have to extract a decompressed version of the above layer.
+	layerRaw, err := layerDecompressor(descriptor.MediaType, layerData, opt)
+	if err != nil {
+		return nil, fmt.Errorf("unpack rootfs: layer %s: %w", descriptor.Digest, err)
+	}
+	return &serialLayer{data: layerData, raw: layerRaw}, nil
+}
+
+// Read implements io.Reader.
+func (sl *serialLayer) Read(p []byte) (int, error) {
+	return sl.raw.Read(p)
+}
+
+// Finish implements layerStream.
+func (sl *serialLayer) Finish() (int64, error) {
+	// It seems like some gzip implementations add trailing NUL bytes, which
+	// Go doesn't slurp up. Just eat up the rest of the remaining bytes and
+	// discard them.
+	//
+	// FIXME: We use sl.data here because pgzip returns io.EOF from WriteTo,
+	// which causes havoc with system.Copy. Ideally we would use sl.raw. See
+	// <https://github.com/klauspost/pgzip/issues/38>.
+	n, err := system.Copy(ioutil.Discard, sl.data)
+	if err != nil {
+		return 0, fmt.Errorf("discard trailing raw bits: %w", err)
+	}
+	if err := sl.data.Close(); err != nil {
+		return 0, fmt.Errorf("close layer data: %w", err)
+	}
+	return n, nil
+}
+
+// Close implements layerStream.
+func (sl *serialLayer) Close() error {
+	rawErr := sl.raw.Close()
+	if err := sl.data.Close(); err != nil {
+		return err
+	}
+	return rawErr
+}
+
+// decompressAheadChunkSize and decompressAheadChunks bound the amount of
+// uncompressed data which is buffered for each layer being decompressed ahead
+// of its extraction (see UnpackOptions.DecompressAhead).
+const (
+	decompressAheadChunkSize = 256 * 1024
+	decompressAheadChunks    = 16
+)
+
+// errAheadStopped is returned by the goroutine of an aheadLayer which was
+// closed before its contents were read in full.
+var errAheadStopped = errors.New("[internal error] layer decompression stopped")
+
+// aheadLayer is a layerStream for a layer blob which is being read and
+// decompressed by a background goroutine, so that decompression can overlap
+// the extraction of earlier layers. At most decompressAheadChunks chunks of
+// uncompressed data are buffered before the goroutine blocks.
+type aheadLayer struct {
+	chunks   chan []byte
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// free holds chunks which have been read in full, so they can be reused
+	// rather than allocating a new chunk each time.
+	free chan []byte
+
+	// chunk is the chunk currently being read, and buf is the remainder of
+	// it which hasn't been read yet.
+	chunk, buf []byte
+
+	// err and trailing are the result of the background goroutine. They must
+	// only be accessed once chunks has been closed (or done has been closed).
+	err      error
+	trailing int64
+}
+
+// startAheadLayer starts reading and decompressing the blob of the given layer
+// in the background.
+func startAheadLayer(ctx context.Context, src BlobSource, descriptor ispec.Descriptor, opt *UnpackOptions) *aheadLayer {
+	al := &aheadLayer{
+		chunks: make(chan []byte, decompressAheadChunks),
+		free:   make(chan []byte, decompressAheadChunks+1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(al.done)
+		al.trailing, al.err = al.decompress(ctx, src, descriptor, opt)
+		close(al.chunks)
+	}()
+	return al
+}
+
+// decompress reads the uncompressed contents of the layer into al.chunks,
+// returning the number of trailing bytes in the compressed blob.
+func (al *aheadLayer) decompress(ctx context.Context, src BlobSource, descriptor ispec.Descriptor, opt *UnpackOptions) (int64, error) {
+	sl, err := openSerialLayer(ctx, src, descriptor, opt)
+	if err != nil {
+		return 0, err
+	}
+	defer sl.Close()
+
+	for {
+		var chunk []byte
+		select {
+		case chunk = <-al.free:
+		default:
+			chunk = make([]byte, decompressAheadChunkSize)
+		}
+		var n int
+		for n < len(chunk) && err == nil {
+			var m int
+			m, err = sl.Read(chunk[n:])
+			n += m
+		}
+		if n > 0 {
+			select {
+			case al.chunks <- chunk[:n]:
+			case <-al.stop:
+				return 0, errAheadStopped
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return sl.Finish()
+}
+
+// Read implements io.Reader. Once all of the uncompressed contents have been
+// read, any error from the background goroutine is returned instead of
+// io.EOF.
+func (al *aheadLayer) Read(p []byte) (int, error) {
+	for len(al.buf) == 0 {
+		if al.chunk != nil {
+			select {
+			case al.free <- al.chunk[:cap(al.chunk)]:
+			default:
+			}
+			al.chunk = nil
+		}
+		chunk, ok := <-al.chunks
+		if !ok {
+			if al.err != nil {
+				return 0, al.err
+			}
+			return 0, io.EOF
+		}
+		al.chunk, al.buf = chunk, chunk
+	}
+	n := copy(p, al.buf)
+	al.buf = al.buf[n:]
+	return n, nil
+}
+
+// Finish implements layerStream.
+func (al *aheadLayer) Finish() (int64, error) {
+	<-al.done
+	return al.trailing, al.err
+}
+
+// Close implements layerStream. It stops the background goroutine (if it is
+// still running) and waits for it to finish.
+func (al *aheadLayer) Close() error {
+	al.stopOnce.Do(func() { close(al.stop) })
+	<-al.done
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// layerReadCloser is the uncompressed tar stream of a layer blob.
+type layerReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *layerReadCloser) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if err2 := closer.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// OpenLayer returns the uncompressed tar stream of the given layer blob (as
+// with WalkLayer, gzip and zstd compressed layers are supported). The
+// caller must Close the returned reader.
+func OpenLayer(ctx context.Context, engineExt casext.Engine, desc ispec.Descriptor) (io.ReadCloser, error) {
+	layerBlob, err := engineExt.FromDescriptor(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("get layer blob: %w", err)
+	}
+	if !isLayerType(layerBlob.Descriptor.MediaType) {
+		layerBlob.Close()
+		return nil, fmt.Errorf("layer %s: blob is not correct mediatype: %s", layerBlob.Descriptor.Digest, layerBlob.Descriptor.MediaType)
+	}
+	layerData, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		layerBlob.Close()
+		// Should _never_ be reached.
+		return nil, errors.New("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	rawRdr, err := layerDecompressor(layerBlob.Descriptor.MediaType, layerData, nil)
+	if err != nil {
+		layerBlob.Close()
+		return nil, err
+	}
+	return &layerReadCloser{
+		Reader:  rawRdr,
+		closers: []io.Closer{rawRdr, layerBlob},
+	}, nil
+}
+
+// WalkLayerFunc is the type of the function called by WalkLayer for each
+// entry in a layer. The reader contains the contents of the entry and is only
+// valid until the function returns. If the function returns an error, the walk
+// is stopped and the error is returned by WalkLayer.
+type WalkLayerFunc func(hdr *tar.Header, r io.Reader) error
+
+// WalkLayer decompresses the given layer blob and calls walkFn for each entry
+// in the layer's tar archive, in archive order. Unlike UnpackLayer, this has
+// no filesystem side-effects and whiteouts are passed to walkFn as-is.
+func WalkLayer(ctx context.Context, engine cas.Engine, desc ispec.Descriptor, walkFn WalkLayerFunc) error {
+	engineExt := casext.NewEngine(engine)
+
+	layerRdr, err := OpenLayer(ctx, engineExt, desc)
+	if err != nil {
+		return err
+	}
+	defer layerRdr.Close()
+
+	tr := tar.NewReader(layerRdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read next entry: %w", err)
+		}
+		if err := walkFn(hdr, tr); err != nil {
+			return err
+		}
+	}
+	return layerRdr.Close()
+}
+
+// PathExists returns whether the given path exists in the filesystem that
+// would result from extracting all of the layers in the given manifest,
+// taking whiteouts into account. This is a best-effort lexical check --
+// symlinks (in either the path or the layers) are not resolved.
+func PathExists(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path string) (bool, error) {
+	path = CleanPath("/" + path)
+	if path == "/" {
+		// The root always exists.
+		return true, nil
+	}
+	path = strings.TrimPrefix(path, "/")
+
+	// covers returns whether removing dir (along with everything beneath it)
+	// would also remove path.
+	covers := func(dir string) bool {
+		return dir == "." || dir == path || strings.HasPrefix(path, dir+"/")
+	}
+
+	// Only the state of path is tracked, rather than every path in the
+	// layers, so that lookups don't depend on the size of the image.
+	var exists bool
+	for _, layerDescriptor := range manifest.Layers {
+		var (
+			// upper is whether this layer itself contains path.
+			upper bool
+			// removed is whether this layer removes path from the lower
+			// layers, with a whiteout or by replacing one of its parent
+			// directories with a non-directory.
+			removed bool
+		)
+
+		err := WalkLayer(ctx, engine, layerDescriptor, func(hdr *tar.Header, _ io.Reader) error {
+			name := strings.TrimPrefix(CleanPath("/"+hdr.Name), "/")
+			dir, file := filepath.Split(name)
+			dir = filepath.Clean(dir)
+			switch {
+			// Whiteouts only apply to the lower layers.
+			case file == whOpaque:
+				if dir != path && covers(dir) {
+					removed = true
+				}
+			case strings.HasPrefix(file, whPrefix):
+				if covers(filepath.Join(dir, strings.TrimPrefix(file, whPrefix))) {
+					removed = true
+				}
+			// Every entry implicitly creates its parent directories.
+			case name == path || strings.HasPrefix(name, path+"/"):
+				upper = true
+			case strings.HasPrefix(path, name+"/") && hdr.Typeflag != tar.TypeDir:
+				upper = false
+				removed = true
+			}
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("walk layer %s: %w", layerDescriptor.Digest, err)
+		}
+		exists = upper || (exists && !removed)
+	}
+	return exists, nil
+}
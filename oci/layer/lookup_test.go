@@ -0,0 +1,276 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gzip "github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// makeLayer stores a layer made of the given tar entries in the engine. If
+// compress is set, the layer is gzip-compressed.
+func makeLayer(t *testing.T, engineExt casext.Engine, compress bool, entries ...*tar.Header) ispec.Descriptor {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return makeLayerBlob(t, engineExt, compress, buf.Bytes())
+}
+
+// makeLayerBlob stores the given tar archive as a layer in the engine. If
+// compress is set, the layer is gzip-compressed.
+func makeLayerBlob(t *testing.T, engineExt casext.Engine, compress bool, data []byte) ispec.Descriptor {
+	mediaType := ispec.MediaTypeImageLayer
+	if compress {
+		var gzBuf bytes.Buffer
+		gzw := gzip.NewWriter(&gzBuf)
+		if _, err := gzw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = gzBuf.Bytes()
+		mediaType = ispec.MediaTypeImageLayerGzip
+	}
+
+	layerDigest, layerSize, err := engineExt.PutBlob(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+}
+
+func TestPathExists(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPathExists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			makeLayer(t, engineExt, true,
+				&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+				&tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+				&tar.Header{Name: "usr/bin/ls", Typeflag: tar.TypeReg, Mode: 0755},
+				&tar.Header{Name: "opt/app/bin", Typeflag: tar.TypeReg, Mode: 0755},
+				&tar.Header{Name: "var/lib/data", Typeflag: tar.TypeReg, Mode: 0644},
+				&tar.Header{Name: "srv/data/file", Typeflag: tar.TypeReg, Mode: 0644},
+				&tar.Header{Name: "home/user/file", Typeflag: tar.TypeReg, Mode: 0644},
+			),
+			makeLayer(t, engineExt, false,
+				&tar.Header{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "usr/.wh.bin", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "opt/app/new", Typeflag: tar.TypeReg, Mode: 0644},
+				&tar.Header{Name: "opt/app/.wh..wh..opq", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "/var/../var/lib/../new", Typeflag: tar.TypeReg, Mode: 0644},
+			),
+			makeLayer(t, engineExt, false,
+				// Replacing a directory with a non-directory removes its
+				// contents.
+				&tar.Header{Name: "srv/data", Typeflag: tar.TypeSymlink, Linkname: "/data"},
+				// Whiteouts don't apply to entries in the same layer.
+				&tar.Header{Name: "home/.wh.user", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "home/user/other", Typeflag: tar.TypeReg, Mode: 0644},
+			),
+		},
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"/", true},
+		{"etc", true},
+		{"/etc/passwd", true},
+		{"etc/passwd/", true},
+		{"/etc/shadow", false},
+		{"/usr", true},
+		{"/usr/bin", false},
+		{"/usr/bin/ls", false},
+		{"/opt/app", true},
+		{"/opt/app/bin", false},
+		{"/opt/app/new", true},
+		{"/var/lib/data", true},
+		{"/var/new", true},
+		{"/../../var/new", true},
+		{"/srv", true},
+		{"/srv/data", true},
+		{"/srv/data/file", false},
+		{"/home/user", true},
+		{"/home/user/file", false},
+		{"/home/user/other", true},
+		{"/does/not/exist", false},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			exists, err := PathExists(ctx, engine, manifest, test.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if exists != test.exists {
+				t.Errorf("unexpected existence of %q: expected %v got %v", test.path, test.exists, exists)
+			}
+		})
+	}
+}
+
+func TestWalkLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestWalkLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	type entry struct {
+		name     string
+		typeflag byte
+		contents string
+	}
+	entries := []entry{
+		{"etc/", tar.TypeDir, ""},
+		{"etc/passwd", tar.TypeReg, "root:x:0:0:root:/root:/bin/sh\n"},
+		{"etc/.wh.shadow", tar.TypeReg, ""},
+		{"usr/bin/empty", tar.TypeReg, ""},
+		{"usr/bin/data", tar.TypeReg, "some data which is in a file"},
+		{"usr/bin/link", tar.TypeSymlink, ""},
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:     ent.name,
+			Typeflag: ent.typeflag,
+			Mode:     0644,
+			Size:     int64(len(ent.contents)),
+		}
+		if ent.typeflag == tar.TypeSymlink {
+			hdr.Linkname = "data"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(ent.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		desc := makeLayerBlob(t, engineExt, compress, buf.Bytes())
+
+		var idx int
+		err := WalkLayer(ctx, engine, desc, func(hdr *tar.Header, r io.Reader) error {
+			if idx >= len(entries) {
+				t.Fatalf("too many entries walked: %s", hdr.Name)
+			}
+			ent := entries[idx]
+			idx++
+
+			if hdr.Name != ent.name {
+				t.Errorf("unexpected entry name: expected %q got %q", ent.name, hdr.Name)
+			}
+			if hdr.Typeflag != ent.typeflag {
+				t.Errorf("unexpected typeflag for %q: expected %v got %v", ent.name, ent.typeflag, hdr.Typeflag)
+			}
+			if hdr.Size != int64(len(ent.contents)) {
+				t.Errorf("unexpected size for %q: expected %d got %d", ent.name, len(ent.contents), hdr.Size)
+			}
+			contents, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error reading %q: %+v", ent.name, err)
+			}
+			if string(contents) != ent.contents {
+				t.Errorf("unexpected contents for %q: expected %q got %q", ent.name, ent.contents, contents)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error walking layer (compress=%v): %+v", compress, err)
+		}
+		if idx != len(entries) {
+			t.Errorf("not all entries were walked (compress=%v): expected %d got %d", compress, len(entries), idx)
+		}
+
+		// Errors from the callback stop the walk.
+		errStop := errors.New("stop")
+		var count int
+		err = WalkLayer(ctx, engine, desc, func(*tar.Header, io.Reader) error {
+			count++
+			return errStop
+		})
+		if !errors.Is(err, errStop) {
+			t.Errorf("expected callback error to be returned: got %+v", err)
+		}
+		if count != 1 {
+			t.Errorf("walk continued after callback error: %d entries walked", count)
+		}
+	}
+}
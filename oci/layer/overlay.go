@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+// overlayXattrs are the overlayfs xattrs which describe state that is only
+// meaningful within a stack of overlayfs layers: "redirect" marks a directory
+// which was renamed (and should be merged with a different lower directory)
+// and "metacopy" marks a file whose data is stored in a lower layer. They
+// are not applied to regular (OCI-style) root filesystems, but are preserved
+// in layers generated from (and extracted to) overlayfs-style root
+// filesystems so that such layers can be stacked again.
+var overlayXattrs = []string{
+	"trusted.overlay.redirect",
+	"trusted.overlay.metacopy",
+}
+
+// paxOverlayXattrPrefix is the prefix of the PAX records used to store
+// overlayXattrs in a layer. They are stored as PAX records rather than as
+// xattrs so that OCI-style extraction (including by other tools) doesn't
+// apply them. The values may be binary (or empty, which PAX records cannot
+// represent) so they are base64-encoded with paxOverlayValuePrefix.
+const (
+	paxOverlayXattrPrefix = "UMOCI.overlay.xattr."
+	paxOverlayValuePrefix = "base64,"
+)
+
+// addOverlayXattrs records the overlayXattrs of the given path (out of the
+// list of xattr names set on the path) in the PAX records of hdr.
+func (tg *tarGenerator) addOverlayXattrs(hdr *tar.Header, path string, names []string) error {
+	for _, name := range names {
+		if !isOverlayXattr(name) {
+			continue
+		}
+		value, err := tg.fsEval.Lgetxattr(path, name)
+		if err != nil {
+			if errors.Is(err, unix.ENODATA) {
+				continue
+			}
+			return fmt.Errorf("get overlay xattr: %s: %w", name, err)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxOverlayXattrPrefix+name] = paxOverlayValuePrefix + base64.StdEncoding.EncodeToString(value)
+	}
+	return nil
+}
+
+// restoreOverlayXattrs applies the overlayXattrs recorded in the PAX records
+// of an entry to the given path, removing any which are not recorded (so
+// that stale state from a previous layer doesn't leak through). This is only
+// done for overlayfs-style root filesystems.
+func (te *TarExtractor) restoreOverlayXattrs(path string, records map[string]string) error {
+	for _, name := range overlayXattrs {
+		encoded, ok := records[paxOverlayXattrPrefix+name]
+		if !ok {
+			if _, err := te.fsEval.Lgetxattr(path, name); err != nil {
+				continue
+			}
+			if err := te.fsEval.Lremovexattr(path, name); err != nil {
+				return fmt.Errorf("clear overlay xattr %s: %w", name, err)
+			}
+			continue
+		}
+		if !strings.HasPrefix(encoded, paxOverlayValuePrefix) {
+			return fmt.Errorf("decode overlay xattr %s: unknown encoding %q", name, encoded)
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, paxOverlayValuePrefix))
+		if err != nil {
+			return fmt.Errorf("decode overlay xattr %s: %w", name, err)
+		}
+		log.Debugf("overlay{%s} restoring overlay xattr %s", path, name)
+		if err := te.fsEval.Lsetxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("set overlay xattr %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// isOverlayXattr returns whether name is one of overlayXattrs.
+func isOverlayXattr(name string) bool {
+	for _, xattr := range overlayXattrs {
+		if name == xattr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathFilter selects which entries are extracted, based on the
+// UnpackOptions.IncludePaths and UnpackOptions.ExcludePaths patterns. Each
+// pattern is split into path components which are matched against the
+// components of the cleaned entry path with path.Match, except that a "**"
+// component matches any number of components (including none).
+type pathFilter struct {
+	include [][]string
+	exclude [][]string
+}
+
+// splitPath splits the given path (or pattern) into its cleaned components,
+// relative to the root.
+func splitPath(rawPath string) []string {
+	cleanPath := strings.TrimPrefix(filepath.Join("/", CleanPath(rawPath)), "/")
+	if cleanPath == "" {
+		return nil
+	}
+	return strings.Split(cleanPath, "/")
+}
+
+// newPathFilter creates a pathFilter for the given patterns, returning nil if
+// there are no patterns (in which case every path is selected).
+func newPathFilter(include, exclude []string) *pathFilter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	pf := &pathFilter{}
+	for _, pattern := range include {
+		pf.include = append(pf.include, splitPath(pattern))
+	}
+	for _, pattern := range exclude {
+		pf.exclude = append(pf.exclude, splitPath(pattern))
+	}
+	return pf
+}
+
+// matchCovers returns whether pattern matches components or any of its
+// ancestors (so that a pattern for a directory matches everything inside it).
+func matchCovers(pattern, components []string) (bool, error) {
+	if len(pattern) == 0 {
+		return true, nil
+	}
+	if pattern[0] == "**" {
+		if ok, err := matchCovers(pattern[1:], components); ok || err != nil {
+			return ok, err
+		}
+		if len(components) == 0 {
+			return false, nil
+		}
+		return matchCovers(pattern, components[1:])
+	}
+	if len(components) == 0 {
+		return false, nil
+	}
+	ok, err := path.Match(pattern[0], components[0])
+	if !ok || err != nil {
+		return false, err
+	}
+	return matchCovers(pattern[1:], components[1:])
+}
+
+// matchLeadsTo returns whether components is a strict ancestor of some path
+// which pattern could match.
+func matchLeadsTo(pattern, components []string) (bool, error) {
+	if len(pattern) == 0 {
+		return false, nil
+	}
+	if len(components) == 0 || pattern[0] == "**" {
+		return true, nil
+	}
+	ok, err := path.Match(pattern[0], components[0])
+	if !ok || err != nil {
+		return false, err
+	}
+	return matchLeadsTo(pattern[1:], components[1:])
+}
+
+// selected returns whether the given path should be extracted. A path is
+// selected if it is not excluded and either there are no include patterns,
+// an include pattern matches it (or one of its ancestors), or ancestor is set
+// and the path is an ancestor of a path an include pattern could match.
+// Ancestors must be selected for directories (so that the parent directories
+// of included paths are extracted) and for whiteouts (which can remove
+// included paths).
+func (pf *pathFilter) selected(rawPath string, ancestor bool) (bool, error) {
+	if pf == nil {
+		return true, nil
+	}
+	components := splitPath(rawPath)
+	for _, pattern := range pf.exclude {
+		excluded, err := matchCovers(pattern, components)
+		if err != nil {
+			return false, fmt.Errorf("match exclude pattern %q: %w", strings.Join(pattern, "/"), err)
+		}
+		if excluded {
+			return false, nil
+		}
+	}
+	if len(pf.include) == 0 {
+		return true, nil
+	}
+	for _, pattern := range pf.include {
+		included, err := matchCovers(pattern, components)
+		if err != nil {
+			return false, fmt.Errorf("match include pattern %q: %w", strings.Join(pattern, "/"), err)
+		}
+		if !included && ancestor {
+			included, err = matchLeadsTo(pattern, components)
+			if err != nil {
+				return false, fmt.Errorf("match include pattern %q: %w", strings.Join(pattern, "/"), err)
+			}
+		}
+		if included {
+			return true, nil
+		}
+	}
+	return false, nil
+}
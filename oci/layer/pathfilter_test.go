@@ -0,0 +1,85 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"testing"
+)
+
+func TestPathFilterSelected(t *testing.T) {
+	for _, test := range []struct {
+		include, exclude []string
+		path             string
+		ancestor         bool
+		expected         bool
+	}{
+		// No patterns selects everything.
+		{nil, nil, "etc/passwd", false, true},
+		// Patterns match entire components, and everything beneath a match.
+		{[]string{"etc"}, nil, "etc", false, true},
+		{[]string{"/etc/"}, nil, "etc/ssl/certs/ca.pem", false, true},
+		{[]string{"etc"}, nil, "etcetera", false, false},
+		{[]string{"etc"}, nil, "usr/etc", false, false},
+		// Globs within a component.
+		{[]string{"etc/*.conf"}, nil, "etc/resolv.conf", false, true},
+		{[]string{"etc/*.conf"}, nil, "etc/passwd", false, false},
+		{[]string{"etc/*.conf"}, nil, "etc/conf.d/x.conf", false, false},
+		// "**" matches any number of components.
+		{[]string{"etc/**"}, nil, "etc", false, true},
+		{[]string{"etc/**"}, nil, "etc/a/b/c", false, true},
+		{[]string{"usr/**/*.so"}, nil, "usr/lib.so", false, true},
+		{[]string{"usr/**/*.so"}, nil, "usr/lib/x86_64/libc.so", false, true},
+		{[]string{"usr/**/*.so"}, nil, "usr/lib/x86_64/libc.a", false, false},
+		{[]string{"**/*.so"}, nil, "lib/libc.so", false, true},
+		// Ancestors of possible matches are only selected if requested.
+		{[]string{"usr/lib/*.so"}, nil, "usr", false, false},
+		{[]string{"usr/lib/*.so"}, nil, "usr", true, true},
+		{[]string{"usr/lib/*.so"}, nil, "usr/lib", true, true},
+		{[]string{"usr/lib/*.so"}, nil, "usr/bin", true, false},
+		{[]string{"usr/lib/*.so"}, nil, ".", true, true},
+		{[]string{"usr/**/*.so"}, nil, "usr/lib/x86_64", true, true},
+		// Excludes shadow includes.
+		{nil, []string{"etc/shadow"}, "etc/passwd", false, true},
+		{nil, []string{"etc/shadow"}, "etc/shadow", false, false},
+		{[]string{"etc"}, []string{"etc/ssl"}, "etc/ssl/private/key", false, false},
+		{[]string{"etc"}, []string{"etc/ssl"}, "etc/ssl", true, false},
+		{[]string{"etc"}, []string{"**/*.pem"}, "etc/ssl/ca.pem", false, false},
+		{[]string{"etc"}, []string{"**/*.pem"}, "etc/ssl", true, true},
+	} {
+		pf := newPathFilter(test.include, test.exclude)
+		selected, err := pf.selected(test.path, test.ancestor)
+		if err != nil {
+			t.Errorf("include=%v exclude=%v path=%q: unexpected error: %+v", test.include, test.exclude, test.path, err)
+			continue
+		}
+		if selected != test.expected {
+			t.Errorf("include=%v exclude=%v path=%q ancestor=%v: expected selected=%v, got %v", test.include, test.exclude, test.path, test.ancestor, test.expected, selected)
+		}
+	}
+}
+
+func TestPathFilterBadPattern(t *testing.T) {
+	for _, pf := range []*pathFilter{
+		newPathFilter([]string{"etc/[a"}, nil),
+		newPathFilter(nil, []string{"etc/[a"}),
+	} {
+		if selected, err := pf.selected("etc/passwd", false); err == nil {
+			t.Errorf("expected an error with invalid pattern %+v -- got selected=%v", pf, selected)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/hardening"
+)
+
+// BlobSource provides the (possibly compressed) layer blobs extracted by
+// UnpackRootfsFromSource. This allows for layers to be extracted without
+// storing them in a local cas.Engine first, such as when streaming blobs
+// fetched from a registry.
+type BlobSource interface {
+	// OpenBlob returns a reader for the raw contents of the blob described by
+	// desc. Layers are opened in the order they appear in the manifest, and
+	// each reader is read to EOF and closed before the next layer is opened.
+	// The contents must be verified against desc (for instance, using
+	// hardening.VerifiedReadCloser).
+	OpenBlob(ctx context.Context, desc ispec.Descriptor) (io.ReadCloser, error)
+}
+
+// engineSource is a BlobSource backed by a cas.Engine.
+type engineSource struct {
+	engineExt casext.Engine
+}
+
+// OpenBlob implements BlobSource.
+func (s engineSource) OpenBlob(ctx context.Context, desc ispec.Descriptor) (io.ReadCloser, error) {
+	blob, err := s.engineExt.GetVerifiedBlob(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// LayerStream is the raw (possibly compressed) contents of a layer blob,
+// together with the descriptor of the blob.
+type LayerStream struct {
+	// Descriptor is the descriptor of the layer blob.
+	Descriptor ispec.Descriptor
+
+	// Reader provides the contents of the layer blob.
+	Reader io.Reader
+}
+
+// streamSource is a BlobSource backed by an ordered sequence of LayerStreams.
+type streamSource struct {
+	streams []LayerStream
+}
+
+// NewStreamSource returns a BlobSource which provides the given ordered
+// sequence of layer blob streams. Each stream can only be read once, and the
+// layers must be opened in the same order as the streams (though streams
+// skipped over by UnpackOptions.StartFrom are ignored). The contents of each
+// stream are verified against the digest and size of its descriptor.
+func NewStreamSource(streams []LayerStream) BlobSource {
+	return &streamSource{streams: streams}
+}
+
+// OpenBlob implements BlobSource.
+func (s *streamSource) OpenBlob(ctx context.Context, desc ispec.Descriptor) (io.ReadCloser, error) {
+	for len(s.streams) > 0 {
+		stream := s.streams[0]
+		s.streams = s.streams[1:]
+		if stream.Descriptor.Digest != desc.Digest {
+			continue
+		}
+		return &hardening.VerifiedReadCloser{
+			Reader:         ioutil.NopCloser(stream.Reader),
+			ExpectedDigest: desc.Digest,
+			ExpectedSize:   desc.Size,
+		}, nil
+	}
+	return nil, fmt.Errorf("no remaining layer stream for blob %s", desc.Digest)
+}
+
+// UnpackLayerStreams extracts the given ordered sequence of layer blob streams
+// to rootfsPath, as though they were the layers of an image with the provided
+// configuration (the DiffIDs of which are used to verify the layers). This is
+// a convenience wrapper around UnpackRootfsFromSource for callers which have
+// already fetched the layer blobs (such as registry clients), and so do not
+// have an image manifest stored in a cas.Engine.
+func UnpackLayerStreams(ctx context.Context, rootfsPath string, config ispec.Image, streams []LayerStream, opt *UnpackOptions) error {
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+		},
+	}
+	for _, stream := range streams {
+		manifest.Layers = append(manifest.Layers, stream.Descriptor)
+	}
+	return UnpackRootfsFromSource(ctx, NewStreamSource(streams), rootfsPath, config, manifest, opt)
+}
@@ -0,0 +1,202 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// makeLayerStream creates an in-memory gzip-compressed layer from the given
+// entries (with file contents taken from contents), returning the compressed
+// blob, its descriptor and the DiffID of the layer.
+func makeLayerStream(t *testing.T, hdrs []*tar.Header, contents map[string]string) ([]byte, ispec.Descriptor, digest.Digest) {
+	var layerBuf bytes.Buffer
+	tw := tar.NewWriter(&layerBuf)
+	for _, hdr := range hdrs {
+		data := contents[hdr.Name]
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromBytes(layerBuf.Bytes())
+
+	var blobBuf bytes.Buffer
+	gzw := gzip.NewWriter(&blobBuf)
+	if _, err := gzw.Write(layerBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blob := blobBuf.Bytes()
+
+	return blob, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}, diffID
+}
+
+func TestUnpackLayerStreams(t *testing.T) {
+	ctx := context.Background()
+
+	blob1, desc1, diffID1 := makeLayerStream(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+	}, map[string]string{
+		"etc/passwd": "root:x:0:0::/root:/bin/sh\n",
+		"etc/shadow": "root:*:::::::\n",
+	})
+	blob2, desc2, diffID2 := makeLayerStream(t, []*tar.Header{
+		{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{
+		"etc/hostname": "umoci\n",
+	})
+
+	config := ispec.Image{
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID1, diffID2},
+		},
+	}
+	// Map root to the current user.
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		rootfs, err := ioutil.TempDir("", "umoci-TestUnpackLayerStreams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(rootfs)
+
+		streams := []LayerStream{
+			{Descriptor: desc1, Reader: bytes.NewReader(blob1)},
+			{Descriptor: desc2, Reader: bytes.NewReader(blob2)},
+		}
+		if err := UnpackLayerStreams(ctx, rootfs, config, streams, unpackOptions); err != nil {
+			t.Fatalf("unexpected UnpackLayerStreams error: %+v", err)
+		}
+
+		for path, expected := range map[string]string{
+			"etc/passwd":   "root:x:0:0::/root:/bin/sh\n",
+			"etc/hostname": "umoci\n",
+		} {
+			got, err := ioutil.ReadFile(filepath.Join(rootfs, path))
+			if err != nil {
+				t.Errorf("reading extracted %s: %v", path, err)
+				continue
+			}
+			if string(got) != expected {
+				t.Errorf("unexpected contents of %s: expected %q got %q", path, expected, string(got))
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(rootfs, "etc/shadow")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("whiteout of etc/shadow was not applied: %v", err)
+		}
+	})
+
+	for _, test := range []struct {
+		name    string
+		streams []LayerStream
+		config  ispec.Image
+	}{
+		{"OutOfOrder", []LayerStream{
+			{Descriptor: desc2, Reader: bytes.NewReader(blob2)},
+			{Descriptor: desc1, Reader: bytes.NewReader(blob1)},
+		}, config},
+		{"DigestMismatch", []LayerStream{
+			{Descriptor: desc1, Reader: bytes.NewReader(blob2)},
+			{Descriptor: desc2, Reader: bytes.NewReader(blob2)},
+		}, config},
+		{"DiffIDMismatch", []LayerStream{
+			{Descriptor: desc1, Reader: bytes.NewReader(blob1)},
+			{Descriptor: desc2, Reader: bytes.NewReader(blob2)},
+		}, ispec.Image{
+			Platform: ispec.Platform{
+				OS: "linux",
+			},
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: []digest.Digest{diffID2, diffID1},
+			},
+		}},
+		{"MissingDiffID", []LayerStream{
+			{Descriptor: desc1, Reader: bytes.NewReader(blob1)},
+			{Descriptor: desc2, Reader: bytes.NewReader(blob2)},
+		}, ispec.Image{
+			Platform: ispec.Platform{
+				OS: "linux",
+			},
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: []digest.Digest{diffID1},
+			},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "umoci-TestUnpackLayerStreams")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			rootfs := filepath.Join(parent, "rootfs")
+
+			if err := UnpackLayerStreams(ctx, rootfs, test.config, test.streams, unpackOptions); err == nil {
+				t.Errorf("expected UnpackLayerStreams to fail")
+			}
+			// The rootfs is removed on failure.
+			if _, err := os.Lstat(rootfs); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("rootfs was not removed after failure: %v", err)
+			}
+		})
+	}
+}
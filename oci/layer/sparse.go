@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"os"
+)
+
+// sparseBlockSize is the granularity with which runs of zeroes in regular
+// files are turned into holes when unpacking. Only complete, aligned blocks of
+// zeroes are treated as holes.
+const sparseBlockSize = 4096
+
+// zeroBlock is a block of zeroes, used to check whether a block is all zero.
+var zeroBlock [sparseBlockSize]byte
+
+// isZero returns whether b (which is at most sparseBlockSize bytes) only
+// contains zeroes.
+func isZero(b []byte) bool {
+	return bytes.Equal(b, zeroBlock[:len(b)])
+}
+
+// sparseWriter is an io.Writer for the contents of a newly-created regular
+// file, which skips over (rather than writing) every block of zeroes so that
+// the file is created with holes in their place. Close must be called once all
+// of the contents have been written, to write any incomplete final block and
+// set the size of the file (in case it ends with a hole).
+type sparseWriter struct {
+	fh      *os.File
+	off     int64
+	pending []byte
+}
+
+// writeBlocks writes the data blocks of b to the file at sw.off, skipping
+// blocks of zeroes. b must be a whole number of blocks, except when it
+// contains the final part of the file.
+func (sw *sparseWriter) writeBlocks(b []byte) error {
+	start := 0 // start of the current run of data blocks
+	for idx := 0; idx < len(b); idx += sparseBlockSize {
+		end := idx + sparseBlockSize
+		if end > len(b) {
+			end = len(b)
+		}
+		if !isZero(b[idx:end]) {
+			continue
+		}
+		if start < idx {
+			if _, err := sw.fh.WriteAt(b[start:idx], sw.off+int64(start)); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	if start < len(b) {
+		if _, err := sw.fh.WriteAt(b[start:], sw.off+int64(start)); err != nil {
+			return err
+		}
+	}
+	sw.off += int64(len(b))
+	return nil
+}
+
+// Write implements io.Writer.
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	// Complete any partial block from the last write first.
+	if len(sw.pending) > 0 {
+		fill := sparseBlockSize - len(sw.pending)
+		if fill > len(p) {
+			fill = len(p)
+		}
+		sw.pending = append(sw.pending, p[:fill]...)
+		p = p[fill:]
+		if len(sw.pending) < sparseBlockSize {
+			return n, nil
+		}
+		if err := sw.writeBlocks(sw.pending); err != nil {
+			return 0, err
+		}
+		sw.pending = sw.pending[:0]
+	}
+	full := len(p) - len(p)%sparseBlockSize
+	if err := sw.writeBlocks(p[:full]); err != nil {
+		return 0, err
+	}
+	sw.pending = append(sw.pending, p[full:]...)
+	return n, nil
+}
+
+// Close writes any incomplete final block and sets the size of the file. It
+// does not close the underlying file.
+func (sw *sparseWriter) Close() error {
+	if err := sw.writeBlocks(sw.pending); err != nil {
+		return err
+	}
+	sw.pending = nil
+	return sw.fh.Truncate(sw.off)
+}
@@ -0,0 +1,104 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sparseTestContents returns file contents with a mix of data and blocks of
+// zeroes, optionally ending with a hole (otherwise ending with a partial
+// block).
+func sparseTestContents(trailingHole bool) []byte {
+	size := 10 * sparseBlockSize
+	if !trailingHole {
+		size += 123
+	}
+	data := make([]byte, size)
+	copy(data, "header")
+	// A run of data which straddles a block boundary.
+	copy(data[3*sparseBlockSize-10:], bytes.Repeat([]byte("x"), 20))
+	data[6*sparseBlockSize+7] = 'y'
+	return data
+}
+
+func TestSparseWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSparseWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, trailingHole := range []bool{false, true} {
+		contents := sparseTestContents(trailingHole)
+		for _, chunkSize := range []int{1, 100, sparseBlockSize - 1, sparseBlockSize, 3*sparseBlockSize + 5, len(contents)} {
+			t.Run(fmt.Sprintf("TrailingHole=%v,ChunkSize=%d", trailingHole, chunkSize), func(t *testing.T) {
+				path := filepath.Join(dir, "file")
+				fh, err := os.Create(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer fh.Close()
+
+				sw := &sparseWriter{fh: fh}
+				for off := 0; off < len(contents); off += chunkSize {
+					end := off + chunkSize
+					if end > len(contents) {
+						end = len(contents)
+					}
+					if n, err := sw.Write(contents[off:end]); err != nil || n != end-off {
+						t.Fatalf("write chunk at %d: unexpected result: n=%d err=%v", off, n, err)
+					}
+				}
+				if err := sw.Close(); err != nil {
+					t.Fatalf("close sparse writer: %+v", err)
+				}
+
+				got, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, contents) {
+					t.Errorf("unexpected contents written by sparseWriter")
+				}
+			})
+		}
+	}
+}
+
+// writeSparseFile writes contents to path, leaving every block of zeroes as a
+// hole (if the filesystem supports them).
+func writeSparseFile(t *testing.T, path string, contents []byte) {
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	sw := &sparseWriter{fh: fh}
+	if _, err := sw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
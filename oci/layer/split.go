@@ -0,0 +1,123 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// SplitByPath divides the layer changeset read from r into several
+// changesets based on the paths of its entries, writing them to ws (which
+// must have exactly len(prefixes)+2 entries). ws[0] receives all of the
+// whiteouts in the layer, ws[1] receives every entry not under any of the
+// given prefixes, and ws[i+2] receives the entries under prefixes[i]. Entries
+// are assigned to the longest matching prefix, and hardlinks are always kept
+// in the same changeset as their target.
+//
+// Applying the non-empty changesets in the order of ws has the same effect as
+// applying the original layer. The number of entries written to each
+// changeset is returned so that callers can skip empty ones. The writers are
+// not closed.
+func SplitByPath(r io.Reader, prefixes []string, ws []io.Writer) ([]int, error) {
+	if len(ws) != len(prefixes)+2 {
+		return nil, fmt.Errorf("split layer: expected %d writers, got %d", len(prefixes)+2, len(ws))
+	}
+
+	cleanPrefixes := make([]string, len(prefixes))
+	for idx, prefix := range prefixes {
+		prefix = CleanPath("/" + prefix)
+		if prefix == "/" {
+			return nil, errors.New("split layer: prefix cannot be the root directory")
+		}
+		for _, other := range cleanPrefixes[:idx] {
+			if other == prefix {
+				return nil, fmt.Errorf("split layer: duplicate prefix %q", prefix)
+			}
+		}
+		cleanPrefixes[idx] = prefix
+	}
+
+	tws := make([]*tar.Writer, len(ws))
+	for idx, w := range ws {
+		tws[idx] = tar.NewWriter(w)
+	}
+	counts := make([]int, len(ws))
+	// Which changeset each (non-whiteout) path was written to, so that
+	// hardlinks can follow their targets.
+	buckets := make(map[string]int)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read next entry: %w", err)
+		}
+
+		path := CleanPath("/" + hdr.Name)
+		bucket := 1
+		switch {
+		case strings.HasPrefix(filepath.Base(path), whPrefix):
+			bucket = 0
+		case hdr.Typeflag == tar.TypeLink:
+			if target, ok := buckets[CleanPath("/"+hdr.Linkname)]; ok {
+				bucket = target
+				break
+			}
+			fallthrough
+		default:
+			longest := ""
+			for idx, prefix := range cleanPrefixes {
+				if len(prefix) > len(longest) && pathUnder(path, prefix) {
+					longest, bucket = prefix, idx+2
+				}
+			}
+		}
+		if bucket != 0 {
+			buckets[path] = bucket
+		}
+
+		if err := tws[bucket].WriteHeader(hdr); err != nil {
+			return nil, fmt.Errorf("write header %q: %w", hdr.Name, err)
+		}
+		if _, err := io.Copy(tws[bucket], tr); err != nil {
+			return nil, fmt.Errorf("copy entry %q: %w", hdr.Name, err)
+		}
+		counts[bucket]++
+	}
+
+	for idx, tw := range tws {
+		if err := tw.Close(); err != nil {
+			return nil, fmt.Errorf("close changeset %d: %w", idx, err)
+		}
+	}
+	return counts, nil
+}
+
+// pathUnder returns whether the cleaned absolute path is prefix or is inside
+// the directory prefix (matching whole path components only).
+func pathUnder(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -23,14 +23,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	securejoin "github.com/cyphar/filepath-securejoin"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/selinux"
 	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/opencontainers/umoci/third_party/shared"
 	"golang.org/x/sys/unix"
@@ -65,6 +69,25 @@ type TarExtractor struct {
 	// are fully symlink-expanded so no need to worry about that line noise.
 	upperPaths map[string]struct{}
 
+	// maxTrackedPaths and trackedPathsLimit are the corresponding options
+	// from the UnpackOptions supplied when this TarExtractor was constructed.
+	maxTrackedPaths   int
+	trackedPathsLimit TrackedPathsLimitMode
+
+	// upperPathsSpill is the temporary directory to which upperPaths is
+	// flushed whenever it holds maxTrackedPaths paths with
+	// TrackedPathsLimitSpill, so that at most maxTrackedPaths paths are kept
+	// in memory. Each spilled path is stored as a directory at the same path
+	// within upperPathsSpill. It is empty until the first flush.
+	upperPathsSpill string
+
+	// maxUncompressedSize is the maximum number of bytes of regular file
+	// contents which may be written, and written is the number written so
+	// far. written may be shared with other TarExtractors so that the limit
+	// applies across several layers.
+	maxUncompressedSize int64
+	written             *int64
+
 	// enotsupWarned is a flag set when we encounter the first ENOTSUP error
 	// dealing with xattrs. This is used to ensure extraction to a destination
 	// file system that does not support xattrs raises a single warning, rather
@@ -78,6 +101,97 @@ type TarExtractor struct {
 
 	// whiteoutMode indicates how this TarExtractor will handle whiteouts.
 	whiteoutMode WhiteoutMode
+
+	// platform is the platform of the image being extracted, used to decide
+	// whether Linux-specific extraction steps should be applied.
+	platform ispec.Platform
+
+	// clock returns the time used in place of missing mtimes (see
+	// UnpackOptions.Clock).
+	clock func() time.Time
+
+	// maxXattrSize and rejectOversizedXattrs are the corresponding options
+	// from the UnpackOptions supplied when this TarExtractor was constructed.
+	maxXattrSize          int
+	rejectOversizedXattrs bool
+
+	// strictXattrs indicates that failing to apply an xattr should be an
+	// error rather than a warning.
+	strictXattrs bool
+
+	// xattrNamespaces is the set of xattr namespaces (such as "user") which
+	// will be applied to extracted files. If nil, all namespaces are applied.
+	xattrNamespaces map[string]struct{}
+
+	// fileContexts is used to label extracted paths, if set (see
+	// UnpackOptions.SELinuxFileContexts).
+	fileContexts *selinux.FileContexts
+
+	// copyBufferSize is the size of the buffer used to copy the contents of
+	// regular files (see UnpackOptions.CopyBufferSize).
+	copyBufferSize int
+
+	// sequentialIO indicates whether to advise the kernel that regular files
+	// will be written sequentially (see UnpackOptions.SequentialIO).
+	sequentialIO bool
+
+	// reflinkFrom is the root filesystem whose files are reflinked into the
+	// extracted regular files (see UnpackOptions.ReflinkFrom), and
+	// reflinkUnsupported is set once a reflink has failed because they are
+	// not supported (so that they aren't attempted for every file).
+	reflinkFrom        string
+	reflinkUnsupported bool
+
+	// detectSparse indicates whether blocks of zeroes in regular files are
+	// left as holes (see UnpackOptions.DetectSparse).
+	detectSparse bool
+
+	// denyPaths are the cleaned absolute forms of UnpackOptions.DenyPaths.
+	denyPaths []string
+
+	// pathFilter selects which entries are extracted, based on
+	// UnpackOptions.IncludePaths and UnpackOptions.ExcludePaths. If nil,
+	// every entry is extracted.
+	pathFilter *pathFilter
+
+	// numericOwner is the corresponding flag from the UnpackOptions supplied
+	// when this TarExtractor was constructed.
+	numericOwner bool
+
+	// whiteoutsOnly indicates that every entry other than a whiteout should be
+	// skipped.
+	whiteoutsOnly bool
+
+	// skipEmptyLinkTargets indicates that link entries with an empty target
+	// should be skipped rather than treated as an error.
+	skipEmptyLinkTargets bool
+
+	// hardlinkOrder is the corresponding option from the UnpackOptions
+	// supplied when this TarExtractor was constructed. With
+	// HardlinkOrderDefer, deferredLinks are the hardlink entries (in order)
+	// which will be created by CreateDeferredLinks, and creatingDeferredLinks
+	// is set while they are being created.
+	hardlinkOrder         HardlinkOrderMode
+	deferredLinks         []deferredLink
+	creatingDeferredLinks bool
+
+	// restoreBirthTime indicates that recorded birth times should be applied
+	// to extracted files.
+	restoreBirthTime bool
+
+	// noClobberTypeChange indicates that replacing a directory with a
+	// non-directory (or vice versa) should be an error.
+	noClobberTypeChange bool
+
+	// btimeWarned is used to ensure we only warn once about birth times
+	// being unsupported.
+	btimeWarned bool
+
+	// diagnostics receives a Diagnostic for each warning.
+	diagnostics DiagnosticFunc
+
+	// onProgress is called to report the progress of each entry.
+	onProgress ProgressFunc
 }
 
 // NewTarExtractor creates a new TarExtractor.
@@ -86,36 +200,226 @@ func NewTarExtractor(opt UnpackOptions) *TarExtractor {
 	if opt.MapOptions.Rootless {
 		fsEval = fseval.Rootless
 	}
+	if opt.FsEval != nil {
+		fsEval = opt.FsEval
+	}
+
+	clock := opt.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+
+	var denyPaths []string
+	for _, path := range opt.DenyPaths {
+		denyPaths = append(denyPaths, filepath.Join("/", CleanPath(path)))
+	}
+
+	var xattrNamespaces map[string]struct{}
+	if opt.XattrNamespaces != nil {
+		xattrNamespaces = make(map[string]struct{})
+		for _, namespace := range opt.XattrNamespaces {
+			xattrNamespaces[strings.TrimSuffix(namespace, ".")] = struct{}{}
+		}
+	}
 
 	return &TarExtractor{
-		mapOptions:      opt.MapOptions,
-		partialRootless: opt.MapOptions.Rootless || inUserNamespace,
-		fsEval:          fsEval,
-		upperPaths:      make(map[string]struct{}),
-		enotsupWarned:   false,
-		keepDirlinks:    opt.KeepDirlinks,
-		whiteoutMode:    opt.WhiteoutMode,
+		mapOptions:        opt.MapOptions,
+		partialRootless:   opt.MapOptions.Rootless || inUserNamespace,
+		fsEval:            fsEval,
+		upperPaths:        make(map[string]struct{}),
+		maxTrackedPaths:   opt.MaxTrackedPaths,
+		trackedPathsLimit: opt.TrackedPathsLimit,
+		enotsupWarned:     false,
+		keepDirlinks:      opt.KeepDirlinks,
+		whiteoutMode:      opt.WhiteoutMode,
+		platform:          opt.Platform,
+		clock:             clock,
+
+		maxXattrSize:          opt.MaxXattrSize,
+		rejectOversizedXattrs: opt.RejectOversizedXattrs,
+		strictXattrs:          opt.StrictXattrs,
+		xattrNamespaces:       xattrNamespaces,
+		fileContexts:          opt.SELinuxFileContexts,
+
+		copyBufferSize: opt.CopyBufferSize,
+		sequentialIO:   opt.SequentialIO,
+		reflinkFrom:    opt.ReflinkFrom,
+		detectSparse:   opt.DetectSparse,
+
+		maxUncompressedSize: opt.MaxUncompressedSize,
+		written:             new(int64),
+
+		denyPaths:     denyPaths,
+		pathFilter:    newPathFilter(opt.IncludePaths, opt.ExcludePaths),
+		numericOwner:  opt.NumericOwner,
+		whiteoutsOnly: opt.WhiteoutsOnly,
+
+		skipEmptyLinkTargets: opt.SkipEmptyLinkTargets,
+		hardlinkOrder:        opt.HardlinkOrder,
+		restoreBirthTime:     opt.RestoreBirthTime,
+		noClobberTypeChange:  opt.NoClobberTypeChange,
+
+		diagnostics: opt.OnDiagnostic,
+		onProgress:  opt.OnProgress,
+	}
+}
+
+// windowsPlatform returns whether the image being extracted is a Windows
+// image, where Linux-specific metadata (device nodes, xattrs) has no meaning.
+// Every other platform (including an unset one) is extracted as though it
+// were Linux, to match the historical behaviour.
+func (te *TarExtractor) windowsPlatform() bool {
+	return te.platform.OS == "windows"
+}
+
+// pathInside returns whether path is the same as, or lexically beneath, dir.
+// Both paths must be clean and absolute.
+func pathInside(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// isDenied returns whether the given path (relative to the root filesystem,
+// with symlinks already resolved) is one of te.denyPaths or is beneath one of
+// them. If removes is set, the path is also denied if any of te.denyPaths are
+// beneath it (because the operation would remove them as well).
+func (te *TarExtractor) isDenied(path string, removes bool) bool {
+	path = filepath.Join("/", CleanPath(path))
+	for _, deny := range te.denyPaths {
+		if pathInside(path, deny) || (removes && pathInside(deny, path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedEntry returns whether unpacking the entry described by hdr (which
+// resolved to the given file in dir) would modify one of te.denyPaths.
+func (te *TarExtractor) deniedEntry(root, dir, file string, hdr *tar.Header) (bool, error) {
+	// Anything other than a directory replaces whatever is at the path.
+	target, removes := filepath.Join(dir, file), hdr.Typeflag != tar.TypeDir
+	if strings.HasPrefix(file, whPrefix) {
+		// Whiteouts modify the path they refer to, not the whiteout path.
+		target, removes = filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), true
+		if file == whOpaque {
+			target = dir
+		}
+	}
+	relTarget, err := filepath.Rel(root, target)
+	if err != nil {
+		return false, fmt.Errorf("get relative path of entry: %w", err)
+	}
+	if te.isDenied(relTarget, removes) {
+		return true, nil
 	}
+
+	// Hardlinks share their inode with the link target, so changing the
+	// metadata of the new path would modify the target as well.
+	if hdr.Typeflag == tar.TypeLink {
+		unsafeLinkDir, linkFile := filepath.Split(CleanPath(hdr.Linkname))
+		linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
+		if err != nil {
+			return false, fmt.Errorf("sanitise hardlink target in root: %w", err)
+		}
+		relLink, err := filepath.Rel(root, filepath.Join(linkDir, linkFile))
+		if err != nil {
+			return false, fmt.Errorf("get relative path of hardlink target: %w", err)
+		}
+		if te.isDenied(relLink, false) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// filteredEntry returns whether the entry described by hdr (with the given
+// unsafeDir and file components of its path) is selected for extraction by
+// te.pathFilter. Unlike deniedEntry, the paths in the archive are used as-is
+// (without resolving symlinks), since this is only used to restrict what is
+// extracted rather than for security.
+func (te *TarExtractor) filteredEntry(unsafeDir, file string, hdr *tar.Header) (bool, error) {
+	// Whiteouts are selected based on the path they remove, and must be
+	// applied if they could remove any selected path.
+	target, ancestor := filepath.Join(unsafeDir, file), hdr.Typeflag == tar.TypeDir
+	if strings.HasPrefix(file, whPrefix) {
+		target, ancestor = filepath.Join(unsafeDir, strings.TrimPrefix(file, whPrefix)), true
+		if file == whOpaque {
+			target = unsafeDir
+		}
+	}
+	selected, err := te.pathFilter.selected(target, ancestor)
+	if err != nil {
+		return false, err
+	}
+	if !selected {
+		log.Debugf("skipping filtered entry %q", hdr.Name)
+		return false, nil
+	}
+
+	// A hardlink to a file which wasn't extracted cannot be created.
+	if hdr.Typeflag == tar.TypeLink {
+		selected, err := te.pathFilter.selected(hdr.Linkname, false)
+		if err != nil {
+			return false, err
+		}
+		if !selected {
+			te.diagnostics.warnf(DiagnosticFilteredLinkTarget, hdr.Name, "skipping entry %q: hardlink target %q is not being extracted", hdr.Name, hdr.Linkname)
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 // restoreMetadata applies the state described in tar.Header to the filesystem
 // at the given path. No sanity checking is done of the tar.Header's pathname
-// or other information. In addition, no mapping is done of the header.
-func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
+// or other information. In addition, no mapping is done of the header. If
+// expected is non-nil, the metadata is only applied if the inode at path is
+// still the same file as expected (which detects the path being swapped out
+// from underneath us, such as with a hardlink to some other file).
+func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header, expected os.FileInfo) error {
 	// Some of the tar.Header fields don't match the OS API.
 	fi := hdr.FileInfo()
 
+	// Pin the inode at path, so that all of the metadata changes below (other
+	// than xattrs, which cannot be modified through O_PATH handles) are
+	// applied to the same inode even if path is swapped out from underneath
+	// us. If this isn't supported on this system, we fall back to operating
+	// on the path.
+	fh, err := te.fsEval.Lopen(path)
+	if err != nil {
+		if !errors.Is(err, system.ErrFdMetadataUnsupported) {
+			return fmt.Errorf("restore metadata: pin inode: %s: %w", path, err)
+		}
+		fh = nil
+	}
+	if fh != nil {
+		defer fh.Close()
+	}
+
 	// Get the _actual_ file info to figure out if the path is a symlink.
 	isSymlink := hdr.Typeflag == tar.TypeSymlink
-	if realFi, err := te.fsEval.Lstat(path); err == nil {
+	var realFi os.FileInfo
+	if fh != nil {
+		realFi, err = fh.Stat()
+	} else {
+		realFi, err = te.fsEval.Lstat(path)
+	}
+	if err == nil {
 		isSymlink = realFi.Mode()&os.ModeSymlink == os.ModeSymlink
+		if expected != nil && !sameFile(expected, realFi) {
+			return fmt.Errorf("restore metadata: %s: inode was replaced during extraction", path)
+		}
 	}
 
 	// Apply the owner. If we are rootless then "user.rootlesscontainers" has
 	// already been set up by unmapHeader, so nothing to do here.
 	if !te.mapOptions.Rootless {
-		// NOTE: This is not done through fsEval.
-		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		var err error
+		if fh != nil {
+			err = te.fsEval.Fchown(fh, hdr.Uid, hdr.Gid)
+		} else {
+			err = te.fsEval.Lchown(path, hdr.Uid, hdr.Gid)
+		}
+		if err != nil {
 			return fmt.Errorf("restore chown metadata: %s: %w", path, err)
 		}
 	}
@@ -125,7 +429,14 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 	// we've applied the owner because setuid bits are cleared when changing
 	// owner (in rootless we don't care because we're always the owner).
 	if !isSymlink {
-		if err := te.fsEval.Chmod(path, fi.Mode()); err != nil {
+		err := system.ErrFdMetadataUnsupported
+		if fh != nil {
+			err = te.fsEval.Fchmod(fh, fi.Mode())
+		}
+		if errors.Is(err, system.ErrFdMetadataUnsupported) {
+			err = te.fsEval.Chmod(path, fi.Mode())
+		}
+		if err != nil {
 			return fmt.Errorf("restore chmod metadata: %s: %w", path, err)
 		}
 	}
@@ -136,7 +447,7 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 	mtime := hdr.ModTime
 	if mtime.IsZero() {
 		// XXX: Should we instead default to atime if it's non-zero?
-		mtime = time.Now()
+		mtime = te.clock()
 	}
 	atime := hdr.AccessTime
 	if atime.IsZero() {
@@ -146,93 +457,220 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 
 	// Apply xattrs. In order to make sure that we *only* have the xattr set we
 	// want, we first clear the set of xattrs from the file then apply the ones
-	// set in the tar.Header.
-	err := te.fsEval.Lclearxattrs(path, ignoreXattrs)
-	if err != nil {
-		if !errors.Is(err, unix.ENOTSUP) {
-			return fmt.Errorf("clear xattr metadata: %s: %w", path, err)
+	// set in the tar.Header. Xattrs are meaningless for Windows images, so we
+	// leave them alone entirely.
+	if te.windowsPlatform() {
+		if len(hdr.Xattrs) > 0 {
+			log.Debugf("platform{%s} ignoring xattrs for %s image", hdr.Name, te.platform.OS)
 		}
-		if !te.enotsupWarned {
-			log.Warnf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
-			log.Warnf("xattr{%s} destination filesystem does not support xattrs, further warnings will be suppressed", path)
-			te.enotsupWarned = true
-		} else {
-			log.Debugf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
-		}
-	}
-
-	for name, value := range hdr.Xattrs {
-		value := []byte(value)
-
-		// Forbidden xattrs should never be touched.
-		if _, skip := ignoreXattrs[name]; skip {
-			// If the xattr is already set to the requested value, don't bail.
-			// The reason for this logic is kinda convoluted, but effectively
-			// because restoreMetadata is called with the *on-disk* metadata we
-			// run the risk of things like "security.selinux" being included in
-			// that metadata (and thus tripping the forbidden xattr error). By
-			// only touching xattrs that have a different value we are somewhat
-			// more efficient and we don't have to special case parent restore.
-			// Of course this will only ever impact ignoreXattrs.
-			if oldValue, err := te.fsEval.Lgetxattr(path, name); err == nil {
-				if bytes.Equal(value, oldValue) {
-					log.Debugf("restore xattr metadata: skipping already-set xattr %q: %s", name, hdr.Name)
-					continue
-				}
+	} else {
+		if err := te.fsEval.Lclearxattrs(path, te.keepXattrs(path)); err != nil {
+			if !errors.Is(err, unix.ENOTSUP) {
+				return fmt.Errorf("clear xattr metadata: %s: %w", path, err)
+			}
+			if !te.enotsupWarned {
+				te.diagnostics.warnf(DiagnosticXattrUnsupported, hdr.Name, "xattr{%s} ignoring ENOTSUP on clearxattrs", path)
+				log.Warnf("xattr{%s} destination filesystem does not support xattrs, further warnings will be suppressed", path)
+				te.enotsupWarned = true
+			} else {
+				log.Debugf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
+				te.diagnostics.report(DiagnosticXattrUnsupported, hdr.Name, "xattr{%s} ignoring ENOTSUP on clearxattrs", path)
 			}
-			log.Warnf("xattr{%s} ignoring forbidden xattr: %q", hdr.Name, name)
-			continue
 		}
-		if err := te.fsEval.Lsetxattr(path, name, value, 0); err != nil {
-			// In rootless mode, some xattrs will fail (security.capability).
-			// This is _fine_ as long as we're not running as root (in which
-			// case we shouldn't be ignoring xattrs that we were told to set).
-			//
-			// TODO: We should translate all security.capability capabilities
-			//       into v3 capabilities, which allow us to write them as
-			//       unprivileged users (we also would need to translate them
-			//       back when creating archives).
-			if te.partialRootless && errors.Is(err, os.ErrPermission) {
-				log.Warnf("rootless{%s} ignoring (usually) harmless EPERM on setxattr %q", hdr.Name, name)
+
+		for name, value := range hdr.Xattrs {
+			value := []byte(value)
+
+			// Xattrs outside of the requested namespaces are silently skipped.
+			if !te.xattrAllowed(name) {
+				log.Debugf("xattr{%s} skipping xattr %q outside of the requested namespaces", hdr.Name, name)
 				continue
 			}
-			// We cannot do much if we get an ENOTSUP -- this usually means
-			// that extended attributes are simply unsupported by the
-			// underlying filesystem (such as AUFS or NFS).
-			if errors.Is(err, unix.ENOTSUP) {
-				if !te.enotsupWarned {
-					log.Warnf("xattr{%s} ignoring ENOTSUP on setxattr %q", hdr.Name, name)
-					log.Warnf("xattr{%s} destination filesystem does not support xattrs, further warnings will be suppressed", path)
-					te.enotsupWarned = true
-				} else {
-					log.Debugf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
+
+			// Forbidden xattrs should never be touched.
+			if _, skip := ignoreXattrs[name]; skip {
+				// If the xattr is already set to the requested value, don't bail.
+				// The reason for this logic is kinda convoluted, but effectively
+				// because restoreMetadata is called with the *on-disk* metadata we
+				// run the risk of things like "security.selinux" being included in
+				// that metadata (and thus tripping the forbidden xattr error). By
+				// only touching xattrs that have a different value we are somewhat
+				// more efficient and we don't have to special case parent restore.
+				// Of course this will only ever impact ignoreXattrs.
+				if oldValue, err := te.fsEval.Lgetxattr(path, name); err == nil {
+					if bytes.Equal(value, oldValue) {
+						log.Debugf("restore xattr metadata: skipping already-set xattr %q: %s", name, hdr.Name)
+						continue
+					}
 				}
+				te.diagnostics.warnf(DiagnosticXattrForbidden, hdr.Name, "xattr{%s} ignoring forbidden xattr: %q", hdr.Name, name)
 				continue
 			}
-			return fmt.Errorf("restore xattr metadata: %s: %w", path, err)
+			if err := te.fsEval.Lsetxattr(path, name, value, 0); err != nil {
+				// The user asked us to not ignore any failures.
+				if te.strictXattrs {
+					return fmt.Errorf("restore xattr metadata: %s: setxattr %q (strict xattrs enabled): %w", path, name, err)
+				}
+				// In rootless mode, some xattrs will fail (security.capability).
+				// This is _fine_ as long as we're not running as root (in which
+				// case we shouldn't be ignoring xattrs that we were told to set).
+				//
+				// TODO: We should translate all security.capability capabilities
+				//       into v3 capabilities, which allow us to write them as
+				//       unprivileged users (we also would need to translate them
+				//       back when creating archives).
+				if te.partialRootless && errors.Is(err, os.ErrPermission) {
+					te.diagnostics.warnf(DiagnosticRootlessEPERM, hdr.Name, "rootless{%s} ignoring (usually) harmless EPERM on setxattr %q", hdr.Name, name)
+					continue
+				}
+				// We cannot do much if we get an ENOTSUP -- this usually means
+				// that extended attributes are simply unsupported by the
+				// underlying filesystem (such as AUFS or NFS).
+				if errors.Is(err, unix.ENOTSUP) {
+					if !te.enotsupWarned {
+						te.diagnostics.warnf(DiagnosticXattrUnsupported, hdr.Name, "xattr{%s} ignoring ENOTSUP on setxattr %q", hdr.Name, name)
+						log.Warnf("xattr{%s} destination filesystem does not support xattrs, further warnings will be suppressed", path)
+						te.enotsupWarned = true
+					} else {
+						log.Debugf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
+						te.diagnostics.report(DiagnosticXattrUnsupported, hdr.Name, "xattr{%s} ignoring ENOTSUP on setxattr %q", hdr.Name, name)
+					}
+					continue
+				}
+				return fmt.Errorf("restore xattr metadata: %s: %w", path, err)
+			}
 		}
 	}
 
-	if err := te.fsEval.Lutimes(path, atime, mtime); err != nil {
+	// Symlink times can only be changed through the path, since utimensat(2)
+	// would otherwise follow the symlink.
+	err = system.ErrFdMetadataUnsupported
+	if fh != nil && !isSymlink {
+		err = te.fsEval.Futimes(fh, atime, mtime)
+	}
+	if errors.Is(err, system.ErrFdMetadataUnsupported) {
+		err = te.fsEval.Lutimes(path, atime, mtime)
+	}
+	if err != nil {
 		return fmt.Errorf("restore lutimes metadata: %s: %w", path, err)
 	}
 
 	return nil
 }
 
+// xattrAllowed returns whether the named xattr is in one of the namespaces
+// which should be applied to extracted files.
+func (te *TarExtractor) xattrAllowed(name string) bool {
+	if te.xattrNamespaces == nil {
+		return true
+	}
+	namespace := name
+	if idx := strings.Index(name, "."); idx >= 0 {
+		namespace = name[:idx]
+	}
+	_, ok := te.xattrNamespaces[namespace]
+	return ok
+}
+
+// keepXattrs returns the set of xattrs which should not be cleared from path
+// before applying the xattrs of an entry. This is ignoreXattrs along with any
+// existing xattrs outside of the requested namespaces (which we must not
+// touch).
+func (te *TarExtractor) keepXattrs(path string) map[string]struct{} {
+	if te.xattrNamespaces == nil {
+		return ignoreXattrs
+	}
+	// If we can't list the xattrs, Lclearxattrs will hit the same error.
+	names, err := te.fsEval.Llistxattr(path)
+	if err != nil {
+		return ignoreXattrs
+	}
+	keep := make(map[string]struct{}, len(ignoreXattrs))
+	for name := range ignoreXattrs {
+		keep[name] = struct{}{}
+	}
+	for _, name := range names {
+		if !te.xattrAllowed(name) {
+			keep[name] = struct{}{}
+		}
+	}
+	return keep
+}
+
 // applyMetadata applies the state described in tar.Header to the filesystem at
 // the given path, using the state of the TarExtractor to remap information
 // within the header. This should only be used with headers from a tar layer
 // (not from the filesystem). No sanity checking is done of the tar.Header's
-// pathname or other information.
-func (te *TarExtractor) applyMetadata(path string, hdr *tar.Header) error {
+// pathname or other information. See restoreMetadata for the meaning of
+// expected.
+func (te *TarExtractor) applyMetadata(path string, hdr *tar.Header, expected os.FileInfo) error {
+	// Drop any xattrs which are too large to apply. The header belongs to
+	// the caller, so the oversized xattrs are removed from a copy.
+	if te.maxXattrSize > 0 {
+		var oversized []string
+		for name, value := range hdr.Xattrs {
+			if len(value) <= te.maxXattrSize || !te.xattrAllowed(name) {
+				continue
+			}
+			if te.rejectOversizedXattrs {
+				return fmt.Errorf("xattr %q is too large (%d > %d bytes)", name, len(value), te.maxXattrSize)
+			}
+			te.diagnostics.warnf(DiagnosticXattrOversized, hdr.Name, "xattr{%s} ignoring oversized xattr %q (%d > %d bytes)", hdr.Name, name, len(value), te.maxXattrSize)
+			oversized = append(oversized, name)
+		}
+		if len(oversized) > 0 {
+			hdr = copyHeader(hdr)
+			for _, name := range oversized {
+				delete(hdr.Xattrs, name)
+			}
+		}
+	}
+
 	// Modify the header.
 	if err := unmapHeader(hdr, te.mapOptions); err != nil {
 		return fmt.Errorf("unmap header: %w", err)
 	}
 
 	// Restore it on the filesystme.
-	return te.restoreMetadata(path, hdr)
+	if err := te.restoreMetadata(path, hdr, expected); err != nil {
+		return err
+	}
+
+	if value, ok := hdr.PAXRecords[paxBirthTime]; ok && te.restoreBirthTime {
+		if err := te.restoreBtime(path, value); err != nil {
+			return fmt.Errorf("restore birth time: %w", err)
+		}
+	}
+
+	if te.whiteoutMode == OverlayFSWhiteout && !te.windowsPlatform() {
+		if err := te.restoreOverlayXattrs(path, hdr.PAXRecords); err != nil {
+			return fmt.Errorf("restore overlay xattrs: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreBtime applies the birth time recorded in a PAX record to the given
+// path. Since most systems don't permit modifying the birth time of a file,
+// this is best-effort and only warns if it is unsupported.
+func (te *TarExtractor) restoreBtime(path, value string) error {
+	btime, err := parsePAXTime(value)
+	if err != nil {
+		return err
+	}
+	err = te.fsEval.Lsetbtime(path, btime)
+	if errors.Is(err, system.ErrBirthTimeUnsupported) {
+		if !te.btimeWarned {
+			te.diagnostics.warnf(DiagnosticBirthTimeUnsupported, path, "btime{%s} ignoring unsupported birth time restoration", path)
+			log.Warnf("btime{%s} birth times cannot be set on this system, further warnings will be suppressed", path)
+			te.btimeWarned = true
+		} else {
+			log.Debugf("btime{%s} ignoring unsupported birth time restoration", path)
+			te.diagnostics.report(DiagnosticBirthTimeUnsupported, path, "btime{%s} ignoring unsupported birth time restoration", path)
+		}
+		return nil
+	}
+	return err
 }
 
 // isDirlink returns whether the given path is a link to a directory (or a
@@ -341,7 +779,11 @@ func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error
 		}
 
 		// Remove the path only if it hasn't been touched.
-		if _, ok := te.upperPaths[upperPath]; !ok {
+		touched, err := te.hasUpperPath(upperPath)
+		if err != nil {
+			return err
+		}
+		if !touched {
 			// Opaque whiteouts don't remove the directory itself, so skip
 			// the top-level directory.
 			if isOpaque && CleanPath(path) == CleanPath(subpath) {
@@ -378,7 +820,7 @@ func (te *TarExtractor) overlayFSWhiteout(dir string, file string) error {
 
 	// otherwise, white out the file itself.
 	p := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
-	if err := os.RemoveAll(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := te.fsEval.RemoveAll(p); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("couldn't create overlayfs whiteout for %s: %w", p, err)
 	}
 
@@ -388,6 +830,132 @@ func (te *TarExtractor) overlayFSWhiteout(dir string, file string) error {
 	return nil
 }
 
+// reflinkEntry tries to turn fh (the newly-created regular file at path for
+// hdr) into a reflink of the file at the same path in te.reflinkFrom. If this
+// succeeds, the contents of the entry must be written using the returned
+// reflinkWriter. Otherwise nil is returned, and the contents are written as
+// usual -- reflinks are only an optimisation, so failures are not errors.
+func (te *TarExtractor) reflinkEntry(root, path string, hdr *tar.Header, fh *os.File) *reflinkWriter {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil
+	}
+	srcPath, err := securejoin.SecureJoinVFS(te.reflinkFrom, relPath, te.fsEval)
+	if err != nil {
+		return nil
+	}
+	// Files of a different size are very unlikely to share much, so don't
+	// bother comparing them.
+	srcFi, err := te.fsEval.Lstat(srcPath)
+	if err != nil || !srcFi.Mode().IsRegular() || srcFi.Size() != hdr.Size || hdr.Size == 0 {
+		return nil
+	}
+	src, err := te.fsEval.Open(srcPath)
+	if err != nil {
+		log.Debugf("reflink %s: could not open source: %v", hdr.Name, err)
+		return nil
+	}
+	defer src.Close()
+	// Make sure the path wasn't swapped out from underneath us.
+	if fi, err := src.Stat(); err != nil || !sameFile(fi, srcFi) {
+		return nil
+	}
+
+	if err := system.Reflink(fh, src); err != nil {
+		if errors.Is(err, system.ErrReflinkUnsupported) {
+			log.Warnf("reflink %s: %v -- contents will be copied instead", hdr.Name, err)
+			te.reflinkUnsupported = true
+		} else {
+			log.Debugf("reflink %s: %v", hdr.Name, err)
+		}
+		return nil
+	}
+	return &reflinkWriter{fh: fh}
+}
+
+// reflinkWriter is an io.Writer for the contents of a file which was created
+// as a reflink of a file which is expected to have the same contents. Each
+// chunk of data is compared with the existing contents of the file, and only
+// written if they differ, so that the extents of the unchanged parts stay
+// shared with the source.
+type reflinkWriter struct {
+	fh  *os.File
+	off int64
+	buf []byte
+}
+
+// Write implements io.Writer.
+func (rw *reflinkWriter) Write(p []byte) (int, error) {
+	if cap(rw.buf) < len(p) {
+		rw.buf = make([]byte, len(p))
+	}
+	buf := rw.buf[:len(p)]
+	n, err := rw.fh.ReadAt(buf, rw.off)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("read reflinked contents: %w", err)
+	}
+	if n == len(p) && bytes.Equal(buf, p) {
+		rw.off += int64(n)
+		return n, nil
+	}
+	n, err = rw.fh.WriteAt(p, rw.off)
+	rw.off += int64(n)
+	return n, err
+}
+
+// remainingSize returns how many more bytes of regular file contents may be
+// written before te.maxUncompressedSize is exceeded. ok is false if there is
+// no limit.
+func (te *TarExtractor) remainingSize() (remaining int64, ok bool) {
+	if te.maxUncompressedSize <= 0 {
+		return 0, false
+	}
+	return te.maxUncompressedSize - *te.written, true
+}
+
+// sizeLimitWriter is an io.Writer which adds the number of bytes written to
+// *written, and refuses to write more than limit bytes in total.
+type sizeLimitWriter struct {
+	w       io.Writer
+	written *int64
+	limit   int64
+}
+
+// Write implements io.Writer.
+func (lw *sizeLimitWriter) Write(p []byte) (int, error) {
+	var limitErr error
+	if remaining := lw.limit - *lw.written; int64(len(p)) > remaining {
+		p = p[:remaining]
+		limitErr = fmt.Errorf("limit of %d bytes exceeded: %w", lw.limit, ErrSizeLimitExceeded)
+	}
+	n, err := lw.w.Write(p)
+	*lw.written += int64(n)
+	if err == nil {
+		err = limitErr
+	}
+	return n, err
+}
+
+// progressWriter is an io.Writer which reports the number of bytes written
+// to the contents of an entry with a ProgressFunc.
+type progressWriter struct {
+	w     io.Writer
+	fn    ProgressFunc
+	name  string
+	done  int64
+	total int64
+}
+
+// Write implements io.Writer.
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.done += int64(n)
+	if err == nil && n > 0 {
+		pw.fn(pw.name, pw.done, pw.total)
+	}
+	return n, err
+}
+
 // UnpackEntry extracts the given tar.Header to the provided root, ensuring
 // that the layer state is consistent with the layer state that produced the
 // tar archive being iterated over. This does handle whiteouts, so a tar.Header
@@ -397,6 +965,33 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	hdr.Name = CleanPath(hdr.Name)
 	root = filepath.Clean(root)
 
+	// Ownership is only ever taken from the numeric ids in the header, but
+	// make sure that the names cannot be used by anything later on.
+	if te.numericOwner {
+		hdr.Uname, hdr.Gname = "", ""
+	}
+
+	// The rootless device xattr is only ever set by us on placeholders for
+	// device inodes, so layers must not be able to set it on other files.
+	if _, ok := hdr.Xattrs[rootlessDeviceXattr]; ok {
+		log.Warnf("suspicious layer: ignoring special xattr %s stored in layer: %s", rootlessDeviceXattr, hdr.Name)
+		hdr = copyHeader(hdr)
+		delete(hdr.Xattrs, rootlessDeviceXattr)
+	}
+
+	// Report entries once they've been extracted, unless the progress was
+	// already reported while writing their contents. This is deferred first
+	// so that it runs after every other deferred function which can fail.
+	var progressReported bool
+	if te.onProgress != nil {
+		name := hdr.Name
+		defer func() {
+			if Err == nil && !progressReported {
+				te.onProgress(name, 0, 0)
+			}
+		}()
+	}
+
 	log.WithFields(log.Fields{
 		"root": root,
 		"path": hdr.Name,
@@ -408,6 +1003,33 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// which we don't want (we're clever enough to handle the actual path being
 	// a symlink).
 	unsafeDir, file := filepath.Split(hdr.Name)
+	if te.whiteoutsOnly && !strings.HasPrefix(file, whPrefix) {
+		log.Debugf("skipping non-whiteout entry %q", hdr.Name)
+		return nil
+	}
+	if te.pathFilter != nil {
+		selected, err := te.filteredEntry(unsafeDir, file, hdr)
+		if err != nil {
+			return fmt.Errorf("filter entry: %w", err)
+		}
+		if !selected {
+			return nil
+		}
+	}
+
+	// A link without a target is nonsensical (symlink(2) refuses to create
+	// one, and an empty hardlink target would refer to the root), so give a
+	// clear error rather than failing obscurely while creating the link. This
+	// has to be done before we touch the filesystem, so that we don't clobber
+	// an existing path with an entry we won't extract.
+	if (hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeSymlink) && hdr.Linkname == "" {
+		if te.skipEmptyLinkTargets {
+			te.diagnostics.warnf(DiagnosticEmptyLinkTarget, hdr.Name, "skipping entry %q: link has an empty target", hdr.Name)
+			return nil
+		}
+		return fmt.Errorf("malformed tar entry %q -- link has an empty target", hdr.Name)
+	}
+
 	if filepath.Join("/", hdr.Name) == "/" {
 		// If we got an entry for the root, then unsafeDir is the full path.
 		unsafeDir, file = hdr.Name, "."
@@ -423,6 +1045,20 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	}
 	path := filepath.Join(dir, file)
 
+	// Skip any entry which would modify one of the denied paths. This has to
+	// be checked after the symlinks in the parent path have been resolved, to
+	// stop the archive from using symlinks to get around the denylist.
+	if len(te.denyPaths) > 0 {
+		denied, err := te.deniedEntry(root, dir, file, hdr)
+		if err != nil {
+			return fmt.Errorf("check denied paths: %w", err)
+		}
+		if denied {
+			te.diagnostics.warnf(DiagnosticDeniedPath, hdr.Name, "skipping entry %q: path is denied by unpack options", hdr.Name)
+			return nil
+		}
+	}
+
 	// Before we do anything, get the state of dir. Because we might be adding
 	// or removing files, our parent directory might be modified in the
 	// process. As a result, we want to be able to restore the old state
@@ -454,11 +1090,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 				return fmt.Errorf("get dirHdr.Xattrs: %w", err)
 			}
 			if !te.enotsupWarned {
-				log.Warnf("xattr{%s} ignoring ENOTSUP on llistxattr", dir)
+				te.diagnostics.warnf(DiagnosticXattrUnsupported, hdr.Name, "xattr{%s} ignoring ENOTSUP on llistxattr", dir)
 				log.Warnf("xattr{%s} destination filesystem does not support xattrs, further warnings will be suppressed", path)
 				te.enotsupWarned = true
 			} else {
 				log.Debugf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
+				te.diagnostics.report(DiagnosticXattrUnsupported, hdr.Name, "xattr{%s} ignoring ENOTSUP on llistxattr", dir)
 			}
 		}
 		if len(xattrs) > 0 {
@@ -477,7 +1114,7 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		// existed on the filesystem, not from a tar layer.
 		defer func() {
 			// Only overwrite the error if there wasn't one already.
-			if err := te.restoreMetadata(dir, dirHdr); err != nil {
+			if err := te.restoreMetadata(dir, dirHdr, dirFi); err != nil {
 				if Err == nil {
 					Err = fmt.Errorf("restore parent directory: %w", err)
 				}
@@ -485,6 +1122,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}()
 	}
 
+	// Later entries take precedence over earlier ones, so any deferred
+	// hardlinks which this entry replaces must not be created.
+	if len(te.deferredLinks) > 0 {
+		te.dropDeferredLinks(path, hdr)
+	}
+
 	// Currently the spec doesn't specify what the hdr.Typeflag of whiteout
 	// files is meant to be. We specifically only produce regular files
 	// ('\x00') but it could be possible that someone produces a different
@@ -501,11 +1144,38 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}
 	}
 
+	// Hardlinks refer to an existing inode, so they can't be created before
+	// their target has been extracted (see UnpackOptions.HardlinkOrder).
+	if hdr.Typeflag == tar.TypeLink && te.hardlinkOrder != HardlinkOrderImmediate && !te.creatingDeferredLinks {
+		target, err := te.hardlinkTarget(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if _, err := te.fsEval.Lstat(target); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("check hardlink target: %w", err)
+			}
+			if te.hardlinkOrder == HardlinkOrderStrict {
+				return fmt.Errorf("hardlink %q precedes its target %q: %w", hdr.Name, hdr.Linkname, ErrHardlinkTargetMissing)
+			}
+			log.Debugf("deferring hardlink %q until its target %q has been extracted", hdr.Name, hdr.Linkname)
+			te.deferredLinks = append(te.deferredLinks, deferredLink{
+				root: root,
+				path: path,
+				hdr:  copyHeader(hdr),
+			})
+			// The progress is reported once the hardlink has been created.
+			progressReported = true
+			return nil
+		}
+	}
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
 	fi, err := te.fsEval.Lstat(path)
-	if err != nil {
+	exists := err == nil
+	if !exists {
 		// File doesn't exist, just switch fi to the file header.
 		fi = hdr.FileInfo()
 	}
@@ -559,6 +1229,13 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 			}
 		}
 		if !(isDirlink && te.keepDirlinks) {
+			if isDir := hdr.Typeflag == tar.TypeDir; te.noClobberTypeChange && exists && fi.IsDir() != isDir {
+				oldType, newType := "directory", "non-directory"
+				if isDir {
+					oldType, newType = newType, oldType
+				}
+				return fmt.Errorf("refusing to replace %s with %s entry: type change clobbering is disabled", oldType, newType)
+			}
 			if err := te.fsEval.RemoveAll(path); err != nil {
 				return fmt.Errorf("clobber old path: %w", err)
 			}
@@ -568,19 +1245,60 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// Now create or otherwise modify the state of the path. Right now, either
 	// the type of path matches hdr or the path doesn't exist. Note that we
 	// don't care about umasks or the initial mode here, since applyMetadata
-	// will fix all of that for us.
+	// will fix all of that for us. For files we create ourselves, we keep
+	// track of the inode so that applyMetadata can make sure it is modifying
+	// the same file.
+	var created os.FileInfo
 	switch hdr.Typeflag {
 	// regular file
 	case tar.TypeReg, tar.TypeRegA:
+		// Don't bother creating the file if the header already tells us it
+		// is too large. hdr.Size can't be trusted, so the limit is also
+		// enforced while copying.
+		if remaining, ok := te.remainingSize(); ok && hdr.Size > remaining {
+			return fmt.Errorf("regular file of %d bytes: limit of %d bytes exceeded: %w", hdr.Size, te.maxUncompressedSize, ErrSizeLimitExceeded)
+		}
+
 		// Create a new file, then just copy the data.
 		fh, err := te.fsEval.Create(path)
 		if err != nil {
 			return fmt.Errorf("create regular: %w", err)
 		}
 		defer fh.Close()
+		created, err = fh.Stat()
+		if err != nil {
+			return fmt.Errorf("stat created regular file: %w", err)
+		}
+		if te.sequentialIO {
+			adviseSequential(fh)
+		}
+
+		var (
+			dst io.Writer = fh
+			pw  *progressWriter
+			sw  *sparseWriter
+		)
+		if te.reflinkFrom != "" && !te.reflinkUnsupported {
+			if rw := te.reflinkEntry(root, path, hdr, fh); rw != nil {
+				dst = rw
+			}
+		}
+		// Reflinked files already share the extents (and holes) of their
+		// source, so there is no point in punching holes into them.
+		if _, reflinked := dst.(*reflinkWriter); te.detectSparse && !reflinked {
+			sw = &sparseWriter{fh: fh}
+			dst = sw
+		}
+		if te.maxUncompressedSize > 0 {
+			dst = &sizeLimitWriter{w: dst, written: te.written, limit: te.maxUncompressedSize}
+		}
+		if te.onProgress != nil {
+			pw = &progressWriter{w: dst, fn: te.onProgress, name: hdr.Name, total: hdr.Size}
+			dst = pw
+		}
 
 		// We need to make sure that we copy all of the bytes.
-		n, err := system.Copy(fh, r)
+		n, err := system.CopyBuffer(dst, r, te.copyBufferSize)
 		if int64(n) != hdr.Size {
 			if err != nil {
 				err = fmt.Errorf("short write: %w", err)
@@ -591,6 +1309,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err != nil {
 			return fmt.Errorf("unpack to regular file: %w", err)
 		}
+		if sw != nil {
+			if err := sw.Close(); err != nil {
+				return fmt.Errorf("unpack to sparse regular file: %w", err)
+			}
+		}
+		progressReported = pw != nil && pw.done > 0
 
 		// Force close here so that we don't affect the metadata.
 		if err := fh.Close(); err != nil {
@@ -621,43 +1345,45 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		switch hdr.Typeflag {
 		case tar.TypeLink:
 			linkFn = te.fsEval.Link
-			// Because hardlinks are inode-based we need to scope the link to
-			// the rootfs using SecureJoinVFS. As before, we need to be careful
-			// that we don't resolve the last part of the link path (in case
-			// the user actually wanted to hardlink to a symlink).
-			unsafeLinkDir, linkFile := filepath.Split(CleanPath(linkname))
-			linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
+			linkname, err = te.hardlinkTarget(root, linkname)
 			if err != nil {
-				return fmt.Errorf("sanitise hardlink target in root: %w", err)
+				return err
 			}
-			linkname = filepath.Join(linkDir, linkFile)
 		case tar.TypeSymlink:
 			linkFn = te.fsEval.Symlink
 		}
 
 		// Link the new one.
 		if err := linkFn(linkname, path); err != nil {
-			// FIXME: Currently this can break if tar hardlink entries occur
-			//        before we hit the entry those hardlinks link to. I have a
-			//        feeling that such archives are invalid, but the correct
-			//        way of handling this is to delay link creation until the
-			//        very end. Unfortunately this won't work with symlinks
-			//        (which can link to directories).
+			// Hardlink entries which occur before the entry they link to
+			// fail here, unless they were deferred (see HardlinkOrderDefer).
+			// Symlinks don't need to be deferred, since their target doesn't
+			// need to exist.
 			return fmt.Errorf("link: %w", err)
 		}
 
 	// character device node, block device node
 	case tar.TypeChar, tar.TypeBlock:
+		// Device nodes have no meaning for Windows images, so there's no
+		// point in creating them (or faking them in rootless mode).
+		if te.windowsPlatform() {
+			te.diagnostics.warnf(DiagnosticForeignDevice, hdr.Name, "platform{%s} skipping device %d:%d in %s image", hdr.Name, hdr.Devmajor, hdr.Devminor, te.platform.OS)
+			return nil
+		}
+
 		// In rootless mode we have no choice but to fake this, since mknod(2)
-		// doesn't work as an unprivileged user here.
-		//
-		// TODO: We need to add the concept of a fake block device in
-		//       "user.rootlesscontainers", because this workaround suffers
-		//       from the obvious issue that if the file is touched (even the
-		//       metadata) then it will be incorrectly copied into the layer.
-		//       This would break distribution images fairly badly.
+		// doesn't work as an unprivileged user here. The original device is
+		// recorded in rootlessDeviceXattr so that mapHeader can restore it if
+		// the placeholder ends up in a layer (such as when its metadata is
+		// changed).
 		if te.partialRootless {
-			log.Warnf("rootless{%s} creating empty file in place of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+			te.diagnostics.warnf(DiagnosticRootlessDevice, hdr.Name, "rootless{%s} creating empty file in place of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+			// Don't leak the xattr into the caller's header.
+			hdr = copyHeader(hdr)
+			if hdr.Xattrs == nil {
+				hdr.Xattrs = make(map[string]string)
+			}
+			hdr.Xattrs[rootlessDeviceXattr] = formatRootlessDevice(hdr)
 			fh, err := te.fsEval.Create(path)
 			if err != nil {
 				return fmt.Errorf("create rootless block: %w", err)
@@ -666,6 +1392,10 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 			if err := fh.Chmod(0); err != nil {
 				return fmt.Errorf("chmod 0 rootless block: %w", err)
 			}
+			created, err = fh.Stat()
+			if err != nil {
+				return fmt.Errorf("stat rootless block: %w", err)
+			}
 			goto out
 		}
 
@@ -696,7 +1426,7 @@ out:
 	// apply metadata for hardlinks, because hardlinks don't have any separate
 	// metadata from their link (and the tar headers might not be filled).
 	if hdr.Typeflag != tar.TypeLink {
-		if err := te.applyMetadata(path, hdr); err != nil {
+		if err := te.applyMetadata(path, hdr, created); err != nil {
 			return fmt.Errorf("apply hdr metadata: %w", err)
 		}
 	}
@@ -709,8 +1439,218 @@ out:
 		// Really shouldn't happen because of the guarantees of SecureJoinVFS.
 		return fmt.Errorf("find relative-to-root [should never happen]: %w", err)
 	}
+	if hdr.Typeflag != tar.TypeLink {
+		if err := te.applyLabel(path, filepath.Join("/", upperPath), hdr); err != nil {
+			return fmt.Errorf("apply selinux label: %w", err)
+		}
+	}
+	if err := te.addUpperPath(upperPath); err != nil {
+		return fmt.Errorf("track extracted path: %w", err)
+	}
+	return nil
+}
+
+// applyLabel sets the security.selinux xattr of the file at path to the
+// default label of rootfsPath (the path of the file within the root
+// filesystem) according to te.fileContexts. Nothing is done if there are no
+// file contexts or the policy doesn't have a label for the path.
+func (te *TarExtractor) applyLabel(path, rootfsPath string, hdr *tar.Header) error {
+	if te.fileContexts == nil || te.windowsPlatform() {
+		return nil
+	}
+	label, ok := te.fileContexts.Lookup(rootfsPath, hdr.FileInfo().Mode())
+	if !ok {
+		log.Debugf("selinux{%s} no default label in policy", rootfsPath)
+		return nil
+	}
+	if err := te.fsEval.Lsetxattr(path, "security.selinux", []byte(label), 0); err != nil {
+		return fmt.Errorf("set label %q: %s: %w", label, path, err)
+	}
+	return nil
+}
+
+// addUpperPath adds the given path (relative to the root) and all of its
+// ancestors to te.upperPaths. Since tracked paths are never forgotten (they
+// are only ever moved to te.upperPathsSpill), if a path is already tracked
+// then so are all of its ancestors -- so we can stop as soon as we hit a path
+// we've already seen.
+// For large layers most entries share their ancestors with the previous
+// entry, so this avoids re-inserting the same paths for every entry.
+//
+// Upper paths are only used for OCI whiteouts, so nothing is tracked with
+// OverlayFSWhiteout. If te.upperPaths already holds te.maxTrackedPaths paths,
+// they are either spilled to disk or an error is returned (depending on
+// te.trackedPathsLimit).
+func (te *TarExtractor) addUpperPath(upperPath string) error {
+	if te.whiteoutMode == OverlayFSWhiteout {
+		return nil
+	}
+	// Find the ancestors which are not yet tracked, so that they can be added
+	// before their children (spilled paths must have their parents on disk).
+	var missing []string
 	for pth := upperPath; pth != filepath.Dir(pth); pth = filepath.Dir(pth) {
-		te.upperPaths[pth] = struct{}{}
+		known, err := te.hasUpperPath(pth)
+		if err != nil {
+			return err
+		}
+		if known {
+			break
+		}
+		missing = append(missing, pth)
+	}
+	for idx := len(missing) - 1; idx >= 0; idx-- {
+		if te.maxTrackedPaths > 0 && len(te.upperPaths) >= te.maxTrackedPaths {
+			if te.trackedPathsLimit != TrackedPathsLimitSpill {
+				return fmt.Errorf("limit of %d tracked paths exceeded: %w", te.maxTrackedPaths, ErrTooManyTrackedPaths)
+			}
+			if err := te.spillUpperPaths(); err != nil {
+				return fmt.Errorf("spill tracked paths to disk: %w", err)
+			}
+		}
+		te.upperPaths[missing[idx]] = struct{}{}
+	}
+	return nil
+}
+
+// spillUpperPaths flushes te.upperPaths to the temporary directory
+// te.upperPathsSpill (creating it if this is the first flush), leaving
+// te.upperPaths empty.
+func (te *TarExtractor) spillUpperPaths() error {
+	if te.upperPathsSpill == "" {
+		spill, err := ioutil.TempDir("", "umoci-upper-paths")
+		if err != nil {
+			return err
+		}
+		te.upperPathsSpill = spill
+	}
+	log.Debugf("spilling %d tracked paths to %s", len(te.upperPaths), te.upperPathsSpill)
+
+	// The parent of every path is either already on disk or is also being
+	// spilled, and sorting the paths puts each parent before its children.
+	paths := make([]string, 0, len(te.upperPaths))
+	for pth := range te.upperPaths {
+		paths = append(paths, pth)
 	}
+	sort.Strings(paths)
+	for _, pth := range paths {
+		if err := os.Mkdir(filepath.Join(te.upperPathsSpill, pth), 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	te.upperPaths = make(map[string]struct{})
 	return nil
 }
+
+// hasUpperPath returns whether the given path (relative to the root) is one
+// of the upper paths added with addUpperPath.
+func (te *TarExtractor) hasUpperPath(upperPath string) (bool, error) {
+	if _, ok := te.upperPaths[upperPath]; ok {
+		return true, nil
+	}
+	// The root is never an upper path.
+	if te.upperPathsSpill == "" || upperPath == "." {
+		return false, nil
+	}
+	if _, err := os.Lstat(filepath.Join(te.upperPathsSpill, upperPath)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("look up tracked path: %w", err)
+	}
+	return true, nil
+}
+
+// hardlinkTarget returns the path of the target of a hardlink entry with the
+// given linkname. Because hardlinks are inode-based we need to scope the
+// target to root using SecureJoinVFS, but we need to be careful that we don't
+// resolve the last component (in case the user actually wanted to hardlink to
+// a symlink).
+func (te *TarExtractor) hardlinkTarget(root, linkname string) (string, error) {
+	unsafeLinkDir, linkFile := filepath.Split(CleanPath(linkname))
+	linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
+	if err != nil {
+		return "", fmt.Errorf("sanitise hardlink target in root: %w", err)
+	}
+	return filepath.Join(linkDir, linkFile), nil
+}
+
+// deferredLink is a hardlink entry whose creation has been deferred until the
+// end of the layer (see HardlinkOrderDefer).
+type deferredLink struct {
+	// root is the root the entry was extracted to, and path is the path
+	// (inside root) where the hardlink will be created.
+	root, path string
+	hdr        *tar.Header
+}
+
+// dropDeferredLinks forgets any deferred hardlinks which are replaced by the
+// entry for hdr (being extracted at path), including those removed by a
+// whiteout.
+func (te *TarExtractor) dropDeferredLinks(path string, hdr *tar.Header) {
+	// Directories only replace an entry at their own path, but everything
+	// else (and whiteouts) also replaces everything underneath it.
+	subtree := hdr.Typeflag != tar.TypeDir
+	if dir, file := filepath.Split(path); strings.HasPrefix(file, whPrefix) {
+		if file == whOpaque {
+			// Opaque whiteouts only affect the lower layers.
+			return
+		}
+		path = filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+		subtree = true
+	}
+
+	links := te.deferredLinks[:0]
+	for _, link := range te.deferredLinks {
+		if link.path == path || (subtree && strings.HasPrefix(link.path, path+string(filepath.Separator))) {
+			log.Debugf("dropping deferred hardlink %q replaced by later entry %q", link.hdr.Name, hdr.Name)
+			// The entry is done with, as it would have been if the hardlink
+			// had been created and then replaced.
+			if te.onProgress != nil {
+				te.onProgress(link.hdr.Name, 0, 0)
+			}
+			continue
+		}
+		links = append(links, link)
+	}
+	te.deferredLinks = links
+}
+
+// CreateDeferredLinks creates the hardlinks whose creation was deferred
+// because their target had not been extracted yet (see HardlinkOrderDefer),
+// in the order their entries were read. It must be called once every entry of
+// the layer has been passed to UnpackEntry (UnpackLayer does this
+// automatically). An error wrapping ErrHardlinkTargetMissing is returned if
+// the target of a deferred hardlink still doesn't exist.
+func (te *TarExtractor) CreateDeferredLinks() error {
+	links := te.deferredLinks
+	te.deferredLinks = nil
+	te.creatingDeferredLinks = true
+	defer func() { te.creatingDeferredLinks = false }()
+
+	for _, link := range links {
+		target, err := te.hardlinkTarget(link.root, link.hdr.Linkname)
+		if err != nil {
+			return fmt.Errorf("deferred hardlink %s: %w", link.hdr.Name, err)
+		}
+		if _, err := te.fsEval.Lstat(target); errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("deferred hardlink %q to %q: %w", link.hdr.Name, link.hdr.Linkname, ErrHardlinkTargetMissing)
+		}
+		if err := te.UnpackEntry(link.root, link.hdr, nil); err != nil {
+			return fmt.Errorf("deferred hardlink %s: %w", link.hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// Close releases any resources held by the TarExtractor, such as the
+// temporary directory used once paths are spilled to disk (see
+// UnpackOptions.TrackedPathsLimit). The TarExtractor must not be used after
+// it has been closed.
+func (te *TarExtractor) Close() error {
+	if te.upperPathsSpill == "" {
+		return nil
+	}
+	err := os.RemoveAll(te.upperPathsSpill)
+	te.upperPathsSpill = ""
+	return err
+}
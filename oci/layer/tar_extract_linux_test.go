@@ -22,12 +22,21 @@ package layer
 
 import (
 	"archive/tar"
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/selinux"
 	"github.com/opencontainers/umoci/pkg/system"
 	"golang.org/x/sys/unix"
 )
@@ -117,3 +126,1220 @@ func TestUnpackEntryOverlayFSWhiteout(t *testing.T) {
 		}
 	}
 }
+
+func TestUnpackLayerExtraTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerExtraTargets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mknodOk, err := canMknod(dir)
+	if err != nil {
+		t.Fatalf("couldn't mknod in dir: %v", err)
+	}
+	if !mknodOk {
+		t.Skip("skipping overlayfs test on kernel < 5.8")
+	}
+
+	plainRoot := filepath.Join(dir, "plain")
+	overlayRoot := filepath.Join(dir, "overlay")
+	for _, root := range []string{plainRoot, overlayRoot} {
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	makeLayer := func(entries ...pseudoHdr) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, ph := range entries {
+			hdr, rdr := fromPseudoHdr(ph)
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if rdr != nil {
+				if _, err := io.Copy(tw, rdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+		WhiteoutMode: OCIStandardWhiteout,
+		ExtraTargets: []UnpackTarget{
+			{Root: overlayRoot, WhiteoutMode: OverlayFSWhiteout},
+		},
+	}
+
+	// Apply both layers to both targets at once.
+	for _, layer := range []*bytes.Buffer{
+		makeLayer(
+			pseudoHdr{"dir", "", tar.TypeDir, false},
+			pseudoHdr{"dir/file", "", tar.TypeReg, false},
+			pseudoHdr{"removed", "", tar.TypeReg, false},
+		),
+		makeLayer(
+			pseudoHdr{whPrefix + "removed", "", tar.TypeReg, false},
+			pseudoHdr{"dir/another", "", tar.TypeReg, false},
+		),
+	} {
+		if err := UnpackLayer(plainRoot, layer, unpackOptions); err != nil {
+			t.Fatalf("unexpected UnpackLayer error: %+v", err)
+		}
+	}
+
+	// Both targets must have identical regular files.
+	for _, path := range []string{"dir/file", "dir/another"} {
+		plainData, err := ioutil.ReadFile(filepath.Join(plainRoot, path))
+		if err != nil {
+			t.Errorf("plain target is missing %s: %v", path, err)
+			continue
+		}
+		overlayData, err := ioutil.ReadFile(filepath.Join(overlayRoot, path))
+		if err != nil {
+			t.Errorf("overlay target is missing %s: %v", path, err)
+			continue
+		}
+		if !bytes.Equal(plainData, overlayData) {
+			t.Errorf("targets have different contents for %s: %q != %q", path, plainData, overlayData)
+		}
+	}
+
+	// The plain target has the whiteout applied as a removal.
+	if _, err := os.Lstat(filepath.Join(plainRoot, "removed")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("plain target still has removed file: %v", err)
+	}
+
+	// The overlay target has an overlayfs whiteout marker.
+	fi, err := os.Lstat(filepath.Join(overlayRoot, "removed"))
+	if err != nil {
+		t.Fatalf("overlay target is missing whiteout: %v", err)
+	}
+	whiteout, err := isOverlayWhiteout(fi)
+	if err != nil {
+		t.Fatalf("failed to check overlay whiteout: %v", err)
+	}
+	if !whiteout {
+		t.Errorf("overlay target doesn't have an overlayfs whiteout for removed file")
+	}
+}
+
+// recordingFsEval is an fseval.FsEval which records which of the metadata
+// operations were used for each path. beforeLopen (if set) is called before
+// each Lopen, to allow tests to race with the extractor.
+type recordingFsEval struct {
+	fseval.FsEval
+	calls       map[string][]string
+	beforeLopen func(path string)
+}
+
+func (fs *recordingFsEval) record(op, path string) {
+	fs.calls[path] = append(fs.calls[path], op)
+}
+
+func (fs *recordingFsEval) Lopen(path string) (*os.File, error) {
+	if fs.beforeLopen != nil {
+		fs.beforeLopen(path)
+	}
+	fs.record("Lopen", path)
+	return fs.FsEval.Lopen(path)
+}
+
+func (fs *recordingFsEval) Fchown(fh *os.File, uid, gid int) error {
+	fs.record("Fchown", fh.Name())
+	return fs.FsEval.Fchown(fh, uid, gid)
+}
+
+func (fs *recordingFsEval) Fchmod(fh *os.File, mode os.FileMode) error {
+	fs.record("Fchmod", fh.Name())
+	return fs.FsEval.Fchmod(fh, mode)
+}
+
+func (fs *recordingFsEval) Futimes(fh *os.File, atime, mtime time.Time) error {
+	fs.record("Futimes", fh.Name())
+	return fs.FsEval.Futimes(fh, atime, mtime)
+}
+
+func (fs *recordingFsEval) Chmod(path string, mode os.FileMode) error {
+	fs.record("Chmod", path)
+	return fs.FsEval.Chmod(path, mode)
+}
+
+func (fs *recordingFsEval) Lutimes(path string, atime, mtime time.Time) error {
+	fs.record("Lutimes", path)
+	return fs.FsEval.Lutimes(path, atime, mtime)
+}
+
+// requireFdMetadata skips the test if fd-based metadata operations are not
+// supported on this system (such as if /proc is not mounted).
+func requireFdMetadata(t *testing.T, dir string) {
+	fh, err := system.OpenPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := system.Futimes(fh, time.Now(), time.Now()); errors.Is(err, system.ErrFdMetadataUnsupported) {
+		t.Skip("fd-based metadata operations are not supported")
+	}
+}
+
+func TestUnpackEntryFdMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryFdMetadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	requireFdMetadata(t, dir)
+
+	rootless := os.Geteuid() != 0
+	te := NewTarExtractor(UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: rootless,
+		},
+	})
+	fsEval := &recordingFsEval{FsEval: te.fsEval, calls: map[string][]string{}}
+	te.fsEval = fsEval
+
+	mtime := time.Unix(1234567890, 0)
+	for _, test := range []struct {
+		hdr      *tar.Header
+		expected []string
+	}{
+		{&tar.Header{Name: "dir", Typeflag: tar.TypeDir, Mode: 0711}, []string{"Lopen", "Fchown", "Fchmod", "Futimes"}},
+		{&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0640}, []string{"Lopen", "Fchown", "Fchmod", "Futimes"}},
+		{&tar.Header{Name: "dir/fifo", Typeflag: tar.TypeFifo, Mode: 0600}, []string{"Lopen", "Fchown", "Fchmod", "Futimes"}},
+		// Symlinks have no mode, and their times can only be changed
+		// through the path.
+		{&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"}, []string{"Lopen", "Fchown", "Lutimes"}},
+	} {
+		t.Run(test.hdr.Name, func(t *testing.T) {
+			rootfs := filepath.Join(dir, "rootfs")
+			path := filepath.Join(rootfs, test.hdr.Name)
+			test.hdr.Uid = os.Geteuid()
+			test.hdr.Gid = os.Getegid()
+			test.hdr.ModTime = mtime
+
+			if err := os.MkdirAll(rootfs, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := te.UnpackEntry(rootfs, test.hdr, bytes.NewReader(nil)); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+
+			expected := test.expected
+			if rootless {
+				// No chown is done in rootless mode.
+				expected = nil
+				for _, op := range test.expected {
+					if op != "Fchown" {
+						expected = append(expected, op)
+					}
+				}
+			}
+			got := fsEval.calls[path]
+			if len(got) != len(expected) {
+				t.Fatalf("unexpected metadata operations for %s: expected %v got %v", path, expected, got)
+			}
+			for idx := range got {
+				if got[idx] != expected[idx] {
+					t.Errorf("unexpected metadata operations for %s: expected %v got %v", path, expected, got)
+					break
+				}
+			}
+
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fi.ModTime().Equal(mtime) {
+				t.Errorf("unexpected mtime of %s: expected %v got %v", path, mtime, fi.ModTime())
+			}
+			if fi.Mode()&os.ModeSymlink == 0 && fi.Mode().Perm() != os.FileMode(test.hdr.Mode) {
+				t.Errorf("unexpected mode of %s: expected %o got %o", path, test.hdr.Mode, fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestUnpackEntryHardlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryHardlinkSwap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	requireFdMetadata(t, dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A file outside of the rootfs which an attacker wants to modify.
+	victim := filepath.Join(dir, "victim")
+	if err := ioutil.WriteFile(victim, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	te := NewTarExtractor(UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+	})
+	path := filepath.Join(rootfs, "file")
+	te.fsEval = &recordingFsEval{
+		FsEval: te.fsEval,
+		calls:  map[string][]string{},
+		// Swap the newly created file for a hardlink to the victim, after
+		// the contents have been written but before the metadata has been
+		// applied.
+		beforeLopen: func(lopenPath string) {
+			if lopenPath != path {
+				return
+			}
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(victim, path); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	hdr := &tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     04777,
+		Uid:      os.Geteuid(),
+		Gid:      os.Getegid(),
+		Size:     4,
+	}
+	if err := te.UnpackEntry(rootfs, hdr, bytes.NewReader([]byte("data"))); err == nil {
+		t.Fatalf("expected UnpackEntry to detect the swapped inode")
+	}
+
+	fi, err := os.Stat(victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0600 {
+		t.Errorf("victim mode was modified: %v", fi.Mode())
+	}
+}
+
+// TestOverlayXattrsRoundTrip makes sure that overlayfs redirect and metacopy
+// xattrs survive generating a layer from an overlayfs-style rootfs and
+// extracting it to another overlayfs-style rootfs, but are not applied to
+// OCI-style root filesystems.
+func TestOverlayXattrsRoundTrip(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("trusted.* xattrs require root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestOverlayXattrsRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "renamed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"renamed/file", "meta", "plain"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// metacopy xattrs are usually empty, which PAX records can't represent.
+	xattrs := []struct {
+		path, name, value string
+	}{
+		{"renamed", "trusted.overlay.redirect", "/orig"},
+		{"meta", "trusted.overlay.metacopy", ""},
+	}
+	for _, xattr := range xattrs {
+		if err := unix.Lsetxattr(filepath.Join(src, xattr.path), xattr.name, []byte(xattr.value), 0); err != nil {
+			t.Skipf("filesystem does not support trusted xattrs: %v", err)
+		}
+	}
+
+	generate := func(translate bool) []byte {
+		reader := GenerateInsertLayer(src, "/", false, &RepackOptions{TranslateOverlayWhiteouts: translate})
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unexpected error generating layer: %+v", err)
+		}
+		return data
+	}
+	extract := func(root string, layer []byte, mode WhiteoutMode) {
+		te := NewTarExtractor(UnpackOptions{WhiteoutMode: mode})
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := te.UnpackEntry(root, hdr, tr); err != nil {
+				t.Fatalf("unexpected error unpacking %s: %+v", hdr.Name, err)
+			}
+		}
+	}
+	checkXattrs := func(root string, expected bool) {
+		for _, xattr := range xattrs {
+			value, err := system.Lgetxattr(filepath.Join(root, xattr.path), xattr.name)
+			if !expected {
+				if err == nil {
+					t.Errorf("%s: unexpected xattr %s set in %s", xattr.path, xattr.name, root)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: expected xattr %s to be set in %s: %v", xattr.path, xattr.name, root, err)
+			} else if string(value) != xattr.value {
+				t.Errorf("%s: unexpected value for xattr %s: expected %q got %q", xattr.path, xattr.name, xattr.value, string(value))
+			}
+		}
+		if _, err := system.Lgetxattr(filepath.Join(root, "plain"), "trusted.overlay.metacopy"); err == nil {
+			t.Errorf("plain: unexpected metacopy xattr set in %s", root)
+		}
+	}
+
+	// The overlay xattrs are only recorded in overlayfs mode.
+	layer := generate(true)
+	tr := tar.NewReader(bytes.NewReader(layer))
+	recorded := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name := range hdr.Xattrs {
+			if isOverlayXattr(name) {
+				t.Errorf("%s: overlay xattr %s stored as a regular xattr", hdr.Name, name)
+			}
+		}
+		for key := range hdr.PAXRecords {
+			if strings.HasPrefix(key, paxOverlayXattrPrefix) {
+				recorded++
+			}
+		}
+	}
+	if recorded != len(xattrs) {
+		t.Errorf("expected %d overlay xattr records, got %d", len(xattrs), recorded)
+	}
+
+	overlayRoot := filepath.Join(dir, "overlay")
+	extract(overlayRoot, layer, OverlayFSWhiteout)
+	checkXattrs(overlayRoot, true)
+
+	ociRoot := filepath.Join(dir, "oci")
+	extract(ociRoot, layer, OCIStandardWhiteout)
+	checkXattrs(ociRoot, false)
+
+	// Re-extracting entries without the records must clear stale xattrs.
+	extract(overlayRoot, generate(false), OverlayFSWhiteout)
+	checkXattrs(overlayRoot, false)
+}
+
+// failingXattrFsEval is an fseval.FsEval where every Lsetxattr fails with err.
+type failingXattrFsEval struct {
+	fseval.FsEval
+	err error
+}
+
+func (fs failingXattrFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
+	return &os.PathError{Op: "lsetxattr", Path: path, Err: fs.err}
+}
+
+func TestUnpackEntryStrictXattrs(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		err             error
+		partialRootless bool
+	}{
+		{"RootlessEPERM", unix.EPERM, true},
+		{"ENOTSUP", unix.ENOTSUP, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryStrictXattrs")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				te := NewTarExtractor(UnpackOptions{
+					MapOptions: MapOptions{
+						Rootless: os.Geteuid() != 0,
+					},
+					StrictXattrs: strict,
+				})
+				te.partialRootless = test.partialRootless
+				te.fsEval = failingXattrFsEval{FsEval: te.fsEval, err: test.err}
+
+				// A file capability (cap_net_bind_service=ep).
+				hdr := &tar.Header{
+					Name:     "ping",
+					Typeflag: tar.TypeReg,
+					Mode:     0755,
+					Uid:      os.Geteuid(),
+					Gid:      os.Getegid(),
+					Size:     4,
+					Xattrs: map[string]string{
+						"security.capability": "\x01\x00\x00\x02\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+					},
+				}
+				err = te.UnpackEntry(dir, hdr, bytes.NewReader([]byte("data")))
+				if !strict {
+					if err != nil {
+						t.Fatalf("unexpected UnpackEntry error without StrictXattrs: %+v", err)
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatalf("UnpackEntry should fail to apply xattr with StrictXattrs")
+				}
+				if !errors.Is(err, test.err) {
+					t.Errorf("unexpected UnpackEntry error with StrictXattrs: %+v", err)
+				}
+				if !strings.Contains(err.Error(), "security.capability") {
+					t.Errorf("UnpackEntry error doesn't mention the xattr: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRootlessDeviceRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRootlessDeviceRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+	devices := []*tar.Header{
+		{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+		{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "sda", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 8, Devminor: 0},
+		{Name: "big", Typeflag: tar.TypeChar, Mode: 0644, Devmajor: 4095, Devminor: 1048575},
+	}
+
+	unpack := func(rootfs string) {
+		te := NewTarExtractor(UnpackOptions{MapOptions: mapOptions})
+		// Devices must be faked even if we're actually root.
+		te.partialRootless = true
+		for _, dev := range devices {
+			hdr := *dev
+			hdr.ModTime = time.Unix(1234, 0)
+			if err := te.UnpackEntry(rootfs, &hdr, nil); err != nil {
+				t.Fatalf("unpack %s: %v", dev.Name, err)
+			}
+			if _, ok := hdr.Xattrs[rootlessDeviceXattr]; ok {
+				t.Errorf("%s: %s leaked into the caller's header", dev.Name, rootlessDeviceXattr)
+			}
+		}
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	unpack(rootfs)
+
+	// The placeholders for devices must record the original device.
+	for _, dev := range devices {
+		path := filepath.Join(rootfs, dev.Name)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.Typeflag == tar.TypeFifo {
+			if fi.Mode()&os.ModeNamedPipe == 0 {
+				t.Errorf("%s: expected fifo, got mode %v", dev.Name, fi.Mode())
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Size() != 0 {
+			t.Errorf("%s: expected empty placeholder file, got mode %v size %d", dev.Name, fi.Mode(), fi.Size())
+		}
+		value, err := system.Lgetxattr(path, rootlessDeviceXattr)
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skipf("filesystem does not support user xattrs: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("%s: get %s: %v", dev.Name, rootlessDeviceXattr, err)
+		}
+		if want := formatRootlessDevice(dev); string(value) != want {
+			t.Errorf("%s: unexpected %s: expected %q, got %q", dev.Name, rootlessDeviceXattr, want, value)
+		}
+	}
+
+	// Generating a layer from the placeholders must restore the devices.
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, mapOptions)
+	for _, dev := range devices {
+		if err := tg.AddFile(dev.Name, filepath.Join(rootfs, dev.Name)); err != nil {
+			t.Fatalf("AddFile %s: %v", dev.Name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := buf.Bytes()
+
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for _, dev := range devices {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading generated layer: %v", err)
+		}
+		if hdr.Name != dev.Name {
+			t.Fatalf("unexpected entry: expected %s, got %s", dev.Name, hdr.Name)
+		}
+		if hdr.Typeflag != dev.Typeflag || hdr.Devmajor != dev.Devmajor || hdr.Devminor != dev.Devminor {
+			t.Errorf("%s: device not preserved: expected type %c %d:%d, got type %c %d:%d", dev.Name, dev.Typeflag, dev.Devmajor, dev.Devminor, hdr.Typeflag, hdr.Devmajor, hdr.Devminor)
+		}
+		if hdr.Mode&0o7777 != dev.Mode {
+			t.Errorf("%s: unexpected mode: expected %o, got %o", dev.Name, dev.Mode, hdr.Mode&0o7777)
+		}
+		if hdr.Size != 0 {
+			t.Errorf("%s: unexpected size %d", dev.Name, hdr.Size)
+		}
+		if _, ok := hdr.Xattrs[rootlessDeviceXattr]; ok {
+			t.Errorf("%s: %s leaked into layer", dev.Name, rootlessDeviceXattr)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected only %d entries, err=%v", len(devices), err)
+	}
+
+	// Re-extracting the generated layer must result in the same placeholders.
+	rootfs2 := filepath.Join(dir, "rootfs2")
+	te2 := NewTarExtractor(UnpackOptions{MapOptions: mapOptions})
+	te2.partialRootless = true
+	tr = tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading generated layer: %v", err)
+		}
+		if err := te2.UnpackEntry(rootfs2, hdr, tr); err != nil {
+			t.Fatalf("re-unpack %s: %v", hdr.Name, err)
+		}
+	}
+	for _, dev := range devices {
+		if dev.Typeflag == tar.TypeFifo {
+			continue
+		}
+		value, err := system.Lgetxattr(filepath.Join(rootfs2, dev.Name), rootlessDeviceXattr)
+		if err != nil {
+			t.Fatalf("%s: get %s after re-unpack: %v", dev.Name, rootlessDeviceXattr, err)
+		}
+		if want := formatRootlessDevice(dev); string(value) != want {
+			t.Errorf("%s: unexpected %s after re-unpack: expected %q, got %q", dev.Name, rootlessDeviceXattr, want, value)
+		}
+	}
+
+	// A layer cannot set the xattr on other files.
+	te := NewTarExtractor(UnpackOptions{MapOptions: mapOptions})
+	hdr := &tar.Header{
+		Name:     "fake",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Xattrs:   map[string]string{rootlessDeviceXattr: "c 1 3"},
+	}
+	if err := te.UnpackEntry(rootfs, hdr, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("unpack fake: %v", err)
+	}
+	if _, ok := hdr.Xattrs[rootlessDeviceXattr]; !ok {
+		t.Errorf("UnpackEntry removed %s from the caller's header", rootlessDeviceXattr)
+	}
+	if _, err := system.Lgetxattr(filepath.Join(rootfs, "fake"), rootlessDeviceXattr); !errors.Is(err, unix.ENODATA) {
+		t.Errorf("layer was able to set %s: err=%v", rootlessDeviceXattr, err)
+	}
+
+	// Malformed values must be rejected rather than silently generating a
+	// regular file.
+	for _, value := range []string{"", "p 1 3", "c 1", "c -1 3", "b 1 x"} {
+		hdr := &tar.Header{
+			Name:     "bad",
+			Typeflag: tar.TypeReg,
+			Xattrs:   map[string]string{rootlessDeviceXattr: value},
+		}
+		if err := mapHeader(hdr, mapOptions); err == nil {
+			t.Errorf("mapHeader should fail with %s=%q", rootlessDeviceXattr, value)
+		}
+	}
+}
+
+// TestRootlessDeviceXattrNonRootless makes sure that the rootless device xattr
+// is ignored when generating layers outside of rootless mode, since any
+// unprivileged user can set it on a file.
+func TestRootlessDeviceXattrNonRootless(t *testing.T) {
+	if inUserNamespace {
+		t.Skip("placeholders are always converted inside user namespaces")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestRootlessDeviceXattrNonRootless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fake")
+	if err := ioutil.WriteFile(path, []byte("not a device"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(path, rootlessDeviceXattr, []byte("c 1 3"), 0); err != nil {
+		t.Skipf("filesystem does not support user xattrs: %v", err)
+	}
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    false,
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, mapOptions)
+	if err := tg.AddFile("fake", path); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading generated layer: %v", err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		t.Errorf("file with %s was turned into type %c in non-rootless mode", rootlessDeviceXattr, hdr.Typeflag)
+	}
+	if hdr.Size != int64(len("not a device")) {
+		t.Errorf("unexpected size %d", hdr.Size)
+	}
+	if _, ok := hdr.Xattrs[rootlessDeviceXattr]; ok {
+		t.Errorf("%s leaked into layer", rootlessDeviceXattr)
+	}
+}
+
+func TestUnpackLayerMaxTrackedPathsOverlayFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerMaxTrackedPathsOverlayFS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mknodOk, err := canMknod(dir)
+	if err != nil {
+		t.Fatalf("couldn't mknod in dir: %v", err)
+	}
+	if !mknodOk {
+		t.Skip("skipping overlayfs test on kernel < 5.8")
+	}
+
+	// Many whiteouts (and other entries) in a single layer.
+	base := []*tar.Header{{Name: "dir/", Typeflag: tar.TypeDir}}
+	upper := []*tar.Header{{Name: "dir/", Typeflag: tar.TypeDir}}
+	for i := 0; i < 100; i++ {
+		base = append(base, &tar.Header{Name: fmt.Sprintf("dir/file%d", i), Typeflag: tar.TypeReg})
+		upper = append(upper, &tar.Header{Name: fmt.Sprintf("dir/new%d", i), Typeflag: tar.TypeReg})
+		if i%2 == 0 {
+			upper = append(upper, &tar.Header{Name: fmt.Sprintf("dir/%sfile%d", whPrefix, i), Typeflag: tar.TypeReg})
+		}
+	}
+
+	// Paths are not tracked for overlayfs whiteouts, so the limit must never
+	// be hit.
+	rootfs := filepath.Join(dir, "rootfs")
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+		WhiteoutMode:      OverlayFSWhiteout,
+		MaxTrackedPaths:   1,
+		TrackedPathsLimit: TrackedPathsLimitError,
+	}
+	for idx, layer := range [][]byte{makeTarLayer(t, base...), makeTarLayer(t, upper...)} {
+		if err := UnpackLayer(rootfs, bytes.NewReader(layer), &opt); err != nil {
+			t.Fatalf("unexpected error unpacking layer %d: %+v", idx, err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Lstat(filepath.Join(rootfs, "dir", fmt.Sprintf("new%d", i))); err != nil {
+			t.Errorf("new file %d missing: %v", i, err)
+		}
+		fi, err := os.Lstat(filepath.Join(rootfs, "dir", fmt.Sprintf("file%d", i)))
+		if err != nil {
+			t.Errorf("file %d missing: %v", i, err)
+			continue
+		}
+		whiteout, err := isOverlayWhiteout(fi)
+		if err != nil {
+			t.Fatalf("failed to check overlay whiteout: %v", err)
+		}
+		if whiteout != (i%2 == 0) {
+			t.Errorf("file %d: expected whiteout=%v, got %v", i, i%2 == 0, whiteout)
+		}
+	}
+}
+
+// requireReflink skips the test if reflinks are not supported in dir.
+func requireReflink(t *testing.T, dir string) {
+	src, err := ioutil.TempFile(dir, "reflink-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, "reflink-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err := src.Write([]byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.Reflink(dst, src); err != nil {
+		if errors.Is(err, system.ErrReflinkUnsupported) {
+			t.Skipf("reflinks not supported: %v", err)
+		}
+		t.Fatalf("reflink: %v", err)
+	}
+}
+
+// Constants and structures for the FS_IOC_FIEMAP ioctl (from
+// <linux/fiemap.h>), which are not provided by golang.org/x/sys/unix.
+const (
+	fsIocFiemap         = 0xc020660b
+	fiemapFlagSync      = 0x1
+	fiemapExtentLast    = 0x1
+	fiemapExtentShared  = 0x2000
+	fiemapExtentsPerReq = 32
+)
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	Reserved64 [2]uint64
+	Flags      uint32
+	Reserved   [3]uint32
+}
+
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	Reserved      uint32
+	Extents       [fiemapExtentsPerReq]fiemapExtent
+}
+
+// sharedExtents returns the number of bytes of the extents of path which are
+// shared with other files, as well as the total size of its extents.
+func sharedExtents(t *testing.T, path string) (shared, total uint64) {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	var start uint64
+	for {
+		fm := fiemap{
+			Start:       start,
+			Length:      ^uint64(0) - start,
+			Flags:       fiemapFlagSync,
+			ExtentCount: fiemapExtentsPerReq,
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fh.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&fm))); errno != 0 {
+			t.Fatalf("fiemap %s: %v", path, errno)
+		}
+		if fm.MappedExtents == 0 {
+			return
+		}
+		for _, extent := range fm.Extents[:fm.MappedExtents] {
+			total += extent.Length
+			if extent.Flags&fiemapExtentShared != 0 {
+				shared += extent.Length
+			}
+			start = extent.Logical + extent.Length
+			if extent.Flags&fiemapExtentLast != 0 {
+				return
+			}
+		}
+	}
+}
+
+func TestUnpackLayerReflinkFromSharedExtents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerReflinkFromSharedExtents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	requireReflink(t, dir)
+
+	const fileSize = 1024 * 1024
+	layer := sizedTarLayer(t, 4, fileSize)
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	previous := filepath.Join(dir, "previous")
+	if err := UnpackLayer(previous, bytes.NewReader(layer), &opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	// Modify one of the files, so that it cannot be fully shared.
+	fh, err := os.OpenFile(filepath.Join(previous, "dir", "file3"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt([]byte("modified contents"), fileSize/2); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	rootfs := filepath.Join(dir, "rootfs")
+	opt.ReflinkFrom = previous
+	if err := UnpackLayer(rootfs, bytes.NewReader(layer), &opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer with ReflinkFrom: %+v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(rootfs, "dir", fmt.Sprintf("file%d", i))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{'a' + byte(i)}, fileSize)) {
+			t.Errorf("file%d: unexpected contents", i)
+		}
+
+		shared, total := sharedExtents(t, path)
+		switch {
+		case i < 3 && shared != total:
+			t.Errorf("file%d: expected all extents to be shared, only %d of %d bytes are", i, shared, total)
+		case i == 3 && (shared == 0 || shared == total):
+			t.Errorf("file%d: expected extents to be partially shared, %d of %d bytes are", i, shared, total)
+		}
+	}
+}
+
+func TestUnpackLayerMem(t *testing.T) {
+	mem := fseval.NewMem()
+	defer mem.Close()
+
+	base := makeTarLayer(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 100,
+			Xattrs: map[string]string{"user.foo": "bar"}},
+		&tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "etc/passwd.link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		&tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "../usr/share/zoneinfo/UTC"},
+		&tar.Header{Name: "dev/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	)
+	upper := makeTarLayer(t,
+		&tar.Header{Name: "etc/" + whPrefix + "hosts", Typeflag: tar.TypeReg},
+	)
+
+	// The owners are applied even though we might not be root, since nothing
+	// touches the host filesystem.
+	opt := &UnpackOptions{FsEval: mem}
+	for _, layer := range [][]byte{base, upper} {
+		if err := UnpackLayer("/", bytes.NewReader(layer), opt); err != nil {
+			t.Fatalf("unexpected unpack error: %+v", err)
+		}
+	}
+
+	infos, err := mem.Readdir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if got, want := strings.Join(names, " "), "localtime passwd passwd.link"; got != want {
+		t.Errorf("unexpected /etc entries: got %q, want %q", got, want)
+	}
+
+	fh, err := mem.Open("/etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(fh)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "etc/passwd" {
+		t.Errorf("unexpected contents of /etc/passwd: %q", contents)
+	}
+
+	st, err := mem.Lstatx("/etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != unix.S_IFREG|0640 || st.Uid != 1000 || st.Gid != 100 {
+		t.Errorf("unexpected /etc/passwd metadata: mode=0%o uid=%d gid=%d", st.Mode, st.Uid, st.Gid)
+	}
+	if st.Nlink != 2 {
+		t.Errorf("unexpected /etc/passwd link count: %d", st.Nlink)
+	}
+	if st.Mtim.Sec != 1234567890 {
+		t.Errorf("unexpected /etc/passwd mtime: %d", st.Mtim.Sec)
+	}
+	if value, err := mem.Lgetxattr("/etc/passwd", "user.foo"); err != nil || string(value) != "bar" {
+		t.Errorf("unexpected /etc/passwd xattr user.foo: %q (err=%v)", value, err)
+	}
+	fi, err := mem.Lstat("/etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkFi, err := mem.Lstat("/etc/passwd.link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(fi, linkFi) {
+		t.Errorf("/etc/passwd.link is not a hardlink of /etc/passwd")
+	}
+
+	if target, err := mem.Readlink("/etc/localtime"); err != nil || target != "../usr/share/zoneinfo/UTC" {
+		t.Errorf("unexpected /etc/localtime target: %q (err=%v)", target, err)
+	}
+
+	st, err = mem.Lstatx("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUserNamespace {
+		// Devices are replaced with empty files in user namespaces.
+		if st.Mode&unix.S_IFMT != unix.S_IFREG {
+			t.Errorf("expected rootless /dev/null to be a regular file: mode=0%o", st.Mode)
+		}
+	} else if st.Mode != unix.S_IFCHR|0666 || st.Rdev != unix.Mkdev(1, 3) {
+		t.Errorf("unexpected /dev/null metadata: mode=0%o rdev=%d:%d", st.Mode, unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	}
+}
+
+func TestUnpackLayerSELinuxMem(t *testing.T) {
+	mem := fseval.NewMem()
+	defer mem.Close()
+
+	var fileContexts selinux.FileContexts
+	if err := fileContexts.AddSpecs(strings.NewReader(`
+/.*			system_u:object_r:default_t:s0
+/etc(/.*)?		system_u:object_r:etc_t:s0
+/usr/bin(/.*)?	--	system_u:object_r:bin_t:s0
+/usr/bin/.*	-l	system_u:object_r:bin_link_t:s0
+/proc(/.*)?		<<none>>
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := makeTarLayer(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir},
+		// The label must not be taken from the layer.
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg,
+			Xattrs: map[string]string{"security.selinux": "system_u:object_r:evil_t:s0"}},
+		&tar.Header{Name: "usr/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "usr/bin/bash", Typeflag: tar.TypeSymlink, Linkname: "sh"},
+		&tar.Header{Name: "usr/bin/ash", Typeflag: tar.TypeLink, Linkname: "usr/bin/sh"},
+		&tar.Header{Name: "proc/", Typeflag: tar.TypeDir},
+	)
+	// The root filesystem is extracted into a subdirectory, which must not
+	// affect the labels.
+	if err := mem.MkdirAll("/rootfs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer("/rootfs", bytes.NewReader(layer), &UnpackOptions{
+		FsEval:              mem,
+		SELinuxFileContexts: &fileContexts,
+	}); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	for path, expected := range map[string]string{
+		"etc":          "system_u:object_r:etc_t:s0",
+		"etc/passwd":   "system_u:object_r:etc_t:s0",
+		"usr":          "system_u:object_r:default_t:s0",
+		"usr/bin":      "system_u:object_r:default_t:s0",
+		"usr/bin/sh":   "system_u:object_r:bin_t:s0",
+		"usr/bin/bash": "system_u:object_r:bin_link_t:s0",
+		"proc":         "",
+	} {
+		value, err := mem.Lgetxattr(filepath.Join("/rootfs", path), "security.selinux")
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: unexpected label %q", path, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error getting label: %v", path, err)
+		} else if string(value) != expected {
+			t.Errorf("%s: unexpected label: expected %q got %q", path, expected, value)
+		}
+	}
+}
+
+func TestUnpackLayerSELinuxHost(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/selinux/enforce"); err != nil {
+		t.Skip("test requires selinux to be enabled")
+	}
+	fileContexts, err := selinux.HostFileContexts()
+	if err != nil {
+		t.Skipf("test requires an installed selinux policy: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerSELinuxHost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hdrs := []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "usr/", Typeflag: tar.TypeDir},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir},
+		{Name: "usr/bin/sh", Typeflag: tar.TypeReg},
+		{Name: "usr/bin/bash", Typeflag: tar.TypeSymlink, Linkname: "sh"},
+	}
+	if err := UnpackLayer(dir, bytes.NewReader(makeTarLayer(t, hdrs...)), &UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+		SELinuxFileContexts: fileContexts,
+	}); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	for _, hdr := range hdrs {
+		expected, ok := fileContexts.Lookup(filepath.Join("/", hdr.Name), hdr.FileInfo().Mode())
+		if !ok {
+			continue
+		}
+		buf := make([]byte, 1024)
+		n, err := unix.Lgetxattr(filepath.Join(dir, hdr.Name), "security.selinux", buf)
+		if err != nil {
+			t.Errorf("%s: unexpected error getting label: %v", hdr.Name, err)
+			continue
+		}
+		// The kernel may return the label with a trailing NUL byte.
+		if got := strings.TrimSuffix(string(buf[:n]), "\x00"); got != expected {
+			t.Errorf("%s: unexpected label: expected %q got %q", hdr.Name, expected, got)
+		}
+	}
+}
+
+// diskUsage returns the number of bytes allocated on disk for path.
+func diskUsage(t *testing.T, path string) int64 {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		t.Fatalf("lstat %s: %v", path, err)
+	}
+	return st.Blocks * 512
+}
+
+func TestUnpackLayerDetectSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerDetectSparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A 1MiB file which is almost entirely zero.
+	const fileSize = 1024 * 1024
+	contents := make([]byte, fileSize)
+	copy(contents, "start of file")
+	copy(contents[fileSize/2:], "middle of file")
+	copy(contents[fileSize-3:], "end")
+
+	srcPath := filepath.Join(dir, "src")
+	writeSparseFile(t, srcPath, contents)
+	if diskUsage(t, srcPath) >= fileSize {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, MapOptions{})
+	if err := tg.AddFile("file", srcPath); err != nil {
+		t.Fatalf("AddFile: unexpected error: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %+v", err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		detectSparse bool
+	}{
+		{"Dense", false},
+		{"DetectSparse", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rootfs := filepath.Join(dir, test.name)
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					Rootless: os.Geteuid() != 0,
+				},
+				DetectSparse: test.detectSparse,
+			}
+			if err := UnpackLayer(rootfs, bytes.NewReader(layer.Bytes()), &opt); err != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", err)
+			}
+
+			path := filepath.Join(rootfs, "file")
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("unexpected contents of unpacked file")
+			}
+
+			// Without DetectSparse the zeroes are written out in full.
+			usage := diskUsage(t, path)
+			switch {
+			case test.detectSparse && usage >= fileSize/2:
+				t.Errorf("expected unpacked file to be sparse: %d bytes allocated for %d byte file", usage, fileSize)
+			case !test.detectSparse && usage < fileSize:
+				t.Errorf("expected unpacked file to not be sparse: %d bytes allocated for %d byte file", usage, fileSize)
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -31,7 +32,9 @@ import (
 	"testing"
 	"time"
 
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/opencontainers/umoci/pkg/testutils"
 	"golang.org/x/sys/unix"
 )
@@ -201,6 +204,190 @@ func TestUnpackEntryParentDir(t *testing.T) {
 	}
 }
 
+// addUpperPathNaive is the reference implementation of
+// TarExtractor.addUpperPath, which unconditionally inserts every ancestor.
+func addUpperPathNaive(upperPaths map[string]struct{}, upperPath string) {
+	for pth := upperPath; pth != filepath.Dir(pth); pth = filepath.Dir(pth) {
+		upperPaths[pth] = struct{}{}
+	}
+}
+
+// deepLayerPaths returns the names of the entries of a synthetic layer with
+// several deeply nested directory trees, each containing files at every level.
+// Directory names have a trailing "/".
+func deepLayerPaths(trees, depth, files int) []string {
+	var paths []string
+	for i := 0; i < trees; i++ {
+		dir := fmt.Sprintf("tree%d", i)
+		for j := 0; j < depth; j++ {
+			dir = filepath.Join(dir, fmt.Sprintf("level%d", j))
+			paths = append(paths, dir+"/")
+			for k := 0; k < files; k++ {
+				paths = append(paths, filepath.Join(dir, fmt.Sprintf("file%d", k)))
+			}
+		}
+	}
+	return paths
+}
+
+func TestUnpackEntryUpperPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryUpperPaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files before their parent directories, repeated entries, and entries
+	// which aren't clean should all result in the same set of paths.
+	paths := append([]string{
+		"a/b/c/d/file",
+		"a/b/c/",
+		"a/b/other",
+		"./x/y/../y/z",
+		"a/b/c/d/file",
+		"/abs/path",
+	}, deepLayerPaths(3, 16, 2)...)
+
+	te := NewTarExtractor(UnpackOptions{})
+	expected := map[string]struct{}{}
+	for _, path := range paths {
+		hdr := &tar.Header{
+			Name:     path,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		}
+		if strings.HasSuffix(path, "/") {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := te.UnpackEntry(rootfs, hdr, bytes.NewBuffer(nil)); err != nil {
+			t.Fatalf("unexpected UnpackEntry error for %q: %+v", path, err)
+		}
+		addUpperPathNaive(expected, strings.TrimPrefix(CleanPath("/"+path), "/"))
+	}
+
+	if len(te.upperPaths) != len(expected) {
+		t.Errorf("unexpected number of upper paths: expected %d got %d", len(expected), len(te.upperPaths))
+	}
+	for path := range expected {
+		if _, ok := te.upperPaths[path]; !ok {
+			t.Errorf("upper paths missing %q", path)
+		}
+	}
+	for path := range te.upperPaths {
+		if _, ok := expected[path]; !ok {
+			t.Errorf("upper paths has unexpected %q", path)
+		}
+	}
+}
+
+func TestAddUpperPathSpill(t *testing.T) {
+	var paths []string
+	for _, path := range deepLayerPaths(3, 16, 2) {
+		paths = append(paths, filepath.Clean(path))
+	}
+	expected := map[string]struct{}{}
+	for _, path := range paths {
+		addUpperPathNaive(expected, path)
+	}
+
+	for _, test := range []struct {
+		name     string
+		maxPaths int
+		spilled  bool
+	}{
+		{"InMemory", len(expected), false},
+		{"Spill", 7, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "umoci-TestAddUpperPathSpill")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			t.Setenv("TMPDIR", tmpDir)
+
+			te := NewTarExtractor(UnpackOptions{
+				MaxTrackedPaths:   test.maxPaths,
+				TrackedPathsLimit: TrackedPathsLimitSpill,
+			})
+			for _, path := range paths {
+				if err := te.addUpperPath(path); err != nil {
+					t.Fatalf("unexpected addUpperPath error for %q: %+v", path, err)
+				}
+				if len(te.upperPaths) > test.maxPaths {
+					t.Fatalf("more than %d paths tracked in memory: %d", test.maxPaths, len(te.upperPaths))
+				}
+			}
+
+			if spilled := te.upperPathsSpill != ""; spilled != test.spilled {
+				t.Errorf("unexpected spill state: expected spilled=%v got %v (%d paths in memory)", test.spilled, spilled, len(te.upperPaths))
+			}
+			if !test.spilled && len(te.upperPaths) != len(expected) {
+				t.Errorf("unexpected number of in-memory paths: expected %d got %d", len(expected), len(te.upperPaths))
+			}
+
+			// Every path must be found, no matter where it is stored.
+			for path := range expected {
+				if ok, err := te.hasUpperPath(path); err != nil {
+					t.Errorf("unexpected hasUpperPath error for %q: %+v", path, err)
+				} else if !ok {
+					t.Errorf("upper paths missing %q", path)
+				}
+			}
+			for _, path := range []string{".", "missing", "tree0/missing"} {
+				if ok, err := te.hasUpperPath(path); err != nil {
+					t.Errorf("unexpected hasUpperPath error for %q: %+v", path, err)
+				} else if ok {
+					t.Errorf("upper paths has unexpected %q", path)
+				}
+			}
+
+			if err := te.Close(); err != nil {
+				t.Fatalf("unexpected error closing extractor: %+v", err)
+			}
+			if names, err := ioutil.ReadDir(tmpDir); err != nil {
+				t.Fatal(err)
+			} else if len(names) != 0 {
+				t.Errorf("temporary files left behind after close: %v", names)
+			}
+		})
+	}
+}
+
+func BenchmarkAddUpperPath(b *testing.B) {
+	var paths []string
+	for _, path := range deepLayerPaths(8, 64, 8) {
+		paths = append(paths, filepath.Clean(path))
+	}
+
+	b.Run("Naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			upperPaths := map[string]struct{}{}
+			for _, path := range paths {
+				addUpperPathNaive(upperPaths, path)
+			}
+		}
+	})
+
+	b.Run("EarlyStop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			te := &TarExtractor{upperPaths: map[string]struct{}{}}
+			for _, path := range paths {
+				te.addUpperPath(path)
+			}
+		}
+	})
+}
+
 // TestUnpackEntryWhiteout checks whether whiteout handling is done correctly,
 // as well as ensuring that the metadata of the parent is maintained.
 func TestUnpackEntryWhiteout(t *testing.T) {
@@ -957,3 +1144,1036 @@ func TestIsDirlink(t *testing.T) {
 		t.Errorf("file dirlink test failed")
 	}
 }
+
+// TestUnpackEntryForeignPlatform makes sure that Linux-specific extraction
+// steps (device nodes and xattrs) are skipped for windows images.
+func TestUnpackEntryForeignPlatform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryForeignPlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	te := NewTarExtractor(UnpackOptions{
+		Platform: ispec.Platform{
+			OS:           "windows",
+			Architecture: "amd64",
+		},
+	})
+
+	// Device nodes should be skipped entirely (not even faked).
+	devHdr := &tar.Header{
+		Name:     "dev/null",
+		Mode:     0666,
+		Typeflag: tar.TypeChar,
+		Devmajor: 1,
+		Devminor: 3,
+		ModTime:  time.Now(),
+	}
+	if err := te.UnpackEntry(dir, devHdr, nil); err != nil {
+		t.Fatalf("unexpected UnpackEntry error: %s", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "dev/null")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("device node was created for windows image: %v", err)
+	}
+
+	// Xattrs should not be applied.
+	ctrValue := []byte("windows file")
+	fileHdr := &tar.Header{
+		Name:     "file",
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+		Mode:     0644,
+		Size:     int64(len(ctrValue)),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+		Xattrs: map[string]string{
+			"user.some.xattr": "value",
+		},
+	}
+	if err := te.UnpackEntry(dir, fileHdr, bytes.NewBuffer(ctrValue)); err != nil {
+		t.Fatalf("unexpected UnpackEntry error: %s", err)
+	}
+	if _, err := system.Lgetxattr(filepath.Join(dir, "file"), "user.some.xattr"); err == nil {
+		t.Errorf("xattr was applied for windows image")
+	}
+	if ctrValueGot, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil {
+		t.Fatalf("unexpected readfile error: %s", err)
+	} else if !bytes.Equal(ctrValue, ctrValueGot) {
+		t.Errorf("file contents incorrect: expected=%q got=%q", string(ctrValue), string(ctrValueGot))
+	}
+}
+
+// TestUnpackEntryMaxXattrSize makes sure that oversized xattrs are skipped or
+// rejected depending on the UnpackOptions.
+func TestUnpackEntryMaxXattrSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryMaxXattrSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Make sure the filesystem supports user xattrs.
+	testFile := filepath.Join(dir, "xattr-test")
+	if err := ioutil.WriteFile(testFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(testFile, "user.test", []byte("test"), 0); err != nil {
+		t.Skipf("filesystem does not support user xattrs: %v", err)
+	}
+
+	smallValue := "small"
+	hugeValue := strings.Repeat("x", 2048)
+
+	for _, test := range []struct {
+		name        string
+		maxSize     int
+		reject      bool
+		expectErr   bool
+		expectHuge  bool
+		expectSmall bool
+	}{
+		{"NoLimit", 0, false, false, true, true},
+		{"LargeLimit", 4096, true, false, true, true},
+		{"Skip", 1024, false, false, false, true},
+		{"Reject", 1024, true, true, false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rootfs, err := ioutil.TempDir(dir, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := &tar.Header{
+				Name:     "file",
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+				Mode:     0644,
+				Typeflag: tar.TypeReg,
+				ModTime:  time.Now(),
+				Xattrs: map[string]string{
+					"user.small": smallValue,
+					"user.huge":  hugeValue,
+				},
+			}
+
+			// Keep a reference to the original map, to make sure that neither
+			// it nor the caller's header are modified by UnpackEntry.
+			xattrs := hdr.Xattrs
+
+			te := NewTarExtractor(UnpackOptions{
+				MaxXattrSize:          test.maxSize,
+				RejectOversizedXattrs: test.reject,
+			})
+			err = te.UnpackEntry(rootfs, hdr, bytes.NewBuffer(nil))
+			if len(xattrs) != 2 || xattrs["user.small"] != smallValue || xattrs["user.huge"] != hugeValue {
+				t.Errorf("UnpackEntry modified the caller's xattr map: %d xattrs left", len(xattrs))
+			}
+			if hdr.Xattrs["user.huge"] != hugeValue {
+				t.Errorf("UnpackEntry dropped the oversized xattr from the caller's header")
+			}
+			if test.expectErr {
+				if err == nil {
+					t.Fatalf("expected UnpackEntry to fail with oversized xattr")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %s", err)
+			}
+
+			path := filepath.Join(rootfs, "file")
+			for _, xattr := range []struct {
+				name, value string
+				expected    bool
+			}{
+				{"user.small", smallValue, test.expectSmall},
+				{"user.huge", hugeValue, test.expectHuge},
+			} {
+				value, err := system.Lgetxattr(path, xattr.name)
+				if xattr.expected {
+					if err != nil {
+						t.Errorf("expected xattr %q to be set: %v", xattr.name, err)
+					} else if string(value) != xattr.value {
+						t.Errorf("unexpected value for xattr %q: got %d bytes", xattr.name, len(value))
+					}
+				} else if err == nil {
+					t.Errorf("expected xattr %q to be skipped", xattr.name)
+				}
+			}
+		})
+	}
+}
+
+// TestUnpackEntryXattrNamespaces makes sure that only xattrs in the namespaces
+// listed in UnpackOptions.XattrNamespaces are applied.
+func TestUnpackEntryXattrNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryXattrNamespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Make sure the filesystem supports user xattrs.
+	testFile := filepath.Join(dir, "xattr-test")
+	if err := ioutil.WriteFile(testFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(testFile, "user.test", []byte("test"), 0); err != nil {
+		t.Skipf("filesystem does not support user xattrs: %v", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		namespaces []string
+		expected   []string
+		needsRoot  bool
+	}{
+		{"All", nil, []string{"user.a", "user.b", "trusted.c"}, true},
+		{"User", []string{"user"}, []string{"user.a", "user.b"}, false},
+		{"UserDot", []string{"user."}, []string{"user.a", "user.b"}, false},
+		{"Trusted", []string{"trusted"}, []string{"trusted.c"}, true},
+		{"None", []string{}, nil, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.needsRoot && os.Geteuid() != 0 {
+				t.Skip("trusted.* xattrs require root")
+			}
+
+			rootfs, err := ioutil.TempDir(dir, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			xattrs := map[string]string{
+				"user.a":    "a",
+				"user.b":    "b",
+				"trusted.c": "c",
+			}
+			hdr := &tar.Header{
+				Name:     "file",
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+				Mode:     0644,
+				Typeflag: tar.TypeReg,
+				ModTime:  time.Now(),
+				Xattrs:   map[string]string{},
+			}
+			for name, value := range xattrs {
+				hdr.Xattrs[name] = value
+			}
+
+			te := NewTarExtractor(UnpackOptions{
+				XattrNamespaces: test.namespaces,
+			})
+			if err := te.UnpackEntry(rootfs, hdr, bytes.NewBuffer(nil)); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %s", err)
+			}
+
+			path := filepath.Join(rootfs, "file")
+			for name, value := range xattrs {
+				expected := false
+				for _, want := range test.expected {
+					if name == want {
+						expected = true
+					}
+				}
+				got, err := system.Lgetxattr(path, name)
+				if expected {
+					if err != nil {
+						t.Errorf("expected xattr %q to be set: %v", name, err)
+					} else if string(got) != value {
+						t.Errorf("unexpected value for xattr %q: expected %q got %q", name, value, string(got))
+					}
+				} else if err == nil {
+					t.Errorf("expected xattr %q to be skipped", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackEntryCopyBufferSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryCopyBufferSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Make the contents a size which isn't a multiple of any buffer size.
+	ctrValue := make([]byte, 3<<20+1234)
+	if _, err := rand.Read(ctrValue); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 512, 4096, 32 * 1024, 1 << 20, 8 << 20} {
+		t.Run(fmt.Sprintf("Size%d", size), func(t *testing.T) {
+			rootfs, err := ioutil.TempDir(dir, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := &tar.Header{
+				Name:     "file",
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+				Mode:     0644,
+				Size:     int64(len(ctrValue)),
+				Typeflag: tar.TypeReg,
+				ModTime:  time.Now(),
+			}
+
+			te := NewTarExtractor(UnpackOptions{CopyBufferSize: size})
+			if err := te.UnpackEntry(rootfs, hdr, bytes.NewReader(ctrValue)); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+
+			ctrValueGot, err := ioutil.ReadFile(filepath.Join(rootfs, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ctrValue, ctrValueGot) {
+				t.Errorf("unpacked file contents differ (buffer size %d)", size)
+			}
+		})
+	}
+}
+
+func BenchmarkUnpackEntryCopyBufferSize(b *testing.B) {
+	dir, err := ioutil.TempDir("", "umoci-BenchmarkUnpackEntryCopyBufferSize")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctrValue := make([]byte, 64<<20)
+	if _, err := rand.Read(ctrValue); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{4096, 32 * 1024, 1 << 20} {
+		b.Run(fmt.Sprintf("Size%d", size), func(b *testing.B) {
+			te := NewTarExtractor(UnpackOptions{CopyBufferSize: size})
+			b.SetBytes(int64(len(ctrValue)))
+			for i := 0; i < b.N; i++ {
+				hdr := &tar.Header{
+					Name:     "file",
+					Uid:      os.Getuid(),
+					Gid:      os.Getgid(),
+					Mode:     0644,
+					Size:     int64(len(ctrValue)),
+					Typeflag: tar.TypeReg,
+					ModTime:  time.Now(),
+				}
+				if err := te.UnpackEntry(dir, hdr, bytes.NewReader(ctrValue)); err != nil {
+					b.Fatalf("unexpected UnpackEntry error: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackEntrySequentialIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntrySequentialIO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctrValue := make([]byte, 1<<20+1234)
+	if _, err := rand.Read(ctrValue); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sequentialIO := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SequentialIO=%t", sequentialIO), func(t *testing.T) {
+			rootfs, err := ioutil.TempDir(dir, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := &tar.Header{
+				Name:     "file",
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+				Mode:     0640,
+				Size:     int64(len(ctrValue)),
+				Typeflag: tar.TypeReg,
+				ModTime:  time.Unix(1234567890, 0),
+			}
+
+			te := NewTarExtractor(UnpackOptions{SequentialIO: sequentialIO})
+			if err := te.UnpackEntry(rootfs, hdr, bytes.NewReader(ctrValue)); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+
+			path := filepath.Join(rootfs, "file")
+			ctrValueGot, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ctrValue, ctrValueGot) {
+				t.Errorf("unpacked file contents differ")
+			}
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode() != 0640 {
+				t.Errorf("unexpected mode: expected %v got %v", os.FileMode(0640), fi.Mode())
+			}
+			if !fi.ModTime().Equal(hdr.ModTime) {
+				t.Errorf("unexpected mtime: expected %v got %v", hdr.ModTime, fi.ModTime())
+			}
+		})
+	}
+}
+
+func BenchmarkUnpackEntrySequentialIO(b *testing.B) {
+	dir, err := ioutil.TempDir("", "umoci-BenchmarkUnpackEntrySequentialIO")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctrValue := make([]byte, 64<<20)
+	if _, err := rand.Read(ctrValue); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, sequentialIO := range []bool{false, true} {
+		b.Run(fmt.Sprintf("SequentialIO=%t", sequentialIO), func(b *testing.B) {
+			te := NewTarExtractor(UnpackOptions{SequentialIO: sequentialIO})
+			b.SetBytes(int64(len(ctrValue)))
+			for i := 0; i < b.N; i++ {
+				hdr := &tar.Header{
+					Name:     "file",
+					Uid:      os.Getuid(),
+					Gid:      os.Getgid(),
+					Mode:     0644,
+					Size:     int64(len(ctrValue)),
+					Typeflag: tar.TypeReg,
+					ModTime:  time.Now(),
+				}
+				if err := te.UnpackEntry(dir, hdr, bytes.NewReader(ctrValue)); err != nil {
+					b.Fatalf("unexpected UnpackEntry error: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackEntryDenyPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryDenyPaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a pre-existing file in a denied directory.
+	if err := os.MkdirAll(filepath.Join(dir, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dev", "existing"), []byte("host content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctrValue := []byte("container content")
+	for _, test := range []struct {
+		name     string
+		typeflag byte
+		linkname string
+	}{
+		{"dev/null", tar.TypeReg, ""},
+		{"proc", tar.TypeDir, ""},
+		{"proc/self", tar.TypeReg, ""},
+		{"etc", tar.TypeDir, ""},
+		{"etc/passwd", tar.TypeReg, ""},
+		// Only entire path components are matched.
+		{"devices", tar.TypeReg, ""},
+		// Symlinks to denied paths are fine, but writing through them is not.
+		{"link", tar.TypeSymlink, "/dev"},
+		{"link/evil", tar.TypeReg, ""},
+		// Hardlinks to files in denied paths would share the inode.
+		{"hardlink", tar.TypeLink, "dev/existing"},
+		// Whiteouts of (or above) denied paths must not remove them.
+		{".wh.dev", tar.TypeReg, ""},
+		{whOpaque, tar.TypeReg, ""},
+	} {
+		hdr := &tar.Header{
+			Name:     test.name,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Mode:     0644,
+			Typeflag: test.typeflag,
+			Linkname: test.linkname,
+			ModTime:  time.Now(),
+		}
+		var r io.Reader
+		if test.typeflag == tar.TypeReg && !strings.HasPrefix(test.name, whPrefix) {
+			hdr.Size = int64(len(ctrValue))
+			r = bytes.NewReader(ctrValue)
+		}
+		if test.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+
+		te := NewTarExtractor(UnpackOptions{DenyPaths: []string{"/dev", "proc/"}})
+		if err := te.UnpackEntry(dir, hdr, r); err != nil {
+			t.Fatalf("unexpected UnpackEntry(%s) error: %+v", test.name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"dev/existing", true},
+		{"dev/null", false},
+		{"dev/evil", false},
+		{"proc", false},
+		{"hardlink", false},
+		{"etc/passwd", true},
+		{"devices", true},
+		{"link", true},
+	} {
+		_, err := os.Lstat(filepath.Join(dir, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("path %q: expected exists=%v, got err=%v", test.path, test.exists, err)
+		}
+	}
+
+	// Denied paths must not have been modified.
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "dev", "existing")); err != nil {
+		t.Errorf("unexpected error reading denied file: %+v", err)
+	} else if string(got) != "host content" {
+		t.Errorf("denied file was modified: got %q", string(got))
+	}
+	// Siblings must have been extracted.
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "etc", "passwd")); err != nil {
+		t.Errorf("unexpected error reading extracted file: %+v", err)
+	} else if !bytes.Equal(got, ctrValue) {
+		t.Errorf("extracted file has unexpected contents: got %q", string(got))
+	}
+}
+
+func TestUnpackEntryIncludeExcludePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryIncludeExcludePaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create some pre-existing files for whiteouts to remove.
+	for _, path := range []string{"etc/old", "var/old"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var diagnostics []Diagnostic
+	te := NewTarExtractor(UnpackOptions{
+		IncludePaths: []string{"/etc/**", "usr/lib/**/*.so"},
+		ExcludePaths: []string{"etc/ssl/private"},
+		OnDiagnostic: func(d Diagnostic) {
+			diagnostics = append(diagnostics, d)
+		},
+	})
+
+	ctrValue := []byte("container content")
+	for _, test := range []struct {
+		name     string
+		typeflag byte
+		mode     int64
+		linkname string
+	}{
+		{"etc", tar.TypeDir, 0700, ""},
+		{"etc/passwd", tar.TypeReg, 0644, ""},
+		{"etc/ssl", tar.TypeDir, 0755, ""},
+		{"etc/ssl/certs", tar.TypeDir, 0755, ""},
+		{"etc/ssl/certs/ca.pem", tar.TypeReg, 0644, ""},
+		{"etc/ssl/private", tar.TypeDir, 0700, ""},
+		{"etc/ssl/private/key.pem", tar.TypeReg, 0600, ""},
+		{"usr", tar.TypeDir, 0711, ""},
+		{"usr/bin", tar.TypeDir, 0755, ""},
+		{"usr/bin/sh", tar.TypeReg, 0755, ""},
+		{"usr/lib", tar.TypeDir, 0755, ""},
+		// The parent directory has no entry of its own.
+		{"usr/lib/x86_64/libc.so", tar.TypeReg, 0755, ""},
+		{"usr/lib/x86_64/README", tar.TypeReg, 0644, ""},
+		// Whiteouts are only applied to selected paths.
+		{"etc/.wh.old", tar.TypeReg, 0644, ""},
+		{"var/.wh.old", tar.TypeReg, 0644, ""},
+		// Hardlinks to paths which are not extracted are skipped.
+		{"etc/sh", tar.TypeLink, 0755, "usr/bin/sh"},
+		{"etc/passwd-", tar.TypeLink, 0644, "etc/passwd"},
+	} {
+		hdr := &tar.Header{
+			Name:     test.name,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Mode:     test.mode,
+			Typeflag: test.typeflag,
+			Linkname: test.linkname,
+			ModTime:  time.Now(),
+		}
+		var r io.Reader
+		if test.typeflag == tar.TypeReg && !strings.Contains(test.name, whPrefix) {
+			hdr.Size = int64(len(ctrValue))
+			r = bytes.NewReader(ctrValue)
+		}
+		if err := te.UnpackEntry(dir, hdr, r); err != nil {
+			t.Fatalf("unexpected UnpackEntry(%s) error: %+v", test.name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"etc/passwd", true},
+		{"etc/passwd-", true},
+		{"etc/ssl/certs/ca.pem", true},
+		{"etc/ssl/private", false},
+		{"usr/bin", false},
+		{"usr/lib/x86_64/libc.so", true},
+		{"usr/lib/x86_64/README", false},
+		{"etc/old", false},
+		{"var/old", true},
+		{"etc/sh", false},
+	} {
+		_, err := os.Lstat(filepath.Join(dir, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("path %q: expected exists=%v, got err=%v", test.path, test.exists, err)
+		}
+	}
+
+	// The parent directories of included paths must have been extracted
+	// with their metadata.
+	for path, mode := range map[string]os.FileMode{
+		"etc": 0700,
+		"usr": 0711,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("parent directory %q was not extracted: %+v", path, err)
+		} else if !fi.IsDir() || fi.Mode().Perm() != mode {
+			t.Errorf("parent directory %q has unexpected mode %v (expected directory with %v)", path, fi.Mode(), mode)
+		}
+	}
+
+	if len(diagnostics) != 1 || diagnostics[0].Code != DiagnosticFilteredLinkTarget || diagnostics[0].Path != "etc/sh" {
+		t.Errorf("unexpected diagnostics: %+v", diagnostics)
+	}
+}
+
+func TestUnpackEntryNumericOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryNumericOwner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without privileges we can only create files owned by ourselves.
+	uid, gid := os.Getuid(), os.Getgid()
+	if os.Geteuid() == 0 {
+		uid, gid = 1234, 5678
+	}
+
+	for _, numericOwner := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NumericOwner=%v", numericOwner), func(t *testing.T) {
+			rootfs, err := ioutil.TempDir(dir, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The names deliberately refer to a different user than the ids.
+			hdr := &tar.Header{
+				Name:     "file",
+				Uid:      uid,
+				Gid:      gid,
+				Uname:    "root",
+				Gname:    "root",
+				Mode:     0644,
+				Typeflag: tar.TypeReg,
+				ModTime:  time.Now(),
+			}
+
+			te := NewTarExtractor(UnpackOptions{NumericOwner: numericOwner})
+			if err := te.UnpackEntry(rootfs, hdr, bytes.NewReader(nil)); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+
+			var fi unix.Stat_t
+			if err := unix.Lstat(filepath.Join(rootfs, "file"), &fi); err != nil {
+				t.Fatal(err)
+			}
+			if int(fi.Uid) != uid || int(fi.Gid) != gid {
+				t.Errorf("file has the wrong owner: expected %d:%d got %d:%d", uid, gid, fi.Uid, fi.Gid)
+			}
+			if numericOwner && (hdr.Uname != "" || hdr.Gname != "") {
+				t.Errorf("names were not stripped from the header: %q:%q", hdr.Uname, hdr.Gname)
+			}
+		})
+	}
+}
+
+func TestUnpackEntryWhiteoutsOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryWhiteoutsOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Set up an existing root filesystem to apply the whiteouts to.
+	for _, path := range []string{"etc", "opaque", "opaque/sub"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"etc/passwd", "etc/shadow", "removed", "opaque/file", "opaque/sub/file"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte("old "+path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctrValue := []byte("new content")
+	te := NewTarExtractor(UnpackOptions{WhiteoutsOnly: true})
+	for _, test := range []struct {
+		name     string
+		typeflag byte
+		linkname string
+	}{
+		{"etc", tar.TypeDir, ""},
+		{"etc/passwd", tar.TypeReg, ""},
+		{"etc/.wh.shadow", tar.TypeReg, ""},
+		{"new", tar.TypeReg, ""},
+		{"newdir", tar.TypeDir, ""},
+		{"symlink", tar.TypeSymlink, "etc/passwd"},
+		{".wh.removed", tar.TypeReg, ""},
+		{"opaque/" + whOpaque, tar.TypeReg, ""},
+		{"opaque/sub", tar.TypeDir, ""},
+		{"opaque/sub/file", tar.TypeReg, ""},
+	} {
+		hdr := &tar.Header{
+			Name:     test.name,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			Mode:     0644,
+			Typeflag: test.typeflag,
+			Linkname: test.linkname,
+			ModTime:  time.Now(),
+		}
+		var r io.Reader
+		if test.typeflag == tar.TypeReg && !strings.HasPrefix(filepath.Base(test.name), whPrefix) {
+			hdr.Size = int64(len(ctrValue))
+			r = bytes.NewReader(ctrValue)
+		}
+		if test.typeflag == tar.TypeDir {
+			hdr.Mode = 0700
+		}
+		if err := te.UnpackEntry(dir, hdr, r); err != nil {
+			t.Fatalf("unexpected UnpackEntry(%s) error: %+v", test.name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		// Whiteouts are applied.
+		{"etc/shadow", false},
+		{"removed", false},
+		{"opaque", true},
+		{"opaque/file", false},
+		{"opaque/sub", false},
+		// Nothing else is.
+		{"etc/passwd", true},
+		{"new", false},
+		{"newdir", false},
+		{"symlink", false},
+		// Whiteout entries never appear in the root filesystem.
+		{"etc/.wh.shadow", false},
+		{".wh.removed", false},
+	} {
+		_, err := os.Lstat(filepath.Join(dir, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("path %q: expected exists=%v, got err=%v", test.path, test.exists, err)
+		}
+	}
+
+	// Files which were not whited out must be left untouched.
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "etc", "passwd")); err != nil {
+		t.Errorf("unexpected error reading file: %+v", err)
+	} else if string(got) != "old etc/passwd" {
+		t.Errorf("file was modified by non-whiteout entry: got %q", string(got))
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "etc")); err != nil {
+		t.Errorf("unexpected error stating directory: %+v", err)
+	} else if fi.Mode().Perm() != 0755 {
+		t.Errorf("directory metadata was modified by non-whiteout entry: got mode %o", fi.Mode().Perm())
+	}
+}
+
+func TestUnpackEntryEmptyLinkTarget(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		typeflag byte
+	}{
+		{"Hardlink", tar.TypeLink},
+		{"Symlink", tar.TypeSymlink},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryEmptyLinkTarget")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// An existing file at the path must not be clobbered.
+			existing := filepath.Join(dir, "link")
+			if err := ioutil.WriteFile(existing, []byte("existing"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := &tar.Header{
+				Name:     "link",
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+				Mode:     0777,
+				Typeflag: test.typeflag,
+				Linkname: "",
+				ModTime:  time.Now(),
+			}
+
+			te := NewTarExtractor(UnpackOptions{})
+			err = te.UnpackEntry(dir, hdr, nil)
+			if err == nil {
+				t.Fatalf("UnpackEntry should fail with an empty link target")
+			}
+			if !strings.Contains(err.Error(), "empty target") {
+				t.Errorf("unexpected error for empty link target: %v", err)
+			}
+
+			te = NewTarExtractor(UnpackOptions{SkipEmptyLinkTargets: true})
+			if err := te.UnpackEntry(dir, hdr, nil); err != nil {
+				t.Fatalf("unexpected UnpackEntry error with SkipEmptyLinkTargets: %+v", err)
+			}
+
+			if got, err := ioutil.ReadFile(existing); err != nil {
+				t.Errorf("unexpected error reading existing file: %+v", err)
+			} else if string(got) != "existing" {
+				t.Errorf("existing file was modified: got %q", string(got))
+			}
+		})
+	}
+}
+
+func TestUnpackEntryNoClobberTypeChange(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		setup      func(path string) error
+		typeflag   byte
+		typeChange bool
+	}{
+		{"DirToFile", func(path string) error {
+			if err := os.MkdirAll(filepath.Join(path, "sub"), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(path, "sub", "file"), []byte("lower"), 0644)
+		}, tar.TypeReg, true},
+		{"FileToDir", func(path string) error {
+			return ioutil.WriteFile(path, []byte("lower"), 0644)
+		}, tar.TypeDir, true},
+		{"DirToDir", func(path string) error {
+			return os.Mkdir(path, 0755)
+		}, tar.TypeDir, false},
+		{"FileToFile", func(path string) error {
+			return ioutil.WriteFile(path, []byte("lower"), 0644)
+		}, tar.TypeReg, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, noClobber := range []bool{false, true} {
+				dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryNoClobberTypeChange")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				path := filepath.Join(dir, "path")
+				if err := test.setup(path); err != nil {
+					t.Fatal(err)
+				}
+				oldFi, err := os.Lstat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				hdr := &tar.Header{
+					Name:     "path",
+					Uid:      os.Getuid(),
+					Gid:      os.Getgid(),
+					Mode:     0755,
+					Typeflag: test.typeflag,
+					ModTime:  time.Now(),
+				}
+				var data io.Reader
+				if test.typeflag == tar.TypeReg {
+					contents := "upper"
+					hdr.Size = int64(len(contents))
+					data = strings.NewReader(contents)
+				}
+
+				te := NewTarExtractor(UnpackOptions{NoClobberTypeChange: noClobber})
+				err = te.UnpackEntry(dir, hdr, data)
+
+				fi, statErr := os.Lstat(path)
+				if statErr != nil {
+					t.Fatalf("unexpected error stating path after extraction: %+v", statErr)
+				}
+				if noClobber && test.typeChange {
+					if err == nil {
+						t.Fatalf("UnpackEntry should fail to change the type of %q with NoClobberTypeChange", hdr.Name)
+					}
+					if !strings.Contains(err.Error(), "type change") {
+						t.Errorf("unexpected error for type change: %v", err)
+					}
+					if fi.IsDir() != oldFi.IsDir() {
+						t.Errorf("existing path was clobbered despite NoClobberTypeChange")
+					}
+					if oldFi.IsDir() {
+						if _, err := os.Lstat(filepath.Join(path, "sub", "file")); err != nil {
+							t.Errorf("existing directory contents were removed: %v", err)
+						}
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("unexpected UnpackEntry error (NoClobberTypeChange=%v): %+v", noClobber, err)
+				}
+				if wantDir := test.typeflag == tar.TypeDir; fi.IsDir() != wantDir {
+					t.Errorf("path was not replaced by entry: isdir=%v, expected %v", fi.IsDir(), wantDir)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackEntryClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryClock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clockTime := time.Unix(1234567890, 123000000)
+	te := NewTarExtractor(UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+		Clock: func() time.Time { return clockTime },
+	})
+
+	for _, hdr := range []*tar.Header{
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+	} {
+		hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+		// The header deliberately has a zero mtime (and atime).
+		if err := te.UnpackEntry(dir, hdr, bytes.NewReader(nil)); err != nil {
+			t.Fatalf("unexpected UnpackEntry error for %s: %+v", hdr.Name, err)
+		}
+	}
+
+	for _, name := range []string{"dir/file", "dir/link", "dir"} {
+		var fi unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dir, name), &fi); err != nil {
+			t.Fatal(err)
+		}
+		atime := time.Unix(fi.Atim.Unix())
+		mtime := time.Unix(fi.Mtim.Unix())
+		if !mtime.Equal(clockTime) {
+			t.Errorf("%s: unexpected mtime: expected %v got %v", name, clockTime, mtime)
+		}
+		if !atime.Equal(clockTime) {
+			t.Errorf("%s: unexpected atime: expected %v got %v", name, clockTime, atime)
+		}
+	}
+}
+
+func TestReflinkWriter(t *testing.T) {
+	const chunkSize = 4096
+
+	dir, err := ioutil.TempDir("", "umoci-TestReflinkWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldData := make([]byte, 16*chunkSize)
+	if _, err := rand.Read(oldData); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file")
+
+	writeChunks := func(fh *os.File, data []byte) error {
+		rw := &reflinkWriter{fh: fh}
+		for len(data) > 0 {
+			n := chunkSize
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := rw.Write(data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+
+	t.Run("Unchanged", func(t *testing.T) {
+		if err := ioutil.WriteFile(path, oldData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Unchanged contents must never be written, which we can check by
+		// making the file read-only.
+		fh, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+		if err := writeChunks(fh, oldData); err != nil {
+			t.Fatalf("unexpected write to unchanged file: %v", err)
+		}
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		if err := ioutil.WriteFile(path, oldData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		newData := append([]byte(nil), oldData...)
+		copy(newData[3*chunkSize+100:], "some new data")
+		newData[len(newData)-1] ^= 0xff
+		newData = append(newData, "and some more data"...)
+
+		fh, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+		if err := writeChunks(fh, newData); err != nil {
+			t.Fatalf("unexpected error writing changed file: %v", err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, newData) {
+			t.Errorf("file contents don't match written data")
+		}
+	})
+}
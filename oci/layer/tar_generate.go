@@ -28,6 +28,7 @@ import (
 
 	"github.com/apex/log"
 	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/idtools"
 	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/opencontainers/umoci/pkg/testutils"
 	"golang.org/x/sys/unix"
@@ -84,12 +85,36 @@ type tarGenerator struct {
 	// they're added to the layer.
 	mapOptions MapOptions
 
+	// forceOwner, if set, overrides the owner of every entry.
+	forceOwner *idtools.Owner
+
 	// Hardlink mapping.
 	inodes map[uint64]string
 
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
 
+	// lintSymlinks causes warnings to be emitted for suspicious symlinks.
+	lintSymlinks bool
+
+	// recordBirthTime causes the birth time of each file to be included in
+	// its header.
+	recordBirthTime bool
+
+	// btimeWarned is set once we've warned that birth times could not be
+	// read, to avoid spamming the user with the same warning.
+	btimeWarned bool
+
+	// overlayXattrs causes the overlayXattrs of each file to be recorded in
+	// its header, for layers generated from overlayfs-style root filesystems.
+	overlayXattrs bool
+
+	// diagnostics receives a Diagnostic for each warning.
+	diagnostics DiagnosticFunc
+
+	// onEntry is called with the header of each entry written to the layer.
+	onEntry EntryFunc
+
 	// XXX: Should we add a safety check to make sure we don't generate two of
 	//      the same path in a tar archive? This is not permitted by the spec.
 }
@@ -141,6 +166,23 @@ func normalise(rawPath string, isDir bool) (string, error) {
 	return path, nil
 }
 
+// symlinkLint returns a description of why a symlink at the given (normalised)
+// path with the given target is likely to cause problems, or "" if there is
+// nothing suspicious about it. Absolute targets are resolved relative to
+// whatever root the layer is eventually used with, and targets which escape
+// the root filesystem are only resolved correctly by chroot-like resolvers.
+func symlinkLint(name, target string) string {
+	if filepath.IsAbs(target) {
+		return "target is absolute"
+	}
+	// Resolve the target lexically relative to the symlink's directory.
+	resolved := filepath.Join(filepath.Dir(name), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "target escapes the root filesystem"
+	}
+	return ""
+}
+
 // AddFile adds a file from the filesystem to the tar archive. It copies all of
 // the relevant stat information about the file, and also attempts to track
 // hardlinks. This should be functionally equivalent to adding entries with GNU
@@ -174,6 +216,12 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	}
 	hdr.Name = name
 
+	if tg.lintSymlinks && hdr.Typeflag == tar.TypeSymlink {
+		if problem := symlinkLint(name, linkname); problem != "" {
+			tg.diagnostics.warnf(DiagnosticSymlinkLint, name, "lint: symlink %s -> %s: %s", name, linkname, problem)
+		}
+	}
+
 	// Make sure that we don't include any files with the name ".wh.". This
 	// will almost certainly confuse some users (unfortunately) but there's
 	// nothing we can do to store such files on-disk.
@@ -234,13 +282,38 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		// whether the stdlib will correctly handle reading or disable writing
 		// of these PAX headers so we have to track this ourselves.
 		if len(value) <= 0 {
-			log.Warnf("ignoring empty-valued xattr %s: disallowed by PAX standard", name)
+			tg.diagnostics.warnf(DiagnosticXattrEmpty, hdr.Name, "ignoring empty-valued xattr %s: disallowed by PAX standard", name)
 			continue
 		}
 		// Note that Go strings can actually be arbitrary byte sequences, so
 		// this conversion (while it might look a bit wrong) is actually fine.
 		hdr.Xattrs[name] = string(value)
 	}
+	if tg.overlayXattrs {
+		if err := tg.addOverlayXattrs(hdr, path, names); err != nil {
+			return err
+		}
+	}
+
+	if tg.recordBirthTime {
+		btime, err := tg.fsEval.Lbtime(path)
+		switch {
+		case errors.Is(err, system.ErrBirthTimeUnsupported):
+			if !tg.btimeWarned {
+				tg.diagnostics.warnf(DiagnosticBirthTimeUnsupported, hdr.Name, "btime{%s} birth time is not supported by the filesystem, further warnings will be suppressed", path)
+				tg.btimeWarned = true
+			} else {
+				tg.diagnostics.report(DiagnosticBirthTimeUnsupported, hdr.Name, "btime{%s} birth time is not supported by the filesystem", path)
+			}
+		case err != nil:
+			return fmt.Errorf("get birth time: %w", err)
+		default:
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxBirthTime] = formatPAXTime(btime)
+		}
+	}
 
 	// Not all systems have the concept of an inode, but I'm not in the mood to
 	// handle this in a way that makes anything other than GNU/Linux happy
@@ -258,6 +331,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return fmt.Errorf("map header: %w", err)
 	}
+	tg.applyForceOwner(hdr)
 	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("write header: %w", err)
 	}
@@ -279,9 +353,22 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		}
 	}
 
+	if tg.onEntry != nil {
+		tg.onEntry(hdr)
+	}
 	return nil
 }
 
+// applyForceOwner sets the owner of hdr to tg.forceOwner (if set).
+func (tg *tarGenerator) applyForceOwner(hdr *tar.Header) {
+	if tg.forceOwner != nil {
+		hdr.Uid = int(tg.forceOwner.UID)
+		hdr.Gid = int(tg.forceOwner.GID)
+		hdr.Uname = ""
+		hdr.Gname = ""
+	}
+}
+
 // whPrefix is the whiteout prefix, which is used to signify "special" files in
 // an OCI image layer archive. An expanded filesystem image cannot contain
 // files that have a basename starting with this prefix.
@@ -314,9 +401,14 @@ func (tg *tarGenerator) addWhiteout(name string, opaque bool) error {
 	}
 
 	// Add a dummy header for the whiteout file.
-	if err := tg.tw.WriteHeader(&tar.Header{Name: whiteout, Size: 0}); err != nil {
+	hdr := &tar.Header{Name: whiteout, Size: 0}
+	tg.applyForceOwner(hdr)
+	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("write whiteout header: %w", err)
 	}
+	if tg.onEntry != nil {
+		tg.onEntry(hdr)
+	}
 	return nil
 }
 
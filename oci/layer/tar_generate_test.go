@@ -20,6 +20,7 @@ package layer
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,6 +29,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/opencontainers/umoci/pkg/system"
 )
 
 func TestTarGenerateAddFileNormal(t *testing.T) {
@@ -58,7 +61,7 @@ func TestTarGenerateAddFileNormal(t *testing.T) {
 	if err := ioutil.WriteFile(path, data, 0777); err != nil {
 		t.Fatalf("unexpected error creating file to add: %s", err)
 	}
-	if err := te.applyMetadata(path, expectedHdr); err != nil {
+	if err := te.applyMetadata(path, expectedHdr, nil); err != nil {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
@@ -152,7 +155,7 @@ func TestTarGenerateAddFileDirectory(t *testing.T) {
 	if err := os.Mkdir(path, 0777); err != nil {
 		t.Fatalf("unexpected error creating file to add: %s", err)
 	}
-	if err := te.applyMetadata(path, expectedHdr); err != nil {
+	if err := te.applyMetadata(path, expectedHdr, nil); err != nil {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
@@ -239,7 +242,7 @@ func TestTarGenerateAddFileSymlink(t *testing.T) {
 	if err := os.Symlink(linkname, path); err != nil {
 		t.Fatalf("unexpected error creating file to add: %s", err)
 	}
-	if err := te.applyMetadata(path, expectedHdr); err != nil {
+	if err := te.applyMetadata(path, expectedHdr, nil); err != nil {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
@@ -377,3 +380,121 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+func TestSymlinkLint(t *testing.T) {
+	for _, test := range []struct {
+		name, target string
+		problem      bool
+	}{
+		{"a", "b", false},
+		{"a/b", "../c", false},
+		{"a/b/c", "../../d/e", false},
+		{"a/b", "./c/../../d", false},
+		{"a", "/b", true},
+		{"a/b", "/", true},
+		{"a", "..", true},
+		{"a", "../b", true},
+		{"a/b/c", "../../../d", true},
+		{"a/b", "c/../../../d", true},
+	} {
+		t.Run(test.name+"->"+test.target, func(t *testing.T) {
+			problem := symlinkLint(test.name, test.target)
+			if (problem != "") != test.problem {
+				t.Errorf("unexpected lint result for %s -> %s: expected problem=%v got %q", test.name, test.target, test.problem, problem)
+			}
+		})
+	}
+}
+
+func TestPAXTime(t *testing.T) {
+	for _, test := range []struct {
+		time  time.Time
+		value string
+	}{
+		{time.Unix(0, 0), "0"},
+		{time.Unix(1700000000, 0), "1700000000"},
+		{time.Unix(1700000000, 500000000), "1700000000.5"},
+		{time.Unix(1700000000, 123456789), "1700000000.123456789"},
+		{time.Unix(-1, 250000000), "-0.75"},
+	} {
+		if got := formatPAXTime(test.time); got != test.value {
+			t.Errorf("formatPAXTime(%v): expected %q got %q", test.time, test.value, got)
+		}
+		got, err := parsePAXTime(test.value)
+		if err != nil {
+			t.Errorf("parsePAXTime(%q): unexpected error: %+v", test.value, err)
+		} else if !got.Equal(test.time) {
+			t.Errorf("parsePAXTime(%q): expected %v got %v", test.value, test.time, got)
+		}
+	}
+
+	for _, value := range []string{"", "abc", "1.2x", "1.-2"} {
+		if got, err := parsePAXTime(value); err == nil {
+			t.Errorf("parsePAXTime(%q): expected error, got %v", value, got)
+		}
+	}
+}
+
+func TestTarGenerateAddFileBirthTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateAddFileBirthTime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("some data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	btime, err := system.Lbtime(path)
+	if errors.Is(err, system.ErrBirthTimeUnsupported) {
+		t.Skip("birth time not supported on this filesystem")
+	} else if err != nil {
+		t.Fatalf("unexpected error getting birth time: %+v", err)
+	}
+
+	for _, record := range []bool{false, true} {
+		t.Run(fmt.Sprintf("RecordBirthTime=%v", record), func(t *testing.T) {
+			var buf bytes.Buffer
+			tg := newTarGenerator(&buf, MapOptions{})
+			tg.recordBirthTime = record
+			if err := tg.AddFile("file", path); err != nil {
+				t.Fatalf("AddFile: unexpected error: %+v", err)
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Fatalf("tw.Close: unexpected error: %+v", err)
+			}
+
+			hdr, err := tar.NewReader(&buf).Next()
+			if err != nil {
+				t.Fatalf("reading tar archive: %s", err)
+			}
+			value, ok := hdr.PAXRecords[paxBirthTime]
+			if ok != record {
+				t.Fatalf("unexpected presence of birth time record: expected %v got %v (%q)", record, ok, value)
+			}
+			if !record {
+				return
+			}
+			got, err := parsePAXTime(value)
+			if err != nil {
+				t.Fatalf("parse recorded birth time: %+v", err)
+			}
+			if !got.Equal(btime) {
+				t.Errorf("unexpected recorded birth time: expected %v got %v", btime, got)
+			}
+
+			// Restoration is best-effort, so extraction must succeed even if
+			// the birth time cannot be changed.
+			te := NewTarExtractor(UnpackOptions{RestoreBirthTime: true})
+			extractDir := filepath.Join(dir, "extract")
+			if err := os.Mkdir(extractDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+			if err := te.UnpackEntry(extractDir, hdr, strings.NewReader("some data")); err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+		})
+	}
+}
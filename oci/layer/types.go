@@ -1,7 +1,12 @@
 package layer
 
 import (
+	"time"
+
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/opencontainers/umoci/pkg/selinux"
 )
 
 // WhiteoutMode indicates how this TarExtractor will create whiteouts on the
@@ -16,9 +21,60 @@ const (
 	// OverlayFSWhiteout generates a rootfs suitable for use in overlayfs,
 	// so it follows the overlayfs whiteout protocol:
 	//     .wh.foo => mknod c 0 0 foo
+	// Any overlayfs "redirect" and "metacopy" xattrs recorded in the layer
+	// (see RepackOptions.TranslateOverlayWhiteouts) are also restored.
 	OverlayFSWhiteout
 )
 
+// TrackedPathsLimitMode is the action taken when the number of paths tracked
+// while extracting a layer exceeds UnpackOptions.MaxTrackedPaths.
+type TrackedPathsLimitMode int
+
+const (
+	// TrackedPathsLimitError aborts extraction with ErrTooManyTrackedPaths.
+	TrackedPathsLimitError TrackedPathsLimitMode = iota
+
+	// TrackedPathsLimitSpill moves the tracked paths from memory to a
+	// temporary directory on disk whenever MaxTrackedPaths paths are held in
+	// memory, which makes extraction slower but means that the memory used no
+	// longer grows with the number of paths. Lookups check the paths still in
+	// memory before those on disk.
+	TrackedPathsLimitSpill
+)
+
+// HardlinkOrderMode is the action taken when a hardlink entry in a layer
+// refers to a path which has not been extracted yet (see
+// UnpackOptions.HardlinkOrder).
+type HardlinkOrderMode int
+
+const (
+	// HardlinkOrderImmediate creates each hardlink as soon as its entry is
+	// read, so a hardlink which precedes its target fails with whatever error
+	// link(2) returns.
+	HardlinkOrderImmediate HardlinkOrderMode = iota
+
+	// HardlinkOrderStrict rejects hardlinks which precede their target with
+	// an error wrapping ErrHardlinkTargetMissing.
+	HardlinkOrderStrict
+
+	// HardlinkOrderDefer postpones creating hardlinks which precede their
+	// target until the rest of the layer has been extracted. A deferred
+	// hardlink is dropped if a later entry in the layer replaces its path.
+	// If the target still doesn't exist at the end of the layer, extraction
+	// fails with an error wrapping ErrHardlinkTargetMissing.
+	HardlinkOrderDefer
+)
+
+// UnpackTarget describes an additional root filesystem which is extracted
+// alongside the primary one (see UnpackOptions.ExtraTargets).
+type UnpackTarget struct {
+	// Root is the path of the root filesystem to extract to.
+	Root string
+
+	// WhiteoutMode is the type of whiteout to write to this root filesystem.
+	WhiteoutMode WhiteoutMode
+}
+
 // UnpackOptions describes the behavior of the various unpack operations.
 type UnpackOptions struct {
 	// MapOptions are the UID and GID mappings used when unpacking an image
@@ -31,15 +87,288 @@ type UnpackOptions struct {
 	// symlink.
 	KeepDirlinks bool
 
+	// FsEval, if set, is used for all filesystem operations on the root
+	// filesystem being extracted into instead of the default (which operates
+	// on the host filesystem, using the rootless-friendly wrappers if
+	// MapOptions.Rootless is set). For example, fseval.NewMem can be used to
+	// extract layers into memory in order to inspect their contents.
+	FsEval fseval.FsEval
+
 	// AfterLayerUnpack is a function that's called after every layer is
 	// unpacked.
 	AfterLayerUnpack AfterLayerUnpackCallback
 
+	// AfterEntryUnpack is a function that's called after every entry of a
+	// layer is unpacked.
+	AfterEntryUnpack AfterEntryUnpackCallback
+
+	// OnProgress, if set, is called while each entry of a layer is being
+	// extracted. For regular files, it is called each time a chunk of the
+	// contents has been written (with bytesTotal set to the size of the
+	// file). For all other entries (including empty files and entries which
+	// are skipped), it is called once with bytesDone and bytesTotal set to 0
+	// once the entry has been extracted. It is never called for an entry
+	// after extracting that entry has failed.
+	OnProgress ProgressFunc
+
+	// RecordEntryOrder causes umoci.Unpack to record the order of the
+	// entries in each layer in the bundle metadata, so that umoci.Repack can
+	// generate layers with their entries in the same order.
+	RecordEntryOrder bool
+
+	// PreserveMeta causes umoci.Unpack to keep the fields of an existing
+	// umoci.json in the bundle which are not managed by umoci (see
+	// umoci.Meta.Extra), such as fields added by users. This is useful when
+	// re-unpacking an image into a bundle (after removing its root filesystem
+	// and config.json) to reset it. All fields managed by umoci are always
+	// replaced.
+	PreserveMeta bool
+
+	// NoMeta causes umoci.Unpack to not write the umoci.json metadata or the
+	// mtree manifest of the bundle, which is useful for one-shot extractions
+	// (such as for scanning an image). Such bundles cannot be repacked. It
+	// cannot be combined with PreserveMeta or RecordEntryOrder.
+	NoMeta bool
+
+	// SelfCheck causes umoci.Unpack to walk the root filesystem of the bundle
+	// again after writing its mtree manifest, and fail if the two don't match
+	// (see umoci.VerifyBundleManifest). This catches extraction bugs and
+	// modifications made to the bundle while it was being unpacked, at the
+	// cost of reading every file twice. It cannot be combined with NoMeta.
+	SelfCheck bool
+
 	// StartFrom is the descriptor in the manifest to start from
 	StartFrom ispec.Descriptor
 
 	// WhiteoutMode is the type of whiteout to write to the filesystem.
 	WhiteoutMode WhiteoutMode
+
+	// Platform is the platform (OS and architecture) of the image being
+	// extracted. Some extraction steps (such as creating device nodes or
+	// applying xattrs) only make sense for Linux images, and are skipped for
+	// Windows images. Every other platform is extracted as though it were
+	// Linux. If unset, UnpackRootfs will fill it from the image
+	// configuration. umoci.Unpack also uses it to select the manifest to
+	// unpack from a multi-platform image.
+	Platform ispec.Platform
+
+	// Clock, if set, is used instead of time.Now to get the time which is
+	// applied to extracted entries whose header has no modification time
+	// (and no access time), so that extracting such entries is deterministic.
+	Clock func() time.Time
+
+	// MaxXattrSize is the maximum size (in bytes) of an xattr value which will
+	// be applied to an extracted file. Larger values are skipped with a
+	// warning (unless RejectOversizedXattrs is set). If zero, there is no
+	// limit.
+	MaxXattrSize int
+
+	// RejectOversizedXattrs causes extraction to fail if an xattr value is
+	// larger than MaxXattrSize, rather than skipping it.
+	RejectOversizedXattrs bool
+
+	// StrictXattrs causes extraction to fail if an xattr cannot be applied
+	// to an extracted file. By default, xattrs which cannot be set because
+	// the destination filesystem doesn't support them (ENOTSUP) or because of
+	// insufficient privileges in rootless mode (such as security.capability)
+	// are skipped with a warning, which is a problem if the xattrs are
+	// security-critical. Xattrs which umoci never applies (such as
+	// security.selinux) are still skipped.
+	StrictXattrs bool
+
+	// XattrNamespaces restricts the xattrs applied to extracted files to
+	// those in the given namespaces (such as "user" for "user.*" xattrs),
+	// which is useful for destination filesystems that only support some
+	// namespaces. Xattrs in other namespaces are skipped without a warning,
+	// and existing xattrs in other namespaces are left untouched. If nil, all
+	// namespaces are applied.
+	XattrNamespaces []string
+
+	// SELinuxFileContexts, if set, is used to label each extracted path with
+	// the default SELinux label of its path within the root filesystem (in
+	// the same way as setfiles(8) relabels an alternate root). The label is
+	// applied as the security.selinux xattr, and failing to apply it is an
+	// error. Hardlinks are not labeled separately, as they share the label of
+	// their target. Use selinux.HostFileContexts to label extracted files
+	// according to the policy of the host.
+	SELinuxFileContexts *selinux.FileContexts
+
+	// MtreeConcurrency is the maximum number of files which umoci.Unpack will
+	// read concurrently when generating the mtree manifest of the bundle. If
+	// it is less than 2, files are read one at a time (which uses the least
+	// amount of memory).
+	MtreeConcurrency int
+
+	// MaxDecompressionWindow is the maximum window size (in bytes) that a
+	// compressed layer may require in order to be decompressed. Layers which
+	// require a larger window are rejected, which protects against layers
+	// crafted to make umoci allocate huge amounts of memory. Currently this
+	// only affects zstd layers (gzip always uses a 32KiB window). If it is 0,
+	// the zstd library's default limit (512MiB) is used.
+	MaxDecompressionWindow uint64
+
+	// MaxTrackedPaths is the maximum number of paths which are tracked in
+	// memory while extracting each layer. With OCIStandardWhiteout, every
+	// path extracted from a layer (and each of its parent directories) is
+	// remembered so that whiteouts later in the same layer don't remove it,
+	// which can use a lot of memory for layers with huge numbers of entries.
+	// Once the limit is exceeded, TrackedPathsLimit decides what happens. If
+	// it is 0, there is no limit. No paths are tracked with
+	// OverlayFSWhiteout, since overlayfs whiteouts don't need them.
+	MaxTrackedPaths int
+
+	// TrackedPathsLimit is the action taken when MaxTrackedPaths is exceeded.
+	TrackedPathsLimit TrackedPathsLimitMode
+
+	// MaxEntries is the maximum number of entries which may be extracted.
+	// For UnpackRootfs (and UnpackManifest) the limit applies to the total
+	// number of entries in all of the layers being extracted, while for
+	// UnpackLayer it applies to the single layer. Extraction is aborted with
+	// ErrTooManyEntries once the limit is exceeded, which protects against
+	// layers crafted with huge numbers of tiny entries to exhaust inodes or
+	// memory. If it is 0, there is no limit.
+	MaxEntries int64
+
+	// MaxUncompressedSize is the maximum number of bytes of regular file
+	// contents which may be written while extracting. Like MaxEntries, the
+	// limit applies to all of the layers extracted by UnpackRootfs (and
+	// UnpackManifest) but only to the single layer for UnpackLayer. The limit
+	// is enforced while the contents are being copied (rather than being
+	// based on the sizes claimed by the tar headers) and extraction is
+	// aborted with ErrSizeLimitExceeded once it is exceeded, which protects
+	// against layers crafted to fill the disk (such as with huge sparse
+	// files). If it is 0, there is no limit.
+	MaxUncompressedSize int64
+
+	// CopyBufferSize is the size (in bytes) of the buffer used to copy the
+	// contents of regular files when they are extracted. Larger buffers can
+	// improve throughput on fast storage, while smaller buffers reduce memory
+	// usage. If it is 0, a default size (32KiB) is used.
+	CopyBufferSize int
+
+	// SequentialIO causes umoci to advise the kernel (using posix_fadvise(2)
+	// with POSIX_FADV_SEQUENTIAL) that layer blobs will be read sequentially
+	// and that extracted regular files will be written sequentially. This can
+	// improve throughput on spinning disks and network storage by enabling
+	// more aggressive readahead. It is only a hint and never changes what is
+	// extracted, and it has no effect on platforms without posix_fadvise(2).
+	SequentialIO bool
+
+	// DecompressAhead is the number of upcoming layers which UnpackRootfs
+	// (and UnpackManifest) reads and decompresses in the background while
+	// the current layer is being extracted, so that decompression (which is
+	// often CPU-bound) overlaps with writing the extracted files. Up to 4MiB
+	// of uncompressed data is buffered for each of these layers. The layers
+	// are still extracted one at a time in order, so the extracted root
+	// filesystem is the same as without DecompressAhead. If it is 0, each
+	// layer is decompressed while it is extracted.
+	DecompressAhead int
+
+	// ReflinkFrom is the path to the root filesystem of an earlier extraction
+	// (usually of the same image). If it is set, each extracted regular file
+	// is first created as a reflink of the file at the same path in
+	// ReflinkFrom (if it has the same size), and only the parts of the file
+	// whose contents differ from the layer are written. On filesystems with
+	// reflink support (such as btrfs and XFS), this makes re-extracting an
+	// image much cheaper in both time and space, as the unchanged files share
+	// their extents with the earlier extraction. The layer contents are still
+	// read and compared, so the result is always the same as without
+	// ReflinkFrom. If reflinks are not supported, the contents are copied as
+	// usual.
+	ReflinkFrom string
+
+	// DetectSparse causes complete (4KiB-aligned) blocks of zeroes in each
+	// extracted regular file to be left as holes rather than being written,
+	// which saves disk space for files such as disk images and databases
+	// (whether or not the layer stored them as sparse entries). The extracted
+	// contents are the same either way. It has no effect on files which are
+	// created with ReflinkFrom, or if the filesystem doesn't support holes.
+	DetectSparse bool
+
+	// ExtraTargets is a set of additional root filesystems which each layer
+	// is extracted to at the same time as the primary root filesystem, so
+	// that (for instance) both a plain root filesystem and one with overlayfs
+	// whiteouts can be created while only reading each layer once. All other
+	// options apply to every target.
+	ExtraTargets []UnpackTarget
+
+	// DenyPaths is a set of paths in the root filesystem (such as "/dev" or
+	// "/proc") which must never be modified during extraction. Any entry
+	// which would create, modify or remove one of these paths (or anything
+	// beneath them) is skipped with a warning. Entries are matched after
+	// symlinks in their parent path have been resolved, so an archive cannot
+	// get around the denylist with symlinks.
+	DenyPaths []string
+
+	// IncludePaths, if non-empty, restricts extraction to the entries whose
+	// path (or the path of one of whose parent directories) matches one of
+	// these patterns, such as "etc" or "usr/lib/**/*.so". Patterns are
+	// matched against the cleaned path of each entry in the archive, one path
+	// component at a time using path.Match, except that a "**" component
+	// matches any number of components. The parent directories of included
+	// paths are still extracted, as are whiteouts which could remove included
+	// paths.
+	IncludePaths []string
+
+	// ExcludePaths is a set of patterns (in the same format as IncludePaths)
+	// for entries which are not extracted, along with everything beneath
+	// them. Excluded paths are skipped even if they match IncludePaths.
+	ExcludePaths []string
+
+	// AnnotationHintPrefix, if set, causes umoci.Unpack to derive some of
+	// its options from the annotations of the image manifest which start
+	// with this prefix (see umoci.ParseAnnotationHints). Options given here
+	// take precedence over the image, so the hints only replace options
+	// which are left at their default values (such as WhiteoutMode being
+	// OCIStandardWhiteout).
+	AnnotationHintPrefix string
+
+	// NumericOwner guarantees that the ownership of extracted files is only
+	// ever derived from the numeric uid and gid of each tar entry (mapped
+	// with MapOptions), and never from the user and group names in the
+	// entry. umoci never resolves these names when extracting, but with
+	// NumericOwner the names are also stripped from each tar.Header before
+	// it is processed (including before AfterEntryUnpack is called).
+	NumericOwner bool
+
+	// WhiteoutsOnly causes only the whiteout entries of each layer (including
+	// opaque whiteouts) to be applied, with all other entries being skipped.
+	// This is useful for applying just the deletions made by a layer to an
+	// existing root filesystem, such as when computing the differences
+	// between images or building a "delete-only" overlay.
+	WhiteoutsOnly bool
+
+	// SkipEmptyLinkTargets causes hardlink and symlink entries with an empty
+	// target (which can only come from a malformed archive) to be skipped
+	// with a warning. By default, such entries cause extraction to fail.
+	SkipEmptyLinkTargets bool
+
+	// HardlinkOrder is the action taken when a hardlink entry refers to a
+	// path which doesn't exist yet. Such archives are arguably malformed, but
+	// some tools generate them. By default (HardlinkOrderImmediate) creating
+	// the hardlink simply fails.
+	HardlinkOrder HardlinkOrderMode
+
+	// RestoreBirthTime causes the birth (creation) time of each entry, if it
+	// was recorded in the layer (see RepackOptions.RecordBirthTime), to be
+	// applied to the extracted file. Most systems don't allow the birth time
+	// of a file to be changed, in which case a warning is emitted and
+	// extraction continues.
+	RestoreBirthTime bool
+
+	// NoClobberTypeChange causes extraction to fail if an entry would
+	// replace an existing directory with a non-directory (or an existing
+	// non-directory with a directory). By default the existing path is
+	// removed (along with everything underneath it) so that the entry can
+	// be extracted. Replacing a symlink to a directory with a directory in
+	// KeepDirlinks mode is not a type change, as the symlink is kept.
+	NoClobberTypeChange bool
+
+	// OnDiagnostic, if set, is called with a machine-readable Diagnostic for
+	// each warning emitted during extraction (such as skipped xattrs), so
+	// that callers can act on specific kinds of problems. Warnings are still
+	// logged as usual.
+	OnDiagnostic DiagnosticFunc
 }
 
 // RepackOptions describes the behavior of the various GenerateLayer operations.
@@ -49,6 +378,83 @@ type RepackOptions struct {
 
 	// TranslateOverlayWhiteouts changes char devices of type 0,0 to
 	// .wh.foo style whiteouts when generating tarballs. Without this,
-	// whiteouts are untouched.
+	// whiteouts are untouched. It also causes the overlayfs "redirect" and
+	// "metacopy" xattrs to be recorded (as umoci-specific PAX records) so
+	// that they are restored when extracting with OverlayFSWhiteout.
 	TranslateOverlayWhiteouts bool
+
+	// ForceOwner, if set, causes every entry in the generated layer
+	// (including whiteouts) to be owned by the given uid and gid, regardless
+	// of the owner of the file in the root filesystem. Unlike MapOptions,
+	// which translate between host and container ids, this discards the
+	// ownership of every file, so that the layer is the same no matter which
+	// user generated it.
+	ForceOwner *idtools.Owner
+
+	// LintSymlinks causes a warning to be emitted for every symlink added to
+	// the layer which has an absolute target or a target which escapes the
+	// root filesystem. Such symlinks can behave surprisingly when the layer is
+	// used as (for instance) an overlayfs lower layer.
+	LintSymlinks bool
+
+	// MtreeConcurrency is the maximum number of files which umoci.Repack will
+	// read concurrently when computing the changes made to the bundle and
+	// when regenerating the mtree manifest of the bundle. The computed changes
+	// are the same regardless. If it is less than 2, files are read one at a
+	// time (which uses the least amount of memory).
+	MtreeConcurrency int
+
+	// EntryOrder is the order of entry names in the layer(s) the rootfs was
+	// extracted from. If set, GenerateLayer emits any entries whose names are
+	// present in EntryOrder in that order (if a name appears several times,
+	// the last position is used), followed by all other entries sorted by
+	// path. Otherwise all entries are sorted by path.
+	EntryOrder []string
+
+	// RecordBirthTime causes the birth (creation) time of each file to be
+	// recorded in the generated layer, using the same PAX record as
+	// libarchive. This makes the generated layer depend on when files were
+	// created, so it is off by default. Files on filesystems which don't
+	// record birth times are added without one.
+	RecordBirthTime bool
+
+	// CacheLayer causes umoci.Repack to remember the layer it generated in
+	// the bundle (keyed by a hash of the filesystem delta), so that a later
+	// repack of an identical delta can reuse the existing layer blob rather
+	// than generating and compressing it again. It has no effect if
+	// RecordBirthTime is set, since birth times are not part of the delta.
+	CacheLayer bool
+
+	// VerifyBaseline causes umoci.Repack to check that the mtree manifest of
+	// the bundle is present and consistent with umoci.json (and was generated
+	// with the keywords umoci uses) before computing the changes to the
+	// rootfs, failing if the bundle was modified outside of umoci's tracking.
+	VerifyBaseline bool
+
+	// RecordFileManifest causes umoci.Repack to store a FileManifest of the
+	// generated layer as a separate blob, referenced by the
+	// mutate.UmociFileManifestAnnotation annotation on the layer descriptor.
+	RecordFileManifest bool
+
+	// RecordDiffID causes umoci.Repack to annotate the descriptor of the
+	// generated layer with its DiffID, using mutate.UmociDiffIDAnnotation.
+	RecordDiffID bool
+
+	// LayerMediaType, if set, is the media-type of the layer generated by
+	// umoci.Repack instead of ispec.MediaTypeImageLayer. The suffix for the
+	// compression algorithm (such as "+gzip") is still appended to it. This
+	// allows for vendor-specific layer media-types, but note that umoci can
+	// only unpack layers with the standard OCI media-types.
+	LayerMediaType string
+
+	// OnEntry, if set, is called with the header of each entry (including
+	// whiteouts) once it has been written to the generated layer. As with
+	// OnDiagnostic, it is called from the goroutine generating the layer.
+	OnEntry EntryFunc
+
+	// OnDiagnostic, if set, is called with a machine-readable Diagnostic for
+	// each warning emitted while generating the layer. Note that layers are
+	// generated in a separate goroutine, so OnDiagnostic must be safe to
+	// call concurrently with the code consuming the layer.
+	OnDiagnostic DiagnosticFunc
 }
@@ -33,6 +33,7 @@ import (
 	_ "crypto/sha256"
 
 	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -43,21 +44,111 @@ import (
 	"github.com/opencontainers/umoci/pkg/fseval"
 	"github.com/opencontainers/umoci/pkg/idtools"
 	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pierrec/lz4/v4"
 )
 
 // AfterLayerUnpackCallback is called after each layer is unpacked.
 type AfterLayerUnpackCallback func(manifest ispec.Manifest, desc ispec.Descriptor) error
 
+// AfterEntryUnpackCallback is called after each entry in a layer is unpacked,
+// with the header of the entry as it appears in the layer.
+type AfterEntryUnpackCallback func(hdr *tar.Header) error
+
+// ProgressFunc is called to report the progress of extracting an entry, with
+// the (cleaned) name of the entry, the number of bytes of its contents which
+// have been written so far and the total number of bytes which will be
+// written for the entry.
+type ProgressFunc func(entry string, bytesDone, bytesTotal int64)
+
+// ErrTooManyEntries is returned (wrapped) when extraction is aborted because
+// the layers being extracted contain more than UnpackOptions.MaxEntries
+// entries.
+var ErrTooManyEntries = errors.New("too many entries")
+
+// ErrTooManyTrackedPaths is returned (wrapped) when extraction is aborted
+// because a layer contains more paths than UnpackOptions.MaxTrackedPaths and
+// UnpackOptions.TrackedPathsLimit is TrackedPathsLimitError.
+var ErrTooManyTrackedPaths = errors.New("too many tracked paths")
+
+// ErrHardlinkTargetMissing is returned (wrapped) when a hardlink entry refers
+// to a path which doesn't exist, and UnpackOptions.HardlinkOrder is
+// HardlinkOrderStrict or HardlinkOrderDefer.
+var ErrHardlinkTargetMissing = errors.New("hardlink target does not exist")
+
+// ErrSizeLimitExceeded is returned (wrapped) when extraction is aborted
+// because more than UnpackOptions.MaxUncompressedSize bytes of file contents
+// would be written.
+var ErrSizeLimitExceeded = errors.New("uncompressed size limit exceeded")
+
+// unpackUsage is the amount of resources used so far while extracting, which
+// is checked against the limits in UnpackOptions.
+type unpackUsage struct {
+	// entries is the number of entries extracted.
+	entries int64
+	// bytes is the number of bytes of regular file contents written.
+	bytes int64
+}
+
 // UnpackLayer unpacks the tar stream representing an OCI layer at the given
 // root. It ensures that the state of the root is as close as possible to the
 // state used to create the layer. If an error is returned, the state of root
-// is undefined (unpacking is not guaranteed to be atomic).
+// is undefined (unpacking is not guaranteed to be atomic). If any
+// opt.ExtraTargets are specified, the layer is also unpacked to each of them.
 func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	var usage unpackUsage
+	return unpackLayer(root, layer, opt, &usage)
+}
+
+// unpackLayer is UnpackLayer, except that the resources used while extracting
+// are added to *usage (which is checked against the limits in opt), so that
+// the limits can be applied across several layers.
+func unpackLayer(root string, layer io.Reader, opt *UnpackOptions, usage *unpackUsage) error {
 	var unpackOptions UnpackOptions
 	if opt != nil {
 		unpackOptions = *opt
 	}
-	te := NewTarExtractor(unpackOptions)
+	primary := NewTarExtractor(unpackOptions)
+	primary.written = &usage.bytes
+	targets := []unpackTarget{
+		{root: root, te: primary},
+	}
+	for _, extra := range unpackOptions.ExtraTargets {
+		extraOptions := unpackOptions
+		extraOptions.WhiteoutMode = extra.WhiteoutMode
+		extraOptions.ExtraTargets = nil
+		// Progress is only reported for the primary target, and the extra
+		// targets get the same contents so the size limit only needs to be
+		// enforced once.
+		extraOptions.OnProgress = nil
+		extraOptions.MaxUncompressedSize = 0
+		// ReflinkFrom is an earlier version of the primary target.
+		extraOptions.ReflinkFrom = ""
+		targets = append(targets, unpackTarget{
+			root: extra.Root,
+			te:   NewTarExtractor(extraOptions),
+		})
+	}
+	defer func() {
+		for _, target := range targets {
+			if err := target.te.Close(); err != nil {
+				log.Warnf("unpack layer: could not clean up extractor for %s: %v", target.root, err)
+			}
+		}
+	}()
+
+	// With more than one target, the contents of each entry have to be
+	// spooled so that they can be read once per target.
+	var spool *os.File
+	if len(targets) > 1 {
+		var err error
+		spool, err = ioutil.TempFile("", "umoci-unpack-spool")
+		if err != nil {
+			return fmt.Errorf("create entry spool: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+	}
+
 	tr := tar.NewReader(layer)
 	for {
 		hdr, err := tr.Next()
@@ -67,28 +158,160 @@ func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
 		if err != nil {
 			return fmt.Errorf("read next entry: %w", err)
 		}
-		if err := te.UnpackEntry(root, hdr, tr); err != nil {
+		usage.entries++
+		if limit := unpackOptions.MaxEntries; limit > 0 && usage.entries > limit {
+			return fmt.Errorf("unpack entry: %s: limit of %d entries exceeded: %w", hdr.Name, limit, ErrTooManyEntries)
+		}
+		if unpackOptions.NumericOwner {
+			hdr.Uname, hdr.Gname = "", ""
+		}
+		if err := unpackTargets(targets, spool, hdr, tr); err != nil {
+			return err
+		}
+		if unpackOptions.AfterEntryUnpack != nil {
+			if err := unpackOptions.AfterEntryUnpack(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	for _, target := range targets {
+		if err := target.te.CreateDeferredLinks(); err != nil {
+			return fmt.Errorf("unpack deferred hardlinks: %s: %w", target.root, err)
+		}
+	}
+	return nil
+}
+
+// unpackTargets unpacks a single entry to every target. UnpackEntry modifies
+// the header, so each target is given its own copy (leaving hdr untouched).
+func unpackTargets(targets []unpackTarget, spool *os.File, hdr *tar.Header, r io.Reader) error {
+	if spool == nil {
+		if err := targets[0].te.UnpackEntry(targets[0].root, copyHeader(hdr), r); err != nil {
 			return fmt.Errorf("unpack entry: %s: %w", hdr.Name, err)
 		}
+		return nil
+	}
+
+	if err := spool.Truncate(0); err != nil {
+		return fmt.Errorf("truncate entry spool: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek entry spool: %w", err)
+	}
+	// Make sure that the spool doesn't fill the disk before the primary
+	// target gets a chance to enforce the size limit. Spooling one more byte
+	// than the remaining limit is enough for it to notice.
+	if remaining, ok := targets[0].te.remainingSize(); ok {
+		r = io.LimitReader(r, remaining+1)
+	}
+	if _, err := system.Copy(spool, r); err != nil {
+		return fmt.Errorf("spool entry: %s: %w", hdr.Name, err)
+	}
+	for _, target := range targets {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek entry spool: %w", err)
+		}
+		if err := target.te.UnpackEntry(target.root, copyHeader(hdr), spool); err != nil {
+			return fmt.Errorf("unpack entry: %s: %s: %w", target.root, hdr.Name, err)
+		}
 	}
 	return nil
 }
 
+// unpackTarget is a root filesystem being extracted to by UnpackLayer.
+type unpackTarget struct {
+	root string
+	te   *TarExtractor
+}
+
+// copyHeader returns a deep copy of the given tar.Header.
+func copyHeader(hdr *tar.Header) *tar.Header {
+	newHdr := *hdr
+	if hdr.Xattrs != nil {
+		newHdr.Xattrs = make(map[string]string, len(hdr.Xattrs))
+		for k, v := range hdr.Xattrs {
+			newHdr.Xattrs[k] = v
+		}
+	}
+	if hdr.PAXRecords != nil {
+		newHdr.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			newHdr.PAXRecords[k] = v
+		}
+	}
+	return &newHdr
+}
+
 // RootfsName is the name of the rootfs directory inside the bundle path when
 // generated.
 const RootfsName = "rootfs"
 
+// The zstd layer media-types are not defined by the version of the image-spec
+// we use, but are produced by mutate.ZstdCompressor.
+const (
+	mediaTypeImageLayerZstd                 = ispec.MediaTypeImageLayer + "+zstd"
+	mediaTypeImageLayerNonDistributableZstd = ispec.MediaTypeImageLayerNonDistributable + "+zstd"
+)
+
+// The lz4 layer media-types are not defined by the image-spec at all, but are
+// produced by mutate.LZ4Compressor.
+const (
+	mediaTypeImageLayerLZ4                 = ispec.MediaTypeImageLayer + "+lz4"
+	mediaTypeImageLayerNonDistributableLZ4 = ispec.MediaTypeImageLayerNonDistributable + "+lz4"
+)
+
 // isLayerType returns if the given MediaType is the media type of an image
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
 	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		mediaType == mediaTypeImageLayerZstd || mediaType == mediaTypeImageLayerNonDistributableZstd ||
+		mediaType == mediaTypeImageLayerLZ4 || mediaType == mediaTypeImageLayerNonDistributableLZ4
 }
 
 func needsGunzip(mediaType string) bool {
 	return mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
 }
 
+func needsZstd(mediaType string) bool {
+	return mediaType == mediaTypeImageLayerZstd || mediaType == mediaTypeImageLayerNonDistributableZstd
+}
+
+func needsLZ4(mediaType string) bool {
+	return mediaType == mediaTypeImageLayerLZ4 || mediaType == mediaTypeImageLayerNonDistributableLZ4
+}
+
+// layerDecompressor returns a reader for the uncompressed tar stream of a
+// layer blob with the given media-type. If opt is non-nil, its decompression
+// limits are applied. The caller must Close the returned reader (which does
+// not close r).
+func layerDecompressor(mediaType string, r io.Reader, opt *UnpackOptions) (io.ReadCloser, error) {
+	switch {
+	case needsGunzip(mediaType):
+		gzRdr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("create gzip reader: %w", err)
+		}
+		return gzRdr, nil
+	case needsZstd(mediaType):
+		var zstdOpts []zstd.DOption
+		if opt != nil && opt.MaxDecompressionWindow > 0 {
+			// For streaming decompression, the memory limit is the maximum
+			// window size a frame may request.
+			zstdOpts = append(zstdOpts, zstd.WithDecoderMaxMemory(opt.MaxDecompressionWindow))
+		}
+		zstdRdr, err := zstd.NewReader(r, zstdOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("create zstd reader: %w", err)
+		}
+		return zstdRdr.IOReadCloser(), nil
+	case needsLZ4(mediaType):
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
 // UnpackManifest extracts all of the layers in the given manifest, as well as
 // generating a runtime bundle and configuration. The rootfs is extracted to
 // <bundle>/<layer.RootfsName>.
@@ -157,12 +380,46 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 }
 
 // UnpackRootfs extracts all of the layers in the given manifest.
-// Some verification is done during image extraction.
-func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
+// Some verification is done during image extraction. If opt.ExtraTargets is
+// set, each of the extra root filesystems is created and extracted to as well.
+func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *UnpackOptions) error {
 	engineExt := casext.NewEngine(engine)
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("mkdir rootfs: %w", err)
+	// In order to verify the DiffIDs as we extract layers, we have to get the
+	// .Config blob first. But we can't extract it (generate the runtime
+	// config) until after we have the full rootfs generated.
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return fmt.Errorf("get config blob: %w", err)
+	}
+	defer configBlob.Close()
+	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
+		return fmt.Errorf("unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+	}
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return fmt.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+	}
+
+	return UnpackRootfsFromSource(ctx, engineSource{engineExt}, rootfsPath, config, manifest, opt)
+}
+
+// UnpackRootfsFromSource extracts all of the layers in the given manifest,
+// reading the layer blobs from src rather than from a cas.Engine. The layers
+// are verified against the DiffIDs in the provided image configuration. Aside
+// from where the blobs come from, this is identical to UnpackRootfs.
+func UnpackRootfsFromSource(ctx context.Context, src BlobSource, rootfsPath string, config ispec.Image, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
+	// Any extra targets are set up identically to the primary rootfs.
+	rootfsPaths := []string{rootfsPath}
+	for _, extra := range opt.ExtraTargets {
+		rootfsPaths = append(rootfsPaths, extra.Root)
+	}
+
+	for _, rootfsPath := range rootfsPaths {
+		if err := os.Mkdir(rootfsPath, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("mkdir rootfs: %w", err)
+		}
 	}
 
 	// In order to avoid having a broken rootfs in the case of an error, we
@@ -174,9 +431,11 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 			if opt != nil && opt.MapOptions.Rootless {
 				fsEval = fseval.Rootless
 			}
-			// It's too late to care about errors.
-			// #nosec G104
-			_ = fsEval.RemoveAll(rootfsPath)
+			for _, rootfsPath := range rootfsPaths {
+				// It's too late to care about errors.
+				// #nosec G104
+				_ = fsEval.RemoveAll(rootfsPath)
+			}
 		}
 	}()
 
@@ -189,82 +448,101 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	if err != nil {
 		return fmt.Errorf("ensure rootgid has mapping: %w", err)
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
-		return fmt.Errorf("chown rootfs: %w", err)
-	}
+	for _, rootfsPath := range rootfsPaths {
+		if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
+			return fmt.Errorf("chown rootfs: %w", err)
+		}
 
-	// Currently, many different images in the wild don't specify what the
-	// atime/mtime of the root directory is. This is a huge pain because it
-	// means that we can't ensure consistent unpacking. In order to get around
-	// this, we first set the mtime of the root directory to the Unix epoch
-	// (which is as good of an arbitrary choice as any).
-	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
-		return fmt.Errorf("set initial root time: %w", err)
+		// Currently, many different images in the wild don't specify what the
+		// atime/mtime of the root directory is. This is a huge pain because it
+		// means that we can't ensure consistent unpacking. In order to get
+		// around this, we first set the mtime of the root directory to the
+		// Unix epoch (which is as good of an arbitrary choice as any).
+		epoch := time.Unix(0, 0)
+		if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
+			return fmt.Errorf("set initial root time: %w", err)
+		}
 	}
 
-	// In order to verify the DiffIDs as we extract layers, we have to get the
-	// .Config blob first. But we can't extract it (generate the runtime
-	// config) until after we have the full rootfs generated.
-	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
-	if err != nil {
-		return fmt.Errorf("get config blob: %w", err)
+	// We can't understand non-layer images.
+	if config.RootFS.Type != "layers" {
+		return fmt.Errorf("unpack rootfs: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
-	defer configBlob.Close()
-	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return fmt.Errorf("unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+
+	// Figure out what platform the image is for, so that the extractor can
+	// skip any steps which only make sense for Linux images. We make a copy of
+	// the options so we don't modify the caller's version.
+	layerOpt := *opt
+	if layerOpt.Platform.OS == "" {
+		layerOpt.Platform.OS = config.OS
+		layerOpt.Platform.Architecture = config.Architecture
 	}
-	config, ok := configBlob.Data.(ispec.Image)
-	if !ok {
-		// Should _never_ be reached.
-		return fmt.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("unpack rootfs: config has %d diffids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
 	}
 
-	// We can't understand non-layer images.
-	if config.RootFS.Type != "layers" {
-		return fmt.Errorf("unpack rootfs: config: unsupported rootfs.type: %s", config.RootFS.Type)
+	// Layer extraction. The resource usage is shared between all layers so
+	// that opt.MaxEntries and opt.MaxUncompressedSize limit the size of the
+	// whole root filesystem.
+	var usage unpackUsage
+	first := 0
+	if opt.StartFrom.MediaType != "" {
+		first = len(manifest.Layers)
+		for idx, layerDescriptor := range manifest.Layers {
+			if layerDescriptor.Digest.String() == opt.StartFrom.Digest.String() {
+				first = idx
+				break
+			}
+		}
 	}
 
-	// Layer extraction.
-	found := false
-	for idx, layerDescriptor := range manifest.Layers {
-		if !found && opt.StartFrom.MediaType != "" && layerDescriptor.Digest.String() != opt.StartFrom.Digest.String() {
-			continue
+	// If requested, upcoming layers are decompressed in the background while
+	// the current layer is being extracted. The layers are still extracted
+	// one at a time in order, so this doesn't change the result.
+	ahead := map[int]*aheadLayer{}
+	defer func() {
+		for _, al := range ahead {
+			// #nosec G104
+			_ = al.Close()
+		}
+	}()
+	startAhead := func(idx int) {
+		if idx >= len(manifest.Layers) || ahead[idx] != nil || !isLayerType(manifest.Layers[idx].MediaType) {
+			return
 		}
-		found = true
+		ahead[idx] = startAheadLayer(ctx, src, manifest.Layers[idx], opt)
+	}
 
+	for idx := first; idx < len(manifest.Layers); idx++ {
+		layerDescriptor := manifest.Layers[idx]
 		layerDiffID := config.RootFS.DiffIDs[idx]
 		log.Infof("unpack layer: %s", layerDescriptor.Digest)
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
-		if err != nil {
-			return fmt.Errorf("get layer blob: %w", err)
-		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.Descriptor.MediaType) {
-			return fmt.Errorf("unpack rootfs: layer %s: blob is not correct mediatype: %s", layerBlob.Descriptor.Digest, layerBlob.Descriptor.MediaType)
-		}
-		layerData, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.New("[internal error] layerBlob was not an io.ReadCloser")
+		if !isLayerType(layerDescriptor.MediaType) {
+			return fmt.Errorf("unpack rootfs: layer %s: blob is not correct mediatype: %s", layerDescriptor.Digest, layerDescriptor.MediaType)
 		}
 
-		layerRaw := layerData
-		if needsGunzip(layerBlob.Descriptor.MediaType) {
-			// We have to extract a gzip'd version of the above layer. Also note
-			// that we have to check the DiffID we're extracting (which is the
-			// sha256 sum of the *uncompressed* layer).
-			layerRaw, err = gzip.NewReader(layerData)
+		var layerRaw layerStream
+		if opt.DecompressAhead > 0 {
+			for next := idx; next <= idx+opt.DecompressAhead; next++ {
+				startAhead(next)
+			}
+			layerRaw = ahead[idx]
+		} else {
+			layerRaw, err = openSerialLayer(ctx, src, layerDescriptor, opt)
 			if err != nil {
-				return fmt.Errorf("create gzip reader: %w", err)
+				return err
 			}
 		}
+		defer layerRaw.Close()
 
+		// Note that we have to check the DiffID we're extracting (which is
+		// the sha256 sum of the *uncompressed* layer).
 		layerDigester := digest.SHA256.Digester()
 		layer := io.TeeReader(layerRaw, layerDigester.Hash())
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
+		if err := unpackLayer(rootfsPath, layer, &layerOpt, &usage); err != nil {
 			return fmt.Errorf("unpack layer: %w", err)
 		}
 		// Different tar implementations can have different levels of redundant
@@ -279,20 +557,11 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 		} else if n != 0 {
 			log.Debugf("unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the tar stream -- probably from GNU tar", layerDescriptor.Digest, n)
 		}
-		// Same goes for compressed layers -- it seems like some gzip
-		// implementations add trailing NUL bytes, which Go doesn't slurp up.
-		// Just eat up the rest of the remaining bytes and discard them.
-		//
-		// FIXME: We use layerData here because pgzip returns io.EOF from
-		// WriteTo, which causes havoc with system.Copy. Ideally we would use
-		// layerRaw. See <https://github.com/klauspost/pgzip/issues/38>.
-		if n, err := system.Copy(ioutil.Discard, layerData); err != nil {
-			return fmt.Errorf("discard trailing raw bits: %w", err)
+		// Same goes for compressed layers.
+		if n, err := layerRaw.Finish(); err != nil {
+			return err
 		} else if n != 0 {
-			log.Warnf("unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the blob stream -- this may indicate a bug in the tool which built this image", layerDescriptor.Digest, n)
-		}
-		if err := layerData.Close(); err != nil {
-			return fmt.Errorf("close layer data: %w", err)
+			opt.OnDiagnostic.warnf(DiagnosticTrailingData, "", "unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the blob stream -- this may indicate a bug in the tool which built this image", layerDescriptor.Digest, n)
 		}
 
 		layerDigest := layerDigester.Digest()
@@ -18,22 +18,31 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pierrec/lz4/v4"
 )
 
 func mustDecodeString(s string) []byte {
@@ -117,7 +126,9 @@ yRAbACGEEEIIIYQQQgghhBBCCKEr+wTE0sQyACgAAA==`,
 
 	// Create the config.
 	config := ispec.Image{
-		OS: "linux",
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
 		RootFS: ispec.RootFS{
 			Type:    "layers",
 			DiffIDs: layerDigests,
@@ -221,3 +232,1589 @@ func TestUnpackStartFromDescriptor(t *testing.T) {
 		t.Errorf("test file present? %+v\n", err)
 	}
 }
+
+// treeContents returns a description of every path in the tree rooted at root,
+// for comparing the results of extraction.
+func treeContents(t *testing.T, root string) map[string]string {
+	contents := map[string]string{}
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		desc := fmt.Sprintf("mode=%v size=%d mtime=%d", info.Mode(), info.Size(), info.ModTime().UnixNano())
+		switch {
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += fmt.Sprintf(" digest=%s", digest.FromBytes(data))
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc += " target=" + target
+		}
+		contents[relPath] = desc
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+// SequentialIO is only a performance hint, and must not change the extracted
+// root filesystem.
+func TestUnpackManifestSequentialIO(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	var trees []map[string]string
+	for _, sequentialIO := range []bool{false, true} {
+		bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestSequentialIO_bundle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(bundle)
+
+		// Unpack (we map both root and the uid/gid in the archives to the current user).
+		unpackOptions := &UnpackOptions{
+			MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+				},
+				GIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+				},
+				Rootless: os.Geteuid() != 0,
+			},
+			SequentialIO: sequentialIO,
+		}
+		if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+			t.Fatalf("unexpected UnpackManifest error (SequentialIO=%t): %+v", sequentialIO, err)
+		}
+		trees = append(trees, treeContents(t, filepath.Join(bundle, "rootfs")))
+	}
+
+	if len(trees[0]) < 2 {
+		t.Fatalf("unpacked rootfs is unexpectedly empty: %v", trees[0])
+	}
+	if !reflect.DeepEqual(trees[0], trees[1]) {
+		t.Errorf("SequentialIO changed the unpacked rootfs:\n without: %v\n    with: %v", trees[0], trees[1])
+	}
+}
+
+func TestUnpackRootfsMaxDecompressionWindow(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsMaxDecompressionWindow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Create a layer with enough data to need a large window.
+	data := make([]byte, 4<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var layerBuf bytes.Buffer
+	tw := tar.NewWriter(&layerBuf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDiffID := digest.FromBytes(layerBuf.Bytes())
+
+	// Compress it with a (non-default) 8MiB window.
+	const layerWindow = 8 << 20
+	var zstdBuf bytes.Buffer
+	zw, err := zstd.NewWriter(&zstdBuf, zstd.WithWindowSize(layerWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(layerBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &zstdBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := ispec.Image{
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDiffID},
+		},
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: mediaTypeImageLayerZstd,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	}
+
+	for _, test := range []struct {
+		name      string
+		maxWindow uint64
+		ok        bool
+	}{
+		{"Default", 0, true},
+		{"Low", 1 << 20, false},
+		{"Exact", layerWindow, true},
+		{"High", 64 << 20, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rootfs, err := ioutil.TempDir(root, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// UnpackRootfs requires the rootfs to not exist yet.
+			rootfs = filepath.Join(rootfs, "rootfs")
+
+			// Map root to the current user.
+			unpackOptions := &UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				MaxDecompressionWindow: test.maxWindow,
+			}
+			err = UnpackRootfs(ctx, engineExt, rootfs, manifest, unpackOptions)
+			if !test.ok {
+				if !errors.Is(err, zstd.ErrWindowSizeExceeded) {
+					t.Errorf("expected UnpackRootfs to fail with window size exceeded error, got %+v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(rootfs, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("unexpected file contents after unpacking zstd layer")
+			}
+		})
+	}
+}
+
+func TestUnpackLayerDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerDiagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/file", Typeflag: tar.TypeReg, Mode: 0644, Xattrs: map[string]string{
+			"security.selinux": "system_u:object_r:evil_t:s0",
+		}},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "link", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: ""},
+	} {
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var diagnostics []Diagnostic
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		DenyPaths:            []string{"/dev"},
+		SkipEmptyLinkTargets: true,
+		OnDiagnostic: func(d Diagnostic) {
+			diagnostics = append(diagnostics, d)
+		},
+	}
+	if err := UnpackLayer(dir, &buf, &opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	// The filesystem may not support xattrs at all, so only check for the
+	// diagnostics we know must have been emitted.
+	for _, expected := range []Diagnostic{
+		{Code: DiagnosticXattrForbidden, Path: "etc/file"},
+		{Code: DiagnosticDeniedPath, Path: "dev"},
+		{Code: DiagnosticEmptyLinkTarget, Path: "link"},
+	} {
+		found := false
+		for _, d := range diagnostics {
+			if d.Code == expected.Code && d.Path == expected.Path {
+				if d.Message == "" {
+					t.Errorf("diagnostic %s for %q has no message", d.Code, d.Path)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing diagnostic %s for %q: got %+v", expected.Code, expected.Path, diagnostics)
+		}
+	}
+	for _, d := range diagnostics {
+		switch d.Code {
+		case DiagnosticXattrForbidden, DiagnosticDeniedPath, DiagnosticEmptyLinkTarget, DiagnosticXattrUnsupported:
+		default:
+			t.Errorf("unexpected diagnostic: %+v", d)
+		}
+	}
+}
+
+func TestUnpackLayerMaxEntries(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 9; i++ {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("dir/file%d", i), Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := buf.Bytes()
+
+	for _, test := range []struct {
+		name       string
+		maxEntries int64
+		expectErr  bool
+	}{
+		{"Unlimited", 0, false},
+		{"AboveLimit", 11, false},
+		{"AtLimit", 10, false},
+		{"BelowLimit", 9, true},
+		{"SingleEntry", 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerMaxEntries")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var unpacked int64
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				MaxEntries: test.maxEntries,
+				AfterEntryUnpack: func(*tar.Header) error {
+					unpacked++
+					return nil
+				},
+			}
+			err = UnpackLayer(dir, bytes.NewReader(layer), &opt)
+			if !test.expectErr {
+				if err != nil {
+					t.Fatalf("unexpected error unpacking layer: %+v", err)
+				}
+				if unpacked != 10 {
+					t.Errorf("expected 10 entries to be unpacked, got %d", unpacked)
+				}
+				return
+			}
+			if !errors.Is(err, ErrTooManyEntries) {
+				t.Fatalf("expected UnpackLayer to fail with ErrTooManyEntries, got %+v", err)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("limit of %d entries exceeded", test.maxEntries)) {
+				t.Errorf("error does not describe the limit: %v", err)
+			}
+			// Nothing past the limit should have been extracted.
+			if unpacked != test.maxEntries {
+				t.Errorf("expected %d entries to be unpacked before aborting, got %d", test.maxEntries, unpacked)
+			}
+		})
+	}
+}
+
+// sizedTarLayer returns an uncompressed layer containing a directory with n
+// files of size bytes each.
+func sizedTarLayer(t *testing.T, n int, size int64) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("dir/file%d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte{'a' + byte(i%26)}, int(size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnpackLayerMaxUncompressedSize(t *testing.T) {
+	const fileSize = 100 * 1024
+	layer := sizedTarLayer(t, 4, fileSize)
+
+	for _, test := range []struct {
+		name      string
+		maxSize   int64
+		extra     bool
+		expectErr bool
+	}{
+		{"Unlimited", 0, false, false},
+		{"AboveLimit", 5 * fileSize, false, false},
+		{"AtLimit", 4 * fileSize, false, false},
+		{"BelowLimit", 4*fileSize - 1, false, true},
+		{"MidFile", 2*fileSize + fileSize/2, false, true},
+		{"ExtraTargetAtLimit", 4 * fileSize, true, false},
+		{"ExtraTargetMidFile", 2*fileSize + fileSize/2, true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerMaxUncompressedSize")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				MaxUncompressedSize: test.maxSize,
+			}
+			rootfs := filepath.Join(dir, "rootfs")
+			if test.extra {
+				opt.ExtraTargets = []UnpackTarget{{Root: filepath.Join(dir, "extra")}}
+			}
+
+			err = UnpackLayer(rootfs, bytes.NewReader(layer), &opt)
+			if !test.expectErr {
+				if err != nil {
+					t.Fatalf("unexpected error unpacking layer: %+v", err)
+				}
+				for i := 0; i < 4; i++ {
+					fi, err := os.Stat(filepath.Join(rootfs, "dir", fmt.Sprintf("file%d", i)))
+					if err != nil {
+						t.Fatalf("file%d missing: %v", i, err)
+					}
+					if fi.Size() != fileSize {
+						t.Errorf("file%d: expected size %d, got %d", i, fileSize, fi.Size())
+					}
+				}
+				return
+			}
+			if !errors.Is(err, ErrSizeLimitExceeded) {
+				t.Fatalf("expected UnpackLayer to fail with ErrSizeLimitExceeded, got %+v", err)
+			}
+
+			// No more than the limit must have been written to disk.
+			var written int64
+			if err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode().IsRegular() {
+					written += info.Size()
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if written > test.maxSize {
+				t.Errorf("expected at most %d bytes to be written, got %d", test.maxSize, written)
+			}
+		})
+	}
+}
+
+// Make sure that MaxUncompressedSize applies to the total size of all of the
+// layers extracted into a root filesystem.
+func TestUnpackLayerMaxUncompressedSizeShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerMaxUncompressedSizeShared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const fileSize = 1024
+	layer := sizedTarLayer(t, 4, fileSize)
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		MaxUncompressedSize: 6 * fileSize,
+	}
+
+	// Each layer is under the limit on its own, but not both together.
+	var usage unpackUsage
+	if err := unpackLayer(dir, bytes.NewReader(layer), &opt, &usage); err != nil {
+		t.Fatalf("unexpected error unpacking first layer: %+v", err)
+	}
+	if usage.bytes != 4*fileSize {
+		t.Errorf("expected %d bytes to be counted, got %d", 4*fileSize, usage.bytes)
+	}
+	if err := unpackLayer(dir, bytes.NewReader(layer), &opt, &usage); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Fatalf("expected second layer to fail with ErrSizeLimitExceeded, got %+v", err)
+	}
+}
+
+// Make sure that the limit is enforced on the data actually written, rather
+// than on the size claimed by the header.
+func TestUnpackEntryMaxUncompressedSizeLyingHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryMaxUncompressedSizeLyingHeader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const maxSize = 64 * 1024
+	te := NewTarExtractor(UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		MaxUncompressedSize: maxSize,
+	})
+	defer te.Close()
+
+	// A small file is fine.
+	small := &tar.Header{Name: "small", Typeflag: tar.TypeReg, Mode: 0644, Size: 1024}
+	if err := te.UnpackEntry(dir, small, bytes.NewReader(make([]byte, 1024))); err != nil {
+		t.Fatalf("unexpected error unpacking small file: %+v", err)
+	}
+
+	// The header claims the file is tiny, but the contents are far larger
+	// than the limit.
+	hdr := &tar.Header{Name: "bomb", Typeflag: tar.TypeReg, Mode: 0644, Size: 16}
+	err = te.UnpackEntry(dir, hdr, io.LimitReader(zeroReader{}, 16*maxSize))
+	if !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Fatalf("expected UnpackEntry to fail with ErrSizeLimitExceeded, got %+v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "bomb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != maxSize-1024 {
+		t.Errorf("expected only %d bytes to be written, got %d", maxSize-1024, fi.Size())
+	}
+
+	// The limit is cumulative, so nothing else can be written.
+	next := &tar.Header{Name: "next", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}
+	if err := te.UnpackEntry(dir, next, bytes.NewReader([]byte{'a'})); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("expected UnpackEntry to fail with ErrSizeLimitExceeded after the limit was reached, got %+v", err)
+	}
+}
+
+// zeroReader is an io.Reader which produces an endless stream of zeroes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Make sure that extracting with ReflinkFrom always gives the same result as a
+// normal extraction, even if the earlier extraction was modified. Whether
+// extents are actually shared is checked in
+// TestUnpackLayerReflinkFromSharedExtents.
+func TestUnpackLayerReflinkFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerReflinkFrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const fileSize = 100 * 1024
+	layer := sizedTarLayer(t, 6, fileSize)
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	expected := filepath.Join(dir, "expected")
+	if err := UnpackLayer(expected, bytes.NewReader(layer), &opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	previous := filepath.Join(dir, "previous")
+	if err := UnpackLayer(previous, bytes.NewReader(layer), &opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	// Modify the earlier extraction in various ways.
+	fh, err := os.OpenFile(filepath.Join(previous, "dir", "file1"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt([]byte("modified contents"), fileSize/2); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if err := os.Remove(filepath.Join(previous, "dir", "file2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(previous, "dir", "file3"), []byte("different size"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(previous, "dir", "file4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file0", filepath.Join(previous, "dir", "file4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(previous, "dir", "file5"), fileSize*2); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	reflinkOpt := opt
+	reflinkOpt.ReflinkFrom = previous
+	if err := UnpackLayer(rootfs, bytes.NewReader(layer), &reflinkOpt); err != nil {
+		t.Fatalf("unexpected error unpacking layer with ReflinkFrom: %+v", err)
+	}
+
+	want, got := treeContents(t, expected), treeContents(t, rootfs)
+	delete(want, ".")
+	delete(got, ".")
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected rootfs contents with ReflinkFrom:\n\texpected %v\n\tgot      %v", want, got)
+	}
+}
+
+// Make sure that MaxEntries applies to the total number of entries in all of
+// the layers of an image, rather than to each layer separately.
+func TestUnpackManifestMaxEntries(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}
+
+	// Count the entries in each layer.
+	var total, largest, current int64
+	unpackOptions := &UnpackOptions{
+		MapOptions: mapOptions,
+		AfterEntryUnpack: func(*tar.Header) error {
+			current++
+			return nil
+		},
+		AfterLayerUnpack: func(ispec.Manifest, ispec.Descriptor) error {
+			total += current
+			if current > largest {
+				largest = current
+			}
+			current = 0
+			return nil
+		},
+	}
+	bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestMaxEntries_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v", err)
+	}
+	if largest == total {
+		t.Fatalf("test image must have more than one non-empty layer")
+	}
+
+	for _, test := range []struct {
+		name       string
+		maxEntries int64
+		expectErr  bool
+	}{
+		{"AtLimit", total, false},
+		{"BelowLimit", total - 1, true},
+		{"LargestLayer", largest, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestMaxEntries_bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(bundle)
+
+			unpackOptions := &UnpackOptions{
+				MapOptions: mapOptions,
+				MaxEntries: test.maxEntries,
+			}
+			err = UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions)
+			if test.expectErr {
+				if !errors.Is(err, ErrTooManyEntries) {
+					t.Errorf("expected UnpackManifest to fail with ErrTooManyEntries, got %+v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected UnpackManifest error: %+v", err)
+			}
+		})
+	}
+}
+
+func TestUnpackRootfsLZ4(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsLZ4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	data := bytes.Repeat([]byte("lz4 layer contents\n"), 10000)
+	var layerBuf bytes.Buffer
+	tw := tar.NewWriter(&layerBuf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDiffID := digest.FromBytes(layerBuf.Bytes())
+
+	var lz4Buf bytes.Buffer
+	lw := lz4.NewWriter(&lz4Buf)
+	if _, err := lw.Write(layerBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &lz4Buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := ispec.Image{
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDiffID},
+		},
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mediaType := range []string{mediaTypeImageLayerLZ4, mediaTypeImageLayerNonDistributableLZ4} {
+		t.Run(mediaType, func(t *testing.T) {
+			manifest := ispec.Manifest{
+				Versioned: specs.Versioned{
+					SchemaVersion: 2,
+				},
+				MediaType: ispec.MediaTypeImageManifest,
+				Config: ispec.Descriptor{
+					MediaType: ispec.MediaTypeImageConfig,
+					Digest:    configDigest,
+					Size:      configSize,
+				},
+				Layers: []ispec.Descriptor{{
+					MediaType: mediaType,
+					Digest:    layerDigest,
+					Size:      layerSize,
+				}},
+			}
+
+			rootfs, err := ioutil.TempDir(root, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// UnpackRootfs requires the rootfs to not exist yet.
+			rootfs = filepath.Join(rootfs, "rootfs")
+
+			// Map root to the current user.
+			unpackOptions := &UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+			}
+			if err := UnpackRootfs(ctx, engineExt, rootfs, manifest, unpackOptions); err != nil {
+				t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(rootfs, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("unexpected file contents after unpacking lz4 layer")
+			}
+		})
+	}
+}
+
+type progressCall struct {
+	entry            string
+	done, total      int64
+	afterEntryUnpack bool
+}
+
+func TestUnpackLayerOnProgress(t *testing.T) {
+	bigFile := make([]byte, 100*1024+123)
+	if _, err := rand.Read(bigFile); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		hdr  tar.Header
+		data []byte
+	}{
+		{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "dir/big", Typeflag: tar.TypeReg, Mode: 0644}, data: bigFile},
+		{hdr: tar.Header{Name: "dir/small", Typeflag: tar.TypeReg, Mode: 0644}, data: []byte("small file")},
+		{hdr: tar.Header{Name: "dir/empty", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "big"}},
+		{hdr: tar.Header{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/small"}},
+	} {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerOnProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var calls []progressCall
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		CopyBufferSize: 4096,
+		OnProgress: func(entry string, done, total int64) {
+			calls = append(calls, progressCall{entry: entry, done: done, total: total})
+		},
+		AfterEntryUnpack: func(hdr *tar.Header) error {
+			calls = append(calls, progressCall{entry: hdr.Name, afterEntryUnpack: true})
+			return nil
+		},
+	}
+	if err := UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	// Compare the progress reported for each entry against the layer.
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := CleanPath(hdr.Name)
+
+		var entryCalls []progressCall
+		for len(calls) > 0 && !calls[0].afterEntryUnpack {
+			entryCalls = append(entryCalls, calls[0])
+			calls = calls[1:]
+		}
+		if len(calls) == 0 || calls[0].entry != hdr.Name {
+			t.Fatalf("entry %s: progress not reported before AfterEntryUnpack: %+v", name, calls)
+		}
+		calls = calls[1:]
+
+		if len(entryCalls) == 0 {
+			t.Errorf("entry %s: no progress reported", name)
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			if !reflect.DeepEqual(entryCalls, []progressCall{{entry: name}}) {
+				t.Errorf("entry %s: unexpected progress reported: %+v", name, entryCalls)
+			}
+			continue
+		}
+		// Regular files are reported as each chunk is copied.
+		if expected := (hdr.Size + 4095) / 4096; int64(len(entryCalls)) != expected {
+			t.Errorf("entry %s: expected %d progress calls, got %d", name, expected, len(entryCalls))
+		}
+		var lastDone int64
+		for _, call := range entryCalls {
+			if call.entry != name || call.total != hdr.Size || call.done <= lastDone || call.done > hdr.Size {
+				t.Errorf("entry %s: unexpected progress call %+v (after %d bytes)", name, call, lastDone)
+			}
+			lastDone = call.done
+		}
+		if lastDone != hdr.Size {
+			t.Errorf("entry %s: reported %d bytes done, expected %d", name, lastDone, hdr.Size)
+		}
+	}
+	if len(calls) != 0 {
+		t.Errorf("unexpected extra progress calls: %+v", calls)
+	}
+}
+
+func TestUnpackLayerOnProgressError(t *testing.T) {
+	// Create a layer which is truncated in the middle of a file.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "good", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "truncated", Typeflag: tar.TypeReg, Mode: 0644, Size: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Flush(); err == nil {
+		t.Fatal("expected flush of incomplete entry to fail")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerOnProgressError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var calls []progressCall
+	opt := UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		CopyBufferSize: 1024,
+		OnProgress: func(entry string, done, total int64) {
+			calls = append(calls, progressCall{entry: entry, done: done, total: total})
+		},
+	}
+	if err := UnpackLayer(dir, bytes.NewReader(buf.Bytes()), &opt); err == nil {
+		t.Fatal("expected error unpacking truncated layer")
+	}
+
+	if len(calls) < 2 || !reflect.DeepEqual(calls[0], progressCall{entry: "good", done: 5, total: 5}) {
+		t.Fatalf("unexpected progress calls: %+v", calls)
+	}
+	// Only the data copied before the error may be reported.
+	for _, call := range calls[1:] {
+		if call.entry != "truncated" || call.total != 10000 || call.done > 5000 {
+			t.Errorf("unexpected progress call after error: %+v", call)
+		}
+	}
+}
+
+// makeTarLayer returns an uncompressed layer containing the given entries,
+// with the name of each regular file as its contents.
+func makeTarLayer(t *testing.T, hdrs ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg && !strings.HasPrefix(filepath.Base(hdr.Name), whPrefix) {
+			data = []byte(hdr.Name)
+		}
+		hdr.Size = int64(len(data))
+		hdr.ModTime = time.Unix(1234567890, 0)
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Mode = 0755
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnpackLayerMaxTrackedPaths(t *testing.T) {
+	// A base layer with many files, and a layer which removes most of them.
+	// Some of the whiteouts come after entries in the same layer, which must
+	// not be removed by them.
+	base := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir},
+		{Name: "keep/", Typeflag: tar.TypeDir},
+	}
+	for i := 0; i < 100; i++ {
+		base = append(base, &tar.Header{Name: fmt.Sprintf("dir/file%d", i), Typeflag: tar.TypeReg})
+	}
+	for i := 0; i < 20; i++ {
+		base = append(base, &tar.Header{Name: fmt.Sprintf("keep/file%d", i), Typeflag: tar.TypeReg})
+	}
+	upper := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir},
+		{Name: "dir/new", Typeflag: tar.TypeReg},
+		{Name: "dir/sub/", Typeflag: tar.TypeDir},
+		{Name: "dir/sub/file", Typeflag: tar.TypeReg},
+		{Name: "keep/added", Typeflag: tar.TypeReg},
+		{Name: "dir/" + whPrefix + "new", Typeflag: tar.TypeReg},
+		{Name: "dir/" + whPrefix + "sub", Typeflag: tar.TypeReg},
+		{Name: "keep/" + whOpaque, Typeflag: tar.TypeReg},
+	}
+	for i := 0; i < 100; i += 2 {
+		upper = append(upper, &tar.Header{Name: fmt.Sprintf("dir/%sfile%d", whPrefix, i), Typeflag: tar.TypeReg})
+	}
+	layers := [][]byte{makeTarLayer(t, base...), makeTarLayer(t, upper...)}
+
+	var expected map[string]string
+	for _, test := range []struct {
+		name        string
+		maxPaths    int
+		limit       TrackedPathsLimitMode
+		expectedErr error
+	}{
+		// The first test is used as the expected result.
+		{"Unlimited", 0, TrackedPathsLimitError, nil},
+		{"UnderLimit", 200, TrackedPathsLimitError, nil},
+		{"UnderLimitSpill", 200, TrackedPathsLimitSpill, nil},
+		{"Spill", 3, TrackedPathsLimitSpill, nil},
+		{"Error", 3, TrackedPathsLimitError, ErrTooManyTrackedPaths},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerMaxTrackedPaths")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// Spilled paths go in the temporary directory.
+			tmpDir := filepath.Join(dir, "tmp")
+			if err := os.Mkdir(tmpDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("TMPDIR", tmpDir)
+
+			rootfs := filepath.Join(dir, "rootfs")
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				MaxTrackedPaths:   test.maxPaths,
+				TrackedPathsLimit: test.limit,
+			}
+			for _, layer := range layers {
+				err = UnpackLayer(rootfs, bytes.NewReader(layer), &opt)
+				if err != nil {
+					break
+				}
+			}
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Fatalf("expected error %v, got %+v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error unpacking layers: %+v", err)
+			}
+
+			// Whiteouts must only remove paths from the lower layer.
+			for path, exists := range map[string]bool{
+				"dir/file0":    false,
+				"dir/file1":    true,
+				"dir/new":      true,
+				"dir/sub/file": true,
+				"keep/file0":   false,
+				"keep/added":   true,
+			} {
+				if _, err := os.Lstat(filepath.Join(rootfs, path)); (err == nil) != exists {
+					t.Errorf("path %q: expected exists=%v, got err=%v", path, exists, err)
+				}
+			}
+
+			// The root itself has no entry, so its mtime differs.
+			contents := treeContents(t, rootfs)
+			delete(contents, ".")
+			if expected == nil {
+				expected = contents
+			} else if !reflect.DeepEqual(contents, expected) {
+				t.Errorf("extracted rootfs differs from unlimited extraction:\nexpected %v\ngot %v", expected, contents)
+			}
+
+			// Any spilled paths must have been cleaned up.
+			if names, err := ioutil.ReadDir(tmpDir); err != nil {
+				t.Fatal(err)
+			} else if len(names) != 0 {
+				t.Errorf("temporary files left behind after extraction: %v", names)
+			}
+		})
+	}
+}
+
+func TestUnpackLayerHardlinkOrder(t *testing.T) {
+	// Hardlinks which precede their target (including a hardlink to another
+	// such hardlink), and one which is replaced by a later entry.
+	layer := makeTarLayer(t,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "dir/link1", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		&tar.Header{Name: "dir/link2", Typeflag: tar.TypeLink, Linkname: "dir/link1"},
+		&tar.Header{Name: "dir/replaced", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "dir/replaced", Typeflag: tar.TypeReg},
+	)
+	missing := makeTarLayer(t,
+		&tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "nonexistent"},
+	)
+
+	for _, test := range []struct {
+		name        string
+		layer       []byte
+		order       HardlinkOrderMode
+		expectedErr error
+	}{
+		{"Immediate", layer, HardlinkOrderImmediate, os.ErrNotExist},
+		{"Strict", layer, HardlinkOrderStrict, ErrHardlinkTargetMissing},
+		{"Defer", layer, HardlinkOrderDefer, nil},
+		{"DeferMissing", missing, HardlinkOrderDefer, ErrHardlinkTargetMissing},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerHardlinkOrder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			progress := map[string]int{}
+			rootfs := filepath.Join(dir, "rootfs")
+			err = UnpackLayer(rootfs, bytes.NewReader(test.layer), &UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				HardlinkOrder: test.order,
+				OnProgress: func(entry string, _, _ int64) {
+					progress[entry]++
+				},
+			})
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Fatalf("expected error %v, got %+v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", err)
+			}
+
+			fi, err := os.Lstat(filepath.Join(rootfs, "dir/file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, link := range []string{"dir/link1", "dir/link2"} {
+				linkFi, err := os.Lstat(filepath.Join(rootfs, link))
+				if err != nil {
+					t.Errorf("deferred hardlink %s was not created: %v", link, err)
+				} else if !os.SameFile(fi, linkFi) {
+					t.Errorf("deferred hardlink %s does not refer to dir/file", link)
+				}
+			}
+			// The later entry must not have been clobbered by the deferred
+			// hardlink it replaced.
+			data, err := ioutil.ReadFile(filepath.Join(rootfs, "dir/replaced"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "dir/replaced" {
+				t.Errorf("dir/replaced was clobbered by a deferred hardlink: contents %q", data)
+			}
+
+			// The progress of every entry is reported once.
+			for _, entry := range []string{"dir", "dir/link1", "dir/link2", "dir/replaced", "dir/file"} {
+				expected := 1
+				if entry == "dir/replaced" {
+					expected = 2
+				}
+				if progress[entry] != expected {
+					t.Errorf("progress of %s reported %d times, expected %d", entry, progress[entry], expected)
+				}
+			}
+		})
+	}
+}
+
+// makeMultiLayerImage creates an image with the given number of gzip layers,
+// where each layer modifies and removes (with whiteouts) some of the files
+// from the previous layers. Each layer contains several MiB of data.
+func makeMultiLayerImage(tb testing.TB, engineExt casext.Engine, numLayers int) ispec.Manifest {
+	ctx := context.Background()
+
+	var (
+		layers  []ispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	for idx := 0; idx < numLayers; idx++ {
+		var layerBuf bytes.Buffer
+		tw := tar.NewWriter(&layerBuf)
+		addFile := func(name string, data []byte) {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(data)),
+				ModTime:  time.Unix(int64(1000+idx), 0),
+			}); err != nil {
+				tb.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if idx > 0 {
+			// Remove a file and an entire directory from the previous layer.
+			for _, name := range []string{
+				fmt.Sprintf("layer%d/%s", idx-1, whPrefix+"file0"),
+				whPrefix + fmt.Sprintf("removed%d", idx-1),
+			} {
+				if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+					tb.Fatal(err)
+				}
+			}
+		}
+		for _, name := range []string{fmt.Sprintf("layer%d/", idx), fmt.Sprintf("removed%d/", idx)} {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Unix(int64(1000+idx), 0),
+			}); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		for file := 0; file < 4; file++ {
+			data := make([]byte, 1024*1024)
+			if _, err := rand.Read(data[:64*1024]); err != nil {
+				tb.Fatal(err)
+			}
+			addFile(fmt.Sprintf("layer%d/file%d", idx, file), data)
+		}
+		addFile(fmt.Sprintf("removed%d/file", idx), []byte("removed by the next layer"))
+		addFile("shared", []byte(fmt.Sprintf("modified by layer %d", idx)))
+		if err := tw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		diffIDs = append(diffIDs, digest.FromBytes(layerBuf.Bytes()))
+
+		var gzipBuf bytes.Buffer
+		gw := gzip.NewWriter(&gzipBuf)
+		if _, err := gw.Write(layerBuf.Bytes()); err != nil {
+			tb.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, &gzipBuf)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		layers = append(layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	config := ispec.Image{
+		Platform: ispec.Platform{
+			OS: "linux",
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+}
+
+// DecompressAhead only changes when layers are decompressed, and must not
+// change the extracted root filesystem.
+func TestUnpackRootfsDecompressAhead(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsDecompressAhead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifest := makeMultiLayerImage(t, engineExt, 5)
+
+	unpack := func(t *testing.T, manifest ispec.Manifest, decompressAhead int) (string, error) {
+		rootfs, err := ioutil.TempDir(root, "rootfs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// UnpackRootfs requires the rootfs to not exist yet.
+		rootfs = filepath.Join(rootfs, "rootfs")
+
+		// Map root to the current user.
+		unpackOptions := &UnpackOptions{
+			MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+				},
+				GIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+				},
+				Rootless: os.Geteuid() != 0,
+			},
+			DecompressAhead: decompressAhead,
+		}
+		return rootfs, UnpackRootfs(ctx, engineExt, rootfs, manifest, unpackOptions)
+	}
+
+	serialRootfs, err := unpack(t, manifest, 0)
+	if err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	serialTree := treeContents(t, serialRootfs)
+	for _, path := range []string{"layer4/file0", "layer4/file3", "layer3/file1", "removed4/file", "shared"} {
+		if _, ok := serialTree[path]; !ok {
+			t.Errorf("expected %s to be in the unpacked rootfs", path)
+		}
+	}
+	for _, path := range []string{"layer3/file0", "removed3"} {
+		if _, ok := serialTree[path]; ok {
+			t.Errorf("expected %s to be removed from the unpacked rootfs", path)
+		}
+	}
+
+	for _, decompressAhead := range []int{1, 2, 10} {
+		t.Run(fmt.Sprintf("DecompressAhead=%d", decompressAhead), func(t *testing.T) {
+			rootfs, err := unpack(t, manifest, decompressAhead)
+			if err != nil {
+				t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+			}
+			if tree := treeContents(t, rootfs); !reflect.DeepEqual(serialTree, tree) {
+				t.Errorf("DecompressAhead changed the unpacked rootfs:\n without: %v\n    with: %v", serialTree, tree)
+			}
+		})
+	}
+
+	// Errors in any layer (even ones being decompressed ahead of time) must
+	// be reported as usual.
+	for _, decompressAhead := range []int{0, 2} {
+		t.Run(fmt.Sprintf("BadLayer-DecompressAhead=%d", decompressAhead), func(t *testing.T) {
+			badManifest := manifest
+			badManifest.Layers = append([]ispec.Descriptor{}, manifest.Layers...)
+			// Swap the last two layers, so they don't match their diffids.
+			last := len(badManifest.Layers) - 1
+			badManifest.Layers[last-1], badManifest.Layers[last] = badManifest.Layers[last], badManifest.Layers[last-1]
+
+			rootfs, err := unpack(t, badManifest, decompressAhead)
+			if err == nil || !strings.Contains(err.Error(), "diffid mismatch") {
+				t.Errorf("expected diffid mismatch error, got %v", err)
+			}
+			if _, err := os.Lstat(rootfs); !os.IsNotExist(err) {
+				t.Errorf("expected rootfs to be removed after failed unpack: %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkUnpackRootfsDecompressAhead(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkUnpackRootfsDecompressAhead")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		b.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		b.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifest := makeMultiLayerImage(b, engineExt, 10)
+
+	for _, decompressAhead := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("DecompressAhead=%d", decompressAhead), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rootfs := filepath.Join(root, fmt.Sprintf("rootfs-%d-%d", decompressAhead, i))
+				unpackOptions := &UnpackOptions{
+					MapOptions: MapOptions{
+						UIDMappings: []rspec.LinuxIDMapping{
+							{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+						},
+						GIDMappings: []rspec.LinuxIDMapping{
+							{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+						},
+						Rootless: os.Geteuid() != 0,
+					},
+					DecompressAhead: decompressAhead,
+				}
+				if err := UnpackRootfs(ctx, engineExt, rootfs, manifest, unpackOptions); err != nil {
+					b.Fatalf("unexpected UnpackRootfs error: %+v", err)
+				}
+				b.StopTimer()
+				if err := os.RemoveAll(rootfs); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// TestLayerDecompressorLZ4Reference checks that lz4 streams created by the
+// reference lz4 implementation (with the options noted below) can be read.
+func TestLayerDecompressorLZ4Reference(t *testing.T) {
+	var expected bytes.Buffer
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&expected, "umoci lz4 reference stream line %d\n", i)
+	}
+
+	for _, test := range []struct {
+		name, stream string
+	}{
+		// lz4 -c
+		{"Default", "BCJNGGRAp4cAAAD/E3Vtb2NpIGx6NCByZWZlcmVuY2Ugc3RyZWFtIGxpbmUgMQoiAA0fMiIADh8zIgAOHzQiAA4fNSIADh82IgAOHzciAA4fOCIADh85IgAOLzEwIwAPD1YBDx8xVwEPHzFYAQ8fMVkBDx8xWgEPHzFbAQ8fMVwBDx8xXQEPHzFeAQ1QZSAyMAoAAAAAJFwPxw=="},
+		// lz4 -c -BD --content-size
+		{"LinkedBlocksContentSize", "BCJNGGxAswIAAAAAAABBhwAAAP8TdW1vY2kgbHo0IHJlZmVyZW5jZSBzdHJlYW0gbGluZSAxCiIADR8yIgAOHzMiAA4fNCIADh81IgAOHzYiAA4fNyIADh84IgAOHzkiAA4vMTAjAA8PVgEPHzFXAQ8fMVgBDx8xWQEPHzFaAQ8fMVsBDx8xXAEPHzFdAQ8fMV4BDVBlIDIwCgAAAAAkXA/H"},
+		// lz4 -c -l
+		{"Legacy", "AiFMGIcAAAD/E3Vtb2NpIGx6NCByZWZlcmVuY2Ugc3RyZWFtIGxpbmUgMQoiAA0fMiIADh8zIgAOHzQiAA4fNSIADh82IgAOHzciAA4fOCIADh85IgAOLzEwIwAPD1YBDx8xVwEPHzFYAQ8fMVkBDx8xWgEPHzFbAQ8fMVwBDx8xXQEPHzFeAQ1QZSAyMAo="},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stream, err := base64.StdEncoding.DecodeString(test.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdr, err := layerDecompressor(mediaTypeImageLayerLZ4, bytes.NewReader(stream), nil)
+			if err != nil {
+				t.Fatalf("unexpected error creating decompressor: %+v", err)
+			}
+			defer rdr.Close()
+			got, err := ioutil.ReadAll(rdr)
+			if err != nil {
+				t.Fatalf("unexpected error decompressing: %+v", err)
+			}
+			if !bytes.Equal(got, expected.Bytes()) {
+				t.Errorf("unexpected decompressed contents: %q", got)
+			}
+		})
+	}
+
+	// Corrupted streams must be rejected (the default stream has a content
+	// checksum).
+	stream, err := base64.StdEncoding.DecodeString("BCJNGGRAp4cAAAD/E3Vtb2NpIGx6NCByZWZlcmVuY2Ugc3RyZWFtIGxpbmUgMQoiAA0fMiIADh8zIgAOHzQiAA4fNSIADh82IgAOHzciAA4fOCIADh85IgAOLzEwIwAPD1YBDx8xVwEPHzFYAQ8fMVkBDx8xWgEPHzFbAQ8fMVwBDx8xXQEPHzFeAQ1QZSAyMAoAAAAAJFwPxw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream[20] ^= 0xff
+	rdr, err := layerDecompressor(mediaTypeImageLayerLZ4, bytes.NewReader(stream), nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating decompressor: %+v", err)
+	}
+	defer rdr.Close()
+	if _, err := ioutil.ReadAll(rdr); err == nil {
+		t.Errorf("expected error decompressing corrupted lz4 stream")
+	}
+}
@@ -20,13 +20,18 @@ package layer
 import (
 	"archive/tar"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/apex/log"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/hardening"
 	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/opencontainers/umoci/pkg/system"
 	rootlesscontainers "github.com/rootless-containers/proto/go-proto"
 	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
@@ -44,6 +49,51 @@ type MapOptions struct {
 	Rootless bool `json:"rootless"`
 }
 
+// rootlessDeviceXattr is the xattr used to record the original type and
+// device number of a device inode that had to be replaced with an empty
+// regular file when unpacking in rootless mode (where mknod(2) is not
+// permitted). The value has the form "<c|b> <major> <minor>" (the argument
+// order of mknod(1)), which carries the same information a device entry in
+// the "user.rootlesscontainers" payload would. Like "user.rootlesscontainers",
+// it is only a marker for us and is never included in layers.
+const rootlessDeviceXattr = "user.umoci.rootless.device"
+
+// formatRootlessDevice returns the rootlessDeviceXattr value describing the
+// device in hdr.
+func formatRootlessDevice(hdr *tar.Header) string {
+	kind := "c"
+	if hdr.Typeflag == tar.TypeBlock {
+		kind = "b"
+	}
+	return fmt.Sprintf("%s %d %d", kind, hdr.Devmajor, hdr.Devminor)
+}
+
+// parseRootlessDevice parses a rootlessDeviceXattr value, returning the tar
+// typeflag and device number it describes.
+func parseRootlessDevice(value string) (typeflag byte, major, minor int64, err error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return 0, 0, 0, fmt.Errorf("invalid device %q: expected 3 fields", value)
+	}
+	switch fields[0] {
+	case "c":
+		typeflag = tar.TypeChar
+	case "b":
+		typeflag = tar.TypeBlock
+	default:
+		return 0, 0, 0, fmt.Errorf("invalid device %q: unknown type %q", value, fields[0])
+	}
+	major, err = strconv.ParseInt(fields[1], 10, 32)
+	if err != nil || major < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid device %q: bad major number %q", value, fields[1])
+	}
+	minor, err = strconv.ParseInt(fields[2], 10, 32)
+	if err != nil || minor < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid device %q: bad minor number %q", value, fields[2])
+	}
+	return typeflag, major, minor, nil
+}
+
 // mapHeader maps a tar.Header generated from the filesystem so that it
 // describes the inode as it would be observed by a container process. In
 // particular this involves apply an ID mapping from the host filesystem to the
@@ -99,6 +149,30 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 		delete(hdr.Xattrs, rootlesscontainers.Keyname)
 	}
 
+	// Regular files with the rootless device xattr are placeholders for
+	// device inodes we couldn't create when unpacking, so turn them back into
+	// the original device. Placeholders are only ever created in (partial)
+	// rootless mode, and any unprivileged user can set user.* xattrs, so
+	// outside of that mode we just warn and keep the regular file (otherwise
+	// an unprivileged user could create arbitrary device inodes in the layer).
+	if value, ok := hdr.Xattrs[rootlessDeviceXattr]; ok {
+		delete(hdr.Xattrs, rootlessDeviceXattr)
+		if !mapOptions.Rootless && !inUserNamespace {
+			log.Warnf("suspicious filesystem: saw special xattr %s in non-rootless invocation: %s", rootlessDeviceXattr, hdr.Name)
+		} else if hdr.Typeflag != tar.TypeReg {
+			log.Warnf("suspicious filesystem: saw special xattr %s on non-regular file %s", rootlessDeviceXattr, hdr.Name)
+		} else {
+			typeflag, major, minor, err := parseRootlessDevice(value)
+			if err != nil {
+				return fmt.Errorf("parse %s xattr: %w", rootlessDeviceXattr, err)
+			}
+			hdr.Typeflag = typeflag
+			hdr.Devmajor = major
+			hdr.Devminor = minor
+			hdr.Size = 0
+		}
+	}
+
 	hdr.Uid = newUID
 	hdr.Gid = newGID
 	return nil
@@ -229,3 +303,47 @@ func isOverlayWhiteout(info os.FileInfo) (bool, error) {
 	return major == 0 && minor == 0 &&
 		info.Mode()&os.ModeCharDevice != 0, nil
 }
+
+// adviseSequential advises the kernel that the file underlying r (if there is
+// one) will be accessed sequentially. r may be an *os.File, or a
+// hardening.VerifiedReadCloser wrapping one (as returned by the dir CAS
+// engine). Since this is only a hint, failures are logged and otherwise
+// ignored.
+func adviseSequential(r io.Reader) {
+	for {
+		switch rdr := r.(type) {
+		case *hardening.VerifiedReadCloser:
+			r = rdr.Reader
+		case *os.File:
+			if err := system.FadviseSequential(rdr); err != nil {
+				log.Debugf("ignoring fadvise error: %v", err)
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+// sameFile is equivalent to os.SameFile, except that it also handles
+// os.FileInfos which were not returned by the os package (such as those from
+// fseval.Mem) by comparing the device and inode numbers of their stat info.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	if os.SameFile(fi1, fi2) {
+		return true
+	}
+	dev1, ino1, ok1 := devIno(fi1)
+	dev2, ino2, ok2 := devIno(fi2)
+	return ok1 && ok2 && dev1 == dev2 && ino1 == ino2
+}
+
+// devIno returns the device and inode numbers of the file described by info.
+func devIno(info os.FileInfo) (dev, ino uint64, ok bool) {
+	switch stat := info.Sys().(type) {
+	case *unix.Stat_t:
+		return uint64(stat.Dev), uint64(stat.Ino), true
+	case *syscall.Stat_t:
+		return uint64(stat.Dev), uint64(stat.Ino), true
+	}
+	return 0, 0, false
+}
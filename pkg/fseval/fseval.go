@@ -48,12 +48,38 @@ type FsEval interface {
 	// Link is equivalent to os.Link.
 	Link(linkname, path string) error
 
+	// Rename is equivalent to unix.Rename.
+	Rename(oldpath, newpath string) error
+
 	// Chmod is equivalent to os.Chmod.
 	Chmod(path string, mode os.FileMode) error
 
+	// Lchown is equivalent to os.Lchown.
+	Lchown(path string, uid, gid int) error
+
+	// Lopen opens path without following symlinks, returning a handle that
+	// pins the inode at path for use with Fchown, Fchmod and Futimes. The
+	// handle cannot be used for I/O.
+	Lopen(path string) (*os.File, error)
+
+	// Fchown is equivalent to system.Fchown on a handle returned by Lopen.
+	Fchown(fh *os.File, uid, gid int) error
+
+	// Fchmod is equivalent to system.Fchmod on a handle returned by Lopen.
+	Fchmod(fh *os.File, mode os.FileMode) error
+
+	// Futimes is equivalent to system.Futimes on a handle returned by Lopen.
+	Futimes(fh *os.File, atime, mtime time.Time) error
+
 	// Lutimes is equivalent to os.Lutimes.
 	Lutimes(path string, atime, mtime time.Time) error
 
+	// Lbtime is equivalent to system.Lbtime.
+	Lbtime(path string) (time.Time, error)
+
+	// Lsetbtime is equivalent to system.Lsetbtime.
+	Lsetbtime(path string, btime time.Time) error
+
 	// RemoveAll is equivalent to os.RemoveAll.
 	RemoveAll(path string) error
 
@@ -88,16 +88,59 @@ func (fs osFsEval) Link(target, linkname string) error {
 	return unix.Linkat(unix.AT_FDCWD, target, unix.AT_FDCWD, linkname, 0)
 }
 
+// Rename is equivalent to unix.Rename.
+func (fs osFsEval) Rename(oldpath, newpath string) error {
+	if err := unix.Renameat(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
 // Chmod is equivalent to os.Chmod.
 func (fs osFsEval) Chmod(path string, mode os.FileMode) error {
 	return os.Chmod(path, mode)
 }
 
+// Lchown is equivalent to os.Lchown.
+func (fs osFsEval) Lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
 // Lutimes is equivalent to os.Lutimes.
 func (fs osFsEval) Lutimes(path string, atime, mtime time.Time) error {
 	return system.Lutimes(path, atime, mtime)
 }
 
+// Lbtime is equivalent to system.Lbtime.
+func (fs osFsEval) Lbtime(path string) (time.Time, error) {
+	return system.Lbtime(path)
+}
+
+// Lsetbtime is equivalent to system.Lsetbtime.
+func (fs osFsEval) Lsetbtime(path string, btime time.Time) error {
+	return system.Lsetbtime(path, btime)
+}
+
+// Lopen is equivalent to system.OpenPath.
+func (fs osFsEval) Lopen(path string) (*os.File, error) {
+	return system.OpenPath(path)
+}
+
+// Fchown is equivalent to system.Fchown.
+func (fs osFsEval) Fchown(fh *os.File, uid, gid int) error {
+	return system.Fchown(fh, uid, gid)
+}
+
+// Fchmod is equivalent to system.Fchmod.
+func (fs osFsEval) Fchmod(fh *os.File, mode os.FileMode) error {
+	return system.Fchmod(fh, mode)
+}
+
+// Futimes is equivalent to system.Futimes.
+func (fs osFsEval) Futimes(fh *os.File, atime, mtime time.Time) error {
+	return system.Futimes(fh, atime, mtime)
+}
+
 // RemoveAll is equivalent to os.RemoveAll.
 func (fs osFsEval) RemoveAll(path string) error {
 	return os.RemoveAll(path)
@@ -0,0 +1,906 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+// memMaxSymlinks is the maximum number of symlinks followed while resolving a
+// single path (matching the limit used by Linux).
+const memMaxSymlinks = 40
+
+// Mem is an FsEval which stores an entire filesystem tree in memory, rather
+// than operating on the host filesystem. This is useful for extracting layers
+// in order to inspect or scan their contents (as well as for tests), as it
+// doesn't require any privileges or writing anything to disk. Paths are
+// always interpreted relative to the root of the in-memory tree, so "/a/b"
+// and "a/b" refer to the same file. Mem must be created with NewMem, and it
+// is safe for concurrent use.
+//
+// Only the state stored by a filesystem is emulated -- there are no
+// permission checks and no umask is applied, so any owner (and any xattr) can
+// be set without privileges. The contents of each regular file are stored in
+// an anonymous memory-backed file (see system.MemFile), which is what allows
+// regular files to be returned as *os.File. As a result each regular file
+// holds a file descriptor until it is removed or Close is called. Other
+// limitations are:
+//
+//   - Device nodes, FIFOs and sockets created with Mknod are faked: their
+//     type, mode and device number are recorded but they cannot be opened.
+//   - Directories cannot be opened, Readdir must be used instead.
+//   - Lopen (and thus Fchown, Fchmod and Futimes) is not supported and
+//     returns system.ErrFdMetadataUnsupported, so metadata must be modified
+//     through paths. Modifying metadata through a handle returned by Create
+//     or Open (such as with (*os.File).Chmod) does not affect the metadata
+//     stored by Mem.
+//   - ".." components in symlink targets are resolved lexically.
+//   - Handles returned by Create and Open are reopened through /proc/self/fd
+//     so that they have their own offset. If /proc is not available, all of
+//     the handles for a given file share the same offset.
+type Mem struct {
+	mu      sync.Mutex
+	root    *memNode
+	lastIno uint64
+}
+
+// NewMem creates a new in-memory filesystem containing only an empty root
+// directory owned by the current user. Close must be called once the
+// filesystem is no longer needed.
+func NewMem() *Mem {
+	m := &Mem{}
+	m.root = m.newNode(unix.S_IFDIR | 0755)
+	m.root.children = make(map[string]*memNode)
+	m.root.nlink = 1
+	return m
+}
+
+// memNode is an inode in a Mem filesystem. Hardlinks are represented by the
+// same memNode being present in several directories.
+type memNode struct {
+	mode     uint32 // includes the S_IFMT bits
+	uid, gid uint32
+	nlink    uint64
+	ino      uint64
+	rdev     uint64
+
+	atime, mtime, ctime, btime time.Time
+
+	xattrs map[string][]byte
+
+	// Only one of the following is set, depending on the type of the node.
+	children map[string]*memNode // directory entries
+	target   string              // symlink target
+	contents *os.File            // regular file contents
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&unix.S_IFMT == unix.S_IFLNK
+}
+
+// newNode creates a new (unlinked) node of the given mode, owned by the
+// current user.
+func (m *Mem) newNode(mode uint32) *memNode {
+	m.lastIno++
+	now := time.Now()
+	return &memNode{
+		mode:  mode,
+		uid:   uint32(os.Geteuid()),
+		gid:   uint32(os.Getegid()),
+		ino:   m.lastIno,
+		atime: now,
+		mtime: now,
+		ctime: now,
+		btime: now,
+	}
+}
+
+// newFile creates a new (unlinked) empty regular file.
+func (m *Mem) newFile(mode uint32) (*memNode, error) {
+	contents, err := system.MemFile("umoci-mem")
+	if err != nil {
+		return nil, err
+	}
+	n := m.newNode(unix.S_IFREG | mode)
+	n.contents = contents
+	return n, nil
+}
+
+// link adds child to the directory n as name.
+func (n *memNode) link(name string, child *memNode) {
+	n.children[name] = child
+	n.mtime = time.Now()
+	n.ctime = n.mtime
+	child.nlink++
+	child.ctime = n.mtime
+}
+
+// unlink removes the entry name from the directory n, releasing the node
+// once there are no links to it left.
+func (n *memNode) unlink(name string) {
+	child := n.children[name]
+	delete(n.children, name)
+	n.mtime = time.Now()
+	n.ctime = n.mtime
+	child.release()
+}
+
+// release drops a link to n, freeing its contents (and dropping the links to
+// its children) once there are no links left.
+func (n *memNode) release() {
+	n.nlink--
+	if n.nlink > 0 {
+		return
+	}
+	for _, child := range n.children {
+		child.release()
+	}
+	n.children = nil
+	if n.contents != nil {
+		_ = n.contents.Close()
+		n.contents = nil
+	}
+}
+
+// reopen returns a new handle to the contents of the regular file n.
+func (n *memNode) reopen(path string, flag int) (*os.File, error) {
+	fd, err := unix.Open(fmt.Sprintf("/proc/self/fd/%d", n.contents.Fd()), flag|unix.O_CLOEXEC, 0)
+	if err != nil {
+		// Fall back to duplicating the file descriptor, which means that the
+		// handle shares its offset with every other handle to the file.
+		fd, err = unix.FcntlInt(n.contents.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := unix.Seek(fd, 0, io.SeekStart); err != nil {
+			_ = unix.Close(fd)
+			return nil, err
+		}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// setStatField sets a field of a syscall.Stat_t whose type differs between
+// architectures.
+func setStatField[T ~uint32 | ~uint64](field *T, value uint64) {
+	*field = T(value)
+}
+
+// stat returns the stat information of n, in the same form as the os package.
+func (n *memNode) stat() (*syscall.Stat_t, error) {
+	st := new(syscall.Stat_t)
+	if n.contents != nil {
+		// Use the device and inode numbers (as well as the size) of the
+		// contents, so that the stat information matches that of the handles
+		// returned by Create and Open.
+		fi, err := n.contents.Stat()
+		if err != nil {
+			return nil, err
+		}
+		*st = *fi.Sys().(*syscall.Stat_t)
+	} else {
+		st.Ino = n.ino
+		st.Size = int64(len(n.target))
+	}
+	nlink := n.nlink
+	if n.isDir() {
+		// "." and the entry in the parent, plus ".." in each subdirectory.
+		nlink = 2
+		for _, child := range n.children {
+			if child.isDir() {
+				nlink++
+			}
+		}
+	}
+	setStatField(&st.Nlink, nlink)
+	setStatField(&st.Rdev, n.rdev)
+	st.Mode = n.mode
+	st.Uid = n.uid
+	st.Gid = n.gid
+	st.Atim = syscall.NsecToTimespec(n.atime.UnixNano())
+	st.Mtim = syscall.NsecToTimespec(n.mtime.UnixNano())
+	st.Ctim = syscall.NsecToTimespec(n.ctime.UnixNano())
+	return st, nil
+}
+
+// memFileInfo is the os.FileInfo for a memNode. Sys returns a
+// *syscall.Stat_t, just like the os.FileInfos returned by the os package.
+type memFileInfo struct {
+	name string
+	st   *syscall.Stat_t
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.st.Size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fileMode(fi.st.Mode) }
+func (fi *memFileInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *memFileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return fi.st }
+
+func (n *memNode) fileInfo(name string) (os.FileInfo, error) {
+	st, err := n.stat()
+	if err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: name, st: st}, nil
+}
+
+// fileMode converts a stat(2) mode to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	fm := os.FileMode(mode & 0777)
+	switch mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		fm |= os.ModeDevice
+	case unix.S_IFCHR:
+		fm |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFDIR:
+		fm |= os.ModeDir
+	case unix.S_IFIFO:
+		fm |= os.ModeNamedPipe
+	case unix.S_IFLNK:
+		fm |= os.ModeSymlink
+	case unix.S_IFSOCK:
+		fm |= os.ModeSocket
+	}
+	if mode&unix.S_ISUID != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm
+}
+
+// permBits converts the permission bits of an os.FileMode to the
+// corresponding stat(2) mode bits.
+func permBits(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unix.S_ISVTX
+	}
+	return perm
+}
+
+// resolve looks up path, following symlinks in every component other than
+// the last one (which is only followed if follow is set). It returns the
+// directory containing the final component, the name of the final component
+// and the node it refers to (which is nil if it doesn't exist). The root
+// directory is its own parent.
+func (m *Mem) resolve(path string, follow bool) (dir *memNode, name string, node *memNode, err error) {
+	var links int
+	return m.resolveLinks(path, follow, &links)
+}
+
+func (m *Mem) resolveLinks(path string, follow bool, links *int) (*memNode, string, *memNode, error) {
+	path = filepath.Join("/", path)
+	if path == "/" {
+		return m.root, ".", m.root, nil
+	}
+	dirPath, name := filepath.Split(path)
+	_, _, dir, err := m.resolveLinks(dirPath, true, links)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if dir == nil {
+		return nil, "", nil, unix.ENOENT
+	}
+	if !dir.isDir() {
+		return nil, "", nil, unix.ENOTDIR
+	}
+	node := dir.children[name]
+	if node != nil && node.isSymlink() && follow {
+		*links++
+		if *links > memMaxSymlinks {
+			return nil, "", nil, unix.ELOOP
+		}
+		target := node.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dirPath, target)
+		}
+		return m.resolveLinks(target, true, links)
+	}
+	return dir, name, node, nil
+}
+
+// lookup is like resolve, except that it is an error if path doesn't exist.
+func (m *Mem) lookup(path string, follow bool) (*memNode, error) {
+	_, _, node, err := m.resolve(path, follow)
+	if err == nil && node == nil {
+		err = unix.ENOENT
+	}
+	return node, err
+}
+
+// create adds a new node (returned by newFn) at path, which must not already
+// exist.
+func (m *Mem) create(path string, newFn func() (*memNode, error)) (*memNode, error) {
+	dir, name, node, err := m.resolve(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		return nil, unix.EEXIST
+	}
+	node, err = newFn()
+	if err != nil {
+		return nil, err
+	}
+	dir.link(name, node)
+	return node, nil
+}
+
+// Open is equivalent to os.Open. Only regular files can be opened.
+func (m *Mem) Open(path string) (*os.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup(path, true)
+	if err == nil {
+		switch {
+		case node.isDir():
+			err = unix.EISDIR
+		case node.contents == nil:
+			err = unix.ENXIO
+		}
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	fh, err := node.reopen(path, unix.O_RDONLY)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	node.atime = time.Now()
+	return fh, nil
+}
+
+// Create is equivalent to os.Create.
+func (m *Mem) Create(path string) (*os.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, name, node, err := m.resolve(path, true)
+	if err == nil {
+		switch {
+		case node == nil:
+			node, err = m.newFile(0666)
+			if err == nil {
+				dir.link(name, node)
+			}
+		case node.isDir():
+			err = unix.EISDIR
+		case node.contents == nil:
+			err = unix.ENXIO
+		default:
+			err = node.contents.Truncate(0)
+			node.mtime = time.Now()
+			node.ctime = node.mtime
+		}
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	fh, err := node.reopen(path, unix.O_RDWR)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fh, nil
+}
+
+// Readdir is equivalent to os.Readdir. The entries are sorted by name.
+func (m *Mem) Readdir(path string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup(path, true)
+	if err == nil && !node.isDir() {
+		err = unix.ENOTDIR
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "readdirent", Path: path, Err: err}
+	}
+	var infos []os.FileInfo
+	for name, child := range node.children {
+		fi, err := child.fileInfo(name)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdirent", Path: path, Err: err}
+		}
+		infos = append(infos, fi)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Lstat is equivalent to os.Lstat.
+func (m *Mem) Lstat(path string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, name, node, err := m.resolve(path, false)
+	if err == nil && node == nil {
+		err = unix.ENOENT
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if name == "." {
+		name = "/"
+	}
+	fi, err := node.fileInfo(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	return fi, nil
+}
+
+// Lstatx is equivalent to unix.Lstat.
+func (m *Mem) Lstatx(path string) (unix.Stat_t, error) {
+	fi, err := m.Lstat(path)
+	if err != nil {
+		return unix.Stat_t{}, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return unix.Stat_t{
+		Dev:     st.Dev,
+		Ino:     st.Ino,
+		Nlink:   st.Nlink,
+		Mode:    st.Mode,
+		Uid:     st.Uid,
+		Gid:     st.Gid,
+		Rdev:    st.Rdev,
+		Size:    st.Size,
+		Blksize: st.Blksize,
+		Blocks:  st.Blocks,
+		Atim:    unix.NsecToTimespec(st.Atim.Nano()),
+		Mtim:    unix.NsecToTimespec(st.Mtim.Nano()),
+		Ctim:    unix.NsecToTimespec(st.Ctim.Nano()),
+	}, nil
+}
+
+// Readlink is equivalent to os.Readlink.
+func (m *Mem) Readlink(path string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup(path, false)
+	if err == nil && !node.isSymlink() {
+		err = unix.EINVAL
+	}
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	return node.target, nil
+}
+
+// Symlink is equivalent to os.Symlink.
+func (m *Mem) Symlink(target, linkname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.create(linkname, func() (*memNode, error) {
+		node := m.newNode(unix.S_IFLNK | 0777)
+		node.target = target
+		return node, nil
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: linkname, Err: err}
+	}
+	return nil
+}
+
+// Link is equivalent to unix.Link(..., ~AT_SYMLINK_FOLLOW).
+func (m *Mem) Link(target, linkname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup(target, false)
+	if err == nil && node.isDir() {
+		err = unix.EPERM
+	}
+	if err == nil {
+		_, err = m.create(linkname, func() (*memNode, error) { return node, nil })
+	}
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: target, New: linkname, Err: err}
+	}
+	return nil
+}
+
+// Rename is equivalent to unix.Rename.
+func (m *Mem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.rename(oldpath, newpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+func (m *Mem) rename(oldpath, newpath string) error {
+	oldDir, oldName, node, err := m.resolve(oldpath, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return unix.ENOENT
+	}
+	newDir, newName, existing, err := m.resolve(newpath, false)
+	if err != nil {
+		return err
+	}
+	if existing == node {
+		// Renaming a file to (a hardlink of) itself does nothing.
+		return nil
+	}
+	if node == m.root || existing == m.root {
+		return unix.EBUSY
+	}
+	if node.isDir() && node.contains(newDir) {
+		return unix.EINVAL
+	}
+	if existing != nil {
+		switch {
+		case node.isDir() && !existing.isDir():
+			return unix.ENOTDIR
+		case !node.isDir() && existing.isDir():
+			return unix.EISDIR
+		case len(existing.children) > 0:
+			return unix.ENOTEMPTY
+		}
+		newDir.unlink(newName)
+	}
+	newDir.link(newName, node)
+	oldDir.unlink(oldName)
+	return nil
+}
+
+// contains returns whether dir is n or one of its descendants.
+func (n *memNode) contains(dir *memNode) bool {
+	if n == dir {
+		return true
+	}
+	for _, child := range n.children {
+		if child.isDir() && child.contains(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// modify applies fn to the node at path.
+func (m *Mem) modify(op, path string, follow bool, fn func(*memNode) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup(path, follow)
+	if err == nil {
+		err = fn(node)
+	}
+	if err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+// Chmod is equivalent to os.Chmod.
+func (m *Mem) Chmod(path string, mode os.FileMode) error {
+	return m.modify("chmod", path, true, func(node *memNode) error {
+		node.mode = node.mode&unix.S_IFMT | permBits(mode)
+		node.ctime = time.Now()
+		return nil
+	})
+}
+
+// Lchown is equivalent to os.Lchown.
+func (m *Mem) Lchown(path string, uid, gid int) error {
+	return m.modify("lchown", path, false, func(node *memNode) error {
+		if uid != -1 {
+			node.uid = uint32(uid)
+		}
+		if gid != -1 {
+			node.gid = uint32(gid)
+		}
+		node.ctime = time.Now()
+		return nil
+	})
+}
+
+// Lopen is not supported by Mem, and always returns an error wrapping
+// system.ErrFdMetadataUnsupported.
+func (m *Mem) Lopen(path string) (*os.File, error) {
+	return nil, &os.PathError{Op: "lopen", Path: path, Err: system.ErrFdMetadataUnsupported}
+}
+
+// Fchown is not supported by Mem (see Lopen).
+func (m *Mem) Fchown(fh *os.File, uid, gid int) error {
+	return &os.PathError{Op: "fchown", Path: fh.Name(), Err: system.ErrFdMetadataUnsupported}
+}
+
+// Fchmod is not supported by Mem (see Lopen).
+func (m *Mem) Fchmod(fh *os.File, mode os.FileMode) error {
+	return &os.PathError{Op: "fchmod", Path: fh.Name(), Err: system.ErrFdMetadataUnsupported}
+}
+
+// Futimes is not supported by Mem (see Lopen).
+func (m *Mem) Futimes(fh *os.File, atime, mtime time.Time) error {
+	return &os.PathError{Op: "futimes", Path: fh.Name(), Err: system.ErrFdMetadataUnsupported}
+}
+
+// Lutimes is equivalent to system.Lutimes.
+func (m *Mem) Lutimes(path string, atime, mtime time.Time) error {
+	return m.modify("lutimes", path, false, func(node *memNode) error {
+		node.atime, node.mtime = atime, mtime
+		node.ctime = time.Now()
+		return nil
+	})
+}
+
+// Lbtime is equivalent to system.Lbtime.
+func (m *Mem) Lbtime(path string) (time.Time, error) {
+	var btime time.Time
+	err := m.modify("lbtime", path, false, func(node *memNode) error {
+		btime = node.btime
+		return nil
+	})
+	return btime, err
+}
+
+// Lsetbtime is equivalent to system.Lsetbtime.
+func (m *Mem) Lsetbtime(path string, btime time.Time) error {
+	return m.modify("lsetbtime", path, false, func(node *memNode) error {
+		node.btime = btime
+		return nil
+	})
+}
+
+// RemoveAll is equivalent to os.RemoveAll. Removing the root directory
+// removes all of its contents.
+func (m *Mem) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, name, node, err := m.resolve(path, false)
+	if errors.Is(err, unix.ENOENT) || (err == nil && node == nil) {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: path, Err: err}
+	}
+	if node == m.root {
+		for child := range node.children {
+			node.unlink(child)
+		}
+		return nil
+	}
+	dir.unlink(name)
+	return nil
+}
+
+// MkdirAll is equivalent to os.MkdirAll.
+func (m *Mem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.mkdirAll(path, perm); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (m *Mem) mkdirAll(path string, perm os.FileMode) error {
+	dir, name, node, err := m.resolve(path, true)
+	if errors.Is(err, unix.ENOENT) {
+		// Create the parent directories first.
+		if err := m.mkdirAll(filepath.Dir(filepath.Join("/", path)), perm); err != nil {
+			return err
+		}
+		dir, name, node, err = m.resolve(path, true)
+	}
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		if !node.isDir() {
+			return unix.ENOTDIR
+		}
+		return nil
+	}
+	// Don't create the target of a dangling symlink.
+	if _, _, link, _ := m.resolve(path, false); link != nil {
+		return unix.EEXIST
+	}
+	node = m.newNode(unix.S_IFDIR | permBits(perm))
+	node.children = make(map[string]*memNode)
+	dir.link(name, node)
+	return nil
+}
+
+// Mknod is equivalent to unix.Mknod. Device nodes, FIFOs and sockets are
+// faked (see Mem).
+func (m *Mem) Mknod(path string, mode os.FileMode, dev uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rawMode := uint32(mode)
+	_, err := m.create(path, func() (*memNode, error) {
+		switch rawMode & unix.S_IFMT {
+		case 0, unix.S_IFREG:
+			return m.newFile(rawMode &^ unix.S_IFMT)
+		case unix.S_IFCHR, unix.S_IFBLK, unix.S_IFIFO, unix.S_IFSOCK:
+			node := m.newNode(rawMode)
+			node.rdev = dev
+			return node, nil
+		}
+		return nil, unix.EINVAL
+	})
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Llistxattr is equivalent to system.Llistxattr. The names are sorted.
+func (m *Mem) Llistxattr(path string) ([]string, error) {
+	var names []string
+	err := m.modify("llistxattr", path, false, func(node *memNode) error {
+		names = make([]string, 0, len(node.xattrs))
+		for name := range node.xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil
+	})
+	return names, err
+}
+
+// Lremovexattr is equivalent to system.Lremovexattr.
+func (m *Mem) Lremovexattr(path, name string) error {
+	return m.modify("lremovexattr", path, false, func(node *memNode) error {
+		if _, ok := node.xattrs[name]; !ok {
+			return unix.ENODATA
+		}
+		delete(node.xattrs, name)
+		node.ctime = time.Now()
+		return nil
+	})
+}
+
+// Lsetxattr is equivalent to system.Lsetxattr.
+func (m *Mem) Lsetxattr(path, name string, value []byte, flags int) error {
+	return m.modify("lsetxattr", path, false, func(node *memNode) error {
+		_, exists := node.xattrs[name]
+		switch {
+		case flags&unix.XATTR_CREATE != 0 && exists:
+			return unix.EEXIST
+		case flags&unix.XATTR_REPLACE != 0 && !exists:
+			return unix.ENODATA
+		}
+		if node.xattrs == nil {
+			node.xattrs = make(map[string][]byte)
+		}
+		node.xattrs[name] = append([]byte{}, value...)
+		node.ctime = time.Now()
+		return nil
+	})
+}
+
+// Lgetxattr is equivalent to system.Lgetxattr.
+func (m *Mem) Lgetxattr(path string, name string) ([]byte, error) {
+	var value []byte
+	err := m.modify("lgetxattr", path, false, func(node *memNode) error {
+		v, ok := node.xattrs[name]
+		if !ok {
+			return unix.ENODATA
+		}
+		value = append([]byte{}, v...)
+		return nil
+	})
+	return value, err
+}
+
+// Lclearxattrs is equivalent to system.Lclearxattrs.
+func (m *Mem) Lclearxattrs(path string, except map[string]struct{}) error {
+	return m.modify("lclearxattrs", path, false, func(node *memNode) error {
+		for name := range node.xattrs {
+			if _, skip := except[name]; !skip {
+				delete(node.xattrs, name)
+			}
+		}
+		node.ctime = time.Now()
+		return nil
+	})
+}
+
+// KeywordFunc returns a wrapper around the given mtree.KeywordFunc.
+func (m *Mem) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
+	return fn
+}
+
+// walk is the inner implementation of Walk.
+func (m *Mem) walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+	infos, err := m.Readdir(path)
+	err1 := walkFn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, info := range infos {
+		if err := m.walk(filepath.Join(path, info.Name()), info, walkFn); err != nil {
+			// Ignore error if it's SkipDir and subpath is a directory.
+			if !(info.IsDir() && errors.Is(err, filepath.SkipDir)) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Walk is equivalent to filepath.Walk.
+func (m *Mem) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := m.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = m.walk(root, info, walkFn)
+	}
+	if errors.Is(err, filepath.SkipDir) {
+		return nil
+	}
+	return err
+}
+
+// Close releases the contents of every regular file in the filesystem. The
+// filesystem must not be used after it has been closed.
+func (m *Mem) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.root.release()
+	return nil
+}
@@ -0,0 +1,227 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMemFiles(t *testing.T) {
+	mem := NewMem()
+	defer mem.Close()
+
+	if err := mem.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Symlink("b", "/a/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes through the symlink end up in the directory it points to.
+	fh, err := mem.Create("/a/link/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	created, err := fh.Stat()
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := mem.Lstat("a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5 || !fi.Mode().IsRegular() {
+		t.Errorf("unexpected file info: size=%d mode=%v", fi.Size(), fi.Mode())
+	}
+	// Sys must be a *syscall.Stat_t (like the os package) and refer to the
+	// same inode as the handle returned by Create.
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	createdSt := created.Sys().(*syscall.Stat_t)
+	if !ok || st.Dev != createdSt.Dev || st.Ino != createdSt.Ino {
+		t.Errorf("file info does not match the created file: %#v", fi.Sys())
+	}
+	fi, err = mem.Lstat("/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat followed the symlink: mode=%v", fi.Mode())
+	}
+
+	fh, err = mem.Open("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(fh)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	if err := mem.Link("/a/b/file", "/hardlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Lstat("/a/b/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected removed file to not exist: %v", err)
+	}
+	// The hardlink keeps the contents alive.
+	fh, err = mem.Open("/hardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err = ioutil.ReadAll(fh)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello" {
+		t.Errorf("unexpected hardlink contents: %q", contents)
+	}
+
+	var walked []string
+	if err := mem.Walk("/", func(path string, _ os.FileInfo, err error) error {
+		walked = append(walked, path)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/", "/hardlink"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("unexpected walk: got %v, want %v", walked, want)
+	}
+}
+
+func TestMemMetadata(t *testing.T) {
+	mem := NewMem()
+	defer mem.Close()
+
+	if err := mem.Mknod("/null", unix.S_IFCHR|0666, unix.Mkdev(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Lchown("/null", 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Chmod("/null", 0600|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	st, err := mem.Lstatx("/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != unix.S_IFCHR|unix.S_ISUID|0600 || st.Rdev != unix.Mkdev(1, 3) || st.Uid != 1000 || st.Gid != 1000 {
+		t.Errorf("unexpected device metadata: %#v", st)
+	}
+	if _, err := mem.Open("/null"); err == nil {
+		t.Errorf("expected opening a fake device to fail")
+	}
+
+	if err := mem.Lsetxattr("/null", "trusted.foo", []byte("bar"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Lsetxattr("/null", "trusted.foo", []byte("baz"), unix.XATTR_CREATE); !errors.Is(err, unix.EEXIST) {
+		t.Errorf("expected XATTR_CREATE of an existing xattr to fail with EEXIST: %v", err)
+	}
+	if err := mem.Lsetxattr("/null", "user.keep", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Lclearxattrs("/null", map[string]struct{}{"user.keep": {}}); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := mem.Llistxattr("/null"); err != nil || !reflect.DeepEqual(names, []string{"user.keep"}) {
+		t.Errorf("unexpected xattrs after clearing: %v (err=%v)", names, err)
+	}
+	if _, err := mem.Lgetxattr("/null", "trusted.foo"); !errors.Is(err, unix.ENODATA) {
+		t.Errorf("expected cleared xattr to be missing: %v", err)
+	}
+
+	if _, err := mem.Lopen("/null"); err == nil {
+		t.Errorf("expected Lopen to be unsupported")
+	}
+	if err := mem.MkdirAll(filepath.Join("/null", "dir"), 0755); !errors.Is(err, unix.ENOTDIR) {
+		t.Errorf("expected MkdirAll under a device to fail with ENOTDIR: %v", err)
+	}
+}
+
+func TestMemRename(t *testing.T) {
+	mem := NewMem()
+	defer mem.Close()
+
+	if err := mem.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.MkdirAll("/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := mem.Create("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	// Directories are moved along with their contents.
+	if err := mem.Rename("/a/b", "/c/d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Lstat("/a/b/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected old path to not exist: %v", err)
+	}
+	if _, err := mem.Lstat("/c/d/file"); err != nil {
+		t.Errorf("expected file to be moved: %v", err)
+	}
+
+	// Like rename(2), directories cannot replace non-directories (or vice
+	// versa), and cannot be moved inside themselves.
+	if err := mem.Rename("/a", "/c/d/file"); !errors.Is(err, unix.ENOTDIR) {
+		t.Errorf("expected rename of directory over file to fail with ENOTDIR: %v", err)
+	}
+	if err := mem.Rename("/c/d/file", "/a"); !errors.Is(err, unix.EISDIR) {
+		t.Errorf("expected rename of file over directory to fail with EISDIR: %v", err)
+	}
+	if err := mem.Rename("/c", "/c/d/e"); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("expected rename of directory inside itself to fail with EINVAL: %v", err)
+	}
+
+	// Empty directories are replaced.
+	if err := mem.Rename("/c/d", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Lstat("/a/file"); err != nil {
+		t.Errorf("expected directory to replace empty directory: %v", err)
+	}
+}
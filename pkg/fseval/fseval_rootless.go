@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/opencontainers/umoci/pkg/unpriv"
 	"github.com/vbatts/go-mtree"
 	"golang.org/x/sys/unix"
@@ -77,16 +78,59 @@ func (fs unprivFsEval) Link(target, linkname string) error {
 	return unpriv.Link(target, linkname)
 }
 
+// Rename is equivalent to unpriv.Rename.
+func (fs unprivFsEval) Rename(oldpath, newpath string) error {
+	return unpriv.Rename(oldpath, newpath)
+}
+
 // Chmod is equivalent to unpriv.Chmod.
 func (fs unprivFsEval) Chmod(path string, mode os.FileMode) error {
 	return unpriv.Chmod(path, mode)
 }
 
+// Lchown is equivalent to unpriv.Lchown.
+func (fs unprivFsEval) Lchown(path string, uid, gid int) error {
+	return unpriv.Lchown(path, uid, gid)
+}
+
 // Lutimes is equivalent to unpriv.Lutimes.
 func (fs unprivFsEval) Lutimes(path string, atime, mtime time.Time) error {
 	return unpriv.Lutimes(path, atime, mtime)
 }
 
+// Lbtime is equivalent to unpriv.Lbtime.
+func (fs unprivFsEval) Lbtime(path string) (time.Time, error) {
+	return unpriv.Lbtime(path)
+}
+
+// Lsetbtime is equivalent to unpriv.Lsetbtime.
+func (fs unprivFsEval) Lsetbtime(path string, btime time.Time) error {
+	return unpriv.Lsetbtime(path, btime)
+}
+
+// Lopen is equivalent to unpriv.Lopen.
+func (fs unprivFsEval) Lopen(path string) (*os.File, error) {
+	return unpriv.Lopen(path)
+}
+
+// Fchown is equivalent to system.Fchown. Once the inode has been pinned
+// with Lopen, no access to the path is required.
+func (fs unprivFsEval) Fchown(fh *os.File, uid, gid int) error {
+	return system.Fchown(fh, uid, gid)
+}
+
+// Fchmod is equivalent to system.Fchmod. Once the inode has been pinned
+// with Lopen, no access to the path is required.
+func (fs unprivFsEval) Fchmod(fh *os.File, mode os.FileMode) error {
+	return system.Fchmod(fh, mode)
+}
+
+// Futimes is equivalent to system.Futimes. Once the inode has been pinned
+// with Lopen, no access to the path is required.
+func (fs unprivFsEval) Futimes(fh *os.File, atime, mtime time.Time) error {
+	return system.Futimes(fh, atime, mtime)
+}
+
 // RemoveAll is equivalent to unpriv.RemoveAll.
 func (fs unprivFsEval) RemoveAll(path string) error {
 	return unpriv.RemoveAll(path)
@@ -102,3 +102,36 @@ func ParseMapping(spec string) (rspec.LinuxIDMapping, error) {
 		Size:        size,
 	}, nil
 }
+
+// Owner is a fixed (uid, gid) pair.
+type Owner struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// String returns the owner in the "uid:gid" form accepted by ParseOwner.
+func (o Owner) String() string {
+	return fmt.Sprintf("%d:%d", o.UID, o.GID)
+}
+
+// ParseOwner takes an owner string of the form "uid:gid" and returns the
+// corresponding Owner. An error is returned if the string does not have
+// exactly two fields or if either id is invalid.
+func ParseOwner(spec string) (Owner, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 {
+		return Owner{}, fmt.Errorf("invalid number of fields in owner %q: %d", spec, len(parts))
+	}
+
+	uid, err := parseUint32(parts[0])
+	if err != nil {
+		return Owner{}, fmt.Errorf("invalid uid in owner: %w", err)
+	}
+
+	gid, err := parseUint32(parts[1])
+	if err != nil {
+		return Owner{}, fmt.Errorf("invalid gid in owner: %w", err)
+	}
+
+	return Owner{UID: uid, GID: gid}, nil
+}
@@ -330,3 +330,41 @@ func TestParseIDMapping(t *testing.T) {
 		}
 	}
 }
+
+func TestParseOwner(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		uid, gid uint32
+		failure  bool
+	}{
+		{spec: "0:0", uid: 0, gid: 0},
+		{spec: "1000:100", uid: 1000, gid: 100},
+		{spec: "4294967295:1", uid: 4294967295, gid: 1},
+		{spec: "", failure: true},
+		{spec: "0", failure: true},
+		{spec: "0:0:1", failure: true},
+		{spec: ":0", failure: true},
+		{spec: "0:", failure: true},
+		{spec: "root:root", failure: true},
+		{spec: "-1:0", failure: true},
+		{spec: "4294967296:0", failure: true},
+	} {
+		owner, err := ParseOwner(test.spec)
+		if test.failure {
+			if err == nil {
+				t.Errorf("expected an error with spec %q -- got %+v", test.spec, owner)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %+v", test.spec, err)
+			continue
+		}
+		if owner.UID != test.uid || owner.GID != test.gid {
+			t.Errorf("%q: expected to get %d:%d, got %d:%d", test.spec, test.uid, test.gid, owner.UID, owner.GID)
+		}
+		if owner.String() != test.spec {
+			t.Errorf("%q: owner string does not round-trip: %q", test.spec, owner.String())
+		}
+	}
+}
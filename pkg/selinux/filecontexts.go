@@ -0,0 +1,231 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package selinux implements the lookup of default SELinux file labels from
+// the file_contexts configuration of an SELinux policy, in the same way as
+// matchpathcon(3) from libselinux. It does not require libselinux or for
+// SELinux to be enabled on the host.
+package selinux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// noContext is the context used in file_contexts to indicate that paths
+// matching the specification should not be labeled.
+const noContext = "<<none>>"
+
+// fileTypes maps the file type flags used in file_contexts to the
+// corresponding os.FileMode type bits (regular files have no type bits).
+var fileTypes = map[string]os.FileMode{
+	"--": 0,
+	"-d": os.ModeDir,
+	"-l": os.ModeSymlink,
+	"-p": os.ModeNamedPipe,
+	"-s": os.ModeSocket,
+	"-b": os.ModeDevice,
+	"-c": os.ModeDevice | os.ModeCharDevice,
+}
+
+// spec is a single file context specification.
+type spec struct {
+	// regex is the (anchored) path regular expression.
+	regex *regexp.Regexp
+
+	// exact indicates that the regular expression contains no
+	// meta-characters, and thus only matches a single path.
+	exact bool
+
+	// fileType is the os.FileMode type of files matched by the specification,
+	// if anyType is not set.
+	fileType os.FileMode
+	anyType  bool
+
+	// context is the label of matching paths (or noContext).
+	context string
+}
+
+// substitution is an alias for a path prefix, from file_contexts.subs.
+type substitution struct {
+	alias, target string
+}
+
+// FileContexts is a set of file context specifications, which map paths to
+// the default SELinux label for files at those paths. The zero value contains
+// no specifications (and thus labels nothing).
+type FileContexts struct {
+	specs []spec
+	subs  []substitution
+}
+
+// hasMetaChars returns whether the given file_contexts regular expression
+// contains any (unescaped) regular expression meta-characters.
+func hasMetaChars(regex string) bool {
+	for idx := 0; idx < len(regex); idx++ {
+		switch regex[idx] {
+		case '\\':
+			// The next character is escaped.
+			idx++
+		case '.', '^', '$', '?', '*', '+', '|', '[', '(', '{':
+			return true
+		}
+	}
+	return false
+}
+
+// AddSpecs parses file context specifications in the format of the
+// file_contexts file of an SELinux policy from r, and adds them to fc.
+// Specifications added later take precedence over earlier ones.
+func (fc *FileContexts) AddSpecs(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		s := spec{anyType: true}
+		switch len(fields) {
+		case 2:
+		case 3:
+			fileType, ok := fileTypes[fields[1]]
+			if !ok {
+				return fmt.Errorf("line %d: invalid file type %q", lineNo, fields[1])
+			}
+			s.fileType, s.anyType = fileType, false
+		default:
+			return fmt.Errorf("line %d: invalid specification %q", lineNo, line)
+		}
+
+		regex, err := regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return fmt.Errorf("line %d: invalid path regular expression: %w", lineNo, err)
+		}
+		s.regex = regex
+		s.exact = !hasMetaChars(fields[0])
+		s.context = fields[len(fields)-1]
+		fc.specs = append(fc.specs, s)
+	}
+	return scanner.Err()
+}
+
+// AddSubstitutions parses path substitutions in the format of the
+// file_contexts.subs file of an SELinux policy from r, and adds them to fc.
+// Each line contains an alias and the path it is equivalent to, and paths
+// under the alias are labeled as though they were under that path.
+// Substitutions added later take precedence over earlier ones.
+func (fc *FileContexts) AddSubstitutions(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: invalid substitution %q", lineNo, line)
+		}
+		fc.subs = append(fc.subs, substitution{
+			alias:  strings.TrimSuffix(fields[0], "/"),
+			target: strings.TrimSuffix(fields[1], "/"),
+		})
+	}
+	return scanner.Err()
+}
+
+// substitute applies the last matching path substitution to path.
+func (fc *FileContexts) substitute(path string) string {
+	for idx := len(fc.subs) - 1; idx >= 0; idx-- {
+		sub := fc.subs[idx]
+		if path == sub.alias || strings.HasPrefix(path, sub.alias+"/") {
+			return sub.target + strings.TrimPrefix(path, sub.alias)
+		}
+	}
+	return path
+}
+
+// Lookup returns the default label for a file of the given type (only the
+// type bits of mode are used) at the given absolute path. If no
+// specification matches the path, or the matching specification indicates
+// that the path should not be labeled, ok is false.
+//
+// As with matchpathcon(3), specifications which match a single path take
+// precedence over regular expressions, and otherwise the last matching
+// specification is used.
+func (fc *FileContexts) Lookup(path string, mode os.FileMode) (label string, ok bool) {
+	path = fc.substitute(path)
+	fileType := mode & os.ModeType
+	for _, exact := range []bool{true, false} {
+		for idx := len(fc.specs) - 1; idx >= 0; idx-- {
+			s := fc.specs[idx]
+			if s.exact != exact || (!s.anyType && s.fileType != fileType) {
+				continue
+			}
+			if s.regex.MatchString(path) {
+				if s.context == noContext {
+					return "", false
+				}
+				return s.context, true
+			}
+		}
+	}
+	return "", false
+}
+
+// LoadFileContexts loads the file_contexts configuration of the SELinux
+// policy in the given directory (such as /etc/selinux/targeted). The
+// file_contexts file must exist, while the local customisations
+// (file_contexts.homedirs, file_contexts.local) and path substitutions
+// (file_contexts.subs_dist, file_contexts.subs) are loaded if they exist.
+func LoadFileContexts(policyDir string) (*FileContexts, error) {
+	base := filepath.Join(policyDir, "contexts", "files", "file_contexts")
+
+	fc := new(FileContexts)
+	for _, file := range []struct {
+		path     string
+		optional bool
+		add      func(io.Reader) error
+	}{
+		{base, false, fc.AddSpecs},
+		{base + ".homedirs", true, fc.AddSpecs},
+		{base + ".local", true, fc.AddSpecs},
+		{base + ".subs_dist", true, fc.AddSubstitutions},
+		{base + ".subs", true, fc.AddSubstitutions},
+	} {
+		f, err := os.Open(file.path)
+		if err != nil {
+			if file.optional && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("load file contexts: %w", err)
+		}
+		err = file.add(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("load file contexts %s: %w", file.path, err)
+		}
+	}
+	return fc, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selinux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testFileContexts = `
+# Comments and blank lines are ignored.
+
+/.*			system_u:object_r:default_t:s0
+/etc(/.*)?		system_u:object_r:etc_t:s0
+/etc/shadow.*	--	system_u:object_r:shadow_t:s0
+/etc/shadow		system_u:object_r:shadow_exact_t:s0
+/usr/bin(/.*)?		system_u:object_r:bin_t:s0
+/usr/bin/.*	-l	system_u:object_r:bin_link_t:s0
+/dev/null	-c	system_u:object_r:null_device_t:s0
+/proc(/.*)?		<<none>>
+/a\+b			system_u:object_r:escaped_t:s0
+`
+
+func TestFileContextsLookup(t *testing.T) {
+	var fc FileContexts
+	if err := fc.AddSpecs(strings.NewReader(testFileContexts)); err != nil {
+		t.Fatalf("unexpected error parsing specs: %+v", err)
+	}
+	if err := fc.AddSubstitutions(strings.NewReader("/bin /usr/bin\n/usr/local/bin /usr/bin/\n")); err != nil {
+		t.Fatalf("unexpected error parsing substitutions: %+v", err)
+	}
+
+	for _, test := range []struct {
+		path  string
+		mode  os.FileMode
+		label string
+	}{
+		{"/", os.ModeDir, "system_u:object_r:default_t:s0"},
+		{"/etc", os.ModeDir, "system_u:object_r:etc_t:s0"},
+		{"/etc/passwd", 0, "system_u:object_r:etc_t:s0"},
+		// Later specifications take precedence, but only for matching types.
+		{"/etc/shadow-", 0, "system_u:object_r:shadow_t:s0"},
+		{"/etc/shadow-", os.ModeSymlink, "system_u:object_r:etc_t:s0"},
+		// Exact paths take precedence over regular expressions.
+		{"/etc/shadow", 0, "system_u:object_r:shadow_exact_t:s0"},
+		{"/etc/shadowy", os.ModeDir, "system_u:object_r:etc_t:s0"},
+		{"/usr/bin/sh", 0, "system_u:object_r:bin_t:s0"},
+		{"/usr/bin/sh", os.ModeSymlink, "system_u:object_r:bin_link_t:s0"},
+		{"/usr/binary", 0, "system_u:object_r:default_t:s0"},
+		{"/dev/null", os.ModeDevice | os.ModeCharDevice, "system_u:object_r:null_device_t:s0"},
+		{"/dev/null", os.ModeDevice, "system_u:object_r:default_t:s0"},
+		{"/a+b", 0, "system_u:object_r:escaped_t:s0"},
+		{"/aab", 0, "system_u:object_r:default_t:s0"},
+		// Substituted paths.
+		{"/bin/sh", 0, "system_u:object_r:bin_t:s0"},
+		{"/bin", os.ModeDir, "system_u:object_r:bin_t:s0"},
+		{"/binary", 0, "system_u:object_r:default_t:s0"},
+		{"/usr/local/bin/sh", 0, "system_u:object_r:bin_t:s0"},
+		// <<none>> paths are not labeled.
+		{"/proc/self", os.ModeDir, ""},
+	} {
+		label, ok := fc.Lookup(test.path, test.mode)
+		if ok != (test.label != "") || label != test.label {
+			t.Errorf("Lookup(%q, %v): expected %q got %q (ok=%v)", test.path, test.mode, test.label, label, ok)
+		}
+	}
+
+	// An empty set of file contexts labels nothing.
+	var empty FileContexts
+	if label, ok := empty.Lookup("/etc", os.ModeDir); ok {
+		t.Errorf("unexpected label from empty file contexts: %q", label)
+	}
+}
+
+func TestFileContextsInvalid(t *testing.T) {
+	for _, specs := range []string{
+		"/etc",
+		"/etc -d system_u:object_r:etc_t:s0 extra",
+		"/etc -x system_u:object_r:etc_t:s0",
+		"/etc(/.* system_u:object_r:etc_t:s0",
+	} {
+		var fc FileContexts
+		if err := fc.AddSpecs(strings.NewReader(specs)); err == nil {
+			t.Errorf("expected error parsing invalid specs %q", specs)
+		}
+	}
+	var fc FileContexts
+	if err := fc.AddSubstitutions(strings.NewReader("/bin")); err == nil {
+		t.Errorf("expected error parsing invalid substitution")
+	}
+}
+
+func TestLoadFileContexts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLoadFileContexts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadFileContexts(dir); err == nil {
+		t.Errorf("expected error loading policy without file_contexts")
+	}
+
+	filesDir := filepath.Join(dir, "contexts", "files")
+	if err := os.MkdirAll(filesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"file_contexts":           "/.* system_u:object_r:default_t:s0\n/etc(/.*)? system_u:object_r:etc_t:s0\n",
+		"file_contexts.local":     "/etc/local system_u:object_r:local_t:s0\n",
+		"file_contexts.subs_dist": "/opt/etc /etc\n/opt/local /etc\n",
+		"file_contexts.subs":      "/opt/local /etc/local\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(filesDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fc, err := LoadFileContexts(dir)
+	if err != nil {
+		t.Fatalf("unexpected error loading policy: %+v", err)
+	}
+	for path, expected := range map[string]string{
+		"/usr":           "system_u:object_r:default_t:s0",
+		"/etc/passwd":    "system_u:object_r:etc_t:s0",
+		"/etc/local":     "system_u:object_r:local_t:s0",
+		"/opt/etc/hosts": "system_u:object_r:etc_t:s0",
+		// file_contexts.subs takes precedence over file_contexts.subs_dist.
+		"/opt/local": "system_u:object_r:local_t:s0",
+	} {
+		if label, _ := fc.Lookup(path, 0); label != expected {
+			t.Errorf("Lookup(%q): expected %q got %q", path, expected, label)
+		}
+	}
+}
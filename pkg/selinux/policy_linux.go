@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selinux
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configDir is the directory containing the SELinux configuration and the
+// installed policies.
+const configDir = "/etc/selinux"
+
+// defaultPolicyType is the policy type used if the SELinux configuration does
+// not specify one.
+const defaultPolicyType = "targeted"
+
+// policyType returns the SELINUXTYPE configured in the SELinux configuration
+// file.
+func policyType() (string, error) {
+	f, err := os.Open(filepath.Join(configDir, "config"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	policy := defaultPolicyType
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if value := strings.TrimPrefix(line, "SELINUXTYPE="); value != line {
+			policy = strings.Trim(value, `"`)
+		}
+	}
+	return policy, scanner.Err()
+}
+
+// HostFileContexts loads the file_contexts configuration of the SELinux
+// policy configured on the host (as matchpathcon(3) would use). SELinux does
+// not need to be enabled, but the policy must be installed.
+func HostFileContexts() (*FileContexts, error) {
+	policy, err := policyType()
+	if err != nil {
+		return nil, fmt.Errorf("get host selinux policy: %w", err)
+	}
+	return LoadFileContexts(filepath.Join(configDir, policy))
+}
@@ -0,0 +1,37 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrBirthTimeUnsupported is returned by Lbtime and Lsetbtime when the birth
+// time of a file cannot be read or modified on this system.
+var ErrBirthTimeUnsupported = errors.New("file birth time is not supported")
+
+// Lsetbtime sets the birth (creation) time of the given path, without
+// following symlinks. No supported system currently provides an interface for
+// setting the birth time of a file, so this always returns
+// ErrBirthTimeUnsupported. Callers should treat this as a best-effort
+// operation.
+func Lsetbtime(path string, btime time.Time) error {
+	return &os.PathError{Op: "lsetbtime", Path: path, Err: ErrBirthTimeUnsupported}
+}
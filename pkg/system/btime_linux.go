@@ -0,0 +1,43 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lbtime returns the birth (creation) time of the given path, without
+// following symlinks. If the kernel or filesystem doesn't record birth times,
+// ErrBirthTimeUnsupported is returned.
+func Lbtime(path string) (time.Time, error) {
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx)
+	if err != nil {
+		if err == unix.ENOSYS {
+			err = ErrBirthTimeUnsupported
+		}
+		return time.Time{}, &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, &os.PathError{Op: "statx", Path: path, Err: ErrBirthTimeUnsupported}
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), nil
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"time"
+)
+
+// Lbtime is not supported on this platform, and always returns
+// ErrBirthTimeUnsupported.
+func Lbtime(path string) (time.Time, error) {
+	return time.Time{}, &os.PathError{Op: "lbtime", Path: path, Err: ErrBirthTimeUnsupported}
+}
@@ -27,9 +27,20 @@ import (
 // Copy has identical semantics to io.Copy except it will automatically resume
 // the copy after it receives an EINTR error.
 func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return CopyBuffer(dst, src, 0)
+}
+
+// CopyBuffer is identical to Copy except that a buffer of the given size is
+// used for the copy. If size is not positive, a default size is used and (as
+// with io.Copy) src's io.WriterTo or dst's io.ReaderFrom implementation may
+// be used instead of the buffer. Otherwise the buffer is always used, so that
+// the requested size actually takes effect.
+func CopyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	useBuffer := size > 0
+	if !useBuffer {
+		size = 32 * 1024
+	}
 	// Make a buffer so io.Copy doesn't make one for each iteration.
-	var buf []byte
-	size := 32 * 1024
 	if lr, ok := src.(*io.LimitedReader); ok && lr.N < int64(size) {
 		if lr.N < 1 {
 			size = 1
@@ -37,7 +48,13 @@ func Copy(dst io.Writer, src io.Reader) (int64, error) {
 			size = int(lr.N)
 		}
 	}
-	buf = make([]byte, size)
+	buf := make([]byte, size)
+	if useBuffer {
+		// Hide any io.WriterTo or io.ReaderFrom implementations, which would
+		// cause io.CopyBuffer to ignore our buffer.
+		src = struct{ io.Reader }{src}
+		dst = struct{ io.Writer }{dst}
+	}
 
 	var written int64
 	for {
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FadviseSequential advises the kernel that the given file will be accessed
+// sequentially (using posix_fadvise(2) with POSIX_FADV_SEQUENTIAL), which
+// usually results in more aggressive readahead. This is only a hint, and does
+// not affect the contents of the file.
+func FadviseSequential(fh *os.File) error {
+	if err := unix.Fadvise(int(fh.Fd()), 0, 0, unix.FADV_SEQUENTIAL); err != nil {
+		return &os.PathError{Op: "fadvise", Path: fh.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFadviseSequential(t *testing.T) {
+	fh, err := ioutil.TempFile("", "umoci-TestFadviseSequential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := fh.Write([]byte("some contents")); err != nil {
+		t.Fatal(err)
+	}
+	if err := FadviseSequential(fh); err != nil {
+		t.Errorf("unexpected error advising regular file: %v", err)
+	}
+}
+
+func TestFadviseSequentialPipe(t *testing.T) {
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	defer wr.Close()
+
+	// posix_fadvise(2) doesn't work on pipes.
+	err = FadviseSequential(rd)
+	if !errors.Is(err, unix.ESPIPE) {
+		t.Errorf("expected ESPIPE advising pipe, got %v", err)
+	}
+}
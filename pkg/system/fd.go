@@ -0,0 +1,28 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+)
+
+// ErrFdMetadataUnsupported is returned by OpenPath, Fchmod and Futimes when
+// metadata cannot be modified through file descriptors on this system (such
+// as when /proc is not mounted). Callers should fall back to the path-based
+// equivalents in this case.
+var ErrFdMetadataUnsupported = errors.New("fd-based metadata operations are not supported")
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenPath opens the given path with O_PATH|O_NOFOLLOW, returning a handle to
+// the inode at path (which may be a symlink). The handle cannot be used for
+// I/O, but it can be used with Fchown, Fchmod and Futimes to modify the
+// metadata of the inode without being affected by any later changes to path
+// (such as the path being swapped for a hardlink to another file).
+func OpenPath(path string) (*os.File, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+var (
+	procFdOnce      sync.Once
+	procFdAvailable bool
+)
+
+// procFdPath returns the /proc/self/fd path of the given handle. Operating on
+// this path operates on the inode referenced by the handle, which allows for
+// O_PATH handles to be used with syscalls that do not accept O_PATH file
+// descriptors (such as fchmod(2)). We make sure that /proc is actually procfs,
+// to avoid being tricked into operating on some other file.
+func procFdPath(fh *os.File) (string, error) {
+	procFdOnce.Do(func() {
+		var st unix.Statfs_t
+		if err := unix.Statfs("/proc/self/fd", &st); err == nil {
+			procFdAvailable = st.Type == unix.PROC_SUPER_MAGIC
+		}
+	})
+	if !procFdAvailable {
+		return "", ErrFdMetadataUnsupported
+	}
+	return "/proc/self/fd/" + strconv.Itoa(int(fh.Fd())), nil
+}
+
+// Fchown changes the owner of the inode referenced by the given handle
+// (without following symlinks), using fchownat(2) with AT_EMPTY_PATH.
+func Fchown(fh *os.File, uid, gid int) error {
+	if err := unix.Fchownat(int(fh.Fd()), "", uid, gid, unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "fchown", Path: fh.Name(), Err: err}
+	}
+	return nil
+}
+
+// Fchmod changes the mode of the inode referenced by the given handle, which
+// must not be a symlink.
+func Fchmod(fh *os.File, mode os.FileMode) error {
+	path, err := procFdPath(fh)
+	if err != nil {
+		return &os.PathError{Op: "fchmod", Path: fh.Name(), Err: err}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return &os.PathError{Op: "fchmod", Path: fh.Name(), Err: errors.Unwrap(err)}
+	}
+	return nil
+}
+
+// Futimes changes the access and modification times of the inode referenced
+// by the given handle, which must not be a symlink.
+func Futimes(fh *os.File, atime, mtime time.Time) error {
+	path, err := procFdPath(fh)
+	if err != nil {
+		return &os.PathError{Op: "futimes", Path: fh.Name(), Err: err}
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, 0); err != nil {
+		return &os.PathError{Op: "futimes", Path: fh.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFdMetadataSwappedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-system.TestFdMetadataSwappedPath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(path, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err := OpenPath(path)
+	if err != nil {
+		t.Fatalf("unexpected OpenPath error: %+v", err)
+	}
+	defer fh.Close()
+
+	// Replace the path with a hardlink to another file after it has been
+	// pinned. All of the metadata changes must apply to the original file.
+	var origStat unix.Stat_t
+	if err := unix.Lstat(path, &origStat); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(other, path); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1234567890, 0)
+	if err := Fchmod(fh, 0711); err != nil {
+		if errors.Is(err, ErrFdMetadataUnsupported) {
+			t.Skip("fd-based metadata operations are not supported")
+		}
+		t.Fatalf("unexpected Fchmod error: %+v", err)
+	}
+	if err := Futimes(fh, mtime, mtime); err != nil {
+		t.Fatalf("unexpected Futimes error: %+v", err)
+	}
+	if err := Fchown(fh, os.Geteuid(), os.Getegid()); err != nil {
+		t.Fatalf("unexpected Fchown error: %+v", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(fh.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Ino != origStat.Ino {
+		t.Fatalf("handle does not reference the original inode")
+	}
+	if st.Mode&0o7777 != 0711 {
+		t.Errorf("original file mode was not changed: %o", st.Mode&0o7777)
+	}
+	if got := time.Unix(st.Mtim.Unix()); !got.Equal(mtime) {
+		t.Errorf("original file mtime was not changed: %v", got)
+	}
+
+	fi, err := os.Stat(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("swapped-in file mode was modified: %o", fi.Mode().Perm())
+	}
+	if fi.ModTime().Equal(mtime) {
+		t.Errorf("swapped-in file mtime was modified")
+	}
+}
+
+func TestOpenPathSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-system.TestOpenPathSymlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "link")
+	if err := os.Symlink("/does/not/exist", path); err != nil {
+		t.Fatal(err)
+	}
+
+	// OpenPath must not follow the symlink.
+	fh, err := OpenPath(path)
+	if err != nil {
+		t.Fatalf("unexpected OpenPath error: %+v", err)
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("OpenPath followed symlink: mode %v", fi.Mode())
+	}
+	if err := Fchown(fh, os.Geteuid(), os.Getegid()); err != nil {
+		t.Errorf("unexpected Fchown error on symlink: %+v", err)
+	}
+}
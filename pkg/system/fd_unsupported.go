@@ -0,0 +1,50 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"time"
+)
+
+// OpenPath is not supported on this platform, and always returns
+// ErrFdMetadataUnsupported.
+func OpenPath(path string) (*os.File, error) {
+	return nil, &os.PathError{Op: "open", Path: path, Err: ErrFdMetadataUnsupported}
+}
+
+// Fchown is not supported on this platform, and always returns
+// ErrFdMetadataUnsupported.
+func Fchown(fh *os.File, uid, gid int) error {
+	return &os.PathError{Op: "fchown", Path: fh.Name(), Err: ErrFdMetadataUnsupported}
+}
+
+// Fchmod is not supported on this platform, and always returns
+// ErrFdMetadataUnsupported.
+func Fchmod(fh *os.File, mode os.FileMode) error {
+	return &os.PathError{Op: "fchmod", Path: fh.Name(), Err: ErrFdMetadataUnsupported}
+}
+
+// Futimes is not supported on this platform, and always returns
+// ErrFdMetadataUnsupported.
+func Futimes(fh *os.File, atime, mtime time.Time) error {
+	return &os.PathError{Op: "futimes", Path: fh.Name(), Err: ErrFdMetadataUnsupported}
+}
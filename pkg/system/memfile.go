@@ -0,0 +1,37 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"fmt"
+	"os"
+)
+
+// tempMemFile is the fallback for MemFile, and creates an unlinked temporary
+// file.
+func tempMemFile(name string) (*os.File, error) {
+	fh, err := os.CreateTemp("", "umoci-memfile-"+name+".")
+	if err != nil {
+		return nil, fmt.Errorf("create memfile %s: %w", name, err)
+	}
+	if err := os.Remove(fh.Name()); err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("unlink memfile %s: %w", name, err)
+	}
+	return fh, nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reflink replaces the contents of dst with a reflink of the contents of src
+// (using the FICLONE ioctl), so that the two files share their extents until
+// one of them is modified. dst must be open for writing.
+func Reflink(dst, src *os.File) error {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) ||
+			errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+			err = fmt.Errorf("%w: %v", ErrReflinkUnsupported, err)
+		}
+		return &os.PathError{Op: "ficlone", Path: dst.Name(), Err: err}
+	}
+	return nil
+}
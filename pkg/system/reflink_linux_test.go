@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReflink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestReflink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(srcPath, []byte("some contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := Reflink(dst, src); err != nil {
+		// Most filesystems don't support reflinks, but the error must be
+		// recognisable so callers can fall back to copying.
+		if !errors.Is(err, ErrReflinkUnsupported) {
+			t.Fatalf("unexpected reflink error: %v", err)
+		}
+		t.Skipf("reflinks not supported: %v", err)
+	}
+
+	// Modifying the reflink must not affect the source.
+	if _, err := dst.WriteAt([]byte("other"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		srcPath:    "some contents",
+		dst.Name(): "other contents",
+	} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("unexpected contents of %s: expected %q got %q", path, expected, string(data))
+		}
+	}
+}
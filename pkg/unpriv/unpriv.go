@@ -148,6 +148,23 @@ func Open(path string) (*os.File, error) {
 	return fh, nil
 }
 
+// Lopen is a wrapper around system.OpenPath which has been wrapped with
+// unpriv.Wrap to make it possible to get a handle to a path even if you do not
+// currently have the required access bits to resolve the path. Since the
+// handle is opened with O_PATH, no access to the path itself is required.
+func Lopen(path string) (*os.File, error) {
+	var fh *os.File
+	err := Wrap(path, func(path string) error {
+		var err error
+		fh, err = system.OpenPath(path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unpriv.lopen: %w", err)
+	}
+	return fh, nil
+}
+
 // Create is a wrapper around os.Create which has been wrapped with unpriv.Wrap
 // to make it possible to create paths even if you do not currently have read
 // permission. Note that the returned file handle references a path that you do
@@ -296,6 +313,30 @@ func Link(target, linkname string) error {
 	return nil
 }
 
+// Rename is a wrapper around unix.Renameat which has been wrapped with
+// unpriv.Wrap to make it possible to rename a path even if you do not
+// currently have the required access bits to resolve either the old or new
+// path. Note that you may not have resolve access after this function returns
+// because all of the trickery is reverted by unpriv.Wrap.
+func Rename(oldpath, newpath string) error {
+	err := Wrap(newpath, func(newpath string) error {
+		// We have to double-wrap this, because you need write access to the
+		// parents of both paths. This is safe because any common ancestors
+		// will be reverted in reverse call stack order.
+		err := Wrap(oldpath, func(oldpath string) error {
+			return unix.Renameat(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath)
+		})
+		if err != nil {
+			return fmt.Errorf("unpriv.wrap oldpath: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unpriv.rename: %w", err)
+	}
+	return nil
+}
+
 // Chmod is a wrapper around os.Chmod which has been wrapped with unpriv.Wrap
 // to make it possible to change the permission bits of a path even if you do
 // not currently have the required access bits to access the path.
@@ -307,6 +348,17 @@ func Chmod(path string, mode os.FileMode) error {
 	return nil
 }
 
+// Lchown is a wrapper around os.Lchown which has been wrapped with unpriv.Wrap
+// to make it possible to change the owner of a path even if you do not
+// currently have the required access bits to resolve the path.
+func Lchown(path string, uid, gid int) error {
+	err := Wrap(path, func(path string) error { return os.Lchown(path, uid, gid) })
+	if err != nil {
+		return fmt.Errorf("unpriv.lchown: %w", err)
+	}
+	return nil
+}
+
 // Chtimes is a wrapper around os.Chtimes which has been wrapped with
 // unpriv.Wrap to make it possible to change the modified times of a path even
 // if you do not currently have the required access bits to access the path.
@@ -329,6 +381,33 @@ func Lutimes(path string, atime, mtime time.Time) error {
 	return nil
 }
 
+// Lbtime is a wrapper around system.Lbtime which has been wrapped with
+// unpriv.Wrap to make it possible to get the birth time of a path even if you
+// do not currently have the required access bits to resolve the path.
+func Lbtime(path string) (time.Time, error) {
+	var btime time.Time
+	err := Wrap(path, func(path string) error {
+		var err error
+		btime, err = system.Lbtime(path)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unpriv.lbtime: %w", err)
+	}
+	return btime, nil
+}
+
+// Lsetbtime is a wrapper around system.Lsetbtime which has been wrapped with
+// unpriv.Wrap to make it possible to change the birth time of a path even if
+// you do not currently have the required access bits to access the path.
+func Lsetbtime(path string, btime time.Time) error {
+	err := Wrap(path, func(path string) error { return system.Lsetbtime(path, btime) })
+	if err != nil {
+		return fmt.Errorf("unpriv.lsetbtime: %w", err)
+	}
+	return nil
+}
+
 // Remove is a wrapper around os.Remove which has been wrapped with unpriv.Wrap
 // to make it possible to remove a path even if you do not currently have the
 // required access bits to modify or resolve the path.
@@ -833,6 +833,120 @@ func TestLink(t *testing.T) {
 	}
 }
 
+func TestRename(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("unpriv.* tests only work with non-root privileges")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-unpriv.TestRename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveAll(dir)
+
+	fileContent := []byte("some content")
+
+	// Create some structure.
+	if err := os.MkdirAll(filepath.Join(dir, "some", "parent", "directories"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "other", "parent"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "parent", "directories", "file"), fileContent, 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "some", "parent", "directories", "file"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(dir, "some", "parent", "directories"),
+		filepath.Join(dir, "some", "parent"),
+		filepath.Join(dir, "some"),
+		filepath.Join(dir, "other", "parent"),
+		filepath.Join(dir, "other"),
+	} {
+		if err := os.Chmod(path, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fi, err := Lstat(filepath.Join(dir, "some", "parent", "directories", "file"))
+	if err != nil {
+		t.Fatalf("unexpected unpriv.lstat error: %s", err)
+	}
+
+	// Rename within the same directory, and then across directories.
+	if err := Rename(filepath.Join(dir, "some", "parent", "directories", "file"), filepath.Join(dir, "some", "parent", "directories", "file2")); err != nil {
+		t.Errorf("unexpected unpriv.rename error: %s", err)
+	}
+	if err := Rename(filepath.Join(dir, "some", "parent", "directories", "file2"), filepath.Join(dir, "other", "parent", "file3")); err != nil {
+		t.Errorf("unexpected unpriv.rename error: %s", err)
+	}
+
+	// The old paths must be gone.
+	for _, path := range []string{
+		filepath.Join(dir, "some", "parent", "directories", "file"),
+		filepath.Join(dir, "some", "parent", "directories", "file2"),
+	} {
+		if _, err := Lstat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected unpriv.lstat of old path %s to give ENOENT -- got %v", path, err)
+		}
+	}
+
+	// Check the contents.
+	fh, err := Open(filepath.Join(dir, "other", "parent", "file3"))
+	if err != nil {
+		t.Fatalf("unexpected unpriv.open error: %s", err)
+	}
+	defer fh.Close()
+	gotContent, err := ioutil.ReadAll(fh)
+	if err != nil {
+		t.Errorf("unexpected error reading from unpriv.open: %s", err)
+	}
+	if !bytes.Equal(gotContent, fileContent) {
+		t.Errorf("unpriv.open content doesn't match actual content: expected=%s got=%s", fileContent, gotContent)
+	}
+
+	// Check that it is the same file, and it was unchanged.
+	fi1, err := Lstat(filepath.Join(dir, "other", "parent", "file3"))
+	if err != nil {
+		t.Fatalf("unexpected unpriv.lstat error: %s", err)
+	}
+	if !os.SameFile(fi, fi1) {
+		t.Errorf("renamed and original file not the same!")
+	}
+	if fi1.Mode()&os.ModePerm != 0 {
+		t.Errorf("unexpected modeperm for path %s: %o", fi1.Name(), fi1.Mode()&os.ModePerm)
+	}
+
+	// Check that the parents were unchanged.
+	for _, path := range []string{
+		filepath.Join(dir, "some", "parent", "directories"),
+		filepath.Join(dir, "some", "parent"),
+		filepath.Join(dir, "some"),
+		filepath.Join(dir, "other", "parent"),
+		filepath.Join(dir, "other"),
+	} {
+		fi, err := Lstat(path)
+		if err != nil {
+			t.Errorf("unexpected unpriv.lstat error: %s", err)
+			continue
+		}
+		if fi.Mode()&os.ModePerm != 0 {
+			t.Errorf("unexpected modeperm for path %s: %o", fi.Name(), fi.Mode()&os.ModePerm)
+		}
+	}
+
+	// Make sure that os.Lstat still fails.
+	_, err = os.Lstat(filepath.Join(dir, "other", "parent", "file3"))
+	if err == nil {
+		t.Errorf("expected os.Lstat to give EPERM -- got no error!")
+	} else if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected os.Lstat to give EPERM -- got %s", err)
+	}
+}
+
 func TestChtimes(t *testing.T) {
 	if os.Geteuid() == 0 {
 		t.Skip("unpriv.* tests only work with non-root privileges")
@@ -0,0 +1,63 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// Recompress rewrites every layer of the image being modified by mutator so
+// that it is compressed with the given compressor. The uncompressed contents
+// of each layer (and thus the DiffIDs in the image configuration) are left
+// unchanged, only the layer descriptors in the manifest are updated. The
+// caller is responsible for committing the changes made to the mutator.
+func Recompress(ctx context.Context, engineExt casext.Engine, mutator *mutate.Mutator, compressor mutate.Compressor) error {
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+
+	for idx, desc := range manifest.Layers {
+		if err := func() error {
+			layerRdr, err := layer.OpenLayer(ctx, engineExt, desc)
+			if err != nil {
+				return fmt.Errorf("open layer: %w", err)
+			}
+			defer layerRdr.Close()
+
+			newDesc, err := mutator.Recompress(ctx, idx, layerRdr, compressor)
+			if err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{
+				"old": desc.Digest,
+				"new": newDesc.Digest,
+			}).Infof("recompressed layer %d as %s", idx, newDesc.MediaType)
+			return nil
+		}(); err != nil {
+			return fmt.Errorf("recompress layer %d: %w", idx, err)
+		}
+	}
+	return nil
+}
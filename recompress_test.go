@@ -0,0 +1,195 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// imageManifestConfig returns the manifest and configuration of the image
+// tagged with tagName.
+func imageManifestConfig(t *testing.T, engineExt casext.Engine, tagName string) (ispec.Manifest, ispec.Image) {
+	ctx := context.Background()
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, config
+}
+
+func TestRecompress(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestRecompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][]string{
+		{"etc/", "etc/passwd"},
+		{"usr/", "usr/bin/", "usr/bin/sh"},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range names {
+			hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name))}
+			if strings.HasSuffix(name, "/") {
+				hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write([]byte(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, nil, mutate.GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	oldManifest, oldConfig := imageManifestConfig(t, engineExt, "latest")
+
+	mutator, err = mutate.New(engineExt, newDescriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Recompress(ctx, engineExt, mutator, mutate.ZstdCompressor); err != nil {
+		t.Fatalf("unexpected recompress error: %+v", err)
+	}
+	newDescriptorPath, err = mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "recompressed", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	newManifest, newConfig := imageManifestConfig(t, engineExt, "recompressed")
+
+	if !reflect.DeepEqual(oldConfig.RootFS.DiffIDs, newConfig.RootFS.DiffIDs) {
+		t.Errorf("recompress changed diffids: %v != %v", oldConfig.RootFS.DiffIDs, newConfig.RootFS.DiffIDs)
+	}
+	if newManifest.Config.Digest != oldManifest.Config.Digest {
+		t.Errorf("recompress changed config: %s != %s", oldManifest.Config.Digest, newManifest.Config.Digest)
+	}
+	if len(newManifest.Layers) != len(oldManifest.Layers) {
+		t.Fatalf("recompress changed number of layers: %d != %d", len(oldManifest.Layers), len(newManifest.Layers))
+	}
+	for idx, newDesc := range newManifest.Layers {
+		oldDesc := oldManifest.Layers[idx]
+		if oldDesc.MediaType != ispec.MediaTypeImageLayerGzip {
+			t.Errorf("layer %d: unexpected original media-type %q", idx, oldDesc.MediaType)
+		}
+		if newDesc.MediaType != ispec.MediaTypeImageLayer+"+zstd" {
+			t.Errorf("layer %d: unexpected recompressed media-type %q", idx, newDesc.MediaType)
+		}
+		if newDesc.Digest == oldDesc.Digest {
+			t.Errorf("layer %d: recompress did not change layer digest %s", idx, newDesc.Digest)
+		}
+		if got := newDesc.Annotations[mutate.UmociCompressionAnnotation]; !strings.HasPrefix(got, "zstd;") {
+			t.Errorf("layer %d: unexpected compression annotation %q", idx, got)
+		}
+		if got, want := newDesc.Annotations[mutate.UmociUncompressedBlobSizeAnnotation], oldDesc.Annotations[mutate.UmociUncompressedBlobSizeAnnotation]; got != want {
+			t.Errorf("layer %d: uncompressed size annotation changed: %q != %q", idx, want, got)
+		}
+
+		// The layer contents must be unchanged.
+		var oldNames, newNames []string
+		for _, walk := range []struct {
+			desc  ispec.Descriptor
+			names *[]string
+		}{
+			{oldDesc, &oldNames},
+			{newDesc, &newNames},
+		} {
+			names := walk.names
+			if err := layer.WalkLayer(ctx, engineExt, walk.desc, func(hdr *tar.Header, _ io.Reader) error {
+				*names = append(*names, hdr.Name)
+				return nil
+			}); err != nil {
+				t.Fatalf("layer %d: unexpected error walking layer: %+v", idx, err)
+			}
+		}
+		if !reflect.DeepEqual(oldNames, newNames) {
+			t.Errorf("layer %d: recompress changed layer contents: %v != %v", idx, oldNames, newNames)
+		}
+	}
+}
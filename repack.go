@@ -18,13 +18,18 @@
 package umoci
 
 import (
+	"archive/tar"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
@@ -34,9 +39,107 @@ import (
 	"github.com/vbatts/go-mtree"
 )
 
+// UmociChangedFilesAnnotation is an umoci-specific annotation set on the
+// descriptors of layers generated by Repack, containing the number of entries
+// (including whiteouts) written to the layer. This allows tooling to reason
+// about the composition of a layer without decompressing it.
+const UmociChangedFilesAnnotation = "ci.umo.changed_files"
+
+// UmociForcedOwnerAnnotation is an umoci-specific annotation set on the
+// descriptors of layers generated by Repack with layer.RepackOptions.ForceOwner
+// set, containing the "uid:gid" that every entry in the layer was forced to.
+// The ownership of the files in such layers does not reflect the ownership of
+// the files in the bundle.
+const UmociForcedOwnerAnnotation = "ci.umo.forced_owner"
+
 // Repack repacks a bundle into an image adding a new layer for the changed
-// data in the bundle.
+// data in the bundle. It is equivalent to RepackWithOptions with nil
+// repackOptions.
 func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator) error {
+	return RepackWithOptions(engineExt, tagName, bundlePath, meta, history, filters, refreshBundle, mutator, nil)
+}
+
+// RepackWithOptions is like Repack, but allows for the layer generation to be
+// configured with repackOptions (which may be nil). The MapOptions and
+// whiteout translation used to generate the layer are always taken from meta,
+// overriding any set in repackOptions. If repackOptions doesn't specify an
+// EntryOrder, the entry order recorded in meta (if any) is used.
+func RepackWithOptions(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator, repackOptions *layer.RepackOptions) error {
+	newDescriptorPath, err := repackBundle(context.Background(), engineExt, bundlePath, meta, history, filters, mutator, repackOptions)
+	if err != nil {
+		return err
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return fmt.Errorf("add new tag: %w", err)
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+
+	if refreshBundle {
+		var concurrency int
+		if repackOptions != nil {
+			concurrency = repackOptions.MtreeConcurrency
+		}
+		if err := refreshBundleMeta(bundlePath, meta, newDescriptorPath, concurrency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RepackManifest repacks the bundle at bundlePath into a new image manifest
+// based on the image the bundle was unpacked from, adding a new layer for the
+// changed data in the bundle (with config.Volumes masked). No tags are
+// modified -- the descriptor path of the new manifest is returned instead --
+// but the bundle metadata is refreshed to refer to the new manifest so that
+// subsequent repacks only include newer changes. history may be nil, in
+// which case no history entry is added. opt may also be nil, and as with
+// Repack its MapOptions and whiteout translation are taken from the bundle.
+func RepackManifest(ctx context.Context, engineExt casext.Engine, bundlePath string, history *ispec.History, opt *layer.RepackOptions) (casext.DescriptorPath, error) {
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return casext.DescriptorPath{}, fmt.Errorf("read umoci.json metadata: %w", err)
+	}
+	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
+		return casext.DescriptorPath{}, fmt.Errorf("invalid saved from descriptor: descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType)
+	}
+
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		return casext.DescriptorPath{}, fmt.Errorf("create mutator for base image: %w", err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		return casext.DescriptorPath{}, fmt.Errorf("get config: %w", err)
+	}
+	var maskedPaths []string
+	for v := range config.Config.Volumes {
+		maskedPaths = append(maskedPaths, v)
+	}
+	filters := []mtreefilter.FilterFunc{
+		mtreefilter.MaskFilter(maskedPaths),
+	}
+
+	newDescriptorPath, err := repackBundle(ctx, engineExt, bundlePath, meta, history, filters, mutator, opt)
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
+
+	var concurrency int
+	if opt != nil {
+		concurrency = opt.MtreeConcurrency
+	}
+	if err := refreshBundleMeta(bundlePath, meta, newDescriptorPath, concurrency); err != nil {
+		return casext.DescriptorPath{}, err
+	}
+	return newDescriptorPath, nil
+}
+
+// repackBundle generates a new layer from the changes in the bundle relative
+// to the mtree manifest for meta.From, adds it to the image with mutator and
+// commits the result (returning the new manifest's descriptor path).
+func repackBundle(ctx context.Context, engineExt casext.Engine, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, mutator *mutate.Mutator, repackOptions *layer.RepackOptions) (casext.DescriptorPath, error) {
 	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
@@ -47,15 +150,24 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 		"mtree":  mtreePath,
 	}).Debugf("umoci: repacking OCI image")
 
+	if repackOptions != nil && repackOptions.VerifyBaseline {
+		if err := verifyBaseline(bundlePath, meta); err != nil {
+			return casext.DescriptorPath{}, err
+		}
+	}
+	if repackOptions != nil && repackOptions.RecordDiffID {
+		mutator.SetRecordDiffIDs(true)
+	}
+
 	mfh, err := os.Open(mtreePath)
 	if err != nil {
-		return fmt.Errorf("open mtree: %w", err)
+		return casext.DescriptorPath{}, fmt.Errorf("open mtree: %w", err)
 	}
 	defer mfh.Close()
 
 	spec, err := mtree.ParseSpec(mfh)
 	if err != nil {
-		return fmt.Errorf("parse mtree: %w", err)
+		return casext.DescriptorPath{}, fmt.Errorf("parse mtree: %w", err)
 	}
 
 	log.WithFields(log.Fields{
@@ -67,10 +179,15 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 		fsEval = fseval.Rootless
 	}
 
+	var concurrency int
+	if repackOptions != nil {
+		concurrency = repackOptions.MtreeConcurrency
+	}
+
 	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+	diffs, err := checkParallel(fullRootfsPath, spec, MtreeKeywords, fsEval, concurrency)
 	if err != nil {
-		return fmt.Errorf("check mtree: %w", err)
+		return casext.DescriptorPath{}, fmt.Errorf("check mtree: %w", err)
 	}
 	log.Info("... done")
 
@@ -82,68 +199,228 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 	diffs = mtreefilter.FilterDeltas(diffs, allFilters...)
 
 	if len(diffs) == 0 {
-		config, err := mutator.Config(context.Background())
+		config, err := mutator.Config(ctx)
 		if err != nil {
-			return err
+			return casext.DescriptorPath{}, err
 		}
 
-		imageMeta, err := mutator.Meta(context.Background())
+		imageMeta, err := mutator.Meta(ctx)
 		if err != nil {
-			return err
+			return casext.DescriptorPath{}, err
 		}
 
-		annotations, err := mutator.Annotations(context.Background())
+		annotations, err := mutator.Annotations(ctx)
 		if err != nil {
-			return err
+			return casext.DescriptorPath{}, err
 		}
 
-		err = mutator.Set(context.Background(), config.Config, imageMeta, annotations, history)
+		err = mutator.Set(ctx, config.Config, imageMeta, annotations, history)
 		if err != nil {
-			return err
+			return casext.DescriptorPath{}, err
 		}
 	} else {
-		packOptions := layer.RepackOptions{MapOptions: meta.MapOptions}
+		var packOptions layer.RepackOptions
+		if repackOptions != nil {
+			packOptions = *repackOptions
+		}
+		packOptions.MapOptions = meta.MapOptions
+		packOptions.TranslateOverlayWhiteouts = false
 		if meta.WhiteoutMode == layer.OverlayFSWhiteout {
 			packOptions.TranslateOverlayWhiteouts = true
 		}
-		reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &packOptions)
-		if err != nil {
-			return fmt.Errorf("generate diff layer: %w", err)
+		if packOptions.EntryOrder == nil {
+			for _, layerOrder := range meta.EntryOrder {
+				packOptions.EntryOrder = append(packOptions.EntryOrder, layerOrder.Entries...)
+			}
+		}
+
+		// Identical deltas produce identical layers, so we can skip
+		// generating (and compressing) the layer if we already have it.
+		var (
+			cacheKey digest.Digest
+			cached   bool
+		)
+		if packOptions.CacheLayer && !packOptions.RecordBirthTime {
+			cacheKey, err = layerCacheKey(meta, diffs, packOptions)
+			if err != nil {
+				return casext.DescriptorPath{}, err
+			}
+			if cache, ok := readLayerCache(ctx, engineExt, bundlePath, cacheKey); ok {
+				log.Infof("reusing cached layer %s", cache.Descriptor.Digest)
+				if err := mutator.AddExisting(ctx, cache.Descriptor, history, cache.DiffID); err != nil {
+					return casext.DescriptorPath{}, fmt.Errorf("add cached diff layer: %w", err)
+				}
+				cached = true
+			}
 		}
-		defer reader.Close()
 
-		// TODO: We should add a flag to allow for a new layer to be made
-		//       non-distributable.
-		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, mutate.GzipCompressor, nil); err != nil {
-			return fmt.Errorf("add diff layer: %w", err)
+		if !cached {
+			layerDesc, err := addDiffLayer(ctx, engineExt, fullRootfsPath, meta, diffs, history, mutator, &packOptions)
+			if err != nil {
+				return casext.DescriptorPath{}, err
+			}
+			if cacheKey != "" {
+				config, err := mutator.Config(ctx)
+				if err != nil {
+					return casext.DescriptorPath{}, err
+				}
+				diffIDs := config.RootFS.DiffIDs
+				if err := writeLayerCache(bundlePath, layerCache{
+					Key:        cacheKey,
+					Descriptor: layerDesc,
+					DiffID:     diffIDs[len(diffIDs)-1],
+				}); err != nil {
+					return casext.DescriptorPath{}, err
+				}
+			}
 		}
 	}
 
-	newDescriptorPath, err := mutator.Commit(context.Background())
+	newDescriptorPath, err := mutator.Commit(ctx)
 	if err != nil {
-		return fmt.Errorf("commit mutated image: %w", err)
+		return casext.DescriptorPath{}, fmt.Errorf("commit mutated image: %w", err)
 	}
 
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+	return newDescriptorPath, nil
+}
 
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return fmt.Errorf("add new tag: %w", err)
+// addDiffLayer generates a layer from the given deltas of the bundle's root
+// filesystem and adds it to the image with mutator.
+func addDiffLayer(ctx context.Context, engineExt casext.Engine, fullRootfsPath string, meta Meta, diffs []mtree.InodeDelta, history *ispec.History, mutator *mutate.Mutator, packOptions *layer.RepackOptions) (ispec.Descriptor, error) {
+	// The number of entries (and the file manifest) can only be known once
+	// the layer has been generated, so they are recorded as each entry is
+	// written and the layer descriptor is annotated after it has been added.
+	genOptions := *packOptions
+	files := layer.FileManifest{}
+	changedFiles := 0
+	onEntry := genOptions.OnEntry
+	genOptions.OnEntry = func(hdr *tar.Header) {
+		changedFiles++
+		if genOptions.RecordFileManifest {
+			files.Add(hdr)
+		}
+		if onEntry != nil {
+			onEntry(hdr)
+		}
 	}
 
-	log.Infof("created new tag for image manifest: %s", tagName)
+	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &genOptions)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("generate diff layer: %w", err)
+	}
+	defer reader.Close()
 
-	if refreshBundle {
-		newMtreeName := strings.Replace(newDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
-		if err := GenerateBundleManifest(newMtreeName, bundlePath, fsEval); err != nil {
-			return fmt.Errorf("write mtree metadata: %w", err)
-		}
-		if err := os.Remove(mtreePath); err != nil {
-			return fmt.Errorf("remove old mtree metadata: %w", err)
+	var annotations map[string]string
+	if genOptions.ForceOwner != nil {
+		annotations = map[string]string{}
+		annotations[UmociForcedOwnerAnnotation] = genOptions.ForceOwner.String()
+	}
+
+	compressor := mutate.GzipCompressor
+	if meta.Compression != "" {
+		compressor, err = mutate.CompressorFromAnnotation(meta.Compression)
+		if err != nil {
+			return ispec.Descriptor{}, fmt.Errorf("get compressor for bundle: %w", err)
 		}
-		meta.From = newDescriptorPath
-		if err := WriteBundleMeta(bundlePath, meta); err != nil {
-			return fmt.Errorf("write umoci.json metadata: %w", err)
+	}
+
+	mediaType := ispec.MediaTypeImageLayer
+	if genOptions.LayerMediaType != "" {
+		mediaType = genOptions.LayerMediaType
+	}
+	if _, err := mutator.Add(ctx, mediaType, reader, history, compressor, annotations); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("add diff layer: %w", err)
+	}
+
+	// The layer has been fully generated, so the entry count and file
+	// manifest are complete.
+	layerAnnotations := map[string]string{
+		UmociChangedFilesAnnotation: strconv.Itoa(changedFiles),
+	}
+	if genOptions.RecordFileManifest {
+		files.Sort()
+		filesDigest, _, err := engineExt.PutBlobJSON(ctx, files)
+		if err != nil {
+			return ispec.Descriptor{}, fmt.Errorf("put file manifest blob: %w", err)
 		}
+		layerAnnotations[mutate.UmociFileManifestAnnotation] = filesDigest.String()
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	index := len(manifest.Layers) - 1
+	if err := mutator.SetLayerAnnotations(ctx, index, layerAnnotations); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("annotate diff layer: %w", err)
+	}
+	if manifest, err = mutator.Manifest(ctx); err != nil {
+		return ispec.Descriptor{}, err
+	}
+	return manifest.Layers[index], nil
+}
+
+// LayerFileManifest returns the FileManifest recorded for the layer with the
+// given descriptor (see layer.RepackOptions.RecordFileManifest), which allows
+// the contents of the layer to be listed without decompressing it. An error
+// is returned if the layer has no recorded file manifest.
+func LayerFileManifest(ctx context.Context, engineExt casext.Engine, desc ispec.Descriptor) (layer.FileManifest, error) {
+	value, ok := desc.Annotations[mutate.UmociFileManifestAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("layer %s has no recorded file manifest", desc.Digest)
+	}
+	filesDigest, err := digest.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("parse file manifest digest: %w", err)
+	}
+
+	blob, err := engineExt.GetBlob(ctx, filesDigest)
+	if err != nil {
+		return nil, fmt.Errorf("get file manifest blob: %w", err)
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("read file manifest blob: %w", err)
+	}
+	if got := filesDigest.Algorithm().FromBytes(data); got != filesDigest {
+		return nil, fmt.Errorf("file manifest blob digest mismatch: expected %s got %s", filesDigest, got)
+	}
+
+	var files layer.FileManifest
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("parse file manifest: %w", err)
+	}
+	return files, nil
+}
+
+// refreshBundleMeta replaces the bundle's mtree manifest and umoci.json
+// metadata so that they refer to newDescriptorPath rather than meta.From.
+func refreshBundleMeta(bundlePath string, meta Meta, newDescriptorPath casext.DescriptorPath, concurrency int) error {
+	// If nothing was changed, the existing metadata is already correct.
+	if newDescriptorPath.Descriptor().Digest == meta.From.Descriptor().Digest {
+		return nil
+	}
+
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+
+	fsEval := fseval.Default
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	newMtreeName := strings.Replace(newDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
+	if err := GenerateBundleManifestParallel(newMtreeName, bundlePath, fsEval, concurrency); err != nil {
+		return fmt.Errorf("write mtree metadata: %w", err)
+	}
+	if err := os.Remove(mtreePath); err != nil {
+		return fmt.Errorf("remove old mtree metadata: %w", err)
+	}
+	meta.From = newDescriptorPath
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return fmt.Errorf("write umoci.json metadata: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vbatts/go-mtree"
+)
+
+// verifyBaseline checks that the mtree manifest of the bundle (the baseline
+// against which changes to the rootfs are computed) is present and matches
+// what umoci generated when the image described by meta was unpacked. If the
+// baseline has been removed or replaced, repacking would silently produce a
+// layer which doesn't reflect the changes made to the bundle.
+func verifyBaseline(bundlePath string, meta Meta) error {
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+
+	fh, err := os.Open(mtreePath)
+	if errors.Is(err, os.ErrNotExist) {
+		// If there are other baselines, umoci.json is referring to the wrong
+		// image rather than the baseline having been deleted.
+		others, _ := filepath.Glob(filepath.Join(bundlePath, "*.mtree"))
+		for idx, other := range others {
+			others[idx] = filepath.Base(other)
+		}
+		if len(others) > 0 {
+			return fmt.Errorf("verify baseline: no baseline for %s (referenced by %s) but bundle contains %s", meta.From.Descriptor().Digest, MetaName, strings.Join(others, ", "))
+		}
+		return fmt.Errorf("verify baseline: baseline %s of %s is missing (was the bundle modified outside of umoci?)", filepath.Base(mtreePath), meta.From.Descriptor().Digest)
+	}
+	if err != nil {
+		return fmt.Errorf("verify baseline: open mtree: %w", err)
+	}
+	defer fh.Close()
+
+	spec, err := mtree.ParseSpec(fh)
+	if err != nil {
+		return fmt.Errorf("verify baseline: parse mtree: %w", err)
+	}
+
+	// umoci records the keywords used in the header of the manifest. If they
+	// don't match MtreeKeywords, some changes would not be detected.
+	var keywords []string
+	hasRoot := false
+	for _, entry := range spec.Entries {
+		switch entry.Type {
+		case mtree.CommentType:
+			if idx := strings.Index(entry.Raw, "keywords:"); idx >= 0 && keywords == nil {
+				for _, keyword := range strings.Split(entry.Raw[idx+len("keywords:"):], ",") {
+					keywords = append(keywords, strings.TrimSpace(keyword))
+				}
+			}
+		case mtree.RelativeType, mtree.FullType:
+			if entry.Parent == nil && entry.Name == "." {
+				hasRoot = true
+			}
+		}
+	}
+	if keywords == nil {
+		return fmt.Errorf("verify baseline: %s was not generated by umoci (no keywords recorded)", filepath.Base(mtreePath))
+	}
+	var expected []string
+	for _, keyword := range MtreeKeywords {
+		expected = append(expected, string(keyword))
+	}
+	sort.Strings(keywords)
+	sort.Strings(expected)
+	if strings.Join(keywords, ",") != strings.Join(expected, ",") {
+		return fmt.Errorf("verify baseline: %s uses keywords %v rather than %v", filepath.Base(mtreePath), keywords, expected)
+	}
+	if !hasRoot {
+		return fmt.Errorf("verify baseline: %s has no entry for the root of the rootfs", filepath.Base(mtreePath))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/vbatts/go-mtree"
+)
+
+// LayerCacheName is the name of the file in a bundle where umoci.Repack
+// remembers the last layer it generated, if layer.RepackOptions.CacheLayer is
+// set.
+const LayerCacheName = "umoci-layer-cache.json"
+
+// layerCache is the format of LayerCacheName.
+type layerCache struct {
+	// Key is the hash of the filesystem delta (and other inputs) which was
+	// used to generate the layer.
+	Key digest.Digest `json:"key"`
+
+	// Descriptor is the descriptor of the generated (compressed) layer.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// DiffID is the DiffID of the generated layer.
+	DiffID digest.Digest `json:"diff_id"`
+}
+
+// layerCacheKey computes the cache key for a layer generated from the given
+// set of deltas. All of the inputs which affect the generated layer blob are
+// included, so two repacks with the same key will produce identical layers.
+func layerCacheKey(meta Meta, diffs []mtree.InodeDelta, packOptions layer.RepackOptions) (digest.Digest, error) {
+	type cacheDelta struct {
+		Type mtree.DifferenceType `json:"type"`
+		Path string               `json:"path"`
+		Keys []string             `json:"keys,omitempty"`
+	}
+	input := struct {
+		From                      digest.Digest    `json:"from"`
+		Compression               string           `json:"compression"`
+		MapOptions                layer.MapOptions `json:"map_options"`
+		TranslateOverlayWhiteouts bool             `json:"translate_overlay_whiteouts"`
+		ForceOwner                *idtools.Owner   `json:"force_owner,omitempty"`
+		EntryOrder                []string         `json:"entry_order,omitempty"`
+		FileManifest              bool             `json:"file_manifest,omitempty"`
+		LayerMediaType            string           `json:"layer_media_type,omitempty"`
+		DiffID                    bool             `json:"diff_id,omitempty"`
+		Deltas                    []cacheDelta     `json:"deltas"`
+	}{
+		From:                      meta.From.Descriptor().Digest,
+		Compression:               meta.Compression,
+		MapOptions:                packOptions.MapOptions,
+		TranslateOverlayWhiteouts: packOptions.TranslateOverlayWhiteouts,
+		ForceOwner:                packOptions.ForceOwner,
+		EntryOrder:                packOptions.EntryOrder,
+		FileManifest:              packOptions.RecordFileManifest,
+		LayerMediaType:            packOptions.LayerMediaType,
+		DiffID:                    packOptions.RecordDiffID,
+	}
+	for _, diff := range diffs {
+		delta := cacheDelta{Type: diff.Type(), Path: diff.Path()}
+		if entry := diff.New(); entry != nil {
+			for _, kv := range entry.AllKeys() {
+				delta.Keys = append(delta.Keys, string(kv))
+			}
+			sort.Strings(delta.Keys)
+		}
+		input.Deltas = append(input.Deltas, delta)
+	}
+	// The order of the deltas returned by mtree is not stable.
+	sort.Slice(input.Deltas, func(i, j int) bool {
+		if input.Deltas[i].Path != input.Deltas[j].Path {
+			return input.Deltas[i].Path < input.Deltas[j].Path
+		}
+		return input.Deltas[i].Type < input.Deltas[j].Type
+	})
+
+	digester := cas.BlobAlgorithm.Digester()
+	if err := json.NewEncoder(digester.Hash()).Encode(input); err != nil {
+		return "", fmt.Errorf("hash layer cache key: %w", err)
+	}
+	return digester.Digest(), nil
+}
+
+// readLayerCache returns the cached layer for the bundle if it matches key and
+// its blob still exists in the image. Any problems with the cache are treated
+// as a cache miss.
+func readLayerCache(ctx context.Context, engineExt casext.Engine, bundlePath string, key digest.Digest) (layerCache, bool) {
+	var cache layerCache
+
+	data, err := ioutil.ReadFile(filepath.Join(bundlePath, LayerCacheName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("ignoring unreadable layer cache: %v", err)
+		}
+		return cache, false
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Warnf("ignoring invalid layer cache: %v", err)
+		return cache, false
+	}
+	if cache.Key != key {
+		log.Debugf("layer cache miss: cached key %s != %s", cache.Key, key)
+		return cache, false
+	}
+	if exists, err := engineExt.StatBlob(ctx, cache.Descriptor.Digest); err != nil || !exists {
+		log.Debugf("layer cache miss: cached blob %s no longer exists", cache.Descriptor.Digest)
+		return cache, false
+	}
+	if value, ok := cache.Descriptor.Annotations[mutate.UmociFileManifestAnnotation]; ok {
+		if exists, err := engineExt.StatBlob(ctx, digest.Digest(value)); err != nil || !exists {
+			log.Debugf("layer cache miss: cached file manifest blob %s no longer exists", value)
+			return cache, false
+		}
+	}
+	return cache, true
+}
+
+// writeLayerCache records the layer generated for key in the bundle.
+func writeLayerCache(bundlePath string, cache layerCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("encode layer cache: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundlePath, LayerCacheName), data, 0644); err != nil {
+		return fmt.Errorf("write layer cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,1029 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+)
+
+// lastLayerEntries returns the (cleaned) names of the entries in the top-most
+// layer of the image tagged with tagName.
+func lastLayerEntries(t *testing.T, engineExt casext.Engine, tagName string) []string {
+	ctx := context.Background()
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, tagName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptorPaths[0].Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		t.Fatalf("unexpected manifest blob type: %T", manifestBlob.Data)
+	}
+	if len(manifest.Layers) == 0 {
+		t.Fatalf("image has no layers")
+	}
+
+	var names []string
+	if err := layer.WalkLayer(ctx, engineExt, manifest.Layers[len(manifest.Layers)-1], func(hdr *tar.Header, _ io.Reader) error {
+		names = append(names, strings.TrimPrefix(layer.CleanPath("/"+hdr.Name), "/"))
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error walking layer: %+v", err)
+	}
+	return names
+}
+
+func TestRepackEntryOrder(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestRepackEntryOrder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	// A layer whose entries are deliberately not sorted by path.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "zzz", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "mmm/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "aaa", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "mmm/file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "bbb", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, nil, mutate.GzipCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	originalOrder := lastLayerEntries(t, engineExt, "latest")
+
+	for _, test := range []struct {
+		name        string
+		recordOrder bool
+	}{
+		{"Sorted", false},
+		{"RecordEntryOrder", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle := filepath.Join(dir, "bundle-"+test.name)
+			// Map root to the current user.
+			unpackOptions := layer.UnpackOptions{
+				MapOptions: layer.MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				RecordEntryOrder: test.recordOrder,
+			}
+			if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+				t.Fatalf("unexpected unpack error: %+v", err)
+			}
+
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.recordOrder {
+				if meta.EntryOrder != nil {
+					t.Errorf("entry order recorded without RecordEntryOrder: %+v", meta.EntryOrder)
+				}
+			} else {
+				if len(meta.EntryOrder) != 1 {
+					t.Fatalf("expected entry order for 1 layer, got %d: %+v", len(meta.EntryOrder), meta.EntryOrder)
+				}
+				var recorded []string
+				for _, name := range meta.EntryOrder[0].Entries {
+					recorded = append(recorded, strings.TrimPrefix(layer.CleanPath("/"+name), "/"))
+				}
+				if !reflect.DeepEqual(recorded, originalOrder) {
+					t.Errorf("unexpected recorded entry order: expected %v got %v", originalOrder, recorded)
+				}
+			}
+
+			// Modify every entry, so that all of them end up in the new layer.
+			rootfs := filepath.Join(bundle, layer.RootfsName)
+			for _, name := range originalOrder {
+				path := filepath.Join(rootfs, name)
+				fi, err := os.Lstat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.IsDir() {
+					err = os.Chmod(path, 0711)
+				} else {
+					err = ioutil.WriteFile(path, []byte("modified "+name), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mutator, err := mutate.New(engineExt, meta.From)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tagName := "repacked-" + strings.ToLower(test.name)
+			if err := Repack(engineExt, tagName, bundle, meta, nil, nil, false, mutator); err != nil {
+				t.Fatalf("unexpected repack error: %+v", err)
+			}
+
+			expected := append([]string{}, originalOrder...)
+			if !test.recordOrder {
+				sort.Strings(expected)
+			}
+			if got := lastLayerEntries(t, engineExt, tagName); !reflect.DeepEqual(got, expected) {
+				t.Errorf("unexpected repacked entry order: expected %v got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestUnpackRepackManifest(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackRepackManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+	baseDescriptorPath := descriptorPaths[0]
+
+	// Map root to the current user.
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	if err := UnpackManifest(ctx, engineExt, baseDescriptorPath, bundle, &unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "hello"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	history := &ispec.History{CreatedBy: "TestUnpackRepackManifest"}
+	newDescriptorPath, err := RepackManifest(ctx, engineExt, bundle, history, nil)
+	if err != nil {
+		t.Fatalf("unexpected repack error: %+v", err)
+	}
+	if newDescriptorPath.Descriptor().Digest == baseDescriptorPath.Descriptor().Digest {
+		t.Errorf("repack did not create a new manifest: %s", newDescriptorPath.Descriptor().Digest)
+	}
+
+	// No tags should have been touched.
+	descriptorPaths, err = engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != baseDescriptorPath.Descriptor().Digest {
+		t.Errorf("repack modified tag: %+v", descriptorPaths)
+	}
+
+	// The bundle should now refer to the new manifest.
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.From.Descriptor().Digest != newDescriptorPath.Descriptor().Digest {
+		t.Errorf("bundle metadata not refreshed: expected %s got %s", newDescriptorPath.Descriptor().Digest, meta.From.Descriptor().Digest)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, newDescriptorPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		t.Fatalf("unexpected manifest blob type: %T", manifestBlob.Data)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected 1 layer in repacked image, got %d", len(manifest.Layers))
+	}
+	_, config := imageManifestConfig(t, engineExt, "latest")
+	if len(config.History) != 0 {
+		t.Errorf("base image history modified: %+v", config.History)
+	}
+
+	// Unpacking the new manifest must give us back the modified rootfs.
+	newBundle := filepath.Join(dir, "bundle-new")
+	if err := UnpackManifest(ctx, engineExt, newDescriptorPath, newBundle, &unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(newBundle, layer.RootfsName, "hello"))
+	if err != nil {
+		t.Fatalf("repacked file missing from new bundle: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("unexpected repacked file contents: %q", data)
+	}
+
+	// A second repack with no changes must not add a layer.
+	emptyDescriptorPath, err := RepackManifest(ctx, engineExt, newBundle, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected repack error: %+v", err)
+	}
+	if emptyDescriptorPath.Descriptor().Digest != newDescriptorPath.Descriptor().Digest {
+		t.Errorf("repack with no changes created a different manifest: expected %s got %s", newDescriptorPath.Descriptor().Digest, emptyDescriptorPath.Descriptor().Digest)
+	}
+}
+
+// putRecordingEngine is a cas.Engine which records the digest of every blob
+// written with PutBlob.
+type putRecordingEngine struct {
+	cas.Engine
+	put []digest.Digest
+}
+
+func (e *putRecordingEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	blobDigest, size, err := e.Engine.PutBlob(ctx, reader)
+	if err == nil {
+		e.put = append(e.put, blobDigest)
+	}
+	return blobDigest, size, err
+}
+
+func TestRepackCacheLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackCacheLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map root to the current user.
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// repack repacks the bundle to the given tag, and returns the digest of
+	// the new layer along with every blob written during the repack.
+	repack := func(tagName string) (digest.Digest, []digest.Digest) {
+		recorder := &putRecordingEngine{Engine: engineExt.Engine}
+		recorderExt := casext.NewEngine(recorder)
+
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(recorderExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RepackWithOptions(recorderExt, tagName, bundle, meta, nil, nil, false, mutator, &layer.RepackOptions{CacheLayer: true}); err != nil {
+			t.Fatalf("unexpected repack error: %+v", err)
+		}
+
+		manifest, _ := imageManifestConfig(t, engineExt, tagName)
+		if len(manifest.Layers) != 1 {
+			t.Fatalf("expected 1 layer in repacked image, got %d", len(manifest.Layers))
+		}
+		return manifest.Layers[0].Digest, recorder.put
+	}
+
+	contains := func(digests []digest.Digest, needle digest.Digest) bool {
+		for _, d := range digests {
+			if d == needle {
+				return true
+			}
+		}
+		return false
+	}
+
+	firstLayer, firstPut := repack("first")
+	if !contains(firstPut, firstLayer) {
+		t.Errorf("first repack did not write layer blob %s: %v", firstLayer, firstPut)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, LayerCacheName)); err != nil {
+		t.Fatalf("layer cache not written: %v", err)
+	}
+
+	// Repacking the same tree must reuse the layer without generating it.
+	secondLayer, secondPut := repack("second")
+	if secondLayer != firstLayer {
+		t.Errorf("unchanged repack produced a different layer: expected %s got %s", firstLayer, secondLayer)
+	}
+	if contains(secondPut, secondLayer) {
+		t.Errorf("unchanged repack regenerated the cached layer %s", secondLayer)
+	}
+	_, config := imageManifestConfig(t, engineExt, "second")
+	_, firstConfig := imageManifestConfig(t, engineExt, "first")
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, firstConfig.RootFS.DiffIDs) {
+		t.Errorf("cached layer has wrong diffids: expected %v got %v", firstConfig.RootFS.DiffIDs, config.RootFS.DiffIDs)
+	}
+
+	// Any change to the tree must invalidate the cache.
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("other content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	thirdLayer, thirdPut := repack("third")
+	if thirdLayer == firstLayer {
+		t.Errorf("modified repack reused the stale cached layer %s", thirdLayer)
+	}
+	if !contains(thirdPut, thirdLayer) {
+		t.Errorf("modified repack did not write layer blob %s: %v", thirdLayer, thirdPut)
+	}
+}
+
+func TestRepackVerifyBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackVerifyBaseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map root to the current user.
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreePath := filepath.Join(bundle, mtreeName+".mtree")
+
+	repack := func() error {
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return RepackWithOptions(engineExt, "repacked", bundle, meta, nil, nil, false, mutator, &layer.RepackOptions{VerifyBaseline: true})
+	}
+
+	// An untouched baseline is fine.
+	if err := repack(); err != nil {
+		t.Fatalf("unexpected repack error with valid baseline: %+v", err)
+	}
+
+	// A deleted baseline must be reported clearly.
+	baseline, err := ioutil.ReadFile(mtreePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(mtreePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := repack(); err == nil {
+		t.Errorf("expected repack to fail with a missing baseline")
+	} else if !strings.Contains(err.Error(), "verify baseline") || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("unclear error for a missing baseline: %v", err)
+	}
+
+	// A baseline generated with different keywords is also rejected.
+	modified := strings.Replace(string(baseline), "keywords: size,", "keywords: ", 1)
+	if modified == string(baseline) {
+		t.Fatalf("baseline has no keywords header: %q", baseline)
+	}
+	if err := ioutil.WriteFile(mtreePath, []byte(modified), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repack(); err == nil {
+		t.Errorf("expected repack to fail with a baseline using different keywords")
+	} else if !strings.Contains(err.Error(), "verify baseline") {
+		t.Errorf("unclear error for a baseline with different keywords: %v", err)
+	}
+}
+
+func TestRepackFileManifest(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestRepackFileManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map root to the current user.
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc", "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, contents := range map[string]string{
+		"zzz":                 "last",
+		"etc/passwd":          "root:x:0:0::/root:/bin/sh\n",
+		"etc/conf.d/settings": "",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, path), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// checkFileManifest repacks the bundle to the given tag and checks that
+	// the recorded file manifest of the new layer matches its contents.
+	checkFileManifest := func(tagName string) layer.FileManifest {
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RepackWithOptions(engineExt, tagName, bundle, meta, nil, nil, true, mutator, &layer.RepackOptions{RecordFileManifest: true}); err != nil {
+			t.Fatalf("unexpected repack error: %+v", err)
+		}
+
+		manifest, _ := imageManifestConfig(t, engineExt, tagName)
+		layerDesc := manifest.Layers[len(manifest.Layers)-1]
+		if _, ok := layerDesc.Annotations[mutate.UmociFileManifestAnnotation]; !ok {
+			t.Fatalf("repacked layer is missing %s annotation: %v", mutate.UmociFileManifestAnnotation, layerDesc.Annotations)
+		}
+		files, err := LayerFileManifest(ctx, engineExt, layerDesc)
+		if err != nil {
+			t.Fatalf("unexpected error getting file manifest: %+v", err)
+		}
+
+		expected := layer.FileManifest{}
+		if err := layer.WalkLayer(ctx, engineExt, layerDesc, func(hdr *tar.Header, _ io.Reader) error {
+			expected.Add(hdr)
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error walking layer: %+v", err)
+		}
+		expected.Sort()
+		if !reflect.DeepEqual(files, expected) {
+			t.Errorf("file manifest doesn't match layer contents: expected %v got %v", expected, files)
+		}
+		if !sort.SliceIsSorted(files, func(i, j int) bool { return files[i].Path < files[j].Path }) {
+			t.Errorf("file manifest is not sorted: %v", files)
+		}
+		return files
+	}
+
+	files := checkFileManifest("first")
+	found := false
+	for _, entry := range files {
+		if entry.Path == "etc/passwd" {
+			found = true
+			if entry.Size != int64(len("root:x:0:0::/root:/bin/sh\n")) {
+				t.Errorf("unexpected size for etc/passwd in file manifest: %d", entry.Size)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("etc/passwd missing from file manifest: %v", files)
+	}
+
+	// Whiteouts are included in the file manifest.
+	if err := os.Remove(filepath.Join(rootfs, "zzz")); err != nil {
+		t.Fatal(err)
+	}
+	files = checkFileManifest("second")
+	if len(files) != 1 || files[0].Path != ".wh.zzz" {
+		t.Errorf("unexpected file manifest for whiteout layer: %v", files)
+	}
+
+	// The file manifest blobs must survive garbage collection.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("unexpected gc error: %+v", err)
+	}
+	manifest, _ := imageManifestConfig(t, engineExt, "second")
+	for idx, layerDesc := range manifest.Layers {
+		if _, err := LayerFileManifest(ctx, engineExt, layerDesc); err != nil {
+			t.Errorf("file manifest of layer %d missing after gc: %v", idx, err)
+		}
+	}
+}
+
+func TestRepackForceOwner(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestRepackForceOwner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// As root we use the identity mapping so that files can be given
+	// arbitrary owners, otherwise map root to the current user.
+	bundle := filepath.Join(dir, "bundle")
+	var unpackOptions layer.UnpackOptions
+	if os.Geteuid() != 0 {
+		unpackOptions.MapOptions = layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: true,
+		}
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"etc/passwd", "etc/group", "old"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("passwd", filepath.Join(rootfs, "etc", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// repack repacks the bundle to the given tag and checks that every entry
+	// in the new layer is owned by the forced owner.
+	repack := func(tagName string, forceOwner idtools.Owner) []*tar.Header {
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RepackWithOptions(engineExt, tagName, bundle, meta, nil, nil, true, mutator, &layer.RepackOptions{ForceOwner: &forceOwner}); err != nil {
+			t.Fatalf("unexpected repack error: %+v", err)
+		}
+
+		manifest, _ := imageManifestConfig(t, engineExt, tagName)
+		layerDesc := manifest.Layers[len(manifest.Layers)-1]
+		if value := layerDesc.Annotations[UmociForcedOwnerAnnotation]; value != forceOwner.String() {
+			t.Errorf("layer has unexpected %s annotation: expected %q got %q", UmociForcedOwnerAnnotation, forceOwner, value)
+		}
+		var hdrs []*tar.Header
+		if err := layer.WalkLayer(ctx, engineExt, layerDesc, func(hdr *tar.Header, _ io.Reader) error {
+			hdrs = append(hdrs, hdr)
+			if hdr.Uid != int(forceOwner.UID) || hdr.Gid != int(forceOwner.GID) || hdr.Uname != "" || hdr.Gname != "" {
+				t.Errorf("entry %s has unexpected owner %d:%d (%q:%q) (expected forced owner %s)", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname, forceOwner)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error walking layer: %+v", err)
+		}
+		if len(hdrs) == 0 {
+			t.Fatalf("repacked layer has no entries")
+		}
+		return hdrs
+	}
+
+	// The files are owned by root, but the layer must not be.
+	repack("nonroot", idtools.Owner{UID: 1000, GID: 100})
+
+	// Give the files a different owner (if we can) and force them back to
+	// root, including the whiteout for a removed file.
+	if err := os.Remove(filepath.Join(rootfs, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "new"), []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		for _, path := range []string{"etc", "etc/passwd", "new"} {
+			if err := os.Lchown(filepath.Join(rootfs, path), 1234, 1234); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hdrs := repack("root", idtools.Owner{UID: 0, GID: 0})
+	sawWhiteout := false
+	for _, hdr := range hdrs {
+		if filepath.Base(hdr.Name) == ".wh.old" {
+			sawWhiteout = true
+		}
+	}
+	if !sawWhiteout {
+		t.Errorf("repacked layer is missing whiteout for removed file")
+	}
+}
+
+func TestRepackLayerMediaType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackLayerMediaType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const customMediaType = "application/vnd.example.layer.v1.tar"
+	for _, test := range []struct {
+		name, compression, mediaType, expected string
+	}{
+		{"Default", "", "", ispec.MediaTypeImageLayerGzip},
+		{"Gzip", "", customMediaType, customMediaType + "+gzip"},
+		{"Zstd", "zstd", customMediaType, customMediaType + "+zstd"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta.Compression = test.compression
+			mutator, err := mutate.New(engineExt, meta.From)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Don't refresh the bundle, so that every subtest repacks the
+			// same change.
+			if err := RepackWithOptions(engineExt, test.name, bundle, meta, nil, nil, false, mutator, &layer.RepackOptions{LayerMediaType: test.mediaType}); err != nil {
+				t.Fatalf("unexpected repack error: %+v", err)
+			}
+
+			manifest, _ := imageManifestConfig(t, engineExt, test.name)
+			if len(manifest.Layers) == 0 {
+				t.Fatalf("repacked image has no layers")
+			}
+			if got := manifest.Layers[len(manifest.Layers)-1].MediaType; got != test.expected {
+				t.Errorf("unexpected layer media-type: expected %q got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRepackDiffIDAnnotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackDiffIDAnnotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		options    layer.RepackOptions
+		annotation bool
+	}{
+		{"Default", layer.RepackOptions{}, false},
+		{"RecordDiffID", layer.RepackOptions{RecordDiffID: true}, true},
+		// The second repack reuses the cached layer.
+		{"CachedFirst", layer.RepackOptions{RecordDiffID: true, CacheLayer: true}, true},
+		{"CachedSecond", layer.RepackOptions{RecordDiffID: true, CacheLayer: true}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutator, err := mutate.New(engineExt, meta.From)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Don't refresh the bundle, so that every subtest repacks the
+			// same change.
+			if err := RepackWithOptions(engineExt, test.name, bundle, meta, nil, nil, false, mutator, &test.options); err != nil {
+				t.Fatalf("unexpected repack error: %+v", err)
+			}
+
+			manifest, config := imageManifestConfig(t, engineExt, test.name)
+			if len(manifest.Layers) == 0 || len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+				t.Fatalf("unexpected number of layers: %d layers and %d diffids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+			}
+			last := len(manifest.Layers) - 1
+			value, ok := manifest.Layers[last].Annotations[mutate.UmociDiffIDAnnotation]
+			if ok != test.annotation {
+				t.Fatalf("unexpected presence of %s annotation: expected %v got %v", mutate.UmociDiffIDAnnotation, test.annotation, ok)
+			}
+			if ok && value != config.RootFS.DiffIDs[last].String() {
+				t.Errorf("%s annotation doesn't match the config: expected %s got %s", mutate.UmociDiffIDAnnotation, config.RootFS.DiffIDs[last], value)
+			}
+		})
+	}
+}
+
+func TestRepackChangedFilesAnnotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRepackChangedFilesAnnotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		change func() error
+	}{
+		{"Add", func() error {
+			if err := os.MkdirAll(filepath.Join(rootfs, "dir", "sub"), 0755); err != nil {
+				return err
+			}
+			for _, path := range []string{"file", "dir/a", "dir/sub/b", "dir/sub/c"} {
+				if err := ioutil.WriteFile(filepath.Join(rootfs, path), []byte(path), 0644); err != nil {
+					return err
+				}
+			}
+			return os.Link(filepath.Join(rootfs, "file"), filepath.Join(rootfs, "link"))
+		}},
+		// Removing a directory generates a single whiteout for the directory
+		// and none for its contents.
+		{"Remove", func() error {
+			if err := os.RemoveAll(filepath.Join(rootfs, "dir")); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("changed"), 0644)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.change(); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutator, err := mutate.New(engineExt, meta.From)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Repack(engineExt, test.name, bundle, meta, nil, nil, true, mutator); err != nil {
+				t.Fatalf("unexpected repack error: %+v", err)
+			}
+
+			manifest, _ := imageManifestConfig(t, engineExt, test.name)
+			value, ok := manifest.Layers[len(manifest.Layers)-1].Annotations[UmociChangedFilesAnnotation]
+			if !ok {
+				t.Fatalf("layer is missing %s annotation", UmociChangedFilesAnnotation)
+			}
+			entries := lastLayerEntries(t, engineExt, test.name)
+			if value != strconv.Itoa(len(entries)) {
+				t.Errorf("%s annotation doesn't match the layer: expected %d got %s (entries %v)", UmociChangedFilesAnnotation, len(entries), value, entries)
+			}
+		})
+	}
+}
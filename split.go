@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// SplitLayer splits the layer at the given index of the image being modified
+// by mutator into several layers, based on the given path prefixes (see
+// layer.SplitByPath for how entries are assigned). Any whiteouts are placed
+// in the first new layer, followed by a layer containing the entries not
+// under any prefix, and then one layer for each prefix (in the order given).
+// Empty layers are omitted. If compressor is nil, the new layers are
+// compressed in the same way as the original layer. The caller is
+// responsible for committing the changes made to the mutator.
+func SplitLayer(ctx context.Context, engineExt casext.Engine, mutator *mutate.Mutator, index int, prefixes []string, compressor mutate.Compressor) error {
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+	if index < 0 || index >= len(manifest.Layers) {
+		return fmt.Errorf("layer index %d out of range", index)
+	}
+	desc := manifest.Layers[index]
+
+	if compressor == nil {
+		compressor, err = layerCompressor(desc)
+		if err != nil {
+			return fmt.Errorf("get compressor for layer: %w", err)
+		}
+	}
+
+	// Spool each changeset to a temporary file, since we need to read the
+	// whole original layer before any of them are complete.
+	files := make([]*os.File, len(prefixes)+2)
+	writers := make([]io.Writer, len(files))
+	for idx := range files {
+		fh, err := ioutil.TempFile("", "umoci-split-layer.")
+		if err != nil {
+			return fmt.Errorf("create temporary changeset: %w", err)
+		}
+		defer os.Remove(fh.Name())
+		defer fh.Close()
+		files[idx], writers[idx] = fh, fh
+	}
+
+	counts, err := func() ([]int, error) {
+		layerRdr, err := layer.OpenLayer(ctx, engineExt, desc)
+		if err != nil {
+			return nil, fmt.Errorf("open layer: %w", err)
+		}
+		defer layerRdr.Close()
+		return layer.SplitByPath(layerRdr, prefixes, writers)
+	}()
+	if err != nil {
+		return fmt.Errorf("split layer %d: %w", index, err)
+	}
+
+	var readers []io.Reader
+	for idx, fh := range files {
+		if counts[idx] == 0 {
+			continue
+		}
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewind temporary changeset: %w", err)
+		}
+		readers = append(readers, fh)
+	}
+	if len(readers) < 2 {
+		log.Warnf("split-layer: all entries of layer %d are in a single changeset", index)
+	}
+
+	newDescs, err := mutator.SplitLayer(ctx, index, readers, compressor)
+	if err != nil {
+		return fmt.Errorf("split layer %d: %w", index, err)
+	}
+	for idx, newDesc := range newDescs {
+		log.WithFields(log.Fields{
+			"old": desc.Digest,
+			"new": newDesc.Digest,
+		}).Infof("split layer %d into layer %d", index, index+idx)
+	}
+	return nil
+}
+
+// layerCompressor returns a compressor matching the compression used for the
+// given layer descriptor, preferring the exact settings recorded in the
+// mutate.UmociCompressionAnnotation (if present).
+func layerCompressor(desc ispec.Descriptor) (mutate.Compressor, error) {
+	if value, ok := desc.Annotations[mutate.UmociCompressionAnnotation]; ok {
+		return mutate.CompressorFromAnnotation(value)
+	}
+	switch {
+	case strings.HasSuffix(desc.MediaType, "+gzip"):
+		return mutate.GzipCompressor, nil
+	case strings.HasSuffix(desc.MediaType, "+zstd"):
+		if _, ok := desc.Annotations[mutate.ZstdChunkedManifestPositionAnnotation]; ok {
+			return mutate.ZstdChunkedCompressor, nil
+		}
+		return mutate.ZstdCompressor, nil
+	case strings.HasSuffix(desc.MediaType, "+lz4"):
+		return mutate.LZ4Compressor, nil
+	}
+	return mutate.NoopCompressor, nil
+}
@@ -0,0 +1,244 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// rootfsContents returns a description of every path in the rootfs of the
+// given bundle (its type, mode and contents).
+func rootfsContents(t *testing.T, bundle string) map[string]string {
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	contents := make(map[string]string)
+	if err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		desc := info.Mode().String()
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += " " + string(data)
+		}
+		contents[rel] = desc
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestSplitLayer(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestSplitLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hdrs := range [][]*tar.Header{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/gone", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/old", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700},
+			{Name: "etc/.wh.gone", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "usr/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "usrlocal", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "opt/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "opt/sh", Typeflag: tar.TypeLink, Linkname: "usr/bin/sh"},
+			{Name: "opt/passwd", Typeflag: tar.TypeSymlink, Linkname: "../etc/passwd"},
+		},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			var data []byte
+			if hdr.Typeflag == tar.TypeReg && !strings.Contains(hdr.Name, ".wh.") {
+				data = []byte(hdr.Name)
+			}
+			hdr.Size = int64(len(data))
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, &ispec.History{CreatedBy: "test"}, mutate.GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	oldDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", oldDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	_, oldConfig := imageManifestConfig(t, engineExt, "latest")
+
+	mutator, err = mutate.New(engineExt, oldDescriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SplitLayer(ctx, engineExt, mutator, 1, []string{"/usr", "etc/"}, nil); err != nil {
+		t.Fatalf("unexpected split-layer error: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "split", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	newManifest, newConfig := imageManifestConfig(t, engineExt, "split")
+
+	// The whiteouts, the remaining entries, /usr and /etc.
+	if len(newManifest.Layers) != 5 {
+		t.Fatalf("unexpected number of layers after split: %d", len(newManifest.Layers))
+	}
+	if len(newConfig.RootFS.DiffIDs) != len(newManifest.Layers) {
+		t.Errorf("diffids don't match layers: %d != %d", len(newConfig.RootFS.DiffIDs), len(newManifest.Layers))
+	}
+	if newConfig.RootFS.DiffIDs[0] != oldConfig.RootFS.DiffIDs[0] {
+		t.Errorf("split changed diffid of unrelated layer: %s != %s", oldConfig.RootFS.DiffIDs[0], newConfig.RootFS.DiffIDs[0])
+	}
+	if len(newConfig.History) != len(newManifest.Layers) {
+		t.Errorf("history doesn't match layers: %d != %d", len(newConfig.History), len(newManifest.Layers))
+	}
+	for idx, desc := range newManifest.Layers {
+		if desc.MediaType != ispec.MediaTypeImageLayerGzip {
+			t.Errorf("layer %d: unexpected media-type %q", idx, desc.MediaType)
+		}
+	}
+
+	wantLayers := [][]string{
+		nil,
+		{"etc/.wh.gone", "usr/.wh..wh..opq"},
+		{"usrlocal", "opt/", "opt/passwd"},
+		{"usr/bin/", "usr/bin/sh", "opt/sh"},
+		{"etc/", "etc/passwd"},
+	}
+	for idx, want := range wantLayers[1:] {
+		var got []string
+		if err := layer.WalkLayer(ctx, engineExt, newManifest.Layers[idx+1], func(hdr *tar.Header, _ io.Reader) error {
+			got = append(got, hdr.Name)
+			return nil
+		}); err != nil {
+			t.Fatalf("layer %d: unexpected error walking layer: %+v", idx+1, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("layer %d: unexpected entries: %v != %v", idx+1, got, want)
+		}
+	}
+
+	// Applying the split layers must have the same effect as the original.
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	bundles := make([]string, 2)
+	for idx, descriptorPath := range []casext.DescriptorPath{oldDescriptorPath, newDescriptorPath} {
+		bundles[idx] = filepath.Join(dir, "bundle"+string(rune('0'+idx)))
+		if err := UnpackManifest(ctx, engineExt, descriptorPath, bundles[idx], &unpackOptions); err != nil {
+			t.Fatalf("unexpected unpack error: %+v", err)
+		}
+	}
+	oldContents, newContents := rootfsContents(t, bundles[0]), rootfsContents(t, bundles[1])
+	if !reflect.DeepEqual(oldContents, newContents) {
+		t.Errorf("split layers have a different effect:\noriginal: %v\nsplit:    %v", oldContents, newContents)
+	}
+	for _, path := range []string{"etc/gone", "usr/old"} {
+		if _, ok := newContents[path]; ok {
+			t.Errorf("path %q should have been removed by a whiteout", path)
+		}
+	}
+
+	sh, err := os.Lstat(filepath.Join(bundles[1], layer.RootfsName, "usr/bin/sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardlink, err := os.Lstat(filepath.Join(bundles[1], layer.RootfsName, "opt/sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(sh, hardlink) {
+		t.Errorf("hardlink opt/sh does not refer to usr/bin/sh after split")
+	}
+}
@@ -0,0 +1,191 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci blob ls [missing arguments]" {
+	# Missing --layout argument.
+	umoci blob ls
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci blob ls --layout "${IMAGE}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+
+	# Invalid age.
+	umoci blob ls --layout "${IMAGE}" --older-than "this-is-not-an-age"
+	[ "$status" -ne 0 ]
+	umoci blob ls --layout "${IMAGE}" --older-than "-10d"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci blob ls" {
+	# All of the blobs should be listed.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	umoci blob ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# Add an orphan blob and make it old.
+	echo "orphan blob" > "$BATS_TMPDIR/orphan"
+	orphan="$(sha256sum "$BATS_TMPDIR/orphan" | cut -d' ' -f1)"
+	cp "$BATS_TMPDIR/orphan" "$IMAGE/blobs/sha256/$orphan"
+	touch -d "40 days ago" "$IMAGE/blobs/sha256/$orphan"
+
+	umoci blob ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$((nblobs + 1))" ]
+
+	# Only the orphan blob is older than 30 days.
+	touch "$IMAGE/blobs/sha256/"*
+	touch -d "40 days ago" "$IMAGE/blobs/sha256/$orphan"
+	umoci blob ls --layout "${IMAGE}" --older-than 30d
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "sha256:$orphan" ]]
+
+	umoci blob ls --layout "${IMAGE}" --older-than 1000h
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci blob rm [missing arguments]" {
+	# Missing --layout argument.
+	umoci blob rm "sha256:$(printf '%064d' 0)"
+	[ "$status" -ne 0 ]
+
+	# Missing digest.
+	umoci blob rm --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# Invalid digest.
+	umoci blob rm --layout "${IMAGE}" "this-is-not-a-digest"
+	[ "$status" -ne 0 ]
+
+	# Non-existent blob.
+	umoci blob rm --layout "${IMAGE}" "sha256:$(printf '%064d' 0)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci blob rm" {
+	# Add an orphan blob.
+	echo "orphan blob" > "$BATS_TMPDIR/orphan"
+	orphan="$(sha256sum "$BATS_TMPDIR/orphan" | cut -d' ' -f1)"
+	cp "$BATS_TMPDIR/orphan" "$IMAGE/blobs/sha256/$orphan"
+
+	# Get a referenced blob.
+	sane_run jq -SMr '.manifests[0].digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	referenced="$output"
+
+	# Removing a referenced blob is refused without --force.
+	umoci blob rm --layout "${IMAGE}" "$referenced"
+	[ "$status" -ne 0 ]
+	[ -f "$IMAGE/blobs/sha256/${referenced#sha256:}" ]
+	image-verify "${IMAGE}"
+
+	# Nothing is removed if any of the blobs is referenced.
+	umoci blob rm --layout "${IMAGE}" "sha256:$orphan" "$referenced"
+	[ "$status" -ne 0 ]
+	[ -f "$IMAGE/blobs/sha256/$orphan" ]
+	[ -f "$IMAGE/blobs/sha256/${referenced#sha256:}" ]
+
+	# Orphan blobs can be removed.
+	umoci blob rm --layout "${IMAGE}" "sha256:$orphan"
+	[ "$status" -eq 0 ]
+	! [ -e "$IMAGE/blobs/sha256/$orphan" ]
+	image-verify "${IMAGE}"
+
+	# With --force, referenced blobs are removed.
+	umoci blob rm --layout "${IMAGE}" --force "$referenced"
+	[ "$status" -eq 0 ]
+	! [ -e "$IMAGE/blobs/sha256/${referenced#sha256:}" ]
+}
+
+@test "umoci blob check [missing arguments]" {
+	# Missing --layout argument.
+	umoci blob check
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci blob check --layout "${IMAGE}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci blob check" {
+	# A clean layout has no garbage.
+	umoci blob check --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Plant a temporary file, a partially-written blob and a stale temporary
+	# directory.
+	echo "partial" > "$IMAGE/blobs/sha256/blob-1234"
+	echo "some blob contents" > "$BATS_TMPDIR/partial"
+	partial="$(sha256sum "$BATS_TMPDIR/partial" | cut -d' ' -f1)"
+	head -c 5 "$BATS_TMPDIR/partial" > "$IMAGE/blobs/sha256/$partial"
+	mkdir "$IMAGE/.umoci-stale"
+
+	# Get a list of the valid blobs.
+	sane_run find "$IMAGE/blobs" -type f -not -name blob-1234 -not -name "$partial"
+	[ "$status" -eq 0 ]
+	valid=( "${lines[@]}" )
+
+	# The garbage is detected but not removed.
+	umoci blob check --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 3 ]
+	[[ "$output" == *"blobs/sha256/blob-1234: "* ]]
+	[[ "$output" == *"blobs/sha256/$partial: "* ]]
+	[[ "$output" == *".umoci-stale: "* ]]
+	[ -f "$IMAGE/blobs/sha256/blob-1234" ]
+	[ -f "$IMAGE/blobs/sha256/$partial" ]
+	[ -d "$IMAGE/.umoci-stale" ]
+
+	# With --remove, the garbage is removed.
+	umoci blob check --layout "${IMAGE}" --remove
+	[ "$status" -eq 0 ]
+	! [ -e "$IMAGE/blobs/sha256/blob-1234" ]
+	! [ -e "$IMAGE/blobs/sha256/$partial" ]
+	! [ -e "$IMAGE/.umoci-stale" ]
+
+	# The valid blobs were not touched.
+	for blob in "${valid[@]}"; do
+		[ -f "$blob" ]
+	done
+	image-verify "${IMAGE}"
+
+	umoci blob check --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
@@ -0,0 +1,104 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci chown-bundle [missing arguments]" {
+	# Missing bundle argument.
+	umoci chown-bundle --uid-shift 1000
+	[ "$status" -ne 0 ]
+
+	# Missing shift arguments.
+	new_bundle_rootfs
+	umoci chown-bundle "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Not a bundle.
+	umoci chown-bundle --uid-shift 1000 "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci chown-bundle" {
+	requires root
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run stat -c '%u:%g' "$ROOTFS/etc/passwd"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0:0" ]]
+
+	# Shifting below zero must fail without changing anything.
+	umoci chown-bundle --uid-shift -1 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	sane_run stat -c '%u:%g' "$ROOTFS/etc/passwd"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0:0" ]]
+
+	umoci chown-bundle --uid-shift 100000 --gid-shift 200000 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Everything has been shifted.
+	sane_run find "$ROOTFS" -not -uid +99999
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	sane_run find "$ROOTFS" -not -gid +199999
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	sane_run stat -c '%u:%g' "$ROOTFS/etc/passwd"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "100000:200000" ]]
+
+	# The metadata has been shifted too.
+	sane_run jq -SMr '.map_options.uid_mappings[0].hostID' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "100000" ]]
+	sane_run jq -SMr '.map_options.gid_mappings[0].hostID' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "200000" ]]
+
+	# Repacking the shifted bundle should produce an empty layer.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].empty_layer' <<<"$output")" == "true" ]]
+
+	# Unpacking again gives the original ownership.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run stat -c '%u:%g' "$ROOTFS/etc/passwd"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0:0" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,167 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci --config-file [mappings]" {
+	# We do a bunch of remapping tricks, which we can't really do if we're not root.
+	requires root
+
+	CONFIG="$(setup_tmpdir)/umoci.yaml"
+	cat >"$CONFIG" <<-EOF
+	unpack:
+	  uid-map: ["0:1337:65535"]
+	  gid-map: ["0:8888:65535"]
+	EOF
+
+	# The mappings in the config file are used by default.
+	new_bundle_rootfs
+	umoci --config-file "$CONFIG" unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.map_options.uid_mappings[0].hostID' "$BUNDLE/umoci.json")" == 1337 ]]
+	[[ "$(jq -SMr '.map_options.gid_mappings[0].hostID' "$BUNDLE/umoci.json")" == 8888 ]]
+	find "$ROOTFS" | xargs stat -c '%u:%g' | awk -F: '{
+		uid = $1;
+		if (uid < 1337 || uid >= 1337 + 65535)
+			exit 1;
+		gid = $2;
+		if (gid < 8888 || gid >= 8888 + 65535)
+			exit 1;
+	}'
+
+	# Flags on the command-line override the config file (and only the
+	# overridden flags are affected).
+	new_bundle_rootfs
+	umoci --config-file "$CONFIG" unpack --uid-map "0:8080:65535" --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.map_options.uid_mappings | length' "$BUNDLE/umoci.json")" == 1 ]]
+	[[ "$(jq -SMr '.map_options.uid_mappings[0].hostID' "$BUNDLE/umoci.json")" == 8080 ]]
+	[[ "$(jq -SMr '.map_options.gid_mappings[0].hostID' "$BUNDLE/umoci.json")" == 8888 ]]
+
+	# The config file can also be given with $UMOCI_CONFIG_FILE.
+	new_bundle_rootfs
+	export UMOCI_CONFIG_FILE="$CONFIG"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	unset UMOCI_CONFIG_FILE
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.map_options.uid_mappings[0].hostID' "$BUNDLE/umoci.json")" == 1337 ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --config-file [compression]" {
+	CONFIG="$(setup_tmpdir)/umoci.json"
+	echo '{"repack": {"compress": "zstd"}}' >"$CONFIG"
+
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The new layer uses the compression from the config file.
+	echo "first file" > "$ROOTFS/newfile"
+	umoci --config-file "$CONFIG" repack --image "${IMAGE}:${TAG}-zstd" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-zstd" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.mediaType')" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+
+	# --compress overrides the config file.
+	echo "second file" > "$ROOTFS/newfile2"
+	umoci --config-file "$CONFIG" repack --compress gzip --image "${IMAGE}:${TAG}-gzip" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-gzip" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.mediaType')" == "application/vnd.oci.image.layer.v1.tar+gzip" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --config-file [current directory]" {
+	WORKDIR="$(setup_tmpdir)"
+	cat >"$WORKDIR/.umoci.yaml" <<-EOF
+	repack:
+	  compress: zstd
+	EOF
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# .umoci.yaml in the current directory is used automatically.
+	echo "first file" > "$ROOTFS/newfile"
+	pushd "$WORKDIR"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	popd
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.mediaType')" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --config-file [invalid]" {
+	CONFIG="$(setup_tmpdir)/umoci.yaml"
+
+	# Non-existent config file.
+	umoci --config-file "$CONFIG" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Unknown commands and flags.
+	echo 'nonexistent-command: {}' >"$CONFIG"
+	umoci --config-file "$CONFIG" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	echo 'unpack: {nonexistent-flag: true}' >"$CONFIG"
+	umoci --config-file "$CONFIG" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Lists are only permitted for flags that can be repeated.
+	echo 'unpack: {keep-dirlinks: [true, false]}' >"$CONFIG"
+	umoci --config-file "$CONFIG" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Invalid flag values.
+	echo 'repack: {compress: "invalid"}' >"$CONFIG"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci --config-file "$CONFIG" repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
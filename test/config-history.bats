@@ -0,0 +1,102 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci config-history --json" {
+	# Record some directives in the history.
+	umoci config --image "${IMAGE}:${TAG}" \
+		--config.env "FOO=bar" \
+		--history.created_by '/bin/sh -c #(nop)  ENV FOO=bar'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci config --image "${IMAGE}:${TAG}" \
+		--config.cmd "/bin/app" --config.cmd "--serve" \
+		--history.created_by 'CMD ["/bin/app" "--serve"]'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci config --image "${IMAGE}:${TAG}" \
+		--config.label "org.example.label=some value" \
+		--history.created_by 'LABEL org.example.label="some value"'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config-history --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+
+	historyFile="$(setup_tmpdir)/history"
+	echo "$output" > "$historyFile"
+
+	# The last three steps should be the directives we added.
+	sane_run jq -SMr '.steps[-3:] | map(.directive) | join(",")' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "ENV,CMD,LABEL" ]]
+
+	# And the reconstructed config should contain all of them.
+	sane_run jq -SMr '.steps[-1].config.env | index("FOO=bar") != null' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+	sane_run jq -SMr '.steps[-1].config.cmd | join(" ")' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/bin/app --serve" ]]
+	sane_run jq -SMr '.steps[-1].config.labels["org.example.label"]' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "some value" ]]
+
+	# The step before the ENV must not have FOO set.
+	sane_run jq -SMr '.steps[-4].config.env // [] | index("FOO=bar") == null' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
+
+# We can't really test the output for non-JSON output, but we can smoke test it.
+@test "umoci config-history [smoke]" {
+	umoci config --image "${IMAGE}:${TAG}" \
+		--config.env "FOO=bar" \
+		--history.created_by '/bin/sh -c #(nop)  ENV FOO=bar'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config-history --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	echo "$output" | grep 'STEP'
+	echo "$output" | grep 'ENV FOO=bar'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config-history [missing arguments]" {
+	umoci config-history
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci config-history [too many arguments]" {
+	umoci config-history --image "${IMAGE}:${TAG}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+}
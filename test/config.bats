@@ -826,3 +826,33 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config [invalid configuration]" {
+	# Invalid stop signal.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.stopsignal="SIGFOOBAR"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid exposed ports.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.exposedports="80/icmp"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.exposedports="99999/tcp"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid user.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user="user:"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# The new tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	# Valid values are still accepted.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.stopsignal="SIGRTMIN+3" --config.exposedports="53/udp" --config.user="1000:group"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,159 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci copy" {
+	# Add another layer to the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "copy" >"$ROOTFS/copy-file"
+	umoci repack --image "${IMAGE}:${TAG}-multi" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-multi" --json
+	[ "$status" -eq 0 ]
+	srcStat="$output"
+
+	# Copy the image to a new layout.
+	NEW_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci copy --src "${IMAGE}:${TAG}-multi" --dst "${NEW_IMAGE}:copied"
+	[ "$status" -eq 0 ]
+	image-verify "$NEW_IMAGE"
+
+	umoci stat --image "${NEW_IMAGE}:copied" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$srcStat" ]]
+
+	# Garbage collection must not remove anything.
+	sane_run find "$NEW_IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+	umoci gc --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	sane_run find "$NEW_IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# Copying again must be a no-op.
+	umoci copy --src "${IMAGE}:${TAG}-multi" --dst "${NEW_IMAGE}:copied"
+	[ "$status" -eq 0 ]
+	sane_run find "$NEW_IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	image-verify "$NEW_IMAGE"
+	image-verify "${IMAGE}"
+}
+
+@test "umoci copy [index]" {
+	umoci index --image "${IMAGE}:${TAG}-index" "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	NEW_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci copy --src "${IMAGE}:${TAG}-index" --dst "${NEW_IMAGE}:${TAG}-index"
+	[ "$status" -eq 0 ]
+	image-verify "$NEW_IMAGE"
+
+	# The index and the image it contains must both have been copied.
+	sane_run jq -SMr '.manifests[] | .digest' "$NEW_IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	indexDigest="${lines[0]}"
+	sane_run jq -SMr '.manifests[] | .digest' "$NEW_IMAGE/blobs/${indexDigest/://}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[ -f "$NEW_IMAGE/blobs/${lines[0]/://}" ]
+
+	umoci unpack --image "${NEW_IMAGE}:${TAG}-index" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	image-verify "$NEW_IMAGE"
+}
+
+@test "umoci copy [existing tag]" {
+	umoci new --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	# The destination tag must not be replaced without --overwrite.
+	umoci copy --src "${IMAGE}:${TAG}-new" --dst "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Copying the same image is fine.
+	umoci copy --src "${IMAGE}:${TAG}" --dst "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	umoci copy --src "${IMAGE}:${TAG}-new" --dst "${IMAGE}:${TAG}" --overwrite
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	newStat="$output"
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$newStat" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci copy [missing arguments]" {
+	NEW_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci copy --dst "${NEW_IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci copy --src "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci copy --src "${IMAGE}:${TAG}-doesnotexist" --dst "${NEW_IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci copy --src "${IMAGE}:${TAG}" --dst "${NEW_IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+
+	# The destination layout must exist.
+	umoci copy --src "${IMAGE}:${TAG}" --dst "${NEW_IMAGE}-doesnotexist:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "$NEW_IMAGE"
+	image-verify "${IMAGE}"
+}
@@ -286,3 +286,44 @@ function teardown() {
 
 	image-verify "$IMAGE"
 }
+
+@test "umoci --index-created" {
+	# We are making a new image.
+	IMAGE="$(setup_tmpdir)/image" TAG="latest"
+
+	# Invalid timestamps are rejected.
+	umoci --index-created="not-a-timestamp" init --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	! [ -e "${IMAGE}" ]
+	umoci --index-created="@not-a-number" init --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	! [ -e "${IMAGE}" ]
+
+	# The empty index is annotated.
+	umoci --index-created="@1700000000" init --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.annotations["org.opencontainers.image.created"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2023-11-14T22:13:20Z" ]]
+
+	# New entries (and the index itself) get the new timestamp.
+	export SOURCE_DATE_EPOCH=1600000000
+	umoci --index-created="@${SOURCE_DATE_EPOCH}" new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci --index-created="2020-09-13T12:26:40Z" tag --image "${IMAGE}:${TAG}" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.annotations["org.opencontainers.image.created"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2020-09-13T12:26:40Z" ]]
+
+	sane_run jq -SMr '.manifests[] | .annotations["org.opencontainers.image.created"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	for created in "${lines[@]}"; do
+		[[ "$created" == "2020-09-13T12:26:40Z" ]]
+	done
+}
@@ -0,0 +1,137 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# check_same_rootfs <tag1> <tag2> checks that the two images have the same
+# root filesystem.
+function check_same_rootfs() {
+	new_bundle_rootfs && BUNDLE_A="$BUNDLE" ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${IMAGE}:$1" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	new_bundle_rootfs && BUNDLE_B="$BUNDLE" ROOTFS_B="$ROOTFS"
+	umoci unpack --image "${IMAGE}:$2" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	gomtree -p "$ROOTFS_B" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci export" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	umoci export --image "${IMAGE}:${TAG}" --image-name example.com/image "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the structure of the archive.
+	sane_run tar -xOf "$ARCHIVE" manifest.json
+	[ "$status" -eq 0 ]
+	archiveManifest="$output"
+	[[ "$(jq -SMr '.[0].RepoTags[0]' <<<"$archiveManifest")" == "example.com/image:latest" ]]
+	config="$(jq -SMr '.[0].Config' <<<"$archiveManifest")"
+	sane_run tar -xOf "$ARCHIVE" "$config"
+	[ "$status" -eq 0 ]
+	sane_run tar -xOf "$ARCHIVE" repositories
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '."example.com/image".latest' <<<"$output")" != "null" ]]
+
+	# The layers must be uncompressed.
+	for layer in $(jq -SMr '.[0].Layers[]' <<<"$archiveManifest"); do
+		sane_run bash -c "tar -xOf '$ARCHIVE' '$layer' | tar -t >/dev/null"
+		[ "$status" -eq 0 ]
+	done
+
+	# Re-importing the archive must give the same image.
+	umoci import --image "${IMAGE}:${TAG}-imported" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	check_same_rootfs "${TAG}" "${TAG}-imported"
+
+	# The archive must not already exist.
+	umoci export --image "${IMAGE}:${TAG}" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export [zstd]" {
+	umoci recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-zstd" --to zstd
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	umoci export --image "${IMAGE}:${TAG}-zstd" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+
+	# The layers must have been decompressed.
+	sane_run tar -xOf "$ARCHIVE" manifest.json
+	[ "$status" -eq 0 ]
+	for layer in $(jq -SMr '.[0].Layers[]' <<<"$output"); do
+		sane_run bash -c "tar -xOf '$ARCHIVE' '$layer' | tar -t >/dev/null"
+		[ "$status" -eq 0 ]
+	done
+
+	umoci import --image "${IMAGE}:${TAG}-imported" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	check_same_rootfs "${TAG}" "${TAG}-imported"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export [invalid arguments]" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	# Missing --image.
+	umoci export "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	# Missing archive.
+	umoci export --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci export --image "${IMAGE}:${TAG}" "$ARCHIVE" extra
+	[ "$status" -ne 0 ]
+
+	umoci export --image "${IMAGE}:${TAG}-doesnotexist" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	! [ -e "$ARCHIVE" ]
+
+	umoci export --image "${IMAGE}:${TAG}" --image-name "" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -139,6 +139,38 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
 
+	umoci config-history --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci config-history"+ ]]
+
+	umoci config-history -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci config-history"+ ]]
+
+	umoci recompress --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci recompress"+ ]]
+
+	umoci recompress -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci recompress"+ ]]
+
+	umoci split-layer --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci split-layer"+ ]]
+
+	umoci split-layer -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci split-layer"+ ]]
+
+	umoci index --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index"+ ]]
+
+	umoci index -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index"+ ]]
+
 	umoci gc --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
@@ -147,6 +179,78 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
 
+	umoci chown-bundle --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci chown-bundle"+ ]]
+
+	umoci chown-bundle -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci chown-bundle"+ ]]
+
+	umoci layer-from-diff --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci layer-from-diff"+ ]]
+
+	umoci layer-from-diff -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci layer-from-diff"+ ]]
+
+	umoci copy --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci copy"+ ]]
+
+	umoci copy -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci copy"+ ]]
+
+	umoci import --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci import -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci export --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci export -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci layout-diff --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci layout-diff"+ ]]
+
+	umoci layout-diff -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci layout-diff"+ ]]
+
+	umoci referrers --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci referrers -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci referrers ls --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers list"+ ]]
+
+	umoci referrers rm --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers remove"+ ]]
+
+	umoci verify --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify"+ ]]
+
+	umoci verify -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify"+ ]]
+
 	umoci init --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
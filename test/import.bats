@@ -0,0 +1,167 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# make_docker_archive <tag> <archive> converts the image with the given tag
+# into a Docker image archive with the same structure as "docker save".
+function make_docker_archive() {
+	local tag="$1" archive="$2"
+	local archivedir="$(setup_tmpdir)"
+
+	manifest="$(jq -SMr --arg tag "$tag" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json")"
+	config="$(jq -SMr '.config.digest' "$IMAGE/blobs/${manifest/://}")"
+	cp "$IMAGE/blobs/${config/://}" "$archivedir/${config#*:}.json"
+
+	local layers=()
+	while read -r mediatype digest; do
+		mkdir "$archivedir/${digest#*:}"
+		case "$mediatype" in
+		*+gzip) gzip -dc ;;
+		*+zstd) zstd -dc ;;
+		*) cat ;;
+		esac <"$IMAGE/blobs/${digest/://}" >"$archivedir/${digest#*:}/layer.tar"
+		layers+=("${digest#*:}/layer.tar")
+	done < <(jq -SMr '.layers[] | "\(.mediaType) \(.digest)"' "$IMAGE/blobs/${manifest/://}")
+
+	jq -n --arg config "${config#*:}.json" '[{"Config": $config, "RepoTags": ["example.com/image:latest"], "Layers": $ARGS.positional}]' \
+		--args "${layers[@]}" >"$archivedir/manifest.json"
+	tar -cf "$archive" -C "$archivedir" .
+}
+
+@test "umoci import" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	make_docker_archive "${TAG}" "$ARCHIVE"
+
+	umoci import --image "${IMAGE}:${TAG}-imported" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The configuration and history must be the same.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldHistory="$(echo "$output" | jq -SMr '[.history[] | del(.layer)]')"
+	umoci stat --image "${IMAGE}:${TAG}-imported" --json
+	[ "$status" -eq 0 ]
+	newHistory="$(echo "$output" | jq -SMr '[.history[] | del(.layer)]')"
+	[[ "$oldHistory" == "$newHistory" ]]
+
+	oldManifest="$(jq -SMr --arg tag "${TAG}" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json")"
+	newManifest="$(jq -SMr --arg tag "${TAG}-imported" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json")"
+	oldConfig="$(jq -SMr '.config.digest' "$IMAGE/blobs/${oldManifest/://}")"
+	newConfig="$(jq -SMr '.config.digest' "$IMAGE/blobs/${newManifest/://}")"
+	sane_run jq -SM '.rootfs.diff_ids' "$IMAGE/blobs/${oldConfig/://}"
+	oldDiffIDs="$output"
+	sane_run jq -SM '.rootfs.diff_ids' "$IMAGE/blobs/${newConfig/://}"
+	[[ "$output" == "$oldDiffIDs" ]]
+
+	# The root filesystem must be the same.
+	new_bundle_rootfs && BUNDLE_A="$BUNDLE" ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	new_bundle_rootfs && BUNDLE_B="$BUNDLE" ROOTFS_B="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}-imported" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	gomtree -p "$ROOTFS_B" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import --image-name" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	make_docker_archive "${TAG}" "$ARCHIVE"
+
+	# The tag of the name defaults to "latest".
+	umoci import --image "${IMAGE}:${TAG}-imported" --image-name example.com/image "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci import --image "${IMAGE}:${TAG}-imported" --image-name example.com/image:latest "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci import --image "${IMAGE}:${TAG}-imported" --image-name example.com/other "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import --compress" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	make_docker_archive "${TAG}" "$ARCHIVE"
+
+	umoci import --image "${IMAGE}:${TAG}-imported" --compress zstd "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	newManifest="$(jq -SMr --arg tag "${TAG}-imported" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json")"
+	sane_run jq -SMr '.layers[].mediaType' "$IMAGE/blobs/${newManifest/://}"
+	[ "$status" -eq 0 ]
+	for mediatype in "${lines[@]}"; do
+		[[ "$mediatype" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import [invalid arguments]" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	make_docker_archive "${TAG}" "$ARCHIVE"
+
+	# Missing --image.
+	umoci import "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	# Missing archive.
+	umoci import --image "${IMAGE}:${TAG}-imported"
+	[ "$status" -ne 0 ]
+
+	umoci import --image "${IMAGE}:${TAG}-imported" "$ARCHIVE" extra
+	[ "$status" -ne 0 ]
+
+	umoci import --image "${IMAGE}:${TAG}-imported" "$ARCHIVE.doesnotexist"
+	[ "$status" -ne 0 ]
+
+	umoci import --image "${IMAGE}:${TAG}-imported" --compress lzma "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	# An OCI image layout is not a Docker image archive.
+	tar -cf "$ARCHIVE" -C "$IMAGE" .
+	umoci import --image "${IMAGE}:${TAG}-imported" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,103 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# index_blob prints the blob referenced by the given tag.
+function index_blob() {
+	local digest="$(jq -SMr --arg tag "$1" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json" | cut -d: -f2)"
+	cat "$IMAGE/blobs/sha256/$digest"
+}
+
+@test "umoci index" {
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+
+	umoci index --image "${IMAGE}:${TAG}-index" "${TAG}" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+
+	# The tag must reference an OCI image index.
+	[[ "$(jq -SMr --arg tag "${TAG}-index" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .mediaType' "$IMAGE/index.json")" == "application/vnd.oci.image.index.v1+json" ]]
+	sane_run index_blob "${TAG}-index"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.mediaType')" == "application/vnd.oci.image.index.v1+json" ]]
+	[[ "$(echo "$output" | jq -SMr '.manifests | length')" == 2 ]]
+	[[ "$(echo "$output" | jq -SMr '.manifests[0].platform.os')" == "linux" ]]
+
+	# The referenced images must survive a gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index --media-type docker" {
+	umoci index --image "${IMAGE}:${TAG}-list" --media-type docker "${TAG}"
+	[ "$status" -eq 0 ]
+
+	# The tag must reference a Docker manifest list.
+	[[ "$(jq -SMr --arg tag "${TAG}-list" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .mediaType' "$IMAGE/index.json")" == "application/vnd.docker.distribution.manifest.list.v2+json" ]]
+	sane_run index_blob "${TAG}-list"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.mediaType')" == "application/vnd.docker.distribution.manifest.list.v2+json" ]]
+	[[ "$(echo "$output" | jq -SMr '.manifests | length')" == 1 ]]
+
+	# Remove the tag for the original image, so that only the manifest list
+	# keeps it alive through a gc.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-backup"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-backup" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# Docker manifest lists are not part of the OCI specification.
+	umoci rm --image "${IMAGE}:${TAG}-list"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index [invalid arguments]" {
+	# At least one tag is required.
+	umoci index --image "${IMAGE}:${TAG}-index"
+	[ "$status" -ne 0 ]
+
+	# Unknown media-types are rejected.
+	umoci index --image "${IMAGE}:${TAG}-index" --media-type foo "${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Unknown tags are rejected.
+	umoci index --image "${IMAGE}:${TAG}-index" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
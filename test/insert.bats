@@ -300,6 +300,54 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci insert --no-clobber" {
+	# Some things to insert.
+	INSERTDIR="$(setup_tmpdir)"
+	echo "new passwd" > "${INSERTDIR}/passwd"
+	mkdir "${INSERTDIR}/newdir"
+
+	# --no-clobber conflicts with --whiteout.
+	umoci insert --image "${IMAGE}:${TAG}" --no-clobber --whiteout /etc
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Inserting over an existing path is refused.
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --no-clobber "${INSERTDIR}/passwd" /etc/passwd
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	# Inserting into a new path works.
+	umoci insert --image "${IMAGE}:${TAG}" --no-clobber "${INSERTDIR}/newdir" /newdir
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# ... but only once.
+	umoci insert --image "${IMAGE}:${TAG}" --no-clobber "${INSERTDIR}/newdir" /newdir
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Paths which have been whited-out can be inserted again.
+	umoci insert --image "${IMAGE}:${TAG}" --whiteout /newdir
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci insert --image "${IMAGE}:${TAG}" --no-clobber "${INSERTDIR}/newdir" /newdir
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack after the inserts.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[ -d "$ROOTFS/newdir" ]
+	! [[ "$(cat "$ROOTFS/etc/passwd")" == "new passwd" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci insert --history.*" {
 	# Some things to insert.
 	INSERTDIR="$(setup_tmpdir)"
@@ -345,6 +393,83 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci insert --history-template" {
+	# Some things to insert.
+	INSERTDIR="$(setup_tmpdir)"
+	mkdir -p "${INSERTDIR}/etc"
+	touch "${INSERTDIR}/etc/foo"
+
+	# umoci-insert will overwrite the tag.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	# --history-template conflicts with --history.created_by.
+	umoci insert --image "${IMAGE}:${TAG}-new" \
+		--history.created_by="foo" --history-template="{op}" "${INSERTDIR}/etc" /etc
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# --history-template conflicts with --no-history.
+	umoci insert --image "${IMAGE}:${TAG}-new" \
+		--no-history --history-template="{op}" "${INSERTDIR}/etc" /etc
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Insert something into the image, using a template.
+	umoci insert --image "${IMAGE}:${TAG}-new" \
+		--history.created="2021-03-14T15:09:26Z" \
+		--history-template="umoci {op} {files} at {time} {unknown}" "${INSERTDIR}/etc" /etc
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The created_by should be the expanded template.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci insert /etc at 2021-03-14T15:09:26Z {unknown}" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert --history-redact" {
+	# Some things to insert.
+	INSERTDIR="$(setup_tmpdir)"
+	mkdir -p "${INSERTDIR}/etc"
+	touch "${INSERTDIR}/etc/foo"
+
+	# umoci-insert will overwrite the tag.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	# Invalid patterns must be rejected.
+	umoci insert --image "${IMAGE}:${TAG}-new" \
+		--history-redact="(" "${INSERTDIR}/etc" /etc
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	REDACTFILE="$(setup_tmpdir)/redact"
+	cat >"$REDACTFILE" <<EOF
+# Strip the home directory of the user.
+/home/[^/ ]+
+
+EOF
+
+	# Insert something into the image, with a secret in the created_by.
+	umoci insert --image "${IMAGE}:${TAG}-new" \
+		--history.created_by="fetch --password=hunter2 /home/user/src" \
+		--history-redact='--password=(\S+)' --history-redact-file="$REDACTFILE" \
+		"${INSERTDIR}/etc" /etc
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The secret and path should have been redacted.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "fetch --password=<redacted> <redacted>/src" ]]
+	! grep -q hunter2 <<<"$output"
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci insert --no-history" {
 	# Some things to insert.
 	INSERTDIR="$(setup_tmpdir)"
@@ -0,0 +1,120 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci layer-from-diff" {
+	# Create a target image which removes, modifies and adds files.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	rm "$ROOTFS/etc/group"
+	rm -rf "$ROOTFS/usr/share"
+	echo "modified" >"$ROOTFS/etc/passwd"
+	mkdir -p "$ROOTFS/opt/new"
+	echo "added" >"$ROOTFS/opt/new/file"
+
+	umoci repack --image "${IMAGE}:${TAG}-target" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Generate the delta layer.
+	DELTA="$(setup_tmpdir)/delta.tar"
+	umoci layer-from-diff --base "${IMAGE}:${TAG}" --target "${IMAGE}:${TAG}-target" --output "$DELTA"
+	[ "$status" -eq 0 ]
+	[ -f "$DELTA" ]
+
+	# Deletions must be represented with whiteouts.
+	sane_run tar -tf "$DELTA"
+	[ "$status" -eq 0 ]
+	grep -qx "etc/.wh.group" <<<"$output"
+	grep -qx "usr/.wh.share" <<<"$output"
+	grep -qx "etc/passwd" <<<"$output"
+	grep -qx "opt/new/file" <<<"$output"
+	! grep -q "^usr/share/" <<<"$output"
+
+	# Applying the delta to the base must produce the target.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-applied"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}-applied" "$DELTA"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_bundle_rootfs && BUNDLE_A="$BUNDLE" ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}-target" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	new_bundle_rootfs && BUNDLE_B="$BUNDLE" ROOTFS_B="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}-applied" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	gomtree -p "$ROOTFS_B" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# The output must not already exist.
+	umoci layer-from-diff --base "${IMAGE}:${TAG}" --target "${IMAGE}:${TAG}-target" --output "$DELTA"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci layer-from-diff [missing arguments]" {
+	DELTA="$(setup_tmpdir)/delta.tar"
+
+	# Missing --base.
+	umoci layer-from-diff --target "${IMAGE}:${TAG}" --output "$DELTA"
+	[ "$status" -ne 0 ]
+	! [ -e "$DELTA" ]
+
+	# Missing --target.
+	umoci layer-from-diff --base "${IMAGE}:${TAG}" --output "$DELTA"
+	[ "$status" -ne 0 ]
+	! [ -e "$DELTA" ]
+
+	# Missing --output.
+	umoci layer-from-diff --base "${IMAGE}:${TAG}" --target "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Non-existent tag.
+	umoci layer-from-diff --base "${IMAGE}:${TAG}-doesnotexist" --target "${IMAGE}:${TAG}" --output "$DELTA"
+	[ "$status" -ne 0 ]
+	! [ -e "$DELTA" ]
+
+	# Unexpected positional argument.
+	umoci layer-from-diff --base "${IMAGE}:${TAG}" --target "${IMAGE}:${TAG}" --output "$DELTA" extra
+	[ "$status" -ne 0 ]
+	! [ -e "$DELTA" ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,100 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci layout-diff" {
+	# Copy the image to a new layout.
+	NEW_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	umoci copy --src "${IMAGE}:${TAG}" --dst "${NEW_IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$NEW_IMAGE"
+
+	# Get rid of everything else in the original layout.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for tag in "${lines[@]}"; do
+		[[ "$tag" == "$TAG" ]] && continue
+		umoci rm --image "${IMAGE}:${tag}"
+		[ "$status" -eq 0 ]
+	done
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# The layouts are now identical.
+	umoci layout-diff "${IMAGE}" "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Add a new layer (and tag) to the new layout.
+	new_bundle_rootfs
+	umoci unpack --image "${NEW_IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" >"$ROOTFS/new-file"
+	umoci repack --image "${NEW_IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "$NEW_IMAGE"
+
+	# And make the original tag refer to it as well.
+	umoci tag --overwrite --image "${NEW_IMAGE}:${TAG}-new" "${TAG}"
+	[ "$status" -eq 0 ]
+
+	umoci layout-diff "${IMAGE}" "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"+ blob sha256:"* ]]
+	[[ "$output" == *"+ reference ${TAG}-new"* ]]
+	[[ "$output" == *"~ reference ${TAG}: sha256:"* ]]
+	[[ "$output" != *"- "* ]]
+
+	umoci layout-diff --json "${IMAGE}" "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -SMr '.blobs_only_in_a | length')" -eq 0 ]
+	# A new layer, config and manifest.
+	[ "$(echo "$output" | jq -SMr '.blobs_only_in_b | length')" -eq 3 ]
+	[ "$(echo "$output" | jq -SMr '.references_only_in_b[]')" == "${TAG}-new" ]
+	[ "$(echo "$output" | jq -SMr '.changed_references[0].name')" == "${TAG}" ]
+
+	# The diff is the other way around if the layouts are swapped.
+	umoci layout-diff "$NEW_IMAGE" "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"- reference ${TAG}-new"* ]]
+	[[ "$output" != *"+ "* ]]
+}
+
+@test "umoci layout-diff [missing args]" {
+	umoci layout-diff
+	[ "$status" -ne 0 ]
+
+	umoci layout-diff "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci layout-diff "${IMAGE}" "$(setup_tmpdir)/non-existent"
+	[ "$status" -ne 0 ]
+}
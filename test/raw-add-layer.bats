@@ -163,4 +163,9 @@ function teardown() {
 	umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR"
 	[ "$status" -ne 0 ]
 	image-verify "${IMAGE}"
+
+	# {files} is not supported in --history-template.
+	umoci raw add-layer --image "${IMAGE}:${TAG}" --history-template "{op} {files}" "$LAYERFILE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
 }
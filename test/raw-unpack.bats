@@ -46,6 +46,50 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci raw unpack --output" {
+	# Add a layer which removes /etc/group and adds a new file.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	rm "$ROOTFS/etc/group"
+	echo "exported" >"$ROOTFS/etc/new-file"
+
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Export the image.
+	ARCHIVE="$(setup_tmpdir)/rootfs.tar"
+	umoci raw unpack --image "${IMAGE}:${TAG}" --output "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[ -f "$ARCHIVE" ]
+
+	# The archive should reflect the final state of the image.
+	sane_run tar -tf "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	grep -qx "etc/passwd" <<<"$output"
+	grep -qx "etc/new-file" <<<"$output"
+	! grep -qx "etc/group" <<<"$output"
+	[[ "$output" != *".wh."* ]]
+	sane_run tar -xOf "$ARCHIVE" etc/new-file
+	[ "$status" -eq 0 ]
+	[[ "$output" == "exported" ]]
+
+	# The output must not already exist.
+	umoci raw unpack --image "${IMAGE}:${TAG}" --output "$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	# --output and a rootfs path cannot be used together.
+	new_bundle_rootfs
+	umoci raw unpack --image "${IMAGE}:${TAG}" --output "$ARCHIVE-new" "$ROOTFS"
+	[ "$status" -ne 0 ]
+	! [ -e "$ARCHIVE-new" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci raw unpack [invalid arguments]" {
 	ROOTFS="$(setup_tmpdir)"
 
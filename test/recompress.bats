@@ -0,0 +1,199 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# layer_media_types prints the media-types of the layers of the given tag.
+function layer_media_types() {
+	local manifest="$(jq -SMr --arg tag "$1" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json" | cut -d: -f2)"
+	jq -SMr '.layers[].mediaType' "$IMAGE/blobs/sha256/$manifest"
+}
+
+@test "umoci recompress --to zstd" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffIDs="$(echo "$output" | jq -SMr '.history[] | select(.empty_layer | not) | .diff_id')"
+
+	umoci recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-zstd" --to zstd
+	[ "$status" -eq 0 ]
+
+	# All of the layers must be zstd compressed.
+	sane_run layer_media_types "${TAG}-zstd"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -ge 1 ]
+	for mediaType in "${lines[@]}"; do
+		[[ "$mediaType" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+	done
+
+	# The diffids must be unchanged.
+	umoci stat --image "${IMAGE}:${TAG}-zstd" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[] | select(.empty_layer | not) | .diff_id')" == "$diffIDs" ]]
+
+	# The contents must also be unchanged.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_A="$BUNDLE"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-zstd" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_B="$BUNDLE"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	# Convert back to gzip so that we can verify the image (the validation
+	# tools don't understand zstd layers).
+	umoci recompress --image "${IMAGE}:${TAG}-zstd" --to gzip
+	[ "$status" -eq 0 ]
+	sane_run layer_media_types "${TAG}-zstd"
+	[ "$status" -eq 0 ]
+	for mediaType in "${lines[@]}"; do
+		[[ "$mediaType" == "application/vnd.oci.image.layer.v1.tar+gzip" ]]
+	done
+
+	umoci rm --image "${IMAGE}:${TAG}-zstd"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci recompress --to zstd:chunked" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffIDs="$(echo "$output" | jq -SMr '.history[] | select(.empty_layer | not) | .diff_id')"
+
+	umoci recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-chunked" --to "zstd:chunked;chunk-size=65536"
+	[ "$status" -eq 0 ]
+
+	# All of the layers must be zstd compressed with a table of contents.
+	sane_run layer_media_types "${TAG}-chunked"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -ge 1 ]
+	for mediaType in "${lines[@]}"; do
+		[[ "$mediaType" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+	done
+	umoci stat --image "${IMAGE}:${TAG}-chunked" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[] | select(.empty_layer | not) | .diff_id')" == "$diffIDs" ]]
+	sane_run jq -SMr '.history[] | select(.empty_layer | not) | .layer.annotations["io.github.containers.zstd-chunked.manifest-position"]' <<<"$output"
+	[ "$status" -eq 0 ]
+	for position in "${lines[@]}"; do
+		[[ "$position" =~ ^[0-9]+:[0-9]+:[0-9]+:1$ ]]
+	done
+
+	# The contents must be unchanged.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_A="$BUNDLE"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-chunked" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_B="$BUNDLE"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	# Converting back to gzip drops the table of contents annotations.
+	umoci recompress --image "${IMAGE}:${TAG}-chunked" --to gzip
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-chunked" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[].layer.annotations // {} | keys[] | select(startswith("io.github.containers.zstd-chunked."))] | length')" == 0 ]]
+
+	umoci rm --image "${IMAGE}:${TAG}-chunked"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci recompress --to lz4" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffIDs="$(echo "$output" | jq -SMr '.history[] | select(.empty_layer | not) | .diff_id')"
+
+	umoci recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-lz4" --to lz4
+	[ "$status" -eq 0 ]
+
+	# All of the layers must be lz4 compressed.
+	sane_run layer_media_types "${TAG}-lz4"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -ge 1 ]
+	for mediaType in "${lines[@]}"; do
+		[[ "$mediaType" == "application/vnd.oci.image.layer.v1.tar+lz4" ]]
+	done
+	umoci stat --image "${IMAGE}:${TAG}-lz4" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[] | select(.empty_layer | not) | .diff_id')" == "$diffIDs" ]]
+
+	# The contents must be unchanged.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_A="$BUNDLE"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-lz4" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_B="$BUNDLE"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	# New layers can also be lz4 compressed.
+	echo "lz4 layer" > "$BUNDLE_B/rootfs/lz4-file"
+	umoci repack --compress lz4 --image "${IMAGE}:${TAG}-lz4" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-lz4" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.mediaType')" == "application/vnd.oci.image.layer.v1.tar+lz4" ]]
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-lz4" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$ROOTFS/lz4-file")" == "lz4 layer" ]]
+
+	umoci rm --image "${IMAGE}:${TAG}-lz4"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci recompress [invalid arguments]" {
+	# --to is mandatory.
+	umoci recompress --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Unknown compression algorithms are rejected.
+	umoci recompress --image "${IMAGE}:${TAG}" --to lz4
+	[ "$status" -ne 0 ]
+
+	# Unknown tags are rejected.
+	umoci recompress --image "${IMAGE}:${TAG}-nonexistent" --to zstd
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,164 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# put_blob <file> stores the given file as a blob in the image and outputs
+# its digest.
+function put_blob() {
+	local hash="$(sha256sum "$1" | cut -d' ' -f1)"
+	cp "$1" "$IMAGE/blobs/sha256/$hash"
+	echo "sha256:$hash"
+}
+
+# attach <tag> <artifact-type> <contents> attaches an artifact with the given
+# type (and a single layer with the given contents) to the tagged image, and
+# tags it as "<tag>-<digest>". The digest of the artifact manifest is
+# output.
+function attach() {
+	local subject="$(jq -SMc --arg tag "$1" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | {mediaType, digest, size}' "$IMAGE/index.json")"
+
+	echo -n "{}" > "$BATS_TMPDIR/config"
+	local config="$(put_blob "$BATS_TMPDIR/config")"
+	echo "$3" > "$BATS_TMPDIR/layer"
+	local layer="$(put_blob "$BATS_TMPDIR/layer")"
+
+	jq -SMc -n \
+		--arg type "$2" \
+		--arg config "$config" \
+		--arg layer "$layer" \
+		--arg layersize "$(stat -c %s "$BATS_TMPDIR/layer")" \
+		--argjson subject "$subject" \
+		'{schemaVersion: 2, mediaType: "application/vnd.oci.image.manifest.v1+json", artifactType: $type, config: {mediaType: "application/vnd.oci.empty.v1+json", digest: $config, size: 2}, layers: [{mediaType: "application/octet-stream", digest: $layer, size: ($layersize | tonumber)}], subject: $subject}' \
+		> "$BATS_TMPDIR/manifest"
+	local manifest="$(put_blob "$BATS_TMPDIR/manifest")"
+
+	jq -SMc \
+		--arg digest "$manifest" \
+		--arg size "$(stat -c %s "$BATS_TMPDIR/manifest")" \
+		--arg tag "$1-${manifest#sha256:}" \
+		'.manifests += [{mediaType: "application/vnd.oci.image.manifest.v1+json", digest: $digest, size: ($size | tonumber), annotations: {"org.opencontainers.image.ref.name": $tag}}]' \
+		"$IMAGE/index.json" > "$BATS_TMPDIR/index.json"
+	mv "$BATS_TMPDIR/index.json" "$IMAGE/index.json"
+	echo "$manifest"
+}
+
+@test "umoci referrers [missing arguments]" {
+	# Missing --image argument.
+	umoci referrers ls
+	[ "$status" -ne 0 ]
+	umoci referrers rm --artifact-type application/vnd.cncf.notary.signature
+	[ "$status" -ne 0 ]
+
+	# Missing --artifact-type argument.
+	umoci referrers rm --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci referrers ls --image "${IMAGE}:${TAG}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+	umoci referrers rm --image "${IMAGE}:${TAG}" --artifact-type application/vnd.cncf.notary.signature this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+
+	# Non-existent tag.
+	umoci referrers ls --image "${IMAGE}:${TAG}-doesnotexist"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci referrers ls" {
+	# No referrers yet.
+	umoci referrers ls --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	notary="$(attach "$TAG" application/vnd.cncf.notary.signature "notary signature")"
+	cosign="$(attach "$TAG" application/vnd.dev.cosign.artifact.sig.v1+json "cosign signature")"
+	image-verify "${IMAGE}"
+
+	umoci referrers ls --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "$output" == *"$notary application/vnd.cncf.notary.signature"* ]]
+	[[ "$output" == *"$cosign application/vnd.dev.cosign.artifact.sig.v1+json"* ]]
+
+	umoci referrers ls --image "${IMAGE}:${TAG}" --artifact-type application/vnd.cncf.notary.signature
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "$notary application/vnd.cncf.notary.signature" ]]
+}
+
+@test "umoci referrers rm" {
+	notary="$(attach "$TAG" application/vnd.cncf.notary.signature "notary signature")"
+	cosign="$(attach "$TAG" application/vnd.dev.cosign.artifact.sig.v1+json "cosign signature")"
+	notary_layer="$(jq -SMr '.layers[0].digest' "$IMAGE/blobs/sha256/${notary#sha256:}")"
+	cosign_layer="$(jq -SMr '.layers[0].digest' "$IMAGE/blobs/sha256/${cosign#sha256:}")"
+	image-verify "${IMAGE}"
+
+	# Only the notary signature is removed.
+	umoci referrers rm --image "${IMAGE}:${TAG}" --artifact-type application/vnd.cncf.notary.signature
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci referrers ls --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "$cosign application/vnd.dev.cosign.artifact.sig.v1+json" ]]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"$TAG-${notary#sha256:}"* ]]
+	[[ "$output" == *"$TAG-${cosign#sha256:}"* ]]
+
+	# The blobs are only removed after a gc.
+	[ -f "$IMAGE/blobs/sha256/${notary#sha256:}" ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[ ! -f "$IMAGE/blobs/sha256/${notary#sha256:}" ]
+	[ ! -f "$IMAGE/blobs/sha256/${notary_layer#sha256:}" ]
+	[ -f "$IMAGE/blobs/sha256/${cosign#sha256:}" ]
+	[ -f "$IMAGE/blobs/sha256/${cosign_layer#sha256:}" ]
+
+	# Removing a type without referrers does nothing.
+	umoci referrers rm --image "${IMAGE}:${TAG}" --artifact-type application/vnd.cncf.notary.signature
+	[ "$status" -eq 0 ]
+	umoci referrers ls --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+}
+
+@test "umoci referrers rm --gc-after" {
+	notary="$(attach "$TAG" application/vnd.cncf.notary.signature "notary signature")"
+	cosign="$(attach "$TAG" application/vnd.dev.cosign.artifact.sig.v1+json "cosign signature")"
+	image-verify "${IMAGE}"
+
+	umoci referrers rm --image "${IMAGE}:${TAG}" --artifact-type application/vnd.dev.cosign.artifact.sig.v1+json --gc-after
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[ -f "$IMAGE/blobs/sha256/${notary#sha256:}" ]
+	[ ! -f "$IMAGE/blobs/sha256/${cosign#sha256:}" ]
+}
@@ -98,6 +98,200 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci repack [changed files annotation]" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "first file" > "$ROOTFS/newfile"
+	mkdir "$ROOTFS/newdir"
+	echo "subfile" > "$ROOTFS/newdir/anotherfile"
+	rm -rf "$ROOTFS/etc"
+
+	# Repack the image under a new tag.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Get the new layer.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layerDigest="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	changedFiles="$(echo "$output" | jq -SMr '.history[-1].layer.annotations["ci.umo.changed_files"]')"
+
+	# The annotation must match the number of entries in the layer.
+	sane_run tar -tzf "$IMAGE/blobs/sha256/${layerDigest#sha256:}"
+	[ "$status" -eq 0 ]
+	[ "$changedFiles" -eq "${#lines[@]}" ]
+	# The root directory, newfile, newdir, newdir/anotherfile and .wh.etc.
+	[ "$changedFiles" -eq 5 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --file-manifest" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "first file" > "$ROOTFS/newfile"
+	mkdir "$ROOTFS/newdir"
+	echo "subfile" > "$ROOTFS/newdir/anotherfile"
+	rm -rf "$ROOTFS/etc"
+
+	# Repack the image under a new tag.
+	umoci repack --file-manifest --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Get the new layer and its file manifest.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layerDigest="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	fileManifest="$(echo "$output" | jq -SMr '.history[-1].layer.annotations["ci.umo.file_manifest"]')"
+	[[ "$fileManifest" == "sha256:"* ]]
+
+	# The file manifest must list the entries in the layer, sorted by path.
+	sane_run tar -tzf "$IMAGE/blobs/sha256/${layerDigest#sha256:}"
+	[ "$status" -eq 0 ]
+	expected="$(printf '%s\n' "${lines[@]}" | LC_ALL=C sort)"
+	sane_run jq -SMr '.[].path' "$IMAGE/blobs/sha256/${fileManifest#sha256:}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+	sane_run jq -SMr '.[] | select(.path == "newfile") | .size' "$IMAGE/blobs/sha256/${fileManifest#sha256:}"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq "$(stat -c %s "$ROOTFS/newfile")" ]
+
+	# The file manifest must not be garbage collected.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "$IMAGE/blobs/sha256/${fileManifest#sha256:}" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --diffid-annotation" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "first file" > "$ROOTFS/newfile"
+	rm -rf "$ROOTFS/etc"
+
+	# Without the flag, there is no annotation.
+	umoci repack --image "${IMAGE}:${TAG}-plain" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-plain" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.annotations["ci.umo.diff_id"]')" == "null" ]]
+
+	# Repack the image under a new tag.
+	umoci repack --diffid-annotation --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The annotation must match the diffid in the configuration.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layerDigest="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	diffID="$(echo "$output" | jq -SMr '.history[-1].diff_id')"
+	annotation="$(echo "$output" | jq -SMr '.history[-1].layer.annotations["ci.umo.diff_id"]')"
+	[[ "$diffID" == "sha256:"* ]]
+	[[ "$annotation" == "$diffID" ]]
+
+	# ... and the uncompressed layer.
+	uncompressed="$(gzip -dc "$IMAGE/blobs/sha256/${layerDigest#sha256:}" | sha256sum | cut -d' ' -f1)"
+	[[ "sha256:$uncompressed" == "$diffID" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --force-owner" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "first file" > "$ROOTFS/newfile"
+	mkdir "$ROOTFS/newdir"
+	echo "subfile" > "$ROOTFS/newdir/anotherfile"
+	rm -rf "$ROOTFS/etc"
+
+	# Repack the image under a new tag.
+	umoci repack --force-owner 0:0 --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layer must be annotated with the forced owner.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layerDigest="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	forcedOwner="$(echo "$output" | jq -SMr '.history[-1].layer.annotations["ci.umo.forced_owner"]')"
+	[[ "$forcedOwner" == "0:0" ]]
+
+	# Every entry in the layer (including whiteouts) must be owned by 0:0.
+	sane_run tar -tvzf "$IMAGE/blobs/sha256/${layerDigest#sha256:}" --numeric-owner
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	for line in "${lines[@]}"; do
+		[[ "$(echo "$line" | awk '{ print $2 }')" == "0/0" ]]
+	done
+
+	# Invalid owners are rejected.
+	for owner in "" "0" "0:0:0" "root:root" "-1:0"; do
+		umoci repack --force-owner "$owner" --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --layer-media-type" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "first file" > "$ROOTFS/newfile"
+
+	# Repack the image with a custom layer media-type.
+	umoci repack --layer-media-type "application/vnd.example.layer.v1.tar" --compress zstd --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The compression suffix must be appended to the media-type.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	mediaType="$(echo "$output" | jq -SMr '.history[-1].layer.mediaType')"
+	[[ "$mediaType" == "application/vnd.example.layer.v1.tar+zstd" ]]
+
+	# Invalid media-types are rejected.
+	for mediaType in "" "tar" "application/" "application/tar; charset=utf-8"; do
+		umoci repack --layer-media-type "$mediaType" --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+
+	# Validators don't know about the custom media-type, so remove the image
+	# before verifying the layout.
+	umoci rm --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
 @test "umoci repack [invalid arguments]" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -856,6 +1050,43 @@ function teardown() {
 	[ "$numLinesC" -gt "$numLinesB" ]
 }
 
+@test "umoci repack --lint-symlinks" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some symlinks.
+	mkdir -p "$ROOTFS/lint/sub"
+	ln -s /etc/passwd "$ROOTFS/lint/absolute"
+	ln -s ../../../etc/passwd "$ROOTFS/lint/sub/escaping"
+	ln -s ../../etc/passwd "$ROOTFS/lint/sub/fine"
+
+	# Without --lint-symlinks there are no warnings.
+	umoci repack --image "${IMAGE}:${TAG}-nolint" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"lint: symlink"* ]]
+	image-verify "${IMAGE}"
+
+	# With --lint-symlinks the suspicious symlinks are reported.
+	umoci repack --lint-symlinks --image "${IMAGE}:${TAG}-lint" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"lint: symlink lint/absolute -> /etc/passwd"* ]]
+	[[ "$output" == *"lint: symlink lint/sub/escaping -> ../../../etc/passwd"* ]]
+	[[ "$output" != *"lint: symlink lint/sub/fine"* ]]
+	image-verify "${IMAGE}"
+
+	# The lint doesn't change the generated layer.
+	umoci stat --image "${IMAGE}:${TAG}-nolint" --json
+	[ "$status" -eq 0 ]
+	nolintLayer="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	umoci stat --image "${IMAGE}:${TAG}-lint" --json
+	[ "$status" -eq 0 ]
+	lintLayer="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	[[ "$nolintLayer" == "$lintLayer" ]]
+}
+
 @test "umoci repack (empty diff)" {
 	# Unpack the original image
 	new_bundle_rootfs
@@ -876,3 +1107,122 @@ function teardown() {
 	layers1=$(cat "${IMAGE}/oci/blobs/sha256/$manifest1" | jq -r .layers)
 	[ "$layers0" == "$layers1" ]
 }
+
+@test "umoci repack --output-descriptor" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$ROOTFS/newfile"
+	umoci repack --output-descriptor "$UMOCI_TMPDIR/descriptor.json" --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The written descriptor must match the new manifest.
+	manifest="$(jq -SMr --arg tag "${TAG}-new" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag)' "$IMAGE/index.json")"
+	[[ "$(jq -SMr '.descriptor.digest' "$UMOCI_TMPDIR/descriptor.json")" == "$(echo "$manifest" | jq -SMr '.digest')" ]]
+	[[ "$(jq -SMr '.descriptor.size' "$UMOCI_TMPDIR/descriptor.json")" == "$(echo "$manifest" | jq -SMr '.size')" ]]
+	[[ "$(jq -SMr '.descriptor.mediaType' "$UMOCI_TMPDIR/descriptor.json")" == "application/vnd.oci.image.manifest.v1+json" ]]
+	[[ "$(jq -SMr '.descriptor_path.descriptor_walk[-1].digest' "$UMOCI_TMPDIR/descriptor.json")" == "$(echo "$manifest" | jq -SMr '.digest')" ]]
+
+	# Other commands write the same format.
+	umoci tag --output-descriptor "$UMOCI_TMPDIR/tag.json" --image "${IMAGE}:${TAG}-new" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.descriptor.digest' "$UMOCI_TMPDIR/tag.json")" == "$(jq -SMr '.descriptor.digest' "$UMOCI_TMPDIR/descriptor.json")" ]]
+	[[ "$(jq -SMr '.descriptor.annotations["org.opencontainers.image.ref.name"]' "$UMOCI_TMPDIR/tag.json")" == "${TAG}-copy" ]]
+}
+
+@test "umoci repack --history-template" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$ROOTFS/newfile"
+
+	# {files} is not supported by repack.
+	umoci repack --image "${IMAGE}:${TAG}-new" --history-template "{op} {files}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" \
+		--history.created="2021-03-14T15:09:26Z" \
+		--history-template "umoci {op} at {time}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci repack at 2021-03-14T15:09:26Z" ]]
+}
+
+@test "umoci repack --gc-after" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create an image which is only referenced by a single tag.
+	echo "first file" > "$ROOTFS/first"
+	umoci repack --refresh-bundle --image "${IMAGE}:${TAG}-gc" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-gc" --json
+	[ "$status" -eq 0 ]
+	oldlayer="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	oldmanifest="$(jq -SMr --arg tag "${TAG}-gc" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json")"
+	oldconfig="$(jq -SMr '.config.digest' "$IMAGE/blobs/${oldmanifest/://}")"
+	[ -f "$IMAGE/blobs/${oldmanifest/://}" ]
+	[ -f "$IMAGE/blobs/${oldconfig/://}" ]
+
+	# Replace that image, and make sure its unique blobs are removed.
+	echo "second file" > "$ROOTFS/second"
+	umoci repack --gc-after --refresh-bundle --image "${IMAGE}:${TAG}-gc" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	! [ -e "$IMAGE/blobs/${oldmanifest/://}" ]
+	! [ -e "$IMAGE/blobs/${oldconfig/://}" ]
+	# Blobs still used by the new image must remain.
+	[ -f "$IMAGE/blobs/${oldlayer/://}" ]
+
+	# Other tags must be unaffected.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# The new image must still be usable.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-gc" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/first" ]
+	[ -f "$ROOTFS/second" ]
+}
+
+@test "umoci repack --verify-baseline" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "some file" > "$ROOTFS/newfile"
+
+	# Hide the baseline mtree manifest.
+	baseline="$(echo "$BUNDLE"/*.mtree)"
+	[ -f "$baseline" ]
+	mv "$baseline" "$baseline.hidden"
+
+	umoci repack --verify-baseline --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"verify baseline"* ]]
+	[[ "$output" == *"missing"* ]]
+
+	# With the baseline restored, the repack succeeds.
+	mv "$baseline.hidden" "$baseline"
+
+	umoci repack --verify-baseline --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
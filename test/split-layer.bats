@@ -0,0 +1,107 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci split-layer" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')"
+	[ "$numLayers" -ge 1 ]
+
+	umoci split-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-split" --layer "$((numLayers - 1))" --by-path /usr,/etc
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# There must be more layers than before.
+	umoci stat --image "${IMAGE}:${TAG}-split" --json
+	[ "$status" -eq 0 ]
+	newNumLayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')"
+	[ "$newNumLayers" -gt "$numLayers" ]
+
+	# The contents must be unchanged.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_A="$BUNDLE"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	BUNDLE_B="$BUNDLE"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+}
+
+@test "umoci split-layer --concurrency" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')"
+	[ "$numLayers" -ge 1 ]
+
+	umoci split-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-serial" --layer "$((numLayers - 1))" --by-path /usr,/etc,/var,/bin
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci split-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-concurrent" --concurrency 4 --layer "$((numLayers - 1))" --by-path /usr,/etc,/var,/bin
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The resulting images must be identical.
+	umoci stat --image "${IMAGE}:${TAG}-serial" --json
+	[ "$status" -eq 0 ]
+	serial="$output"
+	umoci stat --image "${IMAGE}:${TAG}-concurrent" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$serial" ]]
+
+	serialDigest="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-serial"'") | .digest' "${IMAGE}/index.json")"
+	concurrentDigest="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-concurrent"'") | .digest' "${IMAGE}/index.json")"
+	[ -n "$serialDigest" ]
+	[[ "$serialDigest" == "$concurrentDigest" ]]
+
+	# --concurrency must be positive.
+	umoci split-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --concurrency 0 --layer "$((numLayers - 1))" --by-path /usr
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci split-layer [invalid arguments]" {
+	# --layer and --by-path are mandatory.
+	umoci split-layer --image "${IMAGE}:${TAG}" --by-path /usr
+	[ "$status" -ne 0 ]
+	umoci split-layer --image "${IMAGE}:${TAG}" --layer 0
+	[ "$status" -ne 0 ]
+
+	# The root directory cannot be a prefix.
+	umoci split-layer --image "${IMAGE}:${TAG}" --layer 0 --by-path /
+	[ "$status" -ne 0 ]
+
+	# Out-of-range layers are rejected.
+	umoci split-layer --image "${IMAGE}:${TAG}" --layer 1000 --by-path /usr
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
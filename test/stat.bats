@@ -63,6 +63,56 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --security-lint" {
+	# Create some risky files.
+	INSERTDIR="$(setup_tmpdir)"
+	mkdir -p "$INSERTDIR/bin" "$INSERTDIR/shared" "$INSERTDIR/tmp"
+	echo "binary" > "$INSERTDIR/bin/setuid"
+	chmod 4755 "$INSERTDIR/bin/setuid"
+	echo "binary" > "$INSERTDIR/bin/normal"
+	chmod 0755 "$INSERTDIR/bin/normal"
+	chmod 0777 "$INSERTDIR/shared"
+	chmod 1777 "$INSERTDIR/tmp"
+
+	umoci insert --image "${IMAGE}:${TAG}" "$INSERTDIR" /lint
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Without --security-lint there are no issues listed.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.security_issues' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --security-lint --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# Both the setuid binary and the world-writable directory are reported.
+	sane_run jq -SMr '.security_issues[] | select(.path == "lint/bin/setuid") | .problem' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "setuid file" ]]
+	sane_run jq -SMr '.security_issues[] | select(.path == "lint/shared/") | .problem' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "world-writable directory without sticky bit" ]]
+
+	# But not the safe entries.
+	sane_run jq -SMr '[.security_issues[] | select(.path == "lint/bin/normal" or .path == "lint/tmp/")] | length' "$statFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# The human-readable output also includes the issues.
+	umoci stat --image "${IMAGE}:${TAG}" --security-lint
+	[ "$status" -eq 0 ]
+	echo "$output" | grep 'PROBLEM'
+	echo "$output" | grep 'lint/bin/setuid'
+	echo "$output" | grep 'lint/shared/'
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci stat [invalid arguments]" {
 	# Missing --image argument.
 	umoci stat
@@ -112,3 +162,45 @@ function teardown() {
 
 # TODO: Add a test to make sure that empty_layer and layer are mutually
 #	   exclusive. Unfortunately, jq doesn't provide an XOR operator...
+
+@test "umoci stat --last" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	sane_run jq -SMr '.history | length' "$statFile"
+	[ "$status" -eq 0 ]
+	numHistory="$output"
+	[ "$numHistory" -ge 1 ]
+
+	# Only the last entry is output.
+	umoci stat --image "${IMAGE}:${TAG}" --json --last 1
+	[ "$status" -eq 0 ]
+	lastFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$lastFile"
+
+	sane_run jq -SMr '.history | length' "$lastFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+
+	sane_run jq -SMr '.history[-1]' "$statFile"
+	[ "$status" -eq 0 ]
+	expected="$output"
+	sane_run jq -SMr '.history[0]' "$lastFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# Asking for more entries than exist outputs everything.
+	umoci stat --image "${IMAGE}:${TAG}" --json --last "$((numHistory + 10))"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.history | length' <<<"$output"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq "$numHistory" ]
+
+	# Negative values are rejected.
+	umoci stat --image "${IMAGE}:${TAG}" --last -1
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
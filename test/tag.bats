@@ -184,8 +184,30 @@ function teardown() {
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
 
-	# Clobber the tag.
+	umoci stat --image "${IMAGE}:${NEW_TAG}" --json
+	[ "$status" -eq 0 ]
+	modifiedOutput="$output"
+
+	# Clobbering the tag without --overwrite fails.
 	umoci tag --image "${IMAGE}:${TAG}" "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${NEW_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$modifiedOutput" ]]
+
+	# --if-not-exists is a no-op if the tag exists.
+	umoci tag --image "${IMAGE}:${TAG}" --if-not-exists "${NEW_TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${NEW_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$modifiedOutput" ]]
+
+	# Clobber the tag.
+	umoci tag --image "${IMAGE}:${TAG}" --overwrite "${NEW_TAG}"
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
 
@@ -202,6 +224,70 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci tag --if-not-exists" {
+	NEW_TAG="${TAG}-newtag"
+
+	# --if-not-exists creates tags which don't exist.
+	umoci tag --image "${IMAGE}:${TAG}" --if-not-exists "${NEW_TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${IMAGE}:${NEW_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$oldOutput" ]]
+
+	# --overwrite and --if-not-exists are mutually exclusive.
+	umoci tag --image "${IMAGE}:${TAG}" --overwrite --if-not-exists "${NEW_TAG}-other"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${NEW_TAG}-other" --json
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci --relaxed-refs tag" {
+	# Tags which are invalid according to the OCI specification are rejected
+	# by default.
+	umoci tag --image "${IMAGE}:${TAG}" "v1.0~rc1"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# With --relaxed-refs they are sanitized instead.
+	umoci --relaxed-refs tag --image "${IMAGE}:${TAG}" "v1.0~rc1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	printf '%s\n' "${lines[@]}" | grep -Fx "v1.0_rc1"
+	! printf '%s\n' "${lines[@]}" | grep -Fx "v1.0~rc1"
+
+	# The original name is recorded in the index.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "v1.0_rc1") | .annotations["ci.umo.original_ref_name"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "v1.0~rc1" ]]
+
+	# The original name can be used to refer to the tag with --relaxed-refs.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci --relaxed-refs stat --image "${IMAGE}:v1.0~rc1" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$oldOutput" ]]
+
+	# But not without it.
+	umoci stat --image "${IMAGE}:v1.0~rc1" --json
+	[ "$status" -ne 0 ]
+
+	# Tags with nothing that can be salvaged are still rejected.
+	umoci --relaxed-refs tag --image "${IMAGE}:${TAG}" "~~~"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
 @test "umoci remove" {
 	# How many tags?
 	umoci list --layout "${IMAGE}"
@@ -154,6 +154,219 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --sequential-io" {
+	# Unpack the image normally.
+	new_bundle_rootfs && BUNDLE_A="$BUNDLE" ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Unpack it again with --sequential-io.
+	new_bundle_rootfs && BUNDLE_B="$BUNDLE" ROOTFS_B="$ROOTFS"
+	umoci unpack --sequential-io --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The results must be identical.
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	gomtree -p "$ROOTFS_B" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --no-clobber-type-change" {
+	# Create a layer with a non-empty directory.
+	LAYER="$(setup_tmpdir)"
+	mkdir "$LAYER/dir"
+	echo "layer1" > "$LAYER/dir/file"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer1.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	# Create a layer which replaces the directory with a regular file.
+	LAYER="$(setup_tmpdir)"
+	echo "layer2" > "$LAYER/dir"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer2.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	umoci new --image "${IMAGE}:${TAG}-typechange"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}-typechange" "$UMOCI_TMPDIR/layer1.tar"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}-typechange" "$UMOCI_TMPDIR/layer2.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# By default the directory is clobbered.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-typechange" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/dir" ]
+	sane_run cat "$ROOTFS/dir"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"layer2"* ]]
+
+	# With --no-clobber-type-change, unpacking must fail.
+	new_bundle_rootfs
+	umoci unpack --no-clobber-type-change --image "${IMAGE}:${TAG}-typechange" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"type change"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --strict-xattr" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Set some user.* xattrs, as well as a forbidden xattr.
+	mkdir -p "$ROOTFS/strict"
+	xattr -w user.strict.value "strict xattr" "$ROOTFS/strict"
+	xattr -w "user.UMOCI:forbidden_xattr" "should not exist" "$ROOTFS/strict"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}:${TAG}-xattr" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpacking with --strict-xattr must work, since all of the xattrs can be
+	# applied (and forbidden xattrs are still skipped).
+	new_bundle_rootfs
+	umoci unpack --strict-xattr --image "${IMAGE}:${TAG}-xattr" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run xattr -p user.strict.value "$ROOTFS/strict"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "strict xattr" ]]
+	sane_run xattr -p "user.UMOCI:forbidden_xattr" "$ROOTFS/strict"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --selinux-labels" {
+	if [ ! -e /sys/fs/selinux/enforce ] || ! command -v matchpathcon >/dev/null; then
+		skip "test requires selinux"
+	fi
+
+	# Unpack the image with labels from the host policy.
+	new_bundle_rootfs
+	umoci unpack --selinux-labels --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Paths must be labeled according to their path inside the rootfs.
+	for path in /etc /etc/passwd /usr/bin; do
+		[ -e "$ROOTFS$path" ] || continue
+		sane_run matchpathcon -n "$path"
+		[ "$status" -eq 0 ]
+		expected="$output"
+		sane_run stat -c %C "$ROOTFS$path"
+		[ "$status" -eq 0 ]
+		[[ "$output" == "$expected" ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --preserve-meta" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add a custom field to umoci.json.
+	sane_run jq -SMc '. + {"custom_field": {"owner": "me"}}' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	echo "$output" > "$BUNDLE/umoci.json"
+
+	# Reset the bundle (keeping umoci.json) and unpack it again.
+	rm -rf "$ROOTFS" "$BUNDLE/config.json" "$BUNDLE"/*.mtree
+	umoci unpack --preserve-meta --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The custom field must have been preserved.
+	[[ "$(jq -SMr '.custom_field.owner' "$BUNDLE/umoci.json")" == "me" ]]
+	[[ "$(jq -SMr '.umoci_version' "$BUNDLE/umoci.json")" == "2" ]]
+
+	# Repacking the bundle also keeps the field.
+	echo "new file" > "$ROOTFS/newfile"
+	umoci repack --refresh-bundle --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(jq -SMr '.custom_field.owner' "$BUNDLE/umoci.json")" == "me" ]]
+
+	# Without --preserve-meta, umoci.json is overwritten.
+	rm -rf "$ROOTFS" "$BUNDLE/config.json" "$BUNDLE"/*.mtree
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.custom_field' "$BUNDLE/umoci.json")" == "null" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --no-meta" {
+	new_bundle_rootfs
+	umoci unpack --no-meta --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The bundle must be usable, but have no metadata.
+	[ -f "$BUNDLE/config.json" ]
+	[ -d "$ROOTFS" ]
+	sane_run find "$ROOTFS" -mindepth 1 -maxdepth 1
+	[ "${#lines[@]}" -gt 0 ]
+	! [ -e "$BUNDLE/umoci.json" ]
+	sane_run find "$BUNDLE" -maxdepth 1 -name '*.mtree'
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Repacking the bundle must fail with a clear error.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"no umoci.json metadata"* ]]
+
+	# --no-meta cannot be combined with options which need the metadata.
+	new_bundle_rootfs
+	umoci unpack --no-meta --preserve-meta --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --no-meta --record-entry-order --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --no-meta --self-check --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --self-check" {
+	new_bundle_rootfs
+	umoci unpack --self-check --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The bundle is a normal bundle.
+	[ -f "$BUNDLE/umoci.json" ]
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The check also works with concurrent hashing.
+	new_bundle_rootfs
+	umoci unpack --self-check --mtree-concurrency 4 --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci unpack [setuid]" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -354,3 +567,119 @@ function teardown() {
 	[ "$(readlink "$ROOTFS/loop3")" = "link2/loop4" ]
 	[ "$(readlink "$ROOTFS/dir/loop4")" = "../loop1" ]
 }
+
+@test "umoci unpack --hint-annotations" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-hints" \
+		--manifest.annotation "org.example.hint.whiteout-mode=overlayfs" \
+		--manifest.annotation "org.example.hint.compression=zstd"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Without --hint-annotations the annotations are ignored.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-hints" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.whiteout_mode' "$BUNDLE/umoci.json")" == 0 ]]
+	[[ "$(jq -SMr '.compression' "$BUNDLE/umoci.json")" == "null" ]]
+
+	new_bundle_rootfs
+	umoci unpack --hint-annotations org.example.hint --image "${IMAGE}:${TAG}-hints" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.whiteout_mode' "$BUNDLE/umoci.json")" == 1 ]]
+	[[ "$(jq -SMr '.compression' "$BUNDLE/umoci.json")" == "zstd" ]]
+
+	# New layers use the requested compression.
+	echo "new file" > "$ROOTFS/hint-file"
+	umoci repack --image "${IMAGE}:${TAG}-hints" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci raw unpack --image "${IMAGE}:${TAG}-hints" "$UMOCI_TMPDIR/raw"
+	[ "$status" -eq 0 ]
+	[ -f "$UMOCI_TMPDIR/raw/hint-file" ]
+
+	# Invalid hints are rejected.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-badhints" \
+		--manifest.annotation "org.example.hint.whiteout-mode=aufs"
+	[ "$status" -eq 0 ]
+	new_bundle_rootfs
+	umoci unpack --hint-annotations org.example.hint --image "${IMAGE}:${TAG}-badhints" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci unpack --reflink-from" {
+	# Do an initial unpack, and then modify the bundle.
+	new_bundle_rootfs
+	BUNDLE_A="$BUNDLE"
+	ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	modified="$(find "$ROOTFS_A" -type f -size +1k | head -n1)"
+	[ -n "$modified" ]
+	printf 'modified' | dd of="$modified" bs=1 seek=100 conv=notrunc
+	rm -rf "$ROOTFS_A/etc"
+
+	# Re-unpacking with --reflink-from must give a pristine rootfs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --reflink-from "$BUNDLE_A" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	gomtree -p "$ROOTFS" -f "$BUNDLE"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	[ -d "$ROOTFS/etc" ]
+	sane_run cmp "$modified" "$ROOTFS/${modified#"$ROOTFS_A/"}"
+	[ "$status" -ne 0 ]
+
+	# --reflink-from must refer to a bundle.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --reflink-from "$ROOTFS_A" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci unpack --platform" {
+	# Create a multi-platform image.
+	umoci config --image "${IMAGE}:${TAG}" --os linux --architecture amd64 --tag "${TAG}-amd64"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --os linux --architecture arm64 --tag "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	umoci index --image "${IMAGE}:${TAG}-multi" "${TAG}-amd64" "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+
+	for arch in amd64 arm64; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-multi" --platform "linux/$arch" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		# The manifest for the requested platform must have been unpacked.
+		[[ "$(jq -SMr '.platform.architecture' "$BUNDLE/umoci.json")" == "$arch" ]]
+		manifest="$(jq -SMr '.from_descriptor_path.descriptor_walk[-1].digest' "$BUNDLE/umoci.json")"
+		expected="$(jq -SMr --arg tag "${TAG}-$arch" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json")"
+		[[ "$manifest" == "$expected" ]]
+	done
+
+	# There is no manifest for this platform.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-multi" --platform linux/s390x "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"no manifest matches platform linux/s390x"* ]]
+
+	# The platform of a single-platform image is also checked.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-arm64" --platform linux/amd64 "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Invalid platforms.
+	for platform in "" linux linux/ /amd64 linux/arm/v7/extra; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-multi" --platform "$platform" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
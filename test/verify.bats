@@ -0,0 +1,85 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2024 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci verify [missing arguments]" {
+	# Missing --layout argument.
+	umoci verify
+	[ "$status" -ne 0 ]
+
+	# Invalid --concurrency.
+	umoci verify --layout "${IMAGE}" --concurrency 0
+	[ "$status" -ne 0 ]
+
+	# Unknown tag.
+	umoci verify --layout "${IMAGE}" this-tag-does-not-exist
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci verify" {
+	# Create a few extra tags with their own layers.
+	for tag in a b c; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "$tag" --config.label "verify=$tag"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	# Everything should verify.
+	umoci verify --layout "${IMAGE}" --concurrency 3
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${TAG}: OK"* ]]
+	for tag in a b c; do
+		[[ "$output" == *"$tag: OK"* ]]
+	done
+
+	# Only verify the given tags, in order.
+	umoci verify --layout "${IMAGE}" --concurrency 2 c a
+	[ "$status" -eq 0 ]
+	[ "${lines[0]}" = "c: OK" ]
+	[ "${lines[1]}" = "a: OK" ]
+
+	# Corrupt the config of "b".
+	local manifest="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "b") | .digest' "$IMAGE/index.json" | cut -d: -f2)"
+	local config="$(jq -SMr '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)"
+	config="$IMAGE/blobs/sha256/$config"
+	chmod +w "$config"
+	echo "corrupted" >>"$config"
+
+	# Only "b" should fail (and the others should still be verified).
+	umoci verify --layout "${IMAGE}" --concurrency 2 a b c
+	[ "$status" -ne 0 ]
+	[ "${lines[0]}" = "a: OK" ]
+	[[ "${lines[1]}" == "b: FAILED: "* ]]
+	[ "${lines[2]}" = "c: OK" ]
+
+	# With --fail-fast, tags after "b" are aborted.
+	umoci verify --layout "${IMAGE}" --fail-fast b a c
+	[ "$status" -ne 0 ]
+	[[ "${lines[0]}" == "b: FAILED: "* ]]
+	[[ "${lines[1]}" == "a: FAILED: "*"aborted"* ]]
+	[[ "${lines[2]}" == "c: FAILED: "*"aborted"* ]]
+}
@@ -18,9 +18,14 @@
 package umoci
 
 import (
+	"archive/tar"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/apex/log"
@@ -30,27 +35,65 @@ import (
 	"github.com/opencontainers/umoci/pkg/fseval"
 )
 
-// Unpack unpacks an image to the specified bundle path.
+// Unpack unpacks an image to the specified bundle path. If the tag refers to
+// a multi-platform image (or unpackOptions.Platform has an OS and
+// architecture), the manifest for unpackOptions.Platform is unpacked. If no
+// platform was given, the manifest for the host platform is used.
 func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions) error {
-	var meta Meta
-	meta.Version = MetaVersion
-	meta.MapOptions = unpackOptions.MapOptions
-	meta.WhiteoutMode = unpackOptions.WhiteoutMode
+	ctx := context.Background()
 
-	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	fromDescriptorPaths, err := engineExt.ResolveReference(ctx, fromName)
 	if err != nil {
 		return fmt.Errorf("get descriptor: %w", err)
 	}
 	if len(fromDescriptorPaths) == 0 {
 		return fmt.Errorf("tag is not found: %s", fromName)
 	}
-	if len(fromDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return fmt.Errorf("tag is ambiguous: %s", fromName)
+
+	fromDescriptorPath := fromDescriptorPaths[0]
+	platform := unpackOptions.Platform
+	if len(fromDescriptorPaths) != 1 || (platform.OS != "" && platform.Architecture != "") {
+		// We can only pick between the manifests of a single index.
+		root := fromDescriptorPath.Walk[0]
+		for _, descriptorPath := range fromDescriptorPaths[1:] {
+			if descriptorPath.Walk[0].Digest != root.Digest {
+				return fmt.Errorf("tag is ambiguous: %s", fromName)
+			}
+		}
+		if platform.OS == "" || platform.Architecture == "" {
+			platform = ispec.Platform{
+				OS:           runtime.GOOS,
+				Architecture: runtime.GOARCH,
+			}
+		}
+		fromDescriptorPath, err = engineExt.ResolvePlatform(ctx, root, platform)
+		if err != nil {
+			return fmt.Errorf("resolve platform for tag %s: %w", fromName, err)
+		}
+	}
+	return UnpackManifest(ctx, engineExt, fromDescriptorPath, bundlePath, &unpackOptions)
+}
+
+// UnpackManifest unpacks the image manifest referenced by fromDescriptorPath
+// to the specified bundle path, generating the same bundle (including the
+// umoci.json metadata and mtree manifest, unless opt.NoMeta is set) as Unpack. Unlike Unpack, the image
+// is identified by a descriptor path rather than a tag, which allows callers
+// to unpack images which are not tagged. opt may be nil, in which case the
+// default UnpackOptions are used.
+func UnpackManifest(ctx context.Context, engineExt casext.Engine, fromDescriptorPath casext.DescriptorPath, bundlePath string, opt *layer.UnpackOptions) error {
+	var unpackOptions layer.UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
 	}
-	meta.From = fromDescriptorPaths[0]
 
-	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
+	var meta Meta
+	meta.Version = MetaVersion
+	meta.MapOptions = unpackOptions.MapOptions
+	meta.WhiteoutMode = unpackOptions.WhiteoutMode
+	meta.From = fromDescriptorPath
+	meta.Platform = fromDescriptorPath.Platform()
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, meta.From.Descriptor())
 	if err != nil {
 		return fmt.Errorf("get manifest: %w", err)
 	}
@@ -63,7 +106,7 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
 	log.WithFields(log.Fields{
 		"bundle": bundlePath,
-		"ref":    fromName,
+		"from":   meta.From.Descriptor().Digest,
 		"rootfs": layer.RootfsName,
 	}).Debugf("umoci: unpacking OCI image")
 
@@ -74,31 +117,106 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 		return fmt.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
 	}
 
+	// Apply any options requested by the image, if the user opted in.
+	if prefix := unpackOptions.AnnotationHintPrefix; prefix != "" {
+		hints, err := ParseAnnotationHints(manifest.Annotations, prefix)
+		if err != nil {
+			return fmt.Errorf("parse manifest annotation hints: %w", err)
+		}
+		// Options explicitly set by the user take precedence over the image.
+		// An explicit request for the default whiteout mode cannot be told
+		// apart from the default, so only the default is overridden.
+		if hints.WhiteoutMode != nil {
+			if unpackOptions.WhiteoutMode != layer.OCIStandardWhiteout {
+				log.Debugf("umoci: ignoring whiteout mode %d from manifest annotation hints in favour of %d", *hints.WhiteoutMode, unpackOptions.WhiteoutMode)
+			} else {
+				log.Debugf("umoci: using whiteout mode %d from manifest annotation hints", *hints.WhiteoutMode)
+				unpackOptions.WhiteoutMode = *hints.WhiteoutMode
+				meta.WhiteoutMode = *hints.WhiteoutMode
+			}
+		}
+		if hints.Compression != "" {
+			log.Debugf("umoci: using compression %q from manifest annotation hints", hints.Compression)
+			meta.Compression = hints.Compression
+		}
+	}
+
+	if unpackOptions.NoMeta && (unpackOptions.PreserveMeta || unpackOptions.RecordEntryOrder) {
+		return errors.New("bundle metadata cannot be preserved or recorded if it is not written")
+	}
+	if unpackOptions.NoMeta && unpackOptions.SelfCheck {
+		return errors.New("bundle cannot be self-checked if its mtree manifest is not written")
+	}
+
+	// Keep any user fields from an earlier unpack into the bundle.
+	if unpackOptions.PreserveMeta {
+		extra, err := readBundleMetaExtra(bundlePath)
+		if err != nil {
+			return fmt.Errorf("preserve umoci.json metadata: %w", err)
+		}
+		meta.Extra = extra
+	}
+
 	// Unpack the runtime bundle.
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return fmt.Errorf("create bundle path: %w", err)
 	}
 	// XXX: We should probably defer os.RemoveAll(bundlePath).
 
+	if unpackOptions.RecordEntryOrder {
+		var entries []string
+		afterEntryUnpack := unpackOptions.AfterEntryUnpack
+		unpackOptions.AfterEntryUnpack = func(hdr *tar.Header) error {
+			entries = append(entries, hdr.Name)
+			if afterEntryUnpack != nil {
+				return afterEntryUnpack(hdr)
+			}
+			return nil
+		}
+		afterLayerUnpack := unpackOptions.AfterLayerUnpack
+		unpackOptions.AfterLayerUnpack = func(manifest ispec.Manifest, desc ispec.Descriptor) error {
+			meta.EntryOrder = append(meta.EntryOrder, LayerEntryOrder{
+				Layer:   desc.Digest,
+				Entries: entries,
+			})
+			entries = nil
+			if afterLayerUnpack != nil {
+				return afterLayerUnpack(manifest, desc)
+			}
+			return nil
+		}
+	}
+
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &unpackOptions); err != nil {
+	if err := layer.UnpackManifest(ctx, engineExt, bundlePath, manifest, &unpackOptions); err != nil {
 		return fmt.Errorf("create runtime bundle: %w", err)
 	}
 	log.Info("... done")
 
+	if unpackOptions.NoMeta {
+		log.Infof("unpacked image bundle (without metadata): %s", bundlePath)
+		return nil
+	}
+
 	fsEval := fseval.Default
 	if meta.MapOptions.Rootless {
 		fsEval = fseval.Rootless
 	}
 
-	if err := GenerateBundleManifest(mtreeName, bundlePath, fsEval); err != nil {
+	if err := GenerateBundleManifestParallel(mtreeName, bundlePath, fsEval, unpackOptions.MtreeConcurrency); err != nil {
 		return fmt.Errorf("write mtree: %w", err)
 	}
+	if unpackOptions.SelfCheck {
+		if err := VerifyBundleManifest(mtreeName, bundlePath, fsEval, unpackOptions.MtreeConcurrency); err != nil {
+			return fmt.Errorf("self-check: %w", err)
+		}
+	}
 
 	log.WithFields(log.Fields{
 		"version":     meta.Version,
 		"from":        meta.From,
 		"map_options": meta.MapOptions,
+		"platform":    meta.Platform,
 	}).Debugf("umoci: saving Meta metadata")
 
 	if err := WriteBundleMeta(bundlePath, meta); err != nil {
@@ -108,3 +226,24 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// readBundleMetaExtra returns the fields of the existing umoci.json in the
+// bundle which are not managed by umoci (see Meta.Extra). Unlike
+// ReadBundleMeta, the version of the metadata is not checked (the fields are
+// not interpreted) and a missing umoci.json is not an error.
+func readBundleMetaExtra(bundlePath string) (map[string]json.RawMessage, error) {
+	fh, err := os.Open(filepath.Join(bundlePath, MetaName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open metadata: %w", err)
+	}
+	defer fh.Close()
+
+	var meta Meta
+	if err := json.NewDecoder(fh).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+	return meta.Extra, nil
+}
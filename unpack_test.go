@@ -0,0 +1,514 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+)
+
+func TestUnpackPreserveMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackPreserveMeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map root to the current user.
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	metaPath := filepath.Join(bundle, MetaName)
+	readFields := func() map[string]json.RawMessage {
+		data, err := ioutil.ReadFile(metaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("unexpected error parsing umoci.json: %+v", err)
+		}
+		return fields
+	}
+
+	// Add a user field, and modify a field managed by umoci.
+	fields := readFields()
+	fields["custom_field"] = json.RawMessage(`{"owner":"me"}`)
+	fields["whiteout_mode"] = json.RawMessage(`1`)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(metaPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// resetBundle removes everything but umoci.json from the bundle.
+	resetBundle := func() {
+		matches, err := filepath.Glob(filepath.Join(bundle, "*.mtree"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range append(matches, filepath.Join(bundle, "config.json"), filepath.Join(bundle, layer.RootfsName)) {
+			if err := os.RemoveAll(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// With PreserveMeta, the user field must survive while the fields managed
+	// by umoci are regenerated.
+	resetBundle()
+	preserveOptions := unpackOptions
+	preserveOptions.PreserveMeta = true
+	if err := Unpack(engineExt, "latest", bundle, preserveOptions); err != nil {
+		t.Fatalf("unexpected unpack error with PreserveMeta: %+v", err)
+	}
+	fields = readFields()
+	if got := string(fields["custom_field"]); got != `{"owner":"me"}` {
+		t.Errorf("user field not preserved: got %q", got)
+	}
+	if got := string(fields["whiteout_mode"]); got != "0" {
+		t.Errorf("umoci-managed field was preserved: whiteout_mode is %q", got)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatalf("unexpected error reading preserved umoci.json: %+v", err)
+	}
+	if got := string(meta.Extra["custom_field"]); got != `{"owner":"me"}` {
+		t.Errorf("user field missing from Meta.Extra: got %q", got)
+	}
+
+	// Without it, umoci.json is overwritten.
+	resetBundle()
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	if value, ok := readFields()["custom_field"]; ok {
+		t.Errorf("user field unexpectedly preserved without PreserveMeta: %s", value)
+	}
+}
+
+func TestUnpackNoMeta(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackNoMeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map root to the current user.
+	bundle := filepath.Join(dir, "bundle")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+		NoMeta: true,
+	}
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+
+	// The bundle itself must still be generated.
+	for _, name := range []string{"config.json", layer.RootfsName} {
+		if _, err := os.Lstat(filepath.Join(bundle, name)); err != nil {
+			t.Errorf("bundle is missing %s: %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, MetaName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("umoci.json was written with NoMeta: %v", err)
+	}
+	if matches, err := filepath.Glob(filepath.Join(bundle, "*.mtree")); err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Errorf("mtree manifest was written with NoMeta: %v", matches)
+	}
+
+	// The bundle cannot be repacked.
+	if _, err := ReadBundleMeta(bundle); !errors.Is(err, ErrNoBundleMeta) {
+		t.Errorf("expected ErrNoBundleMeta reading bundle metadata, got %v", err)
+	}
+	if _, err := RepackManifest(ctx, engineExt, bundle, nil, nil); !errors.Is(err, ErrNoBundleMeta) {
+		t.Errorf("expected ErrNoBundleMeta repacking bundle, got %v", err)
+	}
+
+	// NoMeta cannot be combined with options which need the metadata.
+	for name, opt := range map[string]func(*layer.UnpackOptions){
+		"PreserveMeta":     func(o *layer.UnpackOptions) { o.PreserveMeta = true },
+		"RecordEntryOrder": func(o *layer.UnpackOptions) { o.RecordEntryOrder = true },
+		"SelfCheck":        func(o *layer.UnpackOptions) { o.SelfCheck = true },
+	} {
+		badOptions := unpackOptions
+		opt(&badOptions)
+		if err := Unpack(engineExt, "latest", filepath.Join(dir, "bundle-"+name), badOptions); err == nil {
+			t.Errorf("expected NoMeta with %s to fail", name)
+		}
+	}
+}
+
+func TestUnpackSelfCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackSelfCheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map root to the current user.
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	// Create an image with some contents to check.
+	bundle := filepath.Join(dir, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, unpackOptions); err != nil {
+		t.Fatalf("unexpected unpack error: %+v", err)
+	}
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/passwd", "etc/group", "file"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, name), []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("etc/passwd", filepath.Join(rootfs, "link")); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Repack(engineExt, "latest", bundle, meta, nil, nil, false, mutator); err != nil {
+		t.Fatalf("unexpected repack error: %+v", err)
+	}
+
+	checkedBundle := filepath.Join(dir, "checked-bundle")
+	checkOptions := unpackOptions
+	checkOptions.SelfCheck = true
+	checkOptions.MtreeConcurrency = 2
+	if err := Unpack(engineExt, "latest", checkedBundle, checkOptions); err != nil {
+		t.Fatalf("unexpected self-check unpack error: %+v", err)
+	}
+	meta, err = ReadBundleMeta(checkedBundle)
+	if err != nil {
+		t.Fatalf("self-checked bundle has no metadata: %+v", err)
+	}
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	fsEval := fseval.Default
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+	if err := VerifyBundleManifest(mtreeName, checkedBundle, fsEval, 1); err != nil {
+		t.Fatalf("unexpected verify error for unmodified bundle: %+v", err)
+	}
+
+	// Any modification after unpacking must be detected.
+	checkedRootfs := filepath.Join(checkedBundle, layer.RootfsName)
+	if err := ioutil.WriteFile(filepath.Join(checkedRootfs, "file"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(checkedRootfs, "etc/group")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkedRootfs, "extra"), []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyBundleManifest(mtreeName, checkedBundle, fsEval, 1)
+	if err == nil {
+		t.Fatalf("expected verify error for modified bundle")
+	}
+	for _, path := range []string{`"file"`, `"etc/group"`, `"extra"`} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("verify error doesn't mention %s: %v", path, err)
+		}
+	}
+}
+
+func TestUnpackPlatform(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackPlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for latest: %d", len(descriptorPaths))
+	}
+
+	// Reference the image through an index with a platform.
+	platform := ispec.Platform{
+		OS:           "linux",
+		Architecture: "arm64",
+		Variant:      "v8",
+	}
+	manifestDesc := descriptorPaths[0].Descriptor()
+	manifestDesc.Annotations = nil
+	manifestDesc.Platform = &platform
+	indexDesc, err := engineExt.CreateIndex(ctx, "", []ispec.Descriptor{manifestDesc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(ctx, "multi", indexDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	unpackOptions := layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	for _, test := range []struct {
+		name     string
+		tag      string
+		platform *ispec.Platform
+	}{
+		{"Index", "multi", &platform},
+		{"Manifest", "latest", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle := filepath.Join(dir, "bundle-"+test.tag)
+			if err := Unpack(engineExt, test.tag, bundle, unpackOptions); err != nil {
+				t.Fatalf("unexpected unpack error: %+v", err)
+			}
+
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatalf("unexpected error reading umoci.json: %+v", err)
+			}
+			if !reflect.DeepEqual(meta.Platform, test.platform) {
+				t.Errorf("unexpected platform in umoci.json: expected %+v got %+v", test.platform, meta.Platform)
+			}
+
+			// The field is omitted entirely if there is no platform.
+			data, err := ioutil.ReadFile(filepath.Join(bundle, MetaName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("unexpected error parsing umoci.json: %+v", err)
+			}
+			if _, ok := fields["platform"]; ok != (test.platform != nil) {
+				t.Errorf("unexpected presence of platform field in umoci.json: %s", data)
+			}
+		})
+	}
+}
+
+func TestUnpackSelectPlatform(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackSelectPlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for latest: %d", len(descriptorPaths))
+	}
+
+	// A multi-platform index, which makes the tag resolve to more than one
+	// manifest. The same manifest is used for both platforms, so the platform
+	// recorded in umoci.json tells us which entry was selected.
+	amd64 := ispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ispec.Platform{OS: "linux", Architecture: "arm64"}
+	var manifests []ispec.Descriptor
+	for _, platform := range []ispec.Platform{amd64, arm64} {
+		platform := platform
+		manifestDesc := descriptorPaths[0].Descriptor()
+		manifestDesc.Annotations = nil
+		manifestDesc.Platform = &platform
+		manifests = append(manifests, manifestDesc)
+	}
+	indexDesc, err := engineExt.CreateIndex(ctx, "", manifests, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(ctx, "multi", indexDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default the host platform is used.
+	var hostPlatform *ispec.Platform
+	for _, platform := range []ispec.Platform{amd64, arm64} {
+		if platform.OS == runtime.GOOS && platform.Architecture == runtime.GOARCH {
+			platform := platform
+			hostPlatform = &platform
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		platform ispec.Platform
+		expected *ispec.Platform
+	}{
+		{"Amd64", amd64, &amd64},
+		{"Arm64", arm64, &arm64},
+		{"Host", ispec.Platform{}, hostPlatform},
+		{"Missing", ispec.Platform{OS: "linux", Architecture: "s390x"}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			unpackOptions := layer.UnpackOptions{
+				MapOptions: layer.MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					},
+					GIDMappings: []rspec.LinuxIDMapping{
+						{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					},
+					Rootless: os.Geteuid() != 0,
+				},
+				Platform: test.platform,
+			}
+			bundle := filepath.Join(dir, "bundle-"+test.name)
+			err := Unpack(engineExt, "multi", bundle, unpackOptions)
+			if test.expected == nil {
+				if err == nil {
+					t.Fatalf("expected unpack to fail without a matching platform")
+				}
+				if !strings.Contains(err.Error(), "no manifest matches platform") {
+					t.Errorf("unexpected unpack error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected unpack error: %+v", err)
+			}
+
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatalf("unexpected error reading umoci.json: %+v", err)
+			}
+			if !reflect.DeepEqual(meta.Platform, test.expected) {
+				t.Errorf("unpacked the wrong manifest: expected platform %+v got %+v", test.expected, meta.Platform)
+			}
+		})
+	}
+}
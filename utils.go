@@ -21,16 +21,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/apex/log"
 	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/opencontainers/umoci/oci/layer"
@@ -82,6 +88,11 @@ type Meta struct {
 	// --image argument to umoci-unpack(1).
 	From casext.DescriptorPath `json:"from_descriptor_path"`
 
+	// Platform is the platform of the unpacked image, as specified by the
+	// descriptors in From. It is only set if the image manifest was resolved
+	// through an index which specified the platform of the image.
+	Platform *ispec.Platform `json:"platform,omitempty"`
+
 	// MapOptions is the parsed version of --uid-map, --gid-map and --rootless
 	// arguments to umoci-unpack(1). While all of these options technically do
 	// not need to be the same for corresponding umoci-unpack(1) and
@@ -92,6 +103,91 @@ type Meta struct {
 	// WhiteoutMode indicates what style of whiteout was written to disk
 	// when this filesystem was extracted.
 	WhiteoutMode layer.WhiteoutMode `json:"whiteout_mode"`
+
+	// Compression is the compression used for new layers created by
+	// umoci-repack(1), in the format of the mutate.UmociCompressionAnnotation
+	// annotation. If empty, new layers are compressed with gzip.
+	Compression string `json:"compression,omitempty"`
+
+	// EntryOrder is the order of the entries in each layer that was
+	// extracted, if --record-entry-order was passed to umoci-unpack(1). It is
+	// used by umoci-repack(1) to order the entries of the new layer.
+	EntryOrder []LayerEntryOrder `json:"entry_order,omitempty"`
+
+	// Extra contains any top-level fields in umoci.json which are not known
+	// to umoci (such as fields added by users or other tools), keyed by the
+	// field name. They are written back alongside the known fields, but can
+	// never override them.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// metaFields is the set of umoci.json field names used by the known fields of
+// Meta.
+var metaFields = func() map[string]struct{} {
+	fields := map[string]struct{}{}
+	metaType := reflect.TypeOf(Meta{})
+	for idx := 0; idx < metaType.NumField(); idx++ {
+		name := strings.Split(metaType.Field(idx).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = struct{}{}
+		}
+	}
+	return fields
+}()
+
+// MarshalJSON serialises the known fields of Meta along with Extra.
+func (m Meta) MarshalJSON() ([]byte, error) {
+	type rawMeta Meta
+	data, err := json.Marshal(rawMeta(m))
+	if err != nil || len(m.Extra) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range m.Extra {
+		if _, ok := metaFields[key]; !ok {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON parses the known fields of Meta, and stores any other fields
+// in Extra.
+func (m *Meta) UnmarshalJSON(data []byte) error {
+	type rawMeta Meta
+	var meta rawMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for key, value := range fields {
+		if _, ok := metaFields[key]; ok {
+			continue
+		}
+		if meta.Extra == nil {
+			meta.Extra = map[string]json.RawMessage{}
+		}
+		meta.Extra[key] = value
+	}
+	*m = Meta(meta)
+	return nil
+}
+
+// LayerEntryOrder is the order of the entries in a single layer.
+type LayerEntryOrder struct {
+	// Layer is the digest of the layer.
+	Layer digest.Digest `json:"layer"`
+
+	// Entries are the names of the entries in the layer, in archive order.
+	Entries []string `json:"entries"`
 }
 
 // WriteTo writes a JSON-serialised version of Meta to the given io.Writer.
@@ -115,12 +211,19 @@ func WriteBundleMeta(bundle string, meta Meta) error {
 	return nil
 }
 
+// ErrNoBundleMeta is returned by ReadBundleMeta if the bundle has no
+// umoci.json metadata, such as bundles unpacked with UnpackOptions.NoMeta.
+var ErrNoBundleMeta = errors.New("bundle has no umoci.json metadata")
+
 // ReadBundleMeta reads and parses the umoci.json file from a given bundle path.
 func ReadBundleMeta(bundle string) (Meta, error) {
 	var meta Meta
 
 	fh, err := os.Open(filepath.Join(bundle, MetaName))
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return meta, ErrNoBundleMeta
+		}
 		return meta, fmt.Errorf("open metadata: %w", err)
 	}
 	defer fh.Close()
@@ -148,6 +251,33 @@ type ManifestStat struct {
 
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// RawConfig contains the raw config blob of the manifest, if the config
+	// is not a standard image configuration (in which case History is
+	// empty).
+	RawConfig *rawConfigStat `json:"raw_config,omitempty"`
+
+	// SecurityIssues is the set of issues found by SecurityLint. It is only
+	// filled if explicitly requested, as it requires reading every layer.
+	SecurityIssues []SecurityIssue `json:"security_issues,omitempty"`
+}
+
+// rawConfigStat contains a config blob which umoci doesn't know how to parse.
+type rawConfigStat struct {
+	// MediaType is the media-type of the config blob.
+	MediaType string `json:"media_type"`
+
+	// Data is the raw contents of the config blob.
+	Data []byte `json:"data"`
+}
+
+// TrimHistory discards all but the last n entries of the history of the
+// ManifestStat (the most recent changes to the image). If n is not positive,
+// or there are fewer than n entries, the history is left unchanged.
+func (ms *ManifestStat) TrimHistory(n int) {
+	if n > 0 && len(ms.History) > n {
+		ms.History = ms.History[len(ms.History)-n:]
+	}
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -157,9 +287,16 @@ type ManifestStat struct {
 //	define their own custom templates for different blocks (meaning that
 //	this should use text/template rather than using tabwriters manually.
 func (ms ManifestStat) Format(w io.Writer) error {
+	// We can only output the raw data for unknown configs.
+	if ms.RawConfig != nil {
+		fmt.Fprintf(w, "CONFIG (%s)\n", ms.RawConfig.MediaType)
+		_, err := w.Write(ms.RawConfig.Data)
+		return err
+	}
+
 	// Output history information.
 	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
-	fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tUNCOMPRESSED\tCOMMENT\n")
 	for _, histEntry := range ms.History {
 		var (
 			created   = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
@@ -167,17 +304,38 @@ func (ms ManifestStat) Format(w io.Writer) error {
 			comment   = strings.Replace(histEntry.Comment, "\t", " ", -1)
 			layerID   = "<none>"
 			size      = "<none>"
+			usize     = "<none>"
 		)
 
 		if !histEntry.EmptyLayer {
 			layerID = histEntry.Layer.Digest.String()
 			size = units.HumanSize(float64(histEntry.Layer.Size))
+			usize = "<unknown>"
+			if histEntry.UncompressedSize != nil {
+				usize = units.HumanSize(float64(*histEntry.UncompressedSize))
+			}
 		}
 
 		// TODO: We need to truncate some of the fields.
-		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, usize, comment)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
 	}
-	return tw.Flush()
+
+	// Output security lint information.
+	if len(ms.SecurityIssues) > 0 {
+		fmt.Fprintf(w, "\n")
+		tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+		fmt.Fprintf(tw, "LAYER\tPATH\tMODE\tPROBLEM\n")
+		for _, issue := range ms.SecurityIssues {
+			path := strings.Replace(issue.Path, "\t", " ", -1)
+			fmt.Fprintf(tw, "%s\t%s\t%#o\t%s\n", issue.Layer, path, issue.Mode, issue.Problem)
+		}
+		return tw.Flush()
+	}
+	return nil
 }
 
 // historyStat contains information about a single entry in the history of a
@@ -194,10 +352,33 @@ type historyStat struct {
 	// is "", then this entry is an empty_layer.
 	DiffID string `json:"diff_id"`
 
+	// UncompressedSize is the size of the uncompressed layer, if it is known
+	// without decompressing the layer (see layerUncompressedSize).
+	UncompressedSize *int64 `json:"uncompressed_size,omitempty"`
+
 	// History is embedded in the stat information.
 	ispec.History
 }
 
+// layerUncompressedSize returns the size of the uncompressed contents of the
+// given layer, if it can be determined from the descriptor alone. For
+// compressed layers this relies on mutate.UmociUncompressedBlobSizeAnnotation,
+// which is only a hint and is not verified.
+func layerUncompressedSize(desc ispec.Descriptor) (int64, bool) {
+	if value, ok := desc.Annotations[mutate.UmociUncompressedBlobSizeAnnotation]; ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && size >= 0 {
+			return size, true
+		}
+		log.Debugf("stat: ignoring invalid %s annotation %q", mutate.UmociUncompressedBlobSizeAnnotation, value)
+	}
+	switch desc.MediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable:
+		return desc.Size, true
+	}
+	return 0, false
+}
+
 // Stat computes the ManifestStat for a given manifest blob. The provided
 // descriptor must refer to an OCI Manifest.
 func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (ManifestStat, error) {
@@ -223,8 +404,24 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 	if err != nil {
 		return stat, fmt.Errorf("stat: %w", err)
 	}
-	config, ok := configBlob.Data.(ispec.Image)
-	if !ok {
+	defer configBlob.Close()
+
+	var config ispec.Image
+	switch data := configBlob.Data.(type) {
+	case ispec.Image:
+		config = data
+	case io.Reader:
+		// Custom config types can only be displayed as raw data.
+		raw, err := ioutil.ReadAll(data)
+		if err != nil {
+			return stat, fmt.Errorf("stat: read %s config: %w", configBlob.Descriptor.MediaType, err)
+		}
+		stat.RawConfig = &rawConfigStat{
+			MediaType: configBlob.Descriptor.MediaType,
+			Data:      raw,
+		}
+		return stat, nil
+	default:
 		// Should _never_ be reached.
 		return stat, fmt.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
 	}
@@ -248,6 +445,9 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		if !histEntry.EmptyLayer {
 			info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
 			info.Layer = &manifest.Layers[layerIdx]
+			if size, ok := layerUncompressedSize(*info.Layer); ok {
+				info.UncompressedSize = &size
+			}
 			layerIdx++
 		}
 
@@ -260,16 +460,25 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 // GenerateBundleManifest creates and writes an mtree of the rootfs in the given
 // bundle path, using the supplied fsEval method
 func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.FsEval) error {
+	return GenerateBundleManifestParallel(mtreeName, bundlePath, fsEval, 1)
+}
+
+// GenerateBundleManifestParallel is equivalent to GenerateBundleManifest,
+// except that the hashing of file contents is spread across up to concurrency
+// workers. The generated mtree is identical to the one GenerateBundleManifest
+// would generate.
+func GenerateBundleManifestParallel(mtreeName string, bundlePath string, fsEval mtree.FsEval, concurrency int) error {
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
-		"mtree":    mtreePath,
+		"keywords":    MtreeKeywords,
+		"mtree":       mtreePath,
+		"concurrency": concurrency,
 	}).Debugf("umoci: generating mtree manifest")
 
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := walkParallel(fullRootfsPath, MtreeKeywords, fsEval, concurrency)
 	if err != nil {
 		return fmt.Errorf("generate mtree spec: %w", err)
 	}
@@ -291,6 +500,51 @@ func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.Fs
 	return nil
 }
 
+// maxVerifyDeltas is the maximum number of differences included in the error
+// returned by VerifyBundleManifest.
+const maxVerifyDeltas = 5
+
+// VerifyBundleManifest walks the rootfs in the given bundle path (using the
+// supplied fsEval method) and compares it against the mtree previously written
+// by GenerateBundleManifest, returning an error describing the differences if
+// they don't match. As with GenerateBundleManifestParallel, files are hashed
+// by up to concurrency workers.
+func VerifyBundleManifest(mtreeName string, bundlePath string, fsEval mtree.FsEval, concurrency int) error {
+	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	fh, err := os.Open(mtreePath)
+	if err != nil {
+		return fmt.Errorf("open mtree: %w", err)
+	}
+	defer fh.Close()
+
+	spec, err := mtree.ParseSpec(fh)
+	if err != nil {
+		return fmt.Errorf("parse mtree: %w", err)
+	}
+
+	log.Info("verifying filesystem manifest ...")
+	diffs, err := checkParallel(fullRootfsPath, spec, MtreeKeywords, fsEval, concurrency)
+	if err != nil {
+		return fmt.Errorf("check mtree: %w", err)
+	}
+	log.Info("... done")
+
+	if len(diffs) == 0 {
+		return nil
+	}
+	var descriptions []string
+	for idx, diff := range diffs {
+		if idx == maxVerifyDeltas {
+			descriptions = append(descriptions, fmt.Sprintf("and %d more", len(diffs)-idx))
+			break
+		}
+		descriptions = append(descriptions, diff.String())
+	}
+	return fmt.Errorf("rootfs does not match %s: %s", filepath.Base(mtreePath), strings.Join(descriptions, "; "))
+}
+
 // ParseIdmapOptions sets up the mapping options for Meta, using
 // the arguments specified on the command line
 func ParseIdmapOptions(meta *Meta, ctx *cli.Context) error {
@@ -0,0 +1,354 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+)
+
+func TestStatCustomConfigMediaType(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestStatCustomConfigMediaType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	// A standard image has no raw config.
+	ms, err := Stat(ctx, engineExt, descriptorPaths[0].Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error in stat: %+v", err)
+	}
+	if ms.RawConfig != nil {
+		t.Errorf("unexpected raw config for standard image: %+v", ms.RawConfig)
+	}
+
+	// Switch to a custom config media-type.
+	const customMediaType = "application/vnd.umoci.test.config.v1+json"
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetConfigMediaType(ctx, customMediaType); err != nil {
+		t.Fatalf("unexpected error setting config media-type: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configReader, err := engineExt.GetBlob(ctx, manifest.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configData, err := ioutil.ReadAll(configReader)
+	configReader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err = Stat(ctx, engineExt, newDescriptorPath.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error in stat of custom config: %+v", err)
+	}
+	if ms.RawConfig == nil {
+		t.Fatalf("expected raw config for custom config media-type")
+	}
+	if ms.RawConfig.MediaType != customMediaType {
+		t.Errorf("unexpected raw config media-type: expected %q got %q", customMediaType, ms.RawConfig.MediaType)
+	}
+	if !bytes.Equal(ms.RawConfig.Data, configData) {
+		t.Errorf("unexpected raw config data: expected %q got %q", configData, ms.RawConfig.Data)
+	}
+	if len(ms.History) != 0 {
+		t.Errorf("unexpected history for custom config: %+v", ms.History)
+	}
+
+	var buf bytes.Buffer
+	if err := ms.Format(&buf); err != nil {
+		t.Fatalf("unexpected error formatting stat: %+v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "CONFIG ("+customMediaType+")\n") {
+		t.Errorf("formatted stat doesn't include the config media-type: %q", buf.String())
+	}
+	if !strings.HasSuffix(buf.String(), string(configData)) {
+		t.Errorf("formatted stat doesn't include the raw config: %q", buf.String())
+	}
+}
+
+func TestStatTrimHistory(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestStatTrimHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := []string{"entry-one", "entry-two", "entry-three", "entry-four"}
+	created := time.Now()
+	for _, comment := range comments {
+		history := &ispec.History{
+			Created:    &created,
+			Comment:    comment,
+			EmptyLayer: true,
+		}
+		if err := mutator.Set(ctx, config.Config, meta, nil, history); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	for _, test := range []struct {
+		last     int
+		expected []string
+	}{
+		{0, comments},
+		{-1, comments},
+		{2, comments[2:]},
+		{1, comments[3:]},
+		{len(comments), comments},
+		{len(comments) + 10, comments},
+	} {
+		ms, err := Stat(ctx, engineExt, newDescriptorPath.Descriptor())
+		if err != nil {
+			t.Fatalf("unexpected error in stat: %+v", err)
+		}
+		ms.TrimHistory(test.last)
+
+		if len(ms.History) != len(test.expected) {
+			t.Errorf("TrimHistory(%d): unexpected number of history entries: expected %d got %d", test.last, len(test.expected), len(ms.History))
+		}
+
+		var buf bytes.Buffer
+		if err := ms.Format(&buf); err != nil {
+			t.Fatalf("unexpected error formatting stat: %+v", err)
+		}
+		output := buf.String()
+		for _, comment := range comments {
+			want := false
+			for _, expected := range test.expected {
+				if comment == expected {
+					want = true
+				}
+			}
+			if got := strings.Contains(output, comment); got != want {
+				t.Errorf("TrimHistory(%d): history entry %q printed=%v, expected %v: %q", test.last, comment, got, want, output)
+			}
+		}
+	}
+}
+
+func TestStatUncompressedSize(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestStatUncompressedSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+	}
+
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Now()
+
+	// An empty tar archive is 1024 bytes of zeroes.
+	emptyLayer := make([]byte, 1024)
+
+	// A compressed layer with the uncompressed size annotation.
+	gzipDesc, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, bytes.NewReader(emptyLayer), &ispec.History{Created: &created, Comment: "annotated"}, mutate.GzipCompressor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same compressed layer without the annotation.
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID := config.RootFS.DiffIDs[len(config.RootFS.DiffIDs)-1]
+	bareDesc := gzipDesc
+	bareDesc.Annotations = nil
+	if err := mutator.AddExisting(ctx, bareDesc, &ispec.History{Created: &created, Comment: "bare"}, diffID); err != nil {
+		t.Fatal(err)
+	}
+	// An uncompressed layer, where the size is the blob size.
+	if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, bytes.NewReader(emptyLayer), &ispec.History{Created: &created, Comment: "uncompressed"}, mutate.NoopCompressor, nil); err != nil {
+		t.Fatal(err)
+	}
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	ms, err := Stat(ctx, engineExt, newDescriptorPath.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error in stat: %+v", err)
+	}
+	if len(ms.History) != 3 {
+		t.Fatalf("unexpected number of history entries: %d", len(ms.History))
+	}
+	for idx, expected := range []int64{1024, -1, 1024} {
+		got := ms.History[idx].UncompressedSize
+		if expected < 0 {
+			if got != nil {
+				t.Errorf("history entry %d: expected unknown uncompressed size, got %d", idx, *got)
+			}
+		} else if got == nil {
+			t.Errorf("history entry %d: expected uncompressed size %d, got unknown", idx, expected)
+		} else if *got != expected {
+			t.Errorf("history entry %d: expected uncompressed size %d, got %d", idx, expected, *got)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ms.Format(&buf); err != nil {
+		t.Fatalf("unexpected error formatting stat: %+v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected number of lines in formatted stat: %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "UNCOMPRESSED") {
+		t.Errorf("formatted stat header doesn't include uncompressed size: %q", lines[0])
+	}
+	for idx, expected := range []string{"1.024kB", "<unknown>", "1.024kB"} {
+		fields := strings.Fields(lines[idx+1])
+		if len(fields) < 2 || fields[len(fields)-2] != expected {
+			t.Errorf("history entry %d: expected uncompressed size %q in %q", idx, expected, lines[idx+1])
+		}
+	}
+}
+
+func TestMetaExtra(t *testing.T) {
+	input := `{"umoci_version":"2","whiteout_mode":1,"custom":{"a":[1,2]},"other":"value"}`
+
+	var meta Meta
+	if err := json.Unmarshal([]byte(input), &meta); err != nil {
+		t.Fatalf("unexpected error parsing meta: %+v", err)
+	}
+	if meta.Version != "2" || meta.WhiteoutMode != 1 {
+		t.Errorf("known fields not parsed: %+v", meta)
+	}
+	if len(meta.Extra) != 2 || string(meta.Extra["custom"]) != `{"a":[1,2]}` || string(meta.Extra["other"]) != `"value"` {
+		t.Errorf("unexpected extra fields: %v", meta.Extra)
+	}
+
+	// Extra fields cannot override known fields.
+	meta.Extra["whiteout_mode"] = json.RawMessage(`2`)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatalf("unexpected error serialising meta: %+v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fields["whiteout_mode"]); got != "1" {
+		t.Errorf("extra field overrode known field: whiteout_mode is %s", got)
+	}
+	if got := string(fields["custom"]); got != `{"a":[1,2]}` {
+		t.Errorf("extra field not serialised: custom is %s", got)
+	}
+	if _, ok := fields["Extra"]; ok {
+		t.Errorf("Extra serialised as a field: %s", data)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// ErrBatchAborted is the error recorded by ForEachReference for references
+// which were never processed because an earlier reference failed and the
+// batch was configured to stop on the first failure.
+var ErrBatchAborted = errors.New("batch aborted after an earlier failure")
+
+// BatchResult is the outcome of processing a single reference as part of a
+// ForEachReference batch.
+type BatchResult struct {
+	// Reference is the name of the reference that was processed.
+	Reference string
+
+	// Err is the error returned while processing the reference (nil if it
+	// succeeded, ErrBatchAborted if it was never processed).
+	Err error
+}
+
+// ForEachReference calls fn for each of the given references using a pool of
+// at most concurrency workers (values less than 1 are treated as 1). The
+// results are returned in the same order as refnames. If failFast is set, the
+// context passed to fn is cancelled after the first failure and any
+// references which have not yet been started are marked with ErrBatchAborted.
+// Otherwise a failure of one reference does not affect the others.
+func ForEachReference(ctx context.Context, refnames []string, concurrency int, failFast bool, fn func(ctx context.Context, refname string) error) []BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]BatchResult, len(refnames))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if failFast && ctx.Err() != nil {
+					results[job].Err = ErrBatchAborted
+					continue
+				}
+				results[job].Err = fn(ctx, refnames[job])
+				if results[job].Err != nil && failFast {
+					cancel()
+				}
+			}
+		}()
+	}
+	for job, refname := range refnames {
+		results[job].Reference = refname
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// VerifyReference checks the integrity of every blob reachable from the given
+// reference, by reading each blob in full and comparing it against the digest
+// and size of the descriptor referencing it. Blobs referenced more than once
+// are only checked once.
+func VerifyReference(ctx context.Context, engineExt casext.Engine, refname string) error {
+	descriptorPaths, err := engineExt.ResolveReference(ctx, refname)
+	if err != nil {
+		return fmt.Errorf("get descriptor: %w", err)
+	}
+	if len(descriptorPaths) == 0 {
+		return fmt.Errorf("tag not found: %s", refname)
+	}
+
+	seen := map[digest.Digest]struct{}{}
+	for _, descriptorPath := range descriptorPaths {
+		if err := engineExt.Walk(ctx, descriptorPath.Root(), func(descriptorPath casext.DescriptorPath) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := seen[descriptor.Digest]; ok {
+				return casext.ErrSkipDescriptor
+			}
+			seen[descriptor.Digest] = struct{}{}
+
+			blob, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+			if err != nil {
+				return fmt.Errorf("get blob %s: %w", descriptor.Digest, err)
+			}
+			_, err = io.Copy(ioutil.Discard, blob)
+			if closeErr := blob.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("verify blob %s: %w", descriptor.Digest, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/pkg/hardening"
+)
+
+func TestVerifyReferences(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestVerifyReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	engineExt, err := CreateLayout(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	// Create a few images, each with a unique layer.
+	tags := []string{"a", "b", "c", "d"}
+	for _, tag := range tags {
+		if err := NewImage(engineExt, tag); err != nil {
+			t.Fatal(err)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(ctx, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 {
+			t.Fatalf("unexpected number of descriptors for tag: %d", len(descriptorPaths))
+		}
+		mutator, err := mutate.New(engineExt, descriptorPaths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: tag, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(tag))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(tag)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(ctx, ispec.MediaTypeImageLayer, &buf, &ispec.History{CreatedBy: "test"}, mutate.GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		newDescriptorPath, err := mutator.Commit(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error committing changes: %+v", err)
+		}
+		if err := engineExt.UpdateReference(ctx, tag, newDescriptorPath.Root()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verify := func(ctx context.Context, refname string) error {
+		return VerifyReference(ctx, engineExt, refname)
+	}
+
+	// All of the images should be fine.
+	for _, result := range ForEachReference(ctx, tags, 3, false, verify) {
+		if result.Err != nil {
+			t.Errorf("unexpected error verifying %s: %+v", result.Reference, result.Err)
+		}
+	}
+
+	// Corrupt the layer of "b" (keeping the size the same).
+	manifest, _ := imageManifestConfig(t, engineExt, "b")
+	layerPath := filepath.Join(image, "blobs", manifest.Layers[0].Digest.Algorithm().String(), manifest.Layers[0].Digest.Encoded())
+	data, err := ioutil.ReadFile(layerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.Chmod(layerPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(layerPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without failFast, only "b" should fail.
+	results := ForEachReference(ctx, tags, 2, false, verify)
+	if len(results) != len(tags) {
+		t.Fatalf("unexpected number of results: expected %d got %d", len(tags), len(results))
+	}
+	for idx, result := range results {
+		if result.Reference != tags[idx] {
+			t.Errorf("results out of order: expected %s got %s", tags[idx], result.Reference)
+		}
+		if result.Reference == "b" {
+			if !errors.Is(result.Err, hardening.ErrDigestMismatch) {
+				t.Errorf("expected digest mismatch verifying %s, got %v", result.Reference, result.Err)
+			}
+		} else if result.Err != nil {
+			t.Errorf("unexpected error verifying %s: %+v", result.Reference, result.Err)
+		}
+	}
+
+	// With failFast (and no concurrency), everything after "b" is aborted.
+	results = ForEachReference(ctx, tags, 1, true, verify)
+	for _, result := range results {
+		switch result.Reference {
+		case "a":
+			if result.Err != nil {
+				t.Errorf("unexpected error verifying %s: %+v", result.Reference, result.Err)
+			}
+		case "b":
+			if !errors.Is(result.Err, hardening.ErrDigestMismatch) {
+				t.Errorf("expected digest mismatch verifying %s, got %v", result.Reference, result.Err)
+			}
+		default:
+			if !errors.Is(result.Err, ErrBatchAborted) {
+				t.Errorf("expected %s to be aborted, got %v", result.Reference, result.Err)
+			}
+		}
+	}
+
+	// Missing tags are reported as failures.
+	if err := VerifyReference(ctx, engineExt, "missing"); err == nil {
+		t.Errorf("expected error verifying missing tag")
+	}
+}